@@ -0,0 +1,164 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Annotator adds information to ASN lookup results,
+// such as a reputation score from an abuse list.
+// (See WithAnnotator.)
+type Annotator interface {
+	// Annotate updates info, typically its Score and Tags.
+	Annotate(ctx context.Context, info *AsnInfo) error
+}
+
+// AnnotatorConfig tells how to run an Annotator.
+type AnnotatorConfig struct {
+	// Bound of each Annotate call, zero for none
+	Timeout time.Duration
+	// Whether Annotate failures fail the lookup,
+	// instead of being logged
+	Required bool
+	// Whether Annotate runs on every lookup, cache hits included,
+	// instead of once before caching (annotations are then not cached)
+	EveryHit bool
+}
+
+// annotator is an Annotator registered with WithAnnotator.
+type annotator struct {
+	Annotator
+	AnnotatorConfig
+}
+
+// WithAnnotator makes LookupAsn, LookupIpInfo and LookupPrefixASN
+// annotate their results with a given Annotator.
+// Annotators run in the order they are registered,
+// and their annotations are cached with the results,
+// so that they do not run on cache hits, unless cfg.EveryHit is set.
+//
+// Results failing a required annotator are not cached.
+func WithAnnotator(a Annotator, cfg AnnotatorConfig) Option {
+	return func(h *Handler) error {
+		if a == nil {
+			return fmt.Errorf("nil annotator")
+		}
+		if cfg.Timeout < 0 {
+			return fmt.Errorf("negative annotator timeout")
+		}
+		h.annotators = append(h.annotators, annotator{a, cfg})
+		return nil
+	}
+}
+
+// annotate runs on a lookup result
+// the annotators whose annotations are cached,
+// or those run on every hit.
+func (h Handler) annotate(ctx context.Context, info *AsnInfo, everyHit bool) error {
+	if len(h.annotators) == 0 {
+		return nil
+	}
+	// Leave cached tags alone
+	info.Tags = slices.Clone(info.Tags)
+	// Annotators see anonymized prefixes only (see WithAnonymization)
+	if prefix := info.Prefix; h.anonymize != nil {
+		info.Prefix = h.anonymizePrefix(prefix)
+		defer func() { info.Prefix = prefix }()
+	}
+	for _, a := range h.annotators {
+		if a.EveryHit != everyHit {
+			continue
+		}
+		if err := a.run(ctx, info); err != nil {
+			if err := ctxErr(ctx); err != nil {
+				return err
+			}
+			if a.Required {
+				return fmt.Errorf("annotator failed for asn '%s': %w", info.Asn, err)
+			}
+			h.logf("warning: annotator failed for asn '%s': %s\n", info.Asn, err)
+		}
+	}
+	return nil
+}
+
+// annotateEntry runs the annotators on a cache entry.
+//
+// Returns the annotated cache entry.
+func (h Handler) annotateEntry(ctx context.Context, entry cacheEntry, everyHit bool) (cacheEntry, error) {
+	if len(h.annotators) == 0 {
+		return entry, nil
+	}
+	info := AsnInfo{
+		Asn:         entry.asn,
+		Descr:       entry.descr,
+		Registry:    entry.registry,
+		AllocatedAt: entry.allocated,
+		Score:       entry.score,
+		Tags:        entry.tags,
+	}
+	if err := h.annotate(ctx, &info, everyHit); err != nil {
+		return cacheEntry{}, err
+	}
+	entry.asn, entry.descr = info.Asn, info.Descr
+	entry.registry, entry.allocated = info.Registry, info.AllocatedAt
+	entry.score, entry.tags = info.Score, info.Tags
+	return entry, nil
+}
+
+// run calls Annotate, bounded by the annotator timeout.
+func (a annotator) run(ctx context.Context, info *AsnInfo) error {
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+	return a.Annotate(ctx, info)
+}
+
+// Reputation is what MapAnnotator knows about an ASN.
+type Reputation struct {
+	Score int
+	Tags  []string
+}
+
+// MapAnnotator is an Annotator
+// setting the score and adding the tags of ASNs from a map.
+// ASNs missing from the map are left alone.
+type MapAnnotator map[string]Reputation
+
+// Annotate sets the score and adds the tags of info.Asn.
+func (m MapAnnotator) Annotate(ctx context.Context, info *AsnInfo) error {
+	if r, ok := m[info.Asn]; ok {
+		info.Score = r.Score
+		info.Tags = append(info.Tags, r.Tags...)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testAnnotator counts its calls, failing or blocking on demand.
+type testAnnotator struct {
+	calls int32
+	err   error
+	block bool
+}
+
+func (a *testAnnotator) Annotate(ctx context.Context, info *AsnInfo) error {
+	atomic.AddInt32(&a.calls, 1)
+	if a.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if a.err != nil {
+		return a.err
+	}
+	info.Tags = append(info.Tags, "seen")
+	return nil
+}
+
+func TestAnnotator(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	reputations := MapAnnotator{
+		"AS13335": {Score: 80, Tags: []string{"abuse"}},
+	}
+	once, every := &testAnnotator{}, &testAnnotator{}
+	h := NewFixtureHandler()
+	for _, opt := range []Option{
+		WithAnnotator(reputations, AnnotatorConfig{}),
+		WithAnnotator(once, AnnotatorConfig{}),
+		WithAnnotator(every, AnnotatorConfig{EveryHit: true}),
+	} {
+		if err := opt(&h); err != nil {
+			t.Fatalf("WithAnnotator failed: %s", err)
+		}
+	}
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		info, err := h.LookupIpInfo(ctx, "1.1.1.1")
+		if err != nil {
+			t.Fatalf("LookupIpInfo failed: %s", err)
+		}
+		// Per hit tags are not cached
+		expected := []string{"abuse", "seen", "seen"}
+		if info.Score != 80 || !reflect.DeepEqual(info.Tags, expected) {
+			t.Fatalf("lookup %d: unexpected annotations %d, %v", i, info.Score, info.Tags)
+		}
+		if atomic.LoadInt32(&once.calls) != 1 || atomic.LoadInt32(&every.calls) != int32(i) {
+			t.Fatalf("lookup %d: unexpected annotator calls %d, %d", i, once.calls, every.calls)
+		}
+	}
+	info, err := h.LookupIpInfo(ctx, "8.8.8.8")
+	if err != nil || info.Score != 0 || !reflect.DeepEqual(info.Tags, []string{"seen", "seen"}) {
+		t.Fatalf("unexpected LookupIpInfo answer: %+v, %v", info, err)
+	}
+	if err := WithAnnotator(nil, AnnotatorConfig{})(&h); err == nil {
+		t.Fatalf("expected an error for a nil annotator")
+	}
+}
+
+func TestAnnotatorFailure(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	failure := errors.New("list unavailable")
+	for _, required := range []bool{false, true} {
+		failing := &testAnnotator{err: failure}
+		slow := &testAnnotator{block: true}
+		h := NewFixtureHandler()
+		WithAnnotator(failing, AnnotatorConfig{Required: required})(&h)
+		WithAnnotator(slow, AnnotatorConfig{Timeout: time.Millisecond})(&h)
+		for i := 0; i < 2; i++ {
+			asn, _, err := h.LookupAsn("9.9.9.9")
+			if required && (err == nil || asn != "") {
+				t.Fatalf("required annotator failure did not fail the lookup: %q, %v", asn, err)
+			}
+			if !required && (err != nil || asn != "AS19281") {
+				t.Fatalf("optional annotator failure failed the lookup: %q, %v", asn, err)
+			}
+		}
+		// Failed lookups are not cached
+		calls := int32(1)
+		if required {
+			calls = 2
+		}
+		if atomic.LoadInt32(&failing.calls) != calls {
+			t.Fatalf("required %v: annotator called %d times", required, failing.calls)
+		}
+		if !required && atomic.LoadInt32(&slow.calls) != 1 {
+			t.Fatalf("slow annotator called %d times", slow.calls)
+		}
+	}
+	// Lookup cancelation is not an annotator failure
+	h := NewFixtureHandler()
+	WithAnnotator(&testAnnotator{block: true}, AnnotatorConfig{})(&h)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, _, err := h.LookupAsnCtx(ctx, "9.9.9.9"); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error of canceled lookup: %v", err)
+	}
+}
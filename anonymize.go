@@ -0,0 +1,113 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// Default prefix lengths IP addresses are truncated to
+// by WithAnonymization.
+const (
+	anonymizeV4Bits = 24
+	anonymizeV6Bits = 48
+)
+
+// WithAnonymization makes the handler truncate client IP addresses
+// to prefixes of v4bits (IPv4) or v6bits (IPv6)
+// wherever it keeps them past a lookup:
+// ASN cache keys (and so LookupIp answers and revalidations),
+// hot keys (see WithKeyTracking) and debug dumps,
+// and prefixes passed to annotators.
+// PTR answers, which usually name the full address, are not cached.
+// Pass zero for the default lengths (/24 and /48).
+//
+// Lookups still query external sources with the full address,
+// but addresses within the same prefix share their ASN cache entry,
+// which suits ASN attribution since routes are rarely longer.
+//
+// Log messages and errors are not covered (see WithRedactIPs).
+func WithAnonymization(v4bits int, v6bits int) Option {
+	return func(h *Handler) error {
+		if v4bits == 0 {
+			v4bits = anonymizeV4Bits
+		}
+		if v6bits == 0 {
+			v6bits = anonymizeV6Bits
+		}
+		if v4bits < 0 || v4bits > 32 || v6bits < 0 || v6bits > 128 {
+			return fmt.Errorf("invalid anonymization prefix lengths /%d and /%d", v4bits, v6bits)
+		}
+		h.anonymize = &anonymization{v4bits, v6bits}
+		return nil
+	}
+}
+
+// anonymization is the anonymization configuration.
+type anonymization struct {
+	v4bits int
+	v6bits int
+}
+
+// anonymizeIP truncates an IP address if the handler anonymizes them.
+//
+// Returns the truncated address, or ip itself if not valid.
+func (h Handler) anonymizeIP(ip string) string {
+	if h.anonymize == nil {
+		return ip
+	}
+	addr, _ := iputils.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	return iputils.TruncateToPrefix(addr, h.anonymize.v4bits, h.anonymize.v6bits).String()
+}
+
+// anonymizeAddr truncates an address if the handler anonymizes them.
+func (h Handler) anonymizeAddr(addr netip.Addr) netip.Addr {
+	return h.anonymizePrefix(netip.PrefixFrom(addr, addr.BitLen())).Addr()
+}
+
+// anonymizePrefix shortens a prefix to the anonymization prefix length
+// of its family, if the handler anonymizes IP addresses.
+func (h Handler) anonymizePrefix(p netip.Prefix) netip.Prefix {
+	if h.anonymize == nil || !p.IsValid() {
+		return p
+	}
+	bits := h.anonymize.v6bits
+	if p.Addr().Unmap().Is4() {
+		p = canonicalPrefix(p)
+		bits = h.anonymize.v4bits
+	}
+	if p.Bits() <= bits {
+		return p
+	}
+	p, _ = p.Addr().Prefix(bits)
+	return p
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// prefixRecorder is an Annotator recording the prefixes it sees.
+type prefixRecorder struct {
+	prefixes []netip.Prefix
+}
+
+func (r *prefixRecorder) Annotate(ctx context.Context, info *AsnInfo) error {
+	r.prefixes = append(r.prefixes, info.Prefix)
+	return nil
+}
+
+func TestTruncateToPrefix(t *testing.T) {
+	tests := []struct {
+		ip     string
+		v4, v6 int
+		want   string
+	}{
+		{"192.0.2.201", 24, 48, "192.0.2.0"},
+		{"192.0.2.201", 20, 48, "192.0.0.0"},
+		{"192.0.2.201", 40, 48, "192.0.2.201"},
+		{"::ffff:192.0.2.201", 24, 48, "192.0.2.0"},
+		{"2001:db8:1234:5678::1", 24, 48, "2001:db8:1234::"},
+		{"2001:db8:1234:5678::1", 24, 0, "::"},
+	}
+	for _, test := range tests {
+		if got := iputils.TruncateToPrefix(net.ParseIP(test.ip), test.v4, test.v6); got.String() != test.want {
+			t.Fatalf("TruncateToPrefix(%s, %d, %d) returned %s", test.ip, test.v4, test.v6, got)
+		}
+	}
+	if got := iputils.TruncateToPrefix(nil, 24, 48); got != nil {
+		t.Fatalf("TruncateToPrefix(nil) returned %s", got)
+	}
+}
+
+func TestAnonymization(t *testing.T) {
+	ips := []string{"8.8.8.8", "2001:4860:4860::8888"}
+	zone := testDNSZone{
+		"8.8.8.8.in-addr.arpa.": {`8.8.8.8.in-addr.arpa. 3600 IN PTR dns.google.`},
+	}
+	for name, records := range testCymruZone {
+		zone[name] = records
+	}
+	h := NewFixtureHandler()
+	h.resolver.server = startTestDNS(t, zone.serve)
+	recorder := &prefixRecorder{}
+	for _, opt := range []Option{
+		WithAnonymization(0, 0),
+		WithKeyTracking(),
+		WithAnnotator(recorder, AnnotatorConfig{}),
+	} {
+		if err := opt(&h); err != nil {
+			t.Fatalf("option failed: %s", err)
+		}
+	}
+	for _, ip := range ips {
+		if _, _, err := h.LookupAsnCtx(context.Background(), ip); err != nil {
+			t.Fatalf("LookupAsnCtx(%s) failed: %s", ip, err)
+		}
+	}
+	// The lookups use full addresses
+	if name, err := h.LookupPTR(context.Background(), "8.8.8.8"); name != "dns.google" || err != nil {
+		t.Fatalf("LookupPTR returned '%s', %v", name, err)
+	}
+	if _, err := h.LookupPrefixASN(context.Background(), netip.MustParsePrefix("8.8.8.0/24")); err != nil {
+		t.Fatalf("LookupPrefixASN failed: %s", err)
+	}
+	for p, want := range map[string]string{
+		"8.8.8.8/32":               "8.8.8.0/24",
+		"8.8.0.0/16":               "8.8.0.0/16",
+		"::ffff:8.8.8.8/128":       "8.8.8.0/24",
+		"2001:4860:4860::8888/128": "2001:4860:4860::/48",
+	} {
+		if got := h.anonymizePrefix(netip.MustParsePrefix(p)); got.String() != want {
+			t.Fatalf("anonymizePrefix(%s) returned %s", p, got)
+		}
+	}
+	// Other addresses of the same prefix share the cache entry
+	if _, _, found := h.cache.lookupByIP("8.8.8.0"); !found {
+		t.Fatalf("no cache entry for 8.8.8.0")
+	}
+	// No full address survives
+	var dump bytes.Buffer
+	if err := h.DebugDump(&dump); err != nil {
+		t.Fatalf("DebugDump failed: %s", err)
+	}
+	artifacts := []string{
+		fmt.Sprint(h.cache.keys()),
+		fmt.Sprint(h.LookupIp("AS15169")),
+		fmt.Sprint(h.TopKeys(10)),
+		fmt.Sprint(recorder.prefixes),
+		fmt.Sprint(h.ptrs.entries),
+		dump.String(),
+	}
+	for _, artifact := range artifacts {
+		for _, leak := range []string{"8.8.8.8", "4860::8888", "dns.google"} {
+			if strings.Contains(artifact, leak) {
+				t.Fatalf("'%s' found in %s", leak, artifact)
+			}
+		}
+	}
+	if keys := fmt.Sprint(h.cache.keys()); !strings.Contains(keys, "8.8.8.0") || !strings.Contains(keys, "2001:4860:4860::") {
+		t.Fatalf("unexpected cache keys %s", keys)
+	}
+	if err := WithAnonymization(33, 0)(&h); err == nil {
+		t.Fatalf("expected an error for an invalid prefix length")
+	}
+}
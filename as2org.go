@@ -0,0 +1,339 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// as2orgCheckInterval is how often LookupOrg checks
+// whether the as2org dataset file was replaced.
+var as2orgCheckInterval = time.Minute
+
+// OrgInfo is the organization an ASN belongs to,
+// according to CAIDA's AS to Organization dataset.
+type OrgInfo struct {
+	Asn     string `json:"asn"`
+	AsnName string `json:"asn_name"`
+	OrgID   string `json:"org_id"`
+	OrgName string `json:"org_name"`
+	Country string `json:"country"`
+	Source  string `json:"source"`
+}
+
+// As2OrgNilDatasetError is returned by LookupOrg
+// when Handler was created without an as2org dataset
+// (see WithAs2Org).
+var As2OrgNilDatasetError = errors.New("nil as2org dataset")
+
+// OrgNotFoundError is returned by LookupOrg
+// when the as2org dataset has no record for an ASN.
+var OrgNotFoundError = newClassError("organization not found", NotFoundError)
+
+// WithAs2Org loads CAIDA's AS to Organization dataset
+// (http://www.caida.org/data/as-organizations/)
+// for use by LookupOrg.
+//
+// Parameter path is either a dataset file,
+// in the pipe separated or jsonl release format, optionally gzipped,
+// or a directory where quarterly releases are dropped,
+// in which case the most recent *as-org2info* file is used.
+// The dataset is reloaded whenever the file is replaced.
+func WithAs2Org(path string) Option {
+	return func(h *Handler) error {
+		a := &as2org{path: path, runs: h.runs}
+		if err := a.reload(); err != nil {
+			return err
+		}
+		h.as2org = a
+		return nil
+	}
+}
+
+// LookupOrg searches the as2org dataset (see WithAs2Org)
+// for the organization owning a given ASN.
+//
+// Returns the organization,
+// or OrgNotFoundError if the ASN is unknown to the dataset.
+func (h Handler) LookupOrg(ctx context.Context, asn string) (OrgInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return OrgInfo{}, err
+	}
+	if h.as2org == nil {
+		return OrgInfo{}, As2OrgNilDatasetError
+	}
+	return h.as2org.lookup(asn)
+}
+
+// as2org holds a loaded as2org dataset
+// and keeps track of the file it came from.
+type as2org struct {
+	// Dataset file or directory
+	path string
+	// Group running background reloads
+	runs *runGroup
+	// Concurrent access control to fields below
+	sync.RWMutex
+	// ASN number (without "AS" prefix) to organization
+	orgs map[string]OrgInfo
+	// File currently loaded, and its modification time
+	file    string
+	modTime time.Time
+	// Last time path was checked for a new file
+	checked time.Time
+	// Whether a reload is in progress
+	reloading bool
+}
+
+// lookup retrieves the organization of a given ASN,
+// scheduling a dataset reload if due.
+func (a *as2org) lookup(asn string) (OrgInfo, error) {
+	a.maybeReload()
+	a.RLock()
+	defer a.RUnlock()
+	org, ok := a.orgs[strings.TrimPrefix(strings.ToUpper(asn), "AS")]
+	if !ok {
+		return OrgInfo{}, OrgNotFoundError
+	}
+	return org, nil
+}
+
+// maybeReload reloads the dataset in the background
+// if as2orgCheckInterval has elapsed since the last check,
+// unless the run group is closed.
+// Lookups keep using the current dataset meanwhile.
+func (a *as2org) maybeReload() {
+	a.Lock()
+	if a.reloading || time.Since(a.checked) < as2orgCheckInterval {
+		a.Unlock()
+		return
+	}
+	a.reloading = true
+	a.Unlock()
+	err := a.runs.run(func(context.Context) {
+		if err := a.reload(); err != nil {
+			log.Printf("warning: as2org reload failed: %s\n", err)
+		}
+		a.Lock()
+		a.reloading = false
+		a.Unlock()
+	})
+	if err != nil {
+		a.Lock()
+		a.reloading = false
+		a.Unlock()
+	}
+}
+
+// reload loads the dataset file, unless it was already loaded.
+// On failure, the current dataset is kept.
+func (a *as2org) reload() error {
+	a.Lock()
+	a.checked = time.Now()
+	a.Unlock()
+	file, err := as2orgFile(a.path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("cannot stat as2org dataset: %w", err)
+	}
+	a.RLock()
+	loaded := file == a.file && fi.ModTime().Equal(a.modTime)
+	a.RUnlock()
+	if loaded {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("cannot open as2org dataset: %w", err)
+	}
+	defer f.Close()
+	orgs, err := parseAs2Org(f)
+	if err != nil {
+		return fmt.Errorf("cannot parse as2org dataset '%s': %w", file, err)
+	}
+	a.Lock()
+	a.orgs = orgs
+	a.file = file
+	a.modTime = fi.ModTime()
+	a.Unlock()
+	log.Printf("(geoipdb) loaded %d as2org records from %s\n", len(orgs), file)
+	return nil
+}
+
+// as2orgFile resolves the dataset file to load from a given path.
+//
+// CAIDA names releases after their date (20240101.as-org2info.jsonl.gz),
+// so the most recent release in a directory sorts last.
+func as2orgFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot stat as2org dataset: %w", err)
+	}
+	if !fi.IsDir() {
+		return path, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read as2org directory: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.Contains(e.Name(), "as-org2info") {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no as2org dataset found in '%s'", path)
+	}
+	sort.Strings(names)
+	return filepath.Join(path, names[len(names)-1]), nil
+}
+
+// as2orgRecord is a record of the jsonl release format,
+// holding either an ASN (type "ASN") or an organization (type "Organization").
+type as2orgRecord struct {
+	Type    string          `json:"type"`
+	Asn     json.RawMessage `json:"asn"`
+	Name    string          `json:"name"`
+	OrgID   string          `json:"organizationId"`
+	Country string          `json:"country"`
+	Source  string          `json:"source"`
+}
+
+// Column layouts of the pipe separated release format,
+// used when a section lacks a "# format:" header line.
+var (
+	as2orgAutFormat = []string{"aut", "changed", "aut_name", "org_id", "opaque_id", "source"}
+	as2orgOrgFormat = []string{"org_id", "changed", "org_name", "country", "source"}
+)
+
+// parseAs2Org parses an as2org dataset,
+// in either the pipe separated or the jsonl release format,
+// optionally gzipped.
+//
+// The pipe separated format has an organization section
+// and an ASN section, each introduced by comment lines,
+// one of them being a "# format:" line naming the columns.
+//
+// Returns a map of ASN number (without "AS" prefix) to organization.
+func parseAs2Org(r io.Reader) (map[string]OrgInfo, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	auts := make(map[string]OrgInfo)
+	orgs := make(map[string]OrgInfo)
+	var format []string
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			comment := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			if strings.HasPrefix(comment, "format:") {
+				format = strings.Split(strings.TrimSpace(strings.TrimPrefix(comment, "format:")), "|")
+			}
+		case strings.HasPrefix(line, "{"):
+			var rec as2orgRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			switch rec.Type {
+			case "ASN":
+				asn := strings.Trim(string(rec.Asn), `"`)
+				if asn == "" {
+					return nil, fmt.Errorf("line %d: missing asn", n)
+				}
+				auts[asn] = OrgInfo{Asn: "AS" + asn, AsnName: rec.Name, OrgID: rec.OrgID, Source: rec.Source}
+			case "Organization":
+				orgs[rec.OrgID] = OrgInfo{OrgID: rec.OrgID, OrgName: rec.Name, Country: rec.Country, Source: rec.Source}
+			}
+		default:
+			fields := strings.Split(line, "|")
+			cols := format
+			if len(cols) != len(fields) {
+				switch len(fields) {
+				case len(as2orgAutFormat):
+					cols = as2orgAutFormat
+				case len(as2orgOrgFormat):
+					cols = as2orgOrgFormat
+				default:
+					return nil, fmt.Errorf("line %d: unexpected number of fields: %d", n, len(fields))
+				}
+			}
+			rec := make(map[string]string, len(cols))
+			for i, col := range cols {
+				rec[col] = strings.TrimSpace(fields[i])
+			}
+			if asn, ok := rec["aut"]; ok {
+				auts[asn] = OrgInfo{Asn: "AS" + asn, AsnName: rec["aut_name"], OrgID: rec["org_id"], Source: rec["source"]}
+			} else {
+				orgs[rec["org_id"]] = OrgInfo{OrgID: rec["org_id"], OrgName: rec["org_name"], Country: rec["country"], Source: rec["source"]}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(auts) == 0 {
+		return nil, errors.New("no ASN records found")
+	}
+	// Join ASNs with their organizations
+	for asn, aut := range auts {
+		org := orgs[aut.OrgID]
+		aut.OrgName = org.OrgName
+		aut.Country = org.Country
+		auts[asn] = aut
+	}
+	return auts, nil
+}
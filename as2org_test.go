@@ -0,0 +1,110 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAs2OrgPipeFormat(t *testing.T) {
+	f, err := os.Open("testdata/as2org/20240101.as-org2info.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	orgs, err := parseAs2Org(f)
+	if err != nil {
+		t.Fatalf("parseAs2Org failed: %s", err)
+	}
+	if len(orgs) != 4 {
+		t.Fatalf("expected 4 ASNs, got %d", len(orgs))
+	}
+	expected := OrgInfo{Asn: "AS396982", AsnName: "GOOGLE-CLOUD-PLATFORM", OrgID: "GOGL-ARIN", OrgName: "Google LLC", Country: "US", Source: "ARIN"}
+	if orgs["396982"] != expected {
+		t.Fatalf("unexpected record for AS396982: %+v", orgs["396982"])
+	}
+	if orgs["64496"].OrgName != "" {
+		t.Fatalf("unexpected organization for AS64496: %+v", orgs["64496"])
+	}
+}
+
+func TestLookupOrg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "as2org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	copyFile(t, "testdata/as2org/20240101.as-org2info.txt", dir)
+	h := newHandler(nil, time.Second)
+	if err := WithAs2Org(dir)(&h); err != nil {
+		t.Fatalf("WithAs2Org failed: %s", err)
+	}
+	ctx := context.Background()
+	org, err := h.LookupOrg(ctx, "AS3356")
+	if err != nil {
+		t.Fatalf("LookupOrg failed: %s", err)
+	}
+	if org.OrgName != "Level 3 Parent, LLC" {
+		t.Fatalf("unexpected organization for AS3356: %+v", org)
+	}
+	// A new quarterly release is dropped in
+	copyFile(t, "testdata/as2org/20240401.as-org2info.jsonl", dir)
+	if err := h.as2org.reload(); err != nil {
+		t.Fatalf("reload failed: %s", err)
+	}
+	if _, err := h.LookupOrg(ctx, "AS3356"); err != OrgNotFoundError {
+		t.Fatalf("unexpected LookupOrg error: %v", err)
+	}
+	org, err = h.LookupOrg(ctx, "AS43515")
+	if err != nil {
+		t.Fatalf("LookupOrg failed: %s", err)
+	}
+	if org.OrgID != "GOGL-ARIN" || org.OrgName != "Google LLC" {
+		t.Fatalf("unexpected organization for AS43515: %+v", org)
+	}
+}
+
+func TestLookupOrgNilDataset(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	if _, err := h.LookupOrg(context.Background(), "AS15169"); err != As2OrgNilDatasetError {
+		t.Fatalf("unexpected LookupOrg error: %v", err)
+	}
+}
+
+func copyFile(t *testing.T, src string, dir string) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(src)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
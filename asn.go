@@ -0,0 +1,149 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParseASN parses an ASN identification:
+// in asplain notation, with or without an "AS" prefix of any case
+// ("AS15169", "as15169", "15169"),
+// or in asdot notation ("AS1.10", "1.10", that is 65546),
+// up to 32-bit ASNs (AS4294967295), surrounding spaces ignored.
+// Reserved ASNs are accepted, see IsReservedASN to flag them.
+//
+// Returns the ASN number, or MalformedAsnError.
+func ParseASN(s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	high, low, dot := strings.Cut(s, ".")
+	if !dot {
+		n, ok := parseASNDigits(s, 32)
+		if !ok {
+			return 0, MalformedAsnError
+		}
+		return uint32(n), nil
+	}
+	h, ok := parseASNDigits(high, 16)
+	if !ok {
+		return 0, MalformedAsnError
+	}
+	l, ok := parseASNDigits(low, 16)
+	if !ok {
+		return 0, MalformedAsnError
+	}
+	return uint32(h<<16 | l), nil
+}
+
+// ParseAsnOrg parses an ASN identification followed by the name
+// of its organization, as ipinfo.io organizations, libgeoip records
+// and many logs encode them ("AS15169 Google LLC").
+// The ASN is the first word, which must have an "AS" prefix of any case,
+// so that names alone are not mistaken for ASNs ("3 Ireland"),
+// and is parsed as by ParseASN, up to 32-bit ASNs.
+// The name is the rest, possibly empty or containing "AS" itself,
+// spaces between words kept.
+// Spaces around the ASN and the name are ignored.
+//
+// Returns the ASN in asplain notation ("AS15169"),
+// the name, empty if none, or MalformedAsnError.
+func ParseAsnOrg(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		i = len(s)
+	}
+	word, name := s[:i], strings.TrimSpace(s[i:])
+	if len(word) < 2 || !strings.EqualFold(word[:2], "AS") {
+		return "", "", MalformedAsnError
+	}
+	asn, err := canonicalASN(word)
+	if err != nil {
+		return "", "", err
+	}
+	return asn, name, nil
+}
+
+// parseASNDigits parses a decimal number of a given bit size,
+// made of digits only.
+func parseASNDigits(s string, bits int) (uint64, bool) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s, 10, bits)
+	return n, err == nil
+}
+
+// FormatASN formats an ASN number as an ASN identification,
+// in asplain notation ("AS15169").
+func FormatASN(n uint32) string {
+	return "AS" + strconv.FormatUint(uint64(n), 10)
+}
+
+// canonicalASN normalizes an ASN identification to asplain notation
+// (see ParseASN).
+//
+// Returns the canonical ASN identification, or MalformedAsnError.
+func canonicalASN(asn string) (string, error) {
+	n, err := ParseASN(asn)
+	if err != nil {
+		return "", err
+	}
+	return FormatASN(n), nil
+}
+
+// normalizeASN is canonicalASN,
+// answering malformed ASN identifications unchanged.
+func normalizeASN(asn string) string {
+	if canonical, err := canonicalASN(asn); err == nil {
+		return canonical
+	}
+	return asn
+}
+
+// IsReservedASN tells whether an ASN is reserved by IANA
+// rather than assignable to networks:
+// 0, AS_TRANS (23456), the ASNs for documentation
+// (64496-64511, 65536-65551), for private use
+// (64512-65534, 4200000000-4294967294), the last ones of
+// 16-bit and 32-bit ranges (65535, 4294967295),
+// and 65552-131071.
+func IsReservedASN(n uint32) bool {
+	switch {
+	case n == 0, n == 23456:
+		return true
+	case n >= 64496 && n <= 131071:
+		return true
+	case n >= 4200000000:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"testing"
+)
+
+func TestParseASN(t *testing.T) {
+	tests := []struct {
+		s  string
+		n  uint32
+		ok bool
+	}{
+		{"AS15169", 15169, true},
+		{"as15169", 15169, true},
+		{"As15169", 15169, true},
+		{"15169", 15169, true},
+		{" AS15169\n", 15169, true},
+		{"AS015169", 15169, true},
+		{"AS0", 0, true},
+		{"0", 0, true},
+		{"AS65535", 65535, true},
+		{"AS65536", 65536, true},
+		{"AS4200000000", 4200000000, true},
+		{"AS4294967295", 4294967295, true},
+		{"4294967295", 4294967295, true},
+		{"AS4294967296", 0, false},
+		{"AS18446744073709551616", 0, false},
+		// asdot
+		{"AS1.10", 65546, true},
+		{"1.10", 65546, true},
+		{"AS64.496", 64<<16 | 496, true},
+		{"AS0.15169", 15169, true},
+		{"AS0.0", 0, true},
+		{"AS65535.65535", 4294967295, true},
+		{"AS65536.0", 0, false},
+		{"AS0.65536", 0, false},
+		{"AS1.", 0, false},
+		{"AS.1", 0, false},
+		{"AS1.2.3", 0, false},
+		// Malformed
+		{"", 0, false},
+		{"AS", 0, false},
+		{"ASN15169", 0, false},
+		{"AS 15169", 0, false},
+		{"AS+15169", 0, false},
+		{"AS-1", 0, false},
+		{"15169AS", 0, false},
+		{"AS15169x", 0, false},
+		{"AS1 5169", 0, false},
+		{"AS0x10", 0, false},
+		{"S15169", 0, false},
+	}
+	for _, test := range tests {
+		n, err := ParseASN(test.s)
+		if test.ok && (err != nil || n != test.n) {
+			t.Errorf("ParseASN(%q) returned %d, %v, expected %d", test.s, n, err, test.n)
+		}
+		if !test.ok && err != MalformedAsnError {
+			t.Errorf("ParseASN(%q) returned %d, %v", test.s, n, err)
+		}
+	}
+	for _, n := range []uint32{0, 1, 65535, 65536, 4294967295} {
+		if m, err := ParseASN(FormatASN(n)); err != nil || m != n {
+			t.Errorf("ParseASN(FormatASN(%d)) returned %d, %v", n, m, err)
+		}
+	}
+}
+
+func TestParseAsnOrg(t *testing.T) {
+	tests := []struct {
+		s, asn, name string
+		ok           bool
+	}{
+		{"AS15169 Google LLC", "AS15169", "Google LLC", true},
+		{"AS15169", "AS15169", "", true},
+		{"AS15169 ", "AS15169", "", true},
+		{"  AS13335   Cloudflare, Inc.  \n", "AS13335", "Cloudflare, Inc.", true},
+		{"AS13335\tCLOUDFLARENET", "AS13335", "CLOUDFLARENET", true},
+		{"as3356 level3", "AS3356", "level3", true},
+		{"AS015169 Google", "AS15169", "Google", true},
+		// Names containing AS
+		{"AS3356 LEVEL3 AS Backbone", "AS3356", "LEVEL3 AS Backbone", true},
+		{"AS7018 AS7018 AT&T Services", "AS7018", "AS7018 AT&T Services", true},
+		{"AS9009 M247  Europe SRL", "AS9009", "M247  Europe SRL", true},
+		{"AS24940 Hetzner Online GmbH (ASN)", "AS24940", "Hetzner Online GmbH (ASN)", true},
+		// 32-bit ASNs
+		{"AS4200000000 Private", "AS4200000000", "Private", true},
+		{"AS4294967295", "AS4294967295", "", true},
+		{"AS1.10 Example", "AS65546", "Example", true},
+		{"AS4294967296 Too large", "", "", false},
+		// Missing or malformed ASN
+		{"15169 Google LLC", "", "", false},
+		{"3 Ireland", "", "", false},
+		{"Google LLC", "", "", false},
+		{"ASTRA Networks", "", "", false},
+		{"AS 15169 Google LLC", "", "", false},
+		{"ASN15169 Google LLC", "", "", false},
+		{"AS15169,Google", "", "", false},
+		{"Rate limit exceeded", "", "", false},
+		{"", "", "", false},
+		{"   ", "", "", false},
+	}
+	for _, test := range tests {
+		asn, name, err := ParseAsnOrg(test.s)
+		if test.ok && (err != nil || asn != test.asn || name != test.name) {
+			t.Errorf("ParseAsnOrg(%q) returned %q %q %v, expected %q %q", test.s, asn, name, err, test.asn, test.name)
+		}
+		if !test.ok && (err != MalformedAsnError || asn != "" || name != "") {
+			t.Errorf("ParseAsnOrg(%q) returned %q %q %v", test.s, asn, name, err)
+		}
+	}
+}
+
+func TestIsReservedASN(t *testing.T) {
+	tests := []struct {
+		n        uint32
+		reserved bool
+	}{
+		{0, true},
+		{1, false},
+		{15169, false},
+		{23455, false},
+		{23456, true},
+		{23457, false},
+		{64495, false},
+		{64496, true},
+		{64511, true},
+		{64512, true},
+		{65534, true},
+		{65535, true},
+		{65536, true},
+		{65551, true},
+		{131071, true},
+		{131072, false},
+		{4199999999, false},
+		{4200000000, true},
+		{4294967294, true},
+		{4294967295, true},
+	}
+	for _, test := range tests {
+		if reserved := IsReservedASN(test.n); reserved != test.reserved {
+			t.Errorf("IsReservedASN(%d) returned %v", test.n, reserved)
+		}
+	}
+}
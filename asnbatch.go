@@ -0,0 +1,350 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/geoipdb/internal/fixtures"
+)
+
+// asnBatchConcurrency is the default concurrency of LookupAsnBatch.
+const asnBatchConcurrency = 10
+
+// LookupAsnDescr searches for the description of a given ASN:
+// its override if any (see NewHandler),
+// what LookupAsn cached for it,
+// or Team Cymru's description.
+// ASNs of any notation are accepted (see ParseASN).
+//
+// Descriptions found are cached,
+// with Team Cymru's TTL when enabled (see WithCymruTTL),
+// failures briefly (see WithNegativeTTL),
+// and purged along with the LookupAsn cache of the ASN.
+// Concurrent lookups of an uncached ASN share the outcome of the first.
+//
+// Returns the ASN description.
+func (h Handler) LookupAsnDescr(ctx context.Context, asn string) (string, error) {
+	asn, err := canonicalASN(asn)
+	if err != nil {
+		return "", err
+	}
+	if descr, ok, err := h.cachedAsnDescr(asn); ok {
+		return descr, h.redactError(err)
+	}
+	return h.resolveAsnDescr(ctx, asn)
+}
+
+// LookupAsnFresh is LookupAsnDescr, ignoring cached descriptions:
+// the description is searched again, and cached in place of the previous one.
+// It helps with descriptions suspected to be stale.
+//
+// Returns the ASN description.
+func (h Handler) LookupAsnFresh(asn string) (string, error) {
+	asn, err := canonicalASN(asn)
+	if err != nil {
+		return "", err
+	}
+	return h.resolveAsnDescrUncached(context.Background(), asn)
+}
+
+// LookupAsnCached is LookupAsnDescr, answering only what is known already:
+// the override of the ASN if any (see NewHandler),
+// or else its cached description.
+// Other sources are never consulted, and nothing is cached.
+//
+// Returns the ASN description, and whether it is known.
+func (h Handler) LookupAsnCached(asn string) (string, bool) {
+	asn, err := canonicalASN(asn)
+	if err != nil {
+		return "", false
+	}
+	if descr, err := h.OverridesLookupCtx(context.Background(), asn); err == nil {
+		return descr, true
+	}
+	descr, ok, err := h.cachedAsnDescr(asn)
+	return descr, ok && err == nil
+}
+
+// cachedAsnDescr retrieves the cached description of an ASN.
+//
+// Returns the description, whether it was found,
+// and the error of a cached failure.
+func (h Handler) cachedAsnDescr(asn string) (string, bool, error) {
+	if entry, found := h.cache.lookupASNEntry(asn); found && entry.descr != "" && h.cache.now().Before(entry.due) {
+		return entry.descr, true, nil
+	}
+	return h.names.lookup(asn)
+}
+
+// resolveAsnDescr searches the overrides, then the fixtures or Team Cymru,
+// for the description of an ASN, and caches it.
+// Concurrent searches of asn share the outcome of the first.
+func (h Handler) resolveAsnDescr(ctx context.Context, asn string) (string, error) {
+	descr, err, _ := h.flights.asns.do(ctx, asnFlightKey{h.tenant, asn}, func(ctx context.Context) (string, error) {
+		return h.resolveAsnDescrUncached(ctx, asn)
+	})
+	return descr, err
+}
+
+// resolveAsnDescrUncached is resolveAsnDescr, without coalescing.
+func (h Handler) resolveAsnDescrUncached(ctx context.Context, asn string) (string, error) {
+	descr, err := h.OverridesLookupCtx(ctx, asn)
+	if err == nil {
+		h.names.store(asn, descr, SourceOverrides, h.cache.defaultTTL())
+		return descr, nil
+	}
+	if cerr := ctxErr(ctx); cerr != nil {
+		return "", cerr
+	}
+	// Descriptions missing an override are not cached
+	cacheable := errors.Is(err, OverridesAsnNotFoundError) || err == OverridesNilCollectionError
+	ttl := h.cache.defaultTTL()
+	source := SourceFixtures
+	if h.fixtures != nil {
+		descr, err = lookupFixtureDescr(asn)
+	} else {
+		descr, source, ttl, err = h.describeAsnBySources(ctx, asn)
+	}
+	if err != nil {
+		if cerr := ctxErr(ctx); cerr != nil {
+			return "", cerr
+		}
+		err = fmt.Errorf("cannot find description of %s: %w", asn, err)
+		if cacheable && h.negativeTTL > 0 {
+			h.names.storeErr(asn, err, h.negativeTTL)
+		}
+		return "", h.redactError(err)
+	}
+	if cacheable {
+		h.names.store(asn, descr, source, ttl)
+	}
+	return descr, nil
+}
+
+// describeAsnBySources asks the sources describing ASNs, in order,
+// for the description of asn (see WithAsnSources).
+//
+// Returns the first description found, the name of its source,
+// and the TTL to cache it for.
+func (h Handler) describeAsnBySources(ctx context.Context, asn string) (string, string, time.Duration, error) {
+	err := fmt.Errorf("no source describes ASNs")
+	sources, names := h.asnSourceList()
+	for i, s := range sources {
+		if byIP(s) {
+			continue
+		}
+		var descr string
+		var ttl time.Duration
+		descr, ttl, err = h.describeAsn(ctx, s, asn)
+		if err == nil {
+			return descr, names[i], ttl, nil
+		}
+		if cerr := ctxErr(ctx); cerr != nil {
+			return "", "", 0, cerr
+		}
+		err = fmt.Errorf("%s: %w", names[i], err)
+	}
+	return "", "", 0, err
+}
+
+// lookupFixtureDescr searches the fixture mappings
+// for the description of an ASN.
+func lookupFixtureDescr(asn string) (string, error) {
+	for _, m := range fixtures.Mappings {
+		if m.Asn == asn {
+			return m.Descr, nil
+		}
+	}
+	return "", fmt.Errorf("%w '%s'", AsnNotFoundError, asn)
+}
+
+// LookupAsnBatch searches for the descriptions of many ASNs,
+// as LookupAsnDescr does,
+// resolving up to concurrency of them at once.
+// Pass zero concurrency for the default (10).
+//
+// ASNs are answered in asplain notation (see ParseASN),
+// and duplicate ASNs are looked up once,
+// and cached descriptions are answered without waiting for others.
+// ASNs not looked up before ctx expires fail with its error.
+//
+// Returns a map of ASN to description,
+// and a map of ASN to error for the ASNs whose lookup failed.
+func (h Handler) LookupAsnBatch(ctx context.Context, asns []string, concurrency int) (map[string]string, map[string]error) {
+	if concurrency <= 0 {
+		concurrency = asnBatchConcurrency
+	}
+	answer := make(map[string]string)
+	errs := make(map[string]error)
+	// Serve cache hits, and deduplicate misses
+	var misses []string
+	for _, asn := range asns {
+		canonical, err := canonicalASN(asn)
+		if err != nil {
+			errs[asn] = err
+			continue
+		}
+		asn = canonical
+		if _, ok := answer[asn]; ok {
+			continue
+		}
+		if _, ok := errs[asn]; ok {
+			continue
+		}
+		if descr, ok, err := h.cachedAsnDescr(asn); ok {
+			if err != nil {
+				errs[asn] = h.redactError(err)
+			} else {
+				answer[asn] = descr
+			}
+			continue
+		}
+		// Marks asn as seen until resolved
+		errs[asn] = nil
+		misses = append(misses, asn)
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	todo := make(chan string)
+	for i := 0; i < min(concurrency, len(misses)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for asn := range todo {
+				descr, err := h.resolveAsnDescr(ctx, asn)
+				mu.Lock()
+				if err == nil {
+					answer[asn] = descr
+					delete(errs, asn)
+				} else {
+					errs[asn] = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, asn := range misses {
+		select {
+		case todo <- asn:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+	for asn, err := range errs {
+		if err == nil {
+			errs[asn] = ctxErr(ctx)
+		}
+	}
+	return answer, errs
+}
+
+// asnNameEntry is a cached ASN description.
+type asnNameEntry struct {
+	descr string
+	// Source of the description
+	source string
+	// Error of negative entries
+	err error
+	// Due date of this entry
+	due time.Time
+}
+
+// asnNameCache caches ASN descriptions found by LookupAsnDescr.
+type asnNameCache struct {
+	// Concurrent access control to map
+	*sync.RWMutex
+	entries map[string]asnNameEntry
+}
+
+// newAsnNameCache returns an empty initialized asnNameCache.
+func newAsnNameCache() asnNameCache {
+	return asnNameCache{
+		&sync.RWMutex{},
+		make(map[string]asnNameEntry),
+	}
+}
+
+// store caches the description of an ASN, found by a given source.
+func (c asnNameCache) store(asn string, descr string, source string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[asn] = asnNameEntry{descr: descr, source: source, due: time.Now().Add(ttl)}
+}
+
+// storeErr caches the failure to find the description of an ASN.
+func (c asnNameCache) storeErr(asn string, err error, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[asn] = asnNameEntry{err: err, due: time.Now().Add(ttl)}
+}
+
+// lookup retrieves the non expired description of an ASN.
+//
+// Returns the description, whether it was found,
+// and the error of a cached failure.
+func (c asnNameCache) lookup(asn string) (string, bool, error) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, ok := c.entries[asn]
+	if !ok || time.Now().After(entry.due) {
+		return "", false, nil
+	}
+	return entry.descr, true, entry.err
+}
+
+// purgeASN removes the description of an ASN.
+func (c asnNameCache) purgeASN(asn string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, asn)
+}
+
+// purgeSource removes the descriptions found by a given source.
+func (c asnNameCache) purgeSource(source string) {
+	c.Lock()
+	defer c.Unlock()
+	maps.DeleteFunc(c.entries, func(asn string, entry asnNameEntry) bool {
+		return entry.source == source
+	})
+}
+
+// purgeAll removes all descriptions.
+func (c asnNameCache) purgeAll() {
+	c.Lock()
+	defer c.Unlock()
+	clear(c.entries)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupAsnBatch(t *testing.T) {
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+		"AS13335.asn.cymru.com.": {`AS13335.asn.cymru.com. 7200 IN TXT "13335 | US | arin | 2010-07-14 | CLOUDFLARENET, US"`},
+		"AS3356.asn.cymru.com.":  {`AS3356.asn.cymru.com. 7200 IN TXT "3356 | US | arin | 2000-03-10 | LEVEL3, US"`},
+		"AS19281.asn.cymru.com.": {`AS19281.asn.cymru.com. 7200 IN TXT "19281 | US | arin | 2016-09-16 | QUAD9-AS-1, US"`},
+	}
+	var (
+		mu               sync.Mutex
+		queries          int
+		inFlight, maxFly int
+	)
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	h.resolver.server = startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		queries++
+		inFlight++
+		maxFly = max(maxFly, inFlight)
+		mu.Unlock()
+		time.Sleep(time.Millisecond * 50)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		zone.serve(w, req)
+	})
+	h.cache.store("192.0.2.1", cacheEntry{asn: "AS64500", descr: "CACHED"})
+	if err := h.OverridesSet("AS64501", "OVERRIDEN"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	ctx := context.Background()
+	asns := []string{"AS15169", "AS64500", "AS13335", "AS64501", "AS3356", "AS15169", "AS19281", "AS64502", "qwerty", "AS64500"}
+	answer, errs := h.LookupAsnBatch(ctx, asns, 3)
+	expected := map[string]string{
+		"AS15169": "GOOGLE, US",
+		"AS13335": "CLOUDFLARENET, US",
+		"AS3356":  "LEVEL3, US",
+		"AS19281": "QUAD9-AS-1, US",
+		"AS64500": "CACHED",
+		"AS64501": "OVERRIDEN",
+	}
+	if !reflect.DeepEqual(answer, expected) {
+		t.Fatalf("LookupAsnBatch answered %v", answer)
+	}
+	if len(errs) != 2 || errs["AS64502"] == nil || errs["qwerty"] != MalformedAsnError {
+		t.Fatalf("LookupAsnBatch failed with %v", errs)
+	}
+	// Misses are resolved concurrently, within bounds,
+	// and only once
+	stats := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries, maxFly
+	}
+	if q, m := stats(); q != 5 || m < 2 || m > 3 {
+		t.Fatalf("expected 5 queries, at most 3 at once, got %d, %d at most", q, m)
+	}
+	// Resolved descriptions are cached for single lookups
+	if descr, err := h.LookupAsnDescr(ctx, "AS3356"); err != nil || descr != "LEVEL3, US" {
+		t.Fatalf("LookupAsnDescr returned '%s', %v", descr, err)
+	}
+	if q, _ := stats(); q != 5 {
+		t.Fatalf("cached LookupAsnDescr made a query")
+	}
+	if err := h.OverridesSet("AS3356", "Lumen"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	if descr, err := h.LookupAsnDescr(ctx, "AS3356"); err != nil || descr != "Lumen" {
+		t.Fatalf("LookupAsnDescr returned '%s', %v after override", descr, err)
+	}
+	// Lookups not done before the context expires fail
+	h.AsnCachePurge()
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	answer, errs = h.LookupAsnBatch(ctx, []string{"AS15169", "AS13335"}, 0)
+	if len(answer) != 0 || errs["AS15169"] != context.Canceled || errs["AS13335"] != context.Canceled {
+		t.Fatalf("canceled LookupAsnBatch returned %v, %v", answer, errs)
+	}
+}
+
+func TestLookupAsnFreshCached(t *testing.T) {
+	source := &testAsnSource{name: "registry", descrs: map[string]string{
+		"AS64500": "EXAMPLE-NET",
+		"AS64501": "OTHER-NET",
+	}}
+	h, err := NewHandlerWithStore(NewMemoryOverrides(), time.Second, WithMMDB(testMMDB), WithAsnSources(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	// Fresh lookups replace stale descriptions
+	h.names.store("AS64500", "POISONED", "registry", time.Hour)
+	if descr, err := h.LookupAsnDescr(ctx, "AS64500"); err != nil || descr != "POISONED" {
+		t.Fatalf("LookupAsnDescr answered %q %v", descr, err)
+	}
+	if descr, err := h.LookupAsnFresh("as64500"); err != nil || descr != "EXAMPLE-NET" {
+		t.Errorf("LookupAsnFresh answered %q %v", descr, err)
+	}
+	if descr, err := h.LookupAsnDescr(ctx, "AS64500"); err != nil || descr != "EXAMPLE-NET" {
+		t.Errorf("LookupAsnDescr answered %q %v after LookupAsnFresh", descr, err)
+	}
+	if _, err := h.LookupAsnFresh("ASX"); err != MalformedAsnError {
+		t.Errorf("LookupAsnFresh of a malformed ASN failed with %v", err)
+	}
+	// Cached lookups never reach the source
+	source.lookups.Store(0)
+	if descr, ok := h.LookupAsnCached("AS64501"); ok {
+		t.Errorf("LookupAsnCached answered %q for an uncached ASN", descr)
+	}
+	if descr, ok := h.LookupAsnCached("64500"); !ok || descr != "EXAMPLE-NET" {
+		t.Errorf("LookupAsnCached answered %q %v", descr, ok)
+	}
+	if err := h.OverridesSet("AS64501", "Overriden"); err != nil {
+		t.Fatal(err)
+	}
+	if descr, ok := h.LookupAsnCached("AS64501"); !ok || descr != "Overriden" {
+		t.Errorf("LookupAsnCached answered %q %v for an overriden ASN", descr, ok)
+	}
+	if n := source.lookups.Load(); n != 0 {
+		t.Errorf("LookupAsnCached consulted the source %d times", n)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// asnCacheTimeout is the default time allowed to every operation
+// of an external ASN cache (see WithAsnCache).
+const asnCacheTimeout = 100 * time.Millisecond
+
+// AsnCache is a cache of LookupAsn answers by IP address,
+// external to the handler, such as a Redis instance
+// shared by the replicas of a service (see WithAsnCache).
+//
+// Implementations must be safe for concurrent use,
+// and should give up when their context is done.
+type AsnCache interface {
+	// Get returns the cached answer for ip,
+	// and its remaining TTL, zero if ip is not cached.
+	Get(ctx context.Context, ip string) (AsnInfo, time.Duration, error)
+	// Set caches the answer for ip for ttl.
+	Set(ctx context.Context, ip string, info AsnInfo, ttl time.Duration) error
+	// PurgeASN removes the answers of a given ASN.
+	PurgeASN(ctx context.Context, asn string) error
+	// PurgeAll removes all answers.
+	PurgeAll(ctx context.Context) error
+}
+
+// MemoryAsnCache is an AsnCache kept in memory,
+// as the handler cache is.
+type MemoryAsnCache struct {
+	cache cache
+}
+
+// NewMemoryAsnCache returns an empty MemoryAsnCache,
+// to be passed to WithAsnCache.
+func NewMemoryAsnCache() *MemoryAsnCache {
+	c := newCache()
+	// Entries are bounded by their TTL only
+	c.capacity = 0
+	return &MemoryAsnCache{c}
+}
+
+// Get implements AsnCache.
+func (c *MemoryAsnCache) Get(ctx context.Context, ip string) (AsnInfo, time.Duration, error) {
+	entry, expired, found := c.cache.lookupByIP(ip)
+	if !found || expired || entry.err != nil {
+		return AsnInfo{}, 0, nil
+	}
+	info := entry.asnInfo()
+	info.Stale = false
+	info.Descrs = maps.Clone(info.Descrs)
+	info.Tags = slices.Clone(info.Tags)
+	return info, entry.due.Sub(c.cache.now()), nil
+}
+
+// Set implements AsnCache.
+func (c *MemoryAsnCache) Set(ctx context.Context, ip string, info AsnInfo, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid cache TTL %s", ttl)
+	}
+	info.Descrs = maps.Clone(info.Descrs)
+	info.Tags = slices.Clone(info.Tags)
+	entry := newOriginEntry(info, ttl)
+	entry.stale = false
+	c.cache.store(ip, entry)
+	return nil
+}
+
+// PurgeASN implements AsnCache.
+func (c *MemoryAsnCache) PurgeASN(ctx context.Context, asn string) error {
+	c.cache.purgeASN(asn)
+	return nil
+}
+
+// PurgeAll implements AsnCache.
+func (c *MemoryAsnCache) PurgeAll(ctx context.Context) error {
+	c.cache.purgeAll()
+	return nil
+}
+
+// externalAsnCache is an AsnCache given to WithAsnCache.
+type externalAsnCache struct {
+	AsnCache
+	// Time allowed to every operation
+	timeout time.Duration
+}
+
+// WithAsnCache adds an external cache of LookupAsn answers,
+// consulted on misses of the handler cache,
+// and updated with the answers the handler caches,
+// so that replicas sharing it look every address up once.
+// Overrides changes and cache purges (see CachePurgeAll) purge it as well.
+//
+// Every operation is given timeout, or 100ms if zero:
+// an external cache failing or too slow is skipped with a warning,
+// lookups going on as if the answer was not cached.
+// Answers are stored in the background.
+//
+// Derived handlers (see Derive), whose answers may differ,
+// do not consult it.
+func WithAsnCache(c AsnCache, timeout time.Duration) Option {
+	return func(h *Handler) error {
+		if c == nil {
+			return errors.New("nil ASN cache")
+		}
+		if timeout < 0 {
+			return fmt.Errorf("invalid ASN cache timeout %s", timeout)
+		}
+		if h.tenant != "" {
+			return fmt.Errorf("derived handlers share the ASN cache of their parent")
+		}
+		if timeout == 0 {
+			timeout = asnCacheTimeout
+		}
+		h.asnCache = &externalAsnCache{c, timeout}
+		return nil
+	}
+}
+
+// usesAsnCache tells whether the handler consults an external ASN cache.
+func (h Handler) usesAsnCache() bool {
+	return h.asnCache != nil && h.tenant == ""
+}
+
+// lookupAsnCache retrieves the answer for a cache key
+// from the external ASN cache.
+//
+// Returns the cache entry, and if key was found.
+func (h Handler) lookupAsnCache(ctx context.Context, key string) (cacheEntry, bool) {
+	ctx, cancel := context.WithTimeout(ctx, h.asnCache.timeout)
+	defer cancel()
+	info, ttl, err := h.asnCache.Get(ctx, key)
+	if err != nil {
+		h.logf("warning: ASN cache lookup failed: %s\n", err)
+		return cacheEntry{}, false
+	}
+	if ttl <= 0 || info.Asn == "" {
+		return cacheEntry{}, false
+	}
+	entry := newOriginEntry(info, ttl)
+	entry.stale = false
+	return entry, true
+}
+
+// storeAsnCache updates the external ASN cache in the background.
+func (h Handler) storeAsnCache(key string, entry cacheEntry) {
+	info := entry.asnInfo()
+	info.Cached, info.Stale = false, false
+	err := h.runs.run(func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, h.asnCache.timeout)
+		defer cancel()
+		if err := h.asnCache.Set(ctx, key, info, entry.ttl); err != nil {
+			h.logf("warning: ASN cache update failed: %s\n", err)
+		}
+	})
+	if err != nil {
+		h.logf("warning: ASN cache update failed: %s\n", err)
+	}
+}
+
+// purgeAsnCache removes the answers of a given ASN,
+// or all answers if empty, from the external ASN cache.
+func (h Handler) purgeAsnCache(asn string) {
+	if h.asnCache == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.asnCache.timeout)
+	defer cancel()
+	var err error
+	if asn == "" {
+		err = h.asnCache.PurgeAll(ctx)
+	} else {
+		err = h.asnCache.PurgeASN(ctx, asn)
+	}
+	if err != nil {
+		h.logf("warning: ASN cache purge failed: %s\n", err)
+	}
+}
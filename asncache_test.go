@@ -0,0 +1,203 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testAsnCache checks the behavior every AsnCache must have.
+func testAsnCache(t *testing.T, c AsnCache) {
+	t.Helper()
+	ctx := context.Background()
+	if info, ttl, err := c.Get(ctx, "192.0.2.1"); err != nil || ttl != 0 {
+		t.Fatalf("Get of an uncached ip answered %+v %s %v", info, ttl, err)
+	}
+	google := AsnInfo{Asn: "AS15169", Descr: "GOOGLE", Source: SourceMMDB, DescrSource: SourceMMDB,
+		Descrs: map[string]string{SourceMMDB: "GOOGLE"}}
+	cloudflare := AsnInfo{Asn: "AS13335", Descr: "CLOUDFLARENET", Source: SourceMMDB}
+	for ip, info := range map[string]AsnInfo{"8.8.8.8": google, "8.8.4.4": google, "1.1.1.1": cloudflare} {
+		if err := c.Set(ctx, ip, info, time.Hour); err != nil {
+			t.Fatalf("Set of %s failed: %v", ip, err)
+		}
+	}
+	info, ttl, err := c.Get(ctx, "8.8.8.8")
+	if err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("Get answered TTL %s %v", ttl, err)
+	}
+	if info.Asn != google.Asn || info.Descr != google.Descr || info.Source != google.Source ||
+		info.DescrSource != google.DescrSource || info.Descrs[SourceMMDB] != "GOOGLE" {
+		t.Errorf("Get answered %+v, expected %+v", info, google)
+	}
+	// Purges
+	if err := c.PurgeASN(ctx, "AS15169"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"8.8.8.8", "8.8.4.4"} {
+		if _, ttl, err := c.Get(ctx, ip); err != nil || ttl != 0 {
+			t.Errorf("Get of purged %s answered TTL %s %v", ip, ttl, err)
+		}
+	}
+	if info, ttl, err := c.Get(ctx, "1.1.1.1"); err != nil || ttl <= 0 || info.Asn != "AS13335" {
+		t.Errorf("Get of 1.1.1.1 answered %+v %s %v after purging another ASN", info, ttl, err)
+	}
+	if err := c.PurgeAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ttl, err := c.Get(ctx, "1.1.1.1"); err != nil || ttl != 0 {
+		t.Errorf("Get answered TTL %s %v after PurgeAll", ttl, err)
+	}
+	// Expiry
+	if err := c.Set(ctx, "1.1.1.1", cloudflare, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, ttl, err := c.Get(ctx, "1.1.1.1"); err != nil || ttl != 0 {
+		t.Errorf("Get of an expired ip answered TTL %s %v", ttl, err)
+	}
+}
+
+func TestMemoryAsnCache(t *testing.T) {
+	testAsnCache(t, NewMemoryAsnCache())
+}
+
+// brokenAsnCache is an AsnCache failing every operation,
+// or blocking until its context is done if slow.
+type brokenAsnCache struct {
+	slow bool
+}
+
+func (c brokenAsnCache) fail(ctx context.Context) error {
+	if c.slow {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return errors.New("connection refused")
+}
+
+func (c brokenAsnCache) Get(ctx context.Context, ip string) (AsnInfo, time.Duration, error) {
+	return AsnInfo{}, 0, c.fail(ctx)
+}
+
+func (c brokenAsnCache) Set(ctx context.Context, ip string, info AsnInfo, ttl time.Duration) error {
+	return c.fail(ctx)
+}
+
+func (c brokenAsnCache) PurgeASN(ctx context.Context, asn string) error {
+	return c.fail(ctx)
+}
+
+func (c brokenAsnCache) PurgeAll(ctx context.Context) error {
+	return c.fail(ctx)
+}
+
+func TestWithAsnCache(t *testing.T) {
+	shared := NewMemoryAsnCache()
+	newReplica := func() Handler {
+		h, err := NewHandlerWithStore(NewMemoryOverrides(), time.Second, WithMMDB(testMMDB), WithAsnCache(shared, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	a, b := newReplica(), newReplica()
+	defer a.Close()
+	defer b.Close()
+	ctx := context.Background()
+	info, err := a.LookupAsnDetailed(ctx, "8.8.8.8")
+	if err != nil || info.Asn != "AS15169" || info.Cached {
+		t.Fatalf("LookupAsnDetailed answered %+v %v", info, err)
+	}
+	// Answers are stored in the background
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ttl, _ := shared.Get(ctx, "8.8.8.8"); ttl > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("answer not stored in the ASN cache")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Other replicas find it, and cache it
+	info, err = b.LookupAsnDetailed(ctx, "8.8.8.8")
+	if err != nil || info.Asn != "AS15169" || info.Descr != "GOOGLE" || !info.Cached {
+		t.Errorf("LookupAsnDetailed of the other replica answered %+v %v", info, err)
+	}
+	if n := b.cache.len(); n != 1 {
+		t.Errorf("other replica cached %d entries", n)
+	}
+	// Overrides changes purge it
+	if err := a.OverridesSet("AS15169", "Overriden"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ttl, _ := shared.Get(ctx, "8.8.8.8"); ttl != 0 {
+		t.Errorf("OverridesSet did not purge the ASN cache")
+	}
+	if err := shared.Set(ctx, "1.1.1.1", AsnInfo{Asn: "AS13335"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	a.AsnCachePurge()
+	if _, ttl, _ := shared.Get(ctx, "1.1.1.1"); ttl != 0 {
+		t.Errorf("AsnCachePurge did not purge the ASN cache")
+	}
+	// Derived handlers do not consult it
+	tenant, err := a.Derive("tenant", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WithAsnCache(shared, 0)(&tenant); err == nil {
+		t.Error("WithAsnCache accepted a derived handler")
+	}
+	if err := WithAsnCache(nil, 0)(&a); err == nil {
+		t.Error("WithAsnCache accepted a nil cache")
+	}
+}
+
+func TestWithAsnCacheDegraded(t *testing.T) {
+	for _, c := range []brokenAsnCache{{}, {slow: true}} {
+		h, err := NewHandlerWithStore(NewMemoryOverrides(), time.Second, WithMMDB(testMMDB),
+			WithAsnCache(c, 20*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		info, err := h.LookupAsnDetailed(context.Background(), "8.8.8.8")
+		if err != nil || info.Asn != "AS15169" {
+			t.Errorf("LookupAsnDetailed with slow %v ASN cache answered %+v %v", c.slow, info, err)
+		}
+		if err := h.OverridesSet("AS15169", "Overriden"); err != nil {
+			t.Errorf("OverridesSet with slow %v ASN cache failed: %v", c.slow, err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("slow %v ASN cache blocked for %s", c.slow, elapsed)
+		}
+		h.Close()
+	}
+}
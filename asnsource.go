@@ -0,0 +1,218 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AsnSource is a source of ASN descriptions LookupAsn may consult,
+// such as an internal registry (see WithAsnSources).
+type AsnSource interface {
+	// Name identifies the source,
+	// in the answers of LookupAsnDetailed and in WithSources.
+	Name() string
+	// Lookup answers the description of an ASN ("AS15169"),
+	// or fails if the source does not know it.
+	Lookup(ctx context.Context, asn string) (string, error)
+}
+
+// builtinSource stands for a source implemented by the handler
+// (see BuiltinSource).
+type builtinSource string
+
+func (s builtinSource) Name() string {
+	return string(s)
+}
+
+func (s builtinSource) Lookup(ctx context.Context, asn string) (string, error) {
+	return "", fmt.Errorf("builtin source '%s' is consulted by handlers only", string(s))
+}
+
+// BuiltinSource answers a placeholder AsnSource
+// for a source implemented by the handler, to order with WithAsnSources:
+// SourceGeoIP or SourceMMDB for the local ASN database (see WithMMDB),
+// SourceIpinfo for ipinfo.io, SourceCymru for Team Cymru's DNS services,
+// and SourcePeeringDB for PeeringDB network names (see PeeringDbLookup).
+// Its own Lookup method always fails.
+func BuiltinSource(name string) AsnSource {
+	return builtinSource(name)
+}
+
+// defaultAsnSources are the sources LookupAsn consults by default,
+// in order.
+var defaultAsnSources = []AsnSource{
+	builtinSource(SourceGeoIP),
+	builtinSource(SourceIpinfo),
+	builtinSource(SourceCymru),
+}
+
+// byIP tells whether a source is queried by IP address,
+// answering an ASN and maybe its description,
+// rather than describing a given ASN.
+func byIP(s AsnSource) bool {
+	switch s {
+	case builtinSource(SourceGeoIP), builtinSource(SourceMMDB), builtinSource(SourceIpinfo):
+		return true
+	}
+	return false
+}
+
+// WithAsnSources sets the sources LookupAsn consults, in order,
+// instead of the local ASN database, ipinfo.io, then Team Cymru.
+// Sources implemented by the handler are given by BuiltinSource,
+// and are not consulted if omitted:
+// for instance, the sources
+// BuiltinSource(SourceMMDB), internal, BuiltinSource(SourceCymru)
+// never reach ipinfo.io,
+// and describe ASNs by an internal AsnSource ahead of Team Cymru.
+//
+// The ASN of an IP address is found by the first source queried by IP
+// answering one, or else by Team Cymru's IP to ASN service if listed.
+// Its description is then answered by the first source describing it,
+// unless a source queried by IP answers both an ASN and a description first.
+// LookupAsnDescr consults the sources describing ASNs in the same order.
+// Network sources are refused in offline mode (see WithOfflineMode).
+// The overrides collection (see NewHandler) still takes precedence,
+// as well as fixture mappings (see NewFixtureHandler),
+// and prefix lookups (see WithPrefixCache) still query Team Cymru.
+//
+// Answers tell which sources found the ASN and its description
+// (see LookupAsnDetailed), and are cached as such.
+// Derived handlers consult the sources of their parent (see Derive).
+func WithAsnSources(sources ...AsnSource) Option {
+	return func(h *Handler) error {
+		if h.tenant != "" {
+			return fmt.Errorf("derived handlers share the ASN sources of their parent")
+		}
+		if len(sources) == 0 {
+			return fmt.Errorf("no ASN source")
+		}
+		names := make(map[string]bool, len(sources))
+		for _, s := range sources {
+			if s == nil {
+				return fmt.Errorf("nil ASN source")
+			}
+			name := s.Name()
+			if _, ok := s.(builtinSource); ok {
+				switch name {
+				case SourceGeoIP, SourceMMDB, SourceIpinfo, SourceCymru, SourcePeeringDB:
+				default:
+					return fmt.Errorf("no builtin ASN source '%s'", name)
+				}
+				if name == SourceMMDB {
+					// Both stand for the local database
+					name = SourceGeoIP
+				}
+			} else {
+				switch name {
+				case "":
+					return fmt.Errorf("unnamed ASN source")
+				case SourceCache, SourceGeoIP, SourceMMDB, SourceIpinfo, SourceCymru, SourcePeeringDB, SourceOverrides, SourceFixtures:
+					return fmt.Errorf("ASN source '%s' named after a builtin source", name)
+				}
+			}
+			if names[name] {
+				return fmt.Errorf("duplicate ASN source '%s'", s.Name())
+			}
+			if h.offline && isNetworkSource(s) {
+				return fmt.Errorf("%w: ASN source '%s'", OfflineModeError, name)
+			}
+			names[name] = true
+		}
+		h.asnSources = append([]AsnSource{}, sources...)
+		return nil
+	}
+}
+
+// asnSourceList answers the sources LookupAsn consults, in order,
+// along with their names, the local database one being resolved,
+// skipping the local database if the handler has none,
+// and network sources in offline mode (see WithOfflineMode).
+func (h Handler) asnSourceList() ([]AsnSource, []string) {
+	sources := h.asnSources
+	if sources == nil {
+		sources = defaultAsnSources
+	}
+	giSource, giLookup := h.localDatabase()
+	list := make([]AsnSource, 0, len(sources))
+	names := make([]string, 0, len(sources))
+	for _, s := range sources {
+		name := s.Name()
+		if h.offline && isNetworkSource(s) {
+			continue
+		}
+		if s == builtinSource(SourceGeoIP) || s == builtinSource(SourceMMDB) {
+			if giLookup == nil {
+				continue
+			}
+			name = giSource
+		}
+		list = append(list, s)
+		names = append(names, name)
+	}
+	return list, names
+}
+
+// describeAsn asks a source describing ASNs for the description of asn,
+// bounded by the timeout of the source (see WithSourceTimeout), unless its breaker is open
+// (see WithSourceBreakers).
+//
+// Returns the description, and the TTL to cache it for.
+func (h Handler) describeAsn(ctx context.Context, s AsnSource, asn string) (descr string, ttl time.Duration, err error) {
+	err = h.guardSource(ctx, s.Name(), func() error {
+		var err error
+		descr, ttl, err = h.describeAsnUnguarded(ctx, s, asn)
+		return err
+	})
+	return descr, ttl, err
+}
+
+// describeAsnUnguarded is describeAsn, whatever the source breaker.
+func (h Handler) describeAsnUnguarded(ctx context.Context, s AsnSource, asn string) (string, time.Duration, error) {
+	if s == builtinSource(SourceCymru) {
+		descr, ttl, err := h.cymru.lookupTTL(ctx, asn)
+		if h.cymruTTL == nil {
+			ttl = h.cache.defaultTTL()
+		} else {
+			ttl = h.cymruTTL.clamp(ttl)
+		}
+		return descr, ttl, err
+	}
+	if timeout := h.sourceTimeout(s.Name()); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if s == builtinSource(SourcePeeringDB) {
+		network, err := h.PeeringDbLookupCtx(ctx, asn)
+		return network.Name, h.cache.defaultTTL(), err
+	}
+	descr, err := s.Lookup(ctx, asn)
+	return descr, h.cache.defaultTTL(), err
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testAsnSource is an AsnSource answering from a map.
+type testAsnSource struct {
+	name    string
+	descrs  map[string]string
+	lookups atomic.Int32
+}
+
+func (s *testAsnSource) Name() string {
+	return s.name
+}
+
+func (s *testAsnSource) Lookup(ctx context.Context, asn string) (string, error) {
+	s.lookups.Add(1)
+	if descr, ok := s.descrs[asn]; ok {
+		return descr, nil
+	}
+	return "", fmt.Errorf("unknown ASN '%s'", asn)
+}
+
+func TestWithAsnSources(t *testing.T) {
+	zone := testDNSZone{
+		"8.8.8.8.origin.asn.cymru.com.": {`8.8.8.8.origin.asn.cymru.com. 60 IN TXT "15169 | 8.8.8.0/24 | US | arin | 2023-12-28"`},
+		"AS15169.asn.cymru.com.":        {`AS15169.asn.cymru.com. 60 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+		"AS3356.asn.cymru.com.":         {`AS3356.asn.cymru.com. 60 IN TXT "3356 | US | arin | 2000-03-10 | LEVEL3, US"`},
+	}
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// ASN without description
+		fmt.Fprintln(w, "AS15169")
+	}))
+	defer ts.Close()
+	dns := startTestDNS(t, zone.serve)
+	internal := &testAsnSource{name: "internal", descrs: map[string]string{"AS15169": "Google (internal)"}}
+	newTestHandler := func(opts ...Option) Handler {
+		h := newHandler(nil, time.Second)
+		h.resolver.server = dns
+		h.ipinfo.baseURL = ts.URL
+		for _, opt := range opts {
+			if err := opt(&h); err != nil {
+				t.Fatalf("option failed: %s", err)
+			}
+		}
+		return h
+	}
+
+	// By default, cymru describes the ASN found by ipinfo.io
+	h := newTestHandler()
+	info, err := h.LookupAsnDetailed(context.Background(), "8.8.8.8")
+	if err != nil || info.Descr != "GOOGLE, US" || info.Source != SourceIpinfo || info.DescrSource != SourceCymru {
+		t.Errorf("default lookup answered %+v, %v", info, err)
+	}
+
+	// Custom sources ahead of cymru take precedence
+	h = newTestHandler(WithAsnSources(BuiltinSource(SourceIpinfo), internal, BuiltinSource(SourceCymru)))
+	if sources := h.Sources(); !reflect.DeepEqual(sources, []string{SourceCache, SourceIpinfo, "internal", SourceCymru}) {
+		t.Errorf("sources %v", sources)
+	}
+	info, err = h.LookupAsnDetailed(context.Background(), "8.8.8.8")
+	if err != nil || info.Asn != "AS15169" || info.Descr != "Google (internal)" || info.Source != SourceIpinfo || info.DescrSource != "internal" {
+		t.Errorf("lookup answered %+v, %v", info, err)
+	}
+	// The cache records the source which won
+	info, err = h.LookupAsnDetailed(context.Background(), "8.8.8.8")
+	if err != nil || !info.Cached || info.DescrSource != "internal" {
+		t.Errorf("cached lookup answered %+v, %v", info, err)
+	}
+	if n := internal.lookups.Load(); n != 1 {
+		t.Errorf("%d lookups of the internal source, expected 1", n)
+	}
+	// ASNs the custom source does not know fall back to cymru
+	descr, err := h.LookupAsnDescr(context.Background(), "AS3356")
+	if err != nil || descr != "LEVEL3, US" {
+		t.Errorf("LookupAsnDescr(AS3356) answered '%s', %v", descr, err)
+	}
+	descr, err = h.LookupAsnDescr(context.Background(), "AS15169")
+	if err != nil || descr != "Google (internal)" {
+		t.Errorf("LookupAsnDescr(AS15169) answered '%s', %v", descr, err)
+	}
+	// Lookups restricted to other sources skip it
+	info, err = h.LookupAsnDetailed(context.Background(), "8.8.8.8", WithSources(SourceIpinfo, SourceCymru))
+	if err != nil || info.DescrSource != SourceCymru {
+		t.Errorf("lookup restricted to builtin sources answered %+v, %v", info, err)
+	}
+
+	// Offline of ipinfo.io, cymru finds the ASN
+	requests.Store(0)
+	h = newTestHandler(WithAsnSources(internal, BuiltinSource(SourceCymru)))
+	info, err = h.LookupAsnDetailed(context.Background(), "8.8.8.8")
+	if err != nil || info.Source != SourceCymru || info.DescrSource != "internal" {
+		t.Errorf("lookup without ipinfo.io answered %+v, %v", info, err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("%d ipinfo.io requests", n)
+	}
+
+	// Without any source finding ASNs, lookups fail
+	h = newTestHandler(WithAsnSources(internal))
+	if _, err := h.LookupAsnDetailed(context.Background(), "8.8.8.8"); err == nil {
+		t.Error("lookup without source finding ASNs did not fail")
+	}
+
+	h = newHandler(nil, time.Second)
+	for _, sources := range [][]AsnSource{
+		nil,
+		{nil},
+		{BuiltinSource("whois")},
+		{&testAsnSource{name: SourceOverrides}},
+		{&testAsnSource{}},
+		{internal, internal},
+		{BuiltinSource(SourceGeoIP), BuiltinSource(SourceMMDB)},
+	} {
+		if err := WithAsnSources(sources...)(&h); err == nil {
+			t.Errorf("WithAsnSources(%v) did not fail", sources)
+		}
+	}
+	if _, err := h.Derive("acme", nil, WithAsnSources(internal)); err == nil {
+		t.Error("WithAsnSources on a derived handler did not fail")
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Actions of OverridesAuditEntry.
+const (
+	OverridesAuditCreated = "created"
+	OverridesAuditUpdated = "updated"
+	OverridesAuditRemoved = "removed"
+)
+
+// OverridesAuditEntry is a change of an override,
+// as recorded in the audit log (see WithOverridesAudit).
+type OverridesAuditEntry struct {
+	Asn string `bson:"asn" json:"asn"`
+	// Description before and after the change,
+	// empty before creation and after removal
+	Old string `bson:"old" json:"old"`
+	New string `bson:"new" json:"new"`
+	// Author of the change (see OverridesSetWithMeta), if known
+	Actor string    `bson:"actor" json:"actor"`
+	Time  time.Time `bson:"time" json:"time"`
+	// OverridesAuditCreated, OverridesAuditUpdated or OverridesAuditRemoved
+	Action string `bson:"action" json:"action"`
+}
+
+// OverridesAuditStore stores the audit log of overrides
+// (see WithOverridesAudit).
+// Its methods are called concurrently.
+type OverridesAuditStore interface {
+	// Append records an entry.
+	Append(e OverridesAuditEntry) error
+	// History retrieves up to limit entries of an ASN,
+	// all of them if limit is zero, most recent first.
+	History(asn string, limit int) ([]OverridesAuditEntry, error)
+	// Since retrieves up to limit entries recorded at or after a given time,
+	// all of them if limit is zero, most recent first.
+	Since(since time.Time, limit int) ([]OverridesAuditEntry, error)
+}
+
+// OverridesNoAuditError is returned by OverridesAuditLog<...> methods
+// when Handler has no audit log (see WithOverridesAudit).
+var OverridesNoAuditError = errors.New("no overrides audit log")
+
+// OverridesAuditError is returned by the methods changing overrides
+// (see WithOverridesAudit) when the override was changed,
+// but the change could not be recorded in the audit log.
+type OverridesAuditError struct {
+	Asn string
+	Err error
+}
+
+func (e *OverridesAuditError) Error() string {
+	return fmt.Sprintf("override of %s changed, but not audited: %s", e.Asn, e.Err)
+}
+
+func (e *OverridesAuditError) Unwrap() error {
+	return e.Err
+}
+
+// WithOverridesAudit makes the handler record the changes of overrides
+// by OverridesSet, OverridesSetWithMeta, OverridesRemove,
+// OverridesImport, OverridesImportHistorical and OverridesNormalize
+// in an audit log (see OverridesAuditLog).
+// Historical imports are recorded at their update time,
+// by their operator.
+//
+// Auditing is best effort: a change is not rolled back
+// if it cannot be recorded, it fails with an *OverridesAuditError.
+func WithOverridesAudit(store OverridesAuditStore) Option {
+	return func(h *Handler) error {
+		if store == nil {
+			return fmt.Errorf("nil overrides audit store")
+		}
+		h.audit = store
+		return nil
+	}
+}
+
+// WithOverridesAuditCollection is WithOverridesAudit,
+// keeping the audit log in a MongoDB collection
+// alongside the overrides collection (see WithOverridesCollection),
+// written within the timeout set before (see WithTimeout).
+func WithOverridesAuditCollection(c *mgo.Collection) Option {
+	return func(h *Handler) error {
+		if c == nil {
+			return fmt.Errorf("nil overrides audit collection")
+		}
+		h.audit = NewMongoOverridesAuditStore(c, h.timeout)
+		return nil
+	}
+}
+
+// OverridesAuditLog answers up to limit changes of the override of an ASN,
+// all of them if limit is zero, most recent first.
+func (h Handler) OverridesAuditLog(asn string, limit int) ([]OverridesAuditEntry, error) {
+	if h.audit == nil {
+		return nil, OverridesNoAuditError
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("negative limit %d", limit)
+	}
+	answer, err := h.audit.History(normalizeASN(asn), limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve audit log: %w", err)
+	}
+	if answer == nil {
+		return make([]OverridesAuditEntry, 0), nil
+	}
+	return answer, nil
+}
+
+// OverridesAuditLogAll answers up to limit changes of overrides
+// made at or after a given time, all of them if limit is zero,
+// most recent first.
+func (h Handler) OverridesAuditLogAll(since time.Time, limit int) ([]OverridesAuditEntry, error) {
+	if h.audit == nil {
+		return nil, OverridesNoAuditError
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("negative limit %d", limit)
+	}
+	answer, err := h.audit.Since(since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve audit log: %w", err)
+	}
+	if answer == nil {
+		return make([]OverridesAuditEntry, 0), nil
+	}
+	return answer, nil
+}
+
+// auditedOverride retrieves the description of an override about to change,
+// if the handler has an audit log.
+//
+// Returns the description, empty if there is no override,
+// and whether there is an override.
+func (h Handler) auditedOverride(asn string) (string, bool, error) {
+	if h.audit == nil {
+		return "", false, nil
+	}
+	o, err := h.overrides.Get(context.Background(), asn)
+	if errors.Is(err, OverridesAsnNotFoundError) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, &OverridesAuditError{asn, fmt.Errorf("cannot lookup override: %w", &SourceError{SourceOverrides, err})}
+	}
+	return o.Name, true, nil
+}
+
+// auditOverride records a change of override in the audit log, if any.
+func (h Handler) auditOverride(e OverridesAuditEntry) error {
+	if h.audit == nil {
+		return nil
+	}
+	if err := h.audit.Append(e); err != nil {
+		return &OverridesAuditError{e.Asn, err}
+	}
+	return nil
+}
+
+// auditOverrides records changes of overrides in the audit log, if any,
+// recording all of them even if some fail.
+//
+// Returns the error of the first failure.
+func (h Handler) auditOverrides(entries []OverridesAuditEntry) error {
+	var first error
+	for _, e := range entries {
+		if err := h.auditOverride(e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// mongoOverridesAudit is the OverridesAuditStore of a MongoDB collection.
+type mongoOverridesAudit struct {
+	c *mgo.Collection
+	// Bound of every operation, if not zero
+	timeout time.Duration
+}
+
+// NewMongoOverridesAuditStore returns the OverridesAuditStore
+// of a MongoDB collection (see WithOverridesAuditCollection).
+// Parameter timeout, if not zero, bounds every operation.
+//
+// Returns nil if the collection is nil.
+func NewMongoOverridesAuditStore(c *mgo.Collection, timeout time.Duration) OverridesAuditStore {
+	if c == nil {
+		return nil
+	}
+	return &mongoOverridesAudit{c, timeout}
+}
+
+// session returns a copy of the collection session, bound by the timeout.
+func (m *mongoOverridesAudit) session() *mgo.Session {
+	s := m.c.Database.Session.Copy()
+	if m.timeout > 0 {
+		s.SetSyncTimeout(m.timeout)
+		s.SetSocketTimeout(m.timeout)
+	}
+	return s
+}
+
+// Append records an entry.
+func (m *mongoOverridesAudit) Append(e OverridesAuditEntry) error {
+	s := m.session()
+	defer s.Close()
+	return m.c.With(s).Insert(e)
+}
+
+// History retrieves entries of an ASN, most recent first.
+func (m *mongoOverridesAudit) History(asn string, limit int) ([]OverridesAuditEntry, error) {
+	return m.find(bson.M{"asn": asn}, limit)
+}
+
+// Since retrieves entries recorded at or after a given time, most recent first.
+func (m *mongoOverridesAudit) Since(since time.Time, limit int) ([]OverridesAuditEntry, error) {
+	return m.find(bson.M{"time": bson.M{"$gte": since}}, limit)
+}
+
+// find retrieves up to limit entries matching a query, most recent first.
+func (m *mongoOverridesAudit) find(query bson.M, limit int) ([]OverridesAuditEntry, error) {
+	s := m.session()
+	defer s.Close()
+	var answer []OverridesAuditEntry
+	err := m.c.With(s).Find(query).Sort("-time", "-_id").Limit(limit).All(&answer)
+	return answer, err
+}
+
+// MemoryOverridesAudit is an OverridesAuditStore
+// keeping the audit log in memory, for tests and small deployments.
+// It is safe for concurrent use.
+type MemoryOverridesAudit struct {
+	mu      sync.RWMutex
+	entries []OverridesAuditEntry
+}
+
+// NewMemoryOverridesAudit returns an empty MemoryOverridesAudit,
+// to be passed to WithOverridesAudit.
+func NewMemoryOverridesAudit() *MemoryOverridesAudit {
+	return &MemoryOverridesAudit{}
+}
+
+// Append records an entry.
+func (m *MemoryOverridesAudit) Append(e OverridesAuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+// History retrieves entries of an ASN, most recent first.
+func (m *MemoryOverridesAudit) History(asn string, limit int) ([]OverridesAuditEntry, error) {
+	return m.find(func(e OverridesAuditEntry) bool { return e.Asn == asn }, limit), nil
+}
+
+// Since retrieves entries recorded at or after a given time, most recent first.
+func (m *MemoryOverridesAudit) Since(since time.Time, limit int) ([]OverridesAuditEntry, error) {
+	return m.find(func(e OverridesAuditEntry) bool { return !e.Time.Before(since) }, limit), nil
+}
+
+// find retrieves up to limit entries matching a filter,
+// most recent first, the last recorded first among simultaneous ones.
+func (m *MemoryOverridesAudit) find(match func(OverridesAuditEntry) bool, limit int) []OverridesAuditEntry {
+	m.mu.RLock()
+	var answer []OverridesAuditEntry
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if match(m.entries[i]) {
+			answer = append(answer, m.entries[i])
+		}
+	}
+	m.mu.RUnlock()
+	sort.SliceStable(answer, func(i, j int) bool { return answer[i].Time.After(answer[j].Time) })
+	if limit > 0 && len(answer) > limit {
+		answer = answer[:limit]
+	}
+	return answer
+}
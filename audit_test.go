@@ -0,0 +1,190 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingAudit is an OverridesAuditStore failing to record entries.
+type failingAudit struct {
+	*MemoryOverridesAudit
+}
+
+func (failingAudit) Append(e OverridesAuditEntry) error {
+	return errors.New("audit collection unavailable")
+}
+
+func TestOverridesAuditLog(t *testing.T) {
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	if err := h.OverridesSet("AS15169", "Google"); err != nil {
+		t.Fatalf("OverridesSet failed without audit log: %s", err)
+	}
+	if _, err := h.OverridesAuditLog("AS15169", 0); err != OverridesNoAuditError {
+		t.Fatalf("OverridesAuditLog failed with %v without audit log", err)
+	}
+	if _, err := h.OverridesAuditLogAll(time.Time{}, 0); err != OverridesNoAuditError {
+		t.Fatalf("OverridesAuditLogAll failed with %v without audit log", err)
+	}
+
+	if err := WithOverridesAudit(NewMemoryOverridesAudit())(&h); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	steps := []func() error{
+		func() error { return h.OverridesSetWithMeta("as15169", "Alphabet", "alice") },
+		func() error { return h.OverridesSet("AS13335", "Cloudflare") },
+		func() error { return h.OverridesSetWithMeta("AS13335", "CLOUDFLARE", "bob") },
+		func() error { return h.OverridesRemove("15169") },
+		// Removing no override is not audited
+		func() error { return h.OverridesRemove("AS15169") },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d failed: %s", i, err)
+		}
+	}
+	all, err := h.OverridesAuditLogAll(start, 0)
+	if err != nil {
+		t.Fatalf("OverridesAuditLogAll failed: %s", err)
+	}
+	expected := []OverridesAuditEntry{
+		{Asn: "AS15169", Old: "Alphabet", Action: OverridesAuditRemoved},
+		{Asn: "AS13335", Old: "Cloudflare", New: "CLOUDFLARE", Actor: "bob", Action: OverridesAuditUpdated},
+		{Asn: "AS13335", New: "Cloudflare", Action: OverridesAuditCreated},
+		{Asn: "AS15169", Old: "Google", New: "Alphabet", Actor: "alice", Action: OverridesAuditUpdated},
+	}
+	if len(all) != len(expected) {
+		t.Fatalf("OverridesAuditLogAll answered %+v", all)
+	}
+	for i, e := range all {
+		if e.Time.Before(start) || i > 0 && e.Time.After(all[i-1].Time) {
+			t.Errorf("entry %d at %s out of order", i, e.Time)
+		}
+		e.Time = time.Time{}
+		if e != expected[i] {
+			t.Errorf("entry %d is %+v, expected %+v", i, e, expected[i])
+		}
+	}
+	if entries, err := h.OverridesAuditLogAll(time.Now().Add(time.Hour), 0); err != nil || len(entries) != 0 {
+		t.Errorf("OverridesAuditLogAll answered %+v, %v in the future", entries, err)
+	}
+	if entries, err := h.OverridesAuditLogAll(start, 1); err != nil || len(entries) != 1 || entries[0].Action != OverridesAuditRemoved {
+		t.Errorf("limited OverridesAuditLogAll answered %+v, %v", entries, err)
+	}
+	entries, err := h.OverridesAuditLog("as13335", 0)
+	if err != nil || len(entries) != 2 || entries[0].New != "CLOUDFLARE" || entries[1].New != "Cloudflare" {
+		t.Errorf("OverridesAuditLog answered %+v, %v", entries, err)
+	}
+	if entries, err := h.OverridesAuditLog("AS15169", 1); err != nil || len(entries) != 1 || entries[0].Action != OverridesAuditRemoved {
+		t.Errorf("limited OverridesAuditLog answered %+v, %v", entries, err)
+	}
+	if entries, err := h.OverridesAuditLog("AS174", 0); err != nil || entries == nil || len(entries) != 0 {
+		t.Errorf("OverridesAuditLog answered %+v, %v for an ASN never overriden", entries, err)
+	}
+	if _, err := h.OverridesAuditLog("AS13335", -1); err == nil {
+		t.Errorf("OverridesAuditLog accepted a negative limit")
+	}
+
+	// Imports and normalizations are audited
+	store := NewMemoryOverrides()
+	imports := newHandler(store, time.Second)
+	if err := WithOverridesAudit(NewMemoryOverridesAudit())(&imports); err != nil {
+		t.Fatal(err)
+	}
+	imports.OverridesSet("AS174", "Cogent (old)")
+	imports.OverridesSet("AS13335", "Cloudflare")
+	start = time.Now()
+	if err := imports.OverridesImport(strings.NewReader(`[{"asn": "AS174", "name": "Cogent"}, {"asn": "AS3356", "name": "Lumen"}]`), true); err != nil {
+		t.Fatalf("OverridesImport failed: %s", err)
+	}
+	updated := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	historical := []AsnOverride{
+		{Asn: "AS64500", Name: "Example", UpdatedAt: updated, Operator: "carol"},
+		{Asn: "AS174", Name: "Cogent Communications", UpdatedAt: time.Now(), UpdatedBy: "dave"},
+	}
+	if _, err := imports.OverridesImportHistorical(historical); err != nil {
+		t.Fatalf("OverridesImportHistorical failed: %s", err)
+	}
+	store.Import(AsnOverride{Asn: "as64501", Name: "Other"})
+	if _, err := imports.OverridesNormalize(); err != nil {
+		t.Fatalf("OverridesNormalize failed: %s", err)
+	}
+	for _, test := range []struct {
+		asn      string
+		expected []OverridesAuditEntry
+	}{
+		{"AS174", []OverridesAuditEntry{
+			{Asn: "AS174", Old: "Cogent", New: "Cogent Communications", Actor: "dave", Action: OverridesAuditUpdated},
+			{Asn: "AS174", Old: "Cogent (old)", New: "Cogent", Action: OverridesAuditUpdated},
+			{Asn: "AS174", New: "Cogent (old)", Action: OverridesAuditCreated},
+		}},
+		{"AS3356", []OverridesAuditEntry{{Asn: "AS3356", New: "Lumen", Action: OverridesAuditCreated}}},
+		{"AS13335", []OverridesAuditEntry{
+			{Asn: "AS13335", Old: "Cloudflare", Action: OverridesAuditRemoved},
+			{Asn: "AS13335", New: "Cloudflare", Action: OverridesAuditCreated},
+		}},
+		{"AS64500", []OverridesAuditEntry{{Asn: "AS64500", New: "Example", Actor: "carol", Time: updated, Action: OverridesAuditCreated}}},
+		{"AS64501", []OverridesAuditEntry{{Asn: "AS64501", New: "Other", Action: OverridesAuditCreated}}},
+	} {
+		entries, err := imports.OverridesAuditLog(test.asn, 0)
+		if err != nil || len(entries) != len(test.expected) {
+			t.Errorf("OverridesAuditLog(%s) answered %+v, %v after imports", test.asn, entries, err)
+			continue
+		}
+		for i, e := range entries {
+			if test.expected[i].Time.IsZero() && !e.Time.IsZero() {
+				e.Time = time.Time{}
+			}
+			if e != test.expected[i] {
+				t.Errorf("OverridesAuditLog(%s) entry %d is %+v, expected %+v", test.asn, i, e, test.expected[i])
+			}
+		}
+	}
+	removed, _ := imports.OverridesAuditLogAll(start, 0)
+	if len(removed) == 0 || removed[0] != (OverridesAuditEntry{Asn: "as64501", Old: "Other", Time: removed[0].Time, Action: OverridesAuditRemoved}) {
+		t.Errorf("OverridesAuditLogAll answered %+v after normalization", removed)
+	}
+
+	// Changes are kept when they cannot be audited
+	h.audit = failingAudit{NewMemoryOverridesAudit()}
+	var auditErr *OverridesAuditError
+	if err := h.OverridesSet("AS174", "Cogent"); !errors.As(err, &auditErr) || auditErr.Asn != "AS174" {
+		t.Fatalf("unaudited OverridesSet failed with %v", err)
+	}
+	if descr, err := h.OverridesLookup("AS174"); err != nil || descr != "Cogent" {
+		t.Fatalf("OverridesLookup answered %q, %v after an unaudited change", descr, err)
+	}
+	if err := h.OverridesRemove("AS174"); !errors.As(err, &auditErr) {
+		t.Fatalf("unaudited OverridesRemove failed with %v", err)
+	}
+	if _, err := h.OverridesLookup("AS174"); err != OverridesAsnNotFoundError {
+		t.Fatalf("OverridesLookup failed with %v after an unaudited removal", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Team Cymru full bogons feeds.
+	bogonsURL4 = "https://www.team-cymru.org/Services/Bogons/fullbogons-ipv4.txt"
+	bogonsURL6 = "https://www.team-cymru.org/Services/Bogons/fullbogons-ipv6.txt"
+	// bogonsRefreshInterval is the default refresh interval of bogon feeds.
+	bogonsRefreshInterval = time.Hour * 6
+	// bogonCacheTTL is the expiration time of a cache entry for a bogon IP.
+	bogonCacheTTL = time.Hour
+)
+
+// BogonIPError is returned on AS lookup of a bogon IP address
+// (see WithBogons).
+var BogonIPError = errors.New("bogon IP address")
+
+// WithBogons makes LookupAsn reject IP addresses
+// in Team Cymru's full bogons lists with BogonIPError,
+// without querying external services.
+// Full bogons include unallocated and unannounced address space.
+//
+// Lists are refreshed every refresh interval.
+// Parameters url4 and url6 override the IPv4 and IPv6 list URLs if not empty.
+// Pass zero refresh for the default interval (6 hours).
+func WithBogons(url4 string, url6 string, refresh time.Duration) Option {
+	return func(h *Handler) error {
+		if url4 == "" {
+			url4 = bogonsURL4
+		}
+		if url6 == "" {
+			url6 = bogonsURL6
+		}
+		if refresh == 0 {
+			refresh = bogonsRefreshInterval
+		}
+		client := h.newHTTPClient()
+		h.bogons = newFeed(h.runs, "bogons", refresh, func(ctx context.Context) (*bogons, error) {
+			return fetchBogons(ctx, client, url4, url6)
+		})
+		return nil
+	}
+}
+
+// isBogon tells if an address is a bogon.
+func (h Handler) isBogon(addr netip.Addr) bool {
+	if h.bogons == nil {
+		return false
+	}
+	b := h.bogons.get()
+	if b == nil {
+		return false
+	}
+	_, _, ok := b.trie.lookup(addr)
+	return ok
+}
+
+// bogons is a set of bogon prefixes.
+type bogons struct {
+	trie *prefixTrie[struct{}]
+	// Oldest update time announced by the lists
+	updated time.Time
+}
+
+// fetchBogons retrieves and merges the IPv4 and IPv6 bogon lists.
+func fetchBogons(ctx context.Context, client *http.Client, urls ...string) (*bogons, error) {
+	b := &bogons{
+		trie: newPrefixTrie[struct{}](),
+	}
+	for _, url := range urls {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to GET '%s': %w", url, err)
+		}
+		updated, err := parseBogons(resp.Body, b.trie)
+		resp.Body.Close()
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GET '%s' failed: %w", url, err)
+		}
+		if b.updated.IsZero() || updated.Before(b.updated) {
+			b.updated = updated
+		}
+	}
+	return b, nil
+}
+
+// parseBogons parses a bogon list into a trie.
+// Lists have one prefix per line, after a header line
+// "# last updated <unix time> (<date>)".
+//
+// Returns the update time announced by the list,
+// or now if there is none.
+func parseBogons(r io.Reader, trie *prefixTrie[struct{}]) (time.Time, error) {
+	updated := time.Now()
+	scanner := bufio.NewScanner(r)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(strings.TrimPrefix(line, "#"))
+			if len(fields) >= 3 && fields[0] == "last" && fields[1] == "updated" {
+				if sec, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+					updated = time.Unix(sec, 0)
+				}
+			}
+			continue
+		}
+		p, err := netip.ParsePrefix(line)
+		if err != nil {
+			return updated, fmt.Errorf("line %d: %w", n, err)
+		}
+		trie.insert(p, struct{}{})
+	}
+	if err := scanner.Err(); err != nil {
+		return updated, err
+	}
+	if trie.len == 0 {
+		return updated, errors.New("empty bogon list")
+	}
+	return updated, nil
+}
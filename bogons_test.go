@@ -0,0 +1,90 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBogons(t *testing.T) {
+	var failing int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) != 0 {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		http.ServeFile(w, r, "testdata/bogons"+r.URL.Path)
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	err := WithBogons(ts.URL+"/fullbogons-ipv4.txt", ts.URL+"/fullbogons-ipv6.txt", time.Hour)(&h)
+	if err != nil {
+		t.Fatalf("WithBogons failed: %s", err)
+	}
+	check := func() {
+		for ip, bogon := range map[string]bool{
+			"41.62.1.1":   true,
+			"102.37.0.1":  true,
+			"2a10:8001::": true,
+			"8.8.8.8":     false,
+			"2a11::1":     false,
+		} {
+			if h.isBogon(netip.MustParseAddr(ip)) != bogon {
+				t.Fatalf("isBogon(%s) did not return %v", ip, bogon)
+			}
+		}
+	}
+	check()
+	status := h.Status()
+	if !status.BogonsUpdated.Equal(time.Unix(1713860101, 0)) || status.Bogons != 8 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	// Failed refreshes keep the previous lists
+	atomic.StoreInt32(&failing, 1)
+	if err := h.bogons.refresh(context.Background()); err == nil {
+		t.Fatalf("expected refresh to fail")
+	}
+	check()
+	// Bogons are rejected and negatively cached
+	for i := 0; i < 2; i++ {
+		if _, err := h.lookupAsn(context.Background(), "41.62.1.1", lookupConfig{}); err != BogonIPError {
+			t.Fatalf("unexpected lookupAsn error: %v", err)
+		}
+		entry, expired, found := h.cache.lookupByIP("41.62.1.1")
+		if !found || expired || entry.err != BogonIPError {
+			t.Fatalf("bogon IP was not negatively cached")
+		}
+	}
+	if asns := h.AsnCacheList(); len(asns) != 0 {
+		t.Fatalf("negative cache entry has an ASN: %v", asns)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of OverridesBreakerConfig
+	breakerFailures     = 5
+	breakerCooldown     = time.Second * 30
+	breakerProbeTimeout = time.Second * 2
+)
+
+// OverridesUnavailableError is returned by OverridesLookup
+// while the overrides circuit breaker is open (see WithOverridesBreaker).
+var OverridesUnavailableError = newClassError("overrides unavailable, circuit breaker open", SourceUnavailableError)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState string
+
+const (
+	// Calls go through
+	BreakerClosed BreakerState = "closed"
+	// Calls are skipped
+	BreakerOpen BreakerState = "open"
+)
+
+// OverridesBreakerConfig configures the circuit breaker
+// of the overrides collection (see WithOverridesBreaker).
+type OverridesBreakerConfig struct {
+	// Number of consecutive failures opening the breaker, zero for 5
+	Failures int
+	// Interval of probes while open, zero for 30 seconds
+	Cooldown time.Duration
+	// Bound of each probe, zero for 2 seconds
+	ProbeTimeout time.Duration
+	// Called on state transitions, such as for metrics
+	OnTransition func(from BreakerState, to BreakerState)
+}
+
+// WithOverridesBreaker makes overrides lookups fail fast
+// while the overrides collection is unreachable:
+// after cfg.Failures consecutive failures, the breaker opens,
+// and OverridesLookup returns OverridesUnavailableError
+// without querying the collection,
+// so that LookupAsn answers upstream data without delay.
+// Such answers are cached by IP address for cfg.Cooldown only.
+// Meanwhile the collection is probed in the background every cfg.Cooldown,
+// and the breaker closes once a probe succeeds.
+//
+// Transitions are logged, passed to cfg.OnTransition,
+// and the breaker state is reported by Status.
+// Handlers derived from the handler share its breaker (see Derive).
+func WithOverridesBreaker(cfg OverridesBreakerConfig) Option {
+	return func(h *Handler) error {
+		if cfg.Failures < 0 || cfg.Cooldown < 0 || cfg.ProbeTimeout < 0 {
+			return fmt.Errorf("invalid overrides breaker config %+v", cfg)
+		}
+		if cfg.Failures == 0 {
+			cfg.Failures = breakerFailures
+		}
+		if cfg.Cooldown == 0 {
+			cfg.Cooldown = breakerCooldown
+		}
+		if cfg.ProbeTimeout == 0 {
+			cfg.ProbeTimeout = breakerProbeTimeout
+		}
+		overrides := h.overrides
+		h.breaker = newBreaker(cfg, h.runs, func(ctx context.Context) error {
+			return pingOverrides(ctx, overrides)
+		})
+		return nil
+	}
+}
+
+// breaker is a circuit breaker.
+type breaker struct {
+	cfg OverridesBreakerConfig
+	// Runs probes
+	runs  *runGroup
+	probe func(ctx context.Context) error
+	// Concurrent access control to fields below
+	sync.Mutex
+	state BreakerState
+	// Consecutive failures
+	failures int
+	// Last transition to open
+	opened time.Time
+	// Number of transitions to open
+	opens uint64
+}
+
+// newBreaker creates a closed breaker.
+func newBreaker(cfg OverridesBreakerConfig, runs *runGroup, probe func(ctx context.Context) error) *breaker {
+	return &breaker{cfg: cfg, runs: runs, probe: probe, state: BreakerClosed}
+}
+
+// do calls op, unless the breaker is open.
+// Failures of op count towards opening the breaker,
+// but the errors in ignore.
+//
+// Returns the error of op, or OverridesUnavailableError if the breaker is open.
+func (b *breaker) do(op func() error, ignore ...error) error {
+	if b == nil {
+		return op()
+	}
+	if b.isOpen() {
+		return OverridesUnavailableError
+	}
+	err := op()
+	for _, e := range ignore {
+		if errors.Is(err, e) {
+			b.record(nil)
+			return err
+		}
+	}
+	b.record(err)
+	return err
+}
+
+// isOpen tells whether the breaker is open.
+func (b *breaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.state == BreakerOpen
+}
+
+// record counts the result of a call,
+// opening the breaker after too many consecutive failures.
+func (b *breaker) record(err error) {
+	b.Lock()
+	defer b.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerOpen || b.failures < b.cfg.Failures {
+		return
+	}
+	b.transition(BreakerOpen)
+	b.opened = time.Now()
+	b.opens++
+	if err := b.runs.run(b.probeLoop); err != nil {
+		// Closed handler: nothing will probe
+		b.transition(BreakerClosed)
+	}
+}
+
+// transition changes the breaker state, with b locked.
+func (b *breaker) transition(to BreakerState) {
+	from := b.state
+	b.state = to
+	b.failures = 0
+	log.Printf("(geoipdb) overrides breaker %s\n", to)
+	if b.cfg.OnTransition != nil {
+		b.cfg.OnTransition(from, to)
+	}
+}
+
+// probeLoop probes every cooldown until a probe succeeds,
+// then closes the breaker.
+func (b *breaker) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.Cooldown)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		pctx, cancel := context.WithTimeout(ctx, b.cfg.ProbeTimeout)
+		err := b.probe(pctx)
+		cancel()
+		if err == nil {
+			b.Lock()
+			b.transition(BreakerClosed)
+			b.Unlock()
+			return
+		}
+		log.Printf("(geoipdb) overrides breaker probe failed: %s\n", err)
+	}
+}
+
+// BreakerStatus is the state of a circuit breaker, for monitoring.
+type BreakerStatus struct {
+	State BreakerState `json:"state"`
+	// Last time the breaker opened, and number of times it did
+	Opened time.Time `json:"opened"`
+	Opens  uint64    `json:"opens"`
+}
+
+// status returns the breaker status.
+func (b *breaker) status() BreakerStatus {
+	b.Lock()
+	defer b.Unlock()
+	return BreakerStatus{State: b.state, Opened: b.opened, Opens: b.opens}
+}
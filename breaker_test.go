@@ -0,0 +1,223 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// fakeOverrides is an overrides store toggled between healthy and failing.
+type fakeOverrides struct {
+	healthy atomic.Bool
+	finds   atomic.Int32
+}
+
+func (f *fakeOverrides) find() error {
+	f.finds.Add(1)
+	if !f.healthy.Load() {
+		return errors.New("no reachable servers")
+	}
+	return mgo.ErrNotFound
+}
+
+func (f *fakeOverrides) ping(ctx context.Context) error {
+	if !f.healthy.Load() {
+		return errors.New("no reachable servers")
+	}
+	return nil
+}
+
+func TestOverridesBreaker(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	var (
+		mu          sync.Mutex
+		transitions []BreakerState
+	)
+	cfg := OverridesBreakerConfig{
+		Failures:     3,
+		Cooldown:     time.Millisecond * 10,
+		ProbeTimeout: time.Second,
+		OnTransition: func(from BreakerState, to BreakerState) {
+			mu.Lock()
+			defer mu.Unlock()
+			transitions = append(transitions, from, to)
+		},
+	}
+	h := newHandler(nil, time.Second)
+	defer h.Close()
+	if err := WithOverridesBreaker(cfg)(&h); err != nil {
+		t.Fatalf("WithOverridesBreaker failed: %s", err)
+	}
+	store := &fakeOverrides{}
+	h.breaker.probe = store.ping
+	// Failures must be consecutive, not found answers are no failures
+	for _, healthy := range []bool{false, false, true, false, false} {
+		store.healthy.Store(healthy)
+		h.breaker.do(store.find, mgo.ErrNotFound)
+	}
+	if h.breaker.isOpen() {
+		t.Fatalf("breaker opened without consecutive failures")
+	}
+	h.breaker.do(store.find, mgo.ErrNotFound)
+	if status := h.Status().OverridesBreaker; status.State != BreakerOpen || status.Opens != 1 {
+		t.Fatalf("unexpected breaker status %+v", status)
+	}
+	// The store is spared while the breaker is open
+	finds := store.finds.Load()
+	if err := h.breaker.do(store.find, mgo.ErrNotFound); err != OverridesUnavailableError || store.finds.Load() != finds {
+		t.Fatalf("open breaker called the store: %v", err)
+	}
+	// Failing probes keep it open
+	time.Sleep(cfg.Cooldown * 5)
+	if !h.breaker.isOpen() {
+		t.Fatalf("breaker closed on failing probes")
+	}
+	// Successful probes close it
+	store.healthy.Store(true)
+	for h.breaker.isOpen() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := h.breaker.do(store.find, mgo.ErrNotFound); err != mgo.ErrNotFound {
+		t.Fatalf("closed breaker returned %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []BreakerState{BreakerClosed, BreakerOpen, BreakerOpen, BreakerClosed}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Fatalf("unexpected transitions %v", transitions)
+	}
+	if err := WithOverridesBreaker(OverridesBreakerConfig{Failures: -1})(&h); err == nil {
+		t.Fatalf("expected an error for a negative threshold")
+	}
+}
+
+// flakyAsnSource is an AsnSource failing while down.
+type flakyAsnSource struct {
+	down    atomic.Bool
+	lookups atomic.Int32
+}
+
+func (s *flakyAsnSource) Name() string {
+	return "flaky"
+}
+
+func (s *flakyAsnSource) Lookup(ctx context.Context, asn string) (string, error) {
+	s.lookups.Add(1)
+	if s.down.Load() {
+		return "", errors.New("connection refused")
+	}
+	return "FLAKY-NAME", nil
+}
+
+func TestSourceBreakers(t *testing.T) {
+	flaky := &flakyAsnSource{}
+	registry := &testAsnSource{name: "registry", descrs: map[string]string{"AS64500": "REGISTRY-NAME"}}
+	var mu sync.Mutex
+	var transitions []string
+	sink := &recordingSink{}
+	h, err := NewHandlerWithStore(NewMemoryOverrides(), time.Second,
+		WithMMDB(testMMDB),
+		WithMetrics(sink),
+		WithAsnSources(flaky, registry),
+		WithSourceBreakers(SourceBreakerConfig{
+			Failures: 3,
+			Cooldown: 50 * time.Millisecond,
+			OnTransition: func(source string, from BreakerState, to BreakerState) {
+				mu.Lock()
+				defer mu.Unlock()
+				transitions = append(transitions, fmt.Sprintf("%s %s>%s", source, from, to))
+			},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	lookup := func(expected string, lookups int32, state BreakerState) {
+		t.Helper()
+		if descr, err := h.LookupAsnFresh("AS64500"); err != nil || descr != expected {
+			t.Errorf("LookupAsnFresh answered %q %v, expected %q", descr, err, expected)
+		}
+		if n := flaky.lookups.Load(); n != lookups {
+			t.Errorf("flaky source queried %d times, expected %d", n, lookups)
+		}
+		if s := h.Status().SourceBreakers["flaky"]; s.State != state {
+			t.Errorf("flaky breaker %+v, expected %s", s, state)
+		}
+	}
+	// Open after consecutive failures, the source is skipped
+	flaky.down.Store(true)
+	lookup("REGISTRY-NAME", 1, BreakerClosed)
+	lookup("REGISTRY-NAME", 2, BreakerClosed)
+	lookup("REGISTRY-NAME", 3, BreakerOpen)
+	sink.take()
+	lookup("REGISTRY-NAME", 3, BreakerOpen)
+	if observations := sink.take(); !slices.Contains(observations, "flaky skipped") {
+		t.Errorf("skipped source not observed: %v", observations)
+	}
+	// Half-open after the cooldown, a failed probe opens it again
+	time.Sleep(60 * time.Millisecond)
+	lookup("REGISTRY-NAME", 4, BreakerOpen)
+	lookup("REGISTRY-NAME", 4, BreakerOpen)
+	// A successful probe closes it
+	flaky.down.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	lookup("FLAKY-NAME", 5, BreakerClosed)
+	lookup("FLAKY-NAME", 6, BreakerClosed)
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		"flaky closed>open",
+		"flaky open>half-open",
+		"flaky half-open>open",
+		"flaky open>half-open",
+		"flaky half-open>closed",
+	}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Errorf("transitions %v, expected %v", transitions, expected)
+	}
+	if s := h.Status().SourceBreakers["flaky"]; s.Opens != 2 {
+		t.Errorf("flaky breaker opened %d times", s.Opens)
+	}
+	if _, ok := h.Status().SourceBreakers["registry"]; ok {
+		t.Error("breaker of a source which never failed reported")
+	}
+	if err := WithSourceBreakers(SourceBreakerConfig{Failures: -1})(&h); err == nil {
+		t.Error("WithSourceBreakers accepted negative failures")
+	}
+}
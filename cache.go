@@ -26,12 +26,25 @@
 package geoipdb
 
 import (
+	"fmt"
+	"math/rand"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// cacheTTL is the expiration time of a cache entry.
-const cacheTTL = time.Hour * 24
+const (
+	// cacheTTL is the default expiration time of a cache entry
+	// (see WithCacheTTL).
+	cacheTTL = time.Hour * 24
+	// negativeCacheTTL is the default expiration time
+	// of failed lookups (see WithNegativeTTL).
+	negativeCacheTTL = time.Minute * 10
+	// cacheCapacity is the default maximum number of cache entries
+	// (see WithCacheCapacity).
+	cacheCapacity = 100000
+)
 
 // cacheEntry is the data we want to keep cached.
 type cacheEntry struct {
@@ -39,73 +52,196 @@ type cacheEntry struct {
 	asn string
 	// ASN description
 	descr string
+	// Regional registry and allocation date
+	// of the BGP prefix (see WithPrefixCache)
+	registry  string
+	allocated time.Time
+	// Reputation (see WithAnnotator)
+	score int
+	tags  []string
+	// Source the ASN was found by
+	source string
+	// Source of the description,
+	// and the descriptions answered by every source consulted
+	// (see LookupAsnDetailed)
+	descrSource string
+	descrs      map[string]string
+	// Whether the entry was answered from cache, by lookupAsn
+	cached bool
+	// Whether the entry is past its soft TTL (see WithSoftTTL),
+	// as answered by lookupByIP
+	stale bool
+	// Error of negative entries
+	err error
+	// Cache generation the entry was looked up at (see storeAt)
+	gen uint64
+	// TTL of this entry
+	ttl time.Duration
 	// Due date of this entry
 	due time.Time
 }
 
+// age returns the time elapsed since an entry was cached,
+// at a given time.
+func (e cacheEntry) age(now time.Time) time.Duration {
+	return e.ttl - e.due.Sub(now)
+}
+
 // cache allows manipulating cached data.
+// Entries are kept in a cacheStore,
+// so that many entries do not slow garbage collection down.
 type cache struct {
-	// Concurrent access control to maps
+	// Concurrent access control to entries
 	*sync.RWMutex
-	// IP to ASN data
-	ip map[string]cacheEntry
-	// ASN to IP list
-	asn map[string]map[string]interface{}
+	// IP to ASN data, and ASN to IP list
+	entries *cacheStore
+	// TTL of entries, shared with derived handlers (see SetCacheTTL),
+	// and soft TTL, zero for none (see WithSoftTTL)
+	ttl  *atomic.Int64
+	soft time.Duration
+	// Fraction of the TTL of entries they expire earlier or later by,
+	// at random (see WithCacheJitter)
+	jitter float64
+	// Clock telling when entries expire (see WithClock)
+	clock Clock
+	// Maximum number of entries, zero for no bound (see WithCacheCapacity)
+	capacity int
+	// Number of entries purged, and evicted
+	purged  *atomic.Uint64
+	evicted *atomic.Uint64
+	// Generation, increased by every purge
+	gen *atomic.Uint64
 }
 
 // newCache returns an empty initialized cache.
 func newCache() cache {
+	gen := &atomic.Uint64{}
+	// Generation zero stands for any (see storeAt)
+	gen.Store(1)
 	return cache{
 		&sync.RWMutex{},
-		make(map[string]cacheEntry),
-		make(map[string]map[string]interface{}),
+		newCacheStore(),
+		newTTL(cacheTTL),
+		0,
+		0,
+		systemClock{},
+		cacheCapacity,
+		&atomic.Uint64{},
+		&atomic.Uint64{},
+		gen,
 	}
 }
 
+// defaultTTL returns the TTL of entries which have none.
+func (c cache) defaultTTL() time.Duration {
+	return time.Duration(c.ttl.Load())
+}
+
+// now returns the time of the cache clock.
+func (c cache) now() time.Time {
+	return c.clock.Now()
+}
+
 // store updates the cache.
-func (c cache) store(ip string, asn string, descr string) {
+// The entry is due after its TTL, or the cache TTL if it has none,
+// with jitter if enabled (see WithCacheJitter).
+// Least recently used entries are evicted past the cache capacity.
+func (c cache) store(ip string, entry cacheEntry) {
+	c.storeAt(ip, entry, 0)
+}
+
+// generation returns the cache generation,
+// to be recorded in entries before their lookup (see storeAt).
+func (c cache) generation() uint64 {
+	return c.gen.Load()
+}
+
+// storeAt is store, unless the cache was purged since a given generation,
+// or zero for any:
+// entries looked up before a purge, such as the purge of an ASN
+// whose override changed, may be outdated already.
+//
+// Returns whether the entry was cached.
+func (c cache) storeAt(ip string, entry cacheEntry, gen uint64) bool {
 	if ip == "" {
-		return
+		return false
+	}
+	if entry.ttl <= 0 {
+		entry.ttl = c.defaultTTL()
 	}
+	entry.ttl = jitterTTL(entry.ttl, c.jitter)
+	entry.due = c.now().Add(entry.ttl)
 	c.Lock()
 	defer c.Unlock()
-	// Purge ASN map of given ip
-	for _, ips := range c.asn {
-		delete(ips, ip)
-	}
-	// Purge ASN map of empty entries
-	for asn, ips := range c.asn {
-		if len(ips) < 1 {
-			delete(c.asn, asn)
-		}
+	if gen != 0 && c.gen.Load() != gen {
+		return false
 	}
-	// Update IP map
-	c.ip[ip] = cacheEntry{
-		asn:   asn,
-		descr: descr,
-		due:   time.Now().Add(cacheTTL),
+	c.insertLocked(ip, entry)
+	return true
+}
+
+// insertLocked caches an entry as most recently used,
+// evicting the least recently used entries past the cache capacity.
+// The cache must be write locked.
+func (c cache) insertLocked(ip string, entry cacheEntry) {
+	c.entries.set(ip, entry)
+	for c.capacity > 0 && c.entries.len() > c.capacity {
+		c.entries.evict()
+		c.evicted.Add(1)
 	}
-	// Update ASN map
-	if c.asn[asn] == nil {
-		c.asn[asn] = make(map[string]interface{})
+}
+
+// restore caches an entry as it was saved (see LoadCache),
+// due at its original time,
+// unless ip has an unexpired entry already.
+//
+// Returns whether the entry was cached.
+func (c cache) restore(ip string, entry cacheEntry) bool {
+	c.Lock()
+	defer c.Unlock()
+	if cached, ok := c.entries.get(ip, false); ok && c.now().Before(cached.due) {
+		return false
 	}
-	c.asn[asn][ip] = nil
+	c.insertLocked(ip, entry)
+	return true
+}
+
+// snapshot returns the cached IP addresses and their entries,
+// least recently used first.
+func (c cache) snapshot() ([]string, []cacheEntry) {
+	c.RLock()
+	defer c.RUnlock()
+	ips := make([]string, 0, c.entries.len())
+	entries := make([]cacheEntry, 0, c.entries.len())
+	c.entries.eachByUse(func(ip string, entry cacheEntry) {
+		ips = append(ips, ip)
+		entries = append(entries, entry)
+	})
+	return ips, entries
 }
 
 // lookupByIP retrieves cached data by IP address.
 //
 // Returns
-// the ASN identification and description,
+// the cache entry, marked stale if past the soft TTL,
 // if cached data is expired,
 // and if ip was found in cache.
-func (c cache) lookupByIP(ip string) (asn string, descr string, expired bool, found bool) {
-	c.RLock()
-	defer c.RUnlock()
-	entry, ok := c.ip[ip]
+func (c cache) lookupByIP(ip string) (entry cacheEntry, expired bool, found bool) {
+	if c.capacity > 0 {
+		// Lookups mark entries recently used
+		c.Lock()
+		defer c.Unlock()
+	} else {
+		c.RLock()
+		defer c.RUnlock()
+	}
+	entry, ok := c.entries.get(ip, c.capacity > 0)
 	if !ok {
-		return "", "", false, false
+		return cacheEntry{}, false, false
 	}
-	return entry.asn, entry.descr, time.Now().After(entry.due), true
+	now := c.now()
+	entry.stale = c.soft > 0 && entry.age(now) >= c.soft
+	return entry, now.After(entry.due), true
 }
 
 // lookupByASN retrieves the list of cached IPs associated with a given ASN.
@@ -114,36 +250,128 @@ func (c cache) lookupByIP(ip string) (asn string, descr string, expired bool, fo
 func (c cache) lookupByASN(asn string) map[string]interface{} {
 	c.RLock()
 	defer c.RUnlock()
-	answer, ok := c.asn[asn]
-	if !ok || answer == nil {
-		return make(map[string]interface{})
+	return c.entries.keys(asn)
+}
+
+// lookupASNEntry retrieves the most recently cached entry of a given ASN.
+//
+// Returns the cache entry and whether the ASN was found in cache.
+func (c cache) lookupASNEntry(asn string) (cacheEntry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	n, ok := c.entries.asns[asn]
+	if !ok {
+		return cacheEntry{}, false
 	}
-	return answer
+	return c.entries.entry(c.entries.record(n)), true
 }
 
 // purgeASN removes from the cache all information related to a given ASN.
 func (c cache) purgeASN(asn string) {
 	c.Lock()
 	defer c.Unlock()
-	// Purge ip map of given asn
-	for ip, entry := range c.ip {
-		if entry.asn == asn {
-			delete(c.ip, ip)
+	c.gen.Add(1)
+	n := c.entries.len()
+	c.entries.removeASN(asn)
+	c.purged.Add(uint64(n - c.entries.len()))
+}
+
+// purgePrefix removes from the cache the IP addresses within a given prefix.
+func (c cache) purgePrefix(prefix netip.Prefix) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen.Add(1)
+	c.entries.each(func(n uint32, ip string, entry cacheEntry) bool {
+		addr, err := netip.ParseAddr(ip)
+		if err == nil && prefix.Contains(addr.Unmap()) {
+			c.entries.remove(n)
+			c.purged.Add(1)
 		}
-	}
-	// Purge asn map of given asn
-	delete(c.asn, asn)
+		return true
+	})
+}
+
+// purgeSource removes from the cache the entries
+// whose ASN or description was found by a given source.
+func (c cache) purgeSource(source string) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen.Add(1)
+	c.entries.each(func(n uint32, ip string, entry cacheEntry) bool {
+		if entry.source == source || entry.descrSource == source {
+			c.entries.remove(n)
+			c.purged.Add(1)
+		}
+		return true
+	})
 }
 
 // purgeAll removes all entries from the cache
 func (c cache) purgeAll() {
 	c.Lock()
 	defer c.Unlock()
-	for ip, _ := range c.ip {
-		delete(c.ip, ip)
+	c.gen.Add(1)
+	c.purged.Add(uint64(c.entries.len()))
+	*c.entries = *newCacheStore()
+}
+
+// len returns the number of cached IP addresses.
+func (c cache) len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.entries.len()
+}
+
+// keys returns the cached IP addresses.
+func (c cache) keys() []string {
+	c.RLock()
+	defer c.RUnlock()
+	var answer []string
+	c.entries.each(func(n uint32, ip string, entry cacheEntry) bool {
+		answer = append(answer, ip)
+		return true
+	})
+	return answer
+}
+
+// fillSources are the sources counted by cacheCounters,
+// as filling the cache with ASNs they found.
+var fillSources = [...]string{SourceGeoIP, SourceMMDB, SourceIpinfo, SourceCymru, SourceFixtures}
+
+// jitterTTL spreads a TTL by up to a fraction of it, at random.
+func jitterTTL(ttl time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return ttl
 	}
-	for asn, _ := range c.asn {
-		delete(c.asn, asn)
+	return ttl + time.Duration((rand.Float64()*2-1)*jitter*float64(ttl))
+}
+
+// cacheCounters count LookupAsn cache hits, misses and fills.
+type cacheCounters struct {
+	exactHits  atomic.Uint64
+	prefixHits atomic.Uint64
+	misses     atomic.Uint64
+	// Entries cached, by source in fillSources
+	fills [len(fillSources)]atomic.Uint64
+}
+
+// fill counts an entry cached with an ASN found by a given source.
+func (c *cacheCounters) fill(source string) {
+	for i, s := range fillSources {
+		if s == source {
+			c.fills[i].Add(1)
+			return
+		}
+	}
+}
+
+// reset zeroes the counters.
+func (c *cacheCounters) reset() {
+	c.exactHits.Store(0)
+	c.prefixHits.Store(0)
+	c.misses.Store(0)
+	for i := range c.fills {
+		c.fills[i].Store(0)
 	}
 }
 
@@ -153,11 +381,91 @@ func (c cache) purgeAll() {
 func (c cache) asnList() []string {
 	c.RLock()
 	defer c.RUnlock()
-	answer := make([]string, len(c.asn))
-	var i int
-	for asn := range c.asn {
-		answer[i] = asn
-		i++
+	answer := make([]string, 0, len(c.entries.asns))
+	for asn := range c.entries.asns {
+		answer = append(answer, asn)
 	}
 	return answer
 }
+
+// AsnCacheStats are LookupAsn cache counters.
+type AsnCacheStats struct {
+	// Cached IP addresses, and BGP prefixes (see WithPrefixCache)
+	Entries  int
+	Prefixes int
+	// Lookups answered by IP address, by covering BGP prefix,
+	// and not answered by the cache
+	ExactHits  uint64
+	PrefixHits uint64
+	Misses     uint64
+	// Cached IP addresses purged (see AsnCachePurge and OverridesSet),
+	// and evicted past the cache capacity (see WithCacheCapacity)
+	Purges    uint64
+	Evictions uint64
+	// Answers cached, by source of their ASN (SourceCymru...),
+	// of the sources which cached any
+	Fills map[string]uint64
+}
+
+// CacheStats are the handler cache counters, by cache.
+type CacheStats struct {
+	// ASN is the cache of LookupAsn.
+	ASN AsnCacheStats
+	// Query is the query cache of text protocol sources,
+	// zero if disabled.
+	Query QueryCacheStats
+}
+
+// CacheStats returns the handler cache counters,
+// cumulated since the handler creation or ResetCacheStats.
+func (h Handler) CacheStats() CacheStats {
+	stats := CacheStats{
+		ASN: AsnCacheStats{
+			Entries:    h.cache.len(),
+			Prefixes:   h.prefixes.len(),
+			ExactHits:  h.counters.exactHits.Load(),
+			PrefixHits: h.counters.prefixHits.Load(),
+			Misses:     h.counters.misses.Load(),
+			Purges:     h.cache.purged.Load(),
+			Evictions:  h.cache.evicted.Load(),
+			Fills:      make(map[string]uint64),
+		},
+	}
+	for i, source := range fillSources {
+		if n := h.counters.fills[i].Load(); n > 0 {
+			stats.ASN.Fills[source] = n
+		}
+	}
+	if h.queries != nil {
+		stats.Query = h.queries.Stats()
+	}
+	return stats
+}
+
+// ResetCacheStats zeroes the LookupAsn cache counters (see CacheStats).
+// Cached entries are kept.
+func (h Handler) ResetCacheStats() {
+	h.counters.reset()
+	h.cache.purged.Store(0)
+	h.cache.evicted.Store(0)
+}
+
+// WithCacheCapacity bounds the number of IP addresses
+// cached by LookupAsn, 100000 by default, or unbounds it if zero:
+// past the capacity, least recently used addresses are evicted.
+// It bounds the number of BGP prefixes cached alike (see WithPrefixCache),
+// evicting the oldest ones.
+// Tenants of derived handlers have their own cache of this capacity
+// (see Derive).
+func WithCacheCapacity(n int) Option {
+	return func(h *Handler) error {
+		if n < 0 {
+			return fmt.Errorf("negative cache capacity %d", n)
+		}
+		h.cache.capacity, h.prefixes.capacity = n, n
+		if h.tenant == "" {
+			h.shared.cache.capacity, h.shared.prefixes.capacity = n, n
+		}
+		return nil
+	}
+}
@@ -0,0 +1,789 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// scanIPs returns the addresses of 8.8.8.0/24 and 1.1.1.0/24,
+// in order, as a scan would look them up.
+func scanIPs() []string {
+	var ips []string
+	for _, net := range []string{"8.8.8", "1.1.1"} {
+		for i := 0; i < 256; i++ {
+			ips = append(ips, fmt.Sprintf("%s.%d", net, i))
+		}
+	}
+	return ips
+}
+
+func TestPrefixCache(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	for _, prefixMode := range []bool{false, true} {
+		h := NewFixtureHandler()
+		if prefixMode {
+			if err := WithPrefixCache()(&h); err != nil {
+				t.Fatalf("WithPrefixCache failed: %s", err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			for _, ip := range scanIPs() {
+				if _, _, err := h.LookupAsn(ip); err != nil {
+					t.Fatalf("LookupAsn(%s) failed: %s", ip, err)
+				}
+			}
+		}
+		expected := AsnCacheStats{Entries: 512, ExactHits: 512, Misses: 512,
+			Fills: map[string]uint64{SourceFixtures: 512}}
+		if prefixMode {
+			expected = AsnCacheStats{Prefixes: 2, PrefixHits: 1022, Misses: 2,
+				Fills: map[string]uint64{SourceFixtures: 2}}
+		}
+		if stats := h.CacheStats().ASN; !reflect.DeepEqual(stats, expected) {
+			t.Fatalf("prefix mode %v: unexpected stats %+v", prefixMode, stats)
+		}
+		// Purging an ASN purges its prefixes
+		h.OverridesRemove("AS13335")
+		if stats := h.CacheStats().ASN; prefixMode && stats.Prefixes != 1 {
+			t.Fatalf("unexpected stats after purge: %+v", stats)
+		}
+	}
+}
+
+func BenchmarkLookupAsnScan(b *testing.B) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	ips := scanIPs()
+	for _, prefixMode := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prefix=%v", prefixMode), func(b *testing.B) {
+			b.ReportAllocs()
+			var misses uint64
+			for i := 0; i < b.N; i++ {
+				h := NewFixtureHandler()
+				h.prefixMode = prefixMode
+				for _, ip := range ips {
+					h.LookupAsn(ip)
+				}
+				misses += h.CacheStats().ASN.Misses
+			}
+			b.ReportMetric(float64(misses)/float64(b.N), "misses/scan")
+		})
+	}
+}
+
+func TestSoftTTL(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	var requests int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Write([]byte("AS64500 Before\n"))
+			return
+		}
+		<-release
+		w.Write([]byte("AS64501 After\n"))
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	h.ipinfo.baseURL = ts.URL
+	if err := WithSoftTTL(CacheASN, time.Nanosecond)(&h); err != nil {
+		t.Fatalf("WithSoftTTL failed: %s", err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	info, err := h.LookupIpInfo(ctx, "8.8.8.8")
+	if err != nil || info.Asn != "AS64500" || info.Stale {
+		t.Fatalf("unexpected first answer: %+v, %v", info, err)
+	}
+	// Stale entries are answered, and revalidated once
+	for i := 0; i < 10; i++ {
+		info, err := h.LookupIpInfo(ctx, "8.8.8.8")
+		if err != nil || info.Asn != "AS64500" || !info.Stale {
+			t.Fatalf("unexpected stale answer: %+v, %v", info, err)
+		}
+	}
+	close(release)
+	for {
+		if entry, _, _ := h.cache.lookupByIP("8.8.8.8"); entry.asn == "AS64501" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if r := atomic.LoadInt32(&requests); r != 2 {
+		t.Fatalf("expected 2 requests, got %d", r)
+	}
+	// Entries past their hard TTL are not answered
+	h.cache.store("8.8.4.4", cacheEntry{asn: "AS64500", ttl: time.Nanosecond})
+	if _, expired, _ := h.cache.lookupByIP("8.8.4.4"); !expired {
+		t.Fatalf("entry not expired past its hard TTL")
+	}
+	// Prefix cache entries have their own soft TTL
+	h = NewFixtureHandler()
+	WithPrefixCache()(&h)
+	if err := WithSoftTTL(CachePrefix, time.Nanosecond)(&h); err != nil {
+		t.Fatalf("WithSoftTTL failed: %s", err)
+	}
+	defer h.Close()
+	for _, stale := range []bool{false, true} {
+		info, err := h.LookupIpInfo(ctx, "9.9.9.9")
+		if err != nil || info.Asn != "AS19281" || info.Stale != stale {
+			t.Fatalf("unexpected prefix cache answer: %+v, %v", info, err)
+		}
+	}
+	for _, class := range []CacheClass{"ptr", CacheASN} {
+		if err := WithSoftTTL(class, -time.Second)(&h); err == nil {
+			t.Fatalf("expected an error for class %s", class)
+		}
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	s := newCacheStore()
+	ref := make(map[string]cacheEntry)
+	rng := rand.New(rand.NewSource(1))
+	var written int
+	for i := 0; i < 20000; i++ {
+		switch op := rng.Intn(100); {
+		case op < 2:
+			asn := fmt.Sprintf("AS%d", rng.Intn(10))
+			s.removeASN(asn)
+			for key, entry := range ref {
+				if entry.err == nil && entry.asn == asn {
+					delete(ref, key)
+				}
+			}
+		case op < 10:
+			key := fmt.Sprintf("192.0.2.%d", rng.Intn(500))
+			if n := s.find(key); n != 0 {
+				s.remove(n)
+			}
+			delete(ref, key)
+		default:
+			key := fmt.Sprintf("192.0.2.%d", rng.Intn(500))
+			entry := cacheEntry{
+				asn:   fmt.Sprintf("AS%d", rng.Intn(10)),
+				descr: strings.Repeat(string(rune('A'+rng.Intn(26))), 1024),
+				score: rng.Intn(100),
+				ttl:   time.Hour,
+				due:   time.Unix(0, rng.Int63()),
+			}
+			switch rng.Intn(4) {
+			case 0:
+				entry.err = BogonIPError
+			case 1:
+				entry.tags = []string{"abuse", "seen"}
+				entry.allocated = time.Date(2011, 8, 11, 0, 0, 0, 0, time.UTC)
+			}
+			s.set(key, entry)
+			ref[key] = entry
+			written += len(key) + len(entry.asn) + len(entry.descr)
+		}
+	}
+	if s.size >= written/2 {
+		t.Fatalf("store never compacted: %d bytes of %d written", s.size, written)
+	}
+	if s.len() != len(ref) {
+		t.Fatalf("store holds %d entries, expected %d", s.len(), len(ref))
+	}
+	var lru int
+	for n := s.lruHead; n != 0; n = s.record(n).lruNext {
+		lru++
+	}
+	if lru != s.len() {
+		t.Fatalf("recently used list holds %d entries, expected %d", lru, s.len())
+	}
+	byASN := make(map[string]map[string]interface{})
+	for key, expected := range ref {
+		entry, ok := s.get(key, false)
+		if !ok || !reflect.DeepEqual(entry, expected) {
+			t.Fatalf("entry of %s is %+v, expected %+v", key, entry, expected)
+		}
+		if expected.err == nil {
+			if byASN[expected.asn] == nil {
+				byASN[expected.asn] = make(map[string]interface{})
+			}
+			byASN[expected.asn][key] = nil
+		}
+	}
+	if len(s.asns) != len(byASN) {
+		t.Fatalf("store holds %d ASNs, expected %d", len(s.asns), len(byASN))
+	}
+	for asn, keys := range byASN {
+		if !reflect.DeepEqual(s.keys(asn), keys) {
+			t.Fatalf("unexpected keys of %s", asn)
+		}
+	}
+}
+
+// BenchmarkCacheGC measures garbage collections
+// with 10M entries in the ASN cache (1M with -short).
+func BenchmarkCacheGC(b *testing.B) {
+	n := 10000000
+	if testing.Short() {
+		n = 1000000
+	}
+	c := newCache()
+	c.capacity = 0
+	for i := 0; i < n; i++ {
+		key := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}).String()
+		asn := fmt.Sprintf("AS%d", 64500+i%100)
+		c.store(key, cacheEntry{asn: asn, descr: asn + " EXAMPLE, US", registry: "arin", source: SourceCymru})
+	}
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "pause-ns/gc")
+	b.ReportMetric(float64(after.HeapAlloc)/float64(n), "heap-B/entry")
+	runtime.KeepAlive(c)
+}
+
+func TestNegativeCache(t *testing.T) {
+	var requests, queries int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/9.9.9.9/org" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("AS19281\n"))
+	}))
+	defer ts.Close()
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	h.ipinfo.baseURL = ts.URL
+	// Team Cymru knows nothing
+	h.resolver.server = startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		testDNSZone{}.serve(w, req)
+	})
+	network := func() int32 {
+		return atomic.LoadInt32(&requests) + atomic.LoadInt32(&queries)
+	}
+	ctx := context.Background()
+	// ASN without description
+	for i := 0; i < 2; i++ {
+		asn, descr, err := h.LookupAsn("9.9.9.9")
+		if err != nil || asn != "AS19281" || descr != "" {
+			t.Fatalf("LookupAsn returned %q, %q, %v", asn, descr, err)
+		}
+		if n := network(); n != 2 {
+			t.Fatalf("expected 2 network requests, got %d", n)
+		}
+	}
+	if entry, _, _ := h.cache.lookupByIP("9.9.9.9"); entry.ttl != negativeCacheTTL {
+		t.Fatalf("ASN without description cached for %s", entry.ttl)
+	}
+	if err := h.OverridesSet("AS19281", "Quad9"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	if asn, descr, err := h.LookupAsn("9.9.9.9"); err != nil || asn != "AS19281" || descr != "Quad9" {
+		t.Fatalf("LookupAsn returned %q, %q, %v after OverridesSet", asn, descr, err)
+	}
+	// IP address without ASN, unless restricted to some sources
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&queries, 0)
+	if _, _, err := h.LookupAsnCtx(ctx, "5.5.5.5", WithSources(SourceCache)); err == nil {
+		t.Fatalf("restricted lookup found an ASN")
+	}
+	for i := 0; i < 2; i++ {
+		if asn, _, err := h.LookupAsn("5.5.5.5"); err == nil {
+			t.Fatalf("LookupAsn found %s", asn)
+		}
+		if n := network(); n != 2 {
+			t.Fatalf("expected 2 network requests, got %d", n)
+		}
+	}
+	// ASN without description, by LookupAsnDescr
+	atomic.StoreInt32(&queries, 0)
+	for i := 0; i < 2; i++ {
+		if descr, err := h.LookupAsnDescr(ctx, "AS64500"); err == nil {
+			t.Fatalf("LookupAsnDescr found %q", descr)
+		}
+		if _, errs := h.LookupAsnBatch(ctx, []string{"AS64500"}, 0); errs["AS64500"] == nil {
+			t.Fatalf("LookupAsnBatch found a description")
+		}
+		if q := atomic.LoadInt32(&queries); q != 1 {
+			t.Fatalf("expected 1 DNS query, got %d", q)
+		}
+	}
+	if err := h.OverridesSet("AS64500", "Example"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	if descr, err := h.LookupAsnDescr(ctx, "AS64500"); err != nil || descr != "Example" {
+		t.Fatalf("LookupAsnDescr returned %q, %v after OverridesSet", descr, err)
+	}
+	// Disabled
+	if err := WithNegativeTTL(-time.Second)(&h); err == nil {
+		t.Fatalf("WithNegativeTTL accepted a negative TTL")
+	}
+	if err := WithNegativeTTL(0)(&h); err != nil {
+		t.Fatalf("WithNegativeTTL failed: %s", err)
+	}
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&queries, 0)
+	for i := 0; i < 2; i++ {
+		h.LookupAsn("5.5.5.6")
+		h.LookupAsnDescr(ctx, "AS64501")
+	}
+	if n := network(); n != 6 {
+		t.Fatalf("expected 6 network requests without negative caching, got %d", n)
+	}
+}
+
+func TestNegativeCacheErrors(t *testing.T) {
+	// Errors are freed with the last entry having them
+	s := newCacheStore()
+	for i := 0; i < 10000; i++ {
+		s.set(fmt.Sprintf("192.0.2.%d", i), cacheEntry{err: fmt.Errorf("error %d", i)})
+		if s.len() > 100 {
+			s.evict()
+		}
+		if i%3 == 0 {
+			s.set(fmt.Sprintf("192.0.2.%d", i), cacheEntry{asn: "AS64500"})
+		}
+	}
+	if len(s.errs) > 101 {
+		t.Fatalf("%d errors kept for %d entries", len(s.errs), s.len())
+	}
+	s.each(func(n uint32, key string, entry cacheEntry) bool {
+		if entry.err != nil && entry.err.Error() != "error "+strings.TrimPrefix(key, "192.0.2.") {
+			t.Fatalf("entry of %s has error %q", key, entry.err)
+		}
+		return true
+	})
+	// Cached unknown ASNs share their error, still telling their address
+	h := NewFixtureHandler()
+	if err := WithCacheCapacity(100)(&h); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("4.4.%d.%d", i/256, i%256)
+		for j := 0; j < 2; j++ {
+			_, _, err := h.LookupAsn(ip)
+			if !errors.Is(err, AsnNotFoundError) || !strings.Contains(err.Error(), ip) {
+				t.Fatalf("LookupAsn(%s) failed with %v", ip, err)
+			}
+		}
+	}
+	if n := len(h.cache.entries.errs); n != 1 {
+		t.Fatalf("%d errors kept for unknown ASNs", n)
+	}
+}
+
+func TestCacheStatsConcurrency(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	h := NewFixtureHandler()
+	ips := scanIPs()
+	const workers = 8
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range ips {
+				ip := ips[(i+w*64)%len(ips)]
+				if _, _, err := h.LookupAsn(ip); err != nil {
+					t.Errorf("LookupAsn(%s) failed: %s", ip, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	stats := h.CacheStats().ASN
+	if calls := uint64(workers * len(ips)); stats.ExactHits+stats.Misses != calls {
+		t.Fatalf("%d hits and %d misses for %d calls", stats.ExactHits, stats.Misses, calls)
+	}
+	// Concurrent misses of an IP address share a fill
+	if fills := stats.Fills[SourceFixtures]; fills > stats.Misses || fills < uint64(len(ips)) || stats.Entries != len(ips) {
+		t.Fatalf("unexpected stats after concurrent lookups: %+v", stats)
+	}
+	// Purges are counted, and counters survive them
+	h.OverridesRemove("AS15169")
+	stats = h.CacheStats().ASN
+	if stats.Purges != 256 || stats.Entries != 256 || stats.ExactHits+stats.Misses != uint64(workers*len(ips)) {
+		t.Fatalf("unexpected stats after purge: %+v", stats)
+	}
+	h.ResetCacheStats()
+	if stats := h.CacheStats().ASN; !reflect.DeepEqual(stats, AsnCacheStats{Entries: 256, Fills: map[string]uint64{}}) {
+		t.Fatalf("unexpected stats after reset: %+v", stats)
+	}
+}
+
+func TestCacheCapacity(t *testing.T) {
+	c := newCache()
+	c.capacity = 3
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		c.store(ip, cacheEntry{asn: "AS64496"})
+	}
+	// 192.0.2.2 is then the least recently used
+	c.lookupByIP("192.0.2.1")
+	c.store("192.0.2.3", cacheEntry{asn: "AS64497"})
+	c.store("192.0.2.4", cacheEntry{asn: "AS64496"})
+	c.store("192.0.2.5", cacheEntry{asn: "AS64496"})
+	for ip, cached := range map[string]bool{
+		"192.0.2.1": false, "192.0.2.2": false, "192.0.2.3": true, "192.0.2.4": true, "192.0.2.5": true,
+	} {
+		if _, _, found := c.lookupByIP(ip); found != cached {
+			t.Fatalf("%s cached: %v, expected %v", ip, found, cached)
+		}
+	}
+	if n := c.evicted.Load(); n != 2 {
+		t.Fatalf("%d entries evicted, expected 2", n)
+	}
+	// Purges free room
+	c.purgeASN("AS64497")
+	c.store("192.0.2.6", cacheEntry{asn: "AS64496"})
+	if n := c.evicted.Load(); n != 2 || c.len() != 3 {
+		t.Fatalf("%d entries evicted, %d cached after purge", n, c.len())
+	}
+	if ips := c.lookupByASN("AS64496"); len(ips) != 3 {
+		t.Fatalf("unexpected IPs of AS64496: %v", ips)
+	}
+	// Expired entries are kept until evicted
+	c.store("192.0.2.7", cacheEntry{asn: "AS64496", ttl: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	if _, expired, found := c.lookupByIP("192.0.2.7"); !found || !expired {
+		t.Fatalf("expired entry found: %v, expired: %v", found, expired)
+	}
+	// Handlers
+	h := NewFixtureHandler()
+	if err := WithCacheCapacity(-1)(&h); err == nil {
+		t.Fatalf("WithCacheCapacity accepted a negative capacity")
+	}
+	if err := WithCacheCapacity(10)(&h); err != nil {
+		t.Fatalf("WithCacheCapacity failed: %s", err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, ip := range scanIPs()[:100] {
+				h.LookupAsn(ip)
+			}
+		}()
+	}
+	wg.Wait()
+	// Concurrent misses of an address store it once
+	if stats := h.CacheStats().ASN; stats.Entries != 10 || stats.Evictions < 90 || stats.Evictions > stats.Misses-10 {
+		t.Fatalf("unexpected stats past capacity: %+v", stats)
+	}
+}
+
+// BenchmarkLookupAsnCapacity measures cached LookupAsn calls,
+// with an unbounded cache, and the default LRU one.
+func BenchmarkLookupAsnCapacity(b *testing.B) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	ips := scanIPs()
+	for _, capacity := range []int{0, cacheCapacity} {
+		b.Run(fmt.Sprintf("capacity=%d", capacity), func(b *testing.B) {
+			h := NewFixtureHandler()
+			if err := WithCacheCapacity(capacity)(&h); err != nil {
+				b.Fatalf("WithCacheCapacity failed: %s", err)
+			}
+			for _, ip := range ips {
+				h.LookupAsn(ip)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					h.LookupAsn(ips[i%len(ips)])
+				}
+			})
+		})
+	}
+}
+
+func TestHandlerConcurrency(t *testing.T) {
+	h, err := NewHandlerWithStore(NewMemoryOverrides(), time.Second, WithMMDB(testMMDB), WithCacheCapacity(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	asns := map[string]string{"AS15169": "GOOGLE", "AS13335": "CLOUDFLARENET"}
+	const workers = 32
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				asn, ip := "AS15169", fmt.Sprintf("8.8.8.%d", (w*7+i)%256)
+				if i%2 == 1 {
+					asn, ip = "AS13335", fmt.Sprintf("1.1.1.%d", (w*7+i)%256)
+				}
+				switch (w + i) % 8 {
+				case 0:
+					if err := h.OverridesSet(asn, fmt.Sprintf("override %d", w)); err != nil {
+						t.Errorf("OverridesSet(%s) failed: %s", asn, err)
+					}
+				case 1:
+					if err := h.OverridesRemove(asn); err != nil {
+						t.Errorf("OverridesRemove(%s) failed: %s", asn, err)
+					}
+				case 2:
+					for _, cached := range h.LookupIp(asn) {
+						if !strings.HasPrefix(cached, ip[:6]) {
+							t.Errorf("LookupIp(%s) answered %s", asn, cached)
+						}
+					}
+				default:
+					answer, descr, err := h.LookupAsn(ip)
+					if err != nil || answer != asn || descr != asns[asn] && !strings.HasPrefix(descr, "override ") {
+						t.Errorf("LookupAsn(%s) answered %q %q %v", ip, answer, descr, err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if stats := h.CacheStats().ASN; stats.Entries > 64 {
+		t.Errorf("%d entries cached past the capacity", stats.Entries)
+	}
+	// Answers looked up before an override change are not cached
+	gen := h.cache.generation()
+	if err := h.OverridesSet("AS15169", "Google"); err != nil {
+		t.Fatal(err)
+	}
+	if h.cache.storeAt("8.8.8.8", cacheEntry{asn: "AS15169", descr: "GOOGLE"}, gen) {
+		t.Errorf("outdated answer cached")
+	}
+	if _, descr, err := h.LookupAsn("8.8.8.8"); err != nil || descr != "Google" {
+		t.Errorf("LookupAsn answered %q %v after override change", descr, err)
+	}
+}
+
+// fakeClock is a Clock told what time it is.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h := NewFixtureHandler()
+	for _, opt := range []Option{WithClock(clock), WithCacheTTL(time.Hour)} {
+		if err := opt(&h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// lookup looks ip up, telling whether it was cached
+	lookup := func(ip string) bool {
+		t.Helper()
+		before := h.CacheStats().ASN.ExactHits
+		if _, _, err := h.LookupAsn(ip); err != nil {
+			t.Fatal(err)
+		}
+		return h.CacheStats().ASN.ExactHits > before
+	}
+	for _, step := range []struct {
+		advance time.Duration
+		ip      string
+		cached  bool
+	}{
+		{0, "8.8.8.8", false},
+		{time.Minute * 59, "8.8.8.8", true},
+		{time.Minute * 2, "8.8.8.8", false},
+	} {
+		clock.advance(step.advance)
+		if cached := lookup(step.ip); cached != step.cached {
+			t.Fatalf("lookup of %s cached %v after %s, expected %v", step.ip, cached, step.advance, step.cached)
+		}
+	}
+	// Changing the TTL does not affect cached entries
+	if err := h.SetCacheTTL(time.Minute * 10); err != nil {
+		t.Fatal(err)
+	}
+	lookup("1.1.1.1")
+	clock.advance(time.Minute * 11)
+	if !lookup("8.8.8.8") {
+		t.Errorf("entry cached before SetCacheTTL expired early")
+	}
+	if lookup("1.1.1.1") {
+		t.Errorf("entry cached after SetCacheTTL expired late")
+	}
+	if err := h.SetCacheTTL(0); err == nil {
+		t.Errorf("SetCacheTTL accepted a zero TTL")
+	}
+	// Listed prefixes expire by the clock too
+	h.prefixes.store(AsnInfo{Asn: "AS64500", Prefix: netip.MustParsePrefix("192.0.2.0/24")})
+	if infos := h.prefixes.list(); len(infos) != 1 {
+		t.Fatalf("%d prefixes listed, expected 1", len(infos))
+	}
+	clock.advance(time.Minute * 11)
+	if infos := h.prefixes.list(); len(infos) != 0 {
+		t.Errorf("expired prefixes listed: %+v", infos)
+	}
+}
+
+func TestCacheJitter(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := newCache()
+	c.capacity, c.clock, c.jitter = 0, clock, 0.1
+	c.ttl.Store(int64(time.Hour))
+	earliest, latest := clock.now.Add(time.Hour), clock.now.Add(time.Hour)
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		c.store(ip, cacheEntry{asn: "AS64500"})
+		entry, _, _ := c.lookupByIP(ip)
+		if entry.due.Before(earliest) {
+			earliest = entry.due
+		}
+		if entry.due.After(latest) {
+			latest = entry.due
+		}
+		if entry.age(clock.now) != 0 {
+			t.Fatalf("entry of age %s cached", entry.age(clock.now))
+		}
+	}
+	if min, max := earliest.Sub(clock.now), latest.Sub(clock.now); min < time.Minute*54 || max > time.Minute*66 || min > time.Minute*57 || max < time.Minute*63 {
+		t.Errorf("entries due in %s to %s, expected 1h ± 10%%", min, max)
+	}
+	if err := WithCacheJitter(1)(&Handler{}); err == nil {
+		t.Errorf("WithCacheJitter accepted a jitter of 100%%")
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if strings.Contains(r.URL.Path, "5.5.5.5") {
+			fmt.Fprintln(w, "AS64501")
+		} else {
+			fmt.Fprintln(w, "AS64500")
+		}
+	}))
+	defer ts.Close()
+	registry := &testAsnSource{name: "registry", descrs: map[string]string{
+		"AS64500": "EXAMPLE-NET",
+		"AS64501": "OTHER-NET",
+	}}
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, testDNSZone{}.serve)
+	h.ipinfo.baseURL = ts.URL
+	if err := WithAsnSources(BuiltinSource(SourceIpinfo), registry)(&h); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(ip string, asn string, fetched bool) {
+		t.Helper()
+		before := requests.Load()
+		info, err := h.LookupAsnDetailed(context.Background(), ip)
+		if err != nil || info.Asn != asn || info.Source != SourceIpinfo || info.DescrSource != "registry" {
+			t.Errorf("LookupAsnDetailed answered %+v %v for %s", info, err, ip)
+		}
+		if refetched := requests.Load() > before; refetched != fetched {
+			t.Errorf("lookup of %s reached ipinfo.io: %v, expected %v", ip, refetched, fetched)
+		}
+	}
+	lookup("4.4.4.4", "AS64500", true)
+	lookup("5.5.5.5", "AS64501", true)
+	lookup("4.4.4.4", "AS64500", false)
+	// By ASN
+	if err := h.CachePurgeASN("64500"); err != nil {
+		t.Fatal(err)
+	}
+	lookup("4.4.4.4", "AS64500", true)
+	lookup("5.5.5.5", "AS64501", false)
+	if err := h.CachePurgeASN("ASX"); err != MalformedAsnError {
+		t.Errorf("CachePurgeASN of a malformed ASN failed with %v", err)
+	}
+	// By source, of the ASN or its description
+	h.CachePurgeBySource(SourceCymru)
+	lookup("4.4.4.4", "AS64500", false)
+	h.CachePurgeBySource(SourceIpinfo)
+	lookup("4.4.4.4", "AS64500", true)
+	lookup("5.5.5.5", "AS64501", true)
+	registry.lookups.Store(0)
+	h.CachePurgeBySource("registry")
+	lookup("4.4.4.4", "AS64500", true)
+	if n := registry.lookups.Load(); n != 1 {
+		t.Errorf("registry consulted %d times after its purge", n)
+	}
+	// All
+	h.CachePurgeAll()
+	if n := h.cache.len(); n != 0 {
+		t.Errorf("CachePurgeAll left %d entries", n)
+	}
+	lookup("5.5.5.5", "AS64501", true)
+	// Purges are safe with concurrent lookups
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				h.LookupAsnDetailed(context.Background(), "4.4.4.4")
+			}
+		}()
+	}
+	for j := 0; j < 50; j++ {
+		h.CachePurgeASN("AS64500")
+		h.CachePurgeBySource("registry")
+		h.CachePurgeAll()
+	}
+	wg.Wait()
+}
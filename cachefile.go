@@ -0,0 +1,198 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// cacheFileFormat and cacheFileVersion identify
+	// the files written by SaveCache.
+	cacheFileFormat  = "geoipdb-cache"
+	cacheFileVersion = 1
+)
+
+// MalformedCacheFileError is returned by LoadCache
+// when its input is not a cache file written by SaveCache.
+var MalformedCacheFileError = newClassError("malformed cache file", MalformedInputError)
+
+// cacheFileHeader is the first line of a cache file.
+type cacheFileHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Whether keys are keyed hashes of IP addresses (see WithPrivacy)
+	HashedKeys bool `json:"hashed_keys"`
+}
+
+// cacheFileEntry is a line of a cache file, after its header.
+type cacheFileEntry struct {
+	// IP address, or its cache key
+	Key         string            `json:"key"`
+	Asn         string            `json:"asn"`
+	Descr       string            `json:"descr,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	DescrSource string            `json:"descr_source,omitempty"`
+	Descrs      map[string]string `json:"descrs,omitempty"`
+	Registry    string            `json:"registry,omitempty"`
+	AllocatedAt time.Time         `json:"allocated_at,omitzero"`
+	Score       int               `json:"score,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	CachedAt    time.Time         `json:"cached_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+}
+
+// SaveCache writes the LookupAsn cache to w, to be loaded by LoadCache,
+// as JSON lines: a header, then one line per cached IP address,
+// with its ASN data and expiration time,
+// least recently used first.
+// Failed lookups (see WithNegativeTTL) are not saved.
+//
+// In privacy mode (see WithPrivacy), IP addresses are saved hashed,
+// otherwise the file holds them as cached (see WithAnonymization).
+func (h Handler) SaveCache(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	header := cacheFileHeader{
+		Format:     cacheFileFormat,
+		Version:    cacheFileVersion,
+		HashedKeys: h.privacy != nil,
+	}
+	if err := enc.Encode(header); err != nil {
+		return fmt.Errorf("cannot save cache: %w", err)
+	}
+	ips, entries := h.cache.snapshot()
+	for i, entry := range entries {
+		if entry.err != nil {
+			continue
+		}
+		line := cacheFileEntry{
+			Key:         ips[i],
+			Asn:         entry.asn,
+			Descr:       entry.descr,
+			Source:      entry.source,
+			DescrSource: entry.descrSource,
+			Descrs:      entry.descrs,
+			Registry:    entry.registry,
+			AllocatedAt: entry.allocated,
+			Score:       entry.score,
+			Tags:        entry.tags,
+			CachedAt:    entry.due.Add(-entry.ttl).UTC(),
+			ExpiresAt:   entry.due.UTC(),
+		}
+		if err := enc.Encode(line); err != nil {
+			return fmt.Errorf("cannot save cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// LoadCache merges a cache file written by SaveCache into the LookupAsn cache,
+// such as to start warm after a restart.
+// Entries keep their expiration time: those already expired are skipped,
+// and so are those of IP addresses cached already.
+// Entries of ASNs overriden since (see OverridesSet)
+// with a different description are skipped too.
+// Entries are cached as lookups would, in file order,
+// so that past the cache capacity (see WithCacheCapacity)
+// the least recently used ones are evicted.
+//
+// The whole input is decoded and checked before any entry is cached:
+// malformed input fails with MalformedCacheFileError,
+// leaving the cache untouched.
+func (h Handler) LoadCache(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	var header cacheFileHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("%w: %w", MalformedCacheFileError, err)
+	}
+	if header.Format != cacheFileFormat || header.Version != cacheFileVersion {
+		return fmt.Errorf("%w: unknown format '%s' version %d", MalformedCacheFileError, header.Format, header.Version)
+	}
+	if header.HashedKeys != (h.privacy != nil) {
+		return fmt.Errorf("cache file hashed keys: %t, handler in privacy mode: %t", header.HashedKeys, h.privacy != nil)
+	}
+	var lines []cacheFileEntry
+	for n := 2; ; n++ {
+		var line cacheFileEntry
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: line %d: %w", MalformedCacheFileError, n, err)
+		}
+		if line.Key == "" || !reASN.MatchString(line.Asn) || line.ExpiresAt.IsZero() || line.CachedAt.After(line.ExpiresAt) {
+			return fmt.Errorf("%w: line %d: invalid entry", MalformedCacheFileError, n)
+		}
+		lines = append(lines, line)
+	}
+	// Current overrides by ASN, and the ASNs checked
+	overrides := make(map[string]string)
+	checked := make(map[string]bool)
+	for _, line := range lines {
+		if checked[line.Asn] {
+			continue
+		}
+		descr, err := h.OverridesLookup(line.Asn)
+		switch err {
+		case nil:
+			overrides[line.Asn] = descr
+		case OverridesAsnNotFoundError, OverridesNilCollectionError:
+		default:
+			return err
+		}
+		checked[line.Asn] = true
+	}
+	now := h.cache.now()
+	for _, line := range lines {
+		if !line.ExpiresAt.After(now) {
+			continue
+		}
+		if descr, ok := overrides[line.Asn]; ok && descr != line.Descr {
+			continue
+		} else if !ok && line.DescrSource == SourceOverrides {
+			// Override removed since
+			continue
+		}
+		h.cache.restore(line.Key, cacheEntry{
+			asn:         line.Asn,
+			descr:       line.Descr,
+			source:      line.Source,
+			descrSource: line.DescrSource,
+			descrs:      line.Descrs,
+			registry:    line.Registry,
+			allocated:   line.AllocatedAt,
+			score:       line.Score,
+			tags:        line.Tags,
+			ttl:         line.ExpiresAt.Sub(line.CachedAt),
+			due:         line.ExpiresAt,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheFile(t *testing.T) {
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	google := cacheEntry{
+		asn: "AS15169", descr: "GOOGLE, US", source: SourceIpinfo,
+		descrSource: SourceCymru, descrs: map[string]string{SourceCymru: "GOOGLE, US"},
+		registry: "arin", allocated: time.Date(2000, 3, 30, 0, 0, 0, 0, time.UTC),
+		score: 10, tags: []string{"cdn"}, ttl: time.Hour,
+	}
+	h.cache.store("8.8.8.8", google)
+	h.cache.store("1.1.1.1", cacheEntry{asn: "AS13335", descr: "CLOUDFLARENET, US", source: SourceCymru})
+	h.cache.store("9.9.9.9", cacheEntry{asn: "AS19281", descr: "Quad9", source: SourceCymru, descrSource: SourceOverrides,
+		descrs: map[string]string{SourceOverrides: "Quad9"}})
+	h.cache.store("4.4.4.4", cacheEntry{asn: "AS3356", descr: "LEVEL3, US", ttl: time.Nanosecond})
+	h.cache.store("192.0.2.1", cacheEntry{err: BogonIPError, ttl: time.Hour})
+	var buf bytes.Buffer
+	if err := h.SaveCache(&buf); err != nil {
+		t.Fatalf("SaveCache failed: %s", err)
+	}
+	saved := buf.String()
+	if lines := strings.Count(saved, "\n"); lines != 5 {
+		t.Fatalf("SaveCache wrote %d lines:\n%s", lines, saved)
+	}
+	cached := func(h Handler, ip string) (cacheEntry, bool) {
+		entry, expired, found := h.cache.lookupByIP(ip)
+		return entry, found && !expired
+	}
+	// Round trip, but for expired entries and removed overrides
+	h2 := newHandler(nil, time.Second)
+	if err := h2.LoadCache(strings.NewReader(saved)); err != nil {
+		t.Fatalf("LoadCache failed: %s", err)
+	}
+	if keys := h2.cache.len(); keys != 2 {
+		t.Fatalf("LoadCache cached %d entries: %v", keys, h2.cache.keys())
+	}
+	original, _ := cached(h, "8.8.8.8")
+	loaded, ok := cached(h2, "8.8.8.8")
+	if !ok || !loaded.due.Equal(original.due) || loaded.ttl != original.ttl {
+		t.Fatalf("LoadCache cached %+v, expected %+v", loaded, original)
+	}
+	loaded.due, original.due = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(loaded, original) {
+		t.Fatalf("LoadCache cached %+v, expected %+v", loaded, original)
+	}
+	if _, ok := cached(h2, "1.1.1.1"); !ok {
+		t.Fatalf("LoadCache skipped 1.1.1.1")
+	}
+	// Merged with cached entries and current overrides
+	overrides := NewMemoryOverrides()
+	overrides.Set("AS13335", "Cloudflare")
+	overrides.Set("AS19281", "Quad9")
+	h3 := newHandler(overrides, time.Second)
+	h3.cache.store("8.8.8.8", cacheEntry{asn: "AS15169", descr: "Google"})
+	if err := h3.LoadCache(strings.NewReader(saved)); err != nil {
+		t.Fatalf("LoadCache failed: %s", err)
+	}
+	if entry, _ := cached(h3, "8.8.8.8"); entry.descr != "Google" {
+		t.Fatalf("LoadCache replaced a cached entry with %+v", entry)
+	}
+	if entry, ok := cached(h3, "1.1.1.1"); ok {
+		t.Fatalf("LoadCache resurrected an overriden entry: %+v", entry)
+	}
+	if entry, _ := cached(h3, "9.9.9.9"); entry.descr != "Quad9" {
+		t.Fatalf("LoadCache skipped an entry agreeing with its override: %+v", entry)
+	}
+	// Loaded entries are bounded by the cache capacity,
+	// the most recently used ones being kept
+	small := newHandler(nil, time.Second)
+	if err := WithCacheCapacity(1)(&small); err != nil {
+		t.Fatalf("WithCacheCapacity failed: %s", err)
+	}
+	if err := small.LoadCache(strings.NewReader(saved)); err != nil {
+		t.Fatalf("LoadCache failed: %s", err)
+	}
+	if keys := small.cache.len(); keys != 1 || small.cache.evicted.Load() != 1 {
+		t.Fatalf("LoadCache cached %d entries past capacity: %v", keys, small.cache.keys())
+	}
+	if _, ok := cached(small, "1.1.1.1"); !ok {
+		t.Fatalf("LoadCache evicted the most recently used entry: %v", small.cache.keys())
+	}
+	// Privacy mode hashes keys
+	private := newHandler(nil, time.Second)
+	if err := WithPrivacy(nil)(&private); err != nil {
+		t.Fatalf("WithPrivacy failed: %s", err)
+	}
+	if err := private.LoadCache(strings.NewReader(saved)); err == nil || private.cache.len() != 0 {
+		t.Fatalf("LoadCache of IP addresses in privacy mode returned %v", err)
+	}
+}
+
+func TestLoadCacheMalformed(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	h.cache.store("8.8.8.8", cacheEntry{asn: "AS15169", descr: "GOOGLE, US"})
+	var buf bytes.Buffer
+	if err := h.SaveCache(&buf); err != nil {
+		t.Fatalf("SaveCache failed: %s", err)
+	}
+	saved := buf.String()
+	header, _, _ := strings.Cut(saved, "\n")
+	for _, input := range []string{
+		"",
+		"garbage",
+		saved[:len(saved)/2],
+		strings.Replace(saved, `"version":1`, `"version":2`, 1),
+		strings.Replace(saved, `"AS15169"`, `"qwerty"`, 1),
+		strings.Replace(saved, `"expires_at":"`, `"expires_at":"x`, 1),
+		header + "\n[1, 2, 3]\n",
+		header + "\n{}\n",
+		saved + "{\"key\": \"1.1.1.1\"",
+	} {
+		h := newHandler(nil, time.Second)
+		if err := h.LoadCache(strings.NewReader(input)); !errors.Is(err, MalformedCacheFileError) {
+			t.Fatalf("LoadCache of %q returned %v", input, err)
+		}
+		if n := h.cache.len(); n != 0 {
+			t.Fatalf("LoadCache of %q cached %d entries", input, n)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"hash/maphash"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+const (
+	// cacheSlabSize is the number of records of a cache slab.
+	cacheSlabSize = 1 << 16
+	// cacheChunkSize is the size of a cache string chunk.
+	cacheChunkSize = 1 << 20
+	// cacheCompactMin is the size of dead string data
+	// past which a cache store may be compacted.
+	cacheCompactMin = cacheChunkSize * 4
+)
+
+// arenaRef locates a string in the chunks of a cacheStore.
+type arenaRef struct {
+	chunk uint32
+	off   uint32
+	n     uint32
+}
+
+// cacheRecord is the fixed size, pointer free, storage of a cacheEntry.
+type cacheRecord struct {
+	key, asn, descr, registry, source, tags arenaRef
+	// Source of descr, and descriptions by source (see encodeDescrs)
+	descrSource, descrs arenaRef
+	// Times, in Unix nanoseconds, zero for the zero time
+	allocated int64
+	due       int64
+	ttl       time.Duration
+	score     int64
+	// Next records with the same key hash, and with the same ASN,
+	// and previous one with the same ASN,
+	// as record number (index+1), zero for none
+	next, asnNext, asnPrev uint32
+	// Less and more recently used records, zero for none
+	lruNext, lruPrev uint32
+	// Error number (index+1), zero for none
+	err  uint32
+	live bool
+}
+
+// cacheStore stores cache entries so that the garbage collector
+// has few pointers to trace, however many entries are stored:
+// entries are fixed size records in large slabs,
+// their strings are in large chunks of bytes,
+// and they are indexed by maps without pointers but the ASNs.
+// It is not safe for concurrent use.
+type cacheStore struct {
+	slabs [][]cacheRecord
+	// Number of records used, and free ones
+	used int
+	free []uint32
+	// String data, only appended to:
+	// strings read from the store point into it
+	chunks [][]byte
+	// Size of string data, and of dead string data
+	size int
+	dead int
+	// First record by key hash
+	seed  maphash.Seed
+	index map[uint64]uint32
+	// First record by ASN
+	asns map[string]uint32
+	// Most and least recently used records
+	lruHead, lruTail uint32
+	// Errors of negative entries, nil if free,
+	// the number of records of each, and free ones
+	errs     []error
+	errRefs  []int
+	freeErrs []uint32
+}
+
+// newCacheStore returns an empty initialized cacheStore.
+func newCacheStore() *cacheStore {
+	return &cacheStore{
+		seed:  maphash.MakeSeed(),
+		index: make(map[uint64]uint32),
+		asns:  make(map[string]uint32),
+	}
+}
+
+// record returns the record of a given number.
+func (s *cacheStore) record(n uint32) *cacheRecord {
+	i := int(n - 1)
+	return &s.slabs[i/cacheSlabSize][i%cacheSlabSize]
+}
+
+// str returns a string of the store, without copying it.
+func (s *cacheStore) str(ref arenaRef) string {
+	if ref.n == 0 {
+		return ""
+	}
+	return unsafe.String(&s.chunks[ref.chunk][ref.off], ref.n)
+}
+
+// put appends a string to the chunks.
+func (s *cacheStore) put(str string) arenaRef {
+	if str == "" {
+		return arenaRef{}
+	}
+	last := len(s.chunks) - 1
+	if last < 0 || len(s.chunks[last])+len(str) > cap(s.chunks[last]) {
+		s.chunks = append(s.chunks, make([]byte, 0, max(cacheChunkSize, len(str))))
+		last++
+	}
+	off := len(s.chunks[last])
+	s.chunks[last] = append(s.chunks[last], str...)
+	s.size += len(str)
+	return arenaRef{uint32(last), uint32(off), uint32(len(str))}
+}
+
+// find searches for the record of a key.
+//
+// Returns the record number, zero if not found.
+func (s *cacheStore) find(key string) uint32 {
+	for n := s.index[maphash.String(s.seed, key)]; n != 0; n = s.record(n).next {
+		if s.str(s.record(n).key) == key {
+			return n
+		}
+	}
+	return 0
+}
+
+// get retrieves the entry of a key,
+// marking it most recently used if touch is true.
+//
+// Returns the entry and whether it was found.
+func (s *cacheStore) get(key string, touch bool) (cacheEntry, bool) {
+	n := s.find(key)
+	if n == 0 {
+		return cacheEntry{}, false
+	}
+	if touch {
+		s.touch(n)
+	}
+	return s.entry(s.record(n)), true
+}
+
+// touch marks a record most recently used.
+func (s *cacheStore) touch(n uint32) {
+	if s.lruHead == n {
+		return
+	}
+	s.unlinkLRU(n)
+	r := s.record(n)
+	r.lruPrev, r.lruNext = 0, s.lruHead
+	if s.lruHead != 0 {
+		s.record(s.lruHead).lruPrev = n
+	}
+	s.lruHead = n
+	if s.lruTail == 0 {
+		s.lruTail = n
+	}
+}
+
+// unlinkLRU removes a record from the list of recently used records.
+func (s *cacheStore) unlinkLRU(n uint32) {
+	r := s.record(n)
+	if r.lruNext != 0 {
+		s.record(r.lruNext).lruPrev = r.lruPrev
+	} else if s.lruTail == n {
+		s.lruTail = r.lruPrev
+	}
+	if r.lruPrev != 0 {
+		s.record(r.lruPrev).lruNext = r.lruNext
+	} else if s.lruHead == n {
+		s.lruHead = r.lruNext
+	}
+	r.lruPrev, r.lruNext = 0, 0
+}
+
+// evict removes the least recently used entry, if any.
+func (s *cacheStore) evict() {
+	if s.lruTail != 0 {
+		s.remove(s.lruTail)
+	}
+}
+
+// entry decodes a record.
+func (s *cacheStore) entry(r *cacheRecord) cacheEntry {
+	entry := cacheEntry{
+		asn:      s.str(r.asn),
+		descr:    s.str(r.descr),
+		registry: s.str(r.registry),
+		score:    int(r.score),
+		source:   s.str(r.source),
+		ttl:      r.ttl,
+		due:      time.Unix(0, r.due),
+	}
+	if r.allocated != 0 {
+		entry.allocated = time.Unix(0, r.allocated).UTC()
+	}
+	if r.tags.n > 0 {
+		entry.tags = strings.Split(s.str(r.tags), "\x00")
+	}
+	if r.descrs.n > 0 {
+		entry.descrSource = s.str(r.descrSource)
+		entry.descrs = decodeDescrs(s.str(r.descrs))
+	}
+	if r.err != 0 {
+		entry.err = s.errs[r.err-1]
+	}
+	return entry
+}
+
+// set stores the entry of a key, replacing any previous one.
+func (s *cacheStore) set(key string, entry cacheEntry) {
+	n := s.find(key)
+	if n != 0 {
+		s.unlinkASN(n)
+		s.release(s.record(n))
+		s.releaseErr(s.record(n))
+	} else {
+		n = s.alloc()
+		r := s.record(n)
+		r.key = s.put(key)
+		h := maphash.String(s.seed, key)
+		r.next = s.index[h]
+		s.index[h] = n
+	}
+	r := s.record(n)
+	r.asn = s.put(entry.asn)
+	r.descr = s.put(entry.descr)
+	r.registry = s.put(entry.registry)
+	r.source = s.put(entry.source)
+	r.tags = s.put(strings.Join(entry.tags, "\x00"))
+	r.descrSource = s.put(entry.descrSource)
+	r.descrs = s.put(encodeDescrs(entry.descrs))
+	r.allocated = 0
+	if !entry.allocated.IsZero() {
+		r.allocated = entry.allocated.UnixNano()
+	}
+	r.due = entry.due.UnixNano()
+	r.ttl = entry.ttl
+	r.score = int64(entry.score)
+	r.err = s.errNumber(entry.err)
+	r.live = true
+	// Negative entries have no ASN
+	if entry.err == nil {
+		asn := entry.asn
+		head, ok := s.asns[asn]
+		if ok {
+			s.record(head).asnPrev = n
+		} else {
+			// Do not keep strings of callers
+			asn = strings.Clone(asn)
+		}
+		r.asnPrev, r.asnNext = 0, head
+		s.asns[asn] = n
+	}
+	s.touch(n)
+	s.compact()
+}
+
+// encodeDescrs encodes descriptions by source
+// as "source\x00descr\x00source\x00descr...", in source order.
+func encodeDescrs(descrs map[string]string) string {
+	sources := make([]string, 0, len(descrs))
+	for source := range descrs {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	var b strings.Builder
+	for _, source := range sources {
+		if b.Len() > 0 {
+			b.WriteByte(0)
+		}
+		b.WriteString(source)
+		b.WriteByte(0)
+		b.WriteString(descrs[source])
+	}
+	return b.String()
+}
+
+// decodeDescrs decodes descriptions by source (see encodeDescrs).
+func decodeDescrs(s string) map[string]string {
+	fields := strings.Split(s, "\x00")
+	descrs := make(map[string]string, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		descrs[fields[i]] = fields[i+1]
+	}
+	return descrs
+}
+
+// alloc allocates a record.
+//
+// Returns the record number.
+func (s *cacheStore) alloc() uint32 {
+	if len(s.free) > 0 {
+		n := s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+		return n
+	}
+	if s.used%cacheSlabSize == 0 {
+		s.slabs = append(s.slabs, make([]cacheRecord, cacheSlabSize))
+	}
+	s.used++
+	return uint32(s.used)
+}
+
+// errNumber returns the number of an error, zero for nil,
+// adding it to the errors of the store if needed,
+// for one more record.
+func (s *cacheStore) errNumber(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	for i, e := range s.errs {
+		if e == err {
+			s.errRefs[i]++
+			return uint32(i + 1)
+		}
+	}
+	if len(s.freeErrs) > 0 {
+		n := s.freeErrs[len(s.freeErrs)-1]
+		s.freeErrs = s.freeErrs[:len(s.freeErrs)-1]
+		s.errs[n-1], s.errRefs[n-1] = err, 1
+		return n
+	}
+	s.errs = append(s.errs, err)
+	s.errRefs = append(s.errRefs, 1)
+	return uint32(len(s.errs))
+}
+
+// releaseErr releases the error of a record, if any,
+// freeing it if no other record has it.
+func (s *cacheStore) releaseErr(r *cacheRecord) {
+	if r.err == 0 {
+		return
+	}
+	i := r.err - 1
+	s.errRefs[i]--
+	if s.errRefs[i] == 0 {
+		s.errs[i] = nil
+		s.freeErrs = append(s.freeErrs, r.err)
+	}
+	r.err = 0
+}
+
+// release marks the strings of a record dead, but its key.
+func (s *cacheStore) release(r *cacheRecord) {
+	s.dead += int(r.asn.n + r.descr.n + r.registry.n + r.source.n + r.tags.n + r.descrSource.n + r.descrs.n)
+}
+
+// unlinkASN removes a record from the list of its ASN.
+func (s *cacheStore) unlinkASN(n uint32) {
+	r := s.record(n)
+	if r.err != 0 {
+		return
+	}
+	if r.asnNext != 0 {
+		s.record(r.asnNext).asnPrev = r.asnPrev
+	}
+	if r.asnPrev != 0 {
+		s.record(r.asnPrev).asnNext = r.asnNext
+	} else if r.asnNext != 0 {
+		s.asns[s.str(r.asn)] = r.asnNext
+	} else {
+		delete(s.asns, s.str(r.asn))
+	}
+	r.asnPrev, r.asnNext = 0, 0
+}
+
+// remove removes the entry of a record.
+func (s *cacheStore) remove(n uint32) {
+	r := s.record(n)
+	s.unlinkASN(n)
+	s.unlinkLRU(n)
+	h := maphash.String(s.seed, s.str(r.key))
+	if s.index[h] == n {
+		if r.next != 0 {
+			s.index[h] = r.next
+		} else {
+			delete(s.index, h)
+		}
+	} else {
+		p := s.index[h]
+		for s.record(p).next != n {
+			p = s.record(p).next
+		}
+		s.record(p).next = r.next
+	}
+	s.release(r)
+	s.releaseErr(r)
+	s.dead += int(r.key.n)
+	*r = cacheRecord{}
+	s.free = append(s.free, n)
+}
+
+// removeASN removes the entries of an ASN.
+func (s *cacheStore) removeASN(asn string) {
+	for n := s.asns[asn]; n != 0; {
+		next := s.record(n).asnNext
+		s.remove(n)
+		n = next
+	}
+}
+
+// each calls f on every entry, until it returns false.
+// Entries may be removed meanwhile.
+func (s *cacheStore) each(f func(n uint32, key string, entry cacheEntry) bool) {
+	for i := 0; i < s.used; i++ {
+		n := uint32(i + 1)
+		r := s.record(n)
+		if r.live && !f(n, s.str(r.key), s.entry(r)) {
+			return
+		}
+	}
+}
+
+// eachByUse calls f on every entry, least recently used first.
+func (s *cacheStore) eachByUse(f func(key string, entry cacheEntry)) {
+	for n := s.lruTail; n != 0; n = s.record(n).lruPrev {
+		r := s.record(n)
+		f(s.str(r.key), s.entry(r))
+	}
+}
+
+// keys returns the keys of an ASN.
+func (s *cacheStore) keys(asn string) map[string]interface{} {
+	answer := make(map[string]interface{})
+	for n := s.asns[asn]; n != 0; n = s.record(n).asnNext {
+		answer[s.str(s.record(n).key)] = nil
+	}
+	return answer
+}
+
+// len returns the number of entries.
+func (s *cacheStore) len() int {
+	return s.used - len(s.free)
+}
+
+// compact copies live strings to new chunks,
+// once most string data is dead,
+// so that old chunks are garbage collected
+// when no string read from them is in use anymore.
+func (s *cacheStore) compact() {
+	if s.dead < cacheCompactMin || s.dead < s.size/2 {
+		return
+	}
+	old := *s
+	s.chunks, s.size, s.dead = nil, 0, 0
+	for i := 0; i < s.used; i++ {
+		r := s.record(uint32(i + 1))
+		if !r.live {
+			continue
+		}
+		r.key = s.put(old.str(r.key))
+		r.asn = s.put(old.str(r.asn))
+		r.descr = s.put(old.str(r.descr))
+		r.registry = s.put(old.str(r.registry))
+		r.source = s.put(old.str(r.source))
+		r.tags = s.put(old.str(r.tags))
+		r.descrSource = s.put(old.str(r.descrSource))
+		r.descrs = s.put(old.str(r.descrs))
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time, such as a fake clock in tests (see WithClock).
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// WithClock makes the caches of LookupAsn, by IP address
+// and by BGP prefix (see WithPrefixCache), and of LookupCountry,
+// tell the time by clock instead of the system clock,
+// deciding when their entries expire.
+func WithClock(clock Clock) Option {
+	return func(h *Handler) error {
+		if clock == nil {
+			return fmt.Errorf("nil clock")
+		}
+		h.cache.clock, h.prefixes.clock = clock, clock
+		if h.tenant == "" {
+			h.shared.cache.clock, h.shared.prefixes.clock = clock, clock
+		}
+		return nil
+	}
+}
+
+// WithCacheJitter spreads the expiry of LookupAsn answers,
+// cached by IP address and by BGP prefix (see WithPrefixCache),
+// so that answers cached at once do not expire at once:
+// every entry is due after its TTL, plus or minus up to
+// a given fraction of it, at random, such as 0.1 for ±10%.
+func WithCacheJitter(fraction float64) Option {
+	return func(h *Handler) error {
+		if fraction < 0 || fraction >= 1 {
+			return fmt.Errorf("invalid cache jitter %g, expected a fraction in [0, 1)", fraction)
+		}
+		h.cache.jitter, h.prefixes.jitter = fraction, fraction
+		if h.tenant == "" {
+			h.shared.cache.jitter, h.shared.prefixes.jitter = fraction, fraction
+		}
+		return nil
+	}
+}
+
+// newTTL returns a TTL shared by caches (see SetCacheTTL).
+func newTTL(ttl time.Duration) *atomic.Int64 {
+	shared := &atomic.Int64{}
+	shared.Store(int64(ttl))
+	return shared
+}
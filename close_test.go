@@ -0,0 +1,236 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClose(t *testing.T) {
+	var slow int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) != 0 {
+			// Hang until the client gives up
+			<-r.Context().Done()
+			return
+		}
+		file := "testdata" + r.URL.Path
+		if _, err := os.Stat(file); err != nil {
+			file += ".json"
+		}
+		http.ServeFile(w, r, file)
+	}))
+	defer ts.Close()
+	features := []struct {
+		name string
+		opt  Option
+		// Triggers background work
+		use func(h Handler)
+	}{
+		{
+			"IXP",
+			WithIXPDetection(ts.URL+"/peeringdb", time.Millisecond),
+			func(h Handler) { h.lookupIXP(netip.MustParseAddr("80.81.192.123")) },
+		},
+		{
+			"cloud",
+			WithCloudRanges(time.Millisecond, CloudFeed{CloudAWS, ts.URL + "/cloud/aws-ip-ranges.json"}),
+			func(h Handler) { h.lookupCloud(netip.MustParseAddr("3.5.141.1")) },
+		},
+		{
+			"bogons",
+			WithBogons(ts.URL+"/bogons/fullbogons-ipv4.txt", ts.URL+"/bogons/fullbogons-ipv6.txt", time.Millisecond),
+			func(h Handler) { h.isBogon(netip.MustParseAddr("41.62.1.1")) },
+		},
+		{
+			"as2org",
+			WithAs2Org("testdata/as2org/20240101.as-org2info.txt"),
+			func(h Handler) {
+				h.as2org.Lock()
+				h.as2org.checked = time.Time{}
+				h.as2org.Unlock()
+				h.LookupOrg(context.Background(), "AS15169")
+			},
+		},
+	}
+	// Every combination of features
+	for mask := 0; mask < 1<<len(features); mask++ {
+		var names []string
+		opts := []Option{WithQueryCache(nil), WithCloseTimeout(time.Second)}
+		for i, f := range features {
+			if mask&(1<<i) != 0 {
+				names = append(names, f.name)
+				opts = append(opts, f.opt)
+			}
+		}
+		atomic.StoreInt32(&slow, 0)
+		before := goroutines()
+		h := newHandler(nil, time.Minute)
+		for _, opt := range opts {
+			if err := opt(&h); err != nil {
+				t.Fatalf("%v: option failed: %s", names, err)
+			}
+		}
+		// Background work in progress
+		atomic.StoreInt32(&slow, 1)
+		time.Sleep(2 * time.Millisecond)
+		for i, f := range features {
+			if mask&(1<<i) != 0 {
+				f.use(h)
+			}
+		}
+		h.runs.Lock()
+		running := h.runs.running
+		h.runs.Unlock()
+		// Feed refreshes hang, as2org reloads may be done already
+		if mask&7 != 0 && running == 0 {
+			t.Fatalf("%v: no background work in progress", names)
+		}
+		if err := h.Close(); err != nil {
+			t.Fatalf("%v: Close failed: %s", names, err)
+		}
+		if leaks := leakedGoroutines(before); len(leaks) > 0 {
+			t.Fatalf("%v: goroutines running after Close:\n\n%s", names, strings.Join(leaks, "\n\n"))
+		}
+		if err := h.runs.run(func(context.Context) {}); err != HandlerClosedError {
+			t.Fatalf("%v: unexpected run error after Close: %v", names, err)
+		}
+		// Lookups keep working, without starting background work
+		for i, f := range features {
+			if mask&(1<<i) != 0 {
+				f.use(h)
+			}
+		}
+		if leaks := leakedGoroutines(before); len(leaks) > 0 {
+			t.Fatalf("%v: goroutines running after Close:\n\n%s", names, strings.Join(leaks, "\n\n"))
+		}
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	if err := WithCloseTimeout(10 * time.Millisecond)(&h); err != nil {
+		t.Fatalf("WithCloseTimeout failed: %s", err)
+	}
+	release := make(chan struct{})
+	if err := h.runs.run(func(context.Context) { <-release }); err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	if err := h.Close(); err == nil {
+		t.Fatalf("expected Close to time out")
+	}
+	close(release)
+}
+
+func TestCloseMany(t *testing.T) {
+	subscriber := NewMemorySubscriber()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 1000; i++ {
+		h, err := NewHandlerOpts(WithMMDB(testMMDB), WithOverridesSubscriber(subscriber))
+		if err != nil {
+			t.Fatalf("NewHandlerOpts failed: %s", err)
+		}
+		if asn, _, err := h.LookupAsn("8.8.8.8"); err != nil || asn != "AS15169" {
+			t.Fatalf("LookupAsn answered %q %v", asn, err)
+		}
+		watched := make(chan error, 1)
+		go func() {
+			watched <- h.StartOverridesWatch(context.Background())
+		}()
+		if err := h.Close(); err != nil {
+			t.Fatalf("Close failed: %s", err)
+		}
+		if err := <-watched; err != HandlerClosedError {
+			t.Fatalf("unexpected watch error after Close: %v", err)
+		}
+		// Closing again does nothing
+		if err := h.Close(); err != nil {
+			t.Fatalf("second Close failed: %s", err)
+		}
+		if _, _, err := h.LookupAsn("8.8.8.8"); err != HandlerClosedError {
+			t.Fatalf("unexpected LookupAsn error after Close: %v", err)
+		}
+		if _, _, err := h.mmdbLookup("8.8.8.8"); err != HandlerClosedError {
+			t.Fatalf("unexpected mmdb error after Close: %v", err)
+		}
+		if ips := h.LookupIp("AS15169"); len(ips) != 0 {
+			t.Fatalf("LookupIp answered %q after Close", ips)
+		}
+	}
+	// Goroutines are given a second to exit
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); after > before && time.Now().Before(deadline); after = runtime.NumGoroutine() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after > before {
+		t.Errorf("%d goroutines before, %d after closing handlers", before, after)
+	}
+}
+
+// goroutines returns the stacks of running goroutines running package code,
+// other than the calling one, by goroutine header line.
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	// The calling goroutine comes first
+	stacks := strings.Split(string(buf), "\n\n")[1:]
+	answer := make(map[string]string)
+	for _, stack := range stacks {
+		if strings.Contains(stack, "github.com/turbobytes/geoipdb.") {
+			id, _, _ := strings.Cut(stack, " [")
+			answer[id] = stack
+		}
+	}
+	return answer
+}
+
+// leakedGoroutines returns the stacks of goroutines running package code
+// that were not running before.
+// Goroutines are given a second to exit.
+func leakedGoroutines(before map[string]string) []string {
+	var leaks []string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		leaks = leaks[:0]
+		for id, stack := range goroutines() {
+			if _, ok := before[id]; !ok {
+				leaks = append(leaks, stack)
+			}
+		}
+		if len(leaks) == 0 {
+			return nil
+		}
+	}
+	return leaks
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cloudRefreshInterval is the default refresh interval of cloud range feeds.
+const cloudRefreshInterval = time.Hour * 6
+
+// Cloud providers known to WithCloudRanges.
+const (
+	CloudAWS        = "AWS"
+	CloudGCP        = "GCP"
+	CloudAzure      = "Azure"
+	CloudCloudflare = "Cloudflare"
+)
+
+// CloudFeed is a published IP ranges feed of a cloud provider.
+type CloudFeed struct {
+	// One of the Cloud<...> provider constants,
+	// which selects the feed format
+	Provider string
+	// Feed URL
+	URL string
+}
+
+// DefaultCloudFeeds are the IP ranges feeds used by WithCloudRanges
+// when none are given.
+//
+// Azure publishes its Service Tags file under a new URL every week,
+// so it has no default; add a CloudFeed for it to include Azure.
+var DefaultCloudFeeds = []CloudFeed{
+	{CloudAWS, "https://ip-ranges.amazonaws.com/ip-ranges.json"},
+	{CloudGCP, "https://www.gstatic.com/ipranges/cloud.json"},
+	{CloudCloudflare, "https://api.cloudflare.com/client/v4/ips"},
+}
+
+// WithCloudRanges enables tagging of addresses
+// belonging to cloud providers,
+// which LookupIpInfo reports in IpInfo.CloudProvider and IpInfo.CloudRegion.
+//
+// Feeds are refreshed every refresh interval,
+// using ETags to skip unchanged ones.
+// Pass no feeds for DefaultCloudFeeds,
+// and zero refresh for the default interval (6 hours).
+func WithCloudRanges(refresh time.Duration, feeds ...CloudFeed) Option {
+	return func(h *Handler) error {
+		if len(feeds) == 0 {
+			feeds = DefaultCloudFeeds
+		}
+		if refresh == 0 {
+			refresh = cloudRefreshInterval
+		}
+		cr := &cloudRanges{
+			client: h.newHTTPClient(),
+		}
+		for _, f := range feeds {
+			if _, ok := cloudParsers[f.Provider]; !ok {
+				return fmt.Errorf("unknown cloud provider '%s'", f.Provider)
+			}
+			cr.sources = append(cr.sources, &cloudSource{feed: f})
+		}
+		h.clouds = newFeed(h.runs, "cloud ranges", refresh, cr.fetch)
+		return nil
+	}
+}
+
+// lookupCloud finds the cloud provider an address belongs to.
+//
+// Returns the cloud tag and whether the address matched.
+func (h Handler) lookupCloud(addr netip.Addr) (cloudTag, bool) {
+	if h.clouds == nil {
+		return cloudTag{}, false
+	}
+	clouds := h.clouds.get()
+	if clouds == nil {
+		return cloudTag{}, false
+	}
+	_, tag, ok := clouds.lookup(addr)
+	return tag, ok
+}
+
+// cloudTag is what we know about a cloud provider prefix.
+type cloudTag struct {
+	provider string
+	region   string
+}
+
+// cloudRange is a prefix taken from a cloud provider feed.
+type cloudRange struct {
+	prefix netip.Prefix
+	region string
+}
+
+// cloudRanges fetches and merges cloud provider feeds.
+type cloudRanges struct {
+	client *http.Client
+	// Serializes fetches
+	sync.Mutex
+	sources []*cloudSource
+}
+
+// cloudSource is a cloud provider feed and its last fetched ranges.
+type cloudSource struct {
+	feed   CloudFeed
+	etag   string
+	ranges []cloudRange
+}
+
+// fetch refreshes all feeds and merges them into a trie of cloud tags.
+// Feeds failing to refresh keep their previous ranges,
+// unless they were never fetched, which fails the whole fetch.
+func (cr *cloudRanges) fetch(ctx context.Context) (*prefixTrie[cloudTag], error) {
+	cr.Lock()
+	defer cr.Unlock()
+	for _, src := range cr.sources {
+		if err := src.refresh(ctx, cr.client); err != nil {
+			if src.ranges == nil {
+				return nil, err
+			}
+			log.Printf("warning: keeping previous %s ranges: %s\n", src.feed.Provider, err)
+		}
+	}
+	trie := newPrefixTrie[cloudTag]()
+	for _, src := range cr.sources {
+		// Region-less ranges go first, to be overwritten
+		// by regional ranges of the same prefix.
+		for _, regional := range []bool{false, true} {
+			for _, r := range src.ranges {
+				if (r.region != "") == regional {
+					trie.insert(r.prefix, cloudTag{src.feed.Provider, r.region})
+				}
+			}
+		}
+	}
+	return trie, nil
+}
+
+// refresh fetches a feed, unless its ETag says it is unchanged.
+func (src *cloudSource) refresh(ctx context.Context, client *http.Client) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.feed.URL, nil)
+	if err != nil {
+		return err
+	}
+	if src.etag != "" && src.ranges != nil {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to GET '%s': %w", src.feed.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET '%s' returned status %s", src.feed.URL, resp.Status)
+	}
+	ranges, err := cloudParsers[src.feed.Provider](resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s feed: %w", src.feed.Provider, err)
+	}
+	src.ranges = ranges
+	src.etag = resp.Header.Get("ETag")
+	return nil
+}
+
+// cloudParsers maps cloud providers to their feed parsers.
+var cloudParsers = map[string]func(io.Reader) ([]cloudRange, error){
+	CloudAWS:        parseAWSRanges,
+	CloudGCP:        parseGCPRanges,
+	CloudAzure:      parseAzureRanges,
+	CloudCloudflare: parseCloudflareRanges,
+}
+
+// appendCloudRange parses and appends a prefix to a list of cloud ranges.
+func appendCloudRange(ranges []cloudRange, prefix string, region string) ([]cloudRange, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return append(ranges, cloudRange{p, region}), nil
+}
+
+// parseAWSRanges parses AWS ip-ranges.json.
+func parseAWSRanges(r io.Reader) ([]cloudRange, error) {
+	var feed struct {
+		Prefixes []struct {
+			Prefix string `json:"ip_prefix"`
+			Region string `json:"region"`
+		} `json:"prefixes"`
+		Prefixes6 []struct {
+			Prefix string `json:"ipv6_prefix"`
+			Region string `json:"region"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return nil, err
+	}
+	var ranges []cloudRange
+	var err error
+	for _, p := range feed.Prefixes {
+		if ranges, err = appendCloudRange(ranges, p.Prefix, awsRegion(p.Region)); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range feed.Prefixes6 {
+		if ranges, err = appendCloudRange(ranges, p.Prefix, awsRegion(p.Region)); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
+// awsRegion maps AWS "GLOBAL" pseudo region to no region.
+func awsRegion(region string) string {
+	if region == "GLOBAL" {
+		return ""
+	}
+	return region
+}
+
+// parseGCPRanges parses GCP cloud.json.
+func parseGCPRanges(r io.Reader) ([]cloudRange, error) {
+	var feed struct {
+		Prefixes []struct {
+			Prefix4 string `json:"ipv4Prefix"`
+			Prefix6 string `json:"ipv6Prefix"`
+			Scope   string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return nil, err
+	}
+	var ranges []cloudRange
+	var err error
+	for _, p := range feed.Prefixes {
+		prefix := p.Prefix4
+		if prefix == "" {
+			prefix = p.Prefix6
+		}
+		if ranges, err = appendCloudRange(ranges, prefix, p.Scope); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
+// parseAzureRanges parses Azure ServiceTags_Public.json.
+//
+// Only service-less tags are used (AzureCloud and AzureCloud.<region>),
+// as service tags overlap them.
+func parseAzureRanges(r io.Reader) ([]cloudRange, error) {
+	var feed struct {
+		Values []struct {
+			Properties struct {
+				Region          string   `json:"region"`
+				SystemService   string   `json:"systemService"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return nil, err
+	}
+	var ranges []cloudRange
+	var err error
+	for _, v := range feed.Values {
+		if v.Properties.SystemService != "" {
+			continue
+		}
+		for _, prefix := range v.Properties.AddressPrefixes {
+			if ranges, err = appendCloudRange(ranges, prefix, v.Properties.Region); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// parseCloudflareRanges parses Cloudflare's /client/v4/ips API answer.
+func parseCloudflareRanges(r io.Reader) ([]cloudRange, error) {
+	var feed struct {
+		Result struct {
+			Prefixes4 []string `json:"ipv4_cidrs"`
+			Prefixes6 []string `json:"ipv6_cidrs"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return nil, err
+	}
+	var ranges []cloudRange
+	var err error
+	for _, prefix := range append(feed.Result.Prefixes4, feed.Result.Prefixes6...) {
+		if ranges, err = appendCloudRange(ranges, prefix, ""); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
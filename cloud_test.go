@@ -0,0 +1,108 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloudRanges(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		fetches  int
+		notModif int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		etag := `"` + r.URL.Path + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModif++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches++
+		w.Header().Set("ETag", etag)
+		http.ServeFile(w, r, "testdata/cloud"+r.URL.Path)
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	err := WithCloudRanges(time.Hour,
+		CloudFeed{CloudAWS, ts.URL + "/aws-ip-ranges.json"},
+		CloudFeed{CloudGCP, ts.URL + "/gcp-cloud.json"},
+		CloudFeed{CloudAzure, ts.URL + "/azure-servicetags.json"},
+		CloudFeed{CloudCloudflare, ts.URL + "/cloudflare-ips.json"},
+	)(&h)
+	if err != nil {
+		t.Fatalf("WithCloudRanges failed: %s", err)
+	}
+	tests := []struct {
+		ip  string
+		tag cloudTag
+	}{
+		{"3.5.141.1", cloudTag{CloudAWS, "ap-northeast-2"}},
+		{"52.94.76.10", cloudTag{CloudAWS, ""}},
+		{"52.94.77.10", cloudTag{CloudAWS, "us-east-1"}},
+		{"2600:1f18::1", cloudTag{CloudAWS, "us-east-1"}},
+		{"35.188.1.1", cloudTag{CloudGCP, "us-central1"}},
+		{"2600:1900:4000::1", cloudTag{CloudGCP, "us-central1"}},
+		{"13.68.130.1", cloudTag{CloudAzure, "eastus"}},
+		{"13.65.0.1", cloudTag{CloudAzure, ""}},
+		{"13.107.246.1", cloudTag{}},
+		{"104.16.1.1", cloudTag{CloudCloudflare, ""}},
+		{"2606:4700::6810:84e5", cloudTag{CloudCloudflare, ""}},
+		{"8.8.8.8", cloudTag{}},
+	}
+	check := func() {
+		for _, test := range tests {
+			tag, ok := h.lookupCloud(netip.MustParseAddr(test.ip))
+			if tag != test.tag || ok != (test.tag != cloudTag{}) {
+				t.Fatalf("lookupCloud(%s) returned %+v, %v", test.ip, tag, ok)
+			}
+		}
+	}
+	check()
+	if err := h.clouds.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh failed: %s", err)
+	}
+	check()
+	if fetches != 4 || notModif != 4 {
+		t.Fatalf("expected 4 fetches and 4 not modified answers, got %d and %d", fetches, notModif)
+	}
+}
+
+func TestWithCloudRangesUnknownProvider(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	if err := WithCloudRanges(0, CloudFeed{"Rackspace", "http://127.0.0.1/"})(&h); err == nil {
+		t.Fatalf("expected an error for an unknown provider")
+	}
+}
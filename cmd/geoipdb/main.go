@@ -0,0 +1,307 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Command geoipdb looks ASNs and IP addresses up,
+// and manages the overrides of ASN descriptions:
+//
+//	geoipdb [flags] lookup-asn AS15169
+//	geoipdb [flags] lookup-ip 8.8.8.8
+//	geoipdb [flags] overrides list
+//	geoipdb [flags] overrides set AS64500 "Example network"
+//	geoipdb [flags] overrides remove AS64500
+//	geoipdb [flags] overrides import [-replace] [file]
+//	geoipdb [flags] overrides export
+//
+// The overrides collection and the GeoLite2 ASN database are given
+// by flags, or else by the environment (see -help).
+// Output is meant for humans, or JSON with -json.
+//
+// The exit code is 0 on success, 3 if what is looked up is not found,
+// 2 on usage errors, such as malformed ASNs, and 1 on other failures.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/turbobytes/geoipdb"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// Exit codes
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+// options are the flags of the command.
+type options struct {
+	mongoURL        string
+	mongoDatabase   string
+	mongoCollection string
+	mmdb            string
+	timeout         time.Duration
+	json            bool
+	// Whether overrides import removes the overrides it does not list
+	replace bool
+}
+
+// invocation is a parsed command line.
+type invocation struct {
+	opts options
+	// Subcommand and its arguments, such as ["overrides", "set", "AS64500", "Example"]
+	args []string
+}
+
+// asnDescr is the output of lookup-asn.
+type asnDescr struct {
+	Asn   string `json:"asn"`
+	Descr string `json:"descr"`
+}
+
+// usageError is a malformed command line.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// arities are the numbers of arguments of the subcommands, minimum and maximum.
+var arities = map[string][2]int{
+	"lookup-asn":       {1, 1},
+	"lookup-ip":        {1, 1},
+	"overrides list":   {0, 0},
+	"overrides set":    {2, 2},
+	"overrides remove": {1, 1},
+	"overrides import": {0, 1},
+	"overrides export": {0, 0},
+}
+
+// newFlagSet returns the flag set of the command,
+// defaulting to the environment given by getenv.
+func newFlagSet(opts *options, getenv func(string) string, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("geoipdb", flag.ContinueOnError)
+	fs.SetOutput(output)
+	orDefault := func(name, value string) string {
+		if v := getenv(name); v != "" {
+			return v
+		}
+		return value
+	}
+	fs.StringVar(&opts.mongoURL, "mongo-url", getenv("GEOIPDB_MONGO_URL"), "MongoDB URL of the overrides, or $GEOIPDB_MONGO_URL")
+	fs.StringVar(&opts.mongoDatabase, "mongo-database", orDefault("GEOIPDB_MONGO_DATABASE", "geoipdb"), "MongoDB database of the overrides, or $GEOIPDB_MONGO_DATABASE")
+	fs.StringVar(&opts.mongoCollection, "mongo-collection", orDefault("GEOIPDB_MONGO_COLLECTION", "asnOverrides"), "MongoDB collection of the overrides, or $GEOIPDB_MONGO_COLLECTION")
+	fs.StringVar(&opts.mmdb, "mmdb", getenv("GEOIPDB_MMDB"), "path of the GeoLite2 ASN database, or $GEOIPDB_MMDB; the libgeoip databases if empty")
+	fs.DurationVar(&opts.timeout, "timeout", 5*time.Second, "timeout of lookups")
+	fs.BoolVar(&opts.json, "json", false, "write JSON output")
+	fs.BoolVar(&opts.replace, "replace", false, "remove the overrides not imported (overrides import)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: geoipdb [flags] lookup-asn ASN | lookup-ip IP | overrides list | set ASN DESCR | remove ASN | import [FILE] | export")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses a command line, without the program name.
+// Flags may come before or after the subcommand and its arguments.
+func parseArgs(args []string, getenv func(string) string, output io.Writer) (invocation, error) {
+	var inv invocation
+	fs := newFlagSet(&inv.opts, getenv, output)
+	for {
+		if err := fs.Parse(args); err == flag.ErrHelp {
+			return invocation{}, err
+		} else if err != nil {
+			return invocation{}, &usageError{err.Error()}
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		inv.args = append(inv.args, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(inv.args) == 0 {
+		return invocation{}, &usageError{"missing subcommand"}
+	}
+	name := inv.args[0]
+	n := 1
+	if name == "overrides" && len(inv.args) > 1 {
+		name, n = name+" "+inv.args[1], 2
+	}
+	arity, ok := arities[name]
+	if !ok {
+		return invocation{}, &usageError{fmt.Sprintf("unknown subcommand '%s'", name)}
+	}
+	if got := len(inv.args) - n; got < arity[0] || got > arity[1] {
+		return invocation{}, &usageError{fmt.Sprintf("wrong number of arguments to %s", name)}
+	}
+	if inv.args[0] == "overrides" && inv.opts.mongoURL == "" {
+		return invocation{}, &usageError{"overrides need a MongoDB URL (-mongo-url or $GEOIPDB_MONGO_URL)"}
+	}
+	if inv.opts.replace && name != "overrides import" {
+		return invocation{}, &usageError{"-replace applies to overrides import only"}
+	}
+	return inv, nil
+}
+
+// newHandler creates the handler of an invocation.
+func newHandler(opts options) (geoipdb.Handler, error) {
+	var handlerOpts []geoipdb.Option
+	if opts.mmdb != "" {
+		handlerOpts = append(handlerOpts, geoipdb.WithMMDB(opts.mmdb))
+	}
+	var overrides *mgo.Collection
+	if opts.mongoURL != "" {
+		session, err := mgo.DialWithTimeout(opts.mongoURL, opts.timeout)
+		if err != nil {
+			return geoipdb.Handler{}, fmt.Errorf("cannot dial to mongodb: %w", err)
+		}
+		overrides = session.DB(opts.mongoDatabase).C(opts.mongoCollection)
+	}
+	h, err := geoipdb.NewHandler(overrides, opts.timeout, handlerOpts...)
+	if err != nil && overrides != nil {
+		overrides.Database.Session.Close()
+	}
+	return h, err
+}
+
+// execute runs an invocation with a given handler.
+func execute(ctx context.Context, h geoipdb.Handler, inv invocation, stdin io.Reader, stdout io.Writer) error {
+	args := inv.args
+	switch args[0] {
+	case "lookup-asn":
+		n, err := geoipdb.ParseASN(args[1])
+		if err != nil {
+			return err
+		}
+		info := asnDescr{Asn: geoipdb.FormatASN(n)}
+		if info.Descr, err = h.LookupAsnDescr(ctx, info.Asn); err != nil {
+			return err
+		}
+		return write(stdout, inv.opts, info, "%s\t%s\n", info.Asn, info.Descr)
+	case "lookup-ip":
+		info, err := h.LookupIpInfo(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return write(stdout, inv.opts, info, "%s\t%s\t%s\n", info.IP, info.Asn, info.Descr)
+	}
+	switch args[1] {
+	case "list":
+		overrides, err := h.OverridesList()
+		if err != nil {
+			return err
+		}
+		if inv.opts.json {
+			return json.NewEncoder(stdout).Encode(overrides)
+		}
+		for _, o := range overrides {
+			if _, err := fmt.Fprintf(stdout, "%s\t%s\n", o.Asn, o.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "set":
+		return h.OverridesSet(args[2], args[3])
+	case "remove":
+		return h.OverridesRemove(args[2])
+	case "import":
+		r := stdin
+		if len(args) == 3 && args[2] != "-" {
+			f, err := os.Open(args[2])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		return h.OverridesImport(r, inv.opts.replace)
+	case "export":
+		// JSON either way
+		return h.OverridesExport(stdout)
+	}
+	return &usageError{fmt.Sprintf("unknown subcommand '%s'", args[1])}
+}
+
+// write writes a value as JSON, or as formatted for humans.
+func write(w io.Writer, opts options, v interface{}, format string, args ...interface{}) error {
+	if opts.json {
+		return json.NewEncoder(w).Encode(v)
+	}
+	_, err := fmt.Fprintf(w, format, args...)
+	return err
+}
+
+// exitCode answers the exit code of the outcome of an invocation.
+func exitCode(err error) int {
+	var usage *usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usage), errors.Is(err, geoipdb.MalformedInputError):
+		return exitUsage
+	case errors.Is(err, geoipdb.NotFoundError):
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+// run runs a command line, without the program name.
+//
+// Returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer, getenv func(string) string) int {
+	inv, err := parseArgs(args, getenv, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "geoipdb: %s\n", err)
+		return exitUsage
+	}
+	h, err := newHandler(inv.opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "geoipdb: %s\n", err)
+		return exitFailure
+	}
+	defer h.Close()
+	if err := execute(context.Background(), h, inv, stdin, stdout); err != nil {
+		fmt.Fprintf(stderr, "geoipdb: %s\n", err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr, os.Getenv))
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/geoipdb"
+)
+
+func TestParseArgs(t *testing.T) {
+	env := map[string]string{
+		"GEOIPDB_MONGO_URL": "mongodb://localhost/geoipdb",
+		"GEOIPDB_MMDB":      "/usr/share/GeoIP/GeoLite2-ASN.mmdb",
+	}
+	getenv := func(name string) string { return env[name] }
+	inv, err := parseArgs([]string{"-timeout", "2s", "overrides", "import", "-replace", "overrides.json", "--json"}, getenv, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := invocation{
+		opts: options{
+			mongoURL:        "mongodb://localhost/geoipdb",
+			mongoDatabase:   "geoipdb",
+			mongoCollection: "asnOverrides",
+			mmdb:            "/usr/share/GeoIP/GeoLite2-ASN.mmdb",
+			timeout:         2 * time.Second,
+			json:            true,
+			replace:         true,
+		},
+		args: []string{"overrides", "import", "overrides.json"},
+	}
+	if !reflect.DeepEqual(inv, expected) {
+		t.Errorf("parseArgs answered %+v, expected %+v", inv, expected)
+	}
+	// Flags take precedence over the environment
+	inv, err = parseArgs([]string{"-mongo-url", "mongodb://other/db", "-mmdb", "asn.mmdb", "lookup-ip", "8.8.8.8"}, getenv, io.Discard)
+	if err != nil || inv.opts.mongoURL != "mongodb://other/db" || inv.opts.mmdb != "asn.mmdb" || inv.opts.json {
+		t.Errorf("parseArgs answered %+v %v", inv, err)
+	}
+	for _, args := range [][]string{
+		{},
+		{"lookup"},
+		{"lookup-asn"},
+		{"lookup-asn", "AS1", "AS2"},
+		{"overrides"},
+		{"overrides", "set", "AS64500"},
+		{"overrides", "export", "file"},
+		{"-replace", "overrides", "export"},
+		{"-timeout", "soon", "lookup-ip", "8.8.8.8"},
+		{"-unknown", "lookup-ip", "8.8.8.8"},
+	} {
+		var usage *usageError
+		if _, err := parseArgs(args, getenv, io.Discard); !errors.As(err, &usage) {
+			t.Errorf("parseArgs of %q failed with %v", args, err)
+		}
+	}
+	// Overrides need a collection
+	if _, err := parseArgs([]string{"overrides", "list"}, func(string) string { return "" }, io.Discard); err == nil {
+		t.Error("parseArgs accepted overrides without MongoDB URL")
+	}
+	if _, err := parseArgs([]string{"-help"}, getenv, io.Discard); err != flag.ErrHelp {
+		t.Errorf("parseArgs of -help failed with %v", err)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	h, err := geoipdb.NewHandlerWithStore(geoipdb.NewMemoryOverrides(), time.Second,
+		geoipdb.WithOfflineMode(),
+		geoipdb.WithMMDB("../../testdata/mmdb/GeoLite2-ASN-Test.mmdb"),
+		geoipdb.WithAsnSources(geoipdb.BuiltinSource(geoipdb.SourceMMDB)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	exec := func(input string, args ...string) (string, error) {
+		t.Helper()
+		inv, err := parseArgs(args, func(string) string { return "mongodb://localhost/geoipdb" }, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		err = execute(context.Background(), h, inv, strings.NewReader(input), &out)
+		return out.String(), err
+	}
+	// Lookups
+	if out, err := exec("", "lookup-ip", "8.8.8.8"); err != nil || out != "8.8.8.8\tAS15169\tGOOGLE\n" {
+		t.Errorf("lookup-ip answered %q %v", out, err)
+	}
+	out, err := exec("", "-json", "lookup-ip", "8.8.8.8")
+	var info geoipdb.IpInfo
+	if err != nil || json.Unmarshal([]byte(out), &info) != nil || info.IP != "8.8.8.8" || info.Asn != "AS15169" || info.Descr != "GOOGLE" {
+		t.Errorf("lookup-ip -json answered %q %v", out, err)
+	}
+	if out, err := exec("", "lookup-asn", "15169"); err != nil || out != "AS15169\tGOOGLE\n" {
+		t.Errorf("lookup-asn answered %q %v", out, err)
+	}
+	// Overrides
+	if _, err := exec("", "overrides", "set", "AS64500", "Example network"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec(`[{"asn": "AS64501", "name": "Other"}]`, "overrides", "import"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec("", "overrides", "list"); err != nil || out != "AS64500\tExample network\nAS64501\tOther\n" {
+		t.Errorf("overrides list answered %q %v", out, err)
+	}
+	out, err = exec("", "overrides", "list", "-json")
+	var overrides []geoipdb.AsnOverride
+	if err != nil || json.Unmarshal([]byte(out), &overrides) != nil || len(overrides) != 2 || overrides[0].Name != "Example network" {
+		t.Errorf("overrides list -json answered %q %v", out, err)
+	}
+	if out, err := exec("", "-json", "lookup-asn", "AS64500"); err != nil || out != `{"asn":"AS64500","descr":"Example network"}`+"\n" {
+		t.Errorf("lookup-asn -json answered %q %v", out, err)
+	}
+	if _, err := exec("", "overrides", "remove", "AS64500"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec("", "overrides", "export"); err != nil || !strings.Contains(out, `"asn":"AS64501"`) || strings.Contains(out, "AS64500") {
+		t.Errorf("overrides export answered %q %v", out, err)
+	}
+	// Exit codes tell what is not found from failures
+	for _, test := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"lookup-ip", "4.4.4.4"}, exitNotFound},
+		{[]string{"lookup-ip", "not-an-ip"}, exitUsage},
+		{[]string{"lookup-asn", "ASX"}, exitUsage},
+		{[]string{"overrides", "import", "missing.json"}, exitFailure},
+	} {
+		if _, err := exec("", test.args...); exitCode(err) != test.code {
+			t.Errorf("%q failed with %v, exit code %d, expected %d", test.args, err, exitCode(err), test.code)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	getenv := func(string) string { return "" }
+	if code := run([]string{"lookup-asn"}, nil, &stdout, &stderr, getenv); code != exitUsage || !strings.Contains(stderr.String(), "wrong number of arguments") {
+		t.Errorf("run answered %d %q", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := run([]string{"-help"}, nil, &stdout, &stderr, getenv); code != exitOK || !strings.Contains(stderr.String(), "usage:") {
+		t.Errorf("run -help answered %d %q", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := run([]string{"-mmdb", "missing.mmdb", "lookup-ip", "8.8.8.8"}, nil, &stdout, &stderr, getenv); code != exitFailure || stderr.Len() == 0 {
+		t.Errorf("run with a missing database answered %d %q", code, stderr.String())
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of a handler,
+// as read by NewHandlerFromConfig from a JSON or YAML file,
+// whose field names are those of the json tags.
+// Durations are strings such as "1m30s".
+// In string values, ${NAME} is replaced
+// by the value of environment variable NAME.
+//
+// Unset optional features are not enabled.
+type Config struct {
+	// Timeout of external services (see NewHandler)
+	Timeout ConfigDuration `json:"timeout"`
+	// Time Close waits for background tasks (see WithCloseTimeout)
+	CloseTimeout ConfigDuration `json:"close_timeout"`
+	// External sources LookupAsn consults by default,
+	// "geoip", "ipinfo" and "cymru", in that order; empty for all.
+	// Lookups may restrict them further (see WithSources).
+	Sources []string `json:"sources"`
+	// GeoIP database files (see WithGeoIPFiles)
+	GeoIP *GeoIPConfig `json:"geoip"`
+	// Overrides collection
+	Mongo *MongoConfig `json:"mongo"`
+	// ipinfo.io client (see NewIpinfoClient)
+	Ipinfo *IpinfoConfig `json:"ipinfo"`
+	// Bounds of Team Cymru TTLs (see WithCymruTTL)
+	Cymru *CymruConfig `json:"cymru"`
+	// LookupAsn cache
+	Cache CacheConfig `json:"cache"`
+	// Circuit breaker of the overrides collection (see WithOverridesBreaker)
+	OverridesBreaker *BreakerConfig `json:"overrides_breaker"`
+	// Bogon lists (see WithBogons)
+	Bogons *BogonsConfig `json:"bogons"`
+	// HMAC key of privacy mode (see WithPrivacy)
+	PrivacySecret string `json:"privacy_secret"`
+	// Truncation of IP addresses (see WithAnonymization)
+	Anonymize *AnonymizeConfig `json:"anonymize"`
+	// Feature flags (see WithRedactIPs and WithKeyTracking)
+	RedactIPs   bool `json:"redact_ips"`
+	KeyTracking bool `json:"key_tracking"`
+}
+
+// GeoIPConfig configures GeoIP database files.
+type GeoIPConfig struct {
+	V4 string `json:"v4"`
+	V6 string `json:"v6"`
+}
+
+// MongoConfig configures the overrides collection,
+// and its audit log and prefix overrides collections
+// in the same database, if any
+// (see WithOverridesAuditCollection and WithPrefixOverridesCollection).
+type MongoConfig struct {
+	URL              string         `json:"url"`
+	Database         string         `json:"database"`
+	Collection       string         `json:"collection"`
+	AuditCollection  string         `json:"audit_collection"`
+	PrefixCollection string         `json:"prefix_collection"`
+	Timeout          ConfigDuration `json:"timeout"`
+}
+
+// IpinfoConfig configures the ipinfo.io client.
+type IpinfoConfig struct {
+	Token    string         `json:"token"`
+	Rate     float64        `json:"rate"`
+	Burst    int            `json:"burst"`
+	Cooldown ConfigDuration `json:"cooldown"`
+}
+
+// CymruConfig configures Team Cymru TTLs.
+type CymruConfig struct {
+	MinTTL ConfigDuration `json:"min_ttl"`
+	MaxTTL ConfigDuration `json:"max_ttl"`
+}
+
+// CacheConfig configures the LookupAsn cache.
+type CacheConfig struct {
+	// Whether to cache by BGP prefix (see WithPrefixCache)
+	PrefixMode bool `json:"prefix_mode"`
+	// Soft TTLs (see WithSoftTTL)
+	SoftTTL       ConfigDuration `json:"soft_ttl"`
+	PrefixSoftTTL ConfigDuration `json:"prefix_soft_ttl"`
+}
+
+// BreakerConfig configures a circuit breaker.
+type BreakerConfig struct {
+	Failures     int            `json:"failures"`
+	Cooldown     ConfigDuration `json:"cooldown"`
+	ProbeTimeout ConfigDuration `json:"probe_timeout"`
+}
+
+// BogonsConfig configures bogon lists.
+type BogonsConfig struct {
+	V4URL   string         `json:"v4_url"`
+	V6URL   string         `json:"v6_url"`
+	Refresh ConfigDuration `json:"refresh"`
+}
+
+// AnonymizeConfig configures the truncation of IP addresses,
+// zero lengths standing for the defaults.
+type AnonymizeConfig struct {
+	V4Bits int `json:"v4_bits"`
+	V6Bits int `json:"v6_bits"`
+}
+
+// ConfigDuration is a duration of Config, such as "1m30s".
+type ConfigDuration time.Duration
+
+func (d *ConfigDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1m30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ConfigDuration(v)
+	return nil
+}
+
+func (d ConfigDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ConfigError is returned when a config file is invalid.
+type ConfigError struct {
+	// Config file
+	File string
+	// Path of the invalid value, such as "sources[2]", if any
+	Path string
+	// What is wrong
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid config %s: %s", e.File, e.Reason)
+	}
+	return fmt.Sprintf("invalid config %s: %s: %s", e.File, e.Path, e.Reason)
+}
+
+// reConfigVar matches environment variables in config strings.
+var reConfigVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// NewHandlerFromConfig creates a handler configured by a file
+// (see Config), in JSON, or YAML if named *.yaml or *.yml.
+// Unknown fields are rejected.
+//
+// Returns a geoipdb handler,
+// or a *ConfigError if the file is invalid.
+func NewHandlerFromConfig(path string) (Handler, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return Handler{}, err
+	}
+	opts := cfg.options()
+	var overrides *mgo.Collection
+	if m := cfg.Mongo; m != nil {
+		timeout := time.Duration(m.Timeout)
+		if timeout == 0 {
+			timeout = time.Duration(cfg.Timeout)
+		}
+		session, err := mgo.DialWithTimeout(m.URL, timeout)
+		if err != nil {
+			return Handler{}, fmt.Errorf("cannot dial to mongodb: %w", err)
+		}
+		overrides = session.DB(m.Database).C(m.Collection)
+		if m.AuditCollection != "" {
+			opts = append(opts, WithOverridesAuditCollection(session.DB(m.Database).C(m.AuditCollection)))
+		}
+		if m.PrefixCollection != "" {
+			opts = append(opts, WithPrefixOverridesCollection(session.DB(m.Database).C(m.PrefixCollection)))
+		}
+	}
+	h, err := NewHandler(overrides, time.Duration(cfg.Timeout), opts...)
+	if err != nil && overrides != nil {
+		overrides.Database.Session.Close()
+	}
+	return h, err
+}
+
+// ValidateConfig checks a config file as NewHandlerFromConfig does,
+// without creating a handler, nor reaching any service.
+//
+// Returns a *ConfigError if the file is invalid.
+func ValidateConfig(path string) error {
+	_, err := loadConfig(path)
+	return err
+}
+
+// loadConfig reads and validates a config file.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	invalid := func(path string, format string, a ...interface{}) error {
+		return &ConfigError{File: path, Reason: fmt.Sprintf(format, a...)}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	var tree interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &tree)
+	default:
+		err = json.Unmarshal(b, &tree)
+	}
+	if err != nil {
+		return cfg, invalid(path, "%s", err)
+	}
+	if tree == nil {
+		tree = map[string]interface{}{}
+	}
+	tree, err = expandConfigVars(tree, "")
+	if err == nil {
+		err = checkConfigFields(tree, reflect.TypeOf(cfg), "")
+	}
+	if err == nil {
+		// The tree is checked, decoding it fails on type mismatches only
+		b, _ = json.Marshal(tree)
+		if err = json.Unmarshal(b, &cfg); err != nil {
+			err = configTypeError(err)
+		}
+	}
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		if e, ok := err.(*ConfigError); ok {
+			e.File = path
+			return cfg, e
+		}
+		return cfg, invalid(path, "%s", err)
+	}
+	return cfg, nil
+}
+
+// expandConfigVars replaces environment variables
+// in the strings of a config tree.
+func expandConfigVars(v interface{}, path string) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		var missing string
+		s := reConfigVar.ReplaceAllStringFunc(v, func(m string) string {
+			name := m[2 : len(m)-1]
+			value, ok := os.LookupEnv(name)
+			if !ok && missing == "" {
+				missing = name
+			}
+			return value
+		})
+		if missing != "" {
+			return nil, &ConfigError{Path: path, Reason: fmt.Sprintf("environment variable %s not set", missing)}
+		}
+		return s, nil
+	case map[string]interface{}:
+		for key, value := range v {
+			expanded, err := expandConfigVars(value, configPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			v[key] = expanded
+		}
+	case []interface{}:
+		for i, value := range v {
+			expanded, err := expandConfigVars(value, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	}
+	return v, nil
+}
+
+// checkConfigFields checks that the objects of a config tree
+// only have the fields of a given type.
+func checkConfigFields(v interface{}, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			fields[name] = t.Field(i).Type
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ft, ok := fields[key]
+			if !ok {
+				return &ConfigError{Path: configPath(path, key), Reason: "unknown field"}
+			}
+			if err := checkConfigFields(v[key], ft, configPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, value := range v {
+			if err := checkConfigFields(value, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// configTypeError converts a JSON decoding error to a *ConfigError.
+func configTypeError(err error) error {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		return &ConfigError{Path: e.Field, Reason: fmt.Sprintf("expected %s, got %s", e.Type, e.Value)}
+	}
+	return err
+}
+
+// configPath appends a field name to a config path.
+func configPath(path string, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// validate checks the values of a config.
+func (cfg Config) validate() error {
+	invalid := func(path string, format string, a ...interface{}) error {
+		return &ConfigError{Path: path, Reason: fmt.Sprintf(format, a...)}
+	}
+	// Sources, in the order LookupAsn tries them
+	order := []string{SourceGeoIP, SourceIpinfo, SourceCymru}
+	last := -1
+	for i, s := range cfg.Sources {
+		rank := -1
+		for r, o := range order {
+			if s == o {
+				rank = r
+			}
+		}
+		path := fmt.Sprintf("sources[%d]", i)
+		if rank < 0 {
+			return invalid(path, "unknown source '%s', expected one of %s", s, strings.Join(order, ", "))
+		}
+		if rank <= last {
+			return invalid(path, "source '%s' duplicated or out of order, expected %s", s, strings.Join(order, ", "))
+		}
+		last = rank
+	}
+	durations := map[string]ConfigDuration{
+		"timeout":               cfg.Timeout,
+		"close_timeout":         cfg.CloseTimeout,
+		"cache.soft_ttl":        cfg.Cache.SoftTTL,
+		"cache.prefix_soft_ttl": cfg.Cache.PrefixSoftTTL,
+	}
+	if m := cfg.Mongo; m != nil {
+		durations["mongo.timeout"] = m.Timeout
+		for path, v := range map[string]string{"mongo.url": m.URL, "mongo.database": m.Database, "mongo.collection": m.Collection} {
+			if v == "" {
+				return invalid(path, "missing")
+			}
+		}
+	}
+	if g := cfg.GeoIP; g != nil && (g.V4 == "" || g.V6 == "") {
+		return invalid("geoip", "both v4 and v6 database files are needed")
+	}
+	if i := cfg.Ipinfo; i != nil {
+		durations["ipinfo.cooldown"] = i.Cooldown
+		if i.Rate < 0 {
+			return invalid("ipinfo.rate", "negative rate")
+		}
+		if i.Burst < 0 {
+			return invalid("ipinfo.burst", "negative burst")
+		}
+	}
+	if c := cfg.Cymru; c != nil {
+		durations["cymru.min_ttl"] = c.MinTTL
+		durations["cymru.max_ttl"] = c.MaxTTL
+		if c.MinTTL > c.MaxTTL {
+			return invalid("cymru.min_ttl", "greater than cymru.max_ttl")
+		}
+	}
+	if b := cfg.OverridesBreaker; b != nil {
+		durations["overrides_breaker.cooldown"] = b.Cooldown
+		durations["overrides_breaker.probe_timeout"] = b.ProbeTimeout
+		if b.Failures < 0 {
+			return invalid("overrides_breaker.failures", "negative threshold")
+		}
+		if cfg.Mongo == nil {
+			return invalid("overrides_breaker", "no mongo collection to guard")
+		}
+	}
+	if b := cfg.Bogons; b != nil {
+		durations["bogons.refresh"] = b.Refresh
+	}
+	if a := cfg.Anonymize; a != nil {
+		if a.V4Bits < 0 || a.V4Bits > 32 {
+			return invalid("anonymize.v4_bits", "expected a prefix length up to 32")
+		}
+		if a.V6Bits < 0 || a.V6Bits > 128 {
+			return invalid("anonymize.v6_bits", "expected a prefix length up to 128")
+		}
+	}
+	paths := make([]string, 0, len(durations))
+	for path := range durations {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if durations[path] < 0 {
+			return invalid(path, "negative duration")
+		}
+	}
+	return nil
+}
+
+// options returns the handler options of a config.
+func (cfg Config) options() []Option {
+	var opts []Option
+	if cfg.CloseTimeout > 0 {
+		opts = append(opts, WithCloseTimeout(time.Duration(cfg.CloseTimeout)))
+	}
+	if len(cfg.Sources) > 0 {
+		sources := append([]string{SourceCache, SourceOverrides, SourceFixtures}, cfg.Sources...)
+		opts = append(opts, func(h *Handler) error {
+			h.sources = sources
+			return nil
+		})
+	}
+	if g := cfg.GeoIP; g != nil {
+		opts = append(opts, WithGeoIPFiles(g.V4, g.V6))
+	}
+	if i := cfg.Ipinfo; i != nil {
+		limits := IpinfoLimits{Rate: i.Rate, Burst: i.Burst, Cooldown: time.Duration(i.Cooldown)}
+		opts = append(opts, WithIpinfoClient(NewIpinfoClient(i.Token, limits)))
+	}
+	if c := cfg.Cymru; c != nil {
+		opts = append(opts, WithCymruTTL(time.Duration(c.MinTTL), time.Duration(c.MaxTTL)))
+	}
+	if cfg.Cache.PrefixMode {
+		opts = append(opts, WithPrefixCache())
+	}
+	if cfg.Cache.SoftTTL > 0 {
+		opts = append(opts, WithSoftTTL(CacheASN, time.Duration(cfg.Cache.SoftTTL)))
+	}
+	if cfg.Cache.PrefixSoftTTL > 0 {
+		opts = append(opts, WithSoftTTL(CachePrefix, time.Duration(cfg.Cache.PrefixSoftTTL)))
+	}
+	if b := cfg.OverridesBreaker; b != nil {
+		opts = append(opts, WithOverridesBreaker(OverridesBreakerConfig{
+			Failures:     b.Failures,
+			Cooldown:     time.Duration(b.Cooldown),
+			ProbeTimeout: time.Duration(b.ProbeTimeout),
+		}))
+	}
+	if b := cfg.Bogons; b != nil {
+		opts = append(opts, WithBogons(b.V4URL, b.V6URL, time.Duration(b.Refresh)))
+	}
+	if a := cfg.Anonymize; a != nil {
+		opts = append(opts, WithAnonymization(a.V4Bits, a.V6Bits))
+	}
+	if cfg.PrivacySecret != "" {
+		opts = append(opts, WithPrivacy([]byte(cfg.PrivacySecret)))
+	}
+	if cfg.RedactIPs {
+		opts = append(opts, WithRedactIPs())
+	}
+	if cfg.KeyTracking {
+		opts = append(opts, WithKeyTracking())
+	}
+	return opts
+}
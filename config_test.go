@@ -0,0 +1,110 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateConfigExamples(t *testing.T) {
+	t.Setenv("GEOIPDB_MONGO_URL", "mongodb://127.0.0.1:27017")
+	t.Setenv("IPINFO_TOKEN", "secret")
+	t.Setenv("GEOIPDB_PRIVACY_SECRET", "hmac key")
+	examples, _ := filepath.Glob("testdata/config/*")
+	if len(examples) == 0 {
+		t.Fatalf("no example config")
+	}
+	for _, path := range examples {
+		if err := ValidateConfig(path); err != nil {
+			t.Fatalf("ValidateConfig(%s) failed: %s", path, err)
+		}
+	}
+	cfg, err := loadConfig("testdata/config/full.yaml")
+	if err != nil {
+		t.Fatalf("loadConfig failed: %s", err)
+	}
+	if cfg.Ipinfo.Token != "secret" || cfg.Mongo.URL != "mongodb://127.0.0.1:27017" ||
+		cfg.Ipinfo.Burst != 20 || time.Duration(cfg.Cymru.MaxTTL) != 24*time.Hour {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	// Options of the minimal example
+	cfg, err = loadConfig("testdata/config/minimal.json")
+	if err != nil {
+		t.Fatalf("loadConfig failed: %s", err)
+	}
+	h := newHandler(nil, time.Duration(cfg.Timeout))
+	for _, opt := range cfg.options() {
+		if err := opt(&h); err != nil {
+			t.Fatalf("config option failed: %s", err)
+		}
+	}
+	if sources := h.Sources(); !reflect.DeepEqual(sources, []string{SourceCache, SourceCymru}) {
+		t.Fatalf("unexpected sources %v", sources)
+	}
+	if h.ipinfo.token != "secret" || h.timeout != 5*time.Second {
+		t.Fatalf("unexpected handler configuration")
+	}
+}
+
+func TestValidateConfigErrors(t *testing.T) {
+	t.Setenv("IPINFO_TOKEN", "secret")
+	os.Unsetenv("GEOIPDB_UNSET")
+	tests := []struct {
+		file   string
+		config string
+		path   string
+	}{
+		{"unknown.json", `{"cache": {"soft": "1m"}}`, "cache.soft"},
+		{"unknown.yaml", "ipinfo:\n  token: x\n  rate_limit: 3\n", "ipinfo.rate_limit"},
+		{"source.yaml", "sources: [geoip, cymru, whois]\n", "sources[2]"},
+		{"order.json", `{"sources": ["cymru", "ipinfo"]}`, "sources[1]"},
+		{"env.json", `{"sources": ["${IPINFO_TOKEN}"]}`, "sources[0]"},
+		{"unset.json", `{"ipinfo": {"token": "${GEOIPDB_UNSET}"}}`, "ipinfo.token"},
+		{"duration.json", `{"cymru": {"min_ttl": "1 minute"}}`, ""},
+		{"negative.yml", "overrides_breaker:\n  cooldown: -1s\nmongo: {url: x, database: y, collection: z}\n", "overrides_breaker.cooldown"},
+		{"type.json", `{"ipinfo": {"burst": "many"}}`, "ipinfo.burst"},
+		{"mongo.json", `{"mongo": {"url": "x", "database": "y"}}`, "mongo.collection"},
+		{"breaker.json", `{"overrides_breaker": {}}`, "overrides_breaker"},
+		{"ttl.json", `{"cymru": {"min_ttl": "1h", "max_ttl": "1m"}}`, "cymru.min_ttl"},
+		{"syntax.json", `{"timeout": "1s",}`, ""},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if err := os.WriteFile(path, []byte(test.config), 0644); err != nil {
+			t.Fatalf("cannot write config: %s", err)
+		}
+		var e *ConfigError
+		if err := ValidateConfig(path); !errors.As(err, &e) || e.File != path || e.Path != test.path {
+			t.Fatalf("ValidateConfig(%s) returned %v", test.file, err)
+		}
+	}
+}
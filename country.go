@@ -0,0 +1,251 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// CountryNotFoundError is returned by LookupCountry
+// when no source knows the country of an IP address.
+var CountryNotFoundError = newClassError("country not found", NotFoundError)
+
+// mmdbCountryRecord is the country data of GeoLite2 Country
+// and City database records.
+type mmdbCountryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// WithCountryMMDB makes the handler answer LookupCountry
+// from a given GeoLite2 Country or City database file (.mmdb),
+// rather than from the database given by WithMMDB.
+// The file is checked when opened (see ValidateMMDBFile).
+func WithCountryMMDB(path string) Option {
+	return func(h *Handler) error {
+		r, err := openMMDB(path)
+		if err != nil {
+			return err
+		}
+		h.countryDB = r
+		return nil
+	}
+}
+
+// LookupCountry answers the ISO 3166-1 alpha-2 code of the country
+// of an IP address ("US"),
+// from the country database of the handler (see WithCountryMMDB),
+// or else from the country field of its GeoLite2 database, if any
+// (see WithMMDB), falling back to ipinfo.io
+// when the local database does not know the address,
+// unless ipinfo.io is not a source of the handler (see Sources).
+//
+// Answers and unknown addresses are cached as LookupAsn ones:
+// as long (see WithCacheTTL and WithNegativeTTL),
+// keyed the same way (see WithPrivacy and WithAnonymization),
+// and up to the same capacity (see WithCacheCapacity).
+//
+// Returns the country code,
+// MalformedIPError or PrivateIPError for local addresses,
+// which are not looked up,
+// or CountryNotFoundError if no source knows the address.
+func (h Handler) LookupCountry(ip string) (string, error) {
+	code, err := h.lookupCountry(context.Background(), ip)
+	return code, h.redactError(err)
+}
+
+// lookupCountry is LookupCountry, with a context.
+func (h Handler) lookupCountry(ctx context.Context, ip string) (string, error) {
+	if h.runs.closed.Load() {
+		return "", HandlerClosedError
+	}
+	ipAddr, _ := iputils.ParseIP(ip)
+	addr, err := netip.ParseAddr(ip)
+	if ipAddr == nil || err != nil {
+		return "", MalformedIPError
+	}
+	if iputils.IsLocalIP(ipAddr) {
+		return "", PrivateIPError
+	}
+	key := h.cacheKey(addr.Unmap().WithZone("").String())
+	if entry, ok := h.countries.lookup(key, h.cache.now()); ok {
+		return entry.code, entry.err
+	}
+	code, err := h.mmdbCountry(ip)
+	if err != nil {
+		h.logf("warning: country lookup failed for ip '%s': %s\n", ip, err)
+	}
+	if code == "" && (lookupConfig{sources: h.Sources()}).allows(SourceIpinfo) {
+		var record IpInfoRecord
+		err = h.ipinfoGuard.do(ctx, h.sourceTimeout(SourceIpinfo), func(ctx context.Context) error {
+			var err error
+			record, err = h.ipinfoClient().record(ctx, ip)
+			return err
+		})
+		code = record.Country
+	}
+	if ctxErr(ctx) != nil {
+		return "", ctxErr(ctx)
+	}
+	if code == "" {
+		if err == nil {
+			err = CountryNotFoundError
+		}
+		// Only definite answers are cached, not failures of sources
+		if h.negativeTTL > 0 && errors.Is(err, NotFoundError) {
+			h.countries.store(key, countryCacheEntry{err: err, due: h.cache.now().Add(h.negativeTTL)}, h.cache.capacity)
+		}
+		return "", err
+	}
+	h.countries.store(key, countryCacheEntry{code: code, due: h.cache.now().Add(h.cache.defaultTTL())}, h.cache.capacity)
+	return code, nil
+}
+
+// mmdbCountry queries the country database of the handler,
+// or else its GeoLite2 database, for the country code of an IP address.
+//
+// Returns the country code, empty if unknown.
+func (h Handler) mmdbCountry(ip string) (string, error) {
+	db := h.countryDB
+	if db == nil {
+		db = h.mmdb
+	}
+	ipAddr, _ := iputils.ParseIP(ip)
+	if db == nil || ipAddr == nil {
+		return "", nil
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return "", HandlerClosedError
+	}
+	var record mmdbCountryRecord
+	if err := db.Lookup(ipAddr, &record); err != nil {
+		h.corrupt.Add(1)
+		return "", &CorruptDatabaseError{Path: db.path, Reason: err.Error()}
+	}
+	if record.Country.IsoCode != "" {
+		return record.Country.IsoCode, nil
+	}
+	return record.RegisteredCountry.IsoCode, nil
+}
+
+// countryCacheEntry is a country answer cached by LookupCountry.
+type countryCacheEntry struct {
+	// Cache key of the IP address (see Handler.cacheKey)
+	key string
+	// Country code
+	code string
+	// Error of negative entries
+	err error
+	// Due date of this entry
+	due time.Time
+}
+
+// countryCache caches country answers by IP address,
+// keyed as the cache of LookupAsn.
+type countryCache struct {
+	// Concurrent access control to map and list
+	*sync.Mutex
+	entries map[string]*list.Element
+	// Entries by recency of use, most recent first
+	lru *list.List
+}
+
+// newCountryCache returns an empty initialized countryCache.
+func newCountryCache() countryCache {
+	return countryCache{
+		&sync.Mutex{},
+		make(map[string]*list.Element),
+		list.New(),
+	}
+}
+
+// store caches a country answer,
+// evicting the least recently used entries beyond capacity,
+// unless capacity is zero.
+func (c countryCache) store(key string, entry countryCacheEntry, capacity int) {
+	c.Lock()
+	defer c.Unlock()
+	entry.key = key
+	if elt, ok := c.entries[key]; ok {
+		elt.Value = entry
+		c.lru.MoveToFront(elt)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for capacity > 0 && c.lru.Len() > capacity {
+		elt := c.lru.Back()
+		c.lru.Remove(elt)
+		delete(c.entries, elt.Value.(countryCacheEntry).key)
+	}
+}
+
+// lookup retrieves a country answer not expired at a given time.
+//
+// Returns the cached entry and whether the key was found in cache.
+func (c countryCache) lookup(key string, now time.Time) (countryCacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elt, ok := c.entries[key]
+	if !ok {
+		return countryCacheEntry{}, false
+	}
+	entry := elt.Value.(countryCacheEntry)
+	if now.After(entry.due) {
+		c.lru.Remove(elt)
+		delete(c.entries, key)
+		return countryCacheEntry{}, false
+	}
+	c.lru.MoveToFront(elt)
+	return entry, true
+}
+
+// len returns the number of cached answers.
+func (c countryCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
+
+// purgeAll removes all entries from the cache.
+func (c countryCache) purgeAll() {
+	c.Lock()
+	defer c.Unlock()
+	clear(c.entries)
+	c.lru.Init()
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLookupCountry(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/9.9.9.9/json":
+			w.Write([]byte(`{"ip": "9.9.9.9", "country": "CH", "org": "AS19281 Quad9"}`))
+		case "/4.4.4.4/json":
+			w.Write([]byte(`{"ip": "4.4.4.4", "org": "AS3356 Level 3 Parent, LLC"}`))
+		case "/5.5.5.5/json":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	newCountryHandler := func(opts ...Option) Handler {
+		h := newHandler(nil, time.Second)
+		h.ipinfo.baseURL = ts.URL
+		for _, opt := range append(opts, WithAsnSources(BuiltinSource(SourceMMDB), BuiltinSource(SourceIpinfo))) {
+			if err := opt(&h); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return h
+	}
+	h := newCountryHandler(WithMMDB(testMMDB), WithCountryMMDB("testdata/mmdb/GeoLite2-Country-Test.mmdb"))
+	for _, test := range []struct {
+		ip       string
+		code     string
+		err      error
+		requests int32
+	}{
+		{"8.8.8.8", "US", nil, 0},
+		{"2001:4860:4860::8888", "US", nil, 0},
+		{"::ffff:1.1.1.1", "AU", nil, 0},
+		// Unknown to the database
+		{"9.9.9.9", "CH", nil, 1},
+		{"4.4.4.4", "", CountryNotFoundError, 1},
+		// Cached
+		{"9.9.9.9", "CH", nil, 0},
+		{"4.4.4.4", "", CountryNotFoundError, 0},
+		// Not looked up
+		{"10.0.0.1", "", PrivateIPError, 0},
+		{"192.0.2.1", "", PrivateIPError, 0},
+		{"fe80::1", "", PrivateIPError, 0},
+		{"ns1.google.com", "", MalformedIPError, 0},
+	} {
+		before := requests.Load()
+		code, err := h.LookupCountry(test.ip)
+		if code != test.code || err != test.err {
+			t.Errorf("LookupCountry(%s) answered %q %v, expected %q %v", test.ip, code, err, test.code, test.err)
+		}
+		if n := requests.Load() - before; n != test.requests {
+			t.Errorf("LookupCountry(%s) sent %d ipinfo.io requests, expected %d", test.ip, n, test.requests)
+		}
+	}
+
+	// Cached answers expire by the clock of the handler
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h = newCountryHandler(WithClock(clock), WithCacheTTL(time.Hour), WithNegativeTTL(10*time.Minute))
+	for _, step := range []struct {
+		advance  time.Duration
+		ip       string
+		requests int32
+	}{
+		{0, "4.4.4.4", 1},
+		{0, "9.9.9.9", 1},
+		{9 * time.Minute, "4.4.4.4", 0},
+		{2 * time.Minute, "4.4.4.4", 1},
+		{48 * time.Minute, "9.9.9.9", 0},
+		{2 * time.Minute, "9.9.9.9", 1},
+	} {
+		clock.advance(step.advance)
+		before := requests.Load()
+		h.LookupCountry(step.ip)
+		if n := requests.Load() - before; n != step.requests {
+			t.Errorf("LookupCountry(%s) sent %d ipinfo.io requests after %s, expected %d", step.ip, n, step.advance, step.requests)
+		}
+	}
+
+	// Failures of ipinfo.io are not cached
+	for i := 0; i < 2; i++ {
+		before := requests.Load()
+		if _, err := h.LookupCountry("5.5.5.5"); err == nil || errors.Is(err, NotFoundError) {
+			t.Errorf("LookupCountry answered %v despite ipinfo.io failure", err)
+		}
+		if requests.Load() == before {
+			t.Errorf("LookupCountry failure of ipinfo.io cached")
+		}
+	}
+
+	// Answers are bounded by the cache capacity
+	h = newCountryHandler(WithCacheCapacity(1))
+	for _, ip := range []string{"9.9.9.9", "4.4.4.4", "9.9.9.9"} {
+		before := requests.Load()
+		h.LookupCountry(ip)
+		if n := requests.Load() - before; n != 1 {
+			t.Errorf("LookupCountry(%s) sent %d ipinfo.io requests past capacity, expected 1", ip, n)
+		}
+	}
+	if n := h.countries.len(); n != 1 {
+		t.Errorf("%d country answers cached, expected 1", n)
+	}
+
+	// Answers are keyed as the cache of LookupAsn
+	h = newCountryHandler(WithPrivacy([]byte("secret")))
+	h.LookupCountry("9.9.9.9")
+	for key := range h.countries.entries {
+		if key != h.cacheKey("9.9.9.9") {
+			t.Errorf("country answer of 9.9.9.9 cached under key %q", key)
+		}
+	}
+	h = newCountryHandler(WithAnonymization(24, 48))
+	h.LookupCountry("9.9.9.9")
+	if code, err := h.LookupCountry("9.9.9.1"); code != "CH" || err != nil {
+		t.Errorf("LookupCountry answered %q %v for anonymized 9.9.9.1", code, err)
+	}
+
+	// GeoLite2 ASN databases have no country
+	h = newCountryHandler(WithMMDB(testMMDB))
+	if code, err := h.LookupCountry("9.9.9.9"); code != "CH" || err != nil {
+		t.Errorf("LookupCountry answered %q %v without country database", code, err)
+	}
+	// Fixture handlers query no external service
+	requests.Store(0)
+	if code, err := NewFixtureHandler().LookupCountry("8.8.8.8"); err != CountryNotFoundError || requests.Load() != 0 {
+		t.Errorf("fixture handler answered %q %v", code, err)
+	}
+}
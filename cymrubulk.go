@@ -0,0 +1,220 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// cymruWhoisServer is Team Cymru's whois server.
+	cymruWhoisServer = "whois.cymru.com:43"
+	// cymruWhoisIdleTimeout bounds the wait for each answer line
+	// of the bulk whois interface, when the handler has no timeout.
+	cymruWhoisIdleTimeout = time.Second * 30
+)
+
+// CymruRecord is the route of an IP address,
+// as answered by Team Cymru's bulk whois interface.
+type CymruRecord struct {
+	IP  string `json:"ip"`
+	Asn string `json:"asn"`
+	// BGP prefix, invalid if unknown
+	Prefix netip.Prefix `json:"prefix"`
+	// Country, regional registry and allocation date of the prefix,
+	// empty if unknown
+	Country   string    `json:"country,omitempty"`
+	Registry  string    `json:"registry,omitempty"`
+	Allocated time.Time `json:"allocated,omitzero"`
+	AsName    string    `json:"as_name,omitempty"`
+}
+
+// CymruBulkLookup resolves many IP addresses at once
+// with Team Cymru's bulk whois interface (whois.cymru.com, TCP port 43),
+// which Team Cymru asks bulk users to prefer to their DNS services.
+//
+// Each read of the answer is bounded by the handler timeout
+// (30 seconds if none).
+//
+// Returns the records by IP address, as given in ips.
+// Addresses without ASN ("NA") are left out.
+// If the connection fails midway, or the answer misses addresses,
+// the records received are returned along with the error.
+func (h Handler) CymruBulkLookup(ips []string) (map[string]CymruRecord, error) {
+	return h.CymruBulkLookupCtx(context.Background(), ips)
+}
+
+// CymruBulkLookupCtx is CymruBulkLookup, with a context:
+// the lookup is given up when ctx is done,
+// failing with its error along with the records received before.
+func (h Handler) CymruBulkLookupCtx(ctx context.Context, ips []string) (map[string]CymruRecord, error) {
+	answer := make(map[string]CymruRecord)
+	// IP addresses as given, by canonical form
+	given := make(map[string][]string, len(ips))
+	query := []string{"begin", "verbose"}
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return answer, MalformedIPError
+		}
+		key := addr.Unmap().WithZone("").String()
+		if _, ok := given[key]; !ok {
+			query = append(query, key)
+		}
+		given[key] = append(given[key], ip)
+	}
+	if len(given) == 0 {
+		return answer, nil
+	}
+	if h.offline {
+		return answer, OfflineModeError
+	}
+	query = append(query, "end", "")
+	idle := h.timeout
+	if idle <= 0 {
+		idle = cymruWhoisIdleTimeout
+	}
+	dialer := net.Dialer{Timeout: idle}
+	conn, err := dialer.DialContext(ctx, "tcp", h.cymruWhois)
+	if err != nil {
+		if err := ctxErr(ctx); err != nil {
+			return answer, err
+		}
+		return answer, fmt.Errorf("cannot reach cymru whois server '%s': %w", h.cymruWhois, &SourceError{SourceCymru, err})
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	// Send the query while reading the answer,
+	// so that long queries do not wait for the server to read them all
+	go func() {
+		conn.SetWriteDeadline(time.Now().Add(idle))
+		io.WriteString(conn, strings.Join(query, "\n"))
+	}()
+	answered := 0
+	err = parseCymruBulk(&idleReader{conn, idle}, func(record CymruRecord) {
+		ips, ok := given[record.IP]
+		if !ok {
+			return
+		}
+		delete(given, record.IP)
+		answered++
+		if record.Asn == "" {
+			return
+		}
+		for _, ip := range ips {
+			record.IP = ip
+			answer[ip] = record
+		}
+	})
+	if err != nil {
+		if err := ctxErr(ctx); err != nil {
+			return answer, err
+		}
+		return answer, fmt.Errorf("failed to read cymru whois answer: %w", &SourceError{SourceCymru, err})
+	}
+	if len(given) > 0 {
+		return answer, fmt.Errorf("cymru whois answer missing %d of %d addresses", len(given), answered+len(given))
+	}
+	return answer, nil
+}
+
+// idleReader is a connection whose every read is bounded by a timeout.
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+// parseCymruBulk parses an answer of Team Cymru's bulk whois interface
+// in verbose mode, calling fn for each record:
+// "ASN | IP | BGP prefix | country | registry | allocation date | AS name".
+// Records of addresses without ASN ("NA") have an empty Asn.
+// The banner and error lines are skipped.
+//
+// Returns the error reading r, if any.
+func parseCymruBulk(r io.Reader, fn func(CymruRecord)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if record, ok := parseCymruBulkRecord(scanner.Text()); ok {
+			fn(record)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseCymruBulkRecord parses a line of a bulk whois answer.
+// Missing fields and "NA" are left empty.
+//
+// Returns the record, and whether the line is a record.
+func parseCymruBulkRecord(line string) (CymruRecord, bool) {
+	// AS names may contain pipes
+	fields := strings.SplitN(line, "|", 7)
+	if len(fields) < 2 {
+		// Banner, or error
+		return CymruRecord{}, false
+	}
+	field := func(i int) string {
+		if i >= len(fields) {
+			return ""
+		}
+		if f := strings.TrimSpace(fields[i]); f != "NA" {
+			return f
+		}
+		return ""
+	}
+	addr, err := netip.ParseAddr(field(1))
+	if err != nil {
+		return CymruRecord{}, false
+	}
+	record := CymruRecord{IP: addr.Unmap().String()}
+	if asn := field(0); asn != "" {
+		if strings.Trim(asn, "0123456789") != "" {
+			return CymruRecord{}, false
+		}
+		record.Asn = "AS" + asn
+	}
+	if prefix, err := netip.ParsePrefix(field(2)); err == nil {
+		record.Prefix = canonicalPrefix(prefix)
+	}
+	record.Country = field(3)
+	record.Registry = field(4)
+	// Dates are sometimes empty, or zero ("0000-00-00")
+	record.Allocated, _ = time.Parse("2006-01-02", field(5))
+	record.AsName = field(6)
+	return record, true
+}
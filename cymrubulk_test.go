@@ -0,0 +1,144 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCymruBulk is a canned answer of Team Cymru's bulk whois interface.
+const testCymruBulk = `Bulk mode; whois.cymru.com [2024-05-07 12:00:00 +0000]
+15169   | 8.8.8.8          | 8.8.8.0/24          | US | arin     | 2023-12-28 | GOOGLE, US
+13335   | 2606:4700::1111  | 2606:4700::/32      | US | arin     | 2011-11-01 | CLOUDFLARENET, US
+NA      | 192.0.2.1        | NA                  |    | other    |            | NA
+64500|198.51.100.7|198.51.100.0/24||ripencc|0000-00-00|EXAMPLE | WITH PIPES
+Error: no ASN or IP match on line 5.
+3356    | 4.2.2.2          | 4.0.0.0/9
+`
+
+func TestParseCymruBulk(t *testing.T) {
+	var records []CymruRecord
+	if err := parseCymruBulk(strings.NewReader(testCymruBulk), func(r CymruRecord) {
+		records = append(records, r)
+	}); err != nil {
+		t.Fatalf("parseCymruBulk failed: %s", err)
+	}
+	expected := []CymruRecord{
+		{IP: "8.8.8.8", Asn: "AS15169", Prefix: netip.MustParsePrefix("8.8.8.0/24"), Country: "US", Registry: "arin",
+			Allocated: time.Date(2023, 12, 28, 0, 0, 0, 0, time.UTC), AsName: "GOOGLE, US"},
+		{IP: "2606:4700::1111", Asn: "AS13335", Prefix: netip.MustParsePrefix("2606:4700::/32"), Country: "US", Registry: "arin",
+			Allocated: time.Date(2011, 11, 1, 0, 0, 0, 0, time.UTC), AsName: "CLOUDFLARENET, US"},
+		{IP: "192.0.2.1", Registry: "other"},
+		{IP: "198.51.100.7", Asn: "AS64500", Prefix: netip.MustParsePrefix("198.51.100.0/24"), Registry: "ripencc",
+			AsName: "EXAMPLE | WITH PIPES"},
+		{IP: "4.2.2.2", Asn: "AS3356", Prefix: netip.MustParsePrefix("4.0.0.0/9")},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("unexpected records:\n%+v\nexpected:\n%+v", records, expected)
+	}
+}
+
+// startTestWhois starts a bulk whois server on localhost,
+// answering queries with a given function of the query lines.
+//
+// Returns the server address.
+func startTestWhois(t *testing.T, answer func(query []string) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var query []string
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() && scanner.Text() != "end" {
+					query = append(query, scanner.Text())
+				}
+				conn.Write([]byte(answer(query)))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestCymruBulkLookup(t *testing.T) {
+	var query []string
+	h := newHandler(nil, time.Second)
+	h.cymruWhois = startTestWhois(t, func(q []string) string {
+		query = q
+		return testCymruBulk
+	})
+	records, err := h.CymruBulkLookup([]string{"8.8.8.8", "::ffff:8.8.8.8", "2606:4700::1111", "192.0.2.1", "8.8.8.8"})
+	if err != nil {
+		t.Fatalf("CymruBulkLookup failed: %s", err)
+	}
+	if expected := []string{"begin", "verbose", "8.8.8.8", "2606:4700::1111", "192.0.2.1"}; !reflect.DeepEqual(query, expected) {
+		t.Errorf("query %v", query)
+	}
+	if len(records) != 3 || records["8.8.8.8"].Asn != "AS15169" || records["::ffff:8.8.8.8"].IP != "::ffff:8.8.8.8" ||
+		records["2606:4700::1111"].AsName != "CLOUDFLARENET, US" {
+		t.Errorf("unexpected records %+v", records)
+	}
+	if records, err := h.CymruBulkLookup(nil); err != nil || len(records) != 0 {
+		t.Errorf("CymruBulkLookup(nil) answered %v, %v", records, err)
+	}
+	if _, err := h.CymruBulkLookup([]string{"8.8.8.8", "bogus"}); err != MalformedIPError {
+		t.Errorf("CymruBulkLookup of a malformed address failed with %v", err)
+	}
+
+	// Partial answers are returned with an error
+	records, err = h.CymruBulkLookup([]string{"8.8.8.8", "1.1.1.1"})
+	if err == nil || len(records) != 1 || records["8.8.8.8"].Asn != "AS15169" {
+		t.Errorf("partial CymruBulkLookup answered %+v, %v", records, err)
+	}
+
+	// Silent servers time out
+	h = newHandler(nil, time.Millisecond*100)
+	h.cymruWhois = startTestWhois(t, func(q []string) string {
+		time.Sleep(time.Second)
+		return testCymruBulk
+	})
+	start := time.Now()
+	if _, err := h.CymruBulkLookup([]string{"8.8.8.8"}); err == nil {
+		t.Error("CymruBulkLookup of a silent server did not fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("CymruBulkLookup of a silent server took %s", elapsed)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// debugDump is what DebugDump writes.
+type debugDump struct {
+	Status     Status     `json:"status"`
+	CacheStats CacheStats `json:"cache_stats"`
+	TopKeys    *HotKeys   `json:"top_keys,omitempty"`
+}
+
+// debugTopKeys is the number of top keys in a debug dump.
+const debugTopKeys = 20
+
+// DebugDump writes the state of the handler to w,
+// as indented JSON meant for humans troubleshooting it.
+// The format is not stable.
+// IP addresses are redacted if the handler redacts them (see WithRedactIPs).
+func (h Handler) DebugDump(w io.Writer) error {
+	dump := debugDump{
+		Status:     h.Status(),
+		CacheStats: h.CacheStats(),
+		TopKeys:    h.TopKeys(debugTopKeys),
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, h.redact(string(data))+"\n")
+	return err
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultDNSServer is the DNS server queried by default:
+// Google public DNS.
+const defaultDNSServer = "8.8.8.8:53"
+
+// dnsFlights coalesces identical DNS queries in progress,
+// process wide.
+var dnsFlights flightGroup[dnsQuery, *dns.Msg]
+
+// dnsQuery identifies a DNS query.
+type dnsQuery struct {
+	server string
+	name   string
+	qtype  uint16
+}
+
+// DNSExchanger sends DNS queries to a server, as *dns.Client does
+// (see WithResolver).
+type DNSExchanger interface {
+	ExchangeContext(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, time.Duration, error)
+}
+
+// resolver sends DNS queries to a recursive DNS server.
+type resolver struct {
+	// Concurrent access control to client and server (see SetDNSServer)
+	sync.RWMutex
+	client DNSExchanger
+	server string
+	// Whether client was given by WithResolver
+	custom bool
+	// Number of queries coalesced with identical ones in progress
+	coalesced atomic.Uint64
+	// Whether queries are disabled (see WithOfflineMode)
+	offline atomic.Bool
+}
+
+// newResolver creates a resolver
+// querying defaultDNSServer with a given timeout.
+func newResolver(timeout time.Duration) *resolver {
+	c := new(dns.Client)
+	c.Timeout = timeout
+	return &resolver{
+		client: c,
+		server: defaultDNSServer,
+	}
+}
+
+// set repoints the resolver to a given server,
+// with a given query timeout, unless its client is custom.
+// Queries in progress are not affected.
+func (r *resolver) set(server string, timeout time.Duration) {
+	c := new(dns.Client)
+	c.Timeout = timeout
+	r.Lock()
+	defer r.Unlock()
+	if !r.custom {
+		r.client = c
+	}
+	r.server = server
+}
+
+// WithResolver makes the handler send its DNS queries with r,
+// such as a *dns.Client over TCP or TLS,
+// to the DNS server of WithDNSServer, or Google public DNS.
+// Timeouts are then up to r (see SetDNSServer).
+// Identical queries in progress are coalesced process wide,
+// whichever DNSExchanger sends them.
+func WithResolver(r DNSExchanger) Option {
+	return func(h *Handler) error {
+		if r == nil {
+			return fmt.Errorf("nil DNS resolver")
+		}
+		if h.tenant != "" {
+			return fmt.Errorf("derived handlers share the DNS resolver of their parent")
+		}
+		h.resolver.Lock()
+		defer h.resolver.Unlock()
+		h.resolver.client, h.resolver.custom = r, true
+		return nil
+	}
+}
+
+// WithDNSServer makes the handler send its DNS queries,
+// such as those to Team Cymru's DNS service, to a given recursive DNS server
+// ("host:port", port 53 if none), instead of Google public DNS,
+// with a given timeout per query (see SetDNSServer).
+func WithDNSServer(server string, timeout time.Duration) Option {
+	return func(h *Handler) error {
+		return h.SetDNSServer(server, timeout)
+	}
+}
+
+// SetDNSServer repoints the handler, and the handlers derived from it,
+// to a given recursive DNS server ("host:port", port 53 if none),
+// with a given timeout per query, or the DNS client default if zero,
+// unless sending queries with a client given by WithResolver.
+// Queries in progress are not affected.
+func (h Handler) SetDNSServer(server string, timeout time.Duration) error {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || host == "" {
+		return fmt.Errorf("malformed DNS server address '%s'", server)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("negative DNS query timeout")
+	}
+	h.resolver.set(server, timeout)
+	return nil
+}
+
+// query sends a recursive query for a given name and type.
+//
+// Identical queries in progress, from any resolver of the process,
+// are coalesced into a single one whose answer is shared:
+// it must not be modified.
+//
+// Returns the DNS answer, whatever its response code,
+// or OfflineModeError in offline mode.
+func (r *resolver) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if r.offline.Load() {
+		return nil, OfflineModeError
+	}
+	r.RLock()
+	client, server := r.client, r.server
+	r.RUnlock()
+	q := dnsQuery{server, dns.Fqdn(name), qtype}
+	answer, err, shared := dnsFlights.do(ctx, q, func(ctx context.Context) (*dns.Msg, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(q.name, q.qtype)
+		msg.RecursionDesired = true
+		answer, _, err := client.ExchangeContext(ctx, msg, q.server)
+		return answer, err
+	})
+	if shared {
+		r.coalesced.Add(1)
+	}
+	if err != nil {
+		if err := ctxErr(ctx); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	return answer, nil
+}
+
+// ctxErr is ctx.Err(),
+// but also reports a context past its deadline as such,
+// before its timer expires it.
+// Network deadlines derived from ctx may fire first.
+func ctxErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testDNSZone is a DNS zone served by startTestDNS,
+// mapping query names to answer records
+// (in zone file format, one per line).
+// Names not in the zone are answered with NXDOMAIN.
+type testDNSZone map[string][]string
+
+// startTestDNS starts a DNS server on localhost,
+// answering queries with a given handler.
+//
+// Returns the server address.
+func startTestDNS(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// serve answers a DNS query from the zone.
+func (z testDNSZone) serve(w dns.ResponseWriter, req *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	records, ok := z[req.Question[0].Name]
+	if !ok {
+		msg.Rcode = dns.RcodeNameError
+	}
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	w.WriteMsg(msg)
+}
+
+func TestCymruTTL(t *testing.T) {
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+		"AS3356.asn.cymru.com.":  {`AS3356.asn.cymru.com. 30 IN TXT "3356 | US | arin | 2000-03-10 | LEVEL3, US"`},
+	}
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, zone.serve)
+	if err := WithCymruTTL(time.Minute, time.Hour)(&h); err != nil {
+		t.Fatalf("WithCymruTTL failed: %s", err)
+	}
+	tests := []struct {
+		asn   string
+		descr string
+		ttl   time.Duration
+	}{
+		{"AS15169", "GOOGLE, US", time.Hour},
+		{"AS3356", "LEVEL3, US", time.Minute},
+	}
+	for _, test := range tests {
+		descr, ttl, err := h.cymru.lookupTTL(context.Background(), test.asn)
+		if err != nil {
+			t.Fatalf("cymru lookup failed: %s", err)
+		}
+		if descr != test.descr || h.cymruTTL.clamp(ttl) != test.ttl {
+			t.Fatalf("unexpected cymru answer for %s: '%s', %s", test.asn, descr, ttl)
+		}
+		h.cache.store("192.0.2.1", cacheEntry{asn: test.asn, descr: descr, ttl: h.cymruTTL.clamp(ttl)})
+		entry, _, _ := h.cache.lookupByIP("192.0.2.1")
+		if due := time.Until(entry.due); due > test.ttl || due < test.ttl-time.Second {
+			t.Fatalf("unexpected cache due date for %s: in %s", test.asn, due)
+		}
+	}
+	if err := WithCymruTTL(time.Hour, time.Minute)(&h); err == nil {
+		t.Fatalf("expected an error for inverted TTL bounds")
+	}
+}
+
+func TestResolverCoalescing(t *testing.T) {
+	var queries int32
+	release := make(chan struct{})
+	server := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		testDNSZone{
+			"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+		}.serve(w, req)
+	})
+	// Handlers share queries in progress
+	var handlers []Handler
+	for i := 0; i < 2; i++ {
+		h := newHandler(nil, time.Second)
+		h.resolver.server = server
+		handlers = append(handlers, h)
+	}
+	key := dnsQuery{server, "AS15169.asn.cymru.com.", dns.TypeTXT}
+	// The first caller gives up, the query goes on for the others
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, _, err := handlers[0].cymru.lookupTTL(ctx, "AS15169")
+		first <- err
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(h Handler) {
+			defer wg.Done()
+			descr, _, err := h.cymru.lookupTTL(context.Background(), "AS15169")
+			if err != nil || descr != "GOOGLE, US" {
+				t.Errorf("cymru lookup returned '%s', %v", descr, err)
+			}
+		}(handlers[i%2])
+	}
+	for dnsWaiters(key) < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("canceled cymru lookup returned %v", err)
+	}
+	close(release)
+	wg.Wait()
+	if q := atomic.LoadInt32(&queries); q != 1 {
+		t.Fatalf("expected 1 query, got %d", q)
+	}
+	coalesced := handlers[0].Status().DNSCoalesced + handlers[1].Status().DNSCoalesced
+	if coalesced != 4 {
+		t.Fatalf("expected 4 coalesced queries, got %d", coalesced)
+	}
+}
+
+// dnsWaiters returns the number of callers waiting for a DNS query in progress.
+func dnsWaiters(q dnsQuery) int {
+	dnsFlights.mu.Lock()
+	defer dnsFlights.mu.Unlock()
+	if f, ok := dnsFlights.flights[q]; ok {
+		return f.waiters
+	}
+	return 0
+}
+
+func TestSetDNSServer(t *testing.T) {
+	var queries int32
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+	}
+	good := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		zone.serve(w, req)
+	})
+	release := make(chan struct{})
+	defer close(release)
+	silent := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		<-release
+	})
+	h := newHandler(nil, 0)
+	if err := WithDNSServer(good, time.Second)(&h); err != nil {
+		t.Fatalf("WithDNSServer failed: %s", err)
+	}
+	if descr, err := h.CymruDnsLookup("AS15169"); err != nil || descr != "GOOGLE, US" {
+		t.Fatalf("CymruDnsLookup returned %q, %v", descr, err)
+	}
+	if atomic.LoadInt32(&queries) != 1 {
+		t.Fatalf("custom DNS server not consulted")
+	}
+	// Unresponsive servers fail queries after the timeout
+	if err := h.SetDNSServer(silent, time.Millisecond*100); err != nil {
+		t.Fatalf("SetDNSServer failed: %s", err)
+	}
+	start := time.Now()
+	if _, err := h.CymruDnsLookup("AS15169"); err == nil {
+		t.Fatalf("CymruDnsLookup answered through a silent server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("CymruDnsLookup failed after %s", elapsed)
+	}
+	if err := h.SetDNSServer(good, 0); err != nil {
+		t.Fatalf("SetDNSServer failed: %s", err)
+	}
+	if descr, err := h.CymruDnsLookup("AS15169"); err != nil || descr != "GOOGLE, US" {
+		t.Fatalf("CymruDnsLookup returned %q, %v after repointing", descr, err)
+	}
+	for _, server := range []string{"", ":53"} {
+		if err := h.SetDNSServer(server, time.Second); err == nil {
+			t.Fatalf("SetDNSServer accepted '%s'", server)
+		}
+	}
+	if err := h.SetDNSServer("127.0.0.1", -time.Second); err == nil {
+		t.Fatalf("SetDNSServer accepted a negative timeout")
+	}
+	if err := h.SetDNSServer("2001:4860:4860::8888", time.Second); err != nil || h.resolver.server != "[2001:4860:4860::8888]:53" {
+		t.Fatalf("SetDNSServer set %s, %v", h.resolver.server, err)
+	}
+}
+
+func TestParseCymruAsn(t *testing.T) {
+	tests := []struct {
+		txt  string
+		info CymruAsnInfo
+	}{
+		{"15169 | US | arin | 2000-03-30 | GOOGLE, US",
+			CymruAsnInfo{"AS15169", "US", "arin", time.Date(2000, 3, 30, 0, 0, 0, 0, time.UTC), "GOOGLE, US"}},
+		{"  3356|US|arin|2000-03-10|LEVEL3, US  ",
+			CymruAsnInfo{"AS3356", "US", "arin", time.Date(2000, 3, 10, 0, 0, 0, 0, time.UTC), "LEVEL3, US"}},
+		{"64500 | EU | ripencc |  | EXAMPLE | WITH PIPES",
+			CymruAsnInfo{Asn: "AS64500", CountryCode: "EU", Registry: "ripencc", Name: "EXAMPLE | WITH PIPES"}},
+		{"64501 |  | other | 0000-00-00 | ",
+			CymruAsnInfo{Asn: "AS64501", Registry: "other"}},
+		{"64502 | US | arin",
+			CymruAsnInfo{Asn: "AS64502", CountryCode: "US", Registry: "arin"}},
+		{"GOOGLE, US", CymruAsnInfo{Name: "GOOGLE, US"}},
+	}
+	for _, test := range tests {
+		if info := parseCymruAsn(test.txt); info != test.info {
+			t.Errorf("parseCymruAsn(%q) returned %+v", test.txt, info)
+		}
+	}
+}
+
+func TestCymruDnsLookupDetailed(t *testing.T) {
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+		"AS64496.asn.cymru.com.": {`AS64496.asn.cymru.com. 7200 IN TXT "| | | |"`},
+	}
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, zone.serve)
+	info, err := h.CymruDnsLookupDetailed("AS15169")
+	expected := CymruAsnInfo{"AS15169", "US", "arin", time.Date(2000, 3, 30, 0, 0, 0, 0, time.UTC), "GOOGLE, US"}
+	if err != nil || info != expected {
+		t.Errorf("CymruDnsLookupDetailed(AS15169) returned %+v, %v", info, err)
+	}
+	if descr, err := h.CymruDnsLookup("AS15169"); err != nil || descr != "GOOGLE, US" {
+		t.Errorf("CymruDnsLookup(AS15169) returned %q, %v", descr, err)
+	}
+	// Records without fields answer the ASN queried
+	if info, err := h.CymruDnsLookupDetailed("AS64496"); err != nil || info != (CymruAsnInfo{Asn: "AS64496"}) {
+		t.Errorf("CymruDnsLookupDetailed(AS64496) returned %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Classes of failures, which errors returned by the handler match
+// with errors.Is, whatever the specific error.
+var (
+	// SourceTimeoutError matches failures of sources,
+	// such as the overrides store or Team Cymru's DNS service,
+	// which did not answer in time (see SourceError).
+	SourceTimeoutError = errors.New("source timeout")
+	// SourceUnavailableError matches other failures of sources,
+	// such as connection failures, or OverridesUnavailableError.
+	SourceUnavailableError = errors.New("source unavailable")
+	// NotFoundError matches the errors of what is not found,
+	// specific to what is looked up:
+	// AsnNotFoundError, OverridesAsnNotFoundError, CountryNotFoundError...
+	NotFoundError = errors.New("not found")
+	// MalformedInputError matches the errors of malformed input:
+	// MalformedIPError, MalformedAsnError, MalformedPrefixError...
+	MalformedInputError = errors.New("malformed input")
+)
+
+// classError is a sentinel error of a class of failures,
+// such as OverridesAsnNotFoundError of NotFoundError.
+type classError struct {
+	msg   string
+	class error
+}
+
+// newClassError creates a sentinel error of a given class.
+func newClassError(msg string, class error) error {
+	return &classError{msg, class}
+}
+
+func (e *classError) Error() string {
+	return e.msg
+}
+
+func (e *classError) Is(target error) bool {
+	return target == e.class
+}
+
+// SourceError is a failure of a source,
+// such as the overrides store, ipinfo.io or Team Cymru's DNS service,
+// wrapping the failure of its client, such as a *net.OpError.
+// It matches SourceTimeoutError if the source did not answer in time,
+// SourceUnavailableError otherwise.
+type SourceError struct {
+	// Source name, such as SourceOverrides or SourceCymru
+	Source string
+	// Failure of the source, which the error message is
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SourceError) Is(target error) bool {
+	switch target {
+	case SourceTimeoutError:
+		return isTimeout(e.Err)
+	case SourceUnavailableError:
+		return !isTimeout(e.Err)
+	}
+	return false
+}
+
+// isTimeout tells whether an error is a timeout,
+// such as a network timeout or a deadline exceeded.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// brokenOverrides is an overrides store failing with a given error.
+type brokenOverrides struct {
+	OverridesStore
+	err error
+}
+
+func (s brokenOverrides) Get(ctx context.Context, asn string) (AsnOverride, error) {
+	return AsnOverride{}, s.err
+}
+
+func (s brokenOverrides) Set(asn, name string) error {
+	return s.err
+}
+
+// brokenExchanger is a DNSExchanger failing with a given error.
+type brokenExchanger struct {
+	err error
+}
+
+func (e brokenExchanger) ExchangeContext(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	return nil, 0, e.err
+}
+
+func TestErrorClasses(t *testing.T) {
+	for class, sentinels := range map[error][]error{
+		MalformedInputError:    {MalformedIPError, MalformedAsnError, MalformedPrefixError, OverridesMalformedAsnError, OverridesMalformedPrefixError, MalformedCacheFileError},
+		NotFoundError:          {AsnNotFoundError, OverridesAsnNotFoundError, CountryNotFoundError, PTRNotFoundError, PeeringDbNotFoundError, NeighboursNotFoundError, OrgNotFoundError},
+		SourceUnavailableError: {OverridesUnavailableError, IpinfoRateLimitedError, IpinfoForbiddenError},
+	} {
+		for _, err := range sentinels {
+			if !errors.Is(err, class) || !errors.Is(fmt.Errorf("wrapped: %w", err), class) {
+				t.Errorf("%q does not match %q", err, class)
+			}
+			if errors.Is(err, PrivateIPError) || !errors.Is(err, err) {
+				t.Errorf("%q matches another sentinel", err)
+			}
+		}
+	}
+}
+
+func TestErrorsIs(t *testing.T) {
+	h := NewFixtureHandler()
+	h.overrides = NewMemoryOverrides()
+	// Lookups
+	if _, _, err := h.LookupAsn("4.4.4.4"); !errors.Is(err, AsnNotFoundError) || !errors.Is(err, NotFoundError) {
+		t.Errorf("LookupAsn of an unknown address failed with %v", err)
+	}
+	if _, _, err := h.LookupAsn("4.4.4"); !errors.Is(err, MalformedIPError) || !errors.Is(err, MalformedInputError) {
+		t.Errorf("LookupAsn of a malformed address failed with %v", err)
+	}
+	// Missing overrides, even if not found by a wrapped error of the store
+	if _, err := h.OverridesGet("AS64500"); !errors.Is(err, OverridesAsnNotFoundError) || !errors.Is(err, NotFoundError) || errors.Is(err, SourceUnavailableError) {
+		t.Errorf("OverridesGet of a missing override failed with %v", err)
+	}
+	h.overrides = brokenOverrides{h.overrides, fmt.Errorf("mongo: %w", OverridesAsnNotFoundError)}
+	if _, err := h.OverridesGet("AS64500"); err != OverridesAsnNotFoundError {
+		t.Errorf("OverridesGet of a missing override failed with %v", err)
+	}
+	// Overrides store outages
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	for _, test := range []struct {
+		err   error
+		class error
+	}{
+		{refused, SourceUnavailableError},
+		{timeout, SourceTimeoutError},
+		{fmt.Errorf("mongo: %w", timeout), SourceTimeoutError},
+	} {
+		h.overrides = brokenOverrides{NewMemoryOverrides(), test.err}
+		for name, err := range map[string]error{
+			"OverridesGet": func() error { _, err := h.OverridesGet("AS15169"); return err }(),
+			"OverridesSet": h.OverridesSet("AS15169", "Google"),
+		} {
+			var sourceErr *SourceError
+			var opErr *net.OpError
+			if !errors.Is(err, test.class) || errors.Is(err, NotFoundError) ||
+				!errors.As(err, &sourceErr) || sourceErr.Source != SourceOverrides || !errors.As(err, &opErr) {
+				t.Errorf("%s failed with %v, expected %q of the overrides", name, err, test.class)
+			}
+		}
+	}
+	// DNS failures
+	for _, test := range []struct {
+		err   error
+		class error
+	}{
+		{refused, SourceUnavailableError},
+		{timeout, SourceTimeoutError},
+	} {
+		h := newHandler(nil, time.Second)
+		h.cymru.guard = nil
+		if err := WithResolver(brokenExchanger{test.err})(&h); err != nil {
+			t.Fatal(err)
+		}
+		for name, err := range map[string]error{
+			"CymruDnsLookup":    func() error { _, err := h.CymruDnsLookup("AS15169"); return err }(),
+			"CymruOriginLookup": func() error { _, _, err := h.CymruOriginLookup("8.8.8.8"); return err }(),
+		} {
+			var sourceErr *SourceError
+			var opErr *net.OpError
+			if !errors.Is(err, test.class) || !errors.As(err, &sourceErr) || sourceErr.Source != SourceCymru || !errors.As(err, &opErr) {
+				t.Errorf("%s failed with %v, expected %q of cymru", name, err, test.class)
+			}
+		}
+	}
+}
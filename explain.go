@@ -0,0 +1,167 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/netip"
+	"time"
+)
+
+// Explanation tells how LookupAsn found the ASN of an IP address
+// (see Explain).
+type Explanation struct {
+	// IP address as given, and its canonical form if different,
+	// as used by prefix lookups and bogon checks
+	IP         string `json:"ip"`
+	Normalized string `json:"normalized,omitempty"`
+	// Lookup steps, in order
+	Steps []ExplainStep `json:"steps"`
+	// Answer, source it was taken from, and why
+	Asn    string        `json:"asn,omitempty"`
+	Descr  string        `json:"descr,omitempty"`
+	Source string        `json:"source,omitempty"`
+	Reason string        `json:"reason,omitempty"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+	// Lookup failure
+	Error string `json:"error,omitempty"`
+}
+
+// ExplainStep is a step of a lookup.
+type ExplainStep struct {
+	// Source consulted (SourceCache, SourceGeoIP...) or "bogons"
+	Source string `json:"source"`
+	// Outcome: "hit", "miss" or "expired" for caches;
+	// "found", "partial" (ASN without description), "empty" or "failed"
+	// for other sources; "applied" for an override;
+	// "rejected" for bogons; "answer" for the final decision
+	Result string `json:"result"`
+	// Summary of the answer or failure, or reason of the decision
+	Detail string `json:"detail,omitempty"`
+	// Age of cache entries
+	Age time.Duration `json:"age,omitempty"`
+	// Time taken by the source
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// lookupObserver is notified of the steps of a lookup.
+type lookupObserver func(ExplainStep)
+
+// withObserver makes a lookup notify its steps to an observer.
+func withObserver(observer lookupObserver) LookupOption {
+	return func(cfg *lookupConfig) {
+		cfg.observer = observer
+	}
+}
+
+// observe notifies a lookup step to the observer of the lookup, if any.
+func (h Handler) observe(step ExplainStep) {
+	if h.observer != nil {
+		h.observer(step)
+	}
+}
+
+// Explain looks up the ASN of an IP address, as LookupAsn does,
+// recording every step: caches consulted, sources queried,
+// with a summary of their answers and their latency,
+// and which answer was taken and why.
+//
+// IP addresses are redacted if the handler redacts them
+// or is in privacy mode (see WithRedactIPs and WithPrivacy).
+//
+// Returns the explanation, whether the lookup failed or not,
+// and an error if ip is malformed.
+func (h Handler) Explain(ctx context.Context, ip string) (Explanation, error) {
+	redact := func(s string) string { return s }
+	if h.redactIPs || h.privacy != nil {
+		redact = redactIPs
+	}
+	x := Explanation{IP: redact(ip), Steps: []ExplainStep{}}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return x, MalformedIPError
+	}
+	if n := addr.Unmap().WithZone("").String(); n != ip {
+		x.Normalized = redact(n)
+	}
+	entry, err := h.lookupAsn(ctx, ip, newLookupConfig([]LookupOption{
+		withObserver(func(step ExplainStep) {
+			step.Detail = redact(step.Detail)
+			if step.Result == "answer" {
+				x.Source, x.Reason = step.Source, step.Detail
+			}
+			x.Steps = append(x.Steps, step)
+		}),
+	}))
+	if err != nil {
+		x.Error = redact(err.Error())
+		return x, nil
+	}
+	x.Asn, x.Descr, x.TTL = entry.asn, entry.descr, entry.ttl
+	return x, nil
+}
+
+// observeHit notifies a cache hit.
+func (h Handler) observeHit(entry cacheEntry) {
+	detail := entry.asn + " " + entry.descr
+	if entry.err != nil {
+		detail = entry.err.Error()
+	}
+	if entry.source != "" {
+		detail += ", from " + entry.source
+	}
+	if entry.stale {
+		detail += ", stale, revalidating"
+	}
+	h.observe(ExplainStep{Source: SourceCache, Result: "hit", Detail: detail, Age: entry.age(h.cache.now())})
+	h.observe(ExplainStep{Source: SourceCache, Result: "answer", Detail: "cached answer, not yet expired"})
+}
+
+// observeAnswer notifies the answer of a source,
+// queried from a given start time,
+// and logs it at debug level (see WithLogger).
+func (h Handler) observeAnswer(source string, asn string, descr string, err error, start time.Time) {
+	if h.observer == nil && h.logger == nil {
+		return
+	}
+	step := ExplainStep{Source: source, Result: "found", Detail: asn + " " + descr, Latency: time.Since(start)}
+	switch {
+	case err != nil:
+		step.Result, step.Detail = "failed", err.Error()
+	case asn == "" && descr == "":
+		step.Result, step.Detail = "empty", ""
+	case asn == "" || descr == "":
+		step.Result = "partial"
+	}
+	h.observe(step)
+	if h.logger != nil {
+		args := []any{"source", source, "result", step.Result, "asn", asn, "descr", descr, "duration", step.Latency}
+		if err != nil {
+			args = append(args, "error", h.redact(err.Error()))
+		}
+		h.logger.Debug("source lookup", args...)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// explainSteps summarizes explanation steps as "source:result" strings.
+func explainSteps(x Explanation) string {
+	var steps []string
+	for _, step := range x.Steps {
+		steps = append(steps, step.Source+":"+step.Result)
+	}
+	return strings.Join(steps, " ")
+}
+
+func TestExplain(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/8.8.8.8/org":
+			w.Write([]byte("AS15169\n"))
+		case "/1.1.1.1/org":
+			w.Write([]byte("AS13335 Cloudflare, Inc.\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	h.ipinfo.baseURL = ts.URL
+	h.resolver.server = startTestDNS(t, testCymruZone.serve)
+	ctx := context.Background()
+	tests := []struct {
+		ip     string
+		steps  string
+		asn    string
+		source string
+		reason string
+	}{
+		{"8.8.8.8", "cache:miss ipinfo:partial cymru:found ipinfo:answer", "AS15169",
+			SourceIpinfo, "first source with ASN, description from cymru"},
+		{"8.8.8.8", "cache:hit cache:answer", "AS15169", SourceCache, "cached answer, not yet expired"},
+		{"1.1.1.1", "cache:miss ipinfo:found ipinfo:answer", "AS13335",
+			SourceIpinfo, "first source with ASN and description"},
+		{"9.9.9.9", "cache:miss ipinfo:failed cymru:failed", "", "", ""},
+	}
+	for _, test := range tests {
+		x, err := h.Explain(ctx, test.ip)
+		if err != nil {
+			t.Fatalf("Explain(%s) failed: %s", test.ip, err)
+		}
+		if steps := explainSteps(x); steps != test.steps || x.Asn != test.asn ||
+			x.Source != test.source || x.Reason != test.reason {
+			t.Fatalf("unexpected explanation of %s: %s, %+v", test.ip, steps, x)
+		}
+		if test.asn == "" && x.Error == "" {
+			t.Fatalf("failed lookup of %s explained without error", test.ip)
+		}
+	}
+	x, _ := h.Explain(ctx, "1.1.1.1")
+	if x.Normalized != "" || x.Descr != "Cloudflare, Inc." || x.TTL != cacheTTL {
+		t.Fatalf("unexpected explanation: %+v", x)
+	}
+	if x.Steps[0].Age <= 0 {
+		t.Fatalf("cache hit without age: %+v", x.Steps[0])
+	}
+	if x, _ := h.Explain(ctx, "::ffff:1.1.1.1"); x.Normalized != "1.1.1.1" {
+		t.Fatalf("unexpected normalization: %+v", x)
+	}
+	if _, err := h.Explain(ctx, "8.8.8"); err != MalformedIPError {
+		t.Fatalf("unexpected Explain error: %v", err)
+	}
+	// Explanations redact addresses as their handler does
+	WithRedactIPs()(&h)
+	x, _ = h.Explain(ctx, "9.9.9.9")
+	b, err := json.Marshal(x)
+	if err != nil {
+		t.Fatalf("cannot marshal explanation: %s", err)
+	}
+	if strings.Contains(string(b), "9.9.9.9") || !strings.Contains(string(b), "9.9.x.x") {
+		t.Fatalf("unredacted explanation: %s", b)
+	}
+}
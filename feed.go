@@ -0,0 +1,143 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// feed holds a dataset fetched from an external source,
+// refreshed in the background once it gets older than interval.
+//
+// Refreshes are triggered by reads rather than timers,
+// so an idle feed costs nothing.
+// A failed refresh keeps the previous data.
+type feed[T any] struct {
+	// Name used in log messages
+	name string
+	// Refresh interval
+	interval time.Duration
+	// Function fetching a new dataset
+	fetch func(context.Context) (T, error)
+	// Group running background refreshes
+	runs *runGroup
+	// Concurrent access control to fields below
+	sync.RWMutex
+	// Current dataset, and when it was fetched
+	data    T
+	updated time.Time
+	// Last refresh attempt
+	checked time.Time
+	// Whether a refresh is in progress
+	refreshing bool
+}
+
+// newFeed creates a feed, fetching its initial dataset.
+// A failed initial fetch is logged and retried on next refresh.
+// Background refreshes run in run group runs.
+func newFeed[T any](runs *runGroup, name string, interval time.Duration, fetch func(context.Context) (T, error)) *feed[T] {
+	f := &feed[T]{
+		name:     name,
+		interval: interval,
+		fetch:    fetch,
+		runs:     runs,
+	}
+	if err := f.refresh(runs.ctx); err != nil {
+		log.Printf("warning: %s\n", err)
+	}
+	return f
+}
+
+// get returns the current dataset,
+// scheduling a background refresh if due.
+func (f *feed[T]) get() T {
+	f.maybeRefresh()
+	f.RLock()
+	defer f.RUnlock()
+	return f.data
+}
+
+// peek returns the current dataset,
+// without scheduling a refresh.
+func (f *feed[T]) peek() T {
+	f.RLock()
+	defer f.RUnlock()
+	return f.data
+}
+
+// lastUpdate returns when the current dataset was fetched,
+// or the zero time if no fetch succeeded yet.
+func (f *feed[T]) lastUpdate() time.Time {
+	f.RLock()
+	defer f.RUnlock()
+	return f.updated
+}
+
+// maybeRefresh refreshes the dataset in the background
+// if interval has elapsed since the last attempt,
+// unless the run group is closed.
+func (f *feed[T]) maybeRefresh() {
+	f.Lock()
+	if f.refreshing || time.Since(f.checked) < f.interval {
+		f.Unlock()
+		return
+	}
+	f.refreshing = true
+	f.Unlock()
+	err := f.runs.run(func(ctx context.Context) {
+		if err := f.refresh(ctx); err != nil {
+			log.Printf("warning: %s\n", err)
+		}
+		f.Lock()
+		f.refreshing = false
+		f.Unlock()
+	})
+	if err != nil {
+		f.Lock()
+		f.refreshing = false
+		f.Unlock()
+	}
+}
+
+// refresh fetches a new dataset and swaps it in.
+func (f *feed[T]) refresh(ctx context.Context) error {
+	f.Lock()
+	f.checked = time.Now()
+	f.Unlock()
+	data, err := f.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("%s refresh failed: %w", f.name, err)
+	}
+	f.Lock()
+	f.data = data
+	f.updated = time.Now()
+	f.Unlock()
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/turbobytes/geoipdb/internal/fixtures"
+)
+
+// NewFixtureHandler creates a handler answering LookupAsn
+// from a fixed set of mappings instead of its usual sources,
+// for deterministic examples and tests.
+// It queries no network service nor database.
+// (The mappings are listed by package geoipdbtest.)
+//
+// Addresses outside the mappings are not found.
+// Other features, such as PTR lookups, are not covered.
+//
+// Returns a geoipdb handler.
+func NewFixtureHandler() Handler {
+	h := newHandler(nil, time.Second)
+	h.fixtures = newPrefixTrie[fixtures.Mapping]()
+	for _, m := range fixtures.Mappings {
+		h.fixtures.insert(netip.MustParsePrefix(m.Prefix), m)
+	}
+	return h
+}
+
+// lookupFixture searches the fixture mappings for the ASN of an ip address.
+//
+// Returns the cache entry to store.
+func (h Handler) lookupFixture(ctx context.Context, ip string) (cacheEntry, error) {
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		if _, m, ok := h.fixtures.lookup(addr); ok {
+			return h.newCacheEntry(ctx, m.Asn, SourceFixtures, map[string]string{SourceFixtures: m.Descr}, SourceFixtures), nil
+		}
+	}
+	return cacheEntry{}, fmt.Errorf("%w for ip '%v'", AsnNotFoundError, ip)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls sharing a key,
+// so that only one of them does the actual work.
+//
+// The work runs with its own context,
+// canceled once every caller waiting for it gave up,
+// so that one caller canceling does not fail the others.
+type flightGroup[K comparable, V any] struct {
+	mu      sync.Mutex
+	flights map[K]*flight[V]
+}
+
+// flight is a call in progress.
+type flight[V any] struct {
+	done   chan struct{}
+	value  V
+	err    error
+	cancel context.CancelFunc
+	// Number of callers waiting
+	waiters int
+}
+
+// do runs fn, unless a call for the same key is in progress,
+// in which case do waits for it and shares its outcome.
+//
+// Returns fn outcome, and whether it was shared with another caller.
+func (g *flightGroup[K, V]) do(ctx context.Context, key K, fn func(context.Context) (V, error)) (V, error, bool) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[K]*flight[V])
+	}
+	f, shared := g.flights[key]
+	if !shared {
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight[V]{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.flights[key] = f
+		go func() {
+			f.value, f.err = fn(fctx)
+			g.mu.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+	select {
+	case <-f.done:
+		return f.value, f.err, shared
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Later callers start afresh, rather than share the cancelation
+			f.cancel()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mu.Unlock()
+		var zero V
+		return zero, ctx.Err(), shared
+	}
+}
+
+// lookupFlights coalesce concurrent lookups
+// of a handler and the handlers derived from it (see Derive).
+type lookupFlights struct {
+	// Uncached lookups of IP addresses (see LookupAsn)
+	ips flightGroup[ipFlightKey, cacheEntry]
+	// Lookups of ASN descriptions (see LookupAsnDescr)
+	asns flightGroup[asnFlightKey, string]
+}
+
+// ipFlightKey identifies the uncached lookups of an IP address
+// which may share their outcome.
+type ipFlightKey struct {
+	tenant string
+	ip     string
+	// Sources allowed, comma separated
+	sources string
+	refresh bool
+}
+
+// asnFlightKey identifies the lookups of an ASN description
+// which may share their outcome.
+type asnFlightKey struct {
+	tenant string
+	asn    string
+}
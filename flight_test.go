@@ -0,0 +1,137 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// flightWaiters returns the number of callers waiting for a flight.
+func flightWaiters[K comparable, V any](g *flightGroup[K, V], key K) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f.waiters
+	}
+	return 0
+}
+
+// waitFlight waits for n callers to wait for a flight.
+func waitFlight[K comparable, V any](t *testing.T, g *flightGroup[K, V], key K, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); flightWaiters(g, key) < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers waiting, expected %d", flightWaiters(g, key), n)
+		}
+	}
+}
+
+func TestLookupFlights(t *testing.T) {
+	const callers = 100
+	var requests, queries int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Write([]byte("AS15169 Google LLC\n"))
+	}))
+	defer ts.Close()
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+	}
+	h := newHandler(nil, time.Second*10)
+	h.ipinfo.baseURL = ts.URL
+	h.resolver.server = startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		zone.serve(w, req)
+	})
+	ctx := context.Background()
+	// run calls lookup concurrently, once the first caller is released
+	run := func(lookup func() (string, error), expected string, waiting func(n int)) {
+		t.Helper()
+		var wg sync.WaitGroup
+		errs := make(chan error, callers)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				answer, err := lookup()
+				if err == nil && answer != expected {
+					t.Errorf("lookup answered %q, expected %q", answer, expected)
+				}
+				errs <- err
+			}()
+		}
+		waiting(callers)
+		release <- struct{}{}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("lookup failed: %s", err)
+			}
+		}
+	}
+	ipKey := ipFlightKey{ip: "8.8.8.8"}
+	lookupIP := func() (string, error) {
+		asn, _, err := h.LookupAsn("8.8.8.8")
+		return asn, err
+	}
+	run(lookupIP, "AS15169", func(n int) { waitFlight(t, &h.flights.ips, ipKey, n) })
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("%d concurrent lookups of an IP sent %d ipinfo.io requests", callers, n)
+	}
+	if fills := h.CacheStats().ASN.Fills; fills[SourceIpinfo] != 1 {
+		t.Fatalf("shared lookup filled the cache %d times", fills[SourceIpinfo])
+	}
+	asnKey := asnFlightKey{asn: "AS15169"}
+	lookupASN := func() (string, error) {
+		return h.LookupAsnDescr(ctx, "AS15169")
+	}
+	// Descriptions cached by LookupAsn are not looked up
+	h.AsnCachePurge()
+	run(lookupASN, "GOOGLE, US", func(n int) { waitFlight(t, &h.flights.asns, asnKey, n) })
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("%d concurrent lookups of an ASN sent %d DNS queries", callers, n)
+	}
+	// Purges between flights make lookups afresh
+	h.AsnCachePurge()
+	run(lookupIP, "AS15169", func(n int) { waitFlight(t, &h.flights.ips, ipKey, n) })
+	h.AsnCachePurge()
+	run(lookupASN, "GOOGLE, US", func(n int) { waitFlight(t, &h.flights.asns, asnKey, n) })
+	if r, q := atomic.LoadInt32(&requests), atomic.LoadInt32(&queries); r != 2 || q != 2 {
+		t.Fatalf("lookups after purges sent %d ipinfo.io requests and %d DNS queries", r, q)
+	}
+}
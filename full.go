@@ -0,0 +1,88 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// IpResult is what LookupIpFull knows about an IP address.
+type IpResult struct {
+	Ip string `json:"ip"`
+	// ASN of Ip, and its description, overrides included (see OverridesSet),
+	// empty if unknown
+	Asn            string `json:"asn,omitempty"`
+	AsnDescription string `json:"asn_description,omitempty"`
+	// Source Asn was found by (SourceCymru...)
+	Source string `json:"source,omitempty"`
+	// Whether Ip is a local address, which is not looked up
+	// (see iputils.IsLocalIP)
+	IsLocal bool `json:"is_local,omitempty"`
+	// Why the description may be missing or outdated, empty if it is not
+	Warning string `json:"warning,omitempty"`
+}
+
+// LookupIpFull looks up the ASN of an IP address and its description,
+// overrides included, as LookupAsn does, consulting the cache once.
+// Local addresses are answered flagged IsLocal, without lookup.
+//
+// Failures past finding the ASN, such as a missing description,
+// or overrides unavailable (see WithOverridesBreaker), are not:
+// the result has the ASN, and a Warning.
+//
+// Returns the result, or an error if the ASN is not found,
+// such as MalformedIPError.
+func (h Handler) LookupIpFull(ip string) (IpResult, error) {
+	result := IpResult{Ip: ip}
+	ipAddr, _ := iputils.ParseIP(ip)
+	if ipAddr == nil {
+		return result, MalformedIPError
+	}
+	if iputils.IsLocalIP(ipAddr) {
+		result.IsLocal = true
+		return result, nil
+	}
+	entry, err := h.lookupAsn(context.Background(), ip, lookupConfig{})
+	if entry.asn == "" {
+		if err == nil {
+			err = fmt.Errorf("%w for ip '%v'", AsnNotFoundError, ip)
+		}
+		return result, err
+	}
+	result.Asn, result.AsnDescription, result.Source = entry.asn, entry.descr, entry.source
+	switch {
+	case err != nil:
+		result.Warning = err.Error()
+	case h.breaker.isOpen():
+		result.Warning = "overrides unavailable, description may not be overriden"
+	case entry.descr == "":
+		result.Warning = "ASN description not found"
+	}
+	return result, nil
+}
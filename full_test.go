@@ -0,0 +1,87 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLookupIpFull(t *testing.T) {
+	h := NewFixtureHandler()
+	h.overrides = NewMemoryOverrides()
+	if err := h.OverridesSet("AS13335", "Cloudflare (override)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ip       string
+		expected IpResult
+		err      error
+	}{
+		{"8.8.8.8", IpResult{Ip: "8.8.8.8", Asn: "AS15169", AsnDescription: "GOOGLE, US", Source: SourceFixtures}, nil},
+		// Overrides take precedence
+		{"1.1.1.1", IpResult{Ip: "1.1.1.1", Asn: "AS13335", AsnDescription: "Cloudflare (override)", Source: SourceFixtures}, nil},
+		{"10.0.0.1", IpResult{Ip: "10.0.0.1", IsLocal: true}, nil},
+		{"::1", IpResult{Ip: "::1", IsLocal: true}, nil},
+		{"ns1.google.com", IpResult{Ip: "ns1.google.com"}, MalformedIPError},
+	} {
+		result, err := h.LookupIpFull(test.ip)
+		if result != test.expected || err != test.err {
+			t.Errorf("LookupIpFull(%s) answered %+v %v, expected %+v %v", test.ip, result, err, test.expected, test.err)
+		}
+	}
+	if _, err := h.LookupIpFull("4.4.4.4"); err == nil {
+		t.Errorf("LookupIpFull succeeded for an unknown address")
+	}
+	// Local addresses are not looked up, others consult the cache once
+	before := h.CacheStats().ASN
+	h.LookupIpFull("10.0.0.1")
+	h.LookupIpFull("8.8.8.8")
+	if after := h.CacheStats().ASN; after.ExactHits != before.ExactHits+1 || after.Misses != before.Misses {
+		t.Errorf("cache stats went from %+v to %+v", before, after)
+	}
+}
+
+func TestLookupIpFullWarning(t *testing.T) {
+	// ipinfo.io finds the ASN, nothing describes it
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "AS64500")
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, testDNSZone{}.serve)
+	h.ipinfo.baseURL = ts.URL
+	if err := WithAsnSources(BuiltinSource(SourceIpinfo), BuiltinSource(SourceCymru))(&h); err != nil {
+		t.Fatal(err)
+	}
+	result, err := h.LookupIpFull("9.9.9.9")
+	if err != nil || result.Asn != "AS64500" || result.AsnDescription != "" || result.Source != SourceIpinfo || result.Warning == "" {
+		t.Errorf("LookupIpFull answered %+v %v", result, err)
+	}
+}
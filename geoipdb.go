@@ -27,32 +27,44 @@
 Package geoipdb is a library of GeoIP related helper functions for TurboBytes
 stack.
 
-Basics
+# Basics
 
-Get a geoipdb Handler with NewHandler, and use its lookup methods at will.
+Get a geoipdb Handler with NewHandler, and use its lookup methods at will,
+from as many goroutines as needed.
 
-Lookup of Autonomous System Numbers
+# Lookup of Autonomous System Numbers
 
 For looking up the autonomous system number of an IP address, use LookupAsn
 as it wraps more than one search method.
 
 If you want a specific service to be queried for ASN,
 see other Handler lookup methods.
+
+# Testing
+
+For deterministic tests and examples, NewFixtureHandler gets a Handler
+answering from a fixed set of mappings, also available to other packages
+through package geoipdbtest.
 */
 package geoipdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"log/slog"
+	"maps"
 	"net/http"
+	"net/netip"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/abh/geoip"
 	"github.com/miekg/dns"
+	"github.com/turbobytes/geoipdb/internal/fixtures"
 	"github.com/turbobytes/geoipdb/iputils"
 	"gopkg.in/mgo.v2"
 )
@@ -60,32 +72,125 @@ import (
 func init() {
 	// reASN is a regexp for matching against an ASN.
 	reASN = regexp.MustCompilePOSIX("^AS[[:digit:]]+$")
-	// reDNSFilter is a regexp for matching content in DNS answers
-	// that is not part of ASN description.
-	reDNSFilter = regexp.MustCompilePOSIX(".*\\|")
 }
 
 // Pre-compiled regular expressions, see init() body source.
 var (
-	reASN       *regexp.Regexp
-	reDNSFilter *regexp.Regexp
+	reASN *regexp.Regexp
 )
 
 var (
 	// MalformedIPError is returned on parse failure of IP parameter.
-	MalformedIPError = errors.New("malformed IP address")
+	MalformedIPError = newClassError("malformed IP address", MalformedInputError)
 	// PrivateIPError is returned on AS lookup of a private IP address.
 	PrivateIPError = errors.New("private IP address")
+	// MalformedAsnError is returned on parse failure of ASN parameter.
+	MalformedAsnError = newClassError("malformed ASN", MalformedInputError)
+	// AsnNotFoundError is returned on AS lookup of an IP address
+	// no source knows the ASN of.
+	AsnNotFoundError = newClassError("unknown ASN", NotFoundError)
 )
 
 // Handler is a handler to TurboBytes GeoIP helper functions.
+//
+// A Handler is safe for concurrent use by multiple goroutines,
+// as are its copies, which share its state:
+// caches are locked, libgeoip lookups are serialized,
+// and lookups concurrent with an override change (see OverridesSet)
+// do not cache answers outdated by the change.
+// Options and Derive are not meant to be used concurrently with lookups.
 type Handler struct {
-	geoip4    *geoip.GeoIP
-	geoip6    *geoip.GeoIP
+	geoip4 geoipDB
+	geoip6 geoipDB
+	// GeoIP database files, if known,
+	// and how often they are checked for changes (see WithGeoIPReload)
+	geoipFiles  []string
+	geoipReload time.Duration
+	// GeoLite2 ASN database (see WithMMDB),
+	// and its updates, nil if disabled (see WithMaxMindUpdates)
+	mmdb    *mmdbReader
+	maxmind *maxmindUpdater
+	// Country database, nil if none (see WithCountryMMDB),
+	// and country answers (see LookupCountry)
+	countryDB *mmdbReader
+	countries countryCache
 	cymru     cymruClient
+	resolver  *resolver
 	timeout   time.Duration
-	overrides *mgo.Collection
-	cache     cache
+	// Timeouts of sources instead of timeout (see WithSourceTimeout)
+	sourceTimeouts map[string]time.Duration
+	overrides      OverridesStore
+	// Audit log of overrides, nil if none (see WithOverridesAudit)
+	audit OverridesAuditStore
+	// Overrides of the ASN of prefixes, nil if none (see WithPrefixOverrides)
+	prefixOverrides *prefixOverrides
+	// Changes of overrides spread among handlers (see WithOverridesSubscriber)
+	watch *overridesWatch
+	// Observer of lookups, nil if none (see WithMetrics)
+	metrics MetricsSink
+	// Logger of structured events, nil if none (see WithLogger)
+	logger *slog.Logger
+	cache  cache
+	// External cache consulted on cache misses, nil if none (see WithAsnCache)
+	asnCache *externalAsnCache
+	as2org   *as2org
+	ixps     *feed[*prefixTable[string]]
+	clouds   *feed[*prefixTrie[cloudTag]]
+	ptrs     ptrCache
+	// ASN descriptions (see LookupAsnDescr)
+	names    asnNameCache
+	cymruTTL *ttlBounds
+	// TTL of failed lookups, zero for none (see WithNegativeTTL)
+	negativeTTL time.Duration
+	bogons      *feed[*bogons]
+	prefixes    prefixCache
+	queries     *QueryCache
+	ripestat    string
+	// Team Cymru's whois server (see CymruBulkLookup)
+	cymruWhois string
+	// PeeringDB API endpoint, and cache of its answers (see PeeringDbLookup)
+	peeringdb      string
+	peeringdbCache peeringdbCache
+	neighbours     neighboursCache
+	ipinfo         *IpinfoClient
+	// Sources consulted by LookupAsn, in order, nil for the default ones
+	// (see WithAsnSources), and concurrently if not nil (see WithSourceRace)
+	asnSources []AsnSource
+	race       *sourceRace
+	// Circuit breakers of sources, nil if none (see WithSourceBreakers)
+	sourceBreakers *sourceBreakers
+	// Limits of ipinfo.io queries (see WithSourceLimits)
+	ipinfoGuard *sourceGuard
+	keys        *hotKeys
+	privacy     *privacy
+	anonymize   *anonymization
+	redactIPs   bool
+	runs        *runGroup
+	fixtures    *prefixTrie[fixtures.Mapping]
+	prefixMode  bool
+	counters    *cacheCounters
+	annotators  []annotator
+	observer    lookupObserver
+	corrupt     *atomic.Uint64
+	// Background refreshes of stale cache entries
+	revalidations *revalidations
+	// Concurrent lookups in progress
+	flights *lookupFlights
+	// Tenant ID of derived handlers, and caches shared with them
+	tenant string
+	shared *sharedCaches
+	// Circuit breaker of the overrides collection
+	breaker *breaker
+	// Sources lookups consult by default, nil for all (see Config)
+	sources []string
+	// Discovery of the public IP address (see LookupSelf)
+	self *selfDiscovery
+	// Shadow lookups (see WithShadow), nil if not enabled
+	shadow *shadow
+	// HTTP client of external services (see WithHTTPClient), nil for default ones
+	httpClient *http.Client
+	// Whether network services are disabled (see WithOfflineMode)
+	offline bool
 }
 
 // NewHandler creates a handler
@@ -93,30 +198,118 @@ type Handler struct {
 //
 // Parameter overrides, if not nil,
 // is used to access a collection of overrides of ASN descriptions.
-// (See Overrides<...> methods.)
+// (See Overrides<...> methods, and NewHandlerWithStore for other stores.)
 //
 // Parameter timeout is honored by methods that access external services.
 // Pass zero to disable timeout.
 //
+// Optional features are enabled by passing Options.
+// NewHandler is NewHandlerOpts,
+// with WithTimeout(timeout) then WithOverridesCollection(overrides) if not nil
+// before opts.
+//
+// GeoIP database files are checked before libgeoip opens them,
+// NewHandler failing with a *CorruptDatabaseError if they are corrupt.
+// They are not opened when a GeoLite2 ASN database is given instead
+// (see WithMMDB), the only ASN database of builds without cgo.
+//
 // Returns a geoipdb handler.
-func NewHandler(overrides *mgo.Collection, timeout time.Duration) (Handler, error) {
-	ge4, err := geoip.OpenType(geoip.GEOIP_ASNUM_EDITION)
-	if err != nil {
-		return Handler{}, fmt.Errorf("cannot open GeoIP database: %s", err)
+func NewHandler(overrides *mgo.Collection, timeout time.Duration, opts ...Option) (Handler, error) {
+	return NewHandlerWithStore(NewMongoOverridesStore(overrides, timeout), timeout, opts...)
+}
+
+// NewHandlerOpts creates a handler for accessing geoipdb features,
+// configured by opts only, such as:
+// WithOverridesCollection, WithTimeout, WithHTTPClient, WithCacheTTL, WithResolver.
+// Unlike NewHandler, it has neither overrides nor timeout by default.
+//
+// Options are applied in order, see WithTimeout and WithHTTPClient
+// for those applying to the options after them.
+//
+// Returns a geoipdb handler.
+func NewHandlerOpts(opts ...Option) (Handler, error) {
+	return NewHandlerWithStore(nil, 0, opts...)
+}
+
+// NewHandlerWithStore is NewHandler,
+// with overrides of ASN descriptions kept in a given store, if not nil,
+// rather than in a MongoDB collection.
+//
+// Returns a geoipdb handler.
+func NewHandlerWithStore(overrides OverridesStore, timeout time.Duration, opts ...Option) (Handler, error) {
+	h := newHandler(overrides, timeout)
+	for _, opt := range opts {
+		if err := opt(&h); err != nil {
+			return Handler{}, err
+		}
 	}
-	ge6, err := geoip.OpenType(geoip.GEOIP_ASNUM_EDITION_V6)
-	if err != nil {
-		return Handler{}, fmt.Errorf("cannot open GeoIP database: %s", err)
+	// Open default databases, unless given (see WithGeoIPFiles, WithMMDB)
+	if h.geoip4 == nil && h.mmdb == nil {
+		ge4, err := openGeoIPType(geoipASNumEdition, "GeoIPASNum.dat")
+		if err != nil {
+			return Handler{}, err
+		}
+		ge6, err := openGeoIPType(geoipASNumEditionV6, "GeoIPASNumv6.dat")
+		if err != nil {
+			return Handler{}, err
+		}
+		h.geoip4, h.geoip6 = ge4, ge6
+		h.geoipFiles = []string{
+			filepath.Join(geoipDataDir, "GeoIPASNum.dat"),
+			filepath.Join(geoipDataDir, "GeoIPASNumv6.dat"),
+		}
+	}
+	if h.geoipReload > 0 {
+		states := h.databaseFileStates()
+		h.runs.run(func(ctx context.Context) {
+			h.watchGeoIPFiles(ctx, states)
+		})
+	}
+	// Warn about documents needing OverridesMigrate, in the background
+	if m, ok := h.overrides.(*mongoOverrides); ok {
+		h.runs.run(func(context.Context) {
+			checkOverridesSchema(m.c)
+		})
 	}
-	cy := newCymruClient(timeout)
+	return h, nil
+}
+
+// newHandler creates a handler
+// with everything but the GeoIP databases initialized.
+func newHandler(overrides OverridesStore, timeout time.Duration) Handler {
+	r := newResolver(timeout)
+	ipinfo := NewIpinfoClient("", IpinfoLimits{})
+	ipinfo.own = true
+	ipinfoGuard, _ := newSourceGuard(defaultSourceLimits[SourceIpinfo])
 	return Handler{
-		geoip4:    ge4,
-		geoip6:    ge6,
-		cymru:     cy,
-		timeout:   timeout,
-		overrides: overrides,
-		cache:     newCache(),
-	}, nil
+		cymru:          newCymruClient(r, timeout),
+		resolver:       r,
+		timeout:        timeout,
+		overrides:      overrides,
+		cache:          newCache(),
+		ptrs:           newPtrCache(),
+		countries:      newCountryCache(),
+		names:          newAsnNameCache(),
+		prefixes:       newPrefixCache(),
+		queries:        DefaultQueryCache,
+		ripestat:       ripestatURL,
+		cymruWhois:     cymruWhoisServer,
+		peeringdb:      peeringdbURL,
+		peeringdbCache: newPeeringdbCache(),
+		neighbours:     newNeighboursCache(),
+		watch:          newOverridesWatch(),
+		ipinfo:         ipinfo,
+		runs:           newRunGroup(),
+		counters:       &cacheCounters{},
+		corrupt:        &atomic.Uint64{},
+		// Background refreshes of stale cache entries
+		revalidations: &revalidations{},
+		shared:        newSharedCaches(),
+		self:          newSelfDiscovery(SelfDiscoveryConfig{}),
+		negativeTTL:   negativeCacheTTL,
+		flights:       &lookupFlights{},
+		ipinfoGuard:   ipinfoGuard,
+	}
 }
 
 // LibGeoipLookup queries the libgeoip database for the ASN of a given ip address.
@@ -125,11 +318,31 @@ func NewHandler(overrides *mgo.Collection, timeout time.Duration) (Handler, erro
 // an ASN identification
 // and the corresponding description.
 func (h Handler) LibGeoipLookup(ip string) (string, string) {
+	asn, descr, _ := h.libGeoipLookup(ip)
+	return asn, descr
+}
+
+// libGeoipLookup is LibGeoipLookup,
+// failing with a *CorruptDatabaseError on malformed records.
+func (h Handler) libGeoipLookup(ip string) (asn string, descr string, err error) {
 	var name string
 	ipAddr, isIPv4 := iputils.ParseIP(ip)
 	if ipAddr == nil {
-		return "", ""
+		return "", "", nil
 	}
+	// Fixture handlers have no database
+	if h.geoip4 == nil || h.geoip6 == nil {
+		return "", "", nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			asn, descr = "", ""
+			err = &CorruptDatabaseError{Reason: fmt.Sprintf("reading record of %s: %v", ip, r)}
+		}
+		if err != nil {
+			h.corrupt.Add(1)
+		}
+	}()
 	if isIPv4 {
 		name, _ = h.geoip4.GetName(ip)
 	} else {
@@ -137,13 +350,13 @@ func (h Handler) LibGeoipLookup(ip string) (string, string) {
 	}
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return "", ""
+		return "", "", nil
 	}
-	answer := strings.SplitN(name, " ", 2)
-	if len(answer) < 2 {
-		return answer[0], ""
+	asn, descr, err = parseGeoipName(name)
+	if err != nil {
+		return "", "", &CorruptDatabaseError{Reason: err.Error()}
 	}
-	return answer[0], answer[1]
+	return asn, descr, nil
 }
 
 // LookupAsn searches for the Autonomous System Number (ASN)
@@ -153,77 +366,562 @@ func (h Handler) LibGeoipLookup(ip string) (string, string) {
 // as it queries several resources for finding proper answers.
 // Particularly, the overrides collection (see NewHandler)
 // takes precedence for querying ASN descriptions.
+// Bogon IP addresses are rejected upfront when enabled (see WithBogons).
 //
-// Data returned by LookupAsn is cached with a 1 day TTL.
-// Also see: AsnCachePurge.
+// Data returned by LookupAsn is cached with a 1 day TTL,
+// or Team Cymru's TTL when enabled (see WithCymruTTL),
+// and failures or answers without description for 10 minutes
+// (see WithNegativeTTL).
+// Concurrent lookups of an uncached IP address share the outcome of the first.
+// Also see: AsnCachePurge, and LookupAsnCtx for restricting sources.
 //
 // Returns
 // an ASN identification
 // and the corresponding description.
 func (h Handler) LookupAsn(ip string) (string, string, error) {
+	info, err := h.LookupAsnDetailed(context.Background(), ip)
+	return info.Asn, info.Descr, err
+}
+
+// LookupAsnDetailed is LookupAsn, with a context and LookupOptions
+// (see WithSources), answering where the data comes from:
+// the source the ASN was found by, the source of its description,
+// which is SourceOverrides if overriden,
+// and the descriptions answered by every source consulted.
+// Cached answers tell the sources they were originally found by.
+//
+// Returns the ASN information.
+func (h Handler) LookupAsnDetailed(ctx context.Context, ip string, opts ...LookupOption) (AsnInfo, error) {
+	cfg := newLookupConfig(opts)
+	if err := h.checkSources(cfg); err != nil {
+		return AsnInfo{}, err
+	}
+	entry, err := h.lookupAsn(ctx, ip, cfg)
+	info := entry.asnInfo()
+	h.addOrgInfo(&info)
+	return info, err
+}
+
+// lookupAsn is LookupAsn, answering a cache entry.
+// Only the sources allowed by cfg are consulted.
+func (h Handler) lookupAsn(ctx context.Context, ip string, cfg lookupConfig) (cacheEntry, error) {
+	if h.metrics != nil {
+		start := time.Now()
+		entry, err := h.lookupAsnUnmeasured(ctx, ip, cfg)
+		h.metrics.ObserveLookup(MetricsLookupAsn, time.Since(start), metricsOutcome(err))
+		return entry, err
+	}
+	return h.lookupAsnUnmeasured(ctx, ip, cfg)
+}
+
+// lookupAsnUnmeasured is lookupAsn, without metrics.
+func (h Handler) lookupAsnUnmeasured(ctx context.Context, ip string, cfg lookupConfig) (cacheEntry, error) {
+	if h.runs.closed.Load() {
+		return cacheEntry{}, HandlerClosedError
+	}
 	// Sanity check input
 	ipAddr, _ := iputils.ParseIP(ip)
 	if ipAddr == nil {
-		return "", "", MalformedIPError
+		return cacheEntry{}, MalformedIPError
 	}
 	if iputils.IsLocalIP(ipAddr) {
-		return "", "", PrivateIPError
+		return cacheEntry{}, PrivateIPError
+	}
+	if err := ctxErr(ctx); err != nil {
+		return cacheEntry{}, err
+	}
+	addr, addrErr := netip.ParseAddr(ip)
+	if addrErr == nil {
+		addr = addr.Unmap().WithZone("")
+		if !cfg.refresh {
+			h.keys.recordIP(h.anonymizeAddr(addr))
+		}
+	}
+	// h is a copy, used by this lookup only
+	h.observer = cfg.observer
+	// Failures of restricted lookups are not cached
+	negative := cfg.sources == nil && !cfg.refresh && h.negativeTTL > 0
+	if cfg.sources == nil {
+		cfg.sources = h.sources
+	}
+	// Answers missing an override are not cached
+	cacheable := h.overrides == nil || cfg.allows(SourceOverrides)
+	if !cfg.allows(SourceOverrides) {
+		h.overrides = nil
+	}
+	// Try prefix overrides
+	if h.prefixOverrides != nil && addrErr == nil && cfg.allows(SourceOverrides) {
+		if o, ok := h.prefixOverrides.lookup(addr); ok {
+			h.keys.recordASN(o.Asn)
+			h.observe(ExplainStep{Source: SourceOverrides, Result: "answer", Detail: "override of prefix " + o.Prefix})
+			// The description of the prefix takes precedence over the one of its ASN
+			entry := cacheEntry{asn: o.Asn, descr: o.Name, source: SourceOverrides, ttl: h.cache.defaultTTL(),
+				descrSource: SourceOverrides, descrs: map[string]string{SourceOverrides: o.Name}}
+			if o.Name == "" {
+				entry = h.newCacheEntry(ctx, o.Asn, SourceOverrides, map[string]string{}, "")
+			}
+			entry, err := h.annotateEntry(ctx, entry, false)
+			if err == nil {
+				entry, err = h.annotateEntry(ctx, entry, true)
+			}
+			return entry, h.redactError(err)
+		}
+	}
+	// Try prefix cache
+	useCache := cfg.allows(SourceCache) && !cfg.refresh
+	if h.prefixMode && addrErr == nil && useCache {
+		if info, ok := h.prefixes.lookup(netip.PrefixFrom(addr, addr.BitLen())); ok {
+			h.counters.prefixHits.Add(1)
+			h.observeMetric(SourceCache, "hit")
+			h.keys.recordASN(info.Asn)
+			if info.Stale {
+				h.revalidatePrefix(info.Prefix)
+			}
+			if h.observer != nil {
+				h.observe(ExplainStep{Source: SourceCache, Result: "hit", Detail: "prefix " + info.Prefix.String()})
+				h.observe(ExplainStep{Source: SourceCache, Result: "answer", Detail: "cached origin of prefix " + info.Prefix.String()})
+			}
+			entry := newOriginEntry(info, h.prefixes.defaultTTL())
+			entry.cached = true
+			return h.annotateEntry(ctx, entry, true)
+		}
+		h.observe(ExplainStep{Source: SourceCache, Result: "miss", Detail: "no covering prefix"})
 	}
 	// Try cache
-	asn, descr, expired, found := h.cache.lookupByIP(ip)
-	if found && !expired {
-		return asn, descr, nil
+	key := h.cacheKey(ip)
+	if useCache {
+		entry, expired, found := h.cache.lookupByIP(key)
+		if found && !expired {
+			h.counters.exactHits.Add(1)
+			h.observeMetric(SourceCache, "hit")
+			h.keys.recordASN(entry.asn)
+			if entry.stale {
+				h.revalidate(ip, cfg)
+			}
+			if h.observer != nil {
+				h.observeHit(entry)
+			}
+			if entry.err == AsnNotFoundError {
+				return entry, h.redactError(fmt.Errorf("%w for ip '%v'", AsnNotFoundError, ip))
+			}
+			if entry.err != nil {
+				return entry, h.redactError(entry.err)
+			}
+			entry.cached = true
+			return h.annotateEntry(ctx, entry, true)
+		}
+		h.counters.misses.Add(1)
+		h.observeMetric(SourceCache, "miss")
+		h.logf("(geoipdb) cache miss for %s\n", ip)
+		if expired {
+			h.observe(ExplainStep{Source: SourceCache, Result: "expired", Age: entry.age(h.cache.now())})
+		} else {
+			h.observe(ExplainStep{Source: SourceCache, Result: "miss"})
+		}
+		// Try external cache, answers of other replicas
+		if h.usesAsnCache() && cacheable {
+			gen := h.cache.generation()
+			if entry, found := h.lookupAsnCache(ctx, key); found {
+				h.observe(ExplainStep{Source: SourceCache, Result: "answer", Detail: "external ASN cache"})
+				h.keys.recordASN(entry.asn)
+				h.cache.storeAt(key, entry, gen)
+				entry.cached = true
+				return h.annotateEntry(ctx, entry, true)
+			}
+		}
 	}
-	log.Printf("(geoipdb) cache miss for %s\n", ip)
-	// Try uncached lookup
+	// Reject bogons
+	if addrErr == nil && h.isBogon(addr) {
+		h.observe(ExplainStep{Source: "bogons", Result: "rejected"})
+		h.cache.store(key, cacheEntry{err: BogonIPError, ttl: bogonCacheTTL})
+		return cacheEntry{}, BogonIPError
+	}
+	// Try origin lookup, cached by BGP prefix
+	origin := SourceCymru
+	if h.fixtures != nil {
+		origin = SourceFixtures
+	}
+	if h.prefixMode && addrErr == nil && cacheable && cfg.allows(origin) && !(h.offline && origin == SourceCymru) {
+		start := time.Now()
+		info, err := h.lookupOrigin(ctx, addr)
+		if err == nil {
+			h.keys.recordASN(info.Asn)
+			h.observe(ExplainStep{Source: origin, Result: "found", Latency: time.Since(start),
+				Detail: "origin " + info.Asn + " of prefix " + info.Prefix.String()})
+			h.observe(ExplainStep{Source: origin, Result: "answer", Detail: "origin of covering prefix, cached by prefix"})
+			if !info.MultipleOrigins {
+				h.counters.fill(origin)
+			}
+			entry := newOriginEntry(info, h.prefixes.defaultTTL())
+			entry.source = origin
+			return entry, nil
+		}
+		if err := ctxErr(ctx); err != nil {
+			return cacheEntry{}, err
+		}
+		h.observe(ExplainStep{Source: origin, Result: "failed", Detail: err.Error(), Latency: time.Since(start)})
+		h.logf("warning: origin lookup failed for ip '%s': %s\n", ip, err)
+	}
+	// Try uncached lookup, shared by tenants
+	uncached := func(ctx context.Context) (cacheEntry, error) {
+		// Overrides changed meanwhile purge the cache
+		gen := h.cache.generation()
+		if h.tenant != "" {
+			entry, err := h.lookupUpstream(ctx, ip, key, cfg)
+			if err == nil {
+				entry.descr, entry.descrSource, entry.descrs = h.overrideDescrs(ctx, entry.asn, entry.descrs, entry.descrSource)
+			}
+			entry.gen = gen
+			return entry, err
+		}
+		entry, err := h.lookupAsnUncached(ctx, ip, cfg)
+		entry.gen = gen
+		return entry, err
+	}
+	var entry cacheEntry
 	var err error
-	asn, descr, err = h.lookupAsnUncached(ip)
+	var shared bool
+	if h.observer == nil {
+		// Concurrent lookups of ip share the outcome of the first,
+		// unless explained (see Explain)
+		fkey := ipFlightKey{h.tenant, ip, strings.Join(cfg.sources, ","), cfg.refresh}
+		entry, err, shared = h.flights.ips.do(ctx, fkey, uncached)
+		if shared {
+			entry.descrs = maps.Clone(entry.descrs)
+		}
+	} else {
+		entry, err = uncached(ctx)
+	}
+	if err != nil && negative && cacheable && ctxErr(ctx) == nil {
+		// Errors of unknown ASNs are told by IP address when read,
+		// so that cached ones are all the same
+		cached := err
+		if errors.Is(err, AsnNotFoundError) {
+			cached = AsnNotFoundError
+		}
+		h.cache.store(key, cacheEntry{err: cached, ttl: h.negativeTTL})
+	}
+	if h.shadow != nil && err == nil && !shared {
+		h.shadow.sample(ip, h.anonymizeIP(ip), entry)
+	}
 	if err == nil {
-		// Update cache
-		h.cache.store(ip, asn, descr)
+		entry, err = h.annotateEntry(ctx, entry, false)
 	}
-	return asn, descr, err
+	if err == nil {
+		// Answers of lookups given up may miss an override
+		err = ctxErr(ctx)
+	}
+	if err == nil {
+		// Update cache, briefly if overrides were unavailable
+		if cacheable {
+			stored := entry
+			if h.breaker.isOpen() {
+				stored.ttl = min(stored.ttl, h.breaker.cfg.Cooldown)
+			}
+			if stored.descr == "" && h.negativeTTL > 0 {
+				// Descriptions may be found later
+				stored.ttl = min(stored.ttl, h.negativeTTL)
+			}
+			// Answers outdated by a purge are not cached
+			if h.cache.storeAt(key, stored, stored.gen) && !shared {
+				h.counters.fill(stored.source)
+				if h.usesAsnCache() {
+					h.storeAsnCache(key, stored)
+				}
+			}
+		}
+		h.keys.recordASN(entry.asn)
+		entry, err = h.annotateEntry(ctx, entry, true)
+	}
+	return entry, h.redactError(err)
+}
+
+// IpInfo is what LookupIpInfo knows about an IP address.
+type IpInfo struct {
+	IP string `json:"ip"`
+	// ASN data, as answered by LookupAsn
+	// (with registry and allocation date if WithPrefixCache is enabled)
+	AsnInfo
+	// Whether IP is on an IXP peering LAN (see WithIXPDetection)
+	IsIXP   bool   `json:"is_ixp"`
+	IXPName string `json:"ixp_name,omitempty"`
+	// Cloud provider owning IP (see WithCloudRanges)
+	CloudProvider string `json:"cloud_provider,omitempty"`
+	CloudRegion   string `json:"cloud_region,omitempty"`
+	// PTR name of IP (see WithPTR)
+	PTR string `json:"ptr,omitempty"`
+	// Cache TTL applied to the ASN data (see WithCymruTTL)
+	TTL time.Duration `json:"ttl"`
+	// Strategy which discovered IP (see LookupSelf)
+	Discovery string `json:"discovery,omitempty"`
+}
+
+// LookupIpInfo gathers what is known about a valid IP address:
+// its ASN, as answered by LookupAsn,
+// and whatever optional features are enabled (see Option and LookupOption).
+//
+// Addresses on IXP peering LANs are announced by whichever member
+// covers them, so their ASN is of little meaning,
+// and failing to find one is not an error.
+//
+// Returns the IP address information.
+func (h Handler) LookupIpInfo(ctx context.Context, ip string, opts ...LookupOption) (IpInfo, error) {
+	cfg := newLookupConfig(opts)
+	info := IpInfo{IP: ip}
+	if err := ctx.Err(); err != nil {
+		return info, err
+	}
+	if err := h.checkSources(cfg); err != nil {
+		return info, err
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return info, MalformedIPError
+	}
+	info.IXPName, info.IsIXP = h.lookupIXP(addr)
+	if tag, ok := h.lookupCloud(addr); ok {
+		info.CloudProvider, info.CloudRegion = tag.provider, tag.region
+	}
+	entry, err := h.lookupAsn(ctx, ip, cfg)
+	info.AsnInfo, info.TTL = entry.asnInfo(), entry.ttl
+	h.addOrgInfo(&info.AsnInfo)
+	if err != nil && (!info.IsIXP || err == MalformedIPError || err == PrivateIPError) {
+		return info, err
+	}
+	switch cfg.ptr {
+	case ptrCached:
+		ptr, _ := h.ptrs.lookup(addr.Unmap().WithZone(""))
+		info.PTR = ptr.name
+	case ptrResolve:
+		info.PTR, _ = h.LookupPTR(ctx, ip)
+	}
+	return info, nil
 }
 
 // lookupAsnUncached is the uncached version of LookupAsn.
-func (h Handler) lookupAsnUncached(ip string) (string, string, error) {
-	// Try libgeoip
-	asnGi, asnDescr := h.LibGeoipLookup(ip)
-	if asnGi != "" && asnDescr != "" {
-		// libgeoip returned an ASN and description.
-		return asnGi, h.getOverridenDescr(asnGi, asnDescr), nil
-	}
-	if asnGi == "" {
-		log.Printf("warning: libgeoip lookup failed for ip '%s'\n", ip)
-	}
-	// Try ipinfo.io
-	asnDescr = ""
-	asnIp, asnDescr, errIp := h.IpInfoLookup(ip)
-	if errIp == nil {
-		if asnIp != "" && asnDescr != "" {
-			// ipinfo.io returned an ASN and description.
-			return asnIp, h.getOverridenDescr(asnIp, asnDescr), nil
+//
+// Returns the cache entry to store.
+func (h Handler) lookupAsnUncached(ctx context.Context, ip string, cfg lookupConfig) (cacheEntry, error) {
+	if h.logger != nil {
+		h.logger = h.logger.With("ip", h.redact(ip))
+	}
+	if h.fixtures != nil {
+		if !cfg.allows(SourceFixtures) {
+			return cacheEntry{}, fmt.Errorf("%w for ip '%v'", AsnNotFoundError, ip)
 		}
-	} else {
-		log.Printf("warning: ipinfo lookup failed for ip '%s': %s\n", ip, errIp)
+		entry, err := h.lookupFixture(ctx, ip)
+		if err != nil {
+			h.observe(ExplainStep{Source: SourceFixtures, Result: "empty"})
+		} else {
+			h.observe(ExplainStep{Source: SourceFixtures, Result: "answer", Detail: "fixture mapping"})
+		}
+		return entry, err
 	}
-	var asn string
-	if asnGi != "" {
-		asn = asnGi
-	} else if errIp == nil && asnIp != "" {
-		asn = asnIp
-	} else {
+	// Descriptions answered by the sources consulted
+	descrs := make(map[string]string)
+	// ASN found, and the source which found it
+	var asn, source string
+	// Sources consulted, in order (see WithAsnSources)
+	sources, names := h.asnSourceList()
+	if h.race != nil {
+		return h.lookupAsnRace(ctx, ip, cfg, sources, names)
+	}
+	// Answers of the sources queried by IP address, by name
+	answers := make(map[string]ipSourceAnswer)
+	queryIP := func(s AsnSource, name string) (ipSourceAnswer, error) {
+		if a, ok := answers[name]; ok {
+			return a, nil
+		}
+		a := h.queryIPSource(ctx, s, name, ip)
+		if err := ctxErr(ctx); err != nil {
+			return a, err
+		}
+		if a.descr != "" {
+			descrs[name] = a.descr
+		}
+		if asn == "" && a.asn != "" {
+			asn, source = a.asn, name
+		}
+		answers[name] = a
+		return a, nil
+	}
+	// findAsn queries the sources by IP address, in order,
+	// or else cymru's IP to ASN service, until one answers an ASN.
+	findAsn := func() error {
+		for i, s := range sources {
+			if asn != "" {
+				return nil
+			}
+			if byIP(s) && cfg.allows(names[i]) {
+				if _, err := queryIP(s, names[i]); err != nil {
+					return err
+				}
+			}
+		}
+		if asn != "" || !cfg.allows(SourceCymru) {
+			return nil
+		}
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil
+		}
+		for _, s := range sources {
+			if s != builtinSource(SourceCymru) {
+				continue
+			}
+			// Cymru's IP to ASN service also knows IPv6 routes
+			start := time.Now()
+			origin, err := h.lookupCymruOrigin(ctx, addr)
+			if err == nil {
+				asn, source = origin.asns[0], SourceCymru
+			}
+			h.observeAnswer(SourceCymru, asn, "", err, start)
+			if err := ctxErr(ctx); err != nil {
+				return err
+			}
+			if err != nil {
+				h.logf("warning: cymru origin lookup failed for ip '%s': %s\n", ip, err)
+			}
+		}
+		return nil
+	}
+	for i, s := range sources {
+		name := names[i]
+		if !cfg.allows(name) {
+			continue
+		}
+		if byIP(s) {
+			a, err := queryIP(s, name)
+			if err != nil {
+				return cacheEntry{}, err
+			}
+			if a.asn != "" && a.descr != "" {
+				h.observe(ExplainStep{Source: name, Result: "answer", Detail: "first source with ASN and description"})
+				return h.newCacheEntry(ctx, a.asn, name, descrs, name), nil
+			}
+			continue
+		}
+		// Sources describing ASNs need one first
+		if err := findAsn(); err != nil {
+			return cacheEntry{}, err
+		}
+		if asn == "" {
+			break
+		}
+		start := time.Now()
+		descr, ttl, err := h.describeAsn(ctx, s, asn)
+		h.observeAnswer(name, asn, descr, err, start)
+		if err := ctxErr(ctx); err != nil {
+			return cacheEntry{}, err
+		}
+		if err != nil {
+			h.logf("warning: %s lookup failed for asn '%s': %s\n", name, asn, err)
+			continue
+		}
+		if descr == "" {
+			continue
+		}
+		h.observe(ExplainStep{Source: source, Result: "answer", Detail: "first source with ASN, description from " + name})
+		descrs[name] = descr
+		entry := h.newCacheEntry(ctx, asn, source, descrs, name)
+		entry.ttl = ttl
+		return entry, nil
+	}
+	if asn == "" {
 		// Cannot find an ASN. Give up.
-		return "", "", fmt.Errorf("unknown ASN for ip '%v'", ip)
+		return cacheEntry{}, fmt.Errorf("%w for ip '%v'", AsnNotFoundError, ip)
 	}
 	// We found an ASN, but no description for it.
-	// Try getting one from cymru's dns service.
-	asnDescr, err := h.CymruDnsLookup(asn)
-	if err != nil {
-		log.Printf("warning: cymru lookup failed for asn '%s': %s\n", asn, err)
-		return asn, h.getOverridenDescr(asn, ""), nil
+	h.observe(ExplainStep{Source: source, Result: "answer", Detail: "first source with ASN, no description"})
+	return h.newCacheEntry(ctx, asn, source, descrs, ""), nil
+}
+
+// ipSourceAnswer is the answer of a source queried by IP address.
+type ipSourceAnswer struct {
+	asn   string
+	descr string
+	err   error
+}
+
+// queryIPSource queries a source by IP address (see byIP).
+// The answer of a failed ipinfo.io lookup is empty.
+func (h Handler) queryIPSource(ctx context.Context, s AsnSource, name string, ip string) ipSourceAnswer {
+	var a ipSourceAnswer
+	start := time.Now()
+	if s == builtinSource(SourceIpinfo) {
+		a.err = h.guardSource(ctx, name, func() error {
+			var err error
+			a.asn, a.descr, err = h.ipInfoLookup(ctx, ip)
+			return err
+		})
+		h.observeAnswer(name, a.asn, a.descr, a.err, start)
+		if a.err != nil {
+			if ctxErr(ctx) == nil {
+				h.logf("warning: ipinfo lookup failed for ip '%s': %s\n", ip, a.err)
+			}
+			a.asn, a.descr = "", ""
+		}
+		return a
+	}
+	// The local ASN database, libgeoip or mmdb
+	_, giLookup := h.localDatabase()
+	a.asn, a.descr, a.err = giLookup(ip)
+	h.observeAnswer(name, a.asn, a.descr, a.err, start)
+	if a.err != nil {
+		h.logf("warning: %s lookup failed for ip '%s': %s\n", name, ip, a.err)
+	} else if a.asn == "" {
+		h.logf("warning: %s lookup failed for ip '%s'\n", name, ip)
+	}
+	return a
+}
+
+// newCacheEntry creates a cache entry
+// for an ASN found by a given source,
+// with the descriptions answered by the sources consulted,
+// of which the one of descrSource is chosen, unless overriden.
+func (h Handler) newCacheEntry(ctx context.Context, asn string, source string, descrs map[string]string, descrSource string) cacheEntry {
+	entry := cacheEntry{
+		asn:    asn,
+		source: source,
+		ttl:    h.cache.defaultTTL(),
+	}
+	entry.descr, entry.descrSource, entry.descrs = h.overrideDescrs(ctx, asn, descrs, descrSource)
+	return entry
+}
+
+// asnInfo returns the ASN data of an entry.
+func (e cacheEntry) asnInfo() AsnInfo {
+	return AsnInfo{
+		Asn:         e.asn,
+		Descr:       e.descr,
+		Registry:    e.registry,
+		AllocatedAt: e.allocated,
+		Score:       e.score,
+		Tags:        e.tags,
+		Stale:       e.stale,
+		Source:      e.source,
+		DescrSource: e.descrSource,
+		Descrs:      e.descrs,
+		Cached:      e.cached,
+	}
+}
+
+// newOriginEntry creates a cache entry
+// for the origin of a BGP prefix, cached for ttl.
+func newOriginEntry(info AsnInfo, ttl time.Duration) cacheEntry {
+	return cacheEntry{
+		asn:         info.Asn,
+		descr:       info.Descr,
+		registry:    info.Registry,
+		allocated:   info.AllocatedAt,
+		score:       info.Score,
+		tags:        info.Tags,
+		source:      info.Source,
+		descrSource: info.DescrSource,
+		descrs:      info.Descrs,
+		stale:       info.Stale,
+		ttl:         ttl,
 	}
-	return asn, h.getOverridenDescr(asn, asnDescr), nil
 }
 
 // IpInfoLookup queries ipinfo.io for the ASN of a given ip address.
@@ -232,33 +930,59 @@ func (h Handler) lookupAsnUncached(ip string) (string, string, error) {
 // an ASN identification
 // and the corresponding description.
 func (h Handler) IpInfoLookup(ip string) (string, string, error) {
-	client := &http.Client{
-		Timeout: h.timeout,
-	}
-	url := fmt.Sprintf("http://ipinfo.io/%s/org", ip)
-	resp, err := client.Get(url)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to GET '%s': %s", url, err)
+	asn, descr, err := h.ipInfoLookup(context.Background(), ip)
+	return asn, descr, h.redactError(err)
+}
+
+// IpInfo queries ipinfo.io for all it knows about a given ip address,
+// such as its host name, location and organization,
+// as IpInfoLookup does for its ASN.
+// Transient failures are retried (see WithSourceLimits).
+//
+// Bogons, such as private addresses, are answered without error,
+// as records flagged Bogon without any other information.
+//
+// Returns the ipinfo.io record.
+func (h Handler) IpInfo(ip string) (IpInfoRecord, error) {
+	if _, err := netip.ParseAddr(ip); err != nil {
+		return IpInfoRecord{}, MalformedIPError
 	}
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read ipinfo.io response: %s", err)
+	if h.offline {
+		return IpInfoRecord{}, OfflineModeError
 	}
-	asnData := strings.TrimSpace(string(data))
-	if asnData == "" {
-		return "", "", fmt.Errorf("GET '%s' returned an empty answer", url)
+	var record IpInfoRecord
+	err := h.ipinfoGuard.do(context.Background(), h.sourceTimeout(SourceIpinfo), func(ctx context.Context) error {
+		var err error
+		record, err = h.ipinfoClient().record(ctx, ip)
+		return err
+	})
+	return record, h.redactError(err)
+}
+
+// ipInfoLookup is IpInfoLookup, with a context.
+// Transient failures are retried (see WithSourceLimits).
+func (h Handler) ipInfoLookup(ctx context.Context, ip string) (string, string, error) {
+	if h.offline {
+		return "", "", OfflineModeError
 	}
-	answer := strings.SplitN(asnData, " ", 2)
-	// ipinfo.io returns errors as regular text (no out-of-band error codes).
-	// Let's try to be smart and identify them.
-	if !reASN.MatchString(answer[0]) {
-		return "", "", fmt.Errorf("ipinfo.io lookup failed for '%s': %s", ip, asnData)
+	var start time.Time
+	if h.metrics != nil {
+		start = time.Now()
 	}
-	if len(answer) < 2 {
-		return answer[0], "", nil
+	var asn, descr string
+	err := h.ipinfoGuard.do(ctx, h.sourceTimeout(SourceIpinfo), func(ctx context.Context) error {
+		var err error
+		asn, descr, err = h.ipinfoClient().lookup(ctx, ip)
+		return err
+	})
+	if h.metrics != nil {
+		outcome := metricsOutcome(err)
+		if err == nil && asn == "" {
+			outcome = "empty"
+		}
+		h.metrics.ObserveLookup(SourceIpinfo, time.Since(start), outcome)
 	}
-	return answer[0], answer[1], nil
+	return asn, descr, err
 }
 
 // CymruDnsLookup performs a query to Team Cymru's DNS service
@@ -269,88 +993,317 @@ func (h Handler) CymruDnsLookup(asn string) (string, error) {
 	return h.cymru.lookup(asn)
 }
 
+// CymruAsnInfo is what Team Cymru's DNS service knows about an ASN.
+type CymruAsnInfo struct {
+	Asn string `json:"asn"`
+	// Country, regional registry and allocation date of the ASN,
+	// empty if unknown
+	CountryCode string    `json:"country_code,omitempty"`
+	Registry    string    `json:"registry,omitempty"`
+	Allocated   time.Time `json:"allocated,omitzero"`
+	// ASN description, as answered by CymruDnsLookup
+	Name string `json:"name"`
+}
+
+// CymruDnsLookupDetailed is CymruDnsLookup,
+// answering every field of Team Cymru's record.
+//
+// Returns the ASN information.
+func (h Handler) CymruDnsLookupDetailed(asn string) (CymruAsnInfo, error) {
+	info, _, err := h.cymru.lookupInfo(context.Background(), asn)
+	return info, err
+}
+
+// CymruOriginLookup performs a query to Team Cymru's DNS service
+// for the ASN originating a given IP address:
+// origin.asn.cymru.com is queried for IPv4 addresses,
+// including IPv4-mapped IPv6 ones,
+// and origin6.asn.cymru.com for IPv6 addresses, in full nibble format.
+// Of multiple origin ASNs, the lowest numbered one is answered
+// (see LookupIpOrigins).
+// The ASN description is then queried as by CymruDnsLookup.
+//
+// Returns
+// an ASN identification
+// and the corresponding description.
+func (h Handler) CymruOriginLookup(ip string) (string, string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", "", MalformedIPError
+	}
+	ctx := context.Background()
+	if h.cymru.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.cymru.timeout)
+		defer cancel()
+	}
+	origin, err := h.cymru.origin(ctx, addr)
+	if err != nil {
+		return "", "", h.redactError(err)
+	}
+	descr, _, err := h.cymru.lookupTTL(ctx, origin.asns[0])
+	if err != nil {
+		return "", "", h.redactError(err)
+	}
+	return origin.asns[0], descr, nil
+}
+
 // cymruClient can do DNS queries to Team Cymru's database
 // for retrieving ASN descriptions.
 type cymruClient struct {
-	dnsClient *dns.Client
-	reFilter  *regexp.Regexp
+	resolver *resolver
+	// Limits of queries (see WithSourceLimits),
+	// and bound of queries and their retries, zero for none
+	guard   *sourceGuard
+	timeout time.Duration
+	// Observer of queries, nil if none (see WithMetrics)
+	metrics MetricsSink
 }
 
 // newCymruClient creates an initialized cymruClient.
-func newCymruClient(timeout time.Duration) cymruClient {
-	c := new(dns.Client)
-	c.Timeout = timeout
+func newCymruClient(r *resolver, timeout time.Duration) cymruClient {
+	guard, _ := newSourceGuard(defaultSourceLimits[SourceCymru])
 	return cymruClient{
-		dnsClient: c,
-		reFilter:  reDNSFilter.Copy(),
+		resolver: r,
+		guard:    guard,
+		timeout:  timeout,
 	}
 }
 
+// query sends a query to Team Cymru's DNS services,
+// within the limits of the client, retrying transient failures.
+//
+// Returns the DNS answer, with a NOERROR or NXDOMAIN response code.
+func (cc cymruClient) query(ctx context.Context, name string) (*dns.Msg, error) {
+	if cc.metrics != nil {
+		start := time.Now()
+		msg, err := cc.queryUnmeasured(ctx, name)
+		outcome := metricsOutcome(err)
+		if err == nil && (msg.Rcode == dns.RcodeNameError || len(msg.Answer) == 0) {
+			outcome = "empty"
+		}
+		cc.metrics.ObserveLookup(SourceCymru, time.Since(start), outcome)
+		return msg, err
+	}
+	return cc.queryUnmeasured(ctx, name)
+}
+
+// queryUnmeasured is query, without metrics.
+func (cc cymruClient) queryUnmeasured(ctx context.Context, name string) (*dns.Msg, error) {
+	var msg *dns.Msg
+	err := cc.guard.do(ctx, cc.timeout, func(ctx context.Context) error {
+		var err error
+		msg, err = cc.resolver.query(ctx, name, dns.TypeTXT)
+		if err != nil {
+			if err == ctxErr(ctx) || err == OfflineModeError {
+				return err
+			}
+			// Such as timeouts
+			return transientError{err}
+		}
+		switch msg.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			return nil
+		case dns.RcodeServerFailure, dns.RcodeRefused:
+			return transientError{fmt.Errorf("%s answer", dns.RcodeToString[msg.Rcode])}
+		default:
+			return fmt.Errorf("%s answer", dns.RcodeToString[msg.Rcode])
+		}
+	})
+	return msg, err
+}
+
 // lookup retrieves the description of a given ASN
 // by reaching Team Cymru's DNS database.
 //
 // Returns the ASN description.
 func (cc cymruClient) lookup(asn string) (string, error) {
+	descr, _, err := cc.lookupTTL(context.Background(), asn)
+	return descr, err
+}
+
+// lookupTTL is lookup, also returning the TTL of the DNS answer.
+func (cc cymruClient) lookupTTL(ctx context.Context, asn string) (string, time.Duration, error) {
+	info, ttl, err := cc.lookupInfo(ctx, asn)
+	return info.Name, ttl, err
+}
+
+// lookupInfo is lookupTTL, answering every field of the record.
+func (cc cymruClient) lookupInfo(ctx context.Context, asn string) (CymruAsnInfo, time.Duration, error) {
 	if asn == "" {
-		return "", fmt.Errorf("empty asn parameter")
-	}
-	if cc.dnsClient == nil {
-		return "", fmt.Errorf("cymruClient not initialized")
-	}
-	msg := new(dns.Msg)
-	msg.Id = dns.Id()
-	msg.RecursionDesired = true
-	msg.Question = make([]dns.Question, 1)
-	msg.Question[0] = dns.Question{
-		Name:   asn + ".asn.cymru.com.",
-		Qtype:  dns.TypeTXT,
-		Qclass: dns.ClassINET,
-	}
-	// Send query to Google public dns server
-	msg, _, err := cc.dnsClient.Exchange(msg, "8.8.8.8:53")
+		return CymruAsnInfo{}, 0, fmt.Errorf("empty asn parameter")
+	}
+	if cc.resolver == nil {
+		return CymruAsnInfo{}, 0, fmt.Errorf("cymruClient not initialized")
+	}
+	msg, err := cc.query(ctx, asn+".asn.cymru.com.")
 	if err != nil {
-		return "", fmt.Errorf("failed to query dns: %s", err)
+		if err == ctxErr(ctx) || err == OfflineModeError {
+			return CymruAsnInfo{}, 0, err
+		}
+		return CymruAsnInfo{}, 0, fmt.Errorf("failed to query dns: %w", &SourceError{SourceCymru, err})
 	}
 	for _, ans := range msg.Answer {
 		if t, ok := ans.(*dns.TXT); ok {
-			return strings.TrimSpace(cc.reFilter.ReplaceAllString(t.Txt[0], "")), nil
+			ttl := time.Duration(t.Hdr.Ttl) * time.Second
+			info := parseCymruAsn(strings.Join(t.Txt, ""))
+			if info.Asn == "" {
+				info.Asn = asn
+			}
+			return info, ttl, nil
 		}
 	}
-	return "", fmt.Errorf("not yet implemented")
+	return CymruAsnInfo{}, 0, fmt.Errorf("not yet implemented")
+}
+
+// parseCymruAsn parses a TXT record of Team Cymru's ASN service:
+// "ASN | country | registry | allocation date | AS name".
+// Missing fields are left empty, and a record without fields is a name.
+func parseCymruAsn(txt string) CymruAsnInfo {
+	// AS names may contain pipes
+	fields := strings.SplitN(txt, "|", 5)
+	if len(fields) == 1 {
+		return CymruAsnInfo{Name: strings.TrimSpace(txt)}
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	fields = append(fields, make([]string, 5-len(fields))...)
+	var info CymruAsnInfo
+	if asn := fields[0]; asn != "" && strings.Trim(asn, "0123456789") == "" {
+		info.Asn = "AS" + asn
+	}
+	info.CountryCode = fields[1]
+	info.Registry = fields[2]
+	// Dates are sometimes empty, or zero ("0000-00-00")
+	info.Allocated, _ = time.Parse("2006-01-02", fields[3])
+	info.Name = fields[4]
+	return info
 }
 
 // getOverridenDescr answers the ASN description
 // taken from the override collection, if found.
 // Otherwise, answers the fallback parameter.
-func (h Handler) getOverridenDescr(asn string, fallback string) string {
-	descr, err := h.OverridesLookup(asn)
+//
+// Returns the description, and whether it is overriden.
+func (h Handler) getOverridenDescr(ctx context.Context, asn string, fallback string) (string, bool) {
+	descr, err := h.OverridesLookupCtx(ctx, asn)
 	if err != nil {
-		if err != OverridesNilCollectionError && err != OverridesAsnNotFoundError {
+		if err == ctxErr(ctx) {
+			// The lookup is given up, see lookupAsn
+		} else if err == OverridesUnavailableError {
+			h.observe(ExplainStep{Source: SourceOverrides, Result: "skipped", Detail: err.Error()})
+		} else if err != OverridesNilCollectionError && err != OverridesAsnNotFoundError {
 			log.Printf("warning: %s\n", err)
+			h.observe(ExplainStep{Source: SourceOverrides, Result: "failed", Detail: err.Error()})
+		} else if err == OverridesAsnNotFoundError {
+			h.observe(ExplainStep{Source: SourceOverrides, Result: "empty"})
 		}
-		return fallback
+		return fallback, false
+	}
+	h.observe(ExplainStep{Source: SourceOverrides, Result: "applied",
+		Detail: "override '" + descr + "' takes precedence over '" + fallback + "'"})
+	return descr, true
+}
+
+// overrideDescrs chooses the description of an ASN
+// among those answered by sources, by source:
+// its override if any, or the one of descrSource.
+//
+// Returns the description, its source,
+// and the descriptions by source, with the override.
+func (h Handler) overrideDescrs(ctx context.Context, asn string, descrs map[string]string, descrSource string) (string, string, map[string]string) {
+	descr, overriden := h.getOverridenDescr(ctx, asn, descrs[descrSource])
+	if !overriden {
+		if descr == "" {
+			descrSource = ""
+		}
+		return descr, descrSource, descrs
+	}
+	// descrs may be cached already
+	descrs = maps.Clone(descrs)
+	if descrs == nil {
+		descrs = make(map[string]string)
 	}
-	return descr
+	descrs[SourceOverrides] = descr
+	return descr, SourceOverrides, descrs
 }
 
 // AsnCachePurge erases all LookupAsn cached data.
+// It is CachePurgeAll.
 func (h Handler) AsnCachePurge() {
+	h.CachePurgeAll()
+}
+
+// CachePurgeAll erases all LookupAsn cached data:
+// answers by IP address and by BGP prefix (see WithPrefixCache),
+// ASN descriptions (see LookupAsnDescr),
+// and the external cache, if any (see WithAsnCache).
+func (h Handler) CachePurgeAll() {
 	log.Println("(geoipdb) cache purge")
 	h.cache.purgeAll()
+	h.prefixes.purgeAll()
+	h.names.purgeAll()
+	h.purgeAsnCache("")
+}
+
+// CachePurgeASN erases the LookupAsn cached data of a given ASN,
+// as CachePurgeAll does.
+func (h Handler) CachePurgeASN(asn string) error {
+	asn, err := canonicalASN(asn)
+	if err != nil {
+		return err
+	}
+	log.Printf("(geoipdb) cache purge of %s\n", asn)
+	h.cache.purgeASN(asn)
+	h.prefixes.purgeASN(asn)
+	h.names.purgeASN(asn)
+	h.purgeAsnCache(asn)
+	return nil
+}
+
+// CachePurgeBySource erases the LookupAsn cached data
+// whose ASN or description was found by a given source
+// (SourceIpinfo..., or the name of an AsnSource, see WithAsnSources),
+// as CachePurgeAll does, such as after a source answered bad data.
+// The external cache, if any, which does not record sources,
+// is purged entirely (see WithAsnCache).
+func (h Handler) CachePurgeBySource(source string) {
+	log.Printf("(geoipdb) cache purge of source %s\n", source)
+	h.cache.purgeSource(source)
+	h.prefixes.purgeSource(source)
+	h.names.purgeSource(source)
+	h.purgeAsnCache("")
 }
 
 // LookupIp searches the cache
 // for all IP addresses associated with a given ASN.
+// In privacy mode (see WithPrivacy), addresses are unknown,
+// and they are truncated if anonymized (see WithAnonymization).
 //
 // Returns a non nil list of IP addresses.
 func (h Handler) LookupIp(asn string) []string {
-	ips := h.cache.lookupByASN(asn)
+	if h.privacy != nil {
+		return []string{}
+	}
+	var start time.Time
+	if h.metrics != nil {
+		start = time.Now()
+	}
+	ips := h.cache.lookupByASN(normalizeASN(asn))
 	answer := make([]string, len(ips))
 	var i int
 	for ip, _ := range ips {
 		answer[i] = ip
 		i++
 	}
+	if h.metrics != nil {
+		outcome := "found"
+		if len(answer) == 0 {
+			outcome = "empty"
+		}
+		h.metrics.ObserveLookup(MetricsLookupIp, time.Since(start), outcome)
+	}
 	return answer
 }
 
@@ -145,17 +145,15 @@ func TestAsnCachePurge(t *testing.T) {
 
 func Example_lookupAsn() {
 	ip := "8.8.8.8"
-	gh, err := geoipdb.NewHandler(nil, time.Second*5)
-	if err != nil {
-		panic(err)
-	}
+	// Use NewHandler for real lookups
+	gh := geoipdb.NewFixtureHandler()
 	asn, descr, err := gh.LookupAsn(ip)
 	if err != nil {
 		panic(err)
 	}
 	fmt.Printf("ASN for %s: %s (%s)\n", ip, asn, descr)
 	// Output:
-	// ASN for 8.8.8.8: AS15169 (Google Inc.)
+	// ASN for 8.8.8.8: AS15169 (GOOGLE, US)
 }
 
 func TestOverridesLookupNilOverrides(t *testing.T) {
@@ -0,0 +1,47 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package geoipdbtest provides geoipdb handlers for tests,
+// answering from a fixed set of mappings
+// without querying network services nor databases.
+package geoipdbtest
+
+import (
+	"github.com/turbobytes/geoipdb"
+	"github.com/turbobytes/geoipdb/internal/fixtures"
+)
+
+// Mapping maps a prefix to the ASN announcing it.
+type Mapping = fixtures.Mapping
+
+// Mappings returns the prefixes known to fixture handlers.
+func Mappings() []Mapping {
+	return append([]Mapping(nil), fixtures.Mappings...)
+}
+
+// NewHandler creates a fixture handler (see geoipdb.NewFixtureHandler).
+func NewHandler() geoipdb.Handler {
+	return geoipdb.NewFixtureHandler()
+}
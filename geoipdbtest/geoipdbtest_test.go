@@ -0,0 +1,55 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdbtest_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/turbobytes/geoipdb/geoipdbtest"
+)
+
+func TestMappings(t *testing.T) {
+	gh := geoipdbtest.NewHandler()
+	for _, m := range geoipdbtest.Mappings() {
+		ip := netip.MustParsePrefix(m.Prefix).Addr().Next().String()
+		for i := 0; i < 2; i++ {
+			asn, descr, err := gh.LookupAsn(ip)
+			if err != nil {
+				t.Fatalf("LookupAsn(%s) failed: %s", ip, err)
+			}
+			if asn != m.Asn || descr != m.Descr {
+				t.Fatalf("LookupAsn(%s) returned %s (%s), expected %s (%s)", ip, asn, descr, m.Asn, m.Descr)
+			}
+		}
+	}
+	if _, _, err := gh.LookupAsn("192.0.2.1"); err == nil {
+		t.Fatalf("documentation address found")
+	}
+	if _, _, err := gh.LookupAsn("4.4.4.4"); err == nil {
+		t.Fatalf("address outside mappings found")
+	}
+}
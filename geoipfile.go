@@ -0,0 +1,260 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// libgeoip types of ASN databases, for IPv4 and IPv6
+	// (geoip.GEOIP_ASNUM_EDITION and GEOIP_ASNUM_EDITION_V6)
+	geoipASNumEdition   = 9
+	geoipASNumEditionV6 = 21
+	// geoipStructureInfoMaxSize bounds the search
+	// for the structure info at the end of a GeoIP database file.
+	geoipStructureInfoMaxSize = 20
+	// geoipRecordLength is the size of search tree records
+	// in GeoIP ASN databases.
+	geoipRecordLength = 3
+	// geoipMaxNameLength bounds the ASN names of GeoIP databases.
+	geoipMaxNameLength = 300
+)
+
+// geoipDataDir is where libgeoip looks for its databases by default.
+var geoipDataDir = "/usr/share/GeoIP"
+
+// geoipDB is a libgeoip database.
+type geoipDB interface {
+	GetName(ip string) (string, int)
+	GetNameV6(ip string) (string, int)
+}
+
+// replaceableGeoIP is a geoipDB whose database can be replaced
+// (see ReloadGeoipDb).
+type replaceableGeoIP interface {
+	geoipDB
+	replace(next geoipDB) bool
+}
+
+// geoipTestKeys are looked up when validating GeoIP databases,
+// by database type.
+var geoipTestKeys = map[int]netip.Addr{
+	geoipASNumEdition:   netip.MustParseAddr("8.8.8.8"),
+	geoipASNumEditionV6: netip.MustParseAddr("2001:4860:4860::8888"),
+}
+
+// CorruptDatabaseError is returned when a GeoIP database file
+// fails sanity checks, or a record read from it is malformed.
+type CorruptDatabaseError struct {
+	// Database file, if known
+	Path string
+	// What is wrong with it
+	Reason string
+}
+
+func (e *CorruptDatabaseError) Error() string {
+	if e.Path == "" {
+		return "corrupt GeoIP database: " + e.Reason
+	}
+	return fmt.Sprintf("corrupt GeoIP database %s: %s", e.Path, e.Reason)
+}
+
+// WithGeoIPFiles makes the handler use given libgeoip ASN database files,
+// for IPv4 and IPv6, instead of the default ones.
+// The files are checked before libgeoip opens them
+// (see ValidateGeoIPFile).
+func WithGeoIPFiles(v4 string, v6 string) Option {
+	return func(h *Handler) error {
+		ge4, err := openGeoIPFile(v4, geoipASNumEdition)
+		if err != nil {
+			return err
+		}
+		ge6, err := openGeoIPFile(v6, geoipASNumEditionV6)
+		if err != nil {
+			return err
+		}
+		h.geoip4, h.geoip6 = ge4, ge6
+		h.geoipFiles = []string{v4, v6}
+		return nil
+	}
+}
+
+// openGeoIPFile opens a GeoIP database file of a given type,
+// if it passes sanity checks.
+func openGeoIPFile(path string, dbType int) (geoipDB, error) {
+	if err := ValidateGeoIPFile(path, dbType); err != nil {
+		return nil, err
+	}
+	gi, err := openLibGeoIP(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open GeoIP database: %w", err)
+	}
+	return gi, nil
+}
+
+// openGeoIPType opens the default GeoIP database of a given type,
+// checking its file first, if found where libgeoip usually looks for it.
+func openGeoIPType(dbType int, name string) (geoipDB, error) {
+	err := ValidateGeoIPFile(filepath.Join(geoipDataDir, name), dbType)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	gi, err := openLibGeoIPType(dbType)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open GeoIP database: %w", err)
+	}
+	return gi, nil
+}
+
+// ValidateGeoIPFile checks that a file is a sound libgeoip ASN database
+// of a given type (geoip.GEOIP_ASNUM_EDITION or GEOIP_ASNUM_EDITION_V6),
+// so that libgeoip does not crash reading it:
+// its size and structure are checked, and a known address looked up.
+//
+// Files meant to replace databases in use, such as downloaded updates,
+// should be checked before being moved in place.
+//
+// Returns a *CorruptDatabaseError if the file is corrupt.
+func ValidateGeoIPFile(path string, dbType int) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	corrupt := func(format string, a ...interface{}) error {
+		return &CorruptDatabaseError{Path: path, Reason: fmt.Sprintf(format, a...)}
+	}
+	segments, fileType, ok := geoipStructure(b)
+	if !ok {
+		return corrupt("no structure info, file truncated?")
+	}
+	if fileType != dbType {
+		return corrupt("database type %d, expected %d", fileType, dbType)
+	}
+	if segments == 0 || segments*2*geoipRecordLength > len(b) {
+		return corrupt("search tree of %d nodes exceeds file size %d", segments, len(b))
+	}
+	key, ok := geoipTestKeys[dbType]
+	if !ok {
+		return corrupt("unsupported database type %d", dbType)
+	}
+	if _, err := geoipFileLookup(b, segments, key); err != nil {
+		return corrupt("test lookup of %s failed: %s", key, err)
+	}
+	return nil
+}
+
+// geoipStructure reads the structure info of a GeoIP database file,
+// searched backwards from its end, as libgeoip does.
+//
+// Returns the number of search tree nodes, the database type,
+// and whether the structure info was found.
+func geoipStructure(b []byte) (int, int, bool) {
+	for i := 0; i < geoipStructureInfoMaxSize; i++ {
+		p := len(b) - 3 - i
+		if p < 0 {
+			break
+		}
+		if !bytes.Equal(b[p:p+3], []byte{0xff, 0xff, 0xff}) {
+			continue
+		}
+		if p+7 > len(b) {
+			return 0, 0, false
+		}
+		dbType := int(b[p+3])
+		if dbType >= 106 {
+			dbType -= 105
+		}
+		segments := int(b[p+4]) | int(b[p+5])<<8 | int(b[p+6])<<16
+		return segments, dbType, true
+	}
+	return 0, 0, false
+}
+
+// geoipFileLookup searches the content of a GeoIP ASN database file
+// for an address, checking every offset read.
+//
+// Returns the name found, empty if none.
+func geoipFileLookup(b []byte, segments int, addr netip.Addr) (string, error) {
+	key := addr.AsSlice()
+	bits := len(key) * 8
+	node := 0
+	for i := 0; i < bits; i++ {
+		offset := node * 2 * geoipRecordLength
+		if offset+2*geoipRecordLength > len(b) {
+			return "", fmt.Errorf("search tree node %d out of file", node)
+		}
+		if key[i/8]>>(7-uint(i%8))&1 == 1 {
+			offset += geoipRecordLength
+		}
+		next := int(b[offset]) | int(b[offset+1])<<8 | int(b[offset+2])<<16
+		if next == segments {
+			return "", nil
+		}
+		if next > segments {
+			return geoipFileName(b, next+(2*geoipRecordLength-1)*segments)
+		}
+		node = next
+	}
+	return "", fmt.Errorf("search tree deeper than %d bits", bits)
+}
+
+// geoipFileName reads the name at a given offset of a GeoIP database file.
+func geoipFileName(b []byte, offset int) (string, error) {
+	if offset >= len(b) {
+		return "", fmt.Errorf("record offset %d out of file", offset)
+	}
+	end := bytes.IndexByte(b[offset:min(len(b), offset+geoipMaxNameLength)], 0)
+	if end < 0 {
+		return "", fmt.Errorf("unterminated record at offset %d", offset)
+	}
+	name := string(b[offset : offset+end])
+	if _, _, err := parseGeoipName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// parseGeoipName parses a non empty name of a GeoIP ASN database:
+// "ASN description".
+//
+// Returns the ASN and its description,
+// or an error if the name is malformed.
+func parseGeoipName(name string) (string, string, error) {
+	asn, descr, err := ParseAsnOrg(name)
+	if err != nil || !utf8.ValidString(descr) {
+		return "", "", fmt.Errorf("malformed record '%s'", strings.ToValidUTF8(name, "?"))
+	}
+	return asn, descr, nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateGeoIPFile(t *testing.T) {
+	tests := []struct {
+		path   string
+		dbType int
+		ok     bool
+	}{
+		{"testdata/geoip/GeoIPASNum.dat", geoipASNumEdition, true},
+		{"testdata/geoip/GeoIPASNumv6.dat", geoipASNumEditionV6, true},
+		{"testdata/geoip/GeoIPASNum-truncated.dat", geoipASNumEdition, false},
+		{"testdata/geoip/GeoIPASNumv6.dat", geoipASNumEdition, false},
+		// GEOIP_COUNTRY_EDITION
+		{"testdata/geoip/GeoIPASNum.dat", 1, false},
+	}
+	for _, test := range tests {
+		err := ValidateGeoIPFile(test.path, test.dbType)
+		var corrupt *CorruptDatabaseError
+		if test.ok && err != nil || !test.ok && !errors.As(err, &corrupt) {
+			t.Fatalf("unexpected ValidateGeoIPFile(%s, %d) answer: %v", test.path, test.dbType, err)
+		}
+	}
+	if err := ValidateGeoIPFile("testdata/geoip/missing.dat", geoipASNumEdition); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error for a missing file: %v", err)
+	}
+}
+
+func TestGeoIPFileLookup(t *testing.T) {
+	b, err := os.ReadFile("testdata/geoip/GeoIPASNum.dat")
+	if err != nil {
+		t.Fatalf("cannot read database: %s", err)
+	}
+	segments, _, _ := geoipStructure(b)
+	for ip, expected := range map[string]string{"8.8.8.8": "AS15169 Google LLC", "8.8.4.4": ""} {
+		if name, err := geoipFileLookup(b, segments, netip.MustParseAddr(ip)); err != nil || name != expected {
+			t.Fatalf("geoipFileLookup(%s) returned %q, %v", ip, name, err)
+		}
+	}
+	// Damage the record, then the search tree
+	damaged := append([]byte{}, b...)
+	copy(damaged[segments*2*geoipRecordLength+1:], "\xff\xfe")
+	if _, err := geoipFileLookup(damaged, segments, netip.MustParseAddr("8.8.8.8")); err == nil {
+		t.Fatalf("malformed record not detected")
+	}
+	damaged = append([]byte{}, b...)
+	copy(damaged, []byte{0xff, 0xff, 0x00})
+	if _, err := geoipFileLookup(damaged, segments, netip.MustParseAddr("8.8.8.8")); err == nil {
+		t.Fatalf("out of file record not detected")
+	}
+}
+
+func TestCorruptDatabaseContained(t *testing.T) {
+	// Corrupt files are not handed to libgeoip
+	h := newHandler(nil, time.Second)
+	err := WithGeoIPFiles("testdata/geoip/GeoIPASNum-truncated.dat", "testdata/geoip/GeoIPASNumv6.dat")(&h)
+	var corrupt *CorruptDatabaseError
+	if !errors.As(err, &corrupt) || h.geoip4 != nil {
+		t.Fatalf("unexpected WithGeoIPFiles answer: %v", err)
+	}
+	b, err := os.ReadFile("testdata/geoip/GeoIPASNum-truncated.dat")
+	if err != nil {
+		t.Fatalf("cannot read database: %s", err)
+	}
+	defer func(dir string) { geoipDataDir = dir }(geoipDataDir)
+	geoipDataDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(geoipDataDir, "GeoIPASNum.dat"), b, 0644); err != nil {
+		t.Fatalf("cannot write database: %s", err)
+	}
+	if _, err := NewHandler(nil, time.Second); !errors.As(err, &corrupt) {
+		t.Fatalf("unexpected NewHandler error: %v", err)
+	}
+}
+
+func TestParseGeoipName(t *testing.T) {
+	tests := []struct {
+		name  string
+		asn   string
+		descr string
+		ok    bool
+	}{
+		{"AS15169 Google LLC", "AS15169", "Google LLC", true},
+		{"AS15169", "AS15169", "", true},
+		{"\x8a\x01 Google LLC", "", "", false},
+		{"AS15169 Goo\xffgle", "", "", false},
+		{"15169 Google LLC", "", "", false},
+	}
+	for _, test := range tests {
+		asn, descr, err := parseGeoipName(test.name)
+		if asn != test.asn || descr != test.descr || (err == nil) != test.ok {
+			t.Fatalf("parseGeoipName(%q) returned %q, %q, %v", test.name, asn, descr, err)
+		}
+	}
+}
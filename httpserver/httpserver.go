@@ -0,0 +1,265 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package httpserver exposes a geoipdb.Handler over HTTP,
+// for services which cannot link the library:
+//
+//	GET    /asn/{asn}        description of an ASN, as geoipdb.AsnInfo
+//	GET    /ip/{ip}          what is known about an IP address, as geoipdb.IpInfo
+//	GET    /overrides        all overrides, as a list of geoipdb.AsnOverride
+//	GET    /overrides/{asn}  override of an ASN, as geoipdb.AsnOverride
+//	PUT    /overrides/{asn}  sets the override of an ASN from a geoipdb.AsnOverride, answering it
+//	DELETE /overrides/{asn}  removes the override of an ASN
+//
+// Bodies are JSON. Failures answer {"error": "..."},
+// with a status code telling the class of failure (see geoipdb.NotFoundError).
+package httpserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/turbobytes/geoipdb"
+)
+
+// maxBodySize is the maximum size of request bodies.
+const maxBodySize = 1 << 20
+
+// Server is an http.Handler serving the routes of the package
+// from a geoipdb.Handler.
+// It can be mounted in another http.ServeMux,
+// under a prefix stripped by http.StripPrefix.
+type Server struct {
+	gh  geoipdb.Handler
+	mux *http.ServeMux
+	// Token requests must bear, empty for none (see WithBearerToken)
+	token string
+}
+
+// Option configures a Server (see New).
+type Option func(*Server)
+
+// WithBearerToken requires requests to be authorized by a bearer token
+// ("Authorization: Bearer <token>"), answering 401 otherwise.
+func WithBearerToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// New creates a Server of a given geoipdb.Handler.
+func New(gh geoipdb.Handler, opts ...Option) *Server {
+	s := &Server{gh: gh, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.HandleFunc("GET /asn/{asn}", s.lookupAsn)
+	s.mux.HandleFunc("GET /ip/{ip}", s.lookupIp)
+	s.mux.HandleFunc("GET /overrides", s.listOverrides)
+	s.mux.HandleFunc("GET /overrides/{asn}", s.getOverride)
+	s.mux.HandleFunc("PUT /overrides/{asn}", s.setOverride)
+	s.mux.HandleFunc("DELETE /overrides/{asn}", s.removeOverride)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" && !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized tells whether a request bears the token of the server.
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// lookupAsn answers the description of an ASN.
+func (s *Server) lookupAsn(w http.ResponseWriter, r *http.Request) {
+	n, err := geoipdb.ParseASN(r.PathValue("asn"))
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	asn := geoipdb.FormatASN(n)
+	descr, err := s.gh.LookupAsnDescr(r.Context(), asn)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, geoipdb.AsnInfo{Asn: asn, Descr: descr})
+}
+
+// lookupIp answers what is known about an IP address.
+func (s *Server) lookupIp(w http.ResponseWriter, r *http.Request) {
+	info, err := s.gh.LookupIpInfo(r.Context(), r.PathValue("ip"))
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// listOverrides answers the overrides,
+// a page of them given the limit and offset query parameters.
+func (s *Server) listOverrides(w http.ResponseWriter, r *http.Request) {
+	var limit, offset int
+	for name, value := range map[string]*int{"limit": &limit, "offset": &offset} {
+		param := r.URL.Query().Get(name)
+		if param == "" {
+			continue
+		}
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s '%s'", name, param))
+			return
+		}
+		*value = n
+	}
+	overrides, err := s.gh.OverridesListPage(limit, offset)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, overrides)
+}
+
+// getOverride answers the override of an ASN.
+func (s *Server) getOverride(w http.ResponseWriter, r *http.Request) {
+	asn, ok := overrideASN(w, r)
+	if !ok {
+		return
+	}
+	override, err := s.gh.OverridesGet(asn)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, override)
+}
+
+// setOverride sets the override of an ASN,
+// its description and author given by the body,
+// then answers it.
+func (s *Server) setOverride(w http.ResponseWriter, r *http.Request) {
+	asn, ok := overrideASN(w, r)
+	if !ok {
+		return
+	}
+	var override geoipdb.AsnOverride
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&override); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed override: %w", err))
+		return
+	}
+	if override.Asn != "" {
+		if n, err := geoipdb.ParseASN(override.Asn); err != nil || geoipdb.FormatASN(n) != asn {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("ASN '%s' of the override differs from %s", override.Asn, asn))
+			return
+		}
+	}
+	if err := s.gh.OverridesSetWithMeta(asn, override.Name, override.UpdatedBy); err != nil {
+		writeFailure(w, err)
+		return
+	}
+	override, err := s.gh.OverridesGet(asn)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, override)
+}
+
+// removeOverride removes the override of an ASN.
+func (s *Server) removeOverride(w http.ResponseWriter, r *http.Request) {
+	asn, ok := overrideASN(w, r)
+	if !ok {
+		return
+	}
+	if err := s.gh.OverridesRemove(asn); err != nil {
+		writeFailure(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// overrideASN answers the ASN of an overrides route, in asplain notation,
+// or answers 400 if malformed.
+func overrideASN(w http.ResponseWriter, r *http.Request) (string, bool) {
+	n, err := geoipdb.ParseASN(r.PathValue("asn"))
+	if err != nil {
+		writeFailure(w, geoipdb.OverridesMalformedAsnError)
+		return "", false
+	}
+	return geoipdb.FormatASN(n), true
+}
+
+// status answers the status code of a failure of the handler.
+func status(err error) int {
+	switch {
+	case errors.Is(err, geoipdb.MalformedInputError):
+		return http.StatusBadRequest
+	case errors.Is(err, geoipdb.NotFoundError):
+		return http.StatusNotFound
+	case errors.Is(err, geoipdb.PrivateIPError), errors.Is(err, geoipdb.BogonIPError):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, geoipdb.OverridesNilCollectionError):
+		return http.StatusNotImplemented
+	case errors.Is(err, geoipdb.SourceTimeoutError):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, geoipdb.SourceUnavailableError), errors.Is(err, geoipdb.HandlerClosedError):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// writeFailure answers a failure of the handler.
+func writeFailure(w http.ResponseWriter, err error) {
+	writeError(w, status(err), err)
+}
+
+// writeError answers an error with a given status code.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// writeJSON answers a value as JSON with a given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
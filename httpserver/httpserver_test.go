@@ -0,0 +1,213 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package httpserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/geoipdb"
+	"github.com/turbobytes/geoipdb/httpserver"
+)
+
+// registry is an AsnSource describing the ASNs it knows.
+type registry map[string]string
+
+func (r registry) Name() string {
+	return "registry"
+}
+
+func (r registry) Lookup(ctx context.Context, asn string) (string, error) {
+	if descr, ok := r[asn]; ok {
+		return descr, nil
+	}
+	return "", fmt.Errorf("%w '%s'", geoipdb.AsnNotFoundError, asn)
+}
+
+func newTestServer(t *testing.T, opts ...httpserver.Option) *httptest.Server {
+	t.Helper()
+	gh, err := geoipdb.NewHandlerWithStore(geoipdb.NewMemoryOverrides(), time.Second,
+		geoipdb.WithOfflineMode(),
+		geoipdb.WithMMDB("../testdata/mmdb/GeoLite2-ASN-Test.mmdb"),
+		geoipdb.WithAsnSources(geoipdb.BuiltinSource(geoipdb.SourceMMDB), registry{"AS13335": "CLOUDFLARENET"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gh.Close() })
+	ts := httptest.NewServer(httpserver.New(gh, opts...))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// do sends a request, and decodes the JSON body of the response into v.
+//
+// Returns the status code.
+func do(t *testing.T, ts *httptest.Server, method, path, body, token string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s answered malformed JSON: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// failure is the body of failed requests.
+type failure struct {
+	Error string `json:"error"`
+}
+
+func TestRoutes(t *testing.T) {
+	ts := newTestServer(t)
+	// Lookups
+	var info geoipdb.IpInfo
+	if code := do(t, ts, "GET", "/ip/8.8.8.8", "", "", &info); code != http.StatusOK || info.Asn != "AS15169" || info.Descr != "GOOGLE" {
+		t.Errorf("GET /ip/8.8.8.8 answered %d %+v", code, info)
+	}
+	var asn geoipdb.AsnInfo
+	if code := do(t, ts, "GET", "/asn/13335", "", "", &asn); code != http.StatusOK || asn.Asn != "AS13335" || asn.Descr != "CLOUDFLARENET" {
+		t.Errorf("GET /asn/13335 answered %d %+v", code, asn)
+	}
+	// Overrides
+	var override geoipdb.AsnOverride
+	code := do(t, ts, "PUT", "/overrides/as64500", `{"name": "Example", "updated_by": "ops"}`, "", &override)
+	if code != http.StatusOK || override.Asn != "AS64500" || override.Name != "Example" || override.UpdatedBy != "ops" {
+		t.Errorf("PUT /overrides/as64500 answered %d %+v", code, override)
+	}
+	override = geoipdb.AsnOverride{}
+	if code := do(t, ts, "GET", "/overrides/AS64500", "", "", &override); code != http.StatusOK || override.Name != "Example" {
+		t.Errorf("GET /overrides/AS64500 answered %d %+v", code, override)
+	}
+	if code := do(t, ts, "PUT", "/overrides/AS64501", `{"asn": "64501", "name": "Other"}`, "", nil); code != http.StatusOK {
+		t.Errorf("PUT /overrides/AS64501 answered %d", code)
+	}
+	var overrides []geoipdb.AsnOverride
+	if code := do(t, ts, "GET", "/overrides", "", "", &overrides); code != http.StatusOK || len(overrides) != 2 || overrides[1].Asn != "AS64501" {
+		t.Errorf("GET /overrides answered %d %+v", code, overrides)
+	}
+	overrides = nil
+	if code := do(t, ts, "GET", "/overrides?limit=1&offset=1", "", "", &overrides); code != http.StatusOK || len(overrides) != 1 || overrides[0].Asn != "AS64501" {
+		t.Errorf("GET /overrides page answered %d %+v", code, overrides)
+	}
+	asn = geoipdb.AsnInfo{}
+	if code := do(t, ts, "GET", "/asn/AS64500", "", "", &asn); code != http.StatusOK || asn.Descr != "Example" {
+		t.Errorf("GET /asn/AS64500 answered %d %+v", code, asn)
+	}
+	if code := do(t, ts, "DELETE", "/overrides/AS64500", "", "", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE /overrides/AS64500 answered %d", code)
+	}
+	if code := do(t, ts, "GET", "/overrides/AS64500", "", "", nil); code != http.StatusNotFound {
+		t.Errorf("GET of a removed override answered %d", code)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ts := newTestServer(t)
+	for _, test := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/overrides/AS64500", "", http.StatusNotFound},
+		{"GET", "/overrides/ASX", "", http.StatusBadRequest},
+		{"PUT", "/overrides/ASX", `{"name": "Example"}`, http.StatusBadRequest},
+		{"PUT", "/overrides/AS64500", `{"name": `, http.StatusBadRequest},
+		{"PUT", "/overrides/AS64500", `{"nmae": "Example"}`, http.StatusBadRequest},
+		{"PUT", "/overrides/AS64500", `{"asn": "AS64501", "name": "Example"}`, http.StatusBadRequest},
+		{"DELETE", "/overrides/ASX", "", http.StatusBadRequest},
+		{"GET", "/overrides?limit=-1", "", http.StatusBadRequest},
+		{"GET", "/overrides?offset=x", "", http.StatusBadRequest},
+		{"GET", "/asn/ASX", "", http.StatusBadRequest},
+		{"GET", "/asn/AS64500", "", http.StatusNotFound},
+		{"GET", "/ip/not-an-ip", "", http.StatusBadRequest},
+		{"GET", "/ip/10.0.0.1", "", http.StatusUnprocessableEntity},
+		{"GET", "/ip/4.4.4.4", "", http.StatusNotFound},
+		{"POST", "/overrides/AS64500", "", http.StatusMethodNotAllowed},
+	} {
+		var body failure
+		code := do(t, ts, test.method, test.path, test.body, "", nil)
+		if code != test.code {
+			t.Errorf("%s %s answered %d, expected %d", test.method, test.path, code, test.code)
+		}
+		if code != http.StatusMethodNotAllowed {
+			do(t, ts, test.method, test.path, test.body, "", &body)
+			if body.Error == "" {
+				t.Errorf("%s %s answered no error", test.method, test.path)
+			}
+		}
+	}
+	// Handlers without overrides
+	gh := geoipdb.NewFixtureHandler()
+	nilTS := httptest.NewServer(httpserver.New(gh))
+	defer nilTS.Close()
+	if code := do(t, nilTS, "GET", "/overrides", "", "", nil); code != http.StatusNotImplemented {
+		t.Errorf("GET /overrides without overrides answered %d", code)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	ts := newTestServer(t, httpserver.WithBearerToken("secret"))
+	for _, token := range []string{"", "wrong"} {
+		var body failure
+		if code := do(t, ts, "GET", "/overrides", "", token, &body); code != http.StatusUnauthorized || body.Error == "" {
+			t.Errorf("request with token %q answered %d %+v", token, code, body)
+		}
+	}
+	if code := do(t, ts, "GET", "/overrides", "", "secret", nil); code != http.StatusOK {
+		t.Errorf("authorized request answered %d", code)
+	}
+}
+
+func ExampleNew() {
+	gh := geoipdb.NewFixtureHandler()
+	mux := http.NewServeMux()
+	mux.Handle("/geoipdb/", http.StripPrefix("/geoipdb", httpserver.New(gh, httpserver.WithBearerToken("secret"))))
+	req := httptest.NewRequest("GET", "/geoipdb/ip/9.9.9.9", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var info geoipdb.IpInfo
+	json.NewDecoder(rec.Body).Decode(&info)
+	fmt.Println(rec.Code, info.Asn)
+	// Output: 200 AS19281
+}
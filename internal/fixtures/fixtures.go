@@ -0,0 +1,51 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package fixtures holds the canonical data of geoipdb fixture handlers,
+// shared by package geoipdb and package geoipdbtest.
+package fixtures
+
+// Mapping maps a prefix to the ASN announcing it.
+type Mapping struct {
+	Prefix string
+	Asn    string
+	Descr  string
+}
+
+// Mappings are the prefixes known to fixture handlers.
+//
+// Documentation ranges (192.0.2.0/24, 198.51.100.0/24, 203.0.113.0/24,
+// 2001:db8::/32) are not listed:
+// being non global, their lookups fail with PrivateIPError.
+var Mappings = []Mapping{
+	{"8.8.8.0/24", "AS15169", "GOOGLE, US"},
+	{"8.8.4.0/24", "AS15169", "GOOGLE, US"},
+	{"2001:4860::/32", "AS15169", "GOOGLE, US"},
+	{"1.1.1.0/24", "AS13335", "CLOUDFLARENET, US"},
+	{"1.0.0.0/24", "AS13335", "CLOUDFLARENET, US"},
+	{"2606:4700::/32", "AS13335", "CLOUDFLARENET, US"},
+	{"9.9.9.0/24", "AS19281", "QUAD9-AS-1, US"},
+	{"208.67.222.0/24", "AS36692", "OPENDNS, US"},
+}
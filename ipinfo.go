@@ -0,0 +1,373 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ipinfoURL is the ipinfo.io API endpoint.
+	ipinfoURL = "https://ipinfo.io"
+	// ipinfoCooldown is the default time ipinfo.io requests are suspended
+	// after being throttled.
+	ipinfoCooldown = time.Minute
+)
+
+// IpinfoRateLimitedError is returned on ipinfo.io lookups
+// refused by the rate limiter of the IpinfoClient,
+// or while it cools down after being throttled.
+var IpinfoRateLimitedError = newClassError("ipinfo.io rate limit reached", SourceUnavailableError)
+
+// IpinfoForbiddenError is returned on ipinfo.io lookups
+// answered 403 Forbidden, such as with an invalid API token.
+// Like throttling, it starts a cooldown of the IpinfoClient.
+var IpinfoForbiddenError = newClassError("ipinfo.io request forbidden", SourceUnavailableError)
+
+// IpinfoLimits are the limits an IpinfoClient keeps to.
+type IpinfoLimits struct {
+	// Rate is the maximum sustained number of requests per second,
+	// and Burst the number of requests that may be sent at once.
+	// Zero Rate means no limit; Burst defaults to 1.
+	Rate  float64
+	Burst int
+	// Cooldown is how long requests are suspended
+	// after ipinfo.io throttles one,
+	// unless its answer says otherwise.
+	// Defaults to 1 minute.
+	Cooldown time.Duration
+}
+
+// IpinfoStats are IpinfoClient counters.
+type IpinfoStats struct {
+	// Requests sent, and those that failed
+	Requests uint64
+	Failures uint64
+	// Requests throttled, and forbidden, by ipinfo.io
+	Throttled uint64
+	Forbidden uint64
+	// Lookups refused by the client rate limiter or cooldown
+	RateLimited uint64
+	// End of the current cooldown, if any
+	CooldownUntil time.Time
+}
+
+// IpinfoClient is an ipinfo.io API client
+// keeping to a request budget.
+//
+// An IpinfoClient is safe for concurrent use,
+// and may be shared by several handlers (see WithIpinfoClient)
+// to account for an ipinfo.io quota process wide.
+type IpinfoClient struct {
+	token   string
+	limits  IpinfoLimits
+	baseURL string
+	client  *http.Client
+	// Whether the client is a handler's own,
+	// rather than given by WithIpinfoClient
+	own bool
+
+	mu sync.Mutex
+	// Token bucket of the rate limiter
+	tokens float64
+	last   time.Time
+	stats  IpinfoStats
+}
+
+// NewIpinfoClient creates an ipinfo.io client
+// authenticating with token, if not empty,
+// and keeping to limits.
+func NewIpinfoClient(token string, limits IpinfoLimits) *IpinfoClient {
+	if limits.Burst <= 0 {
+		limits.Burst = 1
+	}
+	if limits.Cooldown <= 0 {
+		limits.Cooldown = ipinfoCooldown
+	}
+	return &IpinfoClient{
+		token:   token,
+		limits:  limits,
+		baseURL: ipinfoURL,
+		client:  &http.Client{},
+		tokens:  float64(limits.Burst),
+		last:    time.Now(),
+	}
+}
+
+// defaultIpinfoClient is the ipinfo.io client of handlers without one,
+// such as the zero Handler.
+var defaultIpinfoClient = NewIpinfoClient("", IpinfoLimits{})
+
+// ipinfoClient returns the ipinfo.io client of the handler,
+// or else defaultIpinfoClient.
+func (h Handler) ipinfoClient() *IpinfoClient {
+	if h.ipinfo == nil {
+		return defaultIpinfoClient
+	}
+	return h.ipinfo
+}
+
+// WithIpinfoClient makes the handler query ipinfo.io with client c,
+// instead of an unauthenticated client of its own without limits
+// (see WithIpinfoHTTPClient).
+func WithIpinfoClient(c *IpinfoClient) Option {
+	return func(h *Handler) error {
+		if c == nil {
+			return errors.New("nil ipinfo client")
+		}
+		h.ipinfo = c
+		return nil
+	}
+}
+
+// WithIpinfoHTTPClient makes the handler query ipinfo.io with client,
+// such as one with a proxy, TLS settings or instrumentation,
+// and at baseURL, such as a mock of the ipinfo.io API,
+// instead of a default client and https://ipinfo.io.
+// A nil client or empty baseURL keeps the default.
+// This includes discovering the public IP address (see LookupSelf).
+//
+// Clients given by WithIpinfoClient have their own HTTP client,
+// so both options cannot be combined.
+func WithIpinfoHTTPClient(client *http.Client, baseURL string) Option {
+	return func(h *Handler) error {
+		if !h.ipinfo.own {
+			return errors.New("ipinfo client given by WithIpinfoClient")
+		}
+		if h.tenant != "" {
+			return errors.New("derived handlers share the ipinfo client of their parent")
+		}
+		if baseURL != "" {
+			u, err := url.Parse(baseURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("malformed ipinfo base URL '%s'", baseURL)
+			}
+			h.ipinfo.baseURL = strings.TrimSuffix(baseURL, "/")
+		}
+		if client != nil {
+			h.ipinfo.client = client
+		}
+		return nil
+	}
+}
+
+// WithIpinfoToken makes the handler authenticate its ipinfo.io requests
+// with an API token, sent as a Bearer token.
+// Clients given by WithIpinfoClient have their own token
+// (see NewIpinfoClient), so both options cannot be combined.
+func WithIpinfoToken(token string) Option {
+	return func(h *Handler) error {
+		if !h.ipinfo.own {
+			return errors.New("ipinfo client given by WithIpinfoClient")
+		}
+		if h.tenant != "" {
+			return errors.New("derived handlers share the ipinfo client of their parent")
+		}
+		if token == "" {
+			return errors.New("empty ipinfo token")
+		}
+		h.ipinfo.token = token
+		return nil
+	}
+}
+
+// Stats returns the client counters.
+func (c *IpinfoClient) Stats() IpinfoStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// allow tells whether a request may be sent now,
+// taking it from the budget if so.
+func (c *IpinfoClient) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Before(c.stats.CooldownUntil) {
+		c.stats.RateLimited++
+		return false
+	}
+	if c.limits.Rate > 0 {
+		c.tokens = math.Min(float64(c.limits.Burst), c.tokens+now.Sub(c.last).Seconds()*c.limits.Rate)
+		c.last = now
+		if c.tokens < 1 {
+			c.stats.RateLimited++
+			return false
+		}
+		c.tokens--
+	}
+	c.stats.Requests++
+	return true
+}
+
+// done accounts for the outcome of a request.
+// Parameter resp is nil if the request failed.
+func (c *IpinfoClient) done(resp *http.Response, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.stats.Failures++
+	}
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden) {
+		if resp.StatusCode == http.StatusForbidden {
+			c.stats.Forbidden++
+		} else {
+			c.stats.Throttled++
+		}
+		cooldown := c.limits.Cooldown
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			cooldown = time.Duration(s) * time.Second
+		}
+		c.stats.CooldownUntil = time.Now().Add(cooldown)
+	}
+}
+
+// lookup queries ipinfo.io for the ASN of a given ip address.
+//
+// Returns
+// an ASN identification
+// and the corresponding description.
+func (c *IpinfoClient) lookup(ctx context.Context, ip string) (string, string, error) {
+	if !c.allow() {
+		return "", "", IpinfoRateLimitedError
+	}
+	asn, descr, resp, err := c.get(ctx, ip)
+	c.done(resp, err)
+	return asn, descr, err
+}
+
+// get sends an ipinfo.io request for the ASN of a given ip address.
+//
+// Returns the ASN and its description, and the HTTP response if any.
+func (c *IpinfoClient) get(ctx context.Context, ip string) (string, string, *http.Response, error) {
+	url := fmt.Sprintf("%s/%s/org", c.baseURL, ip)
+	data, resp, err := c.fetch(ctx, url)
+	if err != nil {
+		return "", "", resp, err
+	}
+	asnData := strings.TrimSpace(string(data))
+	if asnData == "" {
+		return "", "", resp, fmt.Errorf("GET '%s' returned an empty answer", url)
+	}
+	// ipinfo.io returns errors as regular text (no out-of-band error codes).
+	// Let's try to be smart and identify them.
+	asn, descr, err := ParseAsnOrg(asnData)
+	if err != nil {
+		return "", "", resp, fmt.Errorf("ipinfo.io lookup failed for '%s': %s", ip, asnData)
+	}
+	return asn, descr, resp, nil
+}
+
+// fetch sends an ipinfo.io request.
+//
+// Returns the response body, and the HTTP response if any.
+func (c *IpinfoClient) fetch(ctx context.Context, url string) ([]byte, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to GET '%s': %w", url, &SourceError{SourceIpinfo, err})
+		if ctxErr(ctx) == nil {
+			err = transientError{err}
+		}
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, resp, IpinfoRateLimitedError
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, resp, IpinfoForbiddenError
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, resp, transientError{&SourceError{SourceIpinfo, fmt.Errorf("GET '%s' returned %s", url, resp.Status)}}
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp, fmt.Errorf("failed to read ipinfo.io response: %w", &SourceError{SourceIpinfo, err})
+	}
+	return data, resp, nil
+}
+
+// IpInfoRecord is what ipinfo.io knows about an IP address (see IpInfo).
+type IpInfoRecord struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+	City     string `json:"city,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Country  string `json:"country,omitempty"`
+	// Latitude and longitude, such as "37.4056,-122.0775"
+	Loc      string `json:"loc,omitempty"`
+	Postal   string `json:"postal,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	// Organization, such as "AS15169 Google LLC",
+	// and its ASN and name, empty if unknown
+	Org     string `json:"org,omitempty"`
+	Asn     string `json:"org_asn,omitempty"`
+	OrgName string `json:"org_name,omitempty"`
+	// Whether the address is a bogon, such as a private address,
+	// of which ipinfo.io knows nothing else
+	Bogon bool `json:"bogon,omitempty"`
+}
+
+// record sends an ipinfo.io request for all it knows about an IP address.
+func (c *IpinfoClient) record(ctx context.Context, ip string) (IpInfoRecord, error) {
+	if !c.allow() {
+		return IpInfoRecord{}, IpinfoRateLimitedError
+	}
+	url := fmt.Sprintf("%s/%s/json", c.baseURL, ip)
+	data, resp, err := c.fetch(ctx, url)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET '%s' returned %s", url, resp.Status)
+	}
+	c.done(resp, err)
+	if err != nil {
+		return IpInfoRecord{}, err
+	}
+	var record IpInfoRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return IpInfoRecord{}, fmt.Errorf("cannot decode ipinfo.io response: %w", err)
+	}
+	// Only organizations tell ASNs
+	record.Asn, record.OrgName, _ = ParseAsnOrg(record.Org)
+	return record, nil
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIpinfoClient(t *testing.T) {
+	var throttle int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if atomic.LoadInt32(&throttle) != 0 {
+			w.Header().Set("Retry-After", "3600")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("AS15169 Google LLC\n"))
+	}))
+	defer ts.Close()
+	c := NewIpinfoClient("secret", IpinfoLimits{Rate: 0.001, Burst: 2})
+	c.baseURL = ts.URL
+	// Handlers sharing the client share its budget
+	var handlers []Handler
+	for i := 0; i < 2; i++ {
+		h := newHandler(nil, time.Second)
+		if err := WithIpinfoClient(c)(&h); err != nil {
+			t.Fatalf("WithIpinfoClient failed: %s", err)
+		}
+		handlers = append(handlers, h)
+	}
+	for _, h := range handlers {
+		asn, descr, err := h.IpInfoLookup("8.8.8.8")
+		if err != nil || asn != "AS15169" || descr != "Google LLC" {
+			t.Fatalf("IpInfoLookup returned %q, %q, %v", asn, descr, err)
+		}
+	}
+	for _, h := range handlers {
+		if _, _, err := h.IpInfoLookup("8.8.8.8"); err != IpinfoRateLimitedError {
+			t.Fatalf("unexpected IpInfoLookup error: %v", err)
+		}
+	}
+	stats := c.Stats()
+	if stats.Requests != 2 || stats.RateLimited != 2 || stats.Failures != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	// Throttling starts a cooldown, as long as told by Retry-After
+	c = NewIpinfoClient("secret", IpinfoLimits{})
+	c.baseURL = ts.URL
+	atomic.StoreInt32(&throttle, 1)
+	ctx := context.Background()
+	if _, _, err := c.lookup(ctx, "8.8.8.8"); err != IpinfoRateLimitedError {
+		t.Fatalf("unexpected lookup error: %v", err)
+	}
+	atomic.StoreInt32(&throttle, 0)
+	if _, _, err := c.lookup(ctx, "8.8.8.8"); err != IpinfoRateLimitedError {
+		t.Fatalf("unexpected lookup error: %v", err)
+	}
+	stats = c.Stats()
+	if stats.Requests != 1 || stats.Throttled != 1 || stats.RateLimited != 1 ||
+		time.Until(stats.CooldownUntil) < 59*time.Minute {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestIpinfoZeroHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("AS15169 Google LLC\n"))
+	}))
+	defer ts.Close()
+	defer func(c *IpinfoClient) { defaultIpinfoClient = c }(defaultIpinfoClient)
+	defaultIpinfoClient = NewIpinfoClient("", IpinfoLimits{})
+	defaultIpinfoClient.baseURL = ts.URL
+	asn, descr, err := Handler{}.IpInfoLookup("8.8.8.8")
+	if asn != "AS15169" || descr != "Google LLC" || err != nil {
+		t.Errorf("IpInfoLookup of the zero Handler answered %q %q %v", asn, descr, err)
+	}
+}
+
+func TestIpinfoRate(t *testing.T) {
+	c := NewIpinfoClient("", IpinfoLimits{Rate: 100})
+	if !c.allow() || c.allow() {
+		t.Fatalf("burst of 1 not honored")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !c.allow() {
+		t.Fatalf("budget not replenished")
+	}
+}
+
+// roundTripFunc is an http.RoundTripper function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWithIpinfoHTTPClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ip":
+			w.Write([]byte("8.8.8.8\n"))
+		case "/9.9.9.9/org", "/8.8.4.4/org":
+			w.Write([]byte("AS15169 Google LLC\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	transport := &countingTransport{base: http.DefaultTransport}
+	// Requests with default clients fail
+	var leaked atomic.Int32
+	defer func(rt http.RoundTripper) { http.DefaultTransport = rt }(http.DefaultTransport)
+	http.DefaultTransport = roundTripFunc(func(*http.Request) (*http.Response, error) {
+		leaked.Add(1)
+		return nil, errors.New("default HTTP transport used")
+	})
+	defer func(dir string) { geoipDataDir = dir }(geoipDataDir)
+	geoipDataDir = t.TempDir()
+	h, err := NewHandlerOpts(WithIpinfoHTTPClient(&http.Client{Transport: transport}, ts.URL+"/"), WithMMDB(testMMDB))
+	if err != nil {
+		t.Fatalf("NewHandlerOpts failed: %s", err)
+	}
+	ctx := context.Background()
+	if asn, descr, err := h.LookupAsn("9.9.9.9"); err != nil || asn != "AS15169" || descr != "Google LLC" {
+		t.Fatalf("LookupAsn returned %q, %q, %v", asn, descr, err)
+	}
+	if asn, _, err := h.IpInfoLookup("8.8.4.4"); err != nil || asn != "AS15169" {
+		t.Fatalf("IpInfoLookup returned %q, %v", asn, err)
+	}
+	if info, err := h.LookupSelf(ctx); err != nil || info.IP != "8.8.8.8" || info.Asn != "AS15169" {
+		t.Fatalf("LookupSelf returned %+v, %v", info, err)
+	}
+	if n, leaks := transport.requests.Load(), leaked.Load(); n != 3 || leaks != 0 {
+		t.Fatalf("%d requests with the given client, %d with default ones", n, leaks)
+	}
+	// Defaults are kept
+	h = newHandler(nil, time.Second)
+	if err := WithIpinfoHTTPClient(nil, "")(&h); err != nil || h.ipinfo.baseURL != ipinfoURL {
+		t.Fatalf("WithIpinfoHTTPClient without client nor URL set %s, %v", h.ipinfo.baseURL, err)
+	}
+	for _, url := range []string{"ipinfo.io", "ftp://ipinfo.io", "http://"} {
+		if err := WithIpinfoHTTPClient(nil, url)(&h); err == nil {
+			t.Fatalf("WithIpinfoHTTPClient accepted base URL %s", url)
+		}
+	}
+	if err := WithIpinfoClient(NewIpinfoClient("", IpinfoLimits{}))(&h); err != nil {
+		t.Fatalf("WithIpinfoClient failed: %s", err)
+	}
+	if err := WithIpinfoHTTPClient(http.DefaultClient, "")(&h); err == nil {
+		t.Fatalf("WithIpinfoHTTPClient accepted a client given by WithIpinfoClient")
+	}
+}
+
+func TestWithIpinfoToken(t *testing.T) {
+	auth := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		if r.URL.Path == "/192.0.2.1/org" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("AS15169 Google LLC\n"))
+	}))
+	defer ts.Close()
+	for _, token := range []string{"secret", ""} {
+		h := newHandler(nil, time.Second)
+		h.ipinfo.baseURL = ts.URL
+		if token != "" {
+			if err := WithIpinfoToken(token)(&h); err != nil {
+				t.Fatalf("WithIpinfoToken failed: %s", err)
+			}
+		}
+		if _, _, err := h.IpInfoLookup("8.8.8.8"); err != nil {
+			t.Fatalf("IpInfoLookup failed: %s", err)
+		}
+		expected := ""
+		if token != "" {
+			expected = "Bearer " + token
+		}
+		if header := <-auth; header != expected {
+			t.Fatalf("ipinfo.io request authorized by %q, expected %q", header, expected)
+		}
+	}
+	// Forbidden requests start a cooldown
+	h := newHandler(nil, time.Second)
+	h.ipinfo.baseURL = ts.URL
+	if _, _, err := h.IpInfoLookup("192.0.2.1"); err != IpinfoForbiddenError {
+		t.Fatalf("forbidden IpInfoLookup returned %v", err)
+	}
+	<-auth
+	if _, _, err := h.IpInfoLookup("8.8.8.8"); err != IpinfoRateLimitedError {
+		t.Fatalf("IpInfoLookup during cooldown returned %v", err)
+	}
+	if stats := h.ipinfo.Stats(); stats.Forbidden != 1 || stats.Throttled != 0 || stats.RateLimited != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if err := WithIpinfoToken("")(&h); err == nil {
+		t.Fatalf("WithIpinfoToken accepted an empty token")
+	}
+	if err := WithIpinfoClient(NewIpinfoClient("", IpinfoLimits{}))(&h); err != nil {
+		t.Fatalf("WithIpinfoClient failed: %s", err)
+	}
+	if err := WithIpinfoToken("secret")(&h); err == nil {
+		t.Fatalf("WithIpinfoToken accepted a client given by WithIpinfoClient")
+	}
+}
+
+func TestIpInfo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/json")
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, "testdata/ipinfo/"+ip+".json")
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	if err := WithIpinfoHTTPClient(nil, ts.URL)(&h); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ip       string
+		expected IpInfoRecord
+		err      bool
+	}{
+		{"8.8.8.8", IpInfoRecord{
+			IP:       "8.8.8.8",
+			Hostname: "dns.google",
+			City:     "Mountain View",
+			Region:   "California",
+			Country:  "US",
+			Loc:      "37.4056,-122.0775",
+			Postal:   "94043",
+			Timezone: "America/Los_Angeles",
+			Org:      "AS15169 Google LLC",
+			Asn:      "AS15169",
+			OrgName:  "Google LLC",
+		}, false},
+		// Organization without ASN
+		{"192.0.2.10", IpInfoRecord{IP: "192.0.2.10", City: "Paris", Country: "FR", Org: "Example Hosting"}, false},
+		{"10.0.0.1", IpInfoRecord{IP: "10.0.0.1", Bogon: true}, false},
+		{"192.0.2.11", IpInfoRecord{}, true},
+		{"ns1.google.com", IpInfoRecord{}, true},
+	} {
+		record, err := h.IpInfo(test.ip)
+		if record != test.expected || (err != nil) != test.err {
+			t.Errorf("IpInfo(%s) answered %+v %v, expected %+v", test.ip, record, err, test.expected)
+		}
+	}
+}
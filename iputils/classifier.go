@@ -0,0 +1,337 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package iputils
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// IPClassifier classifies IP addresses by the IANA registries,
+// amended by AddNonGlobal and RemoveNonGlobal.
+// It is safe for concurrent use, lookups never waiting for amendments.
+// The zero IPClassifier deems every valid address global.
+type IPClassifier struct {
+	// Serializes amendments
+	mu sync.Mutex
+	// Sorted prefixes, replaced on amendments
+	tables atomic.Pointer[classifierTables]
+}
+
+// classifierTables are the sorted prefixes of an IPClassifier.
+type classifierTables struct {
+	ipv4, ipv6 []classPrefix
+	// Whether Teredo and 6to4 addresses are classified
+	// by their embedded IPv4 addresses (see SetEmbeddedIPv4)
+	embedded bool
+	// Matcher of local IPv4 addresses, prepared from ipv4 (see store)
+	v4 ipv4Matcher
+}
+
+// ipv4Matcher tells local IPv4 addresses, as 32-bit numbers,
+// by the disjoint ranges of addresses of the same locality.
+type ipv4Matcher struct {
+	// Sorted first addresses of the ranges, starting with zero
+	starts []uint32
+	// Whether the addresses of each range are local
+	local []bool
+}
+
+// newIPv4Matcher prepares the matcher of sorted IPv4 prefixes.
+func newIPv4Matcher(prefixes []classPrefix) ipv4Matcher {
+	// Locality only changes where prefixes start or end
+	bounds := []uint32{0}
+	for _, p := range prefixes {
+		b := p.prefix.Addr().As4()
+		start := binary.BigEndian.Uint32(b[:])
+		bounds = append(bounds, start)
+		if end := uint64(start) + 1<<(32-p.prefix.Bits()); end <= math.MaxUint32 {
+			bounds = append(bounds, uint32(end))
+		}
+	}
+	slices.Sort(bounds)
+	var m ipv4Matcher
+	for _, start := range slices.Compact(bounds) {
+		local := false
+		if p := matchPrefixes(prefixes, netip.AddrFrom4([4]byte(binary.BigEndian.AppendUint32(nil, start)))); p != nil {
+			local = isLocalClass(p.class)
+		}
+		if n := len(m.local); n > 0 && m.local[n-1] == local {
+			continue
+		}
+		m.starts = append(m.starts, start)
+		m.local = append(m.local, local)
+	}
+	return m
+}
+
+// isLocal tells if an IPv4 address is local.
+func (m *ipv4Matcher) isLocal(addr uint32) bool {
+	// Last range starting at addr or below
+	lo, hi := 0, len(m.starts)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if m.starts[mid] <= addr {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo > 0 && m.local[lo-1]
+}
+
+// store prepares tables and makes them those of the classifier.
+func (c *IPClassifier) store(tables *classifierTables) {
+	tables.v4 = newIPv4Matcher(tables.ipv4)
+	c.tables.Store(tables)
+}
+
+// NewIPClassifier returns a classifier of the IANA registries,
+// as ClassifyIP and IsLocalIP.
+func NewIPClassifier() *IPClassifier {
+	c := &IPClassifier{}
+	c.store(&classifierTables{
+		ipv4: parsePrefixes(specialIPv4CIDRs),
+		ipv6: parsePrefixes(specialIPv6CIDRs),
+	})
+	return c
+}
+
+// Classify tells the class of an IP address, as ClassifyIP does.
+func (c *IPClassifier) Classify(ip net.IP) (Class, string) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ClassInvalid, ""
+	}
+	return c.ClassifyAddr(addr)
+}
+
+// ClassifyAddr tells the class of an IP address, as ClassifyAddr does.
+func (c *IPClassifier) ClassifyAddr(addr netip.Addr) (Class, string) {
+	class, prefix := c.classify(addr)
+	if !prefix.IsValid() {
+		return class, ""
+	}
+	return class, prefix.String()
+}
+
+// classify is ClassifyAddr, without formatting the CIDR.
+func (c *IPClassifier) classify(addr netip.Addr) (Class, netip.Prefix) {
+	return c.tables.Load().classify(addr)
+}
+
+// classify is IPClassifier.classify, with tables possibly nil.
+func (tables *classifierTables) classify(addr netip.Addr) (Class, netip.Prefix) {
+	if !addr.IsValid() {
+		return ClassInvalid, netip.Prefix{}
+	}
+	if tables == nil {
+		return ClassGlobal, netip.Prefix{}
+	}
+	addr = addr.Unmap()
+	prefixes := tables.ipv4
+	if !addr.Is4() {
+		addr = addr.WithZone("")
+		prefixes = tables.ipv6
+		if tables.embedded {
+			if embedded, ok := ExtractEmbeddedAddr(addr); ok {
+				addr, prefixes = embedded, tables.ipv4
+			}
+		}
+	}
+	// Ranges made global by RemoveNonGlobal are left out
+	if p := matchPrefixes(prefixes, addr); p != nil && p.class != ClassGlobal {
+		return p.class, p.prefix
+	}
+	return ClassGlobal, netip.Prefix{}
+}
+
+// IsLocal tells if an IP address is not forwardable across networks,
+// as IsLocalIP does.
+func (c *IPClassifier) IsLocal(ip net.IP) bool {
+	return c.tables.Load().isLocal(ip)
+}
+
+// IsLocalAddr tells if an IP address is not forwardable across networks,
+// as IsLocalAddr does.
+func (c *IPClassifier) IsLocalAddr(addr netip.Addr) bool {
+	class, _ := c.classify(addr)
+	return isLocalClass(class)
+}
+
+// IsLocalString tells if an IP address is not forwardable across networks,
+// as IsLocalIPString does.
+func (c *IPClassifier) IsLocalString(s string) bool {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return true
+	}
+	return c.IsLocalAddr(addr)
+}
+
+// FilterGlobal returns the IP addresses of ips
+// not local to networks, as FilterGlobal does.
+func (c *IPClassifier) FilterGlobal(ips []net.IP) []net.IP {
+	tables := c.tables.Load()
+	global := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if !tables.isLocalBatch(ip) {
+			global = append(global, ip)
+		}
+	}
+	if len(global) == 0 {
+		return nil
+	}
+	return global
+}
+
+// ForEachLocal calls fn with the IP addresses of ips
+// local to networks, as ForEachLocal does.
+func (c *IPClassifier) ForEachLocal(ips []net.IP, fn func(net.IP)) {
+	tables := c.tables.Load()
+	for _, ip := range ips {
+		if tables.isLocalBatch(ip) {
+			fn(ip)
+		}
+	}
+}
+
+// isLocalBatch is isLocal, by the prepared matcher for IPv4 addresses,
+// without conversion to netip.Addr.
+func (tables *classifierTables) isLocalBatch(ip net.IP) bool {
+	if tables != nil {
+		switch {
+		case len(ip) == net.IPv4len:
+			return tables.v4.isLocal(binary.BigEndian.Uint32(ip))
+		case len(ip) == net.IPv6len && [12]byte(ip[:12]) == v4InV6Prefix:
+			return tables.v4.isLocal(binary.BigEndian.Uint32(ip[12:]))
+		}
+	}
+	return tables.isLocal(ip)
+}
+
+// v4InV6Prefix is the prefix of IPv4-mapped IPv6 addresses.
+var v4InV6Prefix = [12]byte{10: 0xff, 11: 0xff}
+
+// isLocal is IPClassifier.IsLocal, with tables possibly nil.
+func (tables *classifierTables) isLocal(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	class, _ := tables.classify(addr)
+	return isLocalClass(class)
+}
+
+// isLocalClass tells if addresses of a class are not forwardable.
+func isLocalClass(class Class) bool {
+	return class != ClassGlobal && class != ClassMulticast
+}
+
+// SetEmbeddedIPv4 makes the classifier classify Teredo and 6to4 addresses
+// by the IPv4 address they embed (see ExtractEmbeddedAddr),
+// instead of by their own ranges, if enabled.
+// For instance, 6to4 addresses of private IPv4 addresses become local,
+// and Teredo addresses of global ones become global.
+// It is disabled by default.
+func (c *IPClassifier) SetEmbeddedIPv4(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tables := classifierTables{}
+	if old := c.tables.Load(); old != nil {
+		tables = *old
+	}
+	tables.embedded = enabled
+	c.store(&tables)
+}
+
+// AddNonGlobal makes the addresses of a CIDR, such as "198.51.0.0/16",
+// local: of ClassCustom, unless already local,
+// in which case they keep their class.
+// IPv4-mapped IPv6 CIDRs amend IPv4 addresses.
+func (c *IPClassifier) AddNonGlobal(cidr string) error {
+	return c.amend(cidr, ClassCustom)
+}
+
+// RemoveNonGlobal makes the addresses of a CIDR, such as "100.64.0.0/10",
+// global, unless multicast.
+// IPv4-mapped IPv6 CIDRs amend IPv4 addresses.
+func (c *IPClassifier) RemoveNonGlobal(cidr string) error {
+	return c.amend(cidr, ClassGlobal)
+}
+
+// amend gives the addresses of a CIDR a given class,
+// ClassCustom or ClassGlobal.
+func (c *IPClassifier) amend(cidr string, class Class) error {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	p = p.Masked()
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	local := isLocalClass(class)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tables := classifierTables{}
+	if old := c.tables.Load(); old != nil {
+		tables = *old
+	}
+	table := &tables.ipv6
+	if p.Addr().Is4() {
+		table = &tables.ipv4
+	}
+	// Ranges within p the other way around are dropped
+	var prefixes []classPrefix
+	for _, prefix := range *table {
+		if prefix.prefix.Bits() >= p.Bits() && p.Contains(prefix.prefix.Addr()) && isLocalClass(prefix.class) != local {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	sortPrefixes(prefixes)
+	// The rest of p is amended unless a range containing p already is
+	containing := ClassGlobal
+	if prefix := containingPrefix(prefixes, p); prefix != nil {
+		containing = prefix.class
+	}
+	if isLocalClass(containing) != local {
+		prefixes = append(prefixes, classPrefix{prefix: p, class: class})
+		sortPrefixes(prefixes)
+	}
+	*table = prefixes
+	c.store(&tables)
+	return nil
+}
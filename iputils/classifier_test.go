@@ -0,0 +1,270 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package iputils
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestIPClassifier(t *testing.T) {
+	c := NewIPClassifier()
+	classify := func(ip string, class Class, cidr string) {
+		t.Helper()
+		if got, gotCIDR := c.Classify(net.ParseIP(ip)); got != class || gotCIDR != cidr {
+			t.Errorf("Classify(%s) = %s %q, expected %s %q", ip, got, gotCIDR, class, cidr)
+		}
+	}
+	// A public range
+	if err := c.AddNonGlobal("198.50.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	classify("198.50.1.1", ClassCustom, "198.50.0.0/16")
+	classify("198.51.1.1", ClassGlobal, "")
+	// Overlapping ranges keep the classes of the registries within them
+	if err := c.AddNonGlobal("198.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	classify("198.1.1.1", ClassCustom, "198.0.0.0/8")
+	classify("198.50.1.1", ClassCustom, "198.50.0.0/16")
+	classify("198.51.100.1", ClassDocumentation, "198.51.100.0/24")
+	// Ranges already local are left alone
+	if err := c.AddNonGlobal("10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	classify("10.1.2.3", ClassPrivateUse, "10.0.0.0/8")
+	// Default ranges removed
+	if err := c.RemoveNonGlobal("100.64.0.0/10"); err != nil {
+		t.Fatal(err)
+	}
+	classify("100.64.1.1", ClassGlobal, "")
+	if c.IsLocal(net.ParseIP("100.64.1.1")) {
+		t.Error("IsLocal answered true within a removed range")
+	}
+	// Or parts of them, even through IPv4-mapped IPv6 CIDRs
+	if err := c.RemoveNonGlobal("::ffff:10.2.0.0/112"); err != nil {
+		t.Fatal(err)
+	}
+	classify("10.2.3.4", ClassGlobal, "")
+	classify("10.3.4.5", ClassPrivateUse, "10.0.0.0/8")
+	// Ranges added back
+	if err := c.AddNonGlobal("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	classify("10.2.3.4", ClassPrivateUse, "10.0.0.0/8")
+	// Multicast ranges stay multicast, unless made local
+	if err := c.RemoveNonGlobal("ff00::/8"); err != nil {
+		t.Fatal(err)
+	}
+	classify("ff02::1", ClassMulticast, "ff00::/8")
+	if err := c.AddNonGlobal("ff02::/16"); err != nil {
+		t.Fatal(err)
+	}
+	classify("ff02::1", ClassCustom, "ff02::/16")
+	classify("ff05::1", ClassMulticast, "ff00::/8")
+	// Malformed CIDRs
+	for _, cidr := range []string{"", "10.0.0.0", "10.0.0.0/33", "example.com/8", "fe80::1%eth0/64"} {
+		if err := c.AddNonGlobal(cidr); err == nil {
+			t.Errorf("AddNonGlobal(%q) succeeded", cidr)
+		}
+		if err := c.RemoveNonGlobal(cidr); err == nil {
+			t.Errorf("RemoveNonGlobal(%q) succeeded", cidr)
+		}
+	}
+	// The default classifier is left alone
+	if !IsLocalIP(net.ParseIP("100.64.1.1")) || IsLocalIP(net.ParseIP("198.50.1.1")) {
+		t.Error("amendments changed the default classifier")
+	}
+}
+
+func TestIPClassifierBatch(t *testing.T) {
+	amended := NewIPClassifier()
+	for _, err := range []error{
+		amended.AddNonGlobal("198.51.0.0/16"),
+		amended.RemoveNonGlobal("100.64.0.0/10"),
+		amended.RemoveNonGlobal("10.1.0.0/16"),
+		amended.AddNonGlobal("::ffff:8.8.8.0/120"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, c := range map[string]*IPClassifier{"default": NewIPClassifier(), "amended": amended, "zero": {}} {
+		// Addresses at both ends of every range, and around them
+		var ips []net.IP
+		for _, p := range append(parsePrefixes(specialIPv4CIDRs), amended.tables.Load().ipv4...) {
+			first := p.prefix.Addr()
+			b := first.As4()
+			for i := p.prefix.Bits(); i < 32; i++ {
+				b[i/8] |= 0x80 >> (i % 8)
+			}
+			last := netip.AddrFrom4(b)
+			for _, addr := range []netip.Addr{first.Prev(), first, last, last.Next()} {
+				if addr.IsValid() {
+					ips = append(ips, addr.AsSlice(), net.IP(addr.AsSlice()).To16())
+				}
+			}
+		}
+		ips = append(ips, nil, net.IP{1, 2, 3}, net.ParseIP("2001:db8::1"))
+		var local []net.IP
+		c.ForEachLocal(ips, func(ip net.IP) { local = append(local, ip) })
+		global := c.FilterGlobal(ips)
+		for _, ip := range ips {
+			if isLocal := c.IsLocal(ip); slices.ContainsFunc(local, ip.Equal) != isLocal || slices.ContainsFunc(global, ip.Equal) == isLocal {
+				t.Errorf("%s classifier: batches disagree with IsLocal(%v) = %t", name, ip, isLocal)
+			}
+		}
+	}
+}
+
+func TestIPClassifierConcurrency(t *testing.T) {
+	c := NewIPClassifier()
+	addr := netip.MustParseAddr("198.50.1.1")
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				c.IsLocalAddr(addr)
+			}
+		}()
+	}
+	for range 100 {
+		if err := c.AddNonGlobal("198.50.0.0/16"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.RemoveNonGlobal("198.50.0.0/16"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if c.IsLocalAddr(addr) {
+		t.Error("IsLocalAddr answered true within a removed range")
+	}
+}
+
+func TestExtractEmbeddedIPv4(t *testing.T) {
+	tests := []struct {
+		ip       string
+		embedded string
+	}{
+		// RFC4380 section 4: server 65.54.227.120, client 192.0.2.45 port 40000,
+		// client bits flipped: ^c000:022d = 3fff:fdd2
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", "192.0.2.45"},
+		// ^0808:0808 = f7f7:f7f7
+		{"2001:0:4136:e378:8000:63bf:f7f7:f7f7", "8.8.8.8"},
+		// ^0a00:0001 = f5ff:fffe
+		{"2001::f5ff:fffe", "10.0.0.1"},
+		// ^0000:0000 and ^ffff:ffff
+		{"2001::ffff:ffff", "0.0.0.0"},
+		{"2001::", "255.255.255.255"},
+		// 6to4, the address follows the 2002::/16 prefix
+		{"2002:c000:022d::1", "192.0.2.45"},
+		{"2002:0a00:0001:1234::5", "10.0.0.1"},
+		{"2002:0808:0808::", "8.8.8.8"},
+		// IPv4-mapped
+		{"::ffff:192.168.1.1", "192.168.1.1"},
+		// None
+		{"2001:1::1", ""},
+		{"2003::1", ""},
+		{"2001:db8::1", ""},
+		{"::1", ""},
+		{"8.8.8.8", ""},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if ip.To4() != nil && test.embedded == "" {
+			ip = ip.To4()
+		}
+		embedded, ok := ExtractEmbeddedIPv4(ip)
+		if ok != (test.embedded != "") || ok && (len(embedded) != net.IPv4len || embedded.String() != test.embedded) {
+			t.Errorf("ExtractEmbeddedIPv4(%s) = %v %t, expected %q", test.ip, []byte(embedded), ok, test.embedded)
+		}
+		addr, ok := ExtractEmbeddedAddr(netip.MustParseAddr(test.ip))
+		if ok != (test.embedded != "") || ok && addr.String() != test.embedded {
+			t.Errorf("ExtractEmbeddedAddr(%s) = %s %t, expected %q", test.ip, addr, ok, test.embedded)
+		}
+	}
+	if _, ok := ExtractEmbeddedIPv4(nil); ok {
+		t.Error("ExtractEmbeddedIPv4(nil) succeeded")
+	}
+	if addr, ok := ExtractEmbeddedAddr(netip.MustParseAddr("2002:0a00:0001::1%eth0")); !ok || addr.String() != "10.0.0.1" {
+		t.Errorf("ExtractEmbeddedAddr of a zoned address = %s %t", addr, ok)
+	}
+}
+
+func TestIPClassifierEmbeddedIPv4(t *testing.T) {
+	c := NewIPClassifier()
+	tests := []struct {
+		ip              string
+		class, embedded Class
+	}{
+		// Teredo of a public client, and of a private one
+		{"2001:0:4136:e378:8000:63bf:f7f7:f7f7", ClassTeredo, ClassGlobal},
+		{"2001::f5ff:fffe", ClassTeredo, ClassPrivateUse},
+		// 6to4 of a private site, and of a public one
+		{"2002:c0a8:0101::1", ClassGlobal, ClassPrivateUse},
+		{"2002:0808:0808::1", ClassGlobal, ClassGlobal},
+		// Others are left alone
+		{"2001:db8::1", ClassDocumentation, ClassDocumentation},
+		{"fe80::1", ClassLinkLocal, ClassLinkLocal},
+	}
+	classify := func(embedded bool) {
+		t.Helper()
+		for _, test := range tests {
+			expected := test.class
+			if embedded {
+				expected = test.embedded
+			}
+			if class, _ := c.Classify(net.ParseIP(test.ip)); class != expected {
+				t.Errorf("Classify(%s) = %s, expected %s", test.ip, class, expected)
+			}
+			if local := c.IsLocal(net.ParseIP(test.ip)); local != isLocalClass(expected) {
+				t.Errorf("IsLocal(%s) = %t", test.ip, local)
+			}
+		}
+	}
+	classify(false)
+	c.SetEmbeddedIPv4(true)
+	classify(true)
+	// Amendments keep the setting, and apply to embedded addresses
+	if err := c.RemoveNonGlobal("192.168.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if c.IsLocal(net.ParseIP("2002:c0a8:0101::1")) {
+		t.Error("IsLocal answered true for the 6to4 address of a removed range")
+	}
+	c.SetEmbeddedIPv4(false)
+	tests = tests[:2]
+	classify(false)
+	if class, _ := ClassifyIP(net.ParseIP("2001::f5ff:fffe")); class != ClassTeredo {
+		t.Errorf("the default classifier classified a Teredo address as %s", class)
+	}
+}
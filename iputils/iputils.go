@@ -27,94 +27,314 @@ package iputils
 
 import (
 	"net"
+	"net/netip"
+	"slices"
 )
 
-func init() {
-	// Initialize nonGlobalIPv*Nets
-	nonGlobalIPv4Nets = make([]*net.IPNet, len(nonGlobalIPv4CIDRs))
-	for i, cidr := range nonGlobalIPv4CIDRs {
-		_, inet, err := net.ParseCIDR(cidr)
-		if err != nil {
-			panic(err)
+// defaultClassifier classifies addresses by the IANA registries,
+// left alone.
+var defaultClassifier = NewIPClassifier()
+
+// Class is the kind of range of an IP address (see ClassifyIP).
+type Class int
+
+// Classes of IP addresses.
+const (
+	// Addresses of none of the ranges below
+	ClassGlobal Class = iota
+	// Nil or malformed addresses
+	ClassInvalid
+	ClassLoopback
+	// RFC1918 private networks
+	ClassPrivateUse
+	// Shared Address Space of carrier-grade NAT, RFC6598
+	ClassSharedCGNAT
+	ClassLinkLocal
+	ClassDocumentation
+	ClassBenchmarking
+	ClassReserved
+	ClassUnspecified
+	ClassMulticast
+	// "This host on this network"
+	ClassThisNetwork
+	// IETF Protocol Assignments
+	ClassProtocolAssignments
+	// Limited broadcast
+	ClassBroadcast
+	// IPv6 unique local addresses, RFC4193
+	ClassUniqueLocal
+	ClassIPv4Mapped
+	ClassTeredo
+	ClassDiscardOnly
+	// Added by IPClassifier.AddNonGlobal
+	ClassCustom
+	// Other ranges of registries (see NewIPClassifierFromRegistry)
+	ClassSpecialPurpose
+)
+
+var classNames = [...]string{
+	ClassGlobal:              "global",
+	ClassInvalid:             "invalid",
+	ClassLoopback:            "loopback",
+	ClassPrivateUse:          "private-use",
+	ClassSharedCGNAT:         "shared CGNAT",
+	ClassLinkLocal:           "link-local",
+	ClassDocumentation:       "documentation",
+	ClassBenchmarking:        "benchmarking",
+	ClassReserved:            "reserved",
+	ClassUnspecified:         "unspecified",
+	ClassMulticast:           "multicast",
+	ClassThisNetwork:         "this network",
+	ClassProtocolAssignments: "IETF protocol assignments",
+	ClassBroadcast:           "limited broadcast",
+	ClassUniqueLocal:         "unique-local",
+	ClassIPv4Mapped:          "IPv4-mapped",
+	ClassTeredo:              "Teredo",
+	ClassDiscardOnly:         "discard-only",
+	ClassCustom:              "custom",
+	ClassSpecialPurpose:      "special-purpose",
+}
+
+// String returns the name of the class, such as "private-use".
+func (c Class) String() string {
+	if c < 0 || int(c) >= len(classNames) {
+		return "unknown"
+	}
+	return classNames[c]
+}
+
+// specialCIDR is a CIDR of a range of a given class.
+type specialCIDR struct {
+	cidr  string
+	class Class
+}
+
+// classPrefix is a parsed specialCIDR.
+type classPrefix struct {
+	prefix netip.Prefix
+	class  Class
+	// Index of the closest prefix containing this one, -1 if none
+	parent int
+}
+
+// parsePrefixes parses CIDRs, panicking if one is malformed.
+//
+// Returns the prefixes of the CIDRs, sorted (see sortPrefixes).
+func parsePrefixes(cidrs []specialCIDR) []classPrefix {
+	prefixes := make([]classPrefix, len(cidrs))
+	for i, c := range cidrs {
+		prefixes[i] = classPrefix{prefix: netip.MustParsePrefix(c.cidr).Masked(), class: c.class}
+	}
+	sortPrefixes(prefixes)
+	return prefixes
+}
+
+// sortPrefixes sorts prefixes by address, those containing others first,
+// and links them to their parents.
+func sortPrefixes(prefixes []classPrefix) {
+	slices.SortFunc(prefixes, func(a, b classPrefix) int {
+		if c := a.prefix.Addr().Compare(b.prefix.Addr()); c != 0 {
+			return c
+		}
+		return a.prefix.Bits() - b.prefix.Bits()
+	})
+	// Prefixes nest or are disjoint, so their parents are on a stack
+	var stack []int
+	for i := range prefixes {
+		for len(stack) > 0 && !prefixes[stack[len(stack)-1]].prefix.Contains(prefixes[i].prefix.Addr()) {
+			stack = stack[:len(stack)-1]
 		}
-		nonGlobalIPv4Nets[i] = inet
+		prefixes[i].parent = -1
+		if len(stack) > 0 {
+			prefixes[i].parent = stack[len(stack)-1]
+		}
+		stack = append(stack, i)
 	}
-	nonGlobalIPv6Nets = make([]*net.IPNet, len(nonGlobalIPv6CIDRs))
-	for i, cidr := range nonGlobalIPv6CIDRs {
-		_, inet, err := net.ParseCIDR(cidr)
-		if err != nil {
-			panic(err)
+}
+
+// matchPrefixes finds the longest of sorted prefixes containing an address.
+//
+// Returns the prefix, or nil if none contains addr.
+func matchPrefixes(prefixes []classPrefix, addr netip.Addr) *classPrefix {
+	// The prefixes containing addr are the last one starting at addr or below,
+	// or its ancestors
+	for i := searchPrefixes(prefixes, addr); i >= 0; i = prefixes[i].parent {
+		if prefixes[i].prefix.Contains(addr) {
+			return &prefixes[i]
 		}
-		nonGlobalIPv6Nets[i] = inet
 	}
+	return nil
 }
 
-var (
-	nonGlobalIPv4Nets []*net.IPNet
-	nonGlobalIPv6Nets []*net.IPNet
-)
+// containingPrefix finds the longest of sorted prefixes containing p.
+//
+// Returns the prefix, or nil if none contains p.
+func containingPrefix(prefixes []classPrefix, p netip.Prefix) *classPrefix {
+	for i := searchPrefixes(prefixes, p.Addr()); i >= 0; i = prefixes[i].parent {
+		if prefixes[i].prefix.Bits() <= p.Bits() && prefixes[i].prefix.Contains(p.Addr()) {
+			return &prefixes[i]
+		}
+	}
+	return nil
+}
+
+// searchPrefixes finds the last of sorted prefixes starting at addr or below,
+// by binary search.
+//
+// Returns its index, or -1 if none.
+func searchPrefixes(prefixes []classPrefix, addr netip.Addr) int {
+	lo, hi := 0, len(prefixes)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if prefixes[mid].prefix.Addr().Compare(addr) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo - 1
+}
 
-// nonGlobalIPv4CIDRs contains IANA IPv4 Special-Purpose Address Registry,
-// where 'Global' flag is false.
+// specialIPv4CIDRs contains IANA IPv4 Special-Purpose Address Registry,
+// where 'Global' flag is false, and multicast addresses.
 //
 // http://www.iana.org/assignments/iana-ipv4-special-registry/
-var nonGlobalIPv4CIDRs = []string{
-	"127.0.0.0/8",        // Loopback, RFC1122
-	"192.168.0.0/16",     // Private-Use, RFC1918
-	"10.0.0.0/8",         // Private-Use, RFC1918
-	"172.16.0.0/12",      // Private-Use, RFC1918
-	"0.0.0.0/8",          // "This host on this network", RFC1122 section 3.2.1.3
-	"100.64.0.0/10",      // Shared Address Space, RFC6598
-	"169.254.0.0/16",     // Link Local, RFC3927
-	"192.0.0.0/24",       // IETF Protocol Assignments, RFC6890
-	"192.0.2.0/24",       // Documentation (TEST-NET-1), RFC5737
-	"198.18.0.0/15",      // Benchmarking, RFC2544
-	"198.51.100.0/24",    // Documentation (TEST-NET-2), RFC5737
-	"203.0.113.0/24",     // Documentation (TEST-NET-3), RFC5737
-	"240.0.0.0/4",        // Reserved, RFC1112
-	"255.255.255.255/32", // Limited Broadcast, RFC919
-}
-
-// nonGlobalIPv6CIDRs contains IANA IPv6 Special-Purpose Address Registry,
-// where 'Global' flag is false.
+var specialIPv4CIDRs = []specialCIDR{
+	{"127.0.0.0/8", ClassLoopback},             // Loopback, RFC1122
+	{"192.168.0.0/16", ClassPrivateUse},        // Private-Use, RFC1918
+	{"10.0.0.0/8", ClassPrivateUse},            // Private-Use, RFC1918
+	{"172.16.0.0/12", ClassPrivateUse},         // Private-Use, RFC1918
+	{"0.0.0.0/8", ClassThisNetwork},            // "This host on this network", RFC1122 section 3.2.1.3
+	{"100.64.0.0/10", ClassSharedCGNAT},        // Shared Address Space, RFC6598
+	{"169.254.0.0/16", ClassLinkLocal},         // Link Local, RFC3927
+	{"192.0.0.0/24", ClassProtocolAssignments}, // IETF Protocol Assignments, RFC6890
+	{"192.0.2.0/24", ClassDocumentation},       // Documentation (TEST-NET-1), RFC5737
+	{"198.18.0.0/15", ClassBenchmarking},       // Benchmarking, RFC2544
+	{"198.51.100.0/24", ClassDocumentation},    // Documentation (TEST-NET-2), RFC5737
+	{"203.0.113.0/24", ClassDocumentation},     // Documentation (TEST-NET-3), RFC5737
+	{"240.0.0.0/4", ClassReserved},             // Reserved, RFC1112
+	{"255.255.255.255/32", ClassBroadcast},     // Limited Broadcast, RFC919
+	{"224.0.0.0/4", ClassMulticast},            // Multicast, RFC5771, not in the registry
+}
+
+// specialIPv6CIDRs contains IANA IPv6 Special-Purpose Address Registry,
+// where 'Global' flag is false, and multicast addresses.
 //
 // http://www.iana.org/assignments/iana-ipv6-special-registry/
-var nonGlobalIPv6CIDRs = []string{
-	"::1/128",       // Loopback Address, RFC4291
-	"fc00::/7",      // Unique-Local, RFC4193
-	"::ffff:0:0/96", // IPv4-mapped Address, RFC4291
-	"fe80::/10",     // Linked-Scoped Unicast, RFC4291
-	"::/128",        // Unspecified Address, RFC4291
-	"2001::/23",     // IETF Protocol Assignments, RFC2928
-	"2001:db8::/32", // Documentation, RFC3849
-	"2001:2::/48",   // Benchmarking, RFC5180
-	"2001::/32",     // TEREDO, RFC4380
-	"100::/64",      // Discard-Only Address Block, RFC6666
-}
-
-// IsLocalIP tells if an IP address is not forwardable across networks.
+var specialIPv6CIDRs = []specialCIDR{
+	{"::1/128", ClassLoopback},              // Loopback Address, RFC4291
+	{"fc00::/7", ClassUniqueLocal},          // Unique-Local, RFC4193
+	{"::ffff:0:0/96", ClassIPv4Mapped},      // IPv4-mapped Address, RFC4291
+	{"fe80::/10", ClassLinkLocal},           // Linked-Scoped Unicast, RFC4291
+	{"::/128", ClassUnspecified},            // Unspecified Address, RFC4291
+	{"2001::/23", ClassProtocolAssignments}, // IETF Protocol Assignments, RFC2928
+	{"2001:db8::/32", ClassDocumentation},   // Documentation, RFC3849
+	{"2001:2::/48", ClassBenchmarking},      // Benchmarking, RFC5180
+	{"2001::/32", ClassTeredo},              // TEREDO, RFC4380
+	{"100::/64", ClassDiscardOnly},          // Discard-Only Address Block, RFC6666
+	{"ff00::/8", ClassMulticast},            // Multicast, RFC4291, not in the registry
+}
+
+// ClassifyIP tells the class of an IP address, as ClassifyAddr does,
+// ClassInvalid if ip is nil or malformed.
+func ClassifyIP(ip net.IP) (Class, string) {
+	return defaultClassifier.Classify(ip)
+}
+
+// ClassifyAddr tells the class of an IP address,
+// ClassInvalid if it is the zero Addr.
+// IPv4-mapped IPv6 addresses are classified as IPv4 addresses,
+// and zones are ignored.
+//
+// Returns the class, and the CIDR of the most specific range
+// containing addr, empty for ClassGlobal and ClassInvalid.
+func ClassifyAddr(addr netip.Addr) (Class, string) {
+	return defaultClassifier.ClassifyAddr(addr)
+}
+
+// IsLocalIP tells if an IP address is not forwardable across networks,
+// as IsLocalAddr does, such as nil addresses.
 func IsLocalIP(ip net.IP) bool {
-	if ip == nil {
-		return true
+	return defaultClassifier.IsLocal(ip)
+}
+
+// IsLocalAddr tells if an IP address is not forwardable across networks,
+// that is of a class other than ClassGlobal and ClassMulticast
+// (see ClassifyAddr), such as the zero Addr.
+func IsLocalAddr(addr netip.Addr) bool {
+	return defaultClassifier.IsLocalAddr(addr)
+}
+
+var (
+	teredoPrefix    = netip.MustParsePrefix("2001::/32")
+	sixToFourPrefix = netip.MustParsePrefix("2002::/16")
+)
+
+// IsLocalIPString tells if an IP address, such as "192.168.1.1",
+// is not forwardable across networks, as IsLocalAddr does,
+// parsing it in the same step.
+// Malformed addresses are deemed local.
+func IsLocalIPString(s string) bool {
+	return defaultClassifier.IsLocalString(s)
+}
+
+// FilterGlobal returns the IP addresses of ips
+// IsLocalIP deems forwardable across networks, in order,
+// or nil if there is none.
+// It spares the per address overhead of IsLocalIP calls:
+// IPv4 addresses are matched as numbers,
+// by ranges prepared once for the classifier.
+func FilterGlobal(ips []net.IP) []net.IP {
+	return defaultClassifier.FilterGlobal(ips)
+}
+
+// ForEachLocal calls fn, in order, with the IP addresses of ips
+// IsLocalIP deems not forwardable across networks.
+// It spares the per address overhead of IsLocalIP calls,
+// as FilterGlobal does.
+func ForEachLocal(ips []net.IP, fn func(net.IP)) {
+	defaultClassifier.ForEachLocal(ips, fn)
+}
+
+// ExtractEmbeddedIPv4 extracts the IPv4 address embedded in an IPv6 address,
+// as ExtractEmbeddedAddr does.
+//
+// Returns the IPv4 address, of 4 bytes, and whether ip embeds one.
+func ExtractEmbeddedIPv4(ip net.IP) (net.IP, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || len(ip) != net.IPv6len {
+		return nil, false
 	}
-	ip4 := ip.To4()
-	if ip4 != nil {
-		for _, inet := range nonGlobalIPv4Nets {
-			if inet.Contains(ip4) {
-				return true
-			}
-		}
-		return false
+	embedded, ok := ExtractEmbeddedAddr(addr)
+	if !ok {
+		return nil, false
 	}
-	ip6 := ip.To16()
-	if ip6 != nil {
-		for _, inet := range nonGlobalIPv6Nets {
-			if inet.Contains(ip6) {
-				return true
-			}
-		}
+	ip4 := embedded.As4()
+	return net.IP(ip4[:]), true
+}
+
+// ExtractEmbeddedAddr extracts the IPv4 address embedded in an IPv6 address:
+// that of IPv4-mapped addresses (::ffff:0:0/96),
+// the address of the client of Teredo addresses (2001::/32, RFC4380),
+// stored with its bits flipped,
+// or that of the site of 6to4 addresses (2002::/16, RFC3056).
+//
+// Returns the IPv4 address, and whether addr embeds one.
+func ExtractEmbeddedAddr(addr netip.Addr) (netip.Addr, bool) {
+	if !addr.Is6() {
+		return netip.Addr{}, false
+	}
+	if addr.Is4In6() {
+		return addr.Unmap(), true
 	}
-	return false
+	b := addr.As16()
+	switch {
+	case teredoPrefix.Contains(addr.WithZone("")):
+		return netip.AddrFrom4([4]byte{^b[12], ^b[13], ^b[14], ^b[15]}), true
+	case sixToFourPrefix.Contains(addr.WithZone("")):
+		return netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]}), true
+	}
+	return netip.Addr{}, false
 }
 
 // IsIP tells if a string is an IP address.
@@ -143,3 +363,19 @@ func ParseIP(s string) (ip net.IP, isIPv4 bool) {
 	isIPv4 = ip.To4() != nil
 	return
 }
+
+// TruncateToPrefix masks an IP address to its first v4bits bits if IPv4
+// (IPv4-mapped IPv6 addresses included), or v6bits bits if IPv6,
+// such as 192.0.2.0 for 192.0.2.1 and 24 v4bits.
+// Prefix lengths are bounded by the address length.
+//
+// Returns the truncated address, or nil if ip is not valid.
+func TruncateToPrefix(ip net.IP, v4bits int, v6bits int) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(min(max(v4bits, 0), 32), 32))
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return ip6.Mask(net.CIDRMask(min(max(v6bits, 0), 128), 128))
+	}
+	return nil
+}
@@ -0,0 +1,426 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package iputils
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// parseNets parses the CIDRs of non global addresses,
+// as IsLocalIP once did on every call.
+func parseNets(cidrs []specialCIDR) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		if c.class == ClassMulticast {
+			continue
+		}
+		_, inet, err := net.ParseCIDR(c.cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, inet)
+	}
+	return nets
+}
+
+// isLocalIPNets is IsLocalIP, by a linear scan of parsed CIDRs.
+func isLocalIPNets(ip net.IP, ipv4Nets []*net.IPNet, ipv6Nets []*net.IPNet) bool {
+	if ip == nil {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		for _, inet := range ipv4Nets {
+			if inet.Contains(ip4) {
+				return true
+			}
+		}
+		return false
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		for _, inet := range ipv6Nets {
+			if inet.Contains(ip6) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// testIPs returns addresses around the bounds of every CIDR,
+// in every form, and random addresses.
+func testIPs() []net.IP {
+	ips := []net.IP{nil, {}, {1, 2, 3}, {1, 2, 3, 4, 5}}
+	for _, c := range append(append([]specialCIDR{}, specialIPv4CIDRs...), specialIPv6CIDRs...) {
+		_, inet, _ := net.ParseCIDR(c.cidr)
+		first := inet.IP
+		last := make(net.IP, len(first))
+		for i := range last {
+			last[i] = first[i] | ^inet.Mask[i]
+		}
+		for _, ip := range []net.IP{first, last} {
+			for _, delta := range []int{-1, 0, 1} {
+				ip := add(ip, delta)
+				ips = append(ips, ip, ip.To16())
+			}
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for range 10000 {
+		ip4 := make(net.IP, net.IPv4len)
+		r.Read(ip4)
+		ip6 := make(net.IP, net.IPv6len)
+		r.Read(ip6)
+		ips = append(ips, ip4, ip4.To16(), ip6)
+	}
+	return ips
+}
+
+// add returns ip plus a small delta, wrapping around.
+func add(ip net.IP, delta int) net.IP {
+	sum := make(net.IP, len(ip))
+	copy(sum, ip)
+	for i := len(sum) - 1; i >= 0 && delta != 0; i-- {
+		v := int(sum[i]) + delta
+		sum[i] = byte(v)
+		switch {
+		case v > 255:
+			delta = 1
+		case v < 0:
+			delta = -1
+		default:
+			delta = 0
+		}
+	}
+	return sum
+}
+
+func TestIsLocalIP(t *testing.T) {
+	ipv4Nets, ipv6Nets := parseNets(specialIPv4CIDRs), parseNets(specialIPv6CIDRs)
+	for _, ip := range testIPs() {
+		if got, want := IsLocalIP(ip), isLocalIPNets(ip, ipv4Nets, ipv6Nets); got != want {
+			t.Errorf("IsLocalIP(%v) = %t, expected %t", []byte(ip), got, want)
+		}
+	}
+	tests := []struct {
+		ip    string
+		local bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:192.168.1.1", true},
+		{"8.8.8.8", false},
+		{"::ffff:8.8.8.8", false},
+		{"2001:db8::1", true},
+		{"2001:4860::8888", false},
+		{"fe80::1", true},
+	}
+	for _, test := range tests {
+		if got := IsLocalIP(net.ParseIP(test.ip)); got != test.local {
+			t.Errorf("IsLocalIP(%s) = %t, expected %t", test.ip, got, test.local)
+		}
+	}
+}
+
+func TestIsLocalAddr(t *testing.T) {
+	for _, ip := range testIPs() {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		if got, want := IsLocalAddr(addr), IsLocalIP(ip); got != want {
+			t.Errorf("IsLocalAddr(%s) = %t, IsLocalIP answered %t", addr, got, want)
+		}
+	}
+	if !IsLocalAddr(netip.Addr{}) {
+		t.Error("IsLocalAddr of the zero Addr answered false")
+	}
+	tests := []struct {
+		addr  string
+		local bool
+	}{
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:8.8.8.8", false},
+		{"fe80::1%eth0", true},
+		{"2001:4860::8888%eth0", false},
+		{"::1", true},
+	}
+	for _, test := range tests {
+		if got := IsLocalAddr(netip.MustParseAddr(test.addr)); got != test.local {
+			t.Errorf("IsLocalAddr(%s) = %t, expected %t", test.addr, got, test.local)
+		}
+	}
+	addr := netip.MustParseAddr("fe80::1%eth0")
+	if allocs := testing.AllocsPerRun(100, func() { IsLocalAddr(addr) }); allocs != 0 {
+		t.Errorf("IsLocalAddr allocated %.0f times", allocs)
+	}
+}
+
+func TestClassifyIP(t *testing.T) {
+	tests := []struct {
+		ip    string
+		class Class
+		cidr  string
+	}{
+		{"127.0.0.1", ClassLoopback, "127.0.0.0/8"},
+		{"192.168.1.1", ClassPrivateUse, "192.168.0.0/16"},
+		{"10.1.2.3", ClassPrivateUse, "10.0.0.0/8"},
+		{"172.20.0.1", ClassPrivateUse, "172.16.0.0/12"},
+		{"0.1.2.3", ClassThisNetwork, "0.0.0.0/8"},
+		{"100.100.0.1", ClassSharedCGNAT, "100.64.0.0/10"},
+		{"169.254.1.1", ClassLinkLocal, "169.254.0.0/16"},
+		{"192.0.0.8", ClassProtocolAssignments, "192.0.0.0/24"},
+		{"192.0.2.1", ClassDocumentation, "192.0.2.0/24"},
+		{"198.19.0.1", ClassBenchmarking, "198.18.0.0/15"},
+		{"198.51.100.1", ClassDocumentation, "198.51.100.0/24"},
+		{"203.0.113.1", ClassDocumentation, "203.0.113.0/24"},
+		{"250.0.0.1", ClassReserved, "240.0.0.0/4"},
+		{"255.255.255.255", ClassBroadcast, "255.255.255.255/32"},
+		{"239.1.2.3", ClassMulticast, "224.0.0.0/4"},
+		{"8.8.8.8", ClassGlobal, ""},
+		{"::ffff:10.0.0.1", ClassPrivateUse, "10.0.0.0/8"},
+		{"::1", ClassLoopback, "::1/128"},
+		{"fd00::1", ClassUniqueLocal, "fc00::/7"},
+		{"fe80::1", ClassLinkLocal, "fe80::/10"},
+		{"::", ClassUnspecified, "::/128"},
+		{"2001:100::1", ClassProtocolAssignments, "2001::/23"},
+		{"2001:db8::1", ClassDocumentation, "2001:db8::/32"},
+		{"2001:2::1", ClassBenchmarking, "2001:2::/48"},
+		{"2001::1", ClassTeredo, "2001::/32"},
+		{"100::1", ClassDiscardOnly, "100::/64"},
+		{"ff02::1", ClassMulticast, "ff00::/8"},
+		{"2001:4860::8888", ClassGlobal, ""},
+	}
+	for _, test := range tests {
+		class, cidr := ClassifyIP(net.ParseIP(test.ip))
+		if class != test.class || cidr != test.cidr {
+			t.Errorf("ClassifyIP(%s) = %s %q, expected %s %q", test.ip, class, cidr, test.class, test.cidr)
+		}
+	}
+	// Zones are ignored
+	if class, cidr := ClassifyAddr(netip.MustParseAddr("fe80::1%eth0")); class != ClassLinkLocal || cidr != "fe80::/10" {
+		t.Errorf("ClassifyAddr of a zoned address answered %s %q", class, cidr)
+	}
+	if class, _ := ClassifyIP(nil); class != ClassInvalid {
+		t.Errorf("ClassifyIP(nil) = %s", class)
+	}
+	if class, _ := ClassifyIP(net.IP{1, 2, 3}); class != ClassInvalid {
+		t.Errorf("ClassifyIP of a malformed address = %s", class)
+	}
+	if IsLocalIP(net.ParseIP("224.0.0.1")) || IsLocalIP(net.ParseIP("ff02::1")) {
+		t.Error("IsLocalIP answered true for a multicast address")
+	}
+}
+
+var benchmarkIPs = []net.IP{
+	net.ParseIP("8.8.8.8"),
+	net.ParseIP("192.168.1.1").To4(),
+	net.ParseIP("203.0.113.7"),
+	net.ParseIP("2001:4860::8888"),
+	net.ParseIP("fe80::1"),
+	net.ParseIP("2a00:1450::1"),
+}
+
+func BenchmarkIsLocalIP(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		IsLocalIP(benchmarkIPs[i%len(benchmarkIPs)])
+	}
+}
+
+func BenchmarkIsLocalAddr(b *testing.B) {
+	addrs := make([]netip.Addr, len(benchmarkIPs))
+	for i, ip := range benchmarkIPs {
+		addrs[i], _ = netip.AddrFromSlice(ip)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		IsLocalAddr(addrs[i%len(addrs)])
+	}
+}
+
+// BenchmarkIsLocalIPScan is the linear scan IsLocalIP replaced.
+func BenchmarkIsLocalIPScan(b *testing.B) {
+	ipv4Nets, ipv6Nets := parseNets(specialIPv4CIDRs), parseNets(specialIPv6CIDRs)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		isLocalIPNets(benchmarkIPs[i%len(benchmarkIPs)], ipv4Nets, ipv6Nets)
+	}
+}
+
+// BenchmarkIsLocalIPParse parses CIDRs on every call,
+// as reported in profiles of older versions.
+func BenchmarkIsLocalIPParse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		isLocalIPNets(benchmarkIPs[i%len(benchmarkIPs)], parseNets(specialIPv4CIDRs), parseNets(specialIPv6CIDRs))
+	}
+}
+
+func TestFilterGlobal(t *testing.T) {
+	ips := testIPs()
+	var expectedGlobal, expectedLocal []net.IP
+	for _, ip := range ips {
+		if IsLocalIP(ip) {
+			expectedLocal = append(expectedLocal, ip)
+		} else {
+			expectedGlobal = append(expectedGlobal, ip)
+		}
+	}
+	if global := FilterGlobal(ips); !slices.EqualFunc(global, expectedGlobal, net.IP.Equal) {
+		t.Errorf("FilterGlobal kept %d addresses, expected %d", len(global), len(expectedGlobal))
+	}
+	var local []net.IP
+	ForEachLocal(ips, func(ip net.IP) {
+		local = append(local, ip)
+	})
+	if !slices.EqualFunc(local, expectedLocal, net.IP.Equal) {
+		t.Errorf("ForEachLocal called back with %d addresses, expected %d", len(local), len(expectedLocal))
+	}
+	if global := FilterGlobal(nil); global != nil {
+		t.Errorf("FilterGlobal(nil) = %v", global)
+	}
+	var n int
+	count := func(net.IP) { n++ }
+	if allocs := testing.AllocsPerRun(10, func() { ForEachLocal(ips, count) }); allocs != 0 {
+		t.Errorf("ForEachLocal allocated %.0f times", allocs)
+	}
+}
+
+func TestIsLocalIPString(t *testing.T) {
+	tests := []struct {
+		s     string
+		local bool
+	}{
+		{"8.8.8.8", false},
+		{"192.168.1.1", true},
+		{"::ffff:8.8.8.8", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:4860::8888", false},
+		{"fe80::1%eth0", true},
+		{"", true},
+		{"example.com", true},
+		{"1.2.3", true},
+		{"8.8.8.8/32", true},
+	}
+	for _, test := range tests {
+		if local := IsLocalIPString(test.s); local != test.local {
+			t.Errorf("IsLocalIPString(%q) = %t, expected %t", test.s, local, test.local)
+		}
+	}
+}
+
+func FuzzIsLocalIPString(f *testing.F) {
+	for _, s := range []string{"8.8.8.8", "10.0.0.1", "::1", "2001::f5ff:fffe", "fe80::1%eth0", "::ffff:1.2.3.4", "", "1.2.3.4.5", "\xff"} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s := string(b)
+		local := IsLocalIPString(s)
+		if ip := net.ParseIP(s); ip != nil && local != IsLocalIP(ip) {
+			t.Errorf("IsLocalIPString(%q) = %t, IsLocalIP answered %t", s, local, !local)
+		}
+		if _, err := netip.ParseAddr(s); err != nil && !local {
+			t.Errorf("IsLocalIPString(%q) of a malformed address = false", s)
+		}
+	})
+}
+
+// benchmarkBatch returns a batch of addresses, one in ten local.
+func benchmarkBatch() []net.IP {
+	r := rand.New(rand.NewSource(1))
+	ips := make([]net.IP, 10000)
+	for i := range ips {
+		ip := make(net.IP, net.IPv4len)
+		r.Read(ip)
+		if i%10 == 0 {
+			ip[0] = 10
+		}
+		ips[i] = ip
+	}
+	return ips
+}
+
+func BenchmarkFilterGlobal(b *testing.B) {
+	ips := benchmarkBatch()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FilterGlobal(ips)
+	}
+}
+
+// BenchmarkFilterGlobalLoop is FilterGlobal, by a loop over IsLocalIP.
+func BenchmarkFilterGlobalLoop(b *testing.B) {
+	ips := benchmarkBatch()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var global []net.IP
+		for _, ip := range ips {
+			if !IsLocalIP(ip) {
+				global = append(global, ip)
+			}
+		}
+	}
+}
+
+func BenchmarkForEachLocal(b *testing.B) {
+	ips := benchmarkBatch()
+	var n int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ForEachLocal(ips, func(net.IP) { n++ })
+	}
+}
+
+// BenchmarkForEachLocalLoop is ForEachLocal, by a loop over IsLocalIP.
+func BenchmarkForEachLocalLoop(b *testing.B) {
+	ips := benchmarkBatch()
+	var n int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, ip := range ips {
+			if IsLocalIP(ip) {
+				n++
+			}
+		}
+	}
+}
+
+func BenchmarkIsLocalIPString(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		IsLocalIPString("203.0.113.7")
+	}
+}
+
+// BenchmarkIsLocalIPStringParse is IsLocalIPString, parsing by net.ParseIP.
+func BenchmarkIsLocalIPStringParse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		ip := net.ParseIP("203.0.113.7")
+		if ip == nil || IsLocalIP(ip) {
+			continue
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package iputils
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// footnoteMarker matches the footnote markers of registry fields,
+// such as " [2]" in "192.0.0.0/24 [2]".
+var footnoteMarker = regexp.MustCompile(`\s*\[\d+\]`)
+
+// LoadIANARegistry parses an IANA Special-Purpose Address Registry,
+// IPv4 or IPv6, in the format of their CSV exports
+// (iana-ipv4-special-registry-1.csv and iana-ipv6-special-registry-1.csv).
+// Footnote markers are ignored, and rows of several address blocks split.
+//
+// Returns the CIDRs of the address blocks
+// whose Globally Reachable flag is False, in order,
+// to be passed to NewIPClassifierFromRegistry.
+func LoadIANARegistry(r io.Reader) ([]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty registry")
+	}
+	if err != nil {
+		return nil, err
+	}
+	blockColumn, globalColumn := -1, -1
+	for i, name := range header {
+		switch strings.TrimSpace(name) {
+		case "Address Block":
+			blockColumn = i
+		// Named Global in former versions of the registries
+		case "Globally Reachable", "Global":
+			globalColumn = i
+		}
+	}
+	if blockColumn < 0 || globalColumn < 0 {
+		return nil, errors.New("no Address Block or Globally Reachable column in registry")
+	}
+	var cidrs []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return cidrs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) <= max(blockColumn, globalColumn) {
+			return nil, fmt.Errorf("line %d: %d fields in registry row", line, len(record))
+		}
+		switch global := stripFootnotes(record[globalColumn]); global {
+		case "False":
+		// Deprecated blocks have no flags, and some blocks none applicable
+		case "True", "N/A", "":
+			continue
+		default:
+			return nil, fmt.Errorf("line %d: malformed Globally Reachable flag '%s'", line, global)
+		}
+		for _, block := range strings.Split(stripFootnotes(record[blockColumn]), ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(block))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: malformed address block: %w", line, err)
+			}
+			cidrs = append(cidrs, prefix.Masked().String())
+		}
+	}
+}
+
+// stripFootnotes removes the footnote markers of a registry field.
+func stripFootnotes(field string) string {
+	return strings.TrimSpace(footnoteMarker.ReplaceAllString(field, ""))
+}
+
+// NewIPClassifierFromRegistry returns a classifier deeming local
+// the IPv4 and IPv6 addresses of given CIDRs, such as those loaded
+// by LoadIANARegistry, instead of the registries built in the package.
+// Addresses are given the class of the built in range matching their CIDR,
+// or containing it, or else ClassSpecialPurpose.
+// Multicast addresses are classified as by NewIPClassifier.
+func NewIPClassifierFromRegistry(cidrs []string) (*IPClassifier, error) {
+	var ipv4, ipv6 []classPrefix
+	known := defaultClassifier.tables.Load()
+	seen := make(map[netip.Prefix]bool)
+	for _, cidr := range cidrs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		p = p.Masked()
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		prefixes, table := known.ipv6, &ipv6
+		if p.Addr().Is4() {
+			prefixes, table = known.ipv4, &ipv4
+		}
+		class := ClassSpecialPurpose
+		if containing := containingPrefix(prefixes, p); containing != nil && containing.class != ClassMulticast {
+			class = containing.class
+		}
+		*table = append(*table, classPrefix{prefix: p, class: class})
+	}
+	for _, p := range known.ipv4 {
+		if p.class == ClassMulticast {
+			ipv4 = append(ipv4, p)
+		}
+	}
+	for _, p := range known.ipv6 {
+		if p.class == ClassMulticast {
+			ipv6 = append(ipv6, p)
+		}
+	}
+	sortPrefixes(ipv4)
+	sortPrefixes(ipv6)
+	c := &IPClassifier{}
+	c.store(&classifierTables{ipv4: ipv4, ipv6: ipv6})
+	return c, nil
+}
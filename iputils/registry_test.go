@@ -0,0 +1,128 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package iputils
+
+import (
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// loadRegistry loads a registry of testdata.
+func loadRegistry(t *testing.T, name string) []string {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cidrs, err := LoadIANARegistry(f)
+	if err != nil {
+		t.Fatalf("LoadIANARegistry(%s) failed: %s", name, err)
+	}
+	return cidrs
+}
+
+func TestLoadIANARegistry(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs []string
+	}{
+		{"iana-ipv4-special-registry-1.csv", []string{
+			"0.0.0.0/8", "0.0.0.0/32", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+			"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.0.0.0/29", "192.0.0.8/32",
+			"192.0.0.170/32", "192.0.0.171/32", "192.0.2.0/24", "192.88.99.2/32", "192.168.0.0/16",
+			"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4", "255.255.255.255/32",
+		}},
+		{"iana-ipv6-special-registry-1.csv", []string{
+			"::1/128", "::/128", "::ffff:0.0.0.0/96", "64:ff9b:1::/48", "100::/64",
+			"2001::/23", "2001:2::/48", "2001:db8::/32", "3fff::/20", "5f00::/16",
+			"fc00::/7", "fe80::/10",
+		}},
+	}
+	for _, test := range tests {
+		if cidrs := loadRegistry(t, test.name); !slices.Equal(cidrs, test.cidrs) {
+			t.Errorf("LoadIANARegistry(%s) = %q, expected %q", test.name, cidrs, test.cidrs)
+		}
+	}
+	// Former Global column
+	cidrs, err := LoadIANARegistry(strings.NewReader("Address Block,Name,Global\n10.0.0.0/8,Private-Use,False\n"))
+	if err != nil || !slices.Equal(cidrs, []string{"10.0.0.0/8"}) {
+		t.Errorf("LoadIANARegistry of a Global column = %q %v", cidrs, err)
+	}
+	for _, registry := range []string{
+		"",
+		"Address Block,Name\n10.0.0.0/8,Private-Use\n",
+		"Address Block,Name,Globally Reachable\n10.0.0.0/8,Private-Use,Maybe\n",
+		"Address Block,Name,Globally Reachable\n10.0.0.0,Private-Use,False\n",
+		"Address Block,Name,Globally Reachable\n\"10.0.0.0/8, example\",Private-Use,False\n",
+		"Address Block,Name,Globally Reachable\n10.0.0.0/8,Private-Use\n",
+		"Address Block,Name,Globally Reachable\n\"10.0.0.0/8,Private-Use,False\n",
+	} {
+		if cidrs, err := LoadIANARegistry(strings.NewReader(registry)); err == nil {
+			t.Errorf("LoadIANARegistry(%q) = %q, expected an error", registry, cidrs)
+		}
+	}
+}
+
+func TestNewIPClassifierFromRegistry(t *testing.T) {
+	cidrs := append(loadRegistry(t, "iana-ipv4-special-registry-1.csv"), loadRegistry(t, "iana-ipv6-special-registry-1.csv")...)
+	c, err := NewIPClassifierFromRegistry(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr  string
+		class Class
+		cidr  string
+	}{
+		{"10.1.2.3", ClassPrivateUse, "10.0.0.0/8"},
+		{"0.0.0.0", ClassThisNetwork, "0.0.0.0/32"},
+		{"192.0.0.170", ClassProtocolAssignments, "192.0.0.170/32"},
+		// Globally reachable within a block that is not
+		{"192.0.0.9", ClassProtocolAssignments, "192.0.0.0/24"},
+		{"192.88.99.2", ClassSpecialPurpose, "192.88.99.2/32"},
+		{"192.88.99.1", ClassGlobal, ""},
+		{"224.0.0.1", ClassMulticast, "224.0.0.0/4"},
+		{"8.8.8.8", ClassGlobal, ""},
+		{"3fff::1", ClassSpecialPurpose, "3fff::/20"},
+		{"2001::1", ClassProtocolAssignments, "2001::/23"},
+		{"2002::1", ClassGlobal, ""},
+		{"fd00::1", ClassUniqueLocal, "fc00::/7"},
+		{"ff02::1", ClassMulticast, "ff00::/8"},
+	}
+	for _, test := range tests {
+		class, cidr := c.ClassifyAddr(netip.MustParseAddr(test.addr))
+		if class != test.class || cidr != test.cidr {
+			t.Errorf("ClassifyAddr(%s) = %s %q, expected %s %q", test.addr, class, cidr, test.class, test.cidr)
+		}
+	}
+	if _, err := NewIPClassifierFromRegistry([]string{"10.0.0.0/8", "example"}); err == nil {
+		t.Error("NewIPClassifierFromRegistry accepted a malformed CIDR")
+	}
+}
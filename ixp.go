@@ -0,0 +1,187 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const (
+	// peeringdbURL is the PeeringDB API endpoint.
+	peeringdbURL = "https://www.peeringdb.com/api"
+	// ixpRefreshInterval is the default refresh interval of IXP prefixes.
+	ixpRefreshInterval = time.Hour * 24
+)
+
+// WithIXPDetection enables detection of addresses
+// on Internet Exchange Point peering LANs,
+// which LookupIpInfo reports in IpInfo.IsIXP and IpInfo.IXPName.
+//
+// IXP prefixes are taken from PeeringDB (ix, ixlan and ixpfx objects)
+// and refreshed every refresh interval.
+// Parameter url overrides the PeeringDB API endpoint if not empty.
+// Pass zero refresh for the default interval (24 hours).
+func WithIXPDetection(url string, refresh time.Duration) Option {
+	return func(h *Handler) error {
+		if url == "" {
+			url = peeringdbURL
+		}
+		if refresh == 0 {
+			refresh = ixpRefreshInterval
+		}
+		client := h.newHTTPClient()
+		queries := h.queries
+		table := newPrefixTable[string](0)
+		h.ixps = newFeed(h.runs, "IXP prefixes", refresh, func(ctx context.Context) (*prefixTable[string], error) {
+			if err := fetchIXPrefixes(ctx, client, queries, url, table); err != nil {
+				return nil, err
+			}
+			return table, nil
+		})
+		return nil
+	}
+}
+
+// lookupIXP tells if an address is on an IXP peering LAN.
+//
+// Returns the IXP name and whether the address matched.
+func (h Handler) lookupIXP(addr netip.Addr) (string, bool) {
+	if h.ixps == nil {
+		return "", false
+	}
+	ixps := h.ixps.get()
+	if ixps == nil {
+		return "", false
+	}
+	_, name, ok := ixps.lookup(addr)
+	return name, ok
+}
+
+// PeeringDB objects, reduced to the fields we need.
+type (
+	peeringdbIX struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	peeringdbIXLan struct {
+		ID   int `json:"id"`
+		IXID int `json:"ix_id"`
+	}
+	peeringdbIXPfx struct {
+		IXLanID int    `json:"ixlan_id"`
+		Prefix  string `json:"prefix"`
+	}
+)
+
+// fetchIXPrefixes retrieves IXP peering LAN prefixes from PeeringDB
+// into a table of prefixes to IXP names.
+//
+// Answers go through the query cache queries, if not nil.
+func fetchIXPrefixes(ctx context.Context, client *http.Client, queries *QueryCache, url string, table *prefixTable[string]) error {
+	var (
+		ixs    []peeringdbIX
+		ixlans []peeringdbIXLan
+		ixpfxs []peeringdbIXPfx
+	)
+	if err := getPeeringdb(ctx, client, queries, url+"/ix", &ixs); err != nil {
+		return err
+	}
+	if err := getPeeringdb(ctx, client, queries, url+"/ixlan", &ixlans); err != nil {
+		return err
+	}
+	if err := getPeeringdb(ctx, client, queries, url+"/ixpfx", &ixpfxs); err != nil {
+		return err
+	}
+	_, err := table.update(streamIXPrefixes(ixs, ixlans, ixpfxs))
+	return err
+}
+
+// getPeeringdb retrieves a list of PeeringDB objects into data.
+func getPeeringdb(ctx context.Context, client *http.Client, queries *QueryCache, url string, data interface{}) error {
+	answer, err := queries.get(ctx, "peeringdb", url, func(ctx context.Context) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to GET '%s': %w", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET '%s' returned status %s", url, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	})
+	if err != nil {
+		return err
+	}
+	return decodePeeringdb(bytes.NewReader(answer), data)
+}
+
+// decodePeeringdb decodes the data member of a PeeringDB API answer.
+func decodePeeringdb(r io.Reader, data interface{}) error {
+	answer := struct {
+		Data interface{} `json:"data"`
+	}{data}
+	if err := json.NewDecoder(r).Decode(&answer); err != nil {
+		return fmt.Errorf("cannot decode PeeringDB answer: %w", err)
+	}
+	return nil
+}
+
+// streamIXPrefixes joins PeeringDB ixpfx objects with their IXP names.
+//
+// Returns a stream of prefixes to IXP names.
+func streamIXPrefixes(ixs []peeringdbIX, ixlans []peeringdbIXLan, ixpfxs []peeringdbIXPfx) prefixStream[string] {
+	names := make(map[int]string, len(ixs))
+	for _, ix := range ixs {
+		names[ix.ID] = ix.Name
+	}
+	lanNames := make(map[int]string, len(ixlans))
+	for _, lan := range ixlans {
+		lanNames[lan.ID] = names[lan.IXID]
+	}
+	return func(yield func(netip.Prefix, string) bool) error {
+		for _, pfx := range ixpfxs {
+			p, err := netip.ParsePrefix(pfx.Prefix)
+			if err != nil {
+				continue
+			}
+			if !yield(p, lanNames[pfx.IXLanID]) {
+				break
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIXPDetection(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.ServeFile(w, r, "testdata/peeringdb"+r.URL.Path+".json")
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	if err := WithIXPDetection(ts.URL, time.Hour)(&h); err != nil {
+		t.Fatalf("WithIXPDetection failed: %s", err)
+	}
+	tests := []struct {
+		ip   string
+		name string
+	}{
+		{"80.81.192.123", "DE-CIX Frankfurt"},
+		{"2001:7f8::1a27:5051:c09", "DE-CIX Frankfurt"},
+		{"80.249.209.1", "AMS-IX"},
+		{"::ffff:80.249.209.1", "AMS-IX"},
+		{"8.8.8.8", ""},
+		{"2001:7f8:2::1", ""},
+	}
+	for _, test := range tests {
+		name, ok := h.lookupIXP(netip.MustParseAddr(test.ip))
+		if name != test.name || ok != (test.name != "") {
+			t.Fatalf("lookupIXP(%s) returned '%s', %v", test.ip, name, ok)
+		}
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 PeeringDB requests, got %d", requests)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build cgo
+
+package geoipdb
+
+import (
+	"sync"
+
+	"github.com/abh/geoip"
+)
+
+// libGeoIP is an open libgeoip database, until closed.
+// Lookups are serialized, as libgeoip databases are not safe
+// for concurrent use by every libgeoip version.
+type libGeoIP struct {
+	// Serialized access to gi
+	sync.Mutex
+	// Database handle, nil once closed
+	gi *geoip.GeoIP
+}
+
+// GetName looks up the name of an IPv4 address,
+// empty once the database is closed.
+func (db *libGeoIP) GetName(ip string) (string, int) {
+	db.Lock()
+	defer db.Unlock()
+	if db.gi == nil {
+		return "", 0
+	}
+	return db.gi.GetName(ip)
+}
+
+// GetNameV6 looks up the name of an IPv6 address,
+// empty once the database is closed.
+func (db *libGeoIP) GetNameV6(ip string) (string, int) {
+	db.Lock()
+	defer db.Unlock()
+	if db.gi == nil {
+		return "", 0
+	}
+	return db.gi.GetNameV6(ip)
+}
+
+// replace replaces the database with another libgeoip one,
+// once lookups in progress are done.
+//
+// Returns whether the database was replaced:
+// closed databases, and other databases, are not.
+func (db *libGeoIP) replace(next geoipDB) bool {
+	n, ok := next.(*libGeoIP)
+	if !ok {
+		return false
+	}
+	n.Lock()
+	gi := n.gi
+	n.Unlock()
+	db.Lock()
+	defer db.Unlock()
+	if db.gi == nil || gi == nil {
+		return false
+	}
+	db.gi = gi
+	return true
+}
+
+// Close releases the database handle,
+// which libgeoip frees as soon as the garbage collector finds it unused.
+func (db *libGeoIP) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	db.gi = nil
+	return nil
+}
+
+// openLibGeoIP opens a libgeoip database file.
+func openLibGeoIP(path string) (geoipDB, error) {
+	gi, err := geoip.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &libGeoIP{gi: gi}, nil
+}
+
+// openLibGeoIPType opens the default libgeoip database of a given type.
+func openLibGeoIPType(dbType int) (geoipDB, error) {
+	gi, err := geoip.OpenType(dbType)
+	if err != nil {
+		return nil, err
+	}
+	return &libGeoIP{gi: gi}, nil
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"log/slog"
+)
+
+// WithLogger makes the handler log structured events to a logger:
+// at debug level, every query of a source by LookupAsn,
+// with its outcome, duration and error, if any;
+// at info level, every change of overrides (see OverridesSet).
+// IP addresses are redacted if the handler redacts them
+// (see WithRedactIPs).
+//
+// Handlers without logger log no such events.
+func WithLogger(l *slog.Logger) Option {
+	return func(h *Handler) error {
+		h.logger = l
+		return nil
+	}
+}
+
+// logOverride logs a change of overrides at info level,
+// if the handler has a logger.
+func (h Handler) logOverride(msg string, args ...any) {
+	if h.logger != nil {
+		h.logger.Info(msg, args...)
+	}
+}
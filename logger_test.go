@@ -0,0 +1,154 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogHandler is a slog.Handler recording log records,
+// as level, message and the given attributes.
+type recordingLogHandler struct {
+	mu      *sync.Mutex
+	keys    []string
+	attrs   []slog.Attr
+	records *[]string
+}
+
+func newRecordingLogHandler(keys ...string) *recordingLogHandler {
+	return &recordingLogHandler{mu: &sync.Mutex{}, keys: keys, records: new([]string)}
+}
+
+func (r *recordingLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (r *recordingLogHandler) Handle(_ context.Context, record slog.Record) error {
+	values := make(map[string]string)
+	for _, a := range r.attrs {
+		values[a.Key] = a.Value.String()
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		values[a.Key] = a.Value.String()
+		return true
+	})
+	line := record.Level.String() + " " + record.Message
+	for _, key := range r.keys {
+		if value, ok := values[key]; ok {
+			line += " " + key + "=" + value
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.records = append(*r.records, line)
+	return nil
+}
+
+func (r *recordingLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	with := *r
+	with.attrs = append(append([]slog.Attr(nil), r.attrs...), attrs...)
+	return &with
+}
+
+func (r *recordingLogHandler) WithGroup(string) slog.Handler {
+	return r
+}
+
+// take returns the records logged, and forgets them.
+func (r *recordingLogHandler) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records := *r.records
+	*r.records = nil
+	return records
+}
+
+func TestWithLogger(t *testing.T) {
+	zone := testDNSZone{
+		"8.8.8.8.origin.asn.cymru.com.": {`8.8.8.8.origin.asn.cymru.com. 60 IN TXT "15169 | 8.8.8.0/24 | US | arin | 2023-12-28"`},
+		"AS15169.asn.cymru.com.":        {`AS15169.asn.cymru.com. 60 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+	}
+	// ipinfo.io is down
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer ts.Close()
+	records := newRecordingLogHandler("ip", "source", "result", "asn", "descr", "error")
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	h.resolver.server = startTestDNS(t, zone.serve)
+	h.ipinfo.baseURL = ts.URL
+	for _, opt := range []Option{
+		WithAsnSources(BuiltinSource(SourceIpinfo), BuiltinSource(SourceCymru)),
+		WithLogger(slog.New(records)),
+	} {
+		if err := opt(&h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if asn, descr, err := h.LookupAsn("8.8.8.8"); err != nil || asn != "AS15169" || descr != "GOOGLE, US" {
+		t.Fatalf("LookupAsn answered %q %q %v", asn, descr, err)
+	}
+	failed := fmt.Sprintf("DEBUG source lookup ip=8.8.8.8 source=%s result=failed asn= descr= error=", SourceIpinfo)
+	logged := records.take()
+	if len(logged) != 3 || len(logged[0]) <= len(failed) || logged[0][:len(failed)] != failed {
+		t.Fatalf("logged %q, expected %q first", logged, failed)
+	}
+	expected := []string{
+		"DEBUG source lookup ip=8.8.8.8 source=cymru result=partial asn=AS15169 descr=",
+		"DEBUG source lookup ip=8.8.8.8 source=cymru result=found asn=AS15169 descr=GOOGLE, US",
+	}
+	if !reflect.DeepEqual(logged[1:], expected) {
+		t.Errorf("logged %q, expected %q", logged[1:], expected)
+	}
+
+	// Cache hits query no source
+	h.LookupAsn("8.8.8.8")
+	if logged := records.take(); len(logged) != 0 {
+		t.Errorf("logged %q on cache hit", logged)
+	}
+
+	if err := h.OverridesSetWithMeta("AS15169", "Google", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OverridesRemove("AS15169"); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"INFO override set asn=AS15169 descr=Google",
+		"INFO override removed asn=AS15169",
+	}
+	if logged := records.take(); !reflect.DeepEqual(logged, expected) {
+		t.Errorf("logged %q, expected %q", logged, expected)
+	}
+}
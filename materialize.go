@@ -0,0 +1,269 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// materializeRate is the default rate of MaterializeAsnNames resolutions.
+const materializeRate = 10
+
+// Format is an output format of tabular data.
+type Format string
+
+const (
+	// Tab separated values, with a header line
+	// (tabs and line breaks of names are replaced by spaces)
+	FormatTSV Format = "tsv"
+	// Comma separated values (RFC 4180), with a header line
+	FormatCSV Format = "csv"
+	// One JSON object per line
+	FormatJSONL Format = "jsonl"
+)
+
+// MaterializeOptions configures MaterializeAsnNames.
+type MaterializeOptions struct {
+	// ASNs to include besides those known to the handler
+	Asns []string
+	// Resume after this ASN, as given by MaterializeSummary.Cursor
+	// (the header line is then left out)
+	After string
+	// Maximum number of names resolved per second, zero for 10
+	Rate float64
+}
+
+// MaterializeSummary reports what MaterializeAsnNames wrote.
+type MaterializeSummary struct {
+	// Number of rows written
+	Rows int `json:"rows"`
+	// Rows whose name could not be resolved, written without name
+	Unresolved int `json:"unresolved"`
+	// Last ASN written, to resume from (see MaterializeOptions.After)
+	Cursor string `json:"cursor"`
+}
+
+// asnName is a row of MaterializeAsnNames.
+type asnName struct {
+	Asn        string    `json:"asn"`
+	Name       string    `json:"name"`
+	Source     string    `json:"source"`
+	ResolvedAt time.Time `json:"resolved_at,omitzero"`
+}
+
+// MaterializeAsnNames writes a table of ASNs and their current best names,
+// with columns asn, name, source and resolved_at,
+// for every ASN in the cache (see LookupAsn and WithPrefixCache),
+// in the overrides collection, and in opts.Asns.
+//
+// Names are taken from the overrides, then the cache,
+// and else resolved through Team Cymru at a bounded rate (see opts.Rate).
+// Rows are ordered by ASN number.
+//
+// If ctx expires, or writing fails, MaterializeAsnNames stops
+// and returns what it wrote so far, along with the error;
+// the export may resume after the cursor of the summary.
+//
+// Returns a summary of what was written.
+func (h Handler) MaterializeAsnNames(ctx context.Context, w io.Writer, format Format, opts MaterializeOptions) (MaterializeSummary, error) {
+	var summary MaterializeSummary
+	bw := bufio.NewWriter(w)
+	var write func(asnName) error
+	columns := []string{"asn", "name", "source", "resolved_at"}
+	header := func() error { return nil }
+	switch format {
+	case FormatTSV:
+		header = func() error {
+			_, err := fmt.Fprintln(bw, strings.Join(columns, "\t"))
+			return err
+		}
+		write = func(row asnName) error {
+			_, err := fmt.Fprintf(bw, "%s\t%s\t%s\t%s\n", row.Asn, tsvClean(row.Name), row.Source, formatResolvedAt(row.ResolvedAt))
+			return err
+		}
+	case FormatCSV:
+		cw := csv.NewWriter(bw)
+		header = func() error {
+			cw.Write(columns)
+			cw.Flush()
+			return cw.Error()
+		}
+		write = func(row asnName) error {
+			cw.Write([]string{row.Asn, row.Name, row.Source, formatResolvedAt(row.ResolvedAt)})
+			cw.Flush()
+			return cw.Error()
+		}
+	case FormatJSONL:
+		enc := json.NewEncoder(bw)
+		write = func(row asnName) error {
+			return enc.Encode(row)
+		}
+	default:
+		return summary, fmt.Errorf("unknown format '%s'", format)
+	}
+	// Names known without resolution
+	known := make(map[string]asnName)
+	for _, info := range h.prefixes.list() {
+		if info.Descr != "" {
+			known[info.Asn] = asnName{Asn: info.Asn, Name: info.Descr, Source: SourceCache}
+		}
+	}
+	if h.overrides != nil {
+		list, err := h.OverridesList()
+		if err != nil {
+			return summary, err
+		}
+		for _, o := range list {
+			known[o.Asn] = asnName{Asn: o.Asn, Name: o.Name, Source: SourceOverrides, ResolvedAt: o.UpdatedAt}
+		}
+	}
+	asns, err := h.materializedAsns(opts, known)
+	if err != nil {
+		return summary, err
+	}
+	if opts.After == "" {
+		if err := header(); err != nil {
+			return summary, err
+		}
+	}
+	rate := opts.Rate
+	if rate <= 0 {
+		rate = materializeRate
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	var last time.Time
+	for _, asn := range asns {
+		row, ok := known[asn]
+		if entry, found := h.cache.lookupASNEntry(asn); !ok && found && entry.descr != "" {
+			row, ok = asnName{Asn: asn, Name: entry.descr, Source: SourceCache, ResolvedAt: entry.due.Add(-entry.ttl)}, true
+		}
+		if !ok {
+			if wait := time.Until(last.Add(interval)); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+			if err := ctxErr(ctx); err != nil {
+				bw.Flush()
+				return summary, err
+			}
+			last = time.Now()
+			row = asnName{Asn: asn, Source: SourceCymru, ResolvedAt: last}
+			row.Name, _, err = h.cymru.lookupTTL(ctx, asn)
+			if err != nil {
+				if err := ctxErr(ctx); err != nil {
+					bw.Flush()
+					return summary, err
+				}
+				h.logf("warning: cymru lookup failed for asn '%s': %s\n", asn, err)
+				row = asnName{Asn: asn}
+				summary.Unresolved++
+			}
+		}
+		row.ResolvedAt = row.ResolvedAt.UTC().Truncate(time.Second)
+		if err := write(row); err != nil {
+			return summary, err
+		}
+		summary.Rows++
+		summary.Cursor = asn
+	}
+	return summary, bw.Flush()
+}
+
+// materializedAsns returns the ASNs of MaterializeAsnNames,
+// after the cursor, ordered by number.
+func (h Handler) materializedAsns(opts MaterializeOptions, known map[string]asnName) ([]string, error) {
+	var after uint64
+	if opts.After != "" {
+		var ok bool
+		if after, ok = asnNumber(opts.After); !ok {
+			return nil, MalformedAsnError
+		}
+	}
+	numbers := make(map[uint64]bool)
+	add := func(asn string) bool {
+		n, ok := asnNumber(asn)
+		if ok && (opts.After == "" || n > after) {
+			numbers[n] = true
+		}
+		return ok
+	}
+	for _, asn := range opts.Asns {
+		if !add(asn) {
+			return nil, MalformedAsnError
+		}
+	}
+	for _, asn := range h.cache.asnList() {
+		add(asn)
+	}
+	for asn := range known {
+		add(asn)
+	}
+	sorted := make([]uint64, 0, len(numbers))
+	for n := range numbers {
+		sorted = append(sorted, n)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	asns := make([]string, len(sorted))
+	for i, n := range sorted {
+		asns[i] = "AS" + strconv.FormatUint(n, 10)
+	}
+	return asns, nil
+}
+
+// asnNumber parses an ASN identification, such as "AS15169".
+//
+// Returns the ASN number, and whether it is well formed.
+func asnNumber(asn string) (uint64, bool) {
+	if !reASN.MatchString(asn) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(asn[2:], 10, 32)
+	return n, err == nil
+}
+
+// tsvClean replaces tabs and line breaks of TSV fields by spaces.
+func tsvClean(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(s)
+}
+
+// formatResolvedAt formats a resolution time, empty if unknown.
+func formatResolvedAt(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
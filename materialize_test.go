@@ -0,0 +1,120 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaterializeAsnNames(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, testCymruZone.serve)
+	h.cache.store("8.8.8.8", cacheEntry{asn: "AS15169", descr: "GOOGLE\tLLC"})
+	h.cache.store("192.0.2.1", cacheEntry{err: BogonIPError})
+	opts := MaterializeOptions{Asns: []string{"AS64500", "AS13335", "AS15169"}, Rate: 1000}
+	ctx := context.Background()
+	var out bytes.Buffer
+	summary, err := h.MaterializeAsnNames(ctx, &out, FormatTSV, opts)
+	if err != nil {
+		t.Fatalf("MaterializeAsnNames failed: %s", err)
+	}
+	if summary != (MaterializeSummary{Rows: 3, Unresolved: 1, Cursor: "AS64500"}) {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+	expected := [][]string{
+		{"asn", "name", "source", "resolved_at"},
+		{"AS13335", "CLOUDFLARENET, US", "cymru"},
+		{"AS15169", "GOOGLE LLC", "cache"},
+		{"AS64500", "", "", ""},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	for i, row := range rows {
+		if len(row) != 4 || !reflect.DeepEqual(row[:len(expected[i])], expected[i]) {
+			t.Fatalf("unexpected row %q", row)
+		}
+		if i == 1 || i == 2 {
+			if at, err := time.Parse(time.RFC3339, row[3]); err != nil || time.Since(at) > time.Minute {
+				t.Fatalf("unexpected resolution time %q", row[3])
+			}
+		}
+	}
+	// Resume after a cursor, as CSV
+	opts.After = "AS13335"
+	out.Reset()
+	summary, err = h.MaterializeAsnNames(ctx, &out, FormatCSV, opts)
+	if err != nil || summary.Rows != 2 {
+		t.Fatalf("resumed MaterializeAsnNames returned %+v, %v", summary, err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil || len(records) != 2 || records[0][0] != "AS15169" || records[0][1] != "GOOGLE\tLLC" {
+		t.Fatalf("unexpected CSV output %q, %v", records, err)
+	}
+	// JSON lines
+	opts.After = ""
+	out.Reset()
+	if _, err := h.MaterializeAsnNames(ctx, &out, FormatJSONL, opts); err != nil {
+		t.Fatalf("MaterializeAsnNames failed: %s", err)
+	}
+	dec := json.NewDecoder(&out)
+	var names []asnName
+	for dec.More() {
+		var row asnName
+		if err := dec.Decode(&row); err != nil {
+			t.Fatalf("malformed JSON line: %s", err)
+		}
+		names = append(names, row)
+	}
+	if len(names) != 3 || names[0].Source != SourceCymru || names[2].Name != "" || !names[2].ResolvedAt.IsZero() {
+		t.Fatalf("unexpected JSON lines %+v", names)
+	}
+	// Interrupted exports keep what they wrote
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	summary, err = h.MaterializeAsnNames(cctx, io.Discard, FormatJSONL, opts)
+	if err != context.Canceled || summary.Rows != 0 {
+		t.Fatalf("canceled MaterializeAsnNames returned %+v, %v", summary, err)
+	}
+	if _, err := h.MaterializeAsnNames(ctx, io.Discard, FormatJSONL, MaterializeOptions{Asns: []string{"15169"}}); err != MalformedAsnError {
+		t.Fatalf("unexpected error for a malformed ASN: %v", err)
+	}
+}
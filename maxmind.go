@@ -0,0 +1,431 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxmindURL is the default MaxMind download service
+	// (see MaxMindUpdates).
+	maxmindURL = "https://download.maxmind.com/app/geoip_download"
+	// maxmindEdition is the default MaxMind database edition.
+	maxmindEdition = "GeoLite2-ASN"
+	// maxmindInterval is the default time between MaxMind database updates.
+	maxmindInterval = time.Hour * 24
+)
+
+// MaxMindNoUpdatesError is returned by LastDatabaseUpdate and ForceUpdate
+// of handlers without MaxMind database updates (see WithMaxMindUpdates).
+var MaxMindNoUpdatesError = errors.New("no MaxMind database updates")
+
+// MaxMindChecksumError is returned when a downloaded MaxMind database
+// does not match the checksum published along.
+var MaxMindChecksumError = errors.New("MaxMind database checksum mismatch")
+
+// MaxMindUpdates configures the download of MaxMind databases
+// (see WithMaxMindUpdates).
+type MaxMindUpdates struct {
+	// LicenseKey of the MaxMind account downloading databases
+	LicenseKey string
+	// EditionID of the database, GeoLite2-ASN if empty
+	// (any edition with ASN records will do, such as GeoIP2-ISP)
+	EditionID string
+	// Dir is the working directory databases are downloaded to,
+	// as EditionID.mmdb
+	Dir string
+	// Interval between updates, a day if zero
+	Interval time.Duration
+	// URL of the download service, MaxMind's if empty
+	URL string
+}
+
+// WithMaxMindUpdates makes the handler use a MaxMind ASN database
+// kept up to date in a working directory:
+// the latest database is downloaded once Interval has elapsed
+// since the last update, by a lookup needing the database,
+// verified against its published checksum,
+// then swapped in without disturbing lookups in progress.
+// A failed update keeps the previous database,
+// logging the failure, and reporting it to the metrics sink, if any
+// (see WithMetrics, WithLogger, and LastDatabaseUpdate).
+//
+// The database of the working directory is used from start,
+// unless another one is given (see WithMMDB), which updates replace.
+// The database is downloaded when the handler is created
+// if the working directory has none, the option failing if it cannot.
+func WithMaxMindUpdates(cfg MaxMindUpdates) Option {
+	return func(h *Handler) error {
+		if h.offline {
+			return fmt.Errorf("%w: MaxMind database updates", OfflineModeError)
+		}
+		if cfg.LicenseKey == "" {
+			return fmt.Errorf("missing MaxMind license key")
+		}
+		if cfg.Dir == "" {
+			return fmt.Errorf("missing MaxMind working directory")
+		}
+		if cfg.Interval < 0 {
+			return fmt.Errorf("invalid MaxMind update interval %s", cfg.Interval)
+		}
+		if cfg.EditionID == "" {
+			cfg.EditionID = maxmindEdition
+		}
+		if cfg.Interval == 0 {
+			cfg.Interval = maxmindInterval
+		}
+		if cfg.URL == "" {
+			cfg.URL = maxmindURL
+		}
+		u := &maxmindUpdater{cfg: cfg, client: h.newHTTPClient()}
+		if h.mmdb == nil {
+			if _, err := os.Stat(u.path()); err == nil {
+				r, err := openMMDB(u.path())
+				if err != nil {
+					return err
+				}
+				h.mmdb = r
+				u.updated = fileModTime(u.path())
+				u.checked = u.updated
+				sum, _ := os.ReadFile(u.path() + ".sha256")
+				u.sum = strings.TrimSpace(string(sum))
+			}
+		}
+		if h.mmdb == nil {
+			r, err := u.download(h.runs.ctx)
+			if err != nil {
+				return fmt.Errorf("cannot download MaxMind database: %w", err)
+			}
+			h.mmdb = r
+		}
+		h.maxmind = u
+		return nil
+	}
+}
+
+// LastDatabaseUpdate returns when the MaxMind database in use
+// was downloaded, zero if unknown,
+// and the error of the last update attempt, if it failed
+// (see WithMaxMindUpdates).
+//
+// Returns MaxMindNoUpdatesError if updates are not enabled.
+func (h Handler) LastDatabaseUpdate() (time.Time, error) {
+	if h.maxmind == nil {
+		return time.Time{}, MaxMindNoUpdatesError
+	}
+	h.maxmind.Lock()
+	defer h.maxmind.Unlock()
+	return h.maxmind.updated, h.maxmind.err
+}
+
+// ForceUpdate updates the MaxMind database now,
+// regardless of the update interval (see WithMaxMindUpdates).
+// A database matching the checksum of the one in use
+// is not downloaded again.
+//
+// Returns MaxMindNoUpdatesError if updates are not enabled.
+func (h Handler) ForceUpdate(ctx context.Context) error {
+	if h.maxmind == nil {
+		return MaxMindNoUpdatesError
+	}
+	return h.updateMMDB(ctx)
+}
+
+// maxmindUpdater downloads MaxMind databases (see WithMaxMindUpdates).
+type maxmindUpdater struct {
+	cfg    MaxMindUpdates
+	client *http.Client
+	// Serialized updates
+	updates sync.Mutex
+	// Concurrent access control to fields below
+	sync.Mutex
+	// Checksum of the archive of the database in use, if known
+	sum string
+	// When the database in use was downloaded, and the last update attempt
+	updated time.Time
+	checked time.Time
+	// Error of the last update attempt, nil if it succeeded
+	err error
+	// Whether an update is in progress
+	updating bool
+}
+
+// path returns the path of the database in the working directory.
+func (u *maxmindUpdater) path() string {
+	return filepath.Join(u.cfg.Dir, u.cfg.EditionID+".mmdb")
+}
+
+// maybeUpdateMMDB updates the MaxMind database in the background,
+// if updates are enabled and the update interval has elapsed
+// since the last attempt, unless the handler is closed.
+func (h Handler) maybeUpdateMMDB() {
+	u := h.maxmind
+	if u == nil {
+		return
+	}
+	u.Lock()
+	if u.updating || time.Since(u.checked) < u.cfg.Interval {
+		u.Unlock()
+		return
+	}
+	u.updating = true
+	u.Unlock()
+	err := h.runs.run(func(ctx context.Context) {
+		h.updateMMDB(ctx)
+		u.Lock()
+		u.updating = false
+		u.Unlock()
+	})
+	if err != nil {
+		u.Lock()
+		u.updating = false
+		u.Unlock()
+	}
+}
+
+// updateMMDB downloads the latest MaxMind database, if new,
+// and swaps it in.
+// Failures are logged and reported to the metrics sink.
+func (h Handler) updateMMDB(ctx context.Context) error {
+	u := h.maxmind
+	u.updates.Lock()
+	defer u.updates.Unlock()
+	start := time.Now()
+	u.Lock()
+	u.checked = start
+	current := u.sum
+	u.Unlock()
+	outcome := "empty"
+	sum, err := u.checksum(ctx)
+	if err == nil && sum != current {
+		outcome = "found"
+		var next *mmdbReader
+		next, err = u.fetch(ctx, sum)
+		if err == nil {
+			err = h.mmdb.swap(next)
+		}
+	}
+	if err != nil {
+		outcome = "failed"
+		log.Printf("warning: MaxMind database update failed: %s\n", err)
+		if h.logger != nil {
+			h.logger.Warn("MaxMind database update failed", "edition", u.cfg.EditionID, "error", err.Error())
+		}
+	} else if outcome == "found" && h.logger != nil {
+		h.logger.Info("MaxMind database updated", "edition", u.cfg.EditionID)
+	}
+	if h.metrics != nil {
+		h.metrics.ObserveLookup(MetricsMaxMindUpdate, time.Since(start), outcome)
+	}
+	u.Lock()
+	defer u.Unlock()
+	u.err = err
+	if outcome == "found" {
+		u.sum, u.updated = sum, time.Now()
+	}
+	return err
+}
+
+// download downloads the latest database.
+func (u *maxmindUpdater) download(ctx context.Context) (*mmdbReader, error) {
+	sum, err := u.checksum(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := u.fetch(ctx, sum)
+	if err != nil {
+		return nil, err
+	}
+	u.sum, u.updated, u.checked = sum, time.Now(), time.Now()
+	return r, nil
+}
+
+// checksum returns the published SHA-256 checksum
+// of the latest database archive.
+func (u *maxmindUpdater) checksum(ctx context.Context) (string, error) {
+	body, err := u.get(ctx, "tar.gz.sha256")
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	// The checksum is followed by the archive name
+	line, err := io.ReadAll(io.LimitReader(body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("cannot read checksum: %s", u.redact(err))
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("malformed checksum")
+	}
+	sum := strings.ToLower(fields[0])
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("malformed checksum '%s'", fields[0])
+	}
+	return sum, nil
+}
+
+// fetch downloads the latest database archive,
+// checks it against a checksum,
+// and extracts its database to the working directory.
+//
+// Returns the database, opened.
+func (u *maxmindUpdater) fetch(ctx context.Context, sum string) (*mmdbReader, error) {
+	body, err := u.get(ctx, "tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if err := os.MkdirAll(u.cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create MaxMind working directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(u.cfg.Dir, "."+u.cfg.EditionID+"-*.mmdb")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create database file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	archive := io.TeeReader(body, hash)
+	err = extractMMDB(archive, u.cfg.EditionID+".mmdb", tmp)
+	if closeErr := tmp.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("cannot write database file: %s", closeErr)
+	}
+	if err != nil {
+		return nil, u.redact(err)
+	}
+	// Hash the whole archive
+	if _, err := io.Copy(io.Discard, archive); err != nil {
+		return nil, fmt.Errorf("cannot read archive: %s", u.redact(err))
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != sum {
+		return nil, MaxMindChecksumError
+	}
+	r, err := openMMDB(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	// Open databases survive the renaming of their file
+	if err := os.Rename(tmp.Name(), u.path()); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("cannot replace database file: %w", err)
+	}
+	r.path = u.path()
+	if err := os.WriteFile(u.path()+".sha256", []byte(sum+"\n"), 0644); err != nil {
+		log.Printf("warning: cannot save MaxMind database checksum: %s\n", err)
+	}
+	return r, nil
+}
+
+// get requests a file of the latest database from the download service,
+// by suffix.
+//
+// Returns the response body, to be closed.
+func (u *maxmindUpdater) get(ctx context.Context, suffix string) (io.ReadCloser, error) {
+	query := url.Values{
+		"edition_id":  {u.cfg.EditionID},
+		"license_key": {u.cfg.LicenseKey},
+		"suffix":      {suffix},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.cfg.URL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %s", u.redact(err))
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download %s: %s", suffix, u.redact(err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot download %s: HTTP status %s", suffix, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// redact returns an error without the license key,
+// part of request URLs.
+func (u *maxmindUpdater) redact(err error) error {
+	msg := err.Error()
+	if !strings.Contains(msg, u.cfg.LicenseKey) {
+		return err
+	}
+	return errors.New(strings.ReplaceAll(msg, u.cfg.LicenseKey, "REDACTED"))
+}
+
+// extractMMDB copies a database file out of a gzipped tar archive,
+// as MaxMind publishes them.
+func extractMMDB(archive io.Reader, name string, w io.Writer) error {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return fmt.Errorf("cannot decompress archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("no %s in archive", name)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Base(hdr.Name) != name {
+			continue
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return fmt.Errorf("cannot extract %s: %w", name, err)
+		}
+		// Read the end of the compressed stream, to hash it
+		if _, err := io.Copy(io.Discard, gz); err != nil {
+			return fmt.Errorf("cannot read archive: %w", err)
+		}
+		return nil
+	}
+}
+
+// fileModTime returns the modification time of a file,
+// zero if unknown.
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
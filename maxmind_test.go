@@ -0,0 +1,232 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// maxmindArchive returns a MaxMind style archive of a database file.
+func maxmindArchive(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"GeoLite2-ASN_20240101/LICENSE.txt", []byte("test license\n")},
+		{"GeoLite2-ASN_20240101/GeoLite2-ASN.mmdb", data},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// maxmindServer is a test MaxMind download service.
+type maxmindServer struct {
+	sync.Mutex
+	archive []byte
+	// Checksum served, that of archive if empty
+	sum string
+	// Status of responses, 200 if zero
+	status int
+	// Number of archives downloaded
+	downloads int
+}
+
+func (s *maxmindServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.URL.Query().Get("license_key") != "secret" || r.URL.Query().Get("edition_id") != "GeoLite2-ASN" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.status != 0 {
+		http.Error(w, "failure", s.status)
+		return
+	}
+	switch r.URL.Query().Get("suffix") {
+	case "tar.gz.sha256":
+		sum := s.sum
+		if sum == "" {
+			hash := sha256.Sum256(s.archive)
+			sum = hex.EncodeToString(hash[:])
+		}
+		fmt.Fprintf(w, "%s  GeoLite2-ASN_20240101.tar.gz\n", sum)
+	case "tar.gz":
+		s.downloads++
+		w.Write(s.archive)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *maxmindServer) set(f func(s *maxmindServer)) {
+	s.Lock()
+	defer s.Unlock()
+	f(s)
+}
+
+func TestMaxMindUpdates(t *testing.T) {
+	srv := &maxmindServer{archive: maxmindArchive(t, testMMDB)}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	dir := t.TempDir()
+	sink := &recordingSink{}
+	cfg := MaxMindUpdates{LicenseKey: "secret", Dir: dir, Interval: time.Hour, URL: ts.URL}
+	h, err := NewHandlerOpts(WithMetrics(sink), WithMaxMindUpdates(cfg))
+	if err != nil {
+		t.Fatalf("NewHandlerOpts failed: %s", err)
+	}
+	defer h.Close()
+	lookup := func(expected string) {
+		t.Helper()
+		if asn, _, err := h.mmdbLookup("8.8.8.8"); err != nil || asn != expected {
+			t.Fatalf("mmdbLookup answered %q %v, expected %s", asn, err, expected)
+		}
+	}
+	lookup("AS15169")
+	first, err := h.LastDatabaseUpdate()
+	if err != nil || time.Since(first) > time.Minute {
+		t.Fatalf("LastDatabaseUpdate answered %s %v after download", first, err)
+	}
+
+	// Up to date
+	if err := h.ForceUpdate(context.Background()); err != nil {
+		t.Fatalf("ForceUpdate failed: %s", err)
+	}
+	srv.set(func(s *maxmindServer) {
+		if s.downloads != 1 {
+			t.Fatalf("%d downloads of an unchanged database", s.downloads)
+		}
+	})
+
+	// New database, swapped in
+	srv.set(func(s *maxmindServer) { s.archive = maxmindArchive(t, "testdata/mmdb/GeoLite2-ASN-Test-Updated.mmdb") })
+	if err := h.ForceUpdate(context.Background()); err != nil {
+		t.Fatalf("ForceUpdate failed: %s", err)
+	}
+	lookup("AS64496")
+	updated, err := h.LastDatabaseUpdate()
+	if err != nil || !updated.After(first) {
+		t.Fatalf("LastDatabaseUpdate answered %s %v after update", updated, err)
+	}
+
+	// Failed updates keep the database
+	for _, fail := range []func(s *maxmindServer){
+		func(s *maxmindServer) { s.status = http.StatusInternalServerError },
+		func(s *maxmindServer) {
+			s.status, s.archive = 0, maxmindArchive(t, testMMDB)
+			s.sum = strings.Repeat("0", 64)
+		},
+		func(s *maxmindServer) { s.sum, s.archive = "", []byte("not an archive") },
+	} {
+		srv.set(fail)
+		err := h.ForceUpdate(context.Background())
+		if err == nil || strings.Contains(err.Error(), "secret") {
+			t.Fatalf("unexpected ForceUpdate error: %v", err)
+		}
+		lookup("AS64496")
+		if last, lastErr := h.LastDatabaseUpdate(); !last.Equal(updated) || lastErr == nil || lastErr.Error() != err.Error() {
+			t.Fatalf("LastDatabaseUpdate answered %s %v after failure %s", last, lastErr, err)
+		}
+	}
+	expected := []string{"maxmind_update empty", "maxmind_update found", "maxmind_update failed", "maxmind_update failed", "maxmind_update failed"}
+	if observations := sink.take(); strings.Join(observations, ",") != strings.Join(expected, ",") {
+		t.Errorf("observed %q, expected %q", observations, expected)
+	}
+
+	// Lookups update the database past the interval, in the background
+	srv.set(func(s *maxmindServer) { s.archive = maxmindArchive(t, testMMDB) })
+	h.maxmind.Lock()
+	h.maxmind.checked = time.Now().Add(-time.Hour)
+	h.maxmind.Unlock()
+	h.mmdbLookup("8.8.8.8")
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(10 * time.Millisecond) {
+		if asn, _, _ := h.mmdbLookup("8.8.8.8"); asn == "AS15169" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("database not updated in the background")
+		}
+	}
+	if _, err := h.LastDatabaseUpdate(); err != nil {
+		t.Fatalf("LastDatabaseUpdate failed after update: %s", err)
+	}
+
+	// The database of the working directory is used from start,
+	// and not downloaded again
+	srv.set(func(s *maxmindServer) { s.status = http.StatusInternalServerError })
+	h2, err := NewHandlerOpts(WithMaxMindUpdates(cfg))
+	if err != nil {
+		t.Fatalf("NewHandlerOpts failed with a database in the working directory: %s", err)
+	}
+	defer h2.Close()
+	if asn, _, err := h2.mmdbLookup("8.8.8.8"); err != nil || asn != "AS15169" {
+		t.Fatalf("mmdbLookup answered %q %v from the working directory", asn, err)
+	}
+	if err := h2.ForceUpdate(context.Background()); err == nil {
+		t.Fatalf("ForceUpdate succeeded with the download service failing")
+	}
+	// Without database, the download must succeed
+	cfg.Dir = filepath.Join(dir, "empty")
+	if _, err := NewHandlerOpts(WithMaxMindUpdates(cfg)); err == nil {
+		t.Fatalf("NewHandlerOpts succeeded without database")
+	}
+	if _, err := NewFixtureHandler().LastDatabaseUpdate(); err != MaxMindNoUpdatesError {
+		t.Fatalf("unexpected LastDatabaseUpdate error without updates: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"time"
+)
+
+// Operations observed by a MetricsSink, besides sources.
+const (
+	// MetricsLookupAsn is a whole LookupAsn lookup
+	// (also LookupAsnDetailed, LookupIpInfo...)
+	MetricsLookupAsn = "lookup_asn"
+	// MetricsLookupIp is a LookupIp lookup
+	MetricsLookupIp = "lookup_ip"
+	// MetricsMaxMindUpdate is an update of the MaxMind database
+	// (see WithMaxMindUpdates)
+	MetricsMaxMindUpdate = "maxmind_update"
+)
+
+// MetricsSink receives observations of lookups (see WithMetrics),
+// to be adapted to a metrics library, such as Prometheus histograms
+// labeled by source and outcome.
+// Its methods are called concurrently, and should not block.
+type MetricsSink interface {
+	// ObserveLookup observes a lookup by a source:
+	// SourceCache, with outcome "hit" or "miss" and zero duration;
+	// SourceCymru (every DNS query) or SourceIpinfo,
+	// with outcome "found", "empty" or "failed";
+	// a source skipped by its breaker (see WithSourceBreakers),
+	// with outcome "skipped" and zero duration;
+	// MetricsLookupAsn, with outcome "found" or "failed";
+	// MetricsLookupIp, with outcome "found" or "empty";
+	// MetricsMaxMindUpdate, with outcome "found" (database replaced),
+	// "empty" (database up to date) or "failed".
+	ObserveLookup(source string, duration time.Duration, outcome string)
+}
+
+// WithMetrics makes the handler report lookups to a sink.
+// Handlers without sink do not measure lookups.
+func WithMetrics(sink MetricsSink) Option {
+	return func(h *Handler) error {
+		h.metrics = sink
+		h.cymru.metrics = sink
+		return nil
+	}
+}
+
+// metricsOutcome returns the outcome of a lookup
+// which found something unless failing with err.
+func metricsOutcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "found"
+}
+
+// observeMetric observes an outcome of a source without duration,
+// such as cache hits.
+func (h Handler) observeMetric(source string, outcome string) {
+	if h.metrics != nil {
+		h.metrics.ObserveLookup(source, 0, outcome)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink is a MetricsSink recording observations.
+type recordingSink struct {
+	mu           sync.Mutex
+	observations []string
+}
+
+func (r *recordingSink) ObserveLookup(source string, duration time.Duration, outcome string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if duration < 0 || source == SourceCache && duration != 0 {
+		outcome += " (bad duration)"
+	}
+	r.observations = append(r.observations, source+" "+outcome)
+}
+
+// take returns the observations recorded, and forgets them.
+func (r *recordingSink) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	observations := r.observations
+	r.observations = nil
+	return observations
+}
+
+func TestWithMetrics(t *testing.T) {
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 60 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+		"AS3356.asn.cymru.com.":  {`AS3356.asn.cymru.com. 60 IN TXT "3356 | US | arin | 2000-03-10 | LEVEL3, US"`},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/8.8.8.8/org" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		// ASN without description
+		fmt.Fprintln(w, "AS15169")
+	}))
+	defer ts.Close()
+	sink := &recordingSink{}
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, zone.serve)
+	h.ipinfo.baseURL = ts.URL
+	for _, opt := range []Option{
+		WithAsnSources(BuiltinSource(SourceIpinfo), BuiltinSource(SourceCymru)),
+		WithMetrics(sink),
+	} {
+		if err := opt(&h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		lookup   func()
+		expected []string
+	}{
+		// ipinfo.io finds the ASN, cymru describes it
+		{func() { h.LookupAsn("8.8.8.8") },
+			[]string{"cache miss", "ipinfo found", "cymru found", "lookup_asn found"}},
+		{func() { h.LookupAsn("8.8.8.8") },
+			[]string{"cache hit", "lookup_asn found"}},
+		// Neither finds the ASN
+		{func() { h.LookupAsn("1.1.1.1") },
+			[]string{"cache miss", "ipinfo failed", "cymru empty", "lookup_asn failed"}},
+		{func() { h.LookupAsn("10.0.0.1") },
+			[]string{"lookup_asn failed"}},
+		{func() { h.LookupIp("AS15169") },
+			[]string{"lookup_ip found"}},
+		{func() { h.LookupIp("AS3356") },
+			[]string{"lookup_ip empty"}},
+		{func() { h.CymruDnsLookup("AS3356") },
+			[]string{"cymru found"}},
+	} {
+		test.lookup()
+		if observations := sink.take(); !reflect.DeepEqual(observations, test.expected) {
+			t.Errorf("observed %q, expected %q", observations, test.expected)
+		}
+	}
+}
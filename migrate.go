@@ -0,0 +1,246 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// overridesSchemaVersion is the schema version
+	// of the documents written to the overrides collection.
+	overridesSchemaVersion = 1
+	// overridesMigrationBatch is the number of documents
+	// OverridesMigrate upgrades at once.
+	overridesMigrationBatch = 100
+	// overridesMigrationPause is the pause between batches,
+	// bounding the load of OverridesMigrate on the database.
+	overridesMigrationPause = time.Millisecond * 100
+)
+
+// overridesMigration is a migration step of the overrides collection,
+// upgrading documents to a schema version from the previous one.
+type overridesMigration struct {
+	// Schema version of the upgraded documents
+	version int
+	// Name used in reports
+	name string
+	// Function upgrading a document in place
+	upgrade func(doc bson.M) error
+}
+
+// overridesMigrations lists the migration steps, by schema version.
+// Every schema change registers a step here
+// and bumps overridesSchemaVersion.
+var overridesMigrations = []overridesMigration{
+	{1, "versioning", migrateOverridesVersioning},
+}
+
+// migrateOverridesVersioning upgrades unversioned documents,
+// which predate schema versions, to version 1.
+// Their fields are valid as is.
+func migrateOverridesVersioning(doc bson.M) error {
+	if _, ok := doc["name"].(string); !ok {
+		return fmt.Errorf("override of %v has no name", doc["_id"])
+	}
+	return nil
+}
+
+// MigrationStepReport reports what a migration step did.
+type MigrationStepReport struct {
+	// Schema version of the upgraded documents
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	// Number of documents upgraded by the step
+	Touched int `json:"touched"`
+}
+
+// MigrationReport reports what OverridesMigrate did.
+type MigrationReport struct {
+	// Schema version documents are upgraded to
+	Version int `json:"version"`
+	// Steps run, in order
+	Steps []MigrationStepReport `json:"steps"`
+	// Number of documents upgraded
+	Upgraded int `json:"upgraded"`
+	// Number of documents changed by other writers meanwhile,
+	// left to them
+	Skipped int `json:"skipped"`
+}
+
+// migrationStore is the access of OverridesMigrate
+// to the overrides collection.
+type migrationStore struct {
+	// Returns up to n documents of an older schema version,
+	// of IDs greater than after, in ID order
+	outdated func(after string, n int) ([]bson.M, error)
+	// Replaces a document, unless its schema version changed meanwhile;
+	// returns whether it was replaced
+	replace func(doc bson.M, version int) (bool, error)
+}
+
+// OverridesMigrate upgrades the documents of the overrides collection
+// to the current schema version, in batches paced
+// so that it can run along production traffic.
+// Documents written by OverridesSet and OverridesImportHistorical
+// are always current.
+//
+// Migrating is idempotent: current documents are left alone,
+// so that an interrupted migration resumes where it stopped.
+//
+// Only MongoDB stores have schema versions (see NewHandler),
+// OverridesMigrate fails with OverridesUnsupportedError for other stores.
+//
+// Returns a report of the upgrades, up to the first failure if any.
+func (h Handler) OverridesMigrate(ctx context.Context) (MigrationReport, error) {
+	if h.overrides == nil {
+		return MigrationReport{Version: overridesSchemaVersion}, OverridesNilCollectionError
+	}
+	m, ok := h.overrides.(*mongoOverrides)
+	if !ok {
+		return MigrationReport{Version: overridesSchemaVersion}, OverridesUnsupportedError
+	}
+	return migrateOverrides(ctx, mgoMigrationStore(m.c), overridesMigrations, overridesMigrationPause)
+}
+
+// migrateOverrides runs migration steps over the outdated documents of a store,
+// pausing between batches.
+func migrateOverrides(ctx context.Context, store migrationStore, steps []overridesMigration, pause time.Duration) (MigrationReport, error) {
+	report := MigrationReport{Version: overridesSchemaVersion}
+	for _, step := range steps {
+		report.Steps = append(report.Steps, MigrationStepReport{Version: step.version, Name: step.name})
+	}
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		docs, err := store.outdated(after, overridesMigrationBatch)
+		if err != nil {
+			return report, fmt.Errorf("cannot retrieve outdated overrides: %w", err)
+		}
+		for _, doc := range docs {
+			id, _ := doc["_id"].(string)
+			after = id
+			version := overridesDocVersion(doc)
+			var touched []int
+			for i, step := range steps {
+				if step.version <= version {
+					continue
+				}
+				if err := step.upgrade(doc); err != nil {
+					return report, fmt.Errorf("migration to schema version %d failed: %w", step.version, err)
+				}
+				touched = append(touched, i)
+			}
+			doc["schema_version"] = overridesSchemaVersion
+			replaced, err := store.replace(doc, version)
+			if err != nil {
+				return report, fmt.Errorf("cannot upgrade override of %s: %w", id, err)
+			}
+			if !replaced {
+				report.Skipped++
+				continue
+			}
+			report.Upgraded++
+			for _, i := range touched {
+				report.Steps[i].Touched++
+			}
+		}
+		if len(docs) < overridesMigrationBatch {
+			return report, nil
+		}
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+}
+
+// overridesDocVersion returns the schema version of a document,
+// zero if unversioned.
+func overridesDocVersion(doc bson.M) int {
+	switch v := doc["schema_version"].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// overridesOutdatedQuery selects documents of an older schema version.
+var overridesOutdatedQuery = bson.M{"$or": []bson.M{
+	{"schema_version": bson.M{"$exists": false}},
+	{"schema_version": bson.M{"$lt": overridesSchemaVersion}},
+}}
+
+// mgoMigrationStore returns the migrationStore of a collection.
+func mgoMigrationStore(c *mgo.Collection) migrationStore {
+	return migrationStore{
+		outdated: func(after string, n int) ([]bson.M, error) {
+			query := bson.M{"$and": []bson.M{overridesOutdatedQuery, {"_id": bson.M{"$gt": after}}}}
+			var docs []bson.M
+			err := c.Find(query).Sort("_id").Limit(n).All(&docs)
+			return docs, err
+		},
+		replace: func(doc bson.M, version int) (bool, error) {
+			selector := bson.M{"_id": doc["_id"], "schema_version": version}
+			if version == 0 {
+				selector["schema_version"] = bson.M{"$exists": false}
+			}
+			err := c.Update(selector, doc)
+			if err == mgo.ErrNotFound {
+				return false, nil
+			}
+			return err == nil, err
+		},
+	}
+}
+
+// checkOverridesSchema warns if the overrides collection
+// holds documents of an older schema version (see OverridesMigrate).
+func checkOverridesSchema(c *mgo.Collection) {
+	s := c.Database.Session.Copy()
+	defer s.Close()
+	n, err := c.With(s).Find(overridesOutdatedQuery).Count()
+	if err != nil {
+		log.Printf("warning: cannot check schema of overrides: %s\n", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("warning: %d overrides older than schema version %d, run OverridesMigrate\n", n, overridesSchemaVersion)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memMigrationStore is an in-memory migrationStore.
+type memMigrationStore struct {
+	docs map[string]bson.M
+	// Number of documents upgraded by others, then by replace
+	concurrent int
+	replaced   int
+}
+
+func (m *memMigrationStore) store() migrationStore {
+	return migrationStore{
+		outdated: func(after string, n int) ([]bson.M, error) {
+			var ids []string
+			for id, doc := range m.docs {
+				if id > after && overridesDocVersion(doc) < overridesSchemaVersion {
+					ids = append(ids, id)
+				}
+			}
+			sort.Strings(ids)
+			var docs []bson.M
+			for _, id := range ids[:min(n, len(ids))] {
+				doc := bson.M{}
+				for k, v := range m.docs[id] {
+					doc[k] = v
+				}
+				docs = append(docs, doc)
+			}
+			return docs, nil
+		},
+		replace: func(doc bson.M, version int) (bool, error) {
+			id := doc["_id"].(string)
+			if m.concurrent > 0 {
+				// Upgraded by OverridesSet meanwhile
+				m.concurrent--
+				m.docs[id]["schema_version"] = overridesSchemaVersion
+			}
+			if overridesDocVersion(m.docs[id]) != version {
+				return false, nil
+			}
+			m.docs[id] = doc
+			m.replaced++
+			return true, nil
+		},
+	}
+}
+
+func TestMigrateOverridesVersioning(t *testing.T) {
+	doc := bson.M{"_id": "AS15169", "name": "GOOGLE"}
+	if err := migrateOverridesVersioning(doc); err != nil {
+		t.Fatalf("migrateOverridesVersioning failed: %s", err)
+	}
+	if !reflect.DeepEqual(doc, bson.M{"_id": "AS15169", "name": "GOOGLE"}) {
+		t.Fatalf("unexpected upgraded document %v", doc)
+	}
+	if err := migrateOverridesVersioning(bson.M{"_id": "AS15169"}); err == nil {
+		t.Fatalf("expected an error for a document without name")
+	}
+}
+
+func TestMigrateOverrides(t *testing.T) {
+	m := &memMigrationStore{docs: map[string]bson.M{}, concurrent: 1}
+	for i := 0; i < 250; i++ {
+		doc := bson.M{"_id": fmt.Sprintf("AS%d", 64500+i), "name": "TEST"}
+		if i%10 == 0 {
+			doc["schema_version"] = overridesSchemaVersion
+		}
+		m.docs[doc["_id"].(string)] = doc
+	}
+	// A second step, as a schema change would register
+	var upgraded []string
+	steps := append(append([]overridesMigration{}, overridesMigrations...), overridesMigration{overridesSchemaVersion + 1, "future", func(doc bson.M) error {
+		upgraded = append(upgraded, doc["_id"].(string))
+		return nil
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := migrateOverrides(ctx, m.store(), steps, 0); err != context.Canceled {
+		t.Fatalf("canceled migration returned %v", err)
+	}
+	report, err := migrateOverrides(context.Background(), m.store(), steps, 0)
+	if err != nil {
+		t.Fatalf("migrateOverrides failed: %s", err)
+	}
+	want := MigrationReport{
+		Version: overridesSchemaVersion,
+		Steps: []MigrationStepReport{
+			{Version: 1, Name: "versioning", Touched: 224},
+			{Version: overridesSchemaVersion + 1, Name: "future", Touched: 224},
+		},
+		Upgraded: 224,
+		Skipped:  1,
+	}
+	if !reflect.DeepEqual(report, want) || len(upgraded) != 225 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for id, doc := range m.docs {
+		if overridesDocVersion(doc) != overridesSchemaVersion || doc["name"] != "TEST" {
+			t.Fatalf("unexpected document %s: %v", id, doc)
+		}
+	}
+	// Idempotent
+	report, err = migrateOverrides(context.Background(), m.store(), overridesMigrations, 0)
+	if err != nil || report.Upgraded != 0 || report.Steps[0].Touched != 0 || m.replaced != 224 {
+		t.Fatalf("second migration returned %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// mmdbReader is an open GeoLite2 ASN database, until closed.
+type mmdbReader struct {
+	*maxminddb.Reader
+	// Database file
+	path string
+	// Concurrent access control to the reader, and whether it is closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// file returns the path of the database file.
+func (r *mmdbReader) file() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.path
+}
+
+// swap replaces the database with the one of another reader,
+// closing the previous one once lookups in progress are done.
+//
+// Returns HandlerClosedError, closing next, if the database is closed.
+func (r *mmdbReader) swap(next *mmdbReader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		next.Reader.Close()
+		return HandlerClosedError
+	}
+	prev := r.Reader
+	r.Reader, r.path = next.Reader, next.path
+	return prev.Close()
+}
+
+// close closes the database, once lookups in progress are done.
+// Closing a closed database does nothing.
+func (r *mmdbReader) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.Reader.Close()
+}
+
+// mmdbRecord is the ASN data of GeoLite2 ASN database records.
+type mmdbRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// WithMMDB makes the handler use a given GeoLite2 ASN database file (.mmdb),
+// for IPv4 and IPv6, instead of the libgeoip ones, which are not opened.
+// The database is read by a pure Go reader,
+// so that handlers built this way do not need cgo.
+// The file is checked when opened (see ValidateMMDBFile).
+//
+// LookupAsn answers the same ASN identification and description
+// from either database, under SourceMMDB rather than SourceGeoIP.
+func WithMMDB(path string) Option {
+	return func(h *Handler) error {
+		r, err := openMMDB(path)
+		if err != nil {
+			return err
+		}
+		h.mmdb = r
+		return nil
+	}
+}
+
+// ValidateMMDBFile checks that a file is a sound GeoLite2 ASN database,
+// with IPv6 addresses: its metadata, search tree and data are verified.
+//
+// Files meant to replace databases in use, such as downloaded updates,
+// should be checked before being moved in place.
+//
+// Returns a *CorruptDatabaseError if the file is corrupt.
+func ValidateMMDBFile(path string) error {
+	r, err := openMMDB(path)
+	if err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+// openMMDB opens a GeoLite2 ASN database file,
+// if it passes sanity checks.
+func openMMDB(path string) (*mmdbReader, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		var invalid maxminddb.InvalidDatabaseError
+		if errors.As(err, &invalid) {
+			return nil, &CorruptDatabaseError{Path: path, Reason: invalid.Error()}
+		}
+		return nil, fmt.Errorf("cannot open mmdb database: %w", err)
+	}
+	reason := ""
+	if r.Metadata.IPVersion != 6 {
+		reason = fmt.Sprintf("IPv%d database, expected IPv6", r.Metadata.IPVersion)
+	} else if err := r.Verify(); err != nil {
+		reason = err.Error()
+	}
+	if reason != "" {
+		r.Close()
+		return nil, &CorruptDatabaseError{Path: path, Reason: reason}
+	}
+	return &mmdbReader{Reader: r, path: path}, nil
+}
+
+// mmdbLookup queries the GeoLite2 ASN database for the ASN of a given ip address
+// (see WithMMDB).
+//
+// Returns
+// an ASN identification
+// and the corresponding description,
+// or a *CorruptDatabaseError on malformed records,
+// or HandlerClosedError once the handler is closed.
+func (h Handler) mmdbLookup(ip string) (string, string, error) {
+	ipAddr, _ := iputils.ParseIP(ip)
+	if ipAddr == nil || h.mmdb == nil {
+		return "", "", nil
+	}
+	h.maybeUpdateMMDB()
+	h.mmdb.mu.RLock()
+	defer h.mmdb.mu.RUnlock()
+	if h.mmdb.closed {
+		return "", "", HandlerClosedError
+	}
+	var record mmdbRecord
+	if err := h.mmdb.Lookup(ipAddr, &record); err != nil {
+		h.corrupt.Add(1)
+		return "", "", &CorruptDatabaseError{Path: h.mmdb.path, Reason: fmt.Sprintf("reading record of %s: %s", ip, err)}
+	}
+	if record.Number == 0 {
+		return "", "", nil
+	}
+	return "AS" + strconv.FormatUint(uint64(record.Number), 10), record.Organization, nil
+}
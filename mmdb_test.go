@@ -0,0 +1,114 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testMMDB = "testdata/mmdb/GeoLite2-ASN-Test.mmdb"
+
+func TestWithMMDB(t *testing.T) {
+	// libgeoip databases are not opened
+	defer func(dir string) { geoipDataDir = dir }(geoipDataDir)
+	geoipDataDir = t.TempDir()
+	h, err := NewHandlerWithStore(nil, time.Second, WithMMDB(testMMDB))
+	if err != nil {
+		t.Fatalf("NewHandlerWithStore failed: %s", err)
+	}
+	if h.geoip4 != nil || h.geoip6 != nil {
+		t.Fatalf("libgeoip databases opened along the mmdb one")
+	}
+	if sources := h.Sources(); !reflect.DeepEqual(sources, []string{SourceCache, SourceMMDB, SourceIpinfo, SourceCymru}) {
+		t.Fatalf("unexpected sources: %v", sources)
+	}
+	tests := []struct {
+		ip    string
+		asn   string
+		descr string
+	}{
+		{"8.8.8.8", "AS15169", "GOOGLE"},
+		{"1.1.1.1", "AS13335", "CLOUDFLARENET"},
+		{"2001:4860:4860::8888", "AS15169", "GOOGLE"},
+		{"2606:4700:4700::1111", "AS13335", "CLOUDFLARENET"},
+		{"::ffff:8.8.8.4", "AS15169", "GOOGLE"},
+		{"9.9.9.9", "", ""},
+		{"2620:fe::fe", "", ""},
+	}
+	ctx := context.Background()
+	local := WithSources(SourceCache, SourceMMDB)
+	for _, test := range tests {
+		info, err := h.LookupAsnDetailed(ctx, test.ip, local)
+		if test.asn == "" {
+			if err == nil {
+				t.Fatalf("LookupAsnDetailed(%s) found %s", test.ip, info.Asn)
+			}
+			continue
+		}
+		if err != nil || info.Asn != test.asn || info.Descr != test.descr || info.Source != SourceMMDB {
+			t.Fatalf("LookupAsnDetailed(%s) returned %+v, %v", test.ip, info, err)
+		}
+	}
+	if _, _, err := h.LookupAsnCtx(ctx, "8.8.8.8", WithSources(SourceGeoIP)); !errors.Is(err, SourceNotConfiguredError) {
+		t.Fatalf("unexpected error restricting to libgeoip: %v", err)
+	}
+}
+
+func TestValidateMMDBFile(t *testing.T) {
+	if err := ValidateMMDBFile(testMMDB); err != nil {
+		t.Fatalf("ValidateMMDBFile failed: %s", err)
+	}
+	b, err := os.ReadFile(testMMDB)
+	if err != nil {
+		t.Fatalf("cannot read database: %s", err)
+	}
+	// Truncated, and with a search tree pointing past the data section
+	truncated := filepath.Join(t.TempDir(), "truncated.mmdb")
+	if err := os.WriteFile(truncated, b[:len(b)/2], 0644); err != nil {
+		t.Fatalf("cannot write database: %s", err)
+	}
+	broken := filepath.Join(t.TempDir(), "broken.mmdb")
+	b[0] = 0xff
+	if err := os.WriteFile(broken, b, 0644); err != nil {
+		t.Fatalf("cannot write database: %s", err)
+	}
+	for _, path := range []string{truncated, broken, "testdata/geoip/GeoIPASNum.dat"} {
+		var corrupt *CorruptDatabaseError
+		if err := ValidateMMDBFile(path); !errors.As(err, &corrupt) {
+			t.Fatalf("unexpected ValidateMMDBFile(%s) answer: %v", path, err)
+		}
+		h := newHandler(nil, time.Second)
+		if err := WithMMDB(path)(&h); err == nil || h.mmdb != nil {
+			t.Fatalf("WithMMDB accepted %s", path)
+		}
+	}
+}
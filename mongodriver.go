@@ -0,0 +1,259 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// driverOverrides is the OverridesStore of a MongoDB collection
+// accessed with the official driver.
+type driverOverrides struct {
+	c *mongo.Collection
+	// Bound of every operation, if not zero
+	timeout time.Duration
+}
+
+// NewMongoDriverOverridesStore returns the OverridesStore of a MongoDB collection
+// accessed with the official driver, go.mongodb.org/mongo-driver,
+// to be passed to NewHandlerWithStore.
+// Unlike collections of gopkg.in/mgo.v2 (see NewHandler),
+// it supports recent MongoDB servers and authentication mechanisms,
+// but not OverridesMigrate.
+// Parameter timeout, if not zero, bounds every operation.
+//
+// Returns nil if the collection is nil.
+func NewMongoDriverOverridesStore(c *mongo.Collection, timeout time.Duration) OverridesStore {
+	if c == nil {
+		return nil
+	}
+	return &driverOverrides{c, timeout}
+}
+
+// context bounds ctx by the timeout of the store.
+func (d *driverOverrides) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.timeout)
+}
+
+// Get retrieves the override of an ASN,
+// within the timeout of the store and the deadline of ctx.
+func (d *driverOverrides) Get(ctx context.Context, asn string) (AsnOverride, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	var override AsnOverride
+	err := d.c.FindOne(ctx, bson.M{"_id": asn}).Decode(&override)
+	if err == mongo.ErrNoDocuments {
+		return AsnOverride{}, OverridesAsnNotFoundError
+	}
+	return override, err
+}
+
+// Set stores or updates the description of an ASN,
+// in a document of the current schema version.
+func (d *driverOverrides) Set(asn, name string) error {
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	update := bson.M{"$set": bson.M{"name": name, "schema_version": overridesSchemaVersion}}
+	_, err := d.c.UpdateOne(ctx, bson.M{"_id": asn}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// SetMeta stores or updates the description of an ASN, updated by author,
+// in a document of the current schema version.
+func (d *driverOverrides) SetMeta(asn, name, author string, at time.Time) error {
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	update := bson.M{
+		"$set":         bson.M{"name": name, "updated_at": at, "updated_by": author, "schema_version": overridesSchemaVersion},
+		"$setOnInsert": bson.M{"created_at": at},
+	}
+	_, err := d.c.UpdateOne(ctx, bson.M{"_id": asn}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// Remove removes the override of an ASN, if any.
+func (d *driverOverrides) Remove(asn string) error {
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	_, err := d.c.DeleteOne(ctx, bson.M{"_id": asn})
+	return err
+}
+
+// List retrieves all overrides.
+func (d *driverOverrides) List() ([]AsnOverride, error) {
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	cursor, err := d.c.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var answer []AsnOverride
+	err = cursor.All(ctx, &answer)
+	return answer, err
+}
+
+// Count answers the number of overrides.
+func (d *driverOverrides) Count() (int, error) {
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	n, err := d.c.CountDocuments(ctx, bson.M{})
+	return int(n), err
+}
+
+// Search retrieves the overrides whose description contains query,
+// matched by a case insensitive regular expression.
+// ASNs are sorted by number, which the collection cannot do,
+// so every match is retrieved before paging.
+func (d *driverOverrides) Search(query string, limit, offset int) ([]AsnOverride, error) {
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	filter := bson.M{}
+	if query != "" {
+		filter = bson.M{"name": bson.M{"$regex": regexp.QuoteMeta(query), "$options": "i"}}
+	}
+	cursor, err := d.c.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var answer []AsnOverride
+	if err := cursor.All(ctx, &answer); err != nil {
+		return nil, err
+	}
+	return searchOverrides(answer, "", limit, offset), nil
+}
+
+// SetMany stores or updates the descriptions of many ASNs,
+// in a single unordered bulk write.
+func (d *driverOverrides) SetMany(overrides []AsnOverride) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	models := make([]mongo.WriteModel, 0, len(overrides))
+	for _, o := range overrides {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": o.Asn}).
+			SetUpdate(bson.M{"$set": bson.M{"name": o.Name, "schema_version": overridesSchemaVersion}}).
+			SetUpsert(true))
+	}
+	_, err := d.c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// RemoveMany removes the overrides of many ASNs, if any.
+func (d *driverOverrides) RemoveMany(asns []string) error {
+	if len(asns) == 0 {
+		return nil
+	}
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	_, err := d.c.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": asns}})
+	return err
+}
+
+// Import stores or replaces an override verbatim,
+// in a document of the current schema version.
+func (d *driverOverrides) Import(o AsnOverride) error {
+	ctx, cancel := d.context(context.Background())
+	defer cancel()
+	doc := versionedOverride{o, overridesSchemaVersion}
+	_, err := d.c.ReplaceOne(ctx, bson.M{"_id": o.Asn}, doc, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Ping checks that the MongoDB server is reachable,
+// within the deadline of ctx.
+func (d *driverOverrides) Ping(ctx context.Context) error {
+	return d.c.Database().Client().Ping(ctx, nil)
+}
+
+// driverSubscriber is the OverridesSubscriber
+// of the change stream of a MongoDB collection.
+type driverSubscriber struct {
+	c *mongo.Collection
+}
+
+// NewMongoDriverOverridesSubscriber returns the OverridesSubscriber
+// of the change stream of a MongoDB collection of overrides
+// accessed with the official driver (see NewMongoDriverOverridesStore),
+// to be passed to WithOverridesSubscriber.
+// Changes are announced by the collection itself,
+// which must belong to a replica set or sharded cluster.
+//
+// Returns nil if the collection is nil.
+func NewMongoDriverOverridesSubscriber(c *mongo.Collection) OverridesSubscriber {
+	if c == nil {
+		return nil
+	}
+	return &driverSubscriber{c}
+}
+
+// Publish does nothing: the change stream announces writes.
+func (d *driverSubscriber) Publish(ctx context.Context, asn string) error {
+	return nil
+}
+
+// Subscribe calls fn with the ASNs of the documents changed,
+// or an empty ASN when the collection is dropped or renamed,
+// until ctx is done or the change stream fails.
+func (d *driverSubscriber) Subscribe(ctx context.Context, fn func(asn string)) error {
+	stream, err := d.c.Watch(ctx, mongo.Pipeline{})
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	for stream.Next(ctx) {
+		var event struct {
+			OperationType string `bson:"operationType"`
+			DocumentKey   struct {
+				ID string `bson:"_id"`
+			} `bson:"documentKey"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			return err
+		}
+		switch event.OperationType {
+		case "insert", "update", "replace", "delete":
+			fn(event.DocumentKey.ID)
+		default:
+			fn("")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return stream.Err()
+}
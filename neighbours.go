@@ -0,0 +1,365 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ripestatURL is the RIPEstat data API endpoint.
+	ripestatURL = "https://stat.ripe.net/data"
+	// neighboursCacheTTL is the expiration time of a neighbours cache entry.
+	neighboursCacheTTL = time.Hour * 6
+	// neighboursNegativeCacheTTL is the expiration time
+	// of a neighbours cache entry for an unknown ASN.
+	neighboursNegativeCacheTTL = time.Hour
+)
+
+// NeighboursNotFoundError is returned by LookupAsnNeighbours
+// when RIPEstat knows no neighbour of an ASN,
+// which is usually unknown or not announced.
+var NeighboursNotFoundError = newClassError("ASN neighbours not found", NotFoundError)
+
+// Neighbour is an ASN adjacent to another in BGP AS paths.
+type Neighbour struct {
+	Asn string `json:"asn"`
+	// Power is the number of distinct AS paths
+	// in which the adjacency was seen.
+	Power int `json:"power"`
+	// Number of RIS peers seeing the adjacency, by address family
+	V4Peers int `json:"v4_peers"`
+	V6Peers int `json:"v6_peers"`
+}
+
+// Neighbours are the BGP neighbours of an ASN,
+// as seen by RIPE RIS collectors.
+type Neighbours struct {
+	Asn string `json:"asn"`
+	// Left neighbours precede the ASN in AS paths (upstreams, transit providers),
+	// right neighbours follow it (downstreams, customers).
+	// Both are sorted by decreasing power.
+	Left  []Neighbour `json:"left"`
+	Right []Neighbour `json:"right"`
+	// Numbers of neighbours by side,
+	// not limited by WithTopNeighbours.
+	// Uncertain neighbours are not listed.
+	LeftCount      int `json:"left_count"`
+	RightCount     int `json:"right_count"`
+	UncertainCount int `json:"uncertain_count"`
+}
+
+// WithTopNeighbours makes LookupAsnNeighbours return
+// only the n most powerful neighbours of each side.
+func WithTopNeighbours(n int) LookupOption {
+	return func(cfg *lookupConfig) {
+		cfg.topNeighbours = n
+	}
+}
+
+// LookupAsnNeighbours queries RIPEstat for the neighbours of a given ASN.
+//
+// Answers, including unknown ASNs, are cached.
+//
+// Returns the neighbours of the ASN,
+// or NeighboursNotFoundError if RIPEstat knows none.
+func (h Handler) LookupAsnNeighbours(ctx context.Context, asn string, opts ...LookupOption) (Neighbours, error) {
+	asn, err := canonicalASN(asn)
+	if err != nil {
+		return Neighbours{}, err
+	}
+	cfg := newLookupConfig(opts)
+	if cfg.topNeighbours < 0 {
+		cfg.topNeighbours = 0
+	}
+	key := neighboursKey{asn, cfg.topNeighbours}
+	if entry, found := h.neighbours.lookup(key); found {
+		return entry.neighbours, entry.err
+	}
+	neighbours, err := h.fetchNeighbours(ctx, asn, cfg.topNeighbours)
+	if err == nil || err == NeighboursNotFoundError {
+		h.neighbours.store(key, neighbours, err)
+	}
+	return neighbours, err
+}
+
+// fetchNeighbours retrieves the neighbours of an ASN from RIPEstat,
+// keeping the top most powerful ones of each side if top is not zero.
+func (h Handler) fetchNeighbours(ctx context.Context, asn string, top int) (Neighbours, error) {
+	client := h.newHTTPClient()
+	u := h.ripestat + "/asn-neighbours/data.json?resource=" + url.QueryEscape(asn)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return Neighbours{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return Neighbours{}, err
+		}
+		return Neighbours{}, fmt.Errorf("failed to GET '%s': %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Neighbours{}, fmt.Errorf("GET '%s' returned status %s", u, resp.Status)
+	}
+	neighbours, err := parseNeighbours(resp.Body, top)
+	if err != nil {
+		return Neighbours{}, err
+	}
+	neighbours.Asn = asn
+	if neighbours.LeftCount+neighbours.RightCount+neighbours.UncertainCount == 0 {
+		return Neighbours{}, NeighboursNotFoundError
+	}
+	return neighbours, nil
+}
+
+// ripestatNeighbour is a neighbour in a RIPEstat asn-neighbours answer.
+type ripestatNeighbour struct {
+	Asn     int    `json:"asn"`
+	Type    string `json:"type"`
+	Power   int    `json:"power"`
+	V4Peers int    `json:"v4_peers"`
+	V6Peers int    `json:"v6_peers"`
+}
+
+// parseNeighbours parses a RIPEstat asn-neighbours answer,
+// keeping the top most powerful neighbours of each side if top is not zero.
+//
+// The neighbours array is decoded one element at a time,
+// so that large networks do not take their whole answer in memory.
+func parseNeighbours(r io.Reader, top int) (Neighbours, error) {
+	var (
+		neighbours Neighbours
+		status     string
+	)
+	dec := json.NewDecoder(r)
+	err := walkObject(dec, func(key string) error {
+		switch key {
+		case "status":
+			return dec.Decode(&status)
+		case "data":
+			return walkObject(dec, func(key string) error {
+				switch key {
+				case "neighbour_counts":
+					var counts struct {
+						Left      int `json:"left"`
+						Right     int `json:"right"`
+						Uncertain int `json:"uncertain"`
+					}
+					if err := dec.Decode(&counts); err != nil {
+						return err
+					}
+					neighbours.LeftCount = counts.Left
+					neighbours.RightCount = counts.Right
+					neighbours.UncertainCount = counts.Uncertain
+					return nil
+				case "neighbours":
+					return walkArray(dec, func() error {
+						var n ripestatNeighbour
+						if err := dec.Decode(&n); err != nil {
+							return err
+						}
+						neighbour := Neighbour{
+							Asn:     "AS" + strconv.Itoa(n.Asn),
+							Power:   n.Power,
+							V4Peers: n.V4Peers,
+							V6Peers: n.V6Peers,
+						}
+						switch n.Type {
+						case "left":
+							neighbours.Left = keepTop(append(neighbours.Left, neighbour), top)
+						case "right":
+							neighbours.Right = keepTop(append(neighbours.Right, neighbour), top)
+						}
+						return nil
+					})
+				}
+				return skipValue(dec)
+			})
+		}
+		return skipValue(dec)
+	})
+	if err != nil {
+		return Neighbours{}, fmt.Errorf("cannot decode RIPEstat answer: %w", err)
+	}
+	if status != "ok" {
+		return Neighbours{}, fmt.Errorf("RIPEstat answered with status '%s'", status)
+	}
+	sortNeighbours(neighbours.Left)
+	sortNeighbours(neighbours.Right)
+	neighbours.Left = truncateNeighbours(neighbours.Left, top)
+	neighbours.Right = truncateNeighbours(neighbours.Right, top)
+	return neighbours, nil
+}
+
+// keepTop bounds a growing list of neighbours to twice top,
+// dropping the least powerful ones.
+func keepTop(neighbours []Neighbour, top int) []Neighbour {
+	if top == 0 || len(neighbours) < 2*top {
+		return neighbours
+	}
+	sortNeighbours(neighbours)
+	return neighbours[:top]
+}
+
+// sortNeighbours sorts neighbours by decreasing power, then ASN.
+func sortNeighbours(neighbours []Neighbour) {
+	sort.Slice(neighbours, func(i, j int) bool {
+		if neighbours[i].Power != neighbours[j].Power {
+			return neighbours[i].Power > neighbours[j].Power
+		}
+		return neighbours[i].Asn < neighbours[j].Asn
+	})
+}
+
+// truncateNeighbours keeps the top first neighbours, if top is not zero.
+func truncateNeighbours(neighbours []Neighbour, top int) []Neighbour {
+	if top == 0 || len(neighbours) <= top {
+		return neighbours
+	}
+	return neighbours[:top]
+}
+
+// walkObject reads a JSON object from dec,
+// calling fn to read the value of each key.
+func walkObject(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected object key %v", tok)
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// walkArray reads a JSON array from dec,
+// calling fn to read each element.
+func walkArray(dec *json.Decoder, fn func() error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// expectDelim reads a given JSON delimiter from dec.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected '%s', got %v", delim, tok)
+	}
+	return nil
+}
+
+// skipValue reads and discards a JSON value from dec.
+func skipValue(dec *json.Decoder) error {
+	var v json.RawMessage
+	return dec.Decode(&v)
+}
+
+// neighboursKey identifies a neighbours lookup.
+type neighboursKey struct {
+	asn string
+	top int
+}
+
+// neighboursCache is a cache of RIPEstat neighbours answers.
+type neighboursCache struct {
+	*sync.RWMutex
+	entries map[neighboursKey]neighboursCacheEntry
+}
+
+// neighboursCacheEntry is a cached neighbours answer.
+type neighboursCacheEntry struct {
+	neighbours Neighbours
+	err        error
+	due        time.Time
+}
+
+// newNeighboursCache returns an empty initialized neighboursCache.
+func newNeighboursCache() neighboursCache {
+	return neighboursCache{
+		RWMutex: &sync.RWMutex{},
+		entries: make(map[neighboursKey]neighboursCacheEntry),
+	}
+}
+
+// store caches a neighbours answer.
+func (c neighboursCache) store(key neighboursKey, neighbours Neighbours, err error) {
+	ttl := neighboursCacheTTL
+	if err != nil {
+		ttl = neighboursNegativeCacheTTL
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = neighboursCacheEntry{
+		neighbours: neighbours,
+		err:        err,
+		due:        time.Now().Add(ttl),
+	}
+}
+
+// lookup retrieves a non expired neighbours answer.
+//
+// Returns the cached entry and whether the key was found in cache.
+func (c neighboursCache) lookup(key neighboursKey) (neighboursCacheEntry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.due) {
+		return neighboursCacheEntry{}, false
+	}
+	return entry, true
+}
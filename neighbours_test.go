@@ -0,0 +1,107 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLookupAsnNeighbours(t *testing.T) {
+	var queries int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		if r.URL.Path != "/asn-neighbours/data.json" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Query().Get("resource") {
+		case "AS64500":
+			http.ServeFile(w, r, "testdata/ripestat/asn-neighbours.json")
+		default:
+			http.ServeFile(w, r, "testdata/ripestat/asn-neighbours-unknown.json")
+		}
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	h.ripestat = ts.URL
+	ctx := context.Background()
+	expected := Neighbours{
+		Asn: "AS64500",
+		Left: []Neighbour{
+			{"AS3356", 250, 310, 180},
+			{"AS1299", 120, 300, 200},
+			{"AS174", 90, 150, 100},
+		},
+		Right: []Neighbour{
+			{"AS64512", 7, 12, 3},
+			{"AS64510", 4, 10, 0},
+		},
+		LeftCount:      3,
+		RightCount:     2,
+		UncertainCount: 1,
+	}
+	for i := 0; i < 2; i++ {
+		neighbours, err := h.LookupAsnNeighbours(ctx, "AS64500")
+		if err != nil {
+			t.Fatalf("LookupAsnNeighbours failed: %s", err)
+		}
+		if !reflect.DeepEqual(neighbours, expected) {
+			t.Fatalf("unexpected neighbours: %+v", neighbours)
+		}
+	}
+	if q := atomic.LoadInt32(&queries); q != 1 {
+		t.Fatalf("expected 1 query, got %d", q)
+	}
+	// Top N, counts are not limited
+	neighbours, err := h.LookupAsnNeighbours(ctx, "AS64500", WithTopNeighbours(1))
+	if err != nil {
+		t.Fatalf("LookupAsnNeighbours failed: %s", err)
+	}
+	expected.Left = expected.Left[:1]
+	expected.Right = expected.Right[:1]
+	if !reflect.DeepEqual(neighbours, expected) {
+		t.Fatalf("unexpected top neighbours: %+v", neighbours)
+	}
+	// Unknown ASNs are not found, and negatively cached
+	atomic.StoreInt32(&queries, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := h.LookupAsnNeighbours(ctx, "AS64499"); err != NeighboursNotFoundError {
+			t.Fatalf("unexpected LookupAsnNeighbours error: %v", err)
+		}
+	}
+	if q := atomic.LoadInt32(&queries); q != 1 {
+		t.Fatalf("expected 1 query, got %d", q)
+	}
+	if _, err := h.LookupAsnNeighbours(ctx, "ASN64500"); err != MalformedAsnError {
+		t.Fatalf("unexpected LookupAsnNeighbours error: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// OfflineModeError is returned by features
+// that need network services other than the overrides store,
+// such as ipinfo.io and Team Cymru,
+// when offline mode is enabled (see WithOfflineMode).
+var OfflineModeError = errors.New("unavailable in offline mode")
+
+// WithOfflineMode enables offline mode:
+// the handler never reaches network services,
+// but the overrides store (see NewHandlerWithStore).
+// LookupAsn consults the overrides, the cache and the local ASN database only,
+// and LookupIp, which searches the cache, is unaffected.
+// Features querying ipinfo.io or Team Cymru,
+// such as IpInfoLookup or CymruDnsLookup, fail with OfflineModeError,
+// and those of other network services, such as PeeringDbLookup,
+// LookupPTR or the feeds of WithBogons, fail without sending anything.
+//
+// Network sources are then refused by WithAsnSources,
+// as well as database updates (see WithMaxMindUpdates).
+// AsnSources and annotators given by the caller are still consulted,
+// offline mode being up to them.
+// Options applied before keep their network access,
+// so WithOfflineMode should come first.
+// Derived handlers are offline if their parent is (see Derive).
+func WithOfflineMode() Option {
+	return func(h *Handler) error {
+		if h.tenant != "" {
+			return fmt.Errorf("derived handlers share the network access of their parent")
+		}
+		for _, s := range h.asnSources {
+			if isNetworkSource(s) {
+				return fmt.Errorf("%w: ASN source '%s'", OfflineModeError, s.Name())
+			}
+		}
+		if h.maxmind != nil {
+			return fmt.Errorf("%w: MaxMind database updates", OfflineModeError)
+		}
+		h.offline = true
+		// The resolver is shared with derived handlers
+		h.resolver.offline.Store(true)
+		return nil
+	}
+}
+
+// Offline tells whether offline mode is enabled (see WithOfflineMode).
+func (h Handler) Offline() bool {
+	return h.offline
+}
+
+// isNetworkSource tells whether an ASN source is a network service
+// implemented by the handler.
+func isNetworkSource(s AsnSource) bool {
+	switch s {
+	case builtinSource(SourceIpinfo), builtinSource(SourceCymru), builtinSource(SourcePeeringDB):
+		return true
+	}
+	return false
+}
+
+// offlineTransport is the HTTP transport of offline handlers,
+// failing every request.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, OfflineModeError
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// failingTransport is an http.RoundTripper failing every request.
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("no network")
+}
+
+func TestOfflineMode(t *testing.T) {
+	transport := &countingTransport{base: failingTransport{}}
+	store := NewMemoryOverrides()
+	h, err := NewHandlerWithStore(store, 0,
+		WithOfflineMode(),
+		WithHTTPClient(&http.Client{Transport: transport}),
+		WithMMDB(testMMDB),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	// DNS queries would crash
+	h.resolver.client = nil
+	if !h.Offline() {
+		t.Errorf("Offline() = false")
+	}
+	if sources, expected := h.Sources(), []string{SourceCache, SourceMMDB, SourceOverrides}; !slices.Equal(sources, expected) {
+		t.Errorf("Sources() = %v, expected %v", sources, expected)
+	}
+	if err := h.OverridesSet("AS13335", "Cloudflare (override)"); err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string][2]string{
+		"8.8.8.8": {"AS15169", "GOOGLE"},
+		"1.1.1.1": {"AS13335", "Cloudflare (override)"},
+	} {
+		asn, descr, err := h.LookupAsn(ip)
+		if err != nil || asn != expected[0] || descr != expected[1] {
+			t.Errorf("LookupAsn(%s) answered %s %q %v, expected %s %q", ip, asn, descr, err, expected[0], expected[1])
+		}
+	}
+	if _, _, err := h.LookupAsn("4.4.4.4"); err == nil {
+		t.Errorf("LookupAsn succeeded for an address unknown to the local database")
+	}
+	if ips := h.LookupIp("AS15169"); !slices.Equal(ips, []string{"8.8.8.8"}) {
+		t.Errorf("LookupIp answered %v", ips)
+	}
+	// Network services fail
+	ctx := context.Background()
+	for name, lookup := range map[string]func() error{
+		"IpInfoLookup":           func() error { _, _, err := h.IpInfoLookup("8.8.8.8"); return err },
+		"IpInfo":                 func() error { _, err := h.IpInfo("8.8.8.8"); return err },
+		"CymruDnsLookup":         func() error { _, err := h.CymruDnsLookup("AS15169"); return err },
+		"CymruDnsLookupDetailed": func() error { _, err := h.CymruDnsLookupDetailed("AS15169"); return err },
+		"CymruOriginLookup":      func() error { _, _, err := h.CymruOriginLookup("8.8.8.8"); return err },
+		"CymruBulkLookup":        func() error { _, err := h.CymruBulkLookup([]string{"8.8.8.8"}); return err },
+		"LookupPTR":              func() error { _, err := h.LookupPTR(ctx, "8.8.8.8"); return err },
+		"LookupSelf":             func() error { _, err := h.LookupSelf(ctx); return err },
+	} {
+		if err := lookup(); !errors.Is(err, OfflineModeError) {
+			t.Errorf("%s failed with %v, expected OfflineModeError", name, err)
+		}
+	}
+	if _, err := h.PeeringDbLookup("AS15169"); err == nil {
+		t.Errorf("PeeringDbLookup succeeded")
+	}
+	if n := transport.requests.Load(); n != 0 {
+		t.Errorf("%d HTTP requests sent", n)
+	}
+	// Network sources are refused
+	if _, err := NewHandlerOpts(WithOfflineMode(), WithMMDB(testMMDB), WithAsnSources(BuiltinSource(SourceMMDB), BuiltinSource(SourceCymru))); !errors.Is(err, OfflineModeError) {
+		t.Errorf("WithAsnSources accepted a network source offline: %v", err)
+	}
+	if _, err := NewHandlerOpts(WithMMDB(testMMDB), WithAsnSources(BuiltinSource(SourceIpinfo)), WithOfflineMode()); !errors.Is(err, OfflineModeError) {
+		t.Errorf("WithOfflineMode accepted a network source: %v", err)
+	}
+}
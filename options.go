@@ -0,0 +1,271 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Option configures an optional Handler feature.
+// Options are passed to NewHandler or NewHandlerOpts and applied in order;
+// an Option returning an error aborts Handler creation.
+type Option func(*Handler) error
+
+// LookupOption configures a single lookup call.
+type LookupOption func(*lookupConfig)
+
+// lookupConfig is the configuration of a lookup call,
+// as set by LookupOptions.
+type lookupConfig struct {
+	// Whether and how to include PTR names
+	ptr ptrMode
+	// Number of neighbours kept by side, zero for all
+	topNeighbours int
+	// Whether PeeringDB lookups answer organization names
+	peeringdbOrg bool
+	// Sources LookupAsn may consult, nil for all
+	sources []string
+	// Observer of the lookup steps (see Explain)
+	observer lookupObserver
+	// Whether the lookup revalidates a cached answer (see WithSoftTTL),
+	// so that it skips cache reads and key tracking
+	refresh bool
+}
+
+// newLookupConfig applies LookupOptions to a default lookupConfig.
+func newLookupConfig(opts []LookupOption) lookupConfig {
+	var cfg lookupConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// ttlBounds clamps TTLs taken from external sources.
+type ttlBounds struct {
+	min time.Duration
+	max time.Duration
+}
+
+// clamp bounds a TTL.
+func (b ttlBounds) clamp(ttl time.Duration) time.Duration {
+	if ttl < b.min {
+		return b.min
+	}
+	if ttl > b.max {
+		return b.max
+	}
+	return ttl
+}
+
+// WithCymruTTL makes LookupAsn cache answers described by Team Cymru
+// for as long as the TTL of Cymru's DNS answer,
+// bounded by min and max,
+// instead of the fixed 1 day TTL.
+func WithCymruTTL(min time.Duration, max time.Duration) Option {
+	return func(h *Handler) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("invalid Cymru TTL bounds [%s, %s]", min, max)
+		}
+		h.cymruTTL = &ttlBounds{min, max}
+		return nil
+	}
+}
+
+// WithNegativeTTL sets how long failed lookups are cached,
+// 10 minutes by default, or disables their caching if zero:
+// LookupAsn answers of IP addresses without ASN, or ASNs without description,
+// and LookupAsnDescr failures.
+// Overriding an ASN purges its cached failures (see OverridesSet).
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(h *Handler) error {
+		if ttl < 0 {
+			return fmt.Errorf("negative TTL %s", ttl)
+		}
+		h.negativeTTL = ttl
+		return nil
+	}
+}
+
+// WithOverridesCollection makes the handler keep overrides of ASN descriptions
+// in a MongoDB collection (see NewHandler),
+// queried within the timeout set before (see WithTimeout and WithSourceTimeout).
+func WithOverridesCollection(c *mgo.Collection) Option {
+	return func(h *Handler) error {
+		if c == nil {
+			return OverridesNilCollectionError
+		}
+		h.overrides = NewMongoOverridesStore(c, h.sourceTimeout(SourceOverrides))
+		return nil
+	}
+}
+
+// WithTimeout bounds the calls to external services (see NewHandler),
+// or lifts the bound if zero, the default of NewHandlerOpts.
+// It also sets the DNS query timeout (see SetDNSServer).
+// Sources given their own timeout keep it (see WithSourceTimeout).
+// Options applied before keep the previous timeout,
+// so WithTimeout should come first.
+func WithTimeout(timeout time.Duration) Option {
+	return func(h *Handler) error {
+		if timeout < 0 {
+			return fmt.Errorf("negative timeout %s", timeout)
+		}
+		h.timeout = timeout
+		h.cymru.timeout = h.sourceTimeout(SourceCymru)
+		// The resolver is shared with derived handlers
+		if h.tenant == "" {
+			h.resolver.RLock()
+			server := h.resolver.server
+			h.resolver.RUnlock()
+			h.resolver.set(server, timeout)
+		}
+		return nil
+	}
+}
+
+// WithSourceTimeout bounds the queries of a given source
+// (SourceCymru, SourceIpinfo, SourceOverrides, SourcePeeringDB,
+// or the name of a source of WithAsnSources) by timeout,
+// instead of the handler timeout (see WithTimeout),
+// or lifts the bound if zero.
+// Lookups stay bounded by the deadline of their context, if sooner.
+// Every DNS query to Team Cymru stays bounded
+// by the DNS query timeout too (see SetDNSServer).
+func WithSourceTimeout(source string, timeout time.Duration) Option {
+	return func(h *Handler) error {
+		if source == "" {
+			return fmt.Errorf("empty source name")
+		}
+		if timeout < 0 {
+			return fmt.Errorf("negative timeout %s for source %s", timeout, source)
+		}
+		// Copied, as the map is shared with derived handlers
+		timeouts := maps.Clone(h.sourceTimeouts)
+		if timeouts == nil {
+			timeouts = make(map[string]time.Duration)
+		}
+		timeouts[source] = timeout
+		h.sourceTimeouts = timeouts
+		switch source {
+		case SourceCymru:
+			h.cymru.timeout = timeout
+		case SourceOverrides:
+			if m, ok := h.overrides.(*mongoOverrides); ok {
+				h.overrides = NewMongoOverridesStore(m.c, timeout)
+			}
+		}
+		return nil
+	}
+}
+
+// sourceTimeout returns the bound of the queries of a given source,
+// zero for none.
+func (h Handler) sourceTimeout(source string) time.Duration {
+	if timeout, ok := h.sourceTimeouts[source]; ok {
+		return timeout
+	}
+	return h.timeout
+}
+
+// WithHTTPClient makes the handler send its HTTP requests with client:
+// those of ipinfo.io, unless given a client by WithIpinfoClient,
+// RIPEstat, and the feeds of options applied after
+// (WithBogons, WithIXPDetection, WithCloudRanges).
+// Without it, the handler uses default clients bounded by its timeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(h *Handler) error {
+		if client == nil {
+			return fmt.Errorf("nil HTTP client")
+		}
+		h.httpClient = client
+		// The ipinfo.io client is shared with derived handlers
+		if h.ipinfo.own && h.tenant == "" {
+			h.ipinfo.client = client
+		}
+		return nil
+	}
+}
+
+// newHTTPClient returns the HTTP client given by WithHTTPClient,
+// or else a new one bounded by the handler timeout,
+// or one failing every request in offline mode (see WithOfflineMode).
+func (h Handler) newHTTPClient() *http.Client {
+	if h.offline {
+		return &http.Client{Transport: offlineTransport{}}
+	}
+	if h.httpClient != nil {
+		return h.httpClient
+	}
+	return &http.Client{
+		Timeout: h.timeout,
+	}
+}
+
+// WithCacheTTL sets how long LookupAsn answers are cached,
+// by IP address and by BGP prefix (see WithPrefixCache),
+// and ASN descriptions (see LookupAsnDescr),
+// instead of 1 day.
+// Answers described by Team Cymru are cached for its TTL instead,
+// if enabled (see WithCymruTTL).
+// Every entry is due at its own time, which jitter may spread
+// (see WithCacheJitter), and the TTL may change later (see SetCacheTTL).
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(h *Handler) error {
+		if ttl <= 0 {
+			return fmt.Errorf("invalid cache TTL %s", ttl)
+		}
+		if h.tenant != "" {
+			// Unlike the TTL of its parent
+			h.cache.ttl, h.prefixes.ttl = newTTL(ttl), newTTL(ttl)
+			return nil
+		}
+		return h.SetCacheTTL(ttl)
+	}
+}
+
+// SetCacheTTL changes the TTL of WithCacheTTL on a live handler,
+// and the handlers derived from it, but those given their own TTL.
+// Only the entries cached from now on are affected,
+// those cached already expire as they were due to.
+func (h Handler) SetCacheTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid cache TTL %s", ttl)
+	}
+	if h.tenant != "" {
+		return fmt.Errorf("derived handlers share the cache TTL of their parent")
+	}
+	for _, shared := range []*atomic.Int64{h.cache.ttl, h.prefixes.ttl, h.shared.cache.ttl, h.shared.prefixes.ttl} {
+		shared.Store(int64(ttl))
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingTransport is an http.RoundTripper counting requests
+// sent with another one.
+type countingTransport struct {
+	base     http.RoundTripper
+	requests atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return t.base.RoundTrip(req)
+}
+
+// testExchanger is a DNSExchanger answering TXT records of a zone.
+type testExchanger struct {
+	zone    testDNSZone
+	queries atomic.Int32
+}
+
+func (e *testExchanger) ExchangeContext(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	e.queries.Add(1)
+	answer := new(dns.Msg)
+	answer.SetReply(m)
+	for _, record := range e.zone[m.Question[0].Name] {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, 0, err
+		}
+		answer.Answer = append(answer.Answer, rr)
+	}
+	return answer, 0, nil
+}
+
+func TestNewHandlerOpts(t *testing.T) {
+	// libgeoip databases are not opened
+	defer func(dir string) { geoipDataDir = dir }(geoipDataDir)
+	geoipDataDir = t.TempDir()
+	mmdb := WithMMDB(testMMDB)
+	h, err := NewHandlerOpts(mmdb)
+	if err != nil {
+		t.Fatalf("NewHandlerOpts failed: %s", err)
+	}
+	if h.timeout != 0 || h.overrides != nil || h.httpClient != nil || h.cache.defaultTTL() != cacheTTL {
+		t.Fatalf("unexpected defaults: timeout %s, overrides %v, HTTP client %v, cache TTL %s",
+			h.timeout, h.overrides, h.httpClient, h.cache.defaultTTL())
+	}
+	// NewHandler is a wrapper
+	if h, err := NewHandler(nil, time.Second, mmdb); err != nil || h.timeout != time.Second {
+		t.Fatalf("NewHandler returned a timeout of %s, %v", h.timeout, err)
+	}
+	for name, opt := range map[string]Option{
+		"negative timeout":   WithTimeout(-time.Second),
+		"zero cache TTL":     WithCacheTTL(0),
+		"negative cache TTL": WithCacheTTL(-time.Hour),
+		"nil HTTP client":    WithHTTPClient(nil),
+		"nil resolver":       WithResolver(nil),
+		"nil collection":     WithOverridesCollection(nil),
+	} {
+		if _, err := NewHandlerOpts(mmdb, opt); err == nil {
+			t.Fatalf("NewHandlerOpts accepted a %s", name)
+		}
+	}
+	// Options combined
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/ripestat/asn-neighbours.json")
+	}))
+	defer ts.Close()
+	transport := &countingTransport{base: http.DefaultTransport}
+	client := &http.Client{Transport: transport}
+	exchanger := &testExchanger{zone: testDNSZone{
+		"AS64511.asn.cymru.com.": {`AS64511.asn.cymru.com. 7200 IN TXT "64511 | ZZ | other | 2024-01-01 | EXAMPLE, ZZ"`},
+	}}
+	h, err = NewHandlerOpts(WithTimeout(time.Second*2), WithHTTPClient(client), WithCacheTTL(time.Hour),
+		WithResolver(exchanger), WithDNSServer("192.0.2.53", time.Second), mmdb)
+	if err != nil {
+		t.Fatalf("NewHandlerOpts failed: %s", err)
+	}
+	if h.timeout != time.Second*2 || h.ipinfo.client != client || h.shared.cache.defaultTTL() != time.Hour {
+		t.Fatalf("options not applied: timeout %s, ipinfo client %v, shared cache TTL %s",
+			h.timeout, h.ipinfo.client, h.shared.cache.defaultTTL())
+	}
+	ctx := context.Background()
+	info, err := h.LookupIpInfo(ctx, "1.1.1.1")
+	if err != nil || info.Asn != "AS13335" || info.TTL != time.Hour {
+		t.Fatalf("LookupIpInfo returned %+v, %v", info, err)
+	}
+	descr, err := h.LookupAsnDescr(ctx, "AS64511")
+	if err != nil || descr != "EXAMPLE, ZZ" || exchanger.queries.Load() != 1 {
+		t.Fatalf("LookupAsnDescr returned %q, %v, after %d queries", descr, err, exchanger.queries.Load())
+	}
+	h.ripestat = ts.URL
+	if _, err := h.LookupAsnNeighbours(ctx, "AS64500"); err != nil || transport.requests.Load() != 1 {
+		t.Fatalf("LookupAsnNeighbours failed after %d requests: %v", transport.requests.Load(), err)
+	}
+	// Clients given by WithIpinfoClient are left alone
+	ipinfo := NewIpinfoClient("token", IpinfoLimits{})
+	h, err = NewHandlerOpts(WithIpinfoClient(ipinfo), WithHTTPClient(client), mmdb)
+	if err != nil || h.ipinfo != ipinfo || ipinfo.client == client {
+		t.Fatalf("WithHTTPClient changed the client given by WithIpinfoClient: %v", err)
+	}
+}
+
+func TestWithSourceTimeout(t *testing.T) {
+	zone := testDNSZone{
+		"4.4.4.4.origin.asn.cymru.com.": {`4.4.4.4.origin.asn.cymru.com. 60 IN TXT "64500 | 4.4.4.0/24 | US | arin | 2000-01-01"`},
+	}
+	const delay = 300 * time.Millisecond
+	server := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(delay)
+		zone.serve(w, req)
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		fmt.Fprintln(w, "AS64500")
+	}))
+	defer ts.Close()
+	registry := &delayedAsnSource{name: "registry", descr: "REGISTRY-NAME", delay: delay}
+	newTimeoutHandler := func(opts ...Option) Handler {
+		h := newHandler(nil, 2*time.Second)
+		h.resolver.server = server
+		h.ipinfo.baseURL = ts.URL
+		for _, opt := range opts {
+			if err := opt(&h); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return h
+	}
+	ctx := context.Background()
+	addr := netip.MustParseAddr("4.4.4.4")
+	// within checks whether a lookup succeeded, and its duration
+	within := func(what string, succeeded bool, lookup func() error) {
+		t.Helper()
+		start := time.Now()
+		err := lookup()
+		elapsed := time.Since(start)
+		switch {
+		case succeeded && err != nil:
+			t.Errorf("%s failed after %s: %v", what, elapsed, err)
+		case !succeeded && err == nil:
+			t.Errorf("%s succeeded after %s", what, elapsed)
+		case !succeeded && elapsed >= delay:
+			t.Errorf("%s failed after %s, not bounded", what, elapsed)
+		}
+	}
+	cymru := func(h Handler) func() error {
+		return func() error {
+			_, err := h.cymru.origin(ctx, addr)
+			return err
+		}
+	}
+	ipinfo := func(h Handler) func() error {
+		return func() error {
+			asn, _, err := h.ipInfoLookup(ctx, addr.String())
+			if err == nil && asn != "AS64500" {
+				err = fmt.Errorf("unexpected ASN %q", asn)
+			}
+			return err
+		}
+	}
+
+	// A short Team Cymru timeout leaves ipinfo.io alone, even set before WithTimeout
+	h := newTimeoutHandler(WithSourceTimeout(SourceCymru, 50*time.Millisecond), WithTimeout(2*time.Second))
+	within("Team Cymru lookup", false, cymru(h))
+	within("ipinfo.io lookup", true, ipinfo(h))
+
+	// And the other way around
+	h = newTimeoutHandler(WithSourceTimeout(SourceIpinfo, 50*time.Millisecond))
+	within("ipinfo.io lookup", false, ipinfo(h))
+	within("Team Cymru lookup", true, cymru(h))
+
+	// Sooner context deadlines still apply
+	within("Team Cymru lookup past its context deadline", false, func() error {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := h.cymru.origin(ctx, addr)
+		return err
+	})
+
+	// Sources of WithAsnSources
+	h = newTimeoutHandler(WithAsnSources(registry), WithSourceTimeout("registry", 50*time.Millisecond))
+	within("registry lookup", false, func() error {
+		_, _, err := h.describeAsn(ctx, registry, "AS64500")
+		return err
+	})
+	h = newTimeoutHandler(WithAsnSources(registry), WithSourceTimeout(SourceCymru, 50*time.Millisecond))
+	within("registry lookup", true, func() error {
+		_, _, err := h.describeAsn(ctx, registry, "AS64500")
+		return err
+	})
+
+	if err := WithSourceTimeout(SourceIpinfo, -time.Second)(&h); err == nil {
+		t.Error("WithSourceTimeout accepted a negative timeout")
+	}
+}
@@ -0,0 +1,549 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// MalformedPrefixError is returned on parse failure of prefix parameter.
+var MalformedPrefixError = newClassError("malformed prefix", MalformedInputError)
+
+// AsnInfo is what is known about the ASN originating some address space.
+type AsnInfo struct {
+	Asn   string `json:"asn"`
+	Descr string `json:"descr"`
+	// BGP prefix announced by Asn, if known
+	Prefix netip.Prefix `json:"prefix"`
+	// All ASNs originating Prefix, if there are several,
+	// by increasing number, of which Asn is the first
+	// (see LookupIpOrigins)
+	Origins []string `json:"origins,omitempty"`
+	// Whether the looked up address space spans
+	// routes of different origin ASNs (see LookupPrefixASN)
+	MultipleOrigins bool `json:"multiple_origins,omitempty"`
+	// Organization owning Asn (see WithAs2Org)
+	OrgID   string `json:"org_id,omitempty"`
+	OrgName string `json:"org_name,omitempty"`
+	// Regional registry and allocation date of Prefix, if known
+	Registry    string    `json:"registry,omitempty"`
+	AllocatedAt time.Time `json:"allocated_at,omitzero"`
+	// Reputation of Asn (see WithAnnotator)
+	Score int      `json:"score,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	// Whether the answer was cached past its soft TTL,
+	// and is being revalidated (see WithSoftTTL)
+	Stale bool `json:"stale,omitempty"`
+	// Source Asn was found by (SourceCymru...),
+	// source of Descr (SourceOverrides...),
+	// and descriptions answered by every source consulted, by source,
+	// as originally found for cached answers (see LookupAsnDetailed)
+	Source      string            `json:"source,omitempty"`
+	DescrSource string            `json:"descr_source,omitempty"`
+	Descrs      map[string]string `json:"descrs,omitempty"`
+	// Whether the answer was cached
+	Cached bool `json:"cached,omitempty"`
+}
+
+// AllocatedWithin tells whether the prefix is known
+// to have been allocated less than a given duration ago.
+// Recently allocated address space is a usual fraud signal.
+func (info AsnInfo) AllocatedWithin(d time.Duration) bool {
+	return !info.AllocatedAt.IsZero() && time.Since(info.AllocatedAt) < d
+}
+
+// LookupPrefixASN searches Team Cymru's IP to ASN service
+// for the ASN announcing a given prefix,
+// as used by the prefix network address.
+//
+// If the BGP prefix found does not cover the whole prefix,
+// the ASN of the prefix last address is also searched,
+// and AsnInfo.MultipleOrigins is set if it differs.
+//
+// Results are cached under the BGP prefix found,
+// so lookups of neighbor prefixes hit the cache.
+//
+// Returns the ASN information.
+func (h Handler) LookupPrefixASN(ctx context.Context, prefix netip.Prefix) (AsnInfo, error) {
+	if !prefix.IsValid() {
+		return AsnInfo{}, MalformedPrefixError
+	}
+	prefix = canonicalPrefix(prefix)
+	if iputils.IsLocalIP(net.IP(prefix.Addr().AsSlice())) {
+		return AsnInfo{}, PrivateIPError
+	}
+	if info, ok := h.prefixes.lookup(prefix); ok {
+		if info.Stale {
+			h.revalidatePrefix(info.Prefix)
+		}
+		if err := h.annotate(ctx, &info, true); err != nil {
+			return AsnInfo{}, err
+		}
+		return info, nil
+	}
+	return h.lookupPrefixASNUncached(ctx, prefix)
+}
+
+// lookupPrefixASNUncached is the uncached version of LookupPrefixASN,
+// for a canonical prefix.
+func (h Handler) lookupPrefixASNUncached(ctx context.Context, prefix netip.Prefix) (AsnInfo, error) {
+	info, err := h.lookupPrefixUpstream(ctx, prefix)
+	if err != nil {
+		return AsnInfo{}, err
+	}
+	info.Descr, info.DescrSource, info.Descrs = h.overrideDescrs(ctx, info.Asn, info.Descrs, info.DescrSource)
+	if err := ctxErr(ctx); err != nil {
+		return AsnInfo{}, err
+	}
+	h.addOrgInfo(&info)
+	if err := h.annotate(ctx, &info, false); err != nil {
+		return AsnInfo{}, err
+	}
+	if !info.MultipleOrigins {
+		h.prefixes.store(info)
+	}
+	if err := h.annotate(ctx, &info, true); err != nil {
+		return AsnInfo{}, err
+	}
+	return info, nil
+}
+
+// lookupPrefixUpstream searches external sources
+// for the origin of a canonical prefix,
+// cached for every tenant of derived handlers (see Derive).
+//
+// Returns the ASN information, without overrides nor annotations.
+func (h Handler) lookupPrefixUpstream(ctx context.Context, prefix netip.Prefix) (AsnInfo, error) {
+	if h.tenant != "" {
+		if info, ok := h.shared.prefixes.lookup(prefix); ok {
+			return info, nil
+		}
+	}
+	first, err := h.cymru.origin(ctx, prefix.Addr())
+	if err != nil {
+		return AsnInfo{}, h.redactError(err)
+	}
+	info := AsnInfo{
+		Asn:         first.asns[0],
+		Prefix:      first.prefix,
+		Origins:     first.asns,
+		Registry:    first.registry,
+		AllocatedAt: first.allocated,
+	}
+	if len(info.Origins) < 2 {
+		info.Origins = nil
+	}
+	if first.prefix.Bits() > prefix.Bits() || !first.prefix.Contains(prefix.Addr()) {
+		last, err := h.cymru.origin(ctx, lastAddr(prefix))
+		if err != nil {
+			return AsnInfo{}, h.redactError(err)
+		}
+		info.MultipleOrigins = last.asns[0] != first.asns[0]
+	}
+	descr, _, err := h.cymru.lookupTTL(ctx, info.Asn)
+	if err != nil {
+		if err := ctxErr(ctx); err != nil {
+			return AsnInfo{}, err
+		}
+		h.logf("warning: cymru lookup failed for asn '%s': %s\n", info.Asn, err)
+	}
+	info.Descr = descr
+	info.Source = SourceCymru
+	if descr != "" {
+		info.DescrSource = SourceCymru
+		info.Descrs = map[string]string{SourceCymru: descr}
+	}
+	if h.tenant != "" && !info.MultipleOrigins {
+		h.shared.prefixes.store(info)
+	}
+	return info, nil
+}
+
+// WithPrefixCache makes LookupAsn cache answers by BGP prefix,
+// as found by LookupPrefixASN,
+// so that one lookup answers for every address of the prefix.
+// Addresses without covering BGP prefix in cache
+// are looked up and cached as usual.
+func WithPrefixCache() Option {
+	return func(h *Handler) error {
+		h.prefixMode = true
+		return nil
+	}
+}
+
+// lookupOrigin searches for the BGP prefix covering an address,
+// and its ASN, caching them by prefix.
+func (h Handler) lookupOrigin(ctx context.Context, addr netip.Addr) (AsnInfo, error) {
+	if h.fixtures != nil {
+		prefix, m, ok := h.fixtures.lookup(addr)
+		if !ok {
+			return AsnInfo{}, fmt.Errorf("%w for ip '%s'", AsnNotFoundError, addr)
+		}
+		info := AsnInfo{
+			Asn:    m.Asn,
+			Prefix: prefix,
+			Source: SourceFixtures,
+		}
+		info.Descr, info.DescrSource, info.Descrs = h.overrideDescrs(ctx, m.Asn, map[string]string{SourceFixtures: m.Descr}, SourceFixtures)
+		if err := ctxErr(ctx); err != nil {
+			return AsnInfo{}, err
+		}
+		if err := h.annotate(ctx, &info, false); err != nil {
+			return AsnInfo{}, err
+		}
+		h.prefixes.store(info)
+		if err := h.annotate(ctx, &info, true); err != nil {
+			return AsnInfo{}, err
+		}
+		return info, nil
+	}
+	return h.LookupPrefixASN(ctx, netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// addOrgInfo fills in the organization of an ASN,
+// if the as2org dataset is loaded.
+func (h Handler) addOrgInfo(info *AsnInfo) {
+	if h.as2org == nil {
+		return
+	}
+	if org, err := h.as2org.lookup(info.Asn); err == nil {
+		info.OrgID, info.OrgName = org.OrgID, org.OrgName
+	}
+}
+
+// lastAddr answers the last address of a prefix.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - uint(i%8))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// cymruOrigin is an answer of Team Cymru's IP to ASN service.
+type cymruOrigin struct {
+	// Origin ASNs
+	asns []string
+	// BGP prefix
+	prefix netip.Prefix
+	// Regional registry and allocation date of the prefix, if known
+	registry  string
+	allocated time.Time
+}
+
+// origin queries Team Cymru's IP to ASN service
+// for the BGP route of a given address.
+//
+// Returns the route origin.
+func (cc cymruClient) origin(ctx context.Context, addr netip.Addr) (cymruOrigin, error) {
+	qname, err := dns.ReverseAddr(addr.Unmap().String())
+	if err != nil {
+		return cymruOrigin{}, MalformedIPError
+	}
+	if addr.Unmap().Is4() {
+		qname = strings.TrimSuffix(qname, "in-addr.arpa.") + "origin.asn.cymru.com."
+	} else {
+		qname = strings.TrimSuffix(qname, "ip6.arpa.") + "origin6.asn.cymru.com."
+	}
+	msg, err := cc.query(ctx, qname)
+	if err != nil {
+		if err == ctxErr(ctx) || err == OfflineModeError {
+			return cymruOrigin{}, err
+		}
+		return cymruOrigin{}, fmt.Errorf("failed to query dns: %w", &SourceError{SourceCymru, err})
+	}
+	// Multiple origins are listed in a record, or in several records
+	var origin cymruOrigin
+	for _, ans := range msg.Answer {
+		t, ok := ans.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		o, err := parseCymruOrigin(strings.Join(t.Txt, ""))
+		if err != nil {
+			return cymruOrigin{}, err
+		}
+		if len(origin.asns) == 0 {
+			origin = o
+		} else if o.prefix == origin.prefix {
+			origin.asns = sortOrigins(append(origin.asns, o.asns...))
+		}
+	}
+	if len(origin.asns) == 0 {
+		return cymruOrigin{}, fmt.Errorf("%w for ip '%s'", AsnNotFoundError, addr)
+	}
+	return origin, nil
+}
+
+// parseCymruOrigin parses a TXT record of Team Cymru's IP to ASN service:
+// "ASN [ASN...] | BGP prefix | country | registry | allocation date".
+// Multiple origin ASNs are sorted (see sortOrigins).
+func parseCymruOrigin(txt string) (cymruOrigin, error) {
+	fields := strings.Split(txt, "|")
+	if len(fields) < 2 {
+		return cymruOrigin{}, fmt.Errorf("malformed cymru origin record '%s'", txt)
+	}
+	var origin cymruOrigin
+	for _, asn := range strings.Fields(fields[0]) {
+		if !reASN.MatchString("AS" + asn) {
+			return cymruOrigin{}, fmt.Errorf("malformed ASN '%s' in cymru origin record '%s'", asn, txt)
+		}
+		origin.asns = append(origin.asns, "AS"+asn)
+	}
+	origin.asns = sortOrigins(origin.asns)
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(fields[1]))
+	if err != nil || len(origin.asns) == 0 {
+		return cymruOrigin{}, fmt.Errorf("malformed cymru origin record '%s'", txt)
+	}
+	origin.prefix = canonicalPrefix(prefix)
+	if len(fields) > 3 {
+		origin.registry = strings.TrimSpace(fields[3])
+	}
+	if len(fields) > 4 {
+		// Dates are sometimes empty, or zero ("0000-00-00")
+		origin.allocated, _ = time.Parse("2006-01-02", strings.TrimSpace(fields[4]))
+	}
+	return origin, nil
+}
+
+// sortOrigins sorts and deduplicates origin ASNs by increasing number,
+// so that the first origin, which lookups answer,
+// does not depend on the order of Team Cymru's answers.
+func sortOrigins(asns []string) []string {
+	slices.SortFunc(asns, func(a, b string) int {
+		if len(a) != len(b) {
+			// Same prefix, no leading zeros
+			return len(a) - len(b)
+		}
+		return strings.Compare(a, b)
+	})
+	return slices.Compact(asns)
+}
+
+// LookupIpOrigins searches for all the ASNs originating
+// the BGP route of a valid IP address,
+// as Team Cymru's IP to ASN service answers them,
+// or fixture mappings (see NewFixtureHandler).
+// Routes announced by several ASNs (multiple origin AS, MOAS)
+// answer them all, by increasing number,
+// while LookupAsn and CymruOriginLookup answer the first.
+// Results are cached as by LookupPrefixASN.
+//
+// Returns a non empty list of ASNs.
+func (h Handler) LookupIpOrigins(ctx context.Context, ip string) ([]string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, MalformedIPError
+	}
+	addr = addr.Unmap().WithZone("")
+	if iputils.IsLocalIP(net.IP(addr.AsSlice())) {
+		return nil, PrivateIPError
+	}
+	info, err := h.lookupOrigin(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Origins) == 0 {
+		return []string{info.Asn}, nil
+	}
+	return append([]string{}, info.Origins...), nil
+}
+
+// prefixCacheEntry is an AsnInfo cached by BGP prefix.
+type prefixCacheEntry struct {
+	info AsnInfo
+	// TTL and due date of this entry
+	ttl time.Duration
+	due time.Time
+	// Element of the prefix in the store order
+	elt *list.Element
+}
+
+// prefixCache caches AsnInfo by BGP prefix.
+type prefixCache struct {
+	// Concurrent access control to trie and order
+	*sync.RWMutex
+	trie *prefixTrie[prefixCacheEntry]
+	// Cached prefixes by store date, oldest first
+	order *list.List
+	// Maximum number of prefixes, zero for no bound (see WithCacheCapacity)
+	capacity int
+	// TTL of entries, shared with derived handlers (see SetCacheTTL),
+	// and soft TTL, zero for none (see WithSoftTTL)
+	ttl  *atomic.Int64
+	soft time.Duration
+	// Fraction of the TTL of entries they expire earlier or later by,
+	// at random (see WithCacheJitter)
+	jitter float64
+	// Clock telling when entries expire (see WithClock)
+	clock Clock
+}
+
+// newPrefixCache returns an empty initialized prefixCache.
+func newPrefixCache() prefixCache {
+	return prefixCache{
+		&sync.RWMutex{},
+		newPrefixTrie[prefixCacheEntry](),
+		list.New(),
+		cacheCapacity,
+		newTTL(cacheTTL),
+		0,
+		0,
+		systemClock{},
+	}
+}
+
+// defaultTTL returns the TTL of entries.
+func (c prefixCache) defaultTTL() time.Duration {
+	return time.Duration(c.ttl.Load())
+}
+
+// store caches an AsnInfo under its BGP prefix,
+// with jitter if enabled (see WithCacheJitter).
+// Expired prefixes are evicted as they come first in store order,
+// and the oldest prefixes past the cache capacity.
+func (c prefixCache) store(info AsnInfo) {
+	if !info.Prefix.IsValid() {
+		return
+	}
+	ttl := jitterTTL(c.defaultTTL(), c.jitter)
+	prefix := canonicalPrefix(info.Prefix)
+	c.Lock()
+	defer c.Unlock()
+	if entry, ok := c.trie.get(prefix); ok {
+		c.order.Remove(entry.elt)
+	}
+	c.trie.insert(prefix, prefixCacheEntry{
+		info: info,
+		ttl:  ttl,
+		due:  c.clock.Now().Add(ttl),
+		elt:  c.order.PushBack(prefix),
+	})
+	now := c.clock.Now()
+	for elt := c.order.Front(); elt != nil; elt = c.order.Front() {
+		entry, _ := c.trie.get(elt.Value.(netip.Prefix))
+		if !now.After(entry.due) && (c.capacity == 0 || c.trie.len <= c.capacity) {
+			break
+		}
+		c.trie.remove(c.order.Remove(elt).(netip.Prefix))
+	}
+}
+
+// removeLocked removes from the cache the prefixes matching fn.
+// The cache must be write locked.
+func (c prefixCache) removeLocked(fn func(netip.Prefix, prefixCacheEntry) bool) {
+	var removed []netip.Prefix
+	c.trie.walk(func(p netip.Prefix, entry prefixCacheEntry) bool {
+		if fn(p, entry) {
+			removed = append(removed, p)
+			c.order.Remove(entry.elt)
+		}
+		return true
+	})
+	for _, p := range removed {
+		c.trie.remove(p)
+	}
+}
+
+// lookup retrieves the non expired AsnInfo
+// of the most specific BGP prefix covering a given prefix.
+//
+// Returns the AsnInfo, marked stale if past the soft TTL,
+// and whether it was found.
+func (c prefixCache) lookup(p netip.Prefix) (AsnInfo, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	_, entry, ok := c.trie.cover(p)
+	now := c.clock.Now()
+	if !ok || now.After(entry.due) {
+		return AsnInfo{}, false
+	}
+	info := entry.info
+	info.Stale = c.soft > 0 && entry.ttl-entry.due.Sub(now) >= c.soft
+	return info, true
+}
+
+// purgeASN removes from the cache all prefixes of a given ASN.
+func (c prefixCache) purgeASN(asn string) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeLocked(func(_ netip.Prefix, entry prefixCacheEntry) bool {
+		return entry.info.Asn == asn
+	})
+}
+
+// purgeSource removes from the cache the prefixes
+// whose origin or description was found by a given source.
+func (c prefixCache) purgeSource(source string) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeLocked(func(_ netip.Prefix, entry prefixCacheEntry) bool {
+		return entry.info.Source == source || entry.info.DescrSource == source
+	})
+}
+
+// len returns the number of cached prefixes.
+func (c prefixCache) len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.trie.len
+}
+
+// purgeAll removes all entries from the cache.
+func (c prefixCache) purgeAll() {
+	c.Lock()
+	defer c.Unlock()
+	*c.trie = *newPrefixTrie[prefixCacheEntry]()
+	c.order.Init()
+}
+
+// list returns the non expired AsnInfo of all cached prefixes.
+func (c prefixCache) list() []AsnInfo {
+	c.RLock()
+	defer c.RUnlock()
+	now := c.clock.Now()
+	var infos []AsnInfo
+	c.trie.walk(func(p netip.Prefix, entry prefixCacheEntry) bool {
+		if now.Before(entry.due) {
+			infos = append(infos, entry.info)
+		}
+		return true
+	})
+	return infos
+}
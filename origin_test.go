@@ -0,0 +1,324 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// originName answers the Team Cymru origin query name of an address.
+func originName(ip string) string {
+	name, _ := dns.ReverseAddr(ip)
+	if strings.HasSuffix(name, "in-addr.arpa.") {
+		return strings.TrimSuffix(name, "in-addr.arpa.") + "origin.asn.cymru.com."
+	}
+	return strings.TrimSuffix(name, "ip6.arpa.") + "origin6.asn.cymru.com."
+}
+
+// testCymruZone serves Team Cymru like answers for a few addresses.
+var testCymruZone = testDNSZone{
+	originName("8.8.8.0"):     {originName("8.8.8.0") + ` 300 IN TXT "15169 | 8.8.8.0/24 | US | arin | 2023-12-28"`},
+	originName("1.0.0.0"):     {originName("1.0.0.0") + ` 300 IN TXT "13335 | 1.0.0.0/24 | AU | apnic | 2011-08-11"`},
+	originName("1.0.1.255"):   {originName("1.0.1.255") + ` 300 IN TXT "23969 | 1.0.1.0/24 | CN | apnic | 2011-04-14"`},
+	originName("2001:4860::"): {originName("2001:4860::") + ` 300 IN TXT "15169 | 2001:4860::/32 | US | arin | 2005-03-14"`},
+	"AS15169.asn.cymru.com.":  {`AS15169.asn.cymru.com. 300 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+	"AS13335.asn.cymru.com.":  {`AS13335.asn.cymru.com. 300 IN TXT "13335 | US | arin | 2010-07-14 | CLOUDFLARENET, US"`},
+}
+
+func TestLookupPrefixASN(t *testing.T) {
+	var queries int32
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		testCymruZone.serve(w, req)
+	})
+	ctx := context.Background()
+	tests := []struct {
+		prefix   string
+		asn      string
+		descr    string
+		bgp      string
+		multiple bool
+		queries  int32
+	}{
+		{"8.8.8.0/24", "AS15169", "GOOGLE, US", "8.8.8.0/24", false, 2},
+		// Cached under 8.8.8.0/24
+		{"8.8.8.128/25", "AS15169", "GOOGLE, US", "8.8.8.0/24", false, 0},
+		{"1.0.0.0/23", "AS13335", "CLOUDFLARENET, US", "1.0.0.0/24", true, 3},
+		// Not cached, as it spans multiple origins
+		{"1.0.0.0/23", "AS13335", "CLOUDFLARENET, US", "1.0.0.0/24", true, 3},
+		{"2001:4860::/48", "AS15169", "GOOGLE, US", "2001:4860::/32", false, 2},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&queries, 0)
+		info, err := h.LookupPrefixASN(ctx, netip.MustParsePrefix(test.prefix))
+		if err != nil {
+			t.Fatalf("LookupPrefixASN(%s) failed: %s", test.prefix, err)
+		}
+		if info.Asn != test.asn || info.Descr != test.descr || info.Prefix.String() != test.bgp || info.MultipleOrigins != test.multiple {
+			t.Fatalf("unexpected LookupPrefixASN(%s) answer: %+v", test.prefix, info)
+		}
+		if q := atomic.LoadInt32(&queries); q != test.queries {
+			t.Fatalf("LookupPrefixASN(%s) sent %d queries, expected %d", test.prefix, q, test.queries)
+		}
+	}
+	info, err := h.LookupPrefixASN(ctx, netip.MustParsePrefix("8.8.8.8/32"))
+	if err != nil || info.Registry != "arin" || info.AllocatedAt != time.Date(2023, 12, 28, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("unexpected LookupPrefixASN answer: %+v, %v", info, err)
+	}
+	if !info.AllocatedWithin(time.Since(info.AllocatedAt)+time.Hour) || info.AllocatedWithin(time.Hour) {
+		t.Fatalf("unexpected AllocatedWithin answers for %s", info.AllocatedAt)
+	}
+	if (AsnInfo{}).AllocatedWithin(time.Hour) {
+		t.Fatalf("unknown allocation date is recent")
+	}
+	// Prefix cache entries keep the allocation
+	h.prefixMode = true
+	ipInfo, err := h.LookupIpInfo(ctx, "8.8.8.9")
+	if err != nil || ipInfo.Registry != "arin" || ipInfo.AllocatedAt != info.AllocatedAt {
+		t.Fatalf("unexpected LookupIpInfo answer: %+v, %v", ipInfo, err)
+	}
+	if _, err := h.LookupPrefixASN(ctx, netip.MustParsePrefix("10.1.0.0/16")); err != PrivateIPError {
+		t.Fatalf("unexpected LookupPrefixASN error: %v", err)
+	}
+	if _, err := h.LookupPrefixASN(ctx, netip.Prefix{}); err != MalformedPrefixError {
+		t.Fatalf("unexpected LookupPrefixASN error: %v", err)
+	}
+}
+
+func TestCymruOriginLookup(t *testing.T) {
+	var mu sync.Mutex
+	var qnames []string
+	zone := testDNSZone{
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com.": {
+			`1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com. 300 IN TXT "13335 | 2001:db8::/32 | US | arin | 2005-03-14"`,
+		},
+	}
+	zone[originName("2606:4700::1111")] = []string{originName("2606:4700::1111") + ` 300 IN TXT "13335 | 2606:4700::/32 | US | arin | 2011-11-01"`}
+	for name, rrs := range testCymruZone {
+		zone[name] = rrs
+	}
+	h := newHandler(nil, time.Second)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	h.ipinfo.baseURL = ts.URL
+	h.resolver.server = startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		qnames = append(qnames, req.Question[0].Name)
+		mu.Unlock()
+		zone.serve(w, req)
+	})
+	tests := []struct {
+		ip    string
+		qname string
+		asn   string
+		descr string
+	}{
+		{"8.8.8.0", "0.8.8.8.origin.asn.cymru.com.", "AS15169", "GOOGLE, US"},
+		// Compressed addresses are expanded
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com.", "AS13335", "CLOUDFLARENET, US"},
+		// IPv4-mapped addresses are queried as IPv4 addresses
+		{"::ffff:8.8.8.0", "0.8.8.8.origin.asn.cymru.com.", "AS15169", "GOOGLE, US"},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		qnames = nil
+		mu.Unlock()
+		asn, descr, err := h.CymruOriginLookup(test.ip)
+		if err != nil || asn != test.asn || descr != test.descr {
+			t.Fatalf("CymruOriginLookup(%s) returned %q, %q, %v", test.ip, asn, descr, err)
+		}
+		mu.Lock()
+		if len(qnames) == 0 || qnames[0] != test.qname {
+			t.Fatalf("CymruOriginLookup(%s) queried %v, expected %s", test.ip, qnames, test.qname)
+		}
+		mu.Unlock()
+	}
+	if _, _, err := h.CymruOriginLookup("2001:db8::zz"); err != MalformedIPError {
+		t.Fatalf("unexpected CymruOriginLookup error: %v", err)
+	}
+	// LookupAsn falls back to the origin of IPv6 addresses
+	info, err := h.LookupAsnDetailed(context.Background(), "2606:4700::1111")
+	if err != nil || info.Asn != "AS13335" || info.Descr != "CLOUDFLARENET, US" || info.Source != SourceCymru {
+		t.Fatalf("LookupAsnDetailed returned %+v, %v", info, err)
+	}
+	if _, err := h.LookupAsnDetailed(context.Background(), "2606:4700::1"); err == nil {
+		t.Fatalf("LookupAsnDetailed found an unknown origin")
+	}
+}
+
+func TestParseCymruOrigin(t *testing.T) {
+	origin, err := parseCymruOrigin("13335 395747 | 104.16.0.0/13 | US | arin | 2014-03-28")
+	if err != nil {
+		t.Fatalf("parseCymruOrigin failed: %s", err)
+	}
+	if len(origin.asns) != 2 || origin.asns[1] != "AS395747" || origin.prefix.String() != "104.16.0.0/13" {
+		t.Fatalf("unexpected origin: %+v", origin)
+	}
+	dates := []struct {
+		txt       string
+		registry  string
+		allocated time.Time
+	}{
+		{"15169 | 8.8.8.0/24 | US | arin | 2010-05-04", "arin", time.Date(2010, 5, 4, 0, 0, 0, 0, time.UTC)},
+		{"15169 | 8.8.8.0/24 | US | arin | ", "arin", time.Time{}},
+		{"15169 | 8.8.8.0/24 | US | arin", "arin", time.Time{}},
+		{"15169 | 8.8.8.0/24 | EU | ripencc | 0000-00-00", "ripencc", time.Time{}},
+		{"15169 | 8.8.8.0/24 | US | arin | 05/04/2010", "arin", time.Time{}},
+		{"15169 | 8.8.8.0/24", "", time.Time{}},
+	}
+	for _, test := range dates {
+		origin, err := parseCymruOrigin(test.txt)
+		if err != nil {
+			t.Fatalf("parseCymruOrigin('%s') failed: %s", test.txt, err)
+		}
+		if origin.registry != test.registry || !origin.allocated.Equal(test.allocated) {
+			t.Fatalf("parseCymruOrigin('%s') returned %q, %s", test.txt, origin.registry, origin.allocated)
+		}
+	}
+	// Multiple origins are sorted by number
+	origin, err = parseCymruOrigin("395747 13335 395747 | 104.16.0.0/13 | US | arin | 2014-03-28")
+	if err != nil || !reflect.DeepEqual(origin.asns, []string{"AS13335", "AS395747"}) {
+		t.Fatalf("parseCymruOrigin returned %v, %v", origin.asns, err)
+	}
+	for _, txt := range []string{"", "15169", " | 8.8.8.0/24 | US", "15169 | 8.8.8.0 | US", "15169 AS3356 | 8.8.8.0/24 | US"} {
+		if _, err := parseCymruOrigin(txt); err == nil {
+			t.Fatalf("parseCymruOrigin('%s') did not fail", txt)
+		}
+	}
+}
+
+func TestLookupIpOrigins(t *testing.T) {
+	zone := testDNSZone{
+		// Multiple origins in a record
+		"0.0.16.104.origin.asn.cymru.com.": {`0.0.16.104.origin.asn.cymru.com. 60 IN TXT "395747 13335 | 104.16.0.0/13 | US | arin | 2014-03-28"`},
+		// Multiple origins in several records
+		"0.108.199.185.origin.asn.cymru.com.": {
+			`0.108.199.185.origin.asn.cymru.com. 60 IN TXT "64511 | 185.199.108.0/24 | US | arin | 2010-01-01"`,
+			`0.108.199.185.origin.asn.cymru.com. 60 IN TXT "64500 | 185.199.108.0/24 | US | arin | 2010-01-01"`,
+		},
+		"8.8.8.8.origin.asn.cymru.com.": {`8.8.8.8.origin.asn.cymru.com. 60 IN TXT "15169 | 8.8.8.0/24 | US | arin | 2023-12-28"`},
+		"AS13335.asn.cymru.com.":        {`AS13335.asn.cymru.com. 60 IN TXT "13335 | US | arin | 2010-07-14 | CLOUDFLARENET, US"`},
+		"AS64500.asn.cymru.com.":        {`AS64500.asn.cymru.com. 60 IN TXT "64500 | US | arin | 2010-01-01 | EXAMPLE, US"`},
+	}
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, zone.serve)
+	ctx := context.Background()
+	tests := []struct {
+		ip      string
+		origins []string
+	}{
+		{"104.16.0.0", []string{"AS13335", "AS395747"}},
+		{"185.199.108.0", []string{"AS64500", "AS64511"}},
+		{"8.8.8.8", []string{"AS15169"}},
+	}
+	for _, test := range tests {
+		// Answers are the same, cached or not
+		for i := 0; i < 2; i++ {
+			origins, err := h.LookupIpOrigins(ctx, test.ip)
+			if err != nil || !reflect.DeepEqual(origins, test.origins) {
+				t.Fatalf("LookupIpOrigins(%s) returned %v, %v", test.ip, origins, err)
+			}
+		}
+	}
+	// Single answers are the first origin
+	for _, test := range []struct{ ip, asn, descr string }{
+		{"104.16.0.0", "AS13335", "CLOUDFLARENET, US"},
+		{"185.199.108.0", "AS64500", "EXAMPLE, US"},
+	} {
+		asn, descr, err := h.CymruOriginLookup(test.ip)
+		if err != nil || asn != test.asn || descr != test.descr {
+			t.Errorf("CymruOriginLookup(%s) returned %q, %q, %v", test.ip, asn, descr, err)
+		}
+	}
+	for _, ip := range []string{"bogus", "10.0.0.1"} {
+		if _, err := h.LookupIpOrigins(ctx, ip); err == nil {
+			t.Errorf("LookupIpOrigins(%s) did not fail", ip)
+		}
+	}
+}
+
+func TestPrefixCacheStore(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := newPrefixCache()
+	c.clock = clock
+	c.ttl.Store(int64(time.Hour))
+	for _, p := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"} {
+		c.store(AsnInfo{Asn: p, Prefix: netip.MustParsePrefix(p)})
+	}
+	// Lookups answer the most specific prefix covering the query
+	for _, test := range []struct {
+		prefix string
+		asn    string
+	}{
+		{"10.1.2.3/32", "10.1.2.0/24"},
+		{"10.1.2.0/23", "10.1.0.0/16"},
+		{"10.1.0.0/16", "10.1.0.0/16"},
+		{"10.0.0.0/15", "10.0.0.0/8"},
+		{"10.0.0.0/7", ""},
+	} {
+		info, ok := c.lookup(netip.MustParsePrefix(test.prefix))
+		if info.Asn != test.asn || ok != (test.asn != "") {
+			t.Errorf("lookup(%s) answered %q %v, expected %q", test.prefix, info.Asn, ok, test.asn)
+		}
+	}
+	// Expired prefixes are evicted by later stores
+	clock.advance(2 * time.Hour)
+	c.store(AsnInfo{Asn: "AS64500", Prefix: netip.MustParsePrefix("192.0.2.0/24")})
+	if n := c.len(); n != 1 {
+		t.Errorf("%d prefixes cached after expiry, expected 1", n)
+	}
+	// The oldest prefixes are evicted past capacity
+	c.capacity = 2
+	for _, p := range []string{"198.51.100.0/24", "203.0.113.0/24", "192.0.2.0/24"} {
+		c.store(AsnInfo{Asn: p, Prefix: netip.MustParsePrefix(p)})
+	}
+	if n, m := c.len(), c.order.Len(); n != 2 || m != 2 {
+		t.Errorf("%d prefixes cached, %d ordered past capacity, expected 2", n, m)
+	}
+	for p, ok := range map[string]bool{"198.51.100.1/32": false, "203.0.113.1/32": true, "192.0.2.1/32": true} {
+		if _, found := c.lookup(netip.MustParsePrefix(p)); found != ok {
+			t.Errorf("lookup(%s) found %v past capacity, expected %v", p, found, ok)
+		}
+	}
+	c.purgeASN("192.0.2.0/24")
+	if n, m := c.len(), c.order.Len(); n != 1 || m != 1 {
+		t.Errorf("%d prefixes cached, %d ordered after purge, expected 1", n, m)
+	}
+}
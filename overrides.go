@@ -26,17 +26,36 @@
 package geoipdb
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"io"
+	"sort"
+	"time"
 )
 
 // AsnOverride is what is stored in the overrides collection.
 type AsnOverride struct {
 	Asn  string `bson:"_id" json:"asn"`
 	Name string `bson:"name" json:"name"`
+	// Creation and update times,
+	// set by OverridesSet in stores which are OverridesMetaStore,
+	// or imported from other systems (see OverridesImportHistorical);
+	// zero for overrides set by older versions
+	CreatedAt time.Time `bson:"created_at,omitempty" json:"created_at,omitzero"`
+	UpdatedAt time.Time `bson:"updated_at,omitempty" json:"updated_at,omitzero"`
+	// Author of the last update (see OverridesSetWithMeta)
+	UpdatedBy string `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	// Operator of overrides imported from other systems
+	Operator string `bson:"operator,omitempty" json:"operator,omitempty"`
+}
+
+// versionedOverride is an AsnOverride document
+// with its schema version (see OverridesMigrate).
+type versionedOverride struct {
+	AsnOverride   `bson:",inline"`
+	SchemaVersion int `bson:"schema_version"`
 }
 
 // OverridesNilCollectionError is returned by Overrides<...> methods
@@ -46,11 +65,11 @@ var OverridesNilCollectionError = errors.New("nil overrides collection")
 
 // OverridesAsnNotFoundError is returned by OverridesLookup
 // when there is no override defined.
-var OverridesAsnNotFoundError = errors.New("ASN not found")
+var OverridesAsnNotFoundError = newClassError("ASN not found", NotFoundError)
 
 // OverridesMalformedAsnError is returned by OverridesSet
 // when parameter asn does not conform to an ASN identification.
-var OverridesMalformedAsnError = errors.New("malformed ASN")
+var OverridesMalformedAsnError = newClassError("malformed ASN", MalformedInputError)
 
 // OverridesLookup queries the database of local overrides
 // for the description of a given ASN.
@@ -58,74 +77,629 @@ var OverridesMalformedAsnError = errors.New("malformed ASN")
 // Returns the ASN description,
 // or OverridesAsnNotFoundError if there is no override for the ASN.
 func (h Handler) OverridesLookup(asn string) (string, error) {
+	return h.OverridesLookupCtx(context.Background(), asn)
+}
+
+// OverridesLookupCtx is OverridesLookup, with a context.
+// The query is bounded by the deadline of ctx, if any,
+// and given up when ctx is done, failing with its error.
+//
+// Returns the ASN description,
+// or OverridesAsnNotFoundError if there is no override for the ASN.
+func (h Handler) OverridesLookupCtx(ctx context.Context, asn string) (string, error) {
+	override, err := h.overridesGet(ctx, asn)
+	if err != nil {
+		return "", err
+	}
+	return override.Name, nil
+}
+
+// OverridesGet queries the database of local overrides
+// for the whole override of a given ASN,
+// with its creation and update times, and author.
+//
+// Returns the override,
+// or OverridesAsnNotFoundError if there is no override for the ASN.
+func (h Handler) OverridesGet(asn string) (AsnOverride, error) {
+	return h.overridesGet(context.Background(), asn)
+}
+
+// overridesGet queries the override of a given ASN, within ctx.
+func (h Handler) overridesGet(ctx context.Context, asn string) (AsnOverride, error) {
 	if h.overrides == nil {
-		return "", OverridesNilCollectionError
+		return AsnOverride{}, OverridesNilCollectionError
 	}
-	var override AsnOverride
-	err := h.overrides.FindId(asn).One(&override)
-	if err == mgo.ErrNotFound {
-		return "", OverridesAsnNotFoundError
+	if err := ctxErr(ctx); err != nil {
+		return AsnOverride{}, err
 	}
+	asn = normalizeASN(asn)
+	if timeout := h.sourceTimeouts[SourceOverrides]; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var override AsnOverride
+	err := h.breaker.do(func() error {
+		var err error
+		override, err = h.overrides.Get(ctx, asn)
+		return err
+	}, OverridesAsnNotFoundError, context.Canceled)
 	if err != nil {
-		return "", fmt.Errorf("cannot lookup override: %s", err)
+		if errors.Is(err, OverridesAsnNotFoundError) {
+			return AsnOverride{}, OverridesAsnNotFoundError
+		}
+		if err == OverridesUnavailableError || err == ctxErr(ctx) {
+			return AsnOverride{}, err
+		}
+		return AsnOverride{}, fmt.Errorf("cannot lookup override: %w", &SourceError{SourceOverrides, err})
 	}
-	return override.Name, nil
+	return override, nil
 }
 
 // OverridesSet stores or updates a user defined description for a given ASN
 // in the database of local overrides.
+// ASNs of any notation (see ParseASN) are stored in asplain notation,
+// so that "as15169" and "15169" set the override of "AS15169".
+// It is OverridesSetWithMeta without author.
 //
 // Moreover, this method purges the cache (see LookupAsn)
-// of all data related to the given asn.
+// of all data related to the given asn,
+// and announces the change to other handlers (see WithOverridesSubscriber).
 func (h Handler) OverridesSet(asn string, descr string) error {
+	return h.OverridesSetWithMeta(asn, descr, "")
+}
+
+// OverridesSetWithMeta is OverridesSet, recording the author of the update
+// and the creation and update times of the override,
+// if the overrides store is an OverridesMetaStore
+// (see OverridesGet),
+// and in the audit log, if any (see WithOverridesAudit).
+func (h Handler) OverridesSetWithMeta(asn, descr, author string) error {
+	asn = normalizeASN(asn)
 	h.cache.purgeASN(asn)
+	h.prefixes.purgeASN(asn)
+	h.names.purgeASN(asn)
+	// Once changed, so that other replicas cannot cache the former override
+	defer h.purgeAsnCache(asn)
 	if h.overrides == nil {
 		return OverridesNilCollectionError
 	}
-	if !reASN.MatchString(asn) {
+	if _, err := ParseASN(asn); err != nil {
 		return OverridesMalformedAsnError
 	}
-	_, err := h.overrides.UpsertId(asn, bson.M{"$set": bson.M{"name": descr}})
+	old, found, auditErr := h.auditedOverride(asn)
+	now := time.Now()
+	var err error
+	if meta, ok := h.overrides.(OverridesMetaStore); ok {
+		err = meta.SetMeta(asn, descr, author, now)
+	} else {
+		err = h.overrides.Set(asn, descr)
+	}
 	if err != nil {
-		return fmt.Errorf("cannot set override: %s", err)
+		return fmt.Errorf("cannot set override: %w", &SourceError{SourceOverrides, err})
 	}
-	return nil
+	h.publishOverride(asn)
+	h.logOverride("override set", "asn", asn, "descr", descr, "author", author)
+	if auditErr != nil {
+		return auditErr
+	}
+	action := OverridesAuditCreated
+	if found {
+		action = OverridesAuditUpdated
+	}
+	return h.auditOverride(OverridesAuditEntry{Asn: asn, Old: old, New: descr, Actor: author, Time: now, Action: action})
 }
 
 // OverridesRemove removes the description for a given ASN
 // from the database of local overrides.
 // If there is no such ASN,
-// OverridesRemove returns silently without error.
+// OverridesRemove returns silently without error,
+// nor audit log entry (see WithOverridesAudit).
 //
 // Moreover, this method purges the cache (see LookupAsn)
-// of all data related to the given asn.
+// of all data related to the given asn,
+// and announces the change to other handlers (see WithOverridesSubscriber).
 func (h Handler) OverridesRemove(asn string) error {
+	asn = normalizeASN(asn)
 	h.cache.purgeASN(asn)
+	h.prefixes.purgeASN(asn)
+	h.names.purgeASN(asn)
+	// Once changed, so that other replicas cannot cache the former override
+	defer h.purgeAsnCache(asn)
 	if h.overrides == nil {
 		return OverridesNilCollectionError
 	}
-	err := h.overrides.RemoveId(asn)
-	if err == mgo.ErrNotFound {
-		return nil
+	old, found, auditErr := h.auditedOverride(asn)
+	if err := h.overrides.Remove(asn); err != nil {
+		return fmt.Errorf("cannot remove override: %w", &SourceError{SourceOverrides, err})
 	}
-	if err != nil {
-		return fmt.Errorf("cannot remove override: %s", err)
+	h.publishOverride(asn)
+	h.logOverride("override removed", "asn", asn)
+	if auditErr != nil || !found {
+		return auditErr
 	}
-	return nil
+	return h.auditOverride(OverridesAuditEntry{Asn: asn, Old: old, Time: time.Now(), Action: OverridesAuditRemoved})
 }
 
-// OverridesList answers all ASN description overrides.
+// OverridesList answers all ASN description overrides,
+// sorted by ASN number (AS9000 before AS64512),
+// overrides of malformed ASNs last.
 func (h Handler) OverridesList() ([]AsnOverride, error) {
 	if h.overrides == nil {
 		return nil, OverridesNilCollectionError
 	}
+	answer, err := h.overrides.List()
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve overrides: %w", &SourceError{SourceOverrides, err})
+	}
+	if answer == nil {
+		return make([]AsnOverride, 0), nil
+	}
+	sortOverrides(answer)
+	return answer, nil
+}
+
+// OverridesListPage answers a page of the ASN description overrides
+// listed by OverridesList: skipping offset overrides,
+// up to limit overrides, all of them if limit is zero.
+func (h Handler) OverridesListPage(limit, offset int) ([]AsnOverride, error) {
+	if limit < 0 || offset < 0 {
+		return nil, fmt.Errorf("negative limit %d or offset %d", limit, offset)
+	}
+	answer, err := h.OverridesList()
+	if err != nil {
+		return nil, err
+	}
+	answer = answer[min(offset, len(answer)):]
+	if limit > 0 && len(answer) > limit {
+		answer = answer[:limit]
+	}
+	return answer, nil
+}
+
+// OverridesCount answers the number of ASN description overrides.
+// Overrides stores which are OverridesCounter count themselves,
+// others are counted by listing every override.
+func (h Handler) OverridesCount() (int, error) {
+	if h.overrides == nil {
+		return 0, OverridesNilCollectionError
+	}
+	if counter, ok := h.overrides.(OverridesCounter); ok {
+		n, err := counter.Count()
+		if err != nil {
+			return 0, fmt.Errorf("cannot count overrides: %w", &SourceError{SourceOverrides, err})
+		}
+		return n, nil
+	}
+	overrides, err := h.overrides.List()
+	if err != nil {
+		return 0, fmt.Errorf("cannot count overrides: %w", &SourceError{SourceOverrides, err})
+	}
+	return len(overrides), nil
+}
+
+// sortOverrides sorts overrides by ASN number,
+// then overrides of malformed ASNs, such as written by older versions,
+// by ASN.
+func sortOverrides(overrides []AsnOverride) {
+	type key struct {
+		n  uint32
+		ok bool
+	}
+	keys := make(map[string]key, len(overrides))
+	for _, o := range overrides {
+		n, err := ParseASN(o.Asn)
+		keys[o.Asn] = key{n, err == nil}
+	}
+	sort.SliceStable(overrides, func(i, j int) bool {
+		ki, kj := keys[overrides[i].Asn], keys[overrides[j].Asn]
+		switch {
+		case ki.ok != kj.ok:
+			return ki.ok
+		case ki.ok && ki.n != kj.n:
+			return ki.n < kj.n
+		}
+		return overrides[i].Asn < overrides[j].Asn
+	})
+}
+
+// OverridesSearch answers the overrides whose description contains query,
+// case insensitively, in the order of OverridesList
+// (AS9000 before AS64512, overrides of malformed ASNs last),
+// skipping offset overrides, up to limit overrides,
+// all of them if limit is zero.
+// Every override matches an empty query, for paging OverridesList.
+//
+// Overrides stores which are OverridesSearcher search themselves,
+// others are searched by listing every override.
+func (h Handler) OverridesSearch(query string, limit, offset int) ([]AsnOverride, error) {
+	if h.overrides == nil {
+		return nil, OverridesNilCollectionError
+	}
+	if limit < 0 || offset < 0 {
+		return nil, fmt.Errorf("negative limit %d or offset %d", limit, offset)
+	}
 	var answer []AsnOverride
-	err := h.overrides.Find(nil).All(&answer)
+	var err error
+	if searcher, ok := h.overrides.(OverridesSearcher); ok {
+		answer, err = searcher.Search(query, limit, offset)
+	} else if answer, err = h.overrides.List(); err == nil {
+		answer = searchOverrides(answer, query, limit, offset)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot retrieve overrides: %s", err)
+		return nil, fmt.Errorf("cannot search overrides: %w", &SourceError{SourceOverrides, err})
 	}
 	if answer == nil {
 		return make([]AsnOverride, 0), nil
 	}
 	return answer, nil
 }
+
+// OverridesExport writes all ASN description overrides to w,
+// as a JSON array of AsnOverride (see OverridesImport).
+func (h Handler) OverridesExport(w io.Writer) error {
+	overrides, err := h.OverridesList()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(overrides)
+}
+
+// OverridesImport stores or updates the ASN descriptions read from r,
+// a JSON array of AsnOverride such as written by OverridesExport,
+// in as few writes as the overrides store allows (see OverridesBulkStore).
+// Only ASNs and names are imported,
+// see OverridesImportHistorical to keep update times.
+// The last override of an ASN listed several times wins.
+// If replace is true, overrides of ASNs not in r are removed.
+//
+// The whole input is decoded and checked before any write:
+// a malformed ASN anywhere fails with OverridesMalformedAsnError,
+// leaving the overrides untouched.
+//
+// Every override imported or removed is recorded in the audit log, if any
+// (see WithOverridesAudit).
+//
+// Moreover, this method purges the whole cache (see LookupAsn) once,
+// after writing.
+func (h Handler) OverridesImport(r io.Reader, replace bool) (err error) {
+	if h.overrides == nil {
+		return OverridesNilCollectionError
+	}
+	var overrides []AsnOverride
+	if err := json.NewDecoder(r).Decode(&overrides); err != nil {
+		return fmt.Errorf("cannot decode overrides: %w", err)
+	}
+	// Index of every ASN in overrides, deduplicated
+	imported := make(map[string]int, len(overrides))
+	unique := overrides[:0]
+	for _, o := range overrides {
+		asn, err := canonicalASN(o.Asn)
+		if err != nil {
+			return OverridesMalformedAsnError
+		}
+		o.Asn = asn
+		if i, ok := imported[o.Asn]; ok {
+			unique[i] = o
+			continue
+		}
+		imported[o.Asn] = len(unique)
+		unique = append(unique, o)
+	}
+	overrides = unique
+	var removed []string
+	// Descriptions of existing overrides, if replaced or audited
+	existing := make(map[string]string)
+	if replace || h.audit != nil {
+		list, err := h.OverridesList()
+		if err != nil {
+			return err
+		}
+		for _, o := range list {
+			existing[o.Asn] = o.Name
+			if _, ok := imported[o.Asn]; replace && !ok {
+				removed = append(removed, o.Asn)
+			}
+		}
+	}
+	// Changes to audit, once written
+	var changes []OverridesAuditEntry
+	now := time.Now()
+	setChange := func(o AsnOverride) OverridesAuditEntry {
+		old, found := existing[o.Asn]
+		action := OverridesAuditCreated
+		if found {
+			action = OverridesAuditUpdated
+		}
+		return OverridesAuditEntry{Asn: o.Asn, Old: old, New: o.Name, Time: now, Action: action}
+	}
+	removeChange := func(asn string) OverridesAuditEntry {
+		return OverridesAuditEntry{Asn: asn, Old: existing[asn], Time: now, Action: OverridesAuditRemoved}
+	}
+	defer func() {
+		h.cache.purgeAll()
+		h.prefixes.purgeAll()
+		h.names.purgeAll()
+		h.purgeAsnCache("")
+		h.publishOverride("")
+		if err == nil {
+			h.logOverride("overrides imported", "count", len(overrides), "removed", len(removed))
+		}
+		if auditErr := h.auditOverrides(changes); err == nil {
+			err = auditErr
+		}
+	}()
+	if bulk, ok := h.overrides.(OverridesBulkStore); ok {
+		if err := bulk.SetMany(overrides); err != nil {
+			return fmt.Errorf("cannot import overrides: %w", err)
+		}
+		for _, o := range overrides {
+			changes = append(changes, setChange(o))
+		}
+		if err := bulk.RemoveMany(removed); err != nil {
+			return fmt.Errorf("cannot remove overrides: %w", err)
+		}
+		for _, asn := range removed {
+			changes = append(changes, removeChange(asn))
+		}
+		return nil
+	}
+	for _, o := range overrides {
+		if err := h.overrides.Set(o.Asn, o.Name); err != nil {
+			return fmt.Errorf("cannot import override: %w", err)
+		}
+		changes = append(changes, setChange(o))
+	}
+	for _, asn := range removed {
+		if err := h.overrides.Remove(asn); err != nil {
+			return fmt.Errorf("cannot remove override: %w", err)
+		}
+		changes = append(changes, removeChange(asn))
+	}
+	return nil
+}
+
+// OverridesCollision is an override imported by OverridesImportHistorical
+// for an ASN already overriden.
+type OverridesCollision struct {
+	Asn string `json:"asn"`
+	// Update times of the existing and imported overrides
+	Existing time.Time `json:"existing"`
+	Imported time.Time `json:"imported"`
+	// Whether the imported override replaced the existing one
+	ImportedWins bool `json:"imported_wins"`
+}
+
+// OverridesImportReport reports what OverridesImportHistorical did.
+type OverridesImportReport struct {
+	// Number of overrides inserted
+	Inserted int `json:"inserted"`
+	// Overrides imported for ASNs already overriden
+	Collisions []OverridesCollision `json:"collisions"`
+}
+
+// OverridesImportHistorical imports overrides from other systems
+// into the database of local overrides,
+// keeping their creation and update times, and operator, verbatim.
+//
+// Every override must have an update time,
+// not in the future nor before its creation time, if any.
+// Overrides are checked before any is imported.
+// The overrides store must be an OverridesImporter,
+// otherwise OverridesImportHistorical fails with OverridesUnsupportedError.
+//
+// When an ASN is already overriden, the most recently updated override wins.
+// Overrides without update time,
+// such as set by older versions of OverridesSet, always lose.
+//
+// Overrides imported are recorded in the audit log, if any
+// (see WithOverridesAudit), at their update time,
+// by their operator, or else their author.
+//
+// Moreover, this method purges the cache (see LookupAsn)
+// of all data related to the ASNs of the overrides imported.
+//
+// Returns a report of the imported overrides and collisions,
+// up to the first failure if any.
+func (h Handler) OverridesImportHistorical(overrides []AsnOverride) (OverridesImportReport, error) {
+	report := OverridesImportReport{Collisions: []OverridesCollision{}}
+	if h.overrides == nil {
+		return report, OverridesNilCollectionError
+	}
+	importer, ok := h.overrides.(OverridesImporter)
+	if !ok {
+		return report, OverridesUnsupportedError
+	}
+	if err := checkHistoricalOverrides(overrides, time.Now()); err != nil {
+		return report, err
+	}
+	var auditErr error
+	for _, o := range overrides {
+		o.Asn = normalizeASN(o.Asn)
+		if o.CreatedAt.IsZero() {
+			o.CreatedAt = o.UpdatedAt
+		}
+		existing, err := importer.Get(context.Background(), o.Asn)
+		if err != nil && !errors.Is(err, OverridesAsnNotFoundError) {
+			return report, fmt.Errorf("cannot lookup override: %w", &SourceError{SourceOverrides, err})
+		}
+		if err == nil {
+			collision := OverridesCollision{
+				Asn:          o.Asn,
+				Existing:     existing.UpdatedAt,
+				Imported:     o.UpdatedAt,
+				ImportedWins: o.UpdatedAt.After(existing.UpdatedAt),
+			}
+			report.Collisions = append(report.Collisions, collision)
+			if !collision.ImportedWins {
+				continue
+			}
+		} else {
+			report.Inserted++
+		}
+		h.cache.purgeASN(o.Asn)
+		h.prefixes.purgeASN(o.Asn)
+		h.names.purgeASN(o.Asn)
+		if err := importer.Import(o); err != nil {
+			return report, fmt.Errorf("cannot import override: %w", err)
+		}
+		h.purgeAsnCache(o.Asn)
+		h.publishOverride(o.Asn)
+		h.logOverride("override imported", "asn", o.Asn, "descr", o.Name)
+		change := OverridesAuditEntry{Asn: o.Asn, New: o.Name, Actor: o.Operator, Time: o.UpdatedAt, Action: OverridesAuditCreated}
+		if change.Actor == "" {
+			change.Actor = o.UpdatedBy
+		}
+		if err == nil {
+			change.Old, change.Action = existing.Name, OverridesAuditUpdated
+		}
+		if err := h.auditOverride(change); err != nil && auditErr == nil {
+			auditErr = err
+		}
+	}
+	return report, auditErr
+}
+
+// checkHistoricalOverrides checks overrides to import
+// (see OverridesImportHistorical).
+func checkHistoricalOverrides(overrides []AsnOverride, now time.Time) error {
+	for _, o := range overrides {
+		if _, err := ParseASN(o.Asn); err != nil {
+			return OverridesMalformedAsnError
+		}
+		switch {
+		case o.UpdatedAt.IsZero():
+			return fmt.Errorf("override of %s has no update time", o.Asn)
+		case o.UpdatedAt.After(now) || o.CreatedAt.After(now):
+			return fmt.Errorf("override of %s updated or created in the future", o.Asn)
+		case o.CreatedAt.After(o.UpdatedAt):
+			return fmt.Errorf("override of %s created after its update", o.Asn)
+		}
+	}
+	return nil
+}
+
+// OverridesNormalization is a canonical ASN
+// whose overrides were rewritten by OverridesNormalize.
+type OverridesNormalization struct {
+	Asn string `json:"asn"`
+	// ASNs of the overrides merged into Asn, as they were stored
+	Merged []string `json:"merged"`
+	// ASN of the override kept, as it was stored
+	Kept string `json:"kept"`
+}
+
+// OverridesNormalizeReport reports what OverridesNormalize did.
+type OverridesNormalizeReport struct {
+	// Overrides rewritten, by canonical ASN
+	Normalized []OverridesNormalization `json:"normalized"`
+	// ASNs of overrides left alone, not conforming to an ASN identification
+	Malformed []string `json:"malformed"`
+}
+
+// OverridesNormalize rewrites the overrides stored for ASNs
+// not in asplain notation (see ParseASN),
+// such as by older versions of OverridesSet ("as15169"),
+// to their canonical ASN ("AS15169"),
+// so that OverridesLookup finds them.
+// Overrides of ASNs which are not ASN identifications are left alone.
+//
+// When several overrides share a canonical ASN,
+// the most recently updated wins, and the others are removed;
+// overrides without update time lose,
+// unless all of them have none, then the one of the canonical ASN wins.
+// Overrides stores which are OverridesImporter
+// keep the history of the winner.
+//
+// Normalizing is idempotent, meant to be run once after upgrading.
+// Overrides rewritten and removed are recorded in the audit log, if any
+// (see WithOverridesAudit).
+//
+// Moreover, this method purges the cache (see LookupAsn)
+// of all data related to the ASNs rewritten.
+//
+// Returns a report of the rewritten overrides, up to the first failure if any.
+func (h Handler) OverridesNormalize() (OverridesNormalizeReport, error) {
+	report := OverridesNormalizeReport{Normalized: []OverridesNormalization{}, Malformed: []string{}}
+	overrides, err := h.OverridesList()
+	if err != nil {
+		return report, err
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Asn < overrides[j].Asn })
+	// Overrides by canonical ASN, in order of appearance
+	var asns []string
+	groups := make(map[string][]AsnOverride)
+	for _, o := range overrides {
+		asn, err := canonicalASN(o.Asn)
+		if err != nil {
+			report.Malformed = append(report.Malformed, o.Asn)
+			continue
+		}
+		if _, ok := groups[asn]; !ok {
+			asns = append(asns, asn)
+		}
+		groups[asn] = append(groups[asn], o)
+	}
+	importer, _ := h.overrides.(OverridesImporter)
+	var auditErr error
+	audit := func(e OverridesAuditEntry) {
+		if err := h.auditOverride(e); err != nil && auditErr == nil {
+			auditErr = err
+		}
+	}
+	for _, asn := range asns {
+		group := groups[asn]
+		if len(group) == 1 && group[0].Asn == asn {
+			continue
+		}
+		winner := group[0]
+		for _, o := range group[1:] {
+			if o.UpdatedAt.After(winner.UpdatedAt) || (o.UpdatedAt.Equal(winner.UpdatedAt) && o.Asn == asn) {
+				winner = o
+			}
+		}
+		normalization := OverridesNormalization{Asn: asn, Merged: []string{}, Kept: winner.Asn}
+		for _, o := range group {
+			if o.Asn != asn {
+				normalization.Merged = append(normalization.Merged, o.Asn)
+			}
+		}
+		h.cache.purgeASN(asn)
+		h.prefixes.purgeASN(asn)
+		h.names.purgeASN(asn)
+		h.purgeAsnCache(asn)
+		now := time.Now()
+		if winner.Asn != asn {
+			// Override of the canonical ASN, if any
+			change := OverridesAuditEntry{Asn: asn, New: winner.Name, Time: now, Action: OverridesAuditCreated}
+			for _, o := range group {
+				if o.Asn == asn {
+					change.Old, change.Action = o.Name, OverridesAuditUpdated
+				}
+			}
+			winner.Asn = asn
+			if importer != nil {
+				err = importer.Import(winner)
+			} else {
+				err = h.overrides.Set(asn, winner.Name)
+			}
+			if err != nil {
+				return report, fmt.Errorf("cannot normalize override of %s: %w", asn, err)
+			}
+			audit(change)
+		}
+		for _, o := range group {
+			if o.Asn == asn {
+				continue
+			}
+			if err := h.overrides.Remove(o.Asn); err != nil {
+				return report, fmt.Errorf("cannot remove override of %s: %w", o.Asn, err)
+			}
+			audit(OverridesAuditEntry{Asn: o.Asn, Old: o.Name, Time: now, Action: OverridesAuditRemoved})
+		}
+		h.publishOverride(asn)
+		h.logOverride("override normalized", "asn", asn, "merged", normalization.Merged)
+		report.Normalized = append(report.Normalized, normalization)
+	}
+	return report, auditErr
+}
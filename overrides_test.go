@@ -0,0 +1,197 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckHistoricalOverrides(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	created := time.Date(2015, 3, 2, 0, 0, 0, 0, time.UTC)
+	updated := time.Date(2019, 7, 14, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		override AsnOverride
+		ok       bool
+	}{
+		{AsnOverride{Asn: "AS13335", Name: "Cloudflare", CreatedAt: created, UpdatedAt: updated, Operator: "alice"}, true},
+		{AsnOverride{Asn: "AS13335", Name: "Cloudflare", UpdatedAt: updated}, true},
+		{AsnOverride{Asn: "AS13335", Name: "Cloudflare", UpdatedAt: now}, true},
+		{AsnOverride{Asn: "AS4294967296", Name: "Cloudflare", UpdatedAt: updated}, false},
+		{AsnOverride{Asn: "AS13335", Name: "Cloudflare", CreatedAt: created}, false},
+		{AsnOverride{Asn: "AS13335", Name: "Cloudflare", UpdatedAt: now.Add(time.Second)}, false},
+		{AsnOverride{Asn: "AS13335", Name: "Cloudflare", CreatedAt: updated, UpdatedAt: created}, false},
+		// ASNs of any notation
+		{AsnOverride{Asn: "13335", Name: "Cloudflare", UpdatedAt: updated}, true},
+		{AsnOverride{Asn: "as0.13335", Name: "Cloudflare", UpdatedAt: updated}, true},
+	}
+	for _, test := range tests {
+		err := checkHistoricalOverrides([]AsnOverride{test.override}, now)
+		if (err == nil) != test.ok {
+			t.Fatalf("unexpected check of %+v: %v", test.override, err)
+		}
+	}
+	// Overrides are checked all at once
+	valid := tests[0].override
+	if err := checkHistoricalOverrides([]AsnOverride{valid, tests[3].override}, now); err == nil {
+		t.Fatalf("malformed override not detected")
+	}
+}
+
+func TestOverridesSetNotation(t *testing.T) {
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	for _, asn := range []string{"AS15169", "as15169", "15169", " AS0.15169 "} {
+		if err := h.OverridesSet(asn, "Google ("+asn+")"); err != nil {
+			t.Fatalf("OverridesSet(%q) failed: %s", asn, err)
+		}
+	}
+	overrides, err := h.OverridesList()
+	if err != nil || len(overrides) != 1 || overrides[0].Asn != "AS15169" || overrides[0].Name != "Google ( AS0.15169 )" {
+		t.Fatalf("OverridesList answered %+v, %v", overrides, err)
+	}
+	if descr, err := h.OverridesLookupCtx(context.Background(), "15169"); err != nil || descr != "Google ( AS0.15169 )" {
+		t.Fatalf("OverridesLookupCtx(15169) answered %q, %v", descr, err)
+	}
+	for _, asn := range []string{"AS", "AS4294967296", "AS-1", "google"} {
+		if err := h.OverridesSet(asn, "Google"); err != OverridesMalformedAsnError {
+			t.Errorf("OverridesSet(%q) failed with %v", asn, err)
+		}
+	}
+	if err := h.OverridesRemove("as15169"); err != nil {
+		t.Fatalf("OverridesRemove failed: %s", err)
+	}
+	if overrides, err := h.OverridesList(); err != nil || len(overrides) != 0 {
+		t.Fatalf("OverridesList answered %+v, %v after removal", overrides, err)
+	}
+}
+
+func TestOverridesNormalize(t *testing.T) {
+	store := NewMemoryOverrides()
+	h := newHandler(store, time.Second)
+	updated := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, o := range []AsnOverride{
+		// Most recently updated wins
+		{Asn: "as15169", Name: "Google (old)", UpdatedAt: updated},
+		{Asn: "AS015169", Name: "Google", UpdatedAt: updated.Add(time.Hour), Operator: "alice"},
+		{Asn: "AS15169", Name: "Google (set)"},
+		// Canonical wins without update times
+		{Asn: "13335", Name: "Cloudflare (old)"},
+		{Asn: "AS13335", Name: "Cloudflare"},
+		// Alone
+		{Asn: "as0.3356", Name: "Lumen"},
+		{Asn: "AS174", Name: "Cogent"},
+		{Asn: "google", Name: "Google"},
+	} {
+		if err := store.Import(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := h.OverridesNormalize()
+	if err != nil {
+		t.Fatalf("OverridesNormalize failed: %s", err)
+	}
+	expected := OverridesNormalizeReport{
+		Normalized: []OverridesNormalization{
+			{Asn: "AS13335", Merged: []string{"13335"}, Kept: "AS13335"},
+			{Asn: "AS15169", Merged: []string{"AS015169", "as15169"}, Kept: "AS015169"},
+			{Asn: "AS3356", Merged: []string{"as0.3356"}, Kept: "as0.3356"},
+		},
+		Malformed: []string{"google"},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("OverridesNormalize reported %+v", report)
+	}
+	overrides, err := h.OverridesList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedOverrides := []AsnOverride{
+		{Asn: "AS174", Name: "Cogent"},
+		{Asn: "AS3356", Name: "Lumen"},
+		{Asn: "AS13335", Name: "Cloudflare"},
+		{Asn: "AS15169", Name: "Google", UpdatedAt: updated.Add(time.Hour), Operator: "alice"},
+		{Asn: "google", Name: "Google"},
+	}
+	if !reflect.DeepEqual(overrides, expectedOverrides) {
+		t.Errorf("OverridesList answered %+v after normalization", overrides)
+	}
+	// Normalizing again changes nothing
+	report, err = h.OverridesNormalize()
+	if err != nil || len(report.Normalized) != 0 || len(report.Malformed) != 1 {
+		t.Errorf("OverridesNormalize reported %+v, %v", report, err)
+	}
+}
+
+func TestOverridesListPage(t *testing.T) {
+	store := NewMemoryOverrides()
+	h := newHandler(store, time.Second)
+	for _, asn := range []string{"AS64512", "legacy", "AS9000", "AS4294967295", "AS1", "as15169x", "AS4200000000", "AS13335"} {
+		store.Import(AsnOverride{Asn: asn, Name: asn})
+	}
+	sorted := []string{"AS1", "AS9000", "AS13335", "AS64512", "AS4200000000", "AS4294967295", "as15169x", "legacy"}
+	asns := func(overrides []AsnOverride) []string {
+		answer := make([]string, 0, len(overrides))
+		for _, o := range overrides {
+			answer = append(answer, o.Asn)
+		}
+		return answer
+	}
+	overrides, err := h.OverridesList()
+	if err != nil || !reflect.DeepEqual(asns(overrides), sorted) {
+		t.Fatalf("OverridesList answered %v, %v", asns(overrides), err)
+	}
+	for _, test := range []struct {
+		limit, offset int
+		expected      []string
+	}{
+		{0, 0, sorted},
+		{3, 0, sorted[:3]},
+		{3, 3, sorted[3:6]},
+		{3, 6, sorted[6:]},
+		{0, 7, sorted[7:]},
+		{3, 8, []string{}},
+		{1, 100, []string{}},
+	} {
+		overrides, err := h.OverridesListPage(test.limit, test.offset)
+		if err != nil || !reflect.DeepEqual(asns(overrides), test.expected) {
+			t.Errorf("OverridesListPage(%d, %d) answered %v, %v", test.limit, test.offset, asns(overrides), err)
+		}
+	}
+	if _, err := h.OverridesListPage(0, -1); err == nil {
+		t.Errorf("OverridesListPage accepted a negative offset")
+	}
+	for _, h := range []Handler{h, newHandler(struct{ OverridesStore }{store}, time.Second)} {
+		if n, err := h.OverridesCount(); err != nil || n != len(sorted) {
+			t.Errorf("OverridesCount answered %d, %v", n, err)
+		}
+	}
+	if _, err := newHandler(nil, time.Second).OverridesCount(); err != OverridesNilCollectionError {
+		t.Errorf("OverridesCount failed with %v without overrides", err)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// peeringdbCacheTTL is the expiration time of PeeringDB answers,
+	// longer than cacheTTL since networks seldom change their names,
+	// and PeeringDB rate-limits aggressively.
+	peeringdbCacheTTL = time.Hour * 24 * 7
+	// peeringdbNegativeCacheTTL is the expiration time
+	// of the answers for ASNs PeeringDB does not know.
+	peeringdbNegativeCacheTTL = time.Hour * 6
+	// peeringdbCooldown is how long PeeringDB is left alone
+	// once it rate-limits us, unless it tells how long.
+	peeringdbCooldown = time.Minute
+)
+
+// PeeringDbNotFoundError is returned by PeeringDB lookups
+// of ASNs without a PeeringDB network.
+var PeeringDbNotFoundError = newClassError("ASN not found in PeeringDB", NotFoundError)
+
+// PeeringDbRateLimitedError is returned by PeeringDB lookups
+// when PeeringDB rate-limits us (HTTP 429).
+// Lookups fail without querying PeeringDB until the delay elapses.
+type PeeringDbRateLimitedError struct {
+	// Delay before querying PeeringDB again
+	RetryAfter time.Duration
+}
+
+func (e *PeeringDbRateLimitedError) Error() string {
+	return fmt.Sprintf("PeeringDB rate limit exceeded, retry after %s", e.RetryAfter)
+}
+
+// PeeringDbNetwork is the PeeringDB network of an ASN.
+type PeeringDbNetwork struct {
+	Asn  string `json:"asn"`
+	Name string `json:"name"`
+	// Also known as
+	AKA string `json:"aka,omitempty"`
+	// Organization running the network,
+	// its name if asked for (see WithPeeringDbOrg)
+	OrgID   int    `json:"org_id"`
+	OrgName string `json:"org_name,omitempty"`
+}
+
+// WithPeeringDbOrg makes PeeringDbLookupCtx
+// also answer the name of the organization running the network,
+// at the cost of another PeeringDB query for uncached organizations.
+func WithPeeringDbOrg() LookupOption {
+	return func(cfg *lookupConfig) {
+		cfg.peeringdbOrg = true
+	}
+}
+
+// PeeringDbLookup queries PeeringDB for the network name of a given ASN,
+// the most readable description of CDN and IXP-connected networks.
+// LookupAsn may consult it too (see BuiltinSource and WithAsnSources).
+//
+// Answers, including unknown ASNs, are cached for longer than LookupAsn
+// (7 days).
+//
+// Returns the network name, PeeringDbNotFoundError for unknown ASNs,
+// or a *PeeringDbRateLimitedError if PeeringDB rate-limits us.
+func (h Handler) PeeringDbLookup(asn string) (string, error) {
+	network, err := h.PeeringDbLookupCtx(context.Background(), asn)
+	return network.Name, err
+}
+
+// PeeringDbLookupCtx is PeeringDbLookup, with a context
+// and LookupOptions (see WithPeeringDbOrg),
+// answering the whole network.
+//
+// Returns the network,
+// PeeringDbNotFoundError for unknown ASNs,
+// or a *PeeringDbRateLimitedError if PeeringDB rate-limits us.
+func (h Handler) PeeringDbLookupCtx(ctx context.Context, asn string, opts ...LookupOption) (PeeringDbNetwork, error) {
+	asn, err := canonicalASN(asn)
+	if err != nil {
+		return PeeringDbNetwork{}, err
+	}
+	cfg := newLookupConfig(opts)
+	network, err := h.peeringdbNetwork(ctx, asn)
+	if err != nil || !cfg.peeringdbOrg {
+		return network, err
+	}
+	network.OrgName, err = h.peeringdbOrg(ctx, network.OrgID)
+	return network, err
+}
+
+// peeringdbNet is a PeeringDB net object, reduced to the fields we need.
+type peeringdbNet struct {
+	Name  string `json:"name"`
+	AKA   string `json:"aka"`
+	OrgID int    `json:"org_id"`
+}
+
+// peeringdbOrgObject is a PeeringDB org object, reduced to the fields we need.
+type peeringdbOrgObject struct {
+	Name string `json:"name"`
+}
+
+// peeringdbNetwork retrieves the network of an ASN,
+// from cache or PeeringDB.
+func (h Handler) peeringdbNetwork(ctx context.Context, asn string) (PeeringDbNetwork, error) {
+	if entry, found := h.peeringdbCache.lookup(asn); found {
+		return entry.network, entry.err
+	}
+	if err := h.peeringdbCache.throttled(); err != nil {
+		return PeeringDbNetwork{}, err
+	}
+	var nets []peeringdbNet
+	err := h.getPeeringdbObjects(ctx, "/net?asn="+strings.TrimPrefix(asn, "AS"), &nets)
+	if err != nil {
+		return PeeringDbNetwork{}, err
+	}
+	if len(nets) == 0 {
+		h.peeringdbCache.store(asn, PeeringDbNetwork{}, PeeringDbNotFoundError)
+		return PeeringDbNetwork{}, PeeringDbNotFoundError
+	}
+	network := PeeringDbNetwork{
+		Asn:   asn,
+		Name:  nets[0].Name,
+		AKA:   nets[0].AKA,
+		OrgID: nets[0].OrgID,
+	}
+	h.peeringdbCache.store(asn, network, nil)
+	return network, nil
+}
+
+// peeringdbOrg retrieves the name of an organization,
+// from cache or PeeringDB.
+func (h Handler) peeringdbOrg(ctx context.Context, id int) (string, error) {
+	key := "org/" + strconv.Itoa(id)
+	if entry, found := h.peeringdbCache.lookup(key); found {
+		return entry.network.OrgName, entry.err
+	}
+	if err := h.peeringdbCache.throttled(); err != nil {
+		return "", err
+	}
+	var orgs []peeringdbOrgObject
+	if err := h.getPeeringdbObjects(ctx, "/org?id="+strconv.Itoa(id), &orgs); err != nil {
+		return "", err
+	}
+	if len(orgs) == 0 {
+		err := fmt.Errorf("PeeringDB organization %d not found", id)
+		h.peeringdbCache.store(key, PeeringDbNetwork{}, err)
+		return "", err
+	}
+	h.peeringdbCache.store(key, PeeringDbNetwork{OrgID: id, OrgName: orgs[0].Name}, nil)
+	return orgs[0].Name, nil
+}
+
+// getPeeringdbObjects retrieves a list of PeeringDB objects into data,
+// starting a cooldown if PeeringDB rate-limits us.
+func (h Handler) getPeeringdbObjects(ctx context.Context, query string, data interface{}) error {
+	u := h.peeringdb + query
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.newHTTPClient().Do(req)
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to GET '%s': %w", u, &SourceError{SourcePeeringDB, err})
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		cooldown := peeringdbCooldown
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			cooldown = time.Duration(s) * time.Second
+		}
+		h.peeringdbCache.throttle(cooldown)
+		return &PeeringDbRateLimitedError{RetryAfter: cooldown}
+	default:
+		return fmt.Errorf("GET '%s' returned status %s", u, resp.Status)
+	}
+	return decodePeeringdb(resp.Body, data)
+}
+
+// peeringdbCache is a cache of PeeringDB answers,
+// networks by ASN and organizations by "org/ID".
+type peeringdbCache struct {
+	*sync.RWMutex
+	entries map[string]peeringdbCacheEntry
+	// End of the cooldown after PeeringDB rate-limited us
+	until *time.Time
+}
+
+// peeringdbCacheEntry is a cached PeeringDB answer.
+type peeringdbCacheEntry struct {
+	network PeeringDbNetwork
+	err     error
+	due     time.Time
+}
+
+// newPeeringdbCache returns an empty initialized peeringdbCache.
+func newPeeringdbCache() peeringdbCache {
+	return peeringdbCache{
+		RWMutex: &sync.RWMutex{},
+		entries: make(map[string]peeringdbCacheEntry),
+		until:   &time.Time{},
+	}
+}
+
+// store caches a PeeringDB answer.
+func (c peeringdbCache) store(key string, network PeeringDbNetwork, err error) {
+	ttl := peeringdbCacheTTL
+	if err != nil {
+		ttl = peeringdbNegativeCacheTTL
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = peeringdbCacheEntry{
+		network: network,
+		err:     err,
+		due:     time.Now().Add(ttl),
+	}
+}
+
+// lookup retrieves a non expired PeeringDB answer.
+//
+// Returns the cached entry and whether the key was found in cache.
+func (c peeringdbCache) lookup(key string) (peeringdbCacheEntry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.due) {
+		return peeringdbCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// throttle starts a cooldown of PeeringDB queries.
+func (c peeringdbCache) throttle(cooldown time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	*c.until = time.Now().Add(cooldown)
+}
+
+// throttled tells whether PeeringDB queries are cooling down.
+//
+// Returns a *PeeringDbRateLimitedError until the cooldown ends.
+func (c peeringdbCache) throttled() error {
+	c.RLock()
+	defer c.RUnlock()
+	if left := time.Until(*c.until); left > 0 {
+		return &PeeringDbRateLimitedError{RetryAfter: left}
+	}
+	return nil
+}
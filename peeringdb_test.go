@@ -0,0 +1,115 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeeringDbLookup(t *testing.T) {
+	var requests, throttle atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if throttle.Load() != 0 {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Request was throttled", http.StatusTooManyRequests)
+			return
+		}
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/net?asn=13335":
+			http.ServeFile(w, r, "testdata/peeringdb/net-13335.json")
+		case "/org?id=4715":
+			http.ServeFile(w, r, "testdata/peeringdb/org-4715.json")
+		case "/net?asn=64496":
+			http.ServeFile(w, r, "testdata/peeringdb/net-empty.json")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	h.peeringdb = ts.URL
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		name, err := h.PeeringDbLookup("AS13335")
+		if err != nil || name != "Cloudflare" {
+			t.Fatalf("PeeringDbLookup(AS13335) answered '%s', %v", name, err)
+		}
+	}
+	network, err := h.PeeringDbLookupCtx(ctx, "AS13335", WithPeeringDbOrg())
+	expected := PeeringDbNetwork{Asn: "AS13335", Name: "Cloudflare", AKA: "Cloudflare, Inc.", OrgID: 4715, OrgName: "Cloudflare, Inc."}
+	if err != nil || network != expected {
+		t.Fatalf("PeeringDbLookupCtx(AS13335) answered %+v, %v", network, err)
+	}
+	// Unknown ASNs are cached too
+	for i := 0; i < 2; i++ {
+		if _, err := h.PeeringDbLookup("AS64496"); err != PeeringDbNotFoundError {
+			t.Fatalf("PeeringDbLookup(AS64496) failed with %v", err)
+		}
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("%d PeeringDB requests, expected 3", n)
+	}
+	if _, err := h.PeeringDbLookup("AS13335x"); err != MalformedAsnError {
+		t.Errorf("PeeringDbLookup(AS13335x) failed with %v", err)
+	}
+
+	// Rate limits are typed, and leave PeeringDB alone
+	throttle.Store(1)
+	requests.Store(0)
+	var limited *PeeringDbRateLimitedError
+	if _, err := h.PeeringDbLookup("AS3356"); !errors.As(err, &limited) || limited.RetryAfter != time.Second*30 {
+		t.Fatalf("throttled PeeringDbLookup failed with %v", err)
+	}
+	if _, err := h.PeeringDbLookup("AS174"); !errors.As(err, &limited) {
+		t.Fatalf("PeeringDbLookup during cooldown failed with %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d PeeringDB requests while throttled, expected 1", n)
+	}
+	// Cached answers are still available
+	if name, err := h.PeeringDbLookup("AS13335"); err != nil || name != "Cloudflare" {
+		t.Errorf("cached PeeringDbLookup answered '%s', %v", name, err)
+	}
+
+	// PeeringDB as a source of descriptions
+	h = newHandler(nil, time.Second)
+	h.peeringdb = ts.URL
+	throttle.Store(0)
+	if err := WithAsnSources(BuiltinSource(SourcePeeringDB), BuiltinSource(SourceCymru))(&h); err != nil {
+		t.Fatalf("WithAsnSources failed: %s", err)
+	}
+	if descr, err := h.LookupAsnDescr(ctx, "AS13335"); err != nil || descr != "Cloudflare" {
+		t.Errorf("LookupAsnDescr(AS13335) answered '%s', %v", descr, err)
+	}
+}
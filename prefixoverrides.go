@@ -0,0 +1,355 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// prefixOverridesRetry is the pause before loading prefix overrides again
+// after a failure.
+const prefixOverridesRetry = time.Minute
+
+// PrefixOverride is what is stored in the prefix overrides collection:
+// the ASN of the addresses of a prefix (see OverridesSetPrefix).
+type PrefixOverride struct {
+	// Prefix in CIDR notation ("192.0.2.0/24")
+	Prefix string `bson:"_id" json:"prefix"`
+	Asn    string `bson:"asn" json:"asn"`
+	Name   string `bson:"name" json:"name"`
+}
+
+// OverridesPrefixStore stores prefix overrides
+// (see WithPrefixOverrides).
+// Its methods are called concurrently.
+type OverridesPrefixStore interface {
+	// SetPrefix stores or replaces the override of a prefix.
+	SetPrefix(o PrefixOverride) error
+	// RemovePrefix removes the override of a prefix,
+	// without error if there is none.
+	RemovePrefix(prefix string) error
+	// ListPrefixes retrieves all prefix overrides, in any order.
+	ListPrefixes() ([]PrefixOverride, error)
+}
+
+// OverridesNoPrefixesError is returned by Overrides<...>Prefix<...> methods
+// when Handler has no prefix overrides (see WithPrefixOverrides).
+var OverridesNoPrefixesError = errors.New("no prefix overrides collection")
+
+// OverridesMalformedPrefixError is returned by OverridesSetPrefix
+// and OverridesRemovePrefix when parameter cidr is not a prefix
+// in CIDR notation, without host bits.
+var OverridesMalformedPrefixError = newClassError("malformed prefix", MalformedInputError)
+
+// prefixOverrides is the prefix overrides store of a handler,
+// and the trie of its overrides, rebuilt on changes.
+type prefixOverrides struct {
+	store OverridesPrefixStore
+	// Concurrent access control to the fields below
+	sync.RWMutex
+	// Overrides by prefix, nil until loaded
+	trie *prefixTrie[PrefixOverride]
+	// Time of the last failure to load overrides
+	failed time.Time
+}
+
+// WithPrefixOverrides makes LookupAsn answer the ASN of the addresses
+// of prefixes overriden in a store (see OverridesSetPrefix),
+// before consulting the cache or any source.
+// Overrides are loaded by the first lookup,
+// and reloaded on every change by the handler.
+//
+// Overrides only apply to lookups allowing SourceOverrides
+// (see WithSources).
+func WithPrefixOverrides(store OverridesPrefixStore) Option {
+	return func(h *Handler) error {
+		if store == nil {
+			return OverridesNoPrefixesError
+		}
+		h.prefixOverrides = &prefixOverrides{store: store}
+		return nil
+	}
+}
+
+// WithPrefixOverridesCollection is WithPrefixOverrides,
+// keeping prefix overrides in a MongoDB collection
+// separate from the overrides collection (see WithOverridesCollection).
+func WithPrefixOverridesCollection(c *mgo.Collection) Option {
+	return func(h *Handler) error {
+		if c == nil {
+			return OverridesNoPrefixesError
+		}
+		h.prefixOverrides = &prefixOverrides{store: &mongoPrefixOverrides{c}}
+		return nil
+	}
+}
+
+// parseOverridePrefix parses the prefix of an override.
+func parseOverridePrefix(cidr string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil || p.Addr().Zone() != "" || p != p.Masked() {
+		return netip.Prefix{}, OverridesMalformedPrefixError
+	}
+	return canonicalPrefix(p), nil
+}
+
+// OverridesSetPrefix stores or replaces the ASN, and its description,
+// of the addresses of a prefix in CIDR notation ("192.0.2.0/24"),
+// in the database of prefix overrides (see WithPrefixOverrides).
+// Addresses covered by several prefixes
+// take the override of the longest one.
+// Overrides without description are described
+// by the override of their ASN, if any (see OverridesSet).
+//
+// Moreover, this method purges the cache (see LookupAsn)
+// of the addresses of the prefix.
+func (h Handler) OverridesSetPrefix(cidr string, asn string, descr string) error {
+	if h.prefixOverrides == nil {
+		return OverridesNoPrefixesError
+	}
+	p, err := parseOverridePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	asn, err = canonicalASN(asn)
+	if err != nil {
+		return OverridesMalformedAsnError
+	}
+	defer h.cache.purgePrefix(p)
+	err = h.prefixOverrides.change(func(store OverridesPrefixStore) error {
+		if err := store.SetPrefix(PrefixOverride{p.String(), asn, descr}); err != nil {
+			return fmt.Errorf("cannot set prefix override: %w", &SourceError{SourceOverrides, err})
+		}
+		return nil
+	})
+	if err == nil {
+		h.logOverride("prefix override set", "prefix", p.String(), "asn", asn, "descr", descr)
+	}
+	return err
+}
+
+// OverridesRemovePrefix removes the override of a prefix
+// from the database of prefix overrides.
+// If there is no such prefix,
+// OverridesRemovePrefix returns silently without error.
+//
+// Moreover, this method purges the cache (see LookupAsn)
+// of the addresses of the prefix.
+func (h Handler) OverridesRemovePrefix(cidr string) error {
+	if h.prefixOverrides == nil {
+		return OverridesNoPrefixesError
+	}
+	p, err := parseOverridePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	defer h.cache.purgePrefix(p)
+	err = h.prefixOverrides.change(func(store OverridesPrefixStore) error {
+		if err := store.RemovePrefix(p.String()); err != nil {
+			return fmt.Errorf("cannot remove prefix override: %w", &SourceError{SourceOverrides, err})
+		}
+		return nil
+	})
+	if err == nil {
+		h.logOverride("prefix override removed", "prefix", p.String())
+	}
+	return err
+}
+
+// OverridesListPrefixes answers all prefix overrides, in prefix order.
+func (h Handler) OverridesListPrefixes() ([]PrefixOverride, error) {
+	if h.prefixOverrides == nil {
+		return nil, OverridesNoPrefixesError
+	}
+	answer, err := h.prefixOverrides.store.ListPrefixes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve prefix overrides: %w", &SourceError{SourceOverrides, err})
+	}
+	if answer == nil {
+		return make([]PrefixOverride, 0), nil
+	}
+	sortPrefixOverrides(answer)
+	return answer, nil
+}
+
+// sortPrefixOverrides sorts overrides by prefix,
+// IPv4 first, then by address and length,
+// malformed prefixes last.
+func sortPrefixOverrides(overrides []PrefixOverride) {
+	sort.Slice(overrides, func(i, j int) bool {
+		pi, erri := netip.ParsePrefix(overrides[i].Prefix)
+		pj, errj := netip.ParsePrefix(overrides[j].Prefix)
+		if erri != nil || errj != nil {
+			return errj != nil && (erri == nil || overrides[i].Prefix < overrides[j].Prefix)
+		}
+		if c := pi.Addr().Compare(pj.Addr()); c != 0 {
+			return c < 0
+		}
+		return pi.Bits() < pj.Bits()
+	})
+}
+
+// change applies a change to the store, then rebuilds the trie.
+func (o *prefixOverrides) change(fn func(OverridesPrefixStore) error) error {
+	o.Lock()
+	defer o.Unlock()
+	if err := fn(o.store); err != nil {
+		return err
+	}
+	if err := o.load(); err != nil {
+		log.Printf("warning: %s\n", err)
+	}
+	return nil
+}
+
+// load rebuilds the trie from the store.
+// Overrides of malformed prefixes or ASNs, written by others, are skipped.
+// Callers must hold the lock.
+func (o *prefixOverrides) load() error {
+	overrides, err := o.store.ListPrefixes()
+	if err != nil {
+		o.trie, o.failed = nil, time.Now()
+		return fmt.Errorf("cannot load prefix overrides: %w", &SourceError{SourceOverrides, err})
+	}
+	trie := newPrefixTrie[PrefixOverride]()
+	for _, override := range overrides {
+		p, err := parseOverridePrefix(override.Prefix)
+		if err != nil {
+			continue
+		}
+		if override.Asn, err = canonicalASN(override.Asn); err != nil {
+			continue
+		}
+		trie.insert(p, override)
+	}
+	o.trie = trie
+	return nil
+}
+
+// lookup finds the override of the longest prefix covering an address,
+// loading overrides first if needed.
+// Lookups go on without overrides while they cannot be loaded.
+//
+// Returns the override and whether there is one.
+func (o *prefixOverrides) lookup(addr netip.Addr) (PrefixOverride, bool) {
+	o.RLock()
+	trie, failed := o.trie, o.failed
+	o.RUnlock()
+	if trie == nil {
+		if time.Since(failed) < prefixOverridesRetry {
+			return PrefixOverride{}, false
+		}
+		o.Lock()
+		if o.trie == nil && time.Since(o.failed) >= prefixOverridesRetry {
+			if err := o.load(); err != nil {
+				log.Printf("warning: %s\n", err)
+			}
+		}
+		trie = o.trie
+		o.Unlock()
+		if trie == nil {
+			return PrefixOverride{}, false
+		}
+	}
+	_, override, ok := trie.lookup(addr)
+	return override, ok
+}
+
+// mongoPrefixOverrides is the OverridesPrefixStore of a MongoDB collection.
+type mongoPrefixOverrides struct {
+	c *mgo.Collection
+}
+
+// SetPrefix stores or replaces the override of a prefix.
+func (m *mongoPrefixOverrides) SetPrefix(o PrefixOverride) error {
+	_, err := m.c.UpsertId(o.Prefix, o)
+	return err
+}
+
+// RemovePrefix removes the override of a prefix, if any.
+func (m *mongoPrefixOverrides) RemovePrefix(prefix string) error {
+	err := m.c.RemoveId(prefix)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// ListPrefixes retrieves all prefix overrides.
+func (m *mongoPrefixOverrides) ListPrefixes() ([]PrefixOverride, error) {
+	var answer []PrefixOverride
+	err := m.c.Find(nil).All(&answer)
+	return answer, err
+}
+
+// MemoryPrefixOverrides is an OverridesPrefixStore
+// keeping prefix overrides in memory, for tests and small deployments.
+// It is safe for concurrent use.
+type MemoryPrefixOverrides struct {
+	mu        sync.RWMutex
+	overrides map[string]PrefixOverride
+}
+
+// NewMemoryPrefixOverrides returns an empty MemoryPrefixOverrides,
+// to be passed to WithPrefixOverrides.
+func NewMemoryPrefixOverrides() *MemoryPrefixOverrides {
+	return &MemoryPrefixOverrides{overrides: make(map[string]PrefixOverride)}
+}
+
+// SetPrefix stores or replaces the override of a prefix.
+func (m *MemoryPrefixOverrides) SetPrefix(o PrefixOverride) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[o.Prefix] = o
+	return nil
+}
+
+// RemovePrefix removes the override of a prefix, if any.
+func (m *MemoryPrefixOverrides) RemovePrefix(prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.overrides, prefix)
+	return nil
+}
+
+// ListPrefixes retrieves all prefix overrides.
+func (m *MemoryPrefixOverrides) ListPrefixes() ([]PrefixOverride, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	answer := make([]PrefixOverride, 0, len(m.overrides))
+	for _, o := range m.overrides {
+		answer = append(answer, o)
+	}
+	return answer, nil
+}
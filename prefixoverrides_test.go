@@ -0,0 +1,170 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// failingPrefixStore is an OverridesPrefixStore failing to list overrides.
+type failingPrefixStore struct {
+	*MemoryPrefixOverrides
+}
+
+func (failingPrefixStore) ListPrefixes() ([]PrefixOverride, error) {
+	return nil, errors.New("prefix collection unavailable")
+}
+
+func TestOverridesSetPrefix(t *testing.T) {
+	h := NewFixtureHandler()
+	if err := h.OverridesSetPrefix("8.8.8.0/24", "AS15169", "Google"); err != OverridesNoPrefixesError {
+		t.Fatalf("OverridesSetPrefix failed with %v without prefix overrides", err)
+	}
+	h.overrides = NewMemoryOverrides()
+	store := NewMemoryPrefixOverrides()
+	// Overrides stored beforehand are loaded by the first lookup
+	store.SetPrefix(PrefixOverride{"1.1.0.0/16", "AS64500", "Anycast"})
+	store.SetPrefix(PrefixOverride{"bogus", "AS64500", "Ignored"})
+	if err := WithPrefixOverrides(store)(&h); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(ip, asn, descr string) {
+		t.Helper()
+		if a, d, err := h.LookupAsn(ip); err != nil || a != asn || d != descr {
+			t.Fatalf("LookupAsn(%s) answered %s, '%s', %v", ip, a, d, err)
+		}
+	}
+	lookup("1.1.1.1", "AS64500", "Anycast")
+	lookup("8.8.8.8", "AS15169", "GOOGLE, US")
+
+	for _, cidr := range []string{"", "8.8.8.8", "8.8.8.0/33", "8.8.8.1/24", "2001:db8::1/32", "8.8.8.0/24/1", "google"} {
+		if err := h.OverridesSetPrefix(cidr, "AS15169", "Google"); err != OverridesMalformedPrefixError {
+			t.Errorf("OverridesSetPrefix(%q) failed with %v", cidr, err)
+		}
+	}
+	if err := h.OverridesRemovePrefix("8.8.8.1/24"); err != OverridesMalformedPrefixError {
+		t.Errorf("OverridesRemovePrefix of a malformed prefix failed with %v", err)
+	}
+	if err := h.OverridesSetPrefix("8.8.8.0/24", "Google", "Google"); err != OverridesMalformedAsnError {
+		t.Errorf("OverridesSetPrefix of a malformed ASN failed with %v", err)
+	}
+
+	// The longest prefix wins, over cached answers
+	for _, o := range []PrefixOverride{
+		{"8.0.0.0/8", "as3356", "Level 3"},
+		{"8.8.8.0/24", "15169", "Google anycast"},
+		{"8.8.8.8/32", "AS15169", ""},
+		{"2001:4860::/32", "AS15169", "Google"},
+		{"::ffff:1.1.1.0/120", "AS13335", "Cloudflare"},
+	} {
+		if err := h.OverridesSetPrefix(o.Prefix, o.Asn, o.Name); err != nil {
+			t.Fatalf("OverridesSetPrefix(%s) failed: %s", o.Prefix, err)
+		}
+	}
+	if err := h.OverridesSet("AS15169", "Alphabet"); err != nil {
+		t.Fatal(err)
+	}
+	lookup("8.1.2.3", "AS3356", "Level 3")
+	lookup("8.8.8.4", "AS15169", "Google anycast")
+	lookup("8.8.8.8", "AS15169", "Alphabet")
+	lookup("2001:4860::8888", "AS15169", "Google")
+	lookup("1.1.1.1", "AS13335", "Cloudflare")
+	lookup("1.1.2.1", "AS64500", "Anycast")
+	info, err := h.LookupAsnDetailed(context.Background(), "8.8.8.4")
+	if err != nil || info.Source != SourceOverrides || info.DescrSource != SourceOverrides {
+		t.Errorf("LookupAsnDetailed answered %+v, %v", info, err)
+	}
+	overrides, err := h.OverridesListPrefixes()
+	expected := []PrefixOverride{
+		{"1.1.0.0/16", "AS64500", "Anycast"},
+		{"1.1.1.0/24", "AS13335", "Cloudflare"},
+		{"8.0.0.0/8", "AS3356", "Level 3"},
+		{"8.8.8.0/24", "AS15169", "Google anycast"},
+		{"8.8.8.8/32", "AS15169", ""},
+		{"2001:4860::/32", "AS15169", "Google"},
+		{"bogus", "AS64500", "Ignored"},
+	}
+	if err != nil || !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("OverridesListPrefixes answered %+v, %v", overrides, err)
+	}
+	// Lookups without overrides
+	if a, _, err := h.LookupAsnCtx(context.Background(), "8.8.8.8", WithSources(SourceFixtures)); err != nil || a != "AS15169" {
+		t.Errorf("LookupAsnCtx without overrides answered %s, %v", a, err)
+	}
+	if a, _, err := h.LookupAsnCtx(context.Background(), "8.1.2.3", WithSources(SourceFixtures)); err == nil {
+		t.Errorf("LookupAsnCtx without overrides answered %s", a)
+	}
+
+	// Removing is idempotent
+	for i := 0; i < 2; i++ {
+		if err := h.OverridesRemovePrefix("8.8.8.0/24"); err != nil {
+			t.Fatalf("OverridesRemovePrefix failed: %s", err)
+		}
+	}
+	lookup("8.8.8.4", "AS3356", "Level 3")
+	for _, cidr := range []string{"8.0.0.0/8", "8.8.8.8/32"} {
+		if err := h.OverridesRemovePrefix(cidr); err != nil {
+			t.Fatalf("OverridesRemovePrefix failed: %s", err)
+		}
+	}
+	lookup("8.8.8.4", "AS15169", "Alphabet")
+
+	// Lookups go on while overrides cannot be loaded
+	h = NewFixtureHandler()
+	if err := WithPrefixOverrides(failingPrefixStore{NewMemoryPrefixOverrides()})(&h); err != nil {
+		t.Fatal(err)
+	}
+	lookup("1.1.1.1", "AS13335", "CLOUDFLARENET, US")
+	if err := h.OverridesSetPrefix("1.1.1.0/24", "AS64500", "Anycast"); err != nil {
+		t.Fatalf("OverridesSetPrefix failed: %s", err)
+	}
+	lookup("1.1.1.1", "AS13335", "CLOUDFLARENET, US")
+}
+
+func BenchmarkPrefixOverridesLookup(b *testing.B) {
+	o := &prefixOverrides{store: NewMemoryPrefixOverrides()}
+	// A few thousand overlapping prefixes
+	for i := 0; i < 4096; i++ {
+		o.store.SetPrefix(PrefixOverride{fmt.Sprintf("%d.%d.0.0/16", 1+i/256, i%256), "AS64500", "Anycast"})
+		o.store.SetPrefix(PrefixOverride{fmt.Sprintf("%d.%d.%d.0/24", 1+i/256, i%256, i%256), "AS64501", "Anycast"})
+	}
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		addrs[i] = netip.AddrFrom4([4]byte{byte(1 + i%16), byte(i), byte(i), byte(i)})
+	}
+	if _, ok := o.lookup(addrs[0]); !ok {
+		b.Fatal("no override found")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o.lookup(addrs[i%len(addrs)])
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// prefixDeltaThreshold is the default share of a prefixTable
+// a dataset may change for the table to be updated in place.
+const prefixDeltaThreshold = 0.1
+
+// prefixStream streams a dataset of prefixes to yield, in any order,
+// until yield returns false.
+// A prefix streamed twice takes its last value.
+//
+// Returns an error if the dataset cannot be read.
+type prefixStream[V any] func(yield func(netip.Prefix, V) bool) error
+
+// prefixTable is a prefixTrie guarded by a lock,
+// replaced by new datasets either in place, applying their delta,
+// or by a rebuild when they differ too much.
+//
+// Building a whole new trie before swapping it in
+// doubles memory usage while both tries exist;
+// a delta is computed by streaming the new dataset against the trie,
+// and applied in place, locking lookups out for its duration only.
+type prefixTable[V comparable] struct {
+	// Concurrent access control to trie
+	sync.RWMutex
+	trie *prefixTrie[V]
+	// Largest share of the table a delta applied in place may change
+	threshold float64
+	// Generation of the last update (see trieNode.mark)
+	gen uint32
+}
+
+// prefixUpdate describes how a prefixTable was updated.
+type prefixUpdate struct {
+	// Prefixes added, whose value changed, and removed;
+	// rebuilds count all prefixes as added
+	Added   int
+	Changed int
+	Removed int
+	// Whether the table was rebuilt rather than updated in place
+	Rebuilt bool
+}
+
+// newPrefixTable returns an empty initialized prefixTable.
+// Pass zero threshold for the default share (10%).
+func newPrefixTable[V comparable](threshold float64) *prefixTable[V] {
+	if threshold <= 0 {
+		threshold = prefixDeltaThreshold
+	}
+	return &prefixTable[V]{
+		trie:      newPrefixTrie[V](),
+		threshold: threshold,
+	}
+}
+
+// lookup finds the longest prefix containing a given address.
+//
+// Returns the matched prefix, its value, and whether a match was found.
+func (t *prefixTable[V]) lookup(addr netip.Addr) (netip.Prefix, V, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.trie.lookup(addr)
+}
+
+// len returns the number of prefixes in the table.
+func (t *prefixTable[V]) len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return t.trie.len
+}
+
+// update replaces the contents of the table by a streamed dataset.
+// The table is updated in place if the delta between the table
+// and the dataset changes at most its threshold share of the table,
+// and rebuilt otherwise.
+//
+// Updates must not run concurrently.
+// If the stream fails, the table is left unchanged.
+//
+// Returns the update made.
+func (t *prefixTable[V]) update(stream prefixStream[V]) (prefixUpdate, error) {
+	// Only updates modify the trie, which this one may read without lock,
+	// and mark the nodes of the prefixes streamed
+	cur := t.trie
+	t.gen++
+	gen := t.gen
+	limit := int(t.threshold * float64(cur.len))
+	changes := make(map[netip.Prefix]V)
+	var rebuilt *prefixTrie[V]
+	err := stream(func(p netip.Prefix, value V) bool {
+		if !p.IsValid() {
+			return true
+		}
+		p = canonicalPrefix(p)
+		if rebuilt != nil {
+			rebuilt.insert(p, value)
+			return true
+		}
+		if node := cur.node(p); node != nil {
+			node.mark = gen
+			if node.value == value {
+				// Back to its current value if streamed twice
+				delete(changes, p)
+				return true
+			}
+		}
+		changes[p] = value
+		if len(changes) > limit {
+			// Too many changes, rebuild from what was streamed so far
+			rebuilt = t.rebuild(changes)
+			changes = nil
+		}
+		return true
+	})
+	if err != nil {
+		return prefixUpdate{}, err
+	}
+	var (
+		u       prefixUpdate
+		removed []netip.Prefix
+	)
+	if rebuilt == nil {
+		cur.walkNodes(func(n *trieNode[V]) bool {
+			if n.mark != gen {
+				removed = append(removed, n.prefix)
+			}
+			return len(changes)+len(removed) <= limit
+		})
+		if len(changes)+len(removed) > limit {
+			// Too many removals
+			rebuilt = t.rebuild(changes)
+		}
+	}
+	if rebuilt != nil {
+		t.Lock()
+		t.trie = rebuilt
+		t.Unlock()
+		return prefixUpdate{Added: rebuilt.len, Rebuilt: true}, nil
+	}
+	for p := range changes {
+		if cur.node(p) == nil {
+			u.Added++
+		}
+	}
+	u.Changed = len(changes) - u.Added
+	u.Removed = len(removed)
+	t.Lock()
+	defer t.Unlock()
+	for _, p := range removed {
+		cur.remove(p)
+	}
+	for p, v := range changes {
+		cur.insert(p, v)
+	}
+	return u, nil
+}
+
+// rebuild builds a new trie of the prefixes
+// streamed by the current update so far,
+// given the changes to the table they make.
+func (t *prefixTable[V]) rebuild(changes map[netip.Prefix]V) *prefixTrie[V] {
+	trie := newPrefixTrie[V]()
+	t.trie.walkNodes(func(n *trieNode[V]) bool {
+		if n.mark == t.gen {
+			trie.insert(n.prefix, n.value)
+		}
+		return true
+	})
+	for p, v := range changes {
+		trie.insert(p, v)
+	}
+	return trie
+}
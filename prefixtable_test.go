@@ -0,0 +1,202 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+// randomPrefixes returns n random prefixes of both families
+// mapped to random values.
+func randomPrefixes(r *rand.Rand, n int) map[netip.Prefix]int {
+	prefixes := make(map[netip.Prefix]int, n)
+	for len(prefixes) < n {
+		var addr netip.Addr
+		var bits int
+		if r.Intn(4) == 0 {
+			var b [16]byte
+			r.Read(b[:])
+			addr, bits = netip.AddrFrom16(b), 16+r.Intn(33)
+		} else {
+			var b [4]byte
+			r.Read(b[:])
+			addr, bits = netip.AddrFrom4(b), 8+r.Intn(17)
+		}
+		p, _ := addr.Prefix(bits)
+		prefixes[p] = r.Intn(100000)
+	}
+	return prefixes
+}
+
+// streamPrefixes streams a dataset.
+func streamPrefixes(prefixes map[netip.Prefix]int) prefixStream[int] {
+	return func(yield func(netip.Prefix, int) bool) error {
+		for p, v := range prefixes {
+			if !yield(p, v) {
+				break
+			}
+		}
+		return nil
+	}
+}
+
+// randomDelta changes, removes and adds n prefixes of a dataset,
+// in equal shares.
+//
+// Returns the new dataset.
+func randomDelta(r *rand.Rand, prefixes map[netip.Prefix]int, n int) map[netip.Prefix]int {
+	next := make(map[netip.Prefix]int, len(prefixes)+n)
+	for p, v := range prefixes {
+		next[p] = v
+	}
+	i := 0
+	for p := range prefixes {
+		if i == 2*n/3 {
+			break
+		}
+		if i%2 == 0 {
+			next[p] = -1 - next[p]
+		} else {
+			delete(next, p)
+		}
+		i++
+	}
+	for added := i; added < n; {
+		for p, v := range randomPrefixes(r, n-added) {
+			_, old := prefixes[p]
+			if _, ok := next[p]; !ok && !old && added < n {
+				next[p] = v
+				added++
+			}
+		}
+	}
+	return next
+}
+
+// walkTrie returns the contents of a trie, in walk order.
+func walkTrie(trie *prefixTrie[int]) []string {
+	var walked []string
+	trie.walk(func(p netip.Prefix, v int) bool {
+		walked = append(walked, fmt.Sprintf("%s=%d", p, v))
+		return true
+	})
+	return walked
+}
+
+func TestPrefixTableUpdate(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	prefixes := randomPrefixes(r, 20000)
+	table := newPrefixTable[int](0)
+	u, err := table.update(streamPrefixes(prefixes))
+	if err != nil || !u.Rebuilt || u.Added != len(prefixes) {
+		t.Fatalf("initial update returned %+v, %v", u, err)
+	}
+	for round, n := range []int{0, 1, 150, 1500, 1999, 5000} {
+		next := randomDelta(r, prefixes, n)
+		u, err := table.update(streamPrefixes(next))
+		if err != nil {
+			t.Fatalf("update failed: %s", err)
+		}
+		if u.Rebuilt != (float64(n) > table.threshold*float64(len(prefixes))) {
+			t.Fatalf("round %d: update of %d prefixes returned %+v", round, n, u)
+		}
+		if !u.Rebuilt && u.Added+u.Changed+u.Removed != n {
+			t.Fatalf("round %d: update of %d prefixes returned %+v", round, n, u)
+		}
+		// Compare with a trie built from scratch
+		scratch := newPrefixTrie[int]()
+		for p, v := range next {
+			scratch.insert(p, v)
+		}
+		got, want := walkTrie(table.trie), walkTrie(scratch)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("round %d: table differs from a trie built from scratch", round)
+		}
+		for i := 0; i < 1000; i++ {
+			var b [4]byte
+			r.Read(b[:])
+			addr := netip.AddrFrom4(b)
+			p1, v1, ok1 := table.lookup(addr)
+			p2, v2, ok2 := scratch.lookup(addr)
+			if p1 != p2 || v1 != v2 || ok1 != ok2 {
+				t.Fatalf("round %d: lookup(%s) returned %s=%d, expected %s=%d", round, addr, p1, v1, p2, v2)
+			}
+		}
+		prefixes = next
+	}
+	// Failed streams leave the table unchanged
+	before := walkTrie(table.trie)
+	fail := errors.New("truncated dataset")
+	_, err = table.update(func(yield func(netip.Prefix, int) bool) error {
+		yield(netip.MustParsePrefix("192.0.2.0/24"), 1)
+		return fail
+	})
+	if err != fail || fmt.Sprint(walkTrie(table.trie)) != fmt.Sprint(before) {
+		t.Fatalf("failed update returned %v or changed the table", err)
+	}
+}
+
+// BenchmarkPrefixTableUpdate measures the heap high watermark
+// of updating a table of 500K prefixes with 1% of changes,
+// in place or by a rebuild.
+func BenchmarkPrefixTableUpdate(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	prefixes := randomPrefixes(r, 500000)
+	next := randomDelta(r, prefixes, 5000)
+	for _, threshold := range []float64{prefixDeltaThreshold, 1e-9} {
+		name := "delta"
+		if threshold < prefixDeltaThreshold {
+			name = "rebuild"
+		}
+		b.Run(name, func(b *testing.B) {
+			defer debug.SetGCPercent(debug.SetGCPercent(-1))
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				table := newPrefixTable[int](threshold)
+				table.update(streamPrefixes(prefixes))
+				runtime.GC()
+				var before, after runtime.MemStats
+				runtime.ReadMemStats(&before)
+				b.StartTimer()
+				table.update(streamPrefixes(next))
+				b.StopTimer()
+				// Without GC, the heap only grows during the update
+				runtime.ReadMemStats(&after)
+				peak += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(table)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(peak)/float64(b.N)/(1<<20), "peak-MB/op")
+		})
+	}
+}
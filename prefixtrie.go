@@ -0,0 +1,254 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"net/netip"
+)
+
+// prefixTrie is a binary trie of IP prefixes
+// supporting longest prefix match lookups.
+//
+// IPv4 prefixes and IPv4-mapped IPv6 prefixes share the same branch.
+// A prefixTrie is not safe for concurrent modification;
+// users swap whole tries or guard them with a lock.
+type prefixTrie[V any] struct {
+	v4  *trieNode[V]
+	v6  *trieNode[V]
+	len int
+}
+
+// trieNode is a prefixTrie node,
+// holding a value if set is true.
+type trieNode[V any] struct {
+	child  [2]*trieNode[V]
+	prefix netip.Prefix
+	value  V
+	set    bool
+	// Generation of the last prefixTable update streaming this prefix
+	mark uint32
+}
+
+// newPrefixTrie returns an empty initialized prefixTrie.
+func newPrefixTrie[V any]() *prefixTrie[V] {
+	return &prefixTrie[V]{
+		v4: &trieNode[V]{},
+		v6: &trieNode[V]{},
+	}
+}
+
+// canonicalPrefix masks a prefix and unmaps IPv4-mapped IPv6 prefixes.
+func canonicalPrefix(p netip.Prefix) netip.Prefix {
+	addr, bits := p.Addr(), p.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	p, _ = addr.Prefix(bits)
+	return p
+}
+
+// root returns the branch of a given address family.
+func (t *prefixTrie[V]) root(addr netip.Addr) *trieNode[V] {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// addrBit answers the i-th most significant bit of an address.
+func addrBit(a netip.Addr, i int) int {
+	if a.Is4() {
+		b := a.As4()
+		return int(b[i/8]>>(7-uint(i%8))) & 1
+	}
+	b := a.As16()
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+// insert stores a value under a given prefix,
+// replacing any value previously stored under the same prefix.
+func (t *prefixTrie[V]) insert(p netip.Prefix, value V) {
+	if !p.IsValid() {
+		return
+	}
+	p = canonicalPrefix(p)
+	node := t.root(p.Addr())
+	for i := 0; i < p.Bits(); i++ {
+		bit := addrBit(p.Addr(), i)
+		if node.child[bit] == nil {
+			node.child[bit] = &trieNode[V]{}
+		}
+		node = node.child[bit]
+	}
+	if !node.set {
+		t.len++
+	}
+	node.prefix = p
+	node.value = value
+	node.set = true
+}
+
+// get retrieves the value stored under a given prefix.
+//
+// Returns the value and whether there is one.
+func (t *prefixTrie[V]) get(p netip.Prefix) (V, bool) {
+	if node := t.node(p); node != nil {
+		return node.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// node finds the node holding the value of a given prefix.
+//
+// Returns the node, or nil if there is no value under that prefix.
+func (t *prefixTrie[V]) node(p netip.Prefix) *trieNode[V] {
+	if !p.IsValid() {
+		return nil
+	}
+	p = canonicalPrefix(p)
+	node := t.root(p.Addr())
+	for i := 0; i < p.Bits() && node != nil; i++ {
+		node = node.child[addrBit(p.Addr(), i)]
+	}
+	if node == nil || !node.set {
+		return nil
+	}
+	return node
+}
+
+// remove deletes the value stored under a given prefix,
+// pruning the nodes left without values below them.
+//
+// Returns whether there was such a value.
+func (t *prefixTrie[V]) remove(p netip.Prefix) bool {
+	if !p.IsValid() {
+		return false
+	}
+	p = canonicalPrefix(p)
+	path := make([]*trieNode[V], 1, p.Bits()+1)
+	path[0] = t.root(p.Addr())
+	for i := 0; i < p.Bits(); i++ {
+		next := path[i].child[addrBit(p.Addr(), i)]
+		if next == nil {
+			return false
+		}
+		path = append(path, next)
+	}
+	node := path[len(path)-1]
+	if !node.set {
+		return false
+	}
+	var zero V
+	node.value = zero
+	node.set = false
+	t.len--
+	// Prune, keeping roots
+	for i := len(path) - 1; i > 0; i-- {
+		n := path[i]
+		if n.set || n.child[0] != nil || n.child[1] != nil {
+			break
+		}
+		path[i-1].child[addrBit(p.Addr(), i-1)] = nil
+	}
+	return true
+}
+
+// lookup finds the longest prefix containing a given address.
+//
+// Returns the matched prefix, its value, and whether a match was found.
+func (t *prefixTrie[V]) lookup(addr netip.Addr) (netip.Prefix, V, bool) {
+	if !addr.IsValid() {
+		var zero V
+		return netip.Prefix{}, zero, false
+	}
+	addr = addr.Unmap().WithZone("")
+	return t.match(addr, addr.BitLen())
+}
+
+// cover finds the longest prefix covering a given prefix,
+// ignoring more specific prefixes.
+//
+// Returns the matched prefix, its value, and whether a match was found.
+func (t *prefixTrie[V]) cover(p netip.Prefix) (netip.Prefix, V, bool) {
+	if !p.IsValid() {
+		var zero V
+		return netip.Prefix{}, zero, false
+	}
+	p = canonicalPrefix(p)
+	return t.match(p.Addr(), p.Bits())
+}
+
+// match finds the longest prefix of at most a given length
+// containing a given canonical address.
+func (t *prefixTrie[V]) match(addr netip.Addr, bits int) (netip.Prefix, V, bool) {
+	var (
+		prefix netip.Prefix
+		value  V
+		found  bool
+	)
+	node := t.root(addr)
+	for i := 0; node != nil; i++ {
+		if node.set {
+			prefix, value, found = node.prefix, node.value, true
+		}
+		if i == bits {
+			break
+		}
+		node = node.child[addrBit(addr, i)]
+	}
+	return prefix, value, found
+}
+
+// walk calls fn for every prefix in the trie,
+// in address order with covering prefixes first,
+// until fn returns false.
+func (t *prefixTrie[V]) walk(fn func(netip.Prefix, V) bool) {
+	t.walkNodes(func(n *trieNode[V]) bool {
+		return fn(n.prefix, n.value)
+	})
+}
+
+// walkNodes calls fn for every node holding a value,
+// in the order of walk, until fn returns false.
+func (t *prefixTrie[V]) walkNodes(fn func(*trieNode[V]) bool) {
+	if t.v4.walkNodes(fn) {
+		t.v6.walkNodes(fn)
+	}
+}
+
+// walkNodes is the recursive part of prefixTrie.walkNodes.
+//
+// Returns false if the walk was stopped.
+func (n *trieNode[V]) walkNodes(fn func(*trieNode[V]) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.set && !fn(n) {
+		return false
+	}
+	return n.child[0].walkNodes(fn) && n.child[1].walkNodes(fn)
+}
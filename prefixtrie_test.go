@@ -0,0 +1,94 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	trie := newPrefixTrie[string]()
+	for _, p := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "0.0.0.0/0", "2001:db8::/32", "::ffff:192.0.2.0/120"} {
+		trie.insert(netip.MustParsePrefix(p), p)
+	}
+	tests := []struct {
+		ip     string
+		prefix string
+	}{
+		{"10.1.2.3", "10.1.2.0/24"},
+		{"10.1.3.3", "10.1.0.0/16"},
+		{"10.2.3.3", "10.0.0.0/8"},
+		{"11.2.3.3", "0.0.0.0/0"},
+		{"192.0.2.1", "::ffff:192.0.2.0/120"},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+	}
+	for _, test := range tests {
+		_, value, ok := trie.lookup(netip.MustParseAddr(test.ip))
+		if value != test.prefix || ok != (test.prefix != "") {
+			t.Fatalf("lookup(%s) returned '%s', %v", test.ip, value, ok)
+		}
+	}
+	for _, test := range []struct {
+		prefix string
+		cover  string
+	}{
+		{"10.1.2.0/24", "10.1.2.0/24"},
+		{"10.1.2.0/23", "10.1.0.0/16"},
+		{"10.1.0.0/15", "10.0.0.0/8"},
+		{"::ffff:10.1.2.0/112", "10.1.0.0/16"},
+		{"2001:db8::/16", ""},
+	} {
+		_, value, ok := trie.cover(netip.MustParsePrefix(test.prefix))
+		if value != test.cover || ok != (test.cover != "") {
+			t.Fatalf("cover(%s) returned '%s', %v", test.prefix, value, ok)
+		}
+	}
+	if !trie.remove(netip.MustParsePrefix("10.1.0.0/16")) {
+		t.Fatalf("remove failed")
+	}
+	if _, value, _ := trie.lookup(netip.MustParseAddr("10.1.3.3")); value != "10.0.0.0/8" {
+		t.Fatalf("lookup after remove returned '%s'", value)
+	}
+	var walked []string
+	trie.walk(func(p netip.Prefix, _ string) bool {
+		walked = append(walked, p.String())
+		return true
+	})
+	if len(walked) != trie.len || len(walked) != 5 {
+		t.Fatalf("unexpected walk: %v", walked)
+	}
+	// Removals prune empty branches
+	for _, p := range walked {
+		if !trie.remove(netip.MustParsePrefix(p)) {
+			t.Fatalf("remove(%s) failed", p)
+		}
+	}
+	if trie.len != 0 || trie.v4.child != [2]*trieNode[string]{} || trie.v6.child != [2]*trieNode[string]{} {
+		t.Fatalf("trie not pruned after removing all prefixes")
+	}
+}
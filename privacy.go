@@ -0,0 +1,103 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// privacySecretSize is the size of generated privacy secrets.
+const privacySecretSize = 32
+
+// UnavailableInPrivacyModeError is returned by features
+// that need cached IP addresses in the clear,
+// when privacy mode is enabled (see WithPrivacy).
+var UnavailableInPrivacyModeError = errors.New("unavailable in privacy mode")
+
+// WithPrivacy enables privacy mode:
+// the ASN cache is keyed by an HMAC-SHA256 of IP addresses
+// instead of the addresses themselves,
+// so that its content cannot be mapped back to client addresses.
+// Lookups work the same, the hash being computed again.
+//
+// Parameter secret is the HMAC key;
+// pass nil for a random key, which makes the cache
+// specific to the process.
+//
+// In privacy mode, LookupIp answers nothing,
+// and CachePurgePrefix fails with UnavailableInPrivacyModeError.
+func WithPrivacy(secret []byte) Option {
+	return func(h *Handler) error {
+		if len(secret) == 0 {
+			secret = make([]byte, privacySecretSize)
+			if _, err := rand.Read(secret); err != nil {
+				return fmt.Errorf("cannot generate privacy secret: %w", err)
+			}
+		}
+		h.privacy = &privacy{secret}
+		return nil
+	}
+}
+
+// privacy is the privacy mode configuration.
+type privacy struct {
+	secret []byte
+}
+
+// cacheKey returns the ASN cache key of an IP address:
+// the address itself, or its keyed hash in privacy mode,
+// truncated first if the handler anonymizes addresses.
+func (h Handler) cacheKey(ip string) string {
+	ip = h.anonymizeIP(ip)
+	if h.privacy == nil {
+		return ip
+	}
+	mac := hmac.New(sha256.New, h.privacy.secret)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CachePurgePrefix removes from the ASN cache
+// the entries of IP addresses within a given prefix.
+//
+// Returns UnavailableInPrivacyModeError in privacy mode (see WithPrivacy),
+// where cached addresses are unknown.
+func (h Handler) CachePurgePrefix(prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return MalformedPrefixError
+	}
+	if h.privacy != nil {
+		return UnavailableInPrivacyModeError
+	}
+	h.cache.purgePrefix(prefix.Masked())
+	return nil
+}
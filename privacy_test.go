@@ -0,0 +1,92 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrivacy(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	if err := WithPrivacy([]byte("secret"))(&h); err != nil {
+		t.Fatalf("WithPrivacy failed: %s", err)
+	}
+	h.cache.store(h.cacheKey("8.8.8.8"), cacheEntry{asn: "AS15169", descr: "GOOGLE"})
+	// Lookups hash the address again
+	entry, err := h.lookupAsn(context.Background(), "8.8.8.8", lookupConfig{})
+	if err != nil || entry.asn != "AS15169" {
+		t.Fatalf("lookupAsn returned %+v, %v", entry, err)
+	}
+	// No address in the clear
+	for _, key := range h.cache.keys() {
+		if strings.Contains(key, "8.8.8.8") {
+			t.Fatalf("cache key '%s' holds the address", key)
+		}
+	}
+	if ips := h.LookupIp("AS15169"); len(ips) != 0 {
+		t.Fatalf("LookupIp answered %v", ips)
+	}
+	if err := h.CachePurgePrefix(netip.MustParsePrefix("8.8.8.0/24")); err != UnavailableInPrivacyModeError {
+		t.Fatalf("unexpected CachePurgePrefix error: %v", err)
+	}
+	// Keys depend on the secret
+	other := newHandler(nil, time.Second)
+	if err := WithPrivacy(nil)(&other); err != nil {
+		t.Fatalf("WithPrivacy failed: %s", err)
+	}
+	if other.cacheKey("8.8.8.8") == h.cacheKey("8.8.8.8") {
+		t.Fatalf("random secret gave the same key")
+	}
+}
+
+func TestCachePurgePrefix(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	h.cache.store("8.8.8.8", cacheEntry{asn: "AS15169", descr: "GOOGLE"})
+	h.cache.store("8.8.4.4", cacheEntry{asn: "AS15169", descr: "GOOGLE"})
+	h.cache.store("1.1.1.1", cacheEntry{asn: "AS13335", descr: "CLOUDFLARENET"})
+	if err := h.CachePurgePrefix(netip.MustParsePrefix("1.1.0.0/16")); err != nil {
+		t.Fatalf("CachePurgePrefix failed: %s", err)
+	}
+	if err := h.CachePurgePrefix(netip.MustParsePrefix("8.8.8.8/24")); err != nil {
+		t.Fatalf("CachePurgePrefix failed: %s", err)
+	}
+	if _, _, found := h.cache.lookupByIP("8.8.8.8"); found {
+		t.Fatalf("8.8.8.8 not purged")
+	}
+	if ips := h.LookupIp("AS15169"); len(ips) != 1 || ips[0] != "8.8.4.4" {
+		t.Fatalf("unexpected LookupIp answer: %v", ips)
+	}
+	if asns := h.AsnCacheList(); len(asns) != 1 || asns[0] != "AS15169" {
+		t.Fatalf("unexpected AsnCacheList answer: %v", asns)
+	}
+	if err := h.CachePurgePrefix(netip.Prefix{}); err != MalformedPrefixError {
+		t.Fatalf("unexpected CachePurgePrefix error: %v", err)
+	}
+}
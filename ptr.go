@@ -0,0 +1,311 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ptrTimeout bounds PTR lookups.
+	ptrTimeout = time.Second * 2
+	// ptrCacheTTL is the expiration time of a PTR cache entry.
+	ptrCacheTTL = time.Hour
+	// ptrNegativeCacheTTL is the expiration time
+	// of a PTR cache entry for an address without PTR record.
+	ptrNegativeCacheTTL = time.Minute * 10
+	// ptrMaxCNAMEs bounds CNAME chains in reverse zones,
+	// such as RFC2317 classless delegations.
+	ptrMaxCNAMEs = 8
+)
+
+// PTRNotFoundError is returned by LookupPTR
+// when an IP address has no PTR record.
+var PTRNotFoundError = newClassError("PTR record not found", NotFoundError)
+
+// ptrMode tells whether and how a lookup includes PTR names.
+type ptrMode int
+
+const (
+	// Do not include PTR names
+	ptrNone ptrMode = iota
+	// Include cached PTR names only
+	ptrCached
+	// Include PTR names, resolving them if not cached
+	ptrResolve
+)
+
+// WithPTR makes LookupIpInfo include the PTR name of the IP address,
+// if it is already cached (see LookupPTR).
+// Pass true to resolve the PTR name when it is not cached,
+// which blocks the lookup until the PTR query is answered.
+func WithPTR(resolve bool) LookupOption {
+	return func(cfg *lookupConfig) {
+		cfg.ptr = ptrCached
+		if resolve {
+			cfg.ptr = ptrResolve
+		}
+	}
+}
+
+// LookupPTR searches for the PTR name of a valid IP address.
+// If there are several PTR records, the first name in sort order is used.
+//
+// Answers, including the absence of PTR records, are cached,
+// unless the handler anonymizes IP addresses (see WithAnonymization).
+//
+// Returns the PTR name,
+// or PTRNotFoundError if the IP address has no PTR record.
+func (h Handler) LookupPTR(ctx context.Context, ip string) (string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", MalformedIPError
+	}
+	addr = addr.Unmap().WithZone("")
+	if entry, found := h.ptrs.lookup(addr); found {
+		return entry.name, entry.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, ptrTimeout)
+	defer cancel()
+	name, err := h.resolvePTR(ctx, addr)
+	if (err == nil || err == PTRNotFoundError) && h.anonymize == nil {
+		h.ptrs.store(addr, name, err)
+	}
+	return name, h.redactError(err)
+}
+
+// resolvePTR queries the resolver for the PTR name of an address,
+// following CNAME chains.
+func (h Handler) resolvePTR(ctx context.Context, addr netip.Addr) (string, error) {
+	qname, err := dns.ReverseAddr(addr.String())
+	if err != nil {
+		return "", MalformedIPError
+	}
+	for i := 0; i < ptrMaxCNAMEs; i++ {
+		msg, err := h.resolver.query(ctx, qname, dns.TypePTR)
+		if err != nil {
+			if err == ctxErr(ctx) || err == OfflineModeError {
+				return "", err
+			}
+			return "", fmt.Errorf("failed to query dns: %w", err)
+		}
+		switch msg.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return "", PTRNotFoundError
+		default:
+			return "", fmt.Errorf("PTR query for %s failed: %s", qname, dns.RcodeToString[msg.Rcode])
+		}
+		names, target := ptrAnswer(msg.Answer, qname)
+		if len(names) > 0 {
+			sort.Strings(names)
+			return strings.TrimSuffix(names[0], "."), nil
+		}
+		if target == qname {
+			return "", PTRNotFoundError
+		}
+		// The resolver did not chase the CNAME chain to its end
+		qname = target
+	}
+	return "", fmt.Errorf("too many CNAMEs resolving PTR of %s", addr)
+}
+
+// ptrAnswer follows the CNAME chain of a given name in a DNS answer.
+//
+// Returns the PTR names at the end of the chain, if any,
+// and the name the chain ends at.
+func ptrAnswer(answer []dns.RR, qname string) ([]string, string) {
+	owner := qname
+	for i := 0; i < ptrMaxCNAMEs; i++ {
+		next := owner
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, owner) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == owner {
+			break
+		}
+		owner = next
+	}
+	var names []string
+	for _, rr := range answer {
+		if ptr, ok := rr.(*dns.PTR); ok && strings.EqualFold(ptr.Hdr.Name, owner) {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	return names, owner
+}
+
+// ptrCacheEntry is a cached PTR answer.
+type ptrCacheEntry struct {
+	// PTR name
+	name string
+	// PTRNotFoundError for negative entries
+	err error
+	// Due date of this entry
+	due time.Time
+}
+
+// ptrCache caches PTR answers by IP address.
+type ptrCache struct {
+	// Concurrent access control to map
+	*sync.RWMutex
+	entries map[netip.Addr]ptrCacheEntry
+}
+
+// newPtrCache returns an empty initialized ptrCache.
+func newPtrCache() ptrCache {
+	return ptrCache{
+		&sync.RWMutex{},
+		make(map[netip.Addr]ptrCacheEntry),
+	}
+}
+
+// store caches a PTR answer.
+func (c ptrCache) store(addr netip.Addr, name string, err error) {
+	ttl := ptrCacheTTL
+	if err != nil {
+		ttl = ptrNegativeCacheTTL
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries[addr] = ptrCacheEntry{
+		name: name,
+		err:  err,
+		due:  time.Now().Add(ttl),
+	}
+}
+
+// lookup retrieves a non expired PTR answer.
+//
+// Returns the cached entry and whether the address was found in cache.
+func (c ptrCache) lookup(addr netip.Addr) (ptrCacheEntry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, ok := c.entries[addr]
+	if !ok || time.Now().After(entry.due) {
+		return ptrCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// ptrBatchConcurrency is the default concurrency of LookupPTRBatch.
+const ptrBatchConcurrency = 10
+
+// PTRBatchTruncatedError is returned by LookupPTRBatch
+// when its context expires before all IP addresses are looked up.
+type PTRBatchTruncatedError struct {
+	// Number of distinct IP addresses looked up, and requested
+	Done  int
+	Total int
+	// Context error
+	Err error
+}
+
+func (e *PTRBatchTruncatedError) Error() string {
+	return fmt.Sprintf("PTR batch truncated after %d of %d addresses: %s", e.Done, e.Total, e.Err)
+}
+
+func (e *PTRBatchTruncatedError) Unwrap() error {
+	return e.Err
+}
+
+// LookupPTRBatch searches for the PTR names of many IP addresses,
+// running up to concurrency LookupPTR calls at once.
+// Pass zero concurrency for the default (10).
+//
+// Duplicate addresses are looked up once,
+// and addresses cached as having no PTR record are not queried again.
+//
+// If ctx expires before all addresses are looked up,
+// LookupPTRBatch returns what it found so far
+// along with a *PTRBatchTruncatedError.
+//
+// Returns a map of IP address to PTR name,
+// which omits addresses without PTR name or whose lookup failed.
+func (h Handler) LookupPTRBatch(ctx context.Context, ips []string, concurrency int) (map[string]string, error) {
+	if concurrency <= 0 {
+		concurrency = ptrBatchConcurrency
+	}
+	// Deduplicate input
+	var unique []string
+	seen := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		if !seen[ip] {
+			seen[ip] = true
+			unique = append(unique, ip)
+		}
+	}
+	var (
+		mu     sync.Mutex
+		answer = make(map[string]string)
+		done   int
+		wg     sync.WaitGroup
+	)
+	todo := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range todo {
+				name, err := h.LookupPTR(ctx, ip)
+				mu.Lock()
+				if err == nil {
+					answer[ip] = name
+				}
+				// Lookups cut short by ctx are not done
+				if cerr := ctxErr(ctx); cerr == nil || err != cerr {
+					done++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, ip := range unique {
+		select {
+		case todo <- ip:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if done < len(unique) {
+		return answer, &PTRBatchTruncatedError{Done: done, Total: len(unique), Err: ctxErr(ctx)}
+	}
+	return answer, nil
+}
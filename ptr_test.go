@@ -0,0 +1,185 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupPTR(t *testing.T) {
+	zone := testDNSZone{
+		"1.2.0.192.in-addr.arpa.": {
+			"1.2.0.192.in-addr.arpa. 300 IN PTR b.example.",
+			"1.2.0.192.in-addr.arpa. 300 IN PTR a.example.",
+		},
+		// RFC2317 classless delegation, resolver answering the whole chain
+		"2.2.0.192.in-addr.arpa.": {
+			"2.2.0.192.in-addr.arpa. 300 IN CNAME 2.0-25.2.0.192.in-addr.arpa.",
+			"2.0-25.2.0.192.in-addr.arpa. 300 IN PTR chained.example.",
+		},
+		// RFC2317 classless delegation, resolver answering the CNAME only
+		"3.2.0.192.in-addr.arpa.": {
+			"3.2.0.192.in-addr.arpa. 300 IN CNAME 3.0-25.2.0.192.in-addr.arpa.",
+		},
+		"3.0-25.2.0.192.in-addr.arpa.": {
+			"3.0-25.2.0.192.in-addr.arpa. 300 IN PTR requeried.example.",
+		},
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": {
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 300 IN PTR v6.example.",
+		},
+	}
+	var queries int32
+	addr := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		zone.serve(w, req)
+	})
+	h := newHandler(nil, time.Second)
+	h.resolver.server = addr
+	ctx := context.Background()
+	tests := []struct {
+		ip   string
+		name string
+		err  error
+	}{
+		{"192.0.2.1", "a.example", nil},
+		{"192.0.2.2", "chained.example", nil},
+		{"192.0.2.3", "requeried.example", nil},
+		{"2001:db8::1", "v6.example", nil},
+		{"192.0.2.9", "", PTRNotFoundError},
+		{"192.0.2", "", MalformedIPError},
+	}
+	for _, test := range tests {
+		name, err := h.LookupPTR(ctx, test.ip)
+		if name != test.name || err != test.err {
+			t.Fatalf("LookupPTR(%s) returned '%s', %v", test.ip, name, err)
+		}
+	}
+	// Positive and negative answers are cached
+	n := atomic.LoadInt32(&queries)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.9"} {
+		h.LookupPTR(ctx, ip)
+	}
+	if atomic.LoadInt32(&queries) != n {
+		t.Fatalf("cached PTR answers were queried again")
+	}
+}
+
+func TestLookupPTRTimeout(t *testing.T) {
+	// A server that never answers
+	addr := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {})
+	h := newHandler(nil, time.Second*5)
+	h.resolver.server = addr
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	_, err := h.LookupPTR(ctx, "192.0.2.1")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected LookupPTR error: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("LookupPTR did not honor the context deadline")
+	}
+	// Failures are not cached
+	if _, found := h.ptrs.lookup(netip.MustParseAddr("192.0.2.1")); found {
+		t.Fatalf("timed out PTR lookup was cached")
+	}
+}
+
+func TestLookupPTRBatch(t *testing.T) {
+	var queries, inflight, maxInflight int32
+	addr := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		name := req.Question[0].Name
+		if name == "9.2.0.192.in-addr.arpa." {
+			msg.Rcode = dns.RcodeNameError
+		} else {
+			rr, _ := dns.NewRR(name + " 300 IN PTR host-" + name[:strings.Index(name, ".")] + ".example.")
+			msg.Answer = append(msg.Answer, rr)
+		}
+		w.WriteMsg(msg)
+	})
+	h := newHandler(nil, time.Second)
+	h.resolver.server = addr
+	ctx := context.Background()
+	// Cache the negative answer
+	if _, err := h.LookupPTR(ctx, "192.0.2.9"); err != PTRNotFoundError {
+		t.Fatalf("unexpected LookupPTR error: %v", err)
+	}
+	atomic.StoreInt32(&queries, 0)
+	var ips []string
+	for i := 0; i < 20; i++ {
+		ips = append(ips, fmt.Sprintf("192.0.2.%d", 10+i), fmt.Sprintf("192.0.2.%d", 10+i))
+	}
+	ips = append(ips, "192.0.2.9", "bogus")
+	names, err := h.LookupPTRBatch(ctx, ips, 4)
+	if err != nil {
+		t.Fatalf("LookupPTRBatch failed: %s", err)
+	}
+	if len(names) != 20 || names["192.0.2.15"] != "host-15.example" {
+		t.Fatalf("unexpected LookupPTRBatch answer: %v", names)
+	}
+	if q := atomic.LoadInt32(&queries); q != 20 {
+		t.Fatalf("expected 20 queries, got %d", q)
+	}
+	if max := atomic.LoadInt32(&maxInflight); max > 4 {
+		t.Fatalf("concurrency exceeded: %d queries in flight", max)
+	}
+	// Truncation
+	ips = ips[:0]
+	for i := 0; i < 100; i++ {
+		ips = append(ips, fmt.Sprintf("198.51.100.%d", i))
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*70)
+	defer cancel()
+	names, err = h.LookupPTRBatch(ctx, ips, 2)
+	var truncated *PTRBatchTruncatedError
+	if !errors.As(err, &truncated) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected LookupPTRBatch error: %v", err)
+	}
+	if truncated.Total != 100 || truncated.Done != len(names) || len(names) == 0 {
+		t.Fatalf("unexpected truncation: %s, with %d names", err, len(names))
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queryCacheTTL is the default lifetime of query cache entries.
+	queryCacheTTL = time.Hour
+	// queryCacheSize is the default maximum number of query cache entries.
+	queryCacheSize = 10000
+)
+
+// QueryCache caches answers of text protocol sources
+// (whois, RDAP, PeeringDB), keyed by source and query.
+//
+// Concurrent identical queries are coalesced into a single one.
+// A QueryCache is safe for concurrent use,
+// and may be shared by several handlers (see WithQueryCache).
+type QueryCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[queryKey]*list.Element
+	// Entries by recency of use, most recent first
+	lru     *list.List
+	flights flightGroup[queryKey, []byte]
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	coalesced atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// queryKey identifies a query to a source.
+type queryKey struct {
+	source string
+	query  string
+}
+
+// queryCacheEntry is a cached answer.
+type queryCacheEntry struct {
+	key    queryKey
+	answer []byte
+	due    time.Time
+}
+
+// QueryCacheStats are query cache counters.
+type QueryCacheStats struct {
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Coalesced uint64
+	Evictions uint64
+}
+
+// DefaultQueryCache is the process-wide query cache,
+// used by handlers unless told otherwise with WithQueryCache.
+var DefaultQueryCache = NewQueryCache(queryCacheTTL, queryCacheSize)
+
+// NewQueryCache creates a query cache keeping answers for ttl,
+// and holding at most size entries,
+// the least recently used ones being evicted first.
+// Pass zero ttl or size for the defaults (1 hour, 10000 entries).
+func NewQueryCache(ttl time.Duration, size int) *QueryCache {
+	if ttl <= 0 {
+		ttl = queryCacheTTL
+	}
+	if size <= 0 {
+		size = queryCacheSize
+	}
+	return &QueryCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[queryKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// WithQueryCache makes the handler use query cache c for its text protocol sources,
+// instead of DefaultQueryCache.
+// Pass nil to disable caching of these sources.
+//
+// Must come before the options enabling the sources.
+func WithQueryCache(c *QueryCache) Option {
+	return func(h *Handler) error {
+		h.queries = c
+		return nil
+	}
+}
+
+// Stats returns the query cache counters.
+func (c *QueryCache) Stats() QueryCacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return QueryCacheStats{
+		Entries:   entries,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Coalesced: c.coalesced.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// Purge empties the query cache.
+func (c *QueryCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[queryKey]*list.Element)
+	c.lru.Init()
+}
+
+// get returns the answer of source to query,
+// calling fetch unless cached or already in progress.
+// Errors are not cached.
+//
+// A nil query cache calls fetch every time.
+func (c *QueryCache) get(ctx context.Context, source, query string, fetch func(context.Context) ([]byte, error)) ([]byte, error) {
+	if c == nil {
+		return fetch(ctx)
+	}
+	key := queryKey{source, query}
+	if answer, ok := c.lookup(key); ok {
+		c.hits.Add(1)
+		return answer, nil
+	}
+	answer, err, shared := c.flights.do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		answer, err := fetch(ctx)
+		if err == nil {
+			c.store(key, answer)
+		}
+		return answer, err
+	})
+	if shared {
+		c.coalesced.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return answer, err
+}
+
+// lookup returns the cached answer of a query, if any and not expired.
+func (c *QueryCache) lookup(key queryKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elt, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elt.Value.(*queryCacheEntry)
+	if time.Now().After(entry.due) {
+		c.lru.Remove(elt)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elt)
+	return entry.answer, true
+}
+
+// store caches the answer of a query,
+// evicting the least recently used entries beyond the size bound.
+func (c *QueryCache) store(key queryKey, answer []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &queryCacheEntry{
+		key:    key,
+		answer: answer,
+		due:    time.Now().Add(c.ttl),
+	}
+	if elt, ok := c.entries[key]; ok {
+		elt.Value = entry
+		c.lru.MoveToFront(elt)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		elt := c.lru.Back()
+		c.lru.Remove(elt)
+		delete(c.entries, elt.Value.(*queryCacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
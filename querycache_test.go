@@ -0,0 +1,156 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryCache(t *testing.T) {
+	c := NewQueryCache(time.Hour, 2)
+	var calls atomic.Int32
+	fetch := func(answer string) func(context.Context) ([]byte, error) {
+		return func(context.Context) ([]byte, error) {
+			calls.Add(1)
+			return []byte(answer), nil
+		}
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		answer, err := c.get(ctx, "whois", "AS15169", fetch("GOOGLE"))
+		if err != nil || string(answer) != "GOOGLE" {
+			t.Fatalf("get #%d returned %q, %v", i, answer, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fetched %d times, expected 1", n)
+	}
+	// Same query to another source is another key
+	if _, err := c.get(ctx, "rdap", "AS15169", fetch("GOOGLE")); err != nil {
+		t.Fatalf("get failed: %s", err)
+	}
+	// Exceeds size bound, evicting whois AS15169
+	if _, err := c.get(ctx, "whois", "AS13335", fetch("CLOUDFLARENET")); err != nil {
+		t.Fatalf("get failed: %s", err)
+	}
+	if _, ok := c.lookup(queryKey{"whois", "AS15169"}); ok {
+		t.Errorf("least recently used entry not evicted")
+	}
+	// Errors are not cached
+	fail := errors.New("unreachable")
+	for i := 0; i < 2; i++ {
+		_, err := c.get(ctx, "whois", "AS64496", func(context.Context) ([]byte, error) {
+			calls.Add(1)
+			return nil, fail
+		})
+		if err != fail {
+			t.Fatalf("get returned %v, expected %v", err, fail)
+		}
+	}
+	stats := c.Stats()
+	expected := QueryCacheStats{Entries: 2, Hits: 1, Misses: 5, Evictions: 1}
+	if stats != expected {
+		t.Errorf("stats are %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestQueryCacheExpiry(t *testing.T) {
+	c := NewQueryCache(time.Millisecond, 0)
+	ctx := context.Background()
+	var calls atomic.Int32
+	fetch := func(context.Context) ([]byte, error) {
+		calls.Add(1)
+		return []byte("answer"), nil
+	}
+	c.get(ctx, "whois", "AS15169", fetch)
+	time.Sleep(5 * time.Millisecond)
+	c.get(ctx, "whois", "AS15169", fetch)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("fetched %d times, expected 2", n)
+	}
+}
+
+func TestQueryCacheCoalescing(t *testing.T) {
+	c := NewQueryCache(time.Hour, 0)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fetch := func(context.Context) ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte("answer"), nil
+	}
+	// The first caller gives up, the query goes on for the others
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := c.get(ctx, "peeringdb", "/ix", fetch)
+		first <- err
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answer, err := c.get(context.Background(), "peeringdb", "/ix", fetch)
+			if err != nil || string(answer) != "answer" {
+				t.Errorf("get returned %q, %v", answer, err)
+			}
+		}()
+	}
+	for waiters(c, queryKey{"peeringdb", "/ix"}) < 6 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("canceled get returned %v", err)
+	}
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fetched %d times, expected 1", n)
+	}
+	if n := c.Stats().Coalesced; n != 5 {
+		t.Errorf("coalesced %d queries, expected 5", n)
+	}
+}
+
+// waiters returns the number of callers waiting for a query in progress.
+func waiters(c *QueryCache, key queryKey) int {
+	c.flights.mu.Lock()
+	defer c.flights.mu.Unlock()
+	if f, ok := c.flights.flights[key]; ok {
+		return f.waiters
+	}
+	return 0
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// raceGrace is the default time race mode waits for Team Cymru's
+// description once another source answered (see WithSourceRace).
+const raceGrace = 100 * time.Millisecond
+
+// sourceRace configures race mode (see WithSourceRace).
+type sourceRace struct {
+	// Time Team Cymru's description is waited for
+	grace time.Duration
+}
+
+// WithSourceRace enables race mode:
+// LookupAsn queries its sources (see WithAsnSources) at once
+// rather than in order, and takes the first ASN and description answered,
+// canceling the other queries, so that a source failing slowly
+// does not delay the others.
+// Sources describing ASNs are queried as soon as a source finds the ASN,
+// a source queried by IP address or Team Cymru's IP to ASN service.
+//
+// Team Cymru's descriptions being preferred,
+// a description answered first by another source waits for Team Cymru's
+// for up to grace, or 100ms if zero.
+// Overrides still take precedence.
+// Derived handlers race if their parent does (see Derive).
+func WithSourceRace(grace time.Duration) Option {
+	return func(h *Handler) error {
+		if grace < 0 {
+			return fmt.Errorf("invalid race grace %s", grace)
+		}
+		if h.tenant != "" {
+			return fmt.Errorf("derived handlers share the ASN sources of their parent")
+		}
+		if grace == 0 {
+			grace = raceGrace
+		}
+		h.race = &sourceRace{grace}
+		return nil
+	}
+}
+
+// raceAnswer is the answer of a source in race mode.
+type raceAnswer struct {
+	// Source name
+	name  string
+	asn   string
+	descr string
+	ttl   time.Duration
+	err   error
+	// Whether the source is queried by IP address, finding its own ASN
+	byIP bool
+}
+
+// lookupAsnRace is lookupAsnUncached in race mode, querying sources at once.
+//
+// Returns the cache entry to store.
+func (h Handler) lookupAsnRace(ctx context.Context, ip string, cfg lookupConfig, sources []AsnSource, names []string) (cacheEntry, error) {
+	lookupCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	// Queries still running are given up
+	defer cancel()
+	running := &sync.WaitGroup{}
+	if h.observer != nil {
+		// Explained steps come from every query, all over once explained
+		var mu sync.Mutex
+		observer := h.observer
+		h.observer = func(step ExplainStep) {
+			mu.Lock()
+			defer mu.Unlock()
+			observer(step)
+		}
+		defer func() {
+			cancel()
+			running.Wait()
+		}()
+	}
+	// The first ASN found, by the sources queried by IP address
+	// or Team Cymru's IP to ASN service, and the source which found it
+	var asn, source string
+	var once sync.Once
+	found := make(chan struct{})
+	setAsn := func(a, s string) {
+		once.Do(func() {
+			asn, source = a, s
+			close(found)
+		})
+	}
+	// Closed once every source which may find an ASN answered
+	finding := &sync.WaitGroup{}
+	answers := make(chan raceAnswer, len(sources))
+	pending := 0
+	cymru := false
+	for i, s := range sources {
+		name := names[i]
+		if !cfg.allows(name) {
+			continue
+		}
+		pending++
+		running.Add(1)
+		if byIP(s) {
+			finding.Add(1)
+			go func() {
+				defer running.Done()
+				defer finding.Done()
+				a := h.queryIPSource(ctx, s, name, ip)
+				if a.asn != "" {
+					setAsn(a.asn, name)
+				}
+				answers <- raceAnswer{name, a.asn, a.descr, h.cache.defaultTTL(), a.err, true}
+			}()
+			continue
+		}
+		if s == builtinSource(SourceCymru) {
+			cymru = true
+		}
+		go func() {
+			defer running.Done()
+			// Sources describing ASNs need one first
+			select {
+			case <-found:
+			case <-ctx.Done():
+				answers <- raceAnswer{name: name, err: ctx.Err()}
+				return
+			}
+			start := time.Now()
+			descr, ttl, err := h.describeAsn(ctx, s, asn)
+			h.observeAnswer(name, asn, descr, err, start)
+			if err != nil && ctxErr(ctx) == nil {
+				h.logf("warning: %s lookup failed for asn '%s': %s\n", name, asn, err)
+			}
+			answers <- raceAnswer{name, asn, descr, ttl, err, false}
+		}()
+	}
+	// Cymru's IP to ASN service also knows IPv6 routes
+	if addr, err := netip.ParseAddr(ip); err == nil && cymru {
+		running.Add(1)
+		finding.Add(1)
+		go func() {
+			defer running.Done()
+			defer finding.Done()
+			start := time.Now()
+			origin, err := h.lookupCymruOrigin(ctx, addr)
+			if err == nil {
+				setAsn(origin.asns[0], SourceCymru)
+				h.observeAnswer(SourceCymru, origin.asns[0], "", nil, start)
+			} else {
+				h.observeAnswer(SourceCymru, "", "", err, start)
+				if ctxErr(ctx) == nil {
+					h.logf("warning: cymru origin lookup failed for ip '%s': %s\n", ip, err)
+				}
+			}
+		}()
+	}
+	go func() {
+		// Sources describing ASNs give up if none is found
+		finding.Wait()
+		select {
+		case <-found:
+		default:
+			cancel()
+		}
+	}()
+	// Descriptions answered by the sources consulted
+	descrs := make(map[string]string)
+	var winner *raceAnswer
+	var grace <-chan time.Time
+	for pending > 0 {
+		var a raceAnswer
+		select {
+		case a = <-answers:
+			pending--
+		case <-grace:
+			pending = 0
+			continue
+		}
+		if a.err != nil || a.descr == "" {
+			continue
+		}
+		descrs[a.name] = a.descr
+		if winner != nil {
+			// Team Cymru answered within the grace window
+			if a.name == SourceCymru && a.asn == winner.asn {
+				winner = &a
+				break
+			}
+			continue
+		}
+		if a.asn == "" {
+			continue
+		}
+		winner = &a
+		if a.name == SourceCymru || !cymru {
+			break
+		}
+		timer := time.NewTimer(h.race.grace)
+		defer timer.Stop()
+		grace = timer.C
+	}
+	if err := ctxErr(lookupCtx); err != nil {
+		return cacheEntry{}, err
+	}
+	if winner != nil {
+		// The ASN of sources queried by IP address is their own
+		winnerSource := source
+		if winner.byIP {
+			winnerSource = winner.name
+		}
+		h.observe(ExplainStep{Source: winner.name, Result: "answer", Detail: "first source with ASN and description, in race mode"})
+		entry := h.newCacheEntry(lookupCtx, winner.asn, winnerSource, descrs, winner.name)
+		entry.ttl = winner.ttl
+		return entry, nil
+	}
+	select {
+	case <-found:
+	default:
+		// Cannot find an ASN. Give up.
+		return cacheEntry{}, fmt.Errorf("%w for ip '%v'", AsnNotFoundError, ip)
+	}
+	// We found an ASN, but no description for it.
+	h.observe(ExplainStep{Source: source, Result: "answer", Detail: "first source with ASN, no description"})
+	return h.newCacheEntry(lookupCtx, asn, source, descrs, ""), nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// delayedAsnSource is an AsnSource describing ASNs after a delay,
+// recording whether its lookups were canceled.
+type delayedAsnSource struct {
+	name     string
+	descr    string
+	delay    time.Duration
+	canceled atomic.Int32
+}
+
+func (s *delayedAsnSource) Name() string {
+	return s.name
+}
+
+func (s *delayedAsnSource) Lookup(ctx context.Context, asn string) (string, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.descr, nil
+	case <-ctx.Done():
+		s.canceled.Add(1)
+		return "", ctx.Err()
+	}
+}
+
+func TestWithSourceRace(t *testing.T) {
+	zone := testDNSZone{
+		"4.4.4.4.origin.asn.cymru.com.": {`4.4.4.4.origin.asn.cymru.com. 60 IN TXT "64500 | 4.4.4.0/24 | US | arin | 2000-01-01"`},
+		"AS64500.asn.cymru.com.":        {`AS64500.asn.cymru.com. 60 IN TXT "64500 | US | arin | 2000-01-01 | CYMRU-NAME, US"`},
+	}
+	var cymruDelay atomic.Int64
+	server := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(time.Duration(cymruDelay.Load()))
+		zone.serve(w, req)
+	})
+	// ipinfo.io finds the ASN at once, without description
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "AS64500")
+	}))
+	defer ts.Close()
+	registry := &delayedAsnSource{name: "registry", descr: "REGISTRY-NAME"}
+	slow := &delayedAsnSource{name: "slow", descr: "SLOW-NAME", delay: time.Minute}
+	newRaceHandler := func() Handler {
+		h := newHandler(nil, 5*time.Second)
+		h.resolver.server = server
+		h.ipinfo.baseURL = ts.URL
+		for _, opt := range []Option{
+			WithAsnSources(BuiltinSource(SourceCymru), BuiltinSource(SourceIpinfo), slow, registry),
+			WithSourceRace(100 * time.Millisecond),
+		} {
+			if err := opt(&h); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return h
+	}
+	ctx := context.Background()
+
+	// Slow Team Cymru: the first description wins past the grace window
+	cymruDelay.Store(int64(600 * time.Millisecond))
+	start := time.Now()
+	info, err := newRaceHandler().LookupAsnDetailed(ctx, "4.4.4.4")
+	if err != nil || info.Asn != "AS64500" || info.Descr != "REGISTRY-NAME" || info.Source != SourceIpinfo || info.DescrSource != "registry" {
+		t.Errorf("LookupAsnDetailed answered %+v %v", info, err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("lookup waited %s for slow sources", elapsed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for slow.canceled.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("lookup of the slow source not canceled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Team Cymru answering within the grace window is preferred
+	cymruDelay.Store(int64(20 * time.Millisecond))
+	info, err = newRaceHandler().LookupAsnDetailed(ctx, "4.4.4.4")
+	if err != nil || info.Descr != "CYMRU-NAME, US" || info.DescrSource != SourceCymru || info.Descrs["registry"] != "REGISTRY-NAME" {
+		t.Errorf("LookupAsnDetailed answered %+v %v within the grace window", info, err)
+	}
+
+	// Unknown addresses
+	cymruDelay.Store(0)
+	h := newRaceHandler()
+	h.ipinfo.baseURL = "http://127.0.0.1:1"
+	if _, err := h.LookupAsnDetailed(ctx, "5.5.5.5"); !errors.Is(err, AsnNotFoundError) {
+		t.Errorf("LookupAsnDetailed of an unknown address failed with %v", err)
+	}
+	// Explained lookups record every source
+	explanation, err := newRaceHandler().Explain(ctx, "4.4.4.4")
+	if err != nil || len(explanation.Steps) == 0 {
+		t.Errorf("Explain answered %+v %v", explanation, err)
+	}
+	if err := WithSourceRace(-time.Second)(&h); err == nil {
+		t.Error("WithSourceRace accepted a negative grace")
+	}
+}
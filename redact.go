@@ -0,0 +1,167 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// Regular expressions matching IP addresses in text, see redactIPs.
+var (
+	reRedactInAddr = regexp.MustCompile(`(?i)\b((?:\d{1,3}\.){1,4})(in-addr\.arpa)`)
+	reRedactIP6    = regexp.MustCompile(`(?i)\b((?:[0-9a-f]\.){1,32})(ip6\.arpa)`)
+	reRedactIPv6   = regexp.MustCompile(`[0-9A-Fa-f]*:[0-9A-Fa-f]*:[0-9A-Fa-f:.]*`)
+	reRedactIPv4   = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+)
+
+// WithRedactIPs makes the handler redact IP addresses
+// from the errors it returns, the messages it logs,
+// and its debug dumps (see DebugDump).
+// IPv4 addresses are truncated to their first two octets (192.0.x.x),
+// IPv6 addresses to their /48 prefix.
+//
+// Lookup results are not redacted.
+func WithRedactIPs() Option {
+	return func(h *Handler) error {
+		h.redactIPs = true
+		return nil
+	}
+}
+
+// redact is redactIPs, if the handler redacts IP addresses.
+func (h Handler) redact(s string) string {
+	if !h.redactIPs {
+		return s
+	}
+	return redactIPs(s)
+}
+
+// redactError returns err, or an error with the same chain
+// and its IP addresses redacted, if the handler redacts IP addresses.
+func (h Handler) redactError(err error) error {
+	if err == nil || !h.redactIPs {
+		return err
+	}
+	msg := redactIPs(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg, err}
+}
+
+// logf is log.Printf, redacting IP addresses
+// if the handler redacts them.
+func (h Handler) logf(format string, v ...interface{}) {
+	log.Print(h.redact(fmt.Sprintf(format, v...)))
+}
+
+// redactedError is an error whose message is redacted.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactIPs truncates the IP addresses found in s,
+// including reverse DNS names.
+// It is the one place IP addresses are redacted.
+func redactIPs(s string) string {
+	s = reRedactInAddr.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reRedactInAddr.FindStringSubmatch(m)
+		labels := strings.Split(strings.TrimSuffix(sub[1], "."), ".")
+		// Keep the first two octets, which are the last labels
+		for i := 0; i < len(labels)-2; i++ {
+			labels[i] = "x"
+		}
+		return strings.Join(labels, ".") + "." + sub[2]
+	})
+	s = reRedactIP6.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reRedactIP6.FindStringSubmatch(m)
+		nibbles := strings.Split(strings.TrimSuffix(sub[1], "."), ".")
+		// Keep the first 12 nibbles (/48), which are the last labels
+		if len(nibbles) <= 12 {
+			return m
+		}
+		return "x." + strings.Join(nibbles[len(nibbles)-12:], ".") + "." + sub[2]
+	})
+	s = reRedactIPv6.ReplaceAllStringFunc(s, func(m string) string {
+		// Separators may follow the address
+		trimmed := strings.TrimRight(m, ":.")
+		addr, err := netip.ParseAddr(m)
+		if err != nil {
+			if addr, err = netip.ParseAddr(trimmed); err != nil {
+				return m
+			}
+			return redactAddr(addr) + m[len(trimmed):]
+		}
+		return redactAddr(addr)
+	})
+	// Dotted numbers within longer names are not IPv4 addresses
+	var b strings.Builder
+	last := 0
+	for _, loc := range reRedactIPv4.FindAllStringIndex(s, -1) {
+		start, end := loc[0], loc[1]
+		if start > 0 && s[start-1] == '.' || end < len(s)-1 && s[end] == '.' && isAlnum(s[end+1]) {
+			continue
+		}
+		addr, err := netip.ParseAddr(s[start:end])
+		if err != nil {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(redactAddr(addr))
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// isAlnum tells if c is an ASCII letter or digit.
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// redactAddr truncates an IP address.
+func redactAddr(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		b := addr.As4()
+		return fmt.Sprintf("%d.%d.x.x", b[0], b[1])
+	}
+	prefix, _ := addr.WithZone("").Prefix(48)
+	return prefix.String()
+}
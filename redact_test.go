@@ -0,0 +1,123 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRedactIPs(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"cannot lookup 203.0.113.54: timeout", "cannot lookup 203.0.x.x: timeout"},
+		{"GET 'https://ipinfo.io/203.0.113.54/org'", "GET 'https://ipinfo.io/203.0.x.x/org'"},
+		{"dial udp 192.0.2.1:53: refused", "dial udp 192.0.x.x:53: refused"},
+		{"cannot lookup 2001:db8:1:2::54: timeout", "cannot lookup 2001:db8:1::/48: timeout"},
+		{"dial udp [2001:db8:1:2::54]:53", "dial udp [2001:db8:1::/48]:53"},
+		{"ip '::ffff:203.0.113.54'", "ip '203.0.x.x'"},
+		{"PTR query for 54.113.0.203.in-addr.arpa. failed", "PTR query for x.x.0.203.in-addr.arpa. failed"},
+		{
+			"PTR query for 4.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. failed",
+			"PTR query for x.1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. failed",
+		},
+		{"prefix 203.0.113.0/24", "prefix 203.0.x.x/24"},
+		{"lookup failed for 203.0.113.54.", "lookup failed for 203.0.x.x."},
+		{"host 203.0.113.54.example.net", "host 203.0.113.54.example.net"},
+		{"at 09:41:38, version 1.2.3, AS15169", "at 09:41:38, version 1.2.3, AS15169"},
+	}
+	for _, test := range tests {
+		if out := redactIPs(test.in); out != test.out {
+			t.Errorf("redactIPs(%q) = %q, expected %q", test.in, out, test.out)
+		}
+	}
+}
+
+// reFullIPv4 matches IPv4 addresses in the clear.
+var reFullIPv4 = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+
+func TestWithRedactIPs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Wrong ip"))
+	}))
+	defer ts.Close()
+	server := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(msg)
+	})
+	h := newHandler(nil, time.Second)
+	h.ipinfo.baseURL = ts.URL
+	h.resolver.server = server
+	for _, opt := range []Option{WithRedactIPs(), WithKeyTracking()} {
+		if err := opt(&h); err != nil {
+			t.Fatalf("option failed: %s", err)
+		}
+	}
+	var errs []error
+	_, _, err := h.IpInfoLookup("203.0.113.54")
+	errs = append(errs, err)
+	_, err = h.LookupPTR(context.Background(), "203.0.113.54")
+	errs = append(errs, err)
+	for _, err := range errs {
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+		if reFullIPv4.MatchString(err.Error()) || strings.Contains(err.Error(), "54.113.0.203") {
+			t.Errorf("error holds a full IP address: %s", err)
+		}
+	}
+	// Logs
+	var logs bytes.Buffer
+	output := log.Writer()
+	log.SetOutput(&logs)
+	h.logf("warning: lookup failed for ip '%s'\n", "203.0.113.54")
+	log.SetOutput(output)
+	if reFullIPv4.MatchString(logs.String()) {
+		t.Errorf("log holds a full IP address: %s", logs.String())
+	}
+	// Debug dump
+	h.keys.recordIP(netip.MustParseAddr("203.0.113.54"))
+	var dump bytes.Buffer
+	if err := h.DebugDump(&dump); err != nil {
+		t.Fatalf("DebugDump failed: %s", err)
+	}
+	if reFullIPv4.MatchString(dump.String()) || !strings.Contains(dump.String(), "203.0.x.x/24") {
+		t.Errorf("unexpected debug dump: %s", dump.String())
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// WithGeoIPReload makes the handler check its GeoIP database files
+// (see WithGeoIPFiles and WithMMDB) every interval,
+// and reload them when they change (see ReloadGeoipDb),
+// so that databases replaced by new files, such as ones
+// distributed by configuration management, are used without restart.
+// Files must be replaced by renaming complete ones in place,
+// as GeoLite2 ASN databases in use are mapped in memory
+// and files rewritten in place corrupt them.
+// Reloads of files failing checks are logged,
+// keeping the databases in use.
+// Changes are polled for, rather than notified by the file system,
+// which costs a few stat calls per interval.
+//
+// Checks stop when the handler is closed.
+func WithGeoIPReload(interval time.Duration) Option {
+	return func(h *Handler) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid GeoIP reload interval %s", interval)
+		}
+		h.geoipReload = interval
+		return nil
+	}
+}
+
+// ReloadGeoipDb reopens the GeoIP database files of the handler,
+// the libgeoip files it was created with (see WithGeoIPFiles),
+// or its GeoLite2 ASN database file (see WithMMDB),
+// and swaps the databases in use for them:
+// lookups in progress complete with the previous databases,
+// later ones use the new ones.
+// Files are checked first (see ValidateGeoIPFile and ValidateMMDBFile),
+// corrupt ones failing the reload and leaving the databases in use.
+//
+// Returns HandlerClosedError if the handler is closed,
+// and an error if the handler has no database file,
+// such as handlers created by NewFixtureHandler.
+func (h Handler) ReloadGeoipDb() error {
+	if h.runs.closed.Load() {
+		return HandlerClosedError
+	}
+	reloaded := false
+	if h.mmdb != nil {
+		next, err := openMMDB(h.mmdb.file())
+		if err != nil {
+			return err
+		}
+		if err := h.mmdb.swap(next); err != nil {
+			return err
+		}
+		reloaded = true
+	}
+	if len(h.geoipFiles) == 2 && h.geoip4 != nil && h.geoip6 != nil {
+		ge4, err := openGeoIPFile(h.geoipFiles[0], geoipASNumEdition)
+		if err != nil {
+			return err
+		}
+		ge6, err := openGeoIPFile(h.geoipFiles[1], geoipASNumEditionV6)
+		if err != nil {
+			return err
+		}
+		for _, swap := range []struct{ db, next geoipDB }{{h.geoip4, ge4}, {h.geoip6, ge6}} {
+			db, ok := swap.db.(replaceableGeoIP)
+			if !ok || !db.replace(swap.next) {
+				return fmt.Errorf("cannot replace GeoIP database")
+			}
+		}
+		reloaded = true
+	}
+	if !reloaded {
+		return fmt.Errorf("no GeoIP database file to reload")
+	}
+	return nil
+}
+
+// geoipFileState identifies a version of a database file.
+type geoipFileState struct {
+	info os.FileInfo
+	err  error
+}
+
+// changed returns whether a file changed since state s.
+func (s geoipFileState) changed(next geoipFileState) bool {
+	if s.err != nil || next.err != nil {
+		return (s.err == nil) != (next.err == nil)
+	}
+	return !os.SameFile(s.info, next.info) ||
+		!s.info.ModTime().Equal(next.info.ModTime()) ||
+		s.info.Size() != next.info.Size()
+}
+
+// databaseFiles returns the database files of the handler.
+func (h Handler) databaseFiles() []string {
+	files := h.geoipFiles
+	if h.mmdb != nil {
+		files = append(files[:len(files):len(files)], h.mmdb.file())
+	}
+	return files
+}
+
+// databaseFileStates returns the states of the database files
+// of the handler.
+func (h Handler) databaseFileStates() []geoipFileState {
+	var states []geoipFileState
+	for _, file := range h.databaseFiles() {
+		info, err := os.Stat(file)
+		states = append(states, geoipFileState{info, err})
+	}
+	return states
+}
+
+// watchGeoIPFiles reloads the GeoIP database files when they change
+// from given states, checking them every reload interval,
+// until ctx is done (see WithGeoIPReload).
+func (h Handler) watchGeoIPFiles(ctx context.Context, states []geoipFileState) {
+	ticker := time.NewTicker(h.geoipReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		next := h.databaseFileStates()
+		changed := len(next) != len(states)
+		for i := 0; i < len(next) && !changed; i++ {
+			changed = states[i].changed(next[i])
+		}
+		// Files failing checks are reloaded once changed again
+		states = next
+		if !changed {
+			continue
+		}
+		if err := h.ReloadGeoipDb(); err != nil {
+			log.Printf("warning: GeoIP database reload failed: %s\n", err)
+		} else {
+			h.logf("(geoipdb) GeoIP databases reloaded\n")
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// installMMDB replaces a database file by a copy of another,
+// renamed in place.
+func installMMDB(t *testing.T, src string, dst string) {
+	t.Helper()
+	b, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadGeoipDb(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-ASN.mmdb")
+	installMMDB(t, testMMDB, path)
+	h, err := NewHandlerOpts(WithMMDB(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	lookup := func(expected string) {
+		t.Helper()
+		if asn, _, err := h.mmdbLookup("8.8.8.8"); err != nil || asn != expected {
+			t.Fatalf("mmdbLookup answered %q %v, expected %s", asn, err, expected)
+		}
+	}
+	lookup("AS15169")
+	installMMDB(t, "testdata/mmdb/GeoLite2-ASN-Test-Updated.mmdb", path)
+	// Replaced files are not used until reloaded
+	lookup("AS15169")
+	if err := h.ReloadGeoipDb(); err != nil {
+		t.Fatalf("ReloadGeoipDb failed: %s", err)
+	}
+	lookup("AS64496")
+
+	// Corrupt files are not reloaded
+	corrupt := filepath.Join(t.TempDir(), "corrupt.mmdb")
+	if err := os.WriteFile(corrupt, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	installMMDB(t, corrupt, path)
+	if err := h.ReloadGeoipDb(); err == nil {
+		t.Fatalf("ReloadGeoipDb succeeded with a corrupt file")
+	}
+	lookup("AS64496")
+
+	if err := NewFixtureHandler().ReloadGeoipDb(); err == nil {
+		t.Fatalf("ReloadGeoipDb succeeded without database file")
+	}
+}
+
+func TestWithGeoIPReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-ASN.mmdb")
+	installMMDB(t, testMMDB, path)
+	h, err := NewHandlerOpts(WithMMDB(path), WithGeoIPReload(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for _, test := range []struct {
+		file string
+		asn  string
+	}{
+		{"testdata/mmdb/GeoLite2-ASN-Test-Updated.mmdb", "AS64496"},
+		{testMMDB, "AS15169"},
+	} {
+		installMMDB(t, test.file, path)
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if asn, _, _ := h.mmdbLookup("8.8.8.8"); asn == test.asn {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not reloaded", test.file)
+			}
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if err := h.ReloadGeoipDb(); err != HandlerClosedError {
+		t.Fatalf("unexpected ReloadGeoipDb error after Close: %v", err)
+	}
+}
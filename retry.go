@@ -0,0 +1,212 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SourceLimits bound the queries to an external source,
+// and tell how to retry them (see WithSourceLimits).
+type SourceLimits struct {
+	// QPS is the maximum sustained number of queries per second,
+	// and Burst the number of queries that may be sent at once:
+	// queries past them wait for their turn.
+	// Zero QPS means no limit; Burst defaults to 1.
+	QPS   float64
+	Burst int
+	// Retries is the number of times a query is retried
+	// after a transient failure,
+	// such as a DNS SERVFAIL answer, a timeout, or an HTTP 5xx answer,
+	// waiting for a backoff doubling from Backoff on, with jitter.
+	// Zero Retries means no retry; Backoff defaults to 50ms.
+	Retries int
+	Backoff time.Duration
+}
+
+// defaultSourceLimits are the SourceLimits of sources by default.
+// ipinfo.io queries are also limited by the IpinfoClient (see IpinfoLimits).
+var defaultSourceLimits = map[string]SourceLimits{
+	SourceCymru:  {QPS: 100, Burst: 100, Retries: 2},
+	SourceIpinfo: {Retries: 2},
+}
+
+// sourceBackoff is the default backoff of retries.
+const sourceBackoff = time.Millisecond * 50
+
+// WithSourceLimits sets the SourceLimits of queries
+// to Team Cymru's DNS services (SourceCymru) or ipinfo.io (SourceIpinfo).
+// By default, Team Cymru is queried up to 100 times per second,
+// and failed queries to either source are retried twice.
+// Queries and their retries are bounded by the handler timeout
+// (see NewHandler), and by the context of lookups.
+func WithSourceLimits(source string, limits SourceLimits) Option {
+	return func(h *Handler) error {
+		g, err := newSourceGuard(limits)
+		if err != nil {
+			return fmt.Errorf("invalid %s limits: %w", source, err)
+		}
+		switch source {
+		case SourceCymru:
+			h.cymru.guard = g
+		case SourceIpinfo:
+			h.ipinfoGuard = g
+		default:
+			return fmt.Errorf("no limits for source '%s'", source)
+		}
+		return nil
+	}
+}
+
+// sourceGuard keeps queries to a source within its SourceLimits.
+type sourceGuard struct {
+	limits SourceLimits
+	// Rate limiter, nil for none
+	bucket *tokenBucket
+	// Number of queries retried
+	retried atomic.Uint64
+}
+
+// newSourceGuard creates a sourceGuard keeping to limits.
+func newSourceGuard(limits SourceLimits) (*sourceGuard, error) {
+	if limits.QPS < 0 || limits.Burst < 0 || limits.Retries < 0 || limits.Backoff < 0 {
+		return nil, errors.New("negative limit")
+	}
+	if limits.Burst == 0 {
+		limits.Burst = 1
+	}
+	if limits.Backoff == 0 {
+		limits.Backoff = sourceBackoff
+	}
+	g := &sourceGuard{limits: limits}
+	if limits.QPS > 0 {
+		g.bucket = &tokenBucket{
+			rate:   limits.QPS,
+			burst:  float64(limits.Burst),
+			tokens: float64(limits.Burst),
+			last:   time.Now(),
+		}
+	}
+	return g, nil
+}
+
+// transientError is a failure worth retrying (see sourceGuard.do).
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e transientError) Unwrap() error {
+	return e.err
+}
+
+// do calls fn, once its turn comes, then retries it with backoff
+// as long as it fails with a transientError, within the limits of g,
+// and within timeout, if not zero, and ctx.
+// A nil sourceGuard calls fn once.
+//
+// Returns the error of the last call, unwrapped if transient.
+func (g *sourceGuard) do(ctx context.Context, timeout time.Duration, fn func(context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		if g != nil && g.bucket != nil {
+			if err := g.bucket.wait(ctx); err != nil {
+				return err
+			}
+		}
+		err = fn(ctx)
+		var transient transientError
+		if !errors.As(err, &transient) {
+			return err
+		}
+		err = transient.err
+		if g == nil || attempt >= g.limits.Retries {
+			return err
+		}
+		// Full backoff, or half of it, at random
+		backoff := g.limits.Backoff << attempt
+		backoff -= time.Duration(rand.Int63n(int64(backoff/2) + 1))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		g.retried.Add(1)
+	}
+}
+
+// tokenBucket is a rate limiter queuing callers.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// wait takes a token, waiting for one if needed, until ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	// Tokens go negative as callers queue
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the token back
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
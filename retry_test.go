@@ -0,0 +1,186 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSourceRetries(t *testing.T) {
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+	}
+	var queries, failures atomic.Int32
+	failures.Store(2)
+	h := newHandler(nil, time.Second)
+	h.resolver.server = startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		if failures.Add(-1) >= 0 {
+			msg := new(dns.Msg)
+			msg.SetRcode(req, dns.RcodeServerFailure)
+			w.WriteMsg(msg)
+			return
+		}
+		zone.serve(w, req)
+	})
+	if err := WithSourceLimits(SourceCymru, SourceLimits{Retries: 2, Backoff: time.Millisecond})(&h); err != nil {
+		t.Fatalf("WithSourceLimits failed: %s", err)
+	}
+	descr, _, err := h.cymru.lookupTTL(context.Background(), "AS15169")
+	if err != nil || descr != "GOOGLE, US" {
+		t.Fatalf("lookup after SERVFAILs answered '%s', %v", descr, err)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("%d queries, expected 3", n)
+	}
+	if n := h.cymru.guard.retried.Load(); n != 2 {
+		t.Errorf("%d retries, expected 2", n)
+	}
+
+	// Past the retries, the failure is answered
+	queries.Store(0)
+	failures.Store(3)
+	if _, _, err := h.cymru.lookupTTL(context.Background(), "AS15169"); err == nil {
+		t.Error("lookup failed 3 times did not fail")
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("%d queries, expected 3", n)
+	}
+
+	// NXDOMAIN is no transient failure
+	queries.Store(0)
+	if _, _, err := h.cymru.lookupTTL(context.Background(), "AS64496"); err == nil {
+		t.Error("lookup of an unknown ASN did not fail")
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d queries of an unknown ASN, expected 1", n)
+	}
+
+	// Retries are given up with the context
+	queries.Store(0)
+	failures.Store(100)
+	if err := WithSourceLimits(SourceCymru, SourceLimits{Retries: 100, Backoff: time.Millisecond * 20})(&h); err != nil {
+		t.Fatalf("WithSourceLimits failed: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if _, _, err := h.cymru.lookupTTL(ctx, "AS15169"); err == nil {
+		t.Error("lookup past its context did not fail")
+	}
+	if n := queries.Load(); n >= 10 {
+		t.Errorf("%d queries past the context", n)
+	}
+}
+
+func TestIpinfoRetries(t *testing.T) {
+	var requests, failures atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failures.Add(-1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/8.8.8.8/org":
+			fmt.Fprintln(w, "AS15169 Google LLC")
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	h.ipinfo.baseURL = ts.URL
+	if err := WithSourceLimits(SourceIpinfo, SourceLimits{Retries: 1, Backoff: time.Millisecond})(&h); err != nil {
+		t.Fatalf("WithSourceLimits failed: %s", err)
+	}
+	failures.Store(1)
+	asn, descr, err := h.ipInfoLookup(context.Background(), "8.8.8.8")
+	if err != nil || asn != "AS15169" || descr != "Google LLC" {
+		t.Fatalf("lookup after a 503 answered %s '%s', %v", asn, descr, err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d requests, expected 2", n)
+	}
+
+	// Client errors are no transient failures
+	requests.Store(0)
+	if _, _, err := h.ipInfoLookup(context.Background(), "192.0.2.1"); err == nil {
+		t.Error("lookup answered 404 did not fail")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests answered 404, expected 1", n)
+	}
+}
+
+func TestSourceRate(t *testing.T) {
+	g, err := newSourceGuard(SourceLimits{QPS: 50, Burst: 2})
+	if err != nil {
+		t.Fatalf("newSourceGuard failed: %s", err)
+	}
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		if err := g.do(context.Background(), 0, func(context.Context) error { return nil }); err != nil {
+			t.Fatalf("query %d failed: %s", i, err)
+		}
+	}
+	// 2 queries at once, then 5 at 20ms intervals
+	if elapsed := time.Since(start); elapsed < time.Millisecond*90 {
+		t.Errorf("7 queries in %s, expected at least 100ms", elapsed)
+	}
+
+	// Queries waiting for their turn give up with their context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	slow, _ := newSourceGuard(SourceLimits{QPS: 0.1})
+	slow.do(context.Background(), 0, func(context.Context) error { return nil })
+	if err := slow.do(ctx, 0, func(context.Context) error { return nil }); err != context.DeadlineExceeded {
+		t.Errorf("query waiting past its context failed with %v", err)
+	}
+}
+
+func TestWithSourceLimits(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	for _, tc := range []struct {
+		source string
+		limits SourceLimits
+	}{
+		{SourceCymru, SourceLimits{QPS: -1}},
+		{SourceIpinfo, SourceLimits{Retries: -1}},
+		{SourceGeoIP, SourceLimits{Retries: 1}},
+	} {
+		if err := WithSourceLimits(tc.source, tc.limits)(&h); err == nil {
+			t.Errorf("WithSourceLimits(%s, %+v) did not fail", tc.source, tc.limits)
+		}
+	}
+}
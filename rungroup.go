@@ -0,0 +1,163 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// closeTimeout is the default time Close waits for background tasks.
+const closeTimeout = time.Second * 10
+
+// HandlerClosedError is returned by lookups and background work
+// of a closed handler (see Close).
+var HandlerClosedError = errors.New("handler closed")
+
+// WithCloseTimeout sets how long Close waits for background tasks to exit.
+// Pass zero for the default (10 seconds).
+func WithCloseTimeout(timeout time.Duration) Option {
+	return func(h *Handler) error {
+		if timeout < 0 {
+			return fmt.Errorf("invalid close timeout %s", timeout)
+		}
+		if timeout == 0 {
+			timeout = closeTimeout
+		}
+		h.runs.timeout = timeout
+		return nil
+	}
+}
+
+// Close stops the handler background tasks,
+// such as dataset refreshes and overrides watches
+// (see StartOverridesWatch),
+// waits for them to exit,
+// then closes the GeoIP databases and purges the cache.
+// Closing a closed handler does nothing.
+//
+// LookupAsn and its variants fail with HandlerClosedError afterwards,
+// and LookupIp answers no addresses.
+// Handlers derived from h (see Derive), or h derives from,
+// are closed too.
+//
+// Returns an error if tasks are still running after the close timeout
+// (see WithCloseTimeout), or if a database fails to close.
+func (h Handler) Close() error {
+	err := h.runs.close()
+	for _, db := range []*mmdbReader{h.mmdb, h.countryDB} {
+		if db == nil {
+			continue
+		}
+		if mmdbErr := db.close(); mmdbErr != nil && err == nil {
+			err = fmt.Errorf("cannot close mmdb database: %s", mmdbErr)
+		}
+	}
+	for _, db := range []geoipDB{h.geoip4, h.geoip6} {
+		if closer, ok := db.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	h.cache.purgeAll()
+	h.prefixes.purgeAll()
+	h.names.purgeAll()
+	h.countries.purgeAll()
+	return err
+}
+
+// runGroup runs the background tasks of a handler,
+// sharing a context canceled on close.
+type runGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Time close waits for tasks
+	timeout time.Duration
+	// Concurrent access control to fields below
+	sync.Mutex
+	closed atomic.Bool
+	// Number of running tasks
+	running int
+	tasks   sync.WaitGroup
+}
+
+// newRunGroup creates a run group.
+func newRunGroup() *runGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &runGroup{
+		ctx:     ctx,
+		cancel:  cancel,
+		timeout: closeTimeout,
+	}
+}
+
+// run starts task in the background,
+// with a context canceled when the group is closed.
+//
+// Returns HandlerClosedError if the group is closed.
+func (g *runGroup) run(task func(ctx context.Context)) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.closed.Load() {
+		return HandlerClosedError
+	}
+	g.running++
+	g.tasks.Add(1)
+	go func() {
+		defer g.tasks.Done()
+		task(g.ctx)
+		g.Lock()
+		g.running--
+		g.Unlock()
+	}()
+	return nil
+}
+
+// close cancels the tasks context and waits for them to exit,
+// up to the group timeout.
+func (g *runGroup) close() error {
+	g.Lock()
+	g.closed.Store(true)
+	g.Unlock()
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.tasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(g.timeout):
+		g.Lock()
+		defer g.Unlock()
+		return fmt.Errorf("%d background tasks still running after %s", g.running, g.timeout)
+	}
+}
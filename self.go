@@ -0,0 +1,332 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategies discovering the public IP address of the handler
+// (see WithSelfDiscovery).
+const (
+	// Ask an HTTPS echo endpoint
+	SelfHTTPS = "https"
+	// Send a STUN binding request, reporting the address of the UDP path
+	SelfSTUN = "stun"
+)
+
+const (
+	// selfSTUNServer is the default STUN server.
+	selfSTUNServer = "stun.l.google.com:19302"
+	// selfTimeout is the default bound of a discovery.
+	selfTimeout = time.Second * 5
+	// selfCacheTTL is the default time a discovered address is kept.
+	selfCacheTTL = time.Minute * 5
+	// selfSTUNRetransmit is the interval of STUN request retransmissions.
+	selfSTUNRetransmit = time.Millisecond * 500
+	// stunMagicCookie is the magic cookie of STUN messages (RFC5389).
+	stunMagicCookie = 0x2112A442
+)
+
+// SelfDiscoveryFailedError is returned by LookupSelf
+// when the public IP address of the handler cannot be discovered,
+// such as in environments without egress.
+type SelfDiscoveryFailedError struct {
+	// Strategy used
+	Strategy string
+	// Why it failed
+	Err error
+}
+
+func (e *SelfDiscoveryFailedError) Error() string {
+	return fmt.Sprintf("%s discovery of public IP address failed: %s", e.Strategy, e.Err)
+}
+
+func (e *SelfDiscoveryFailedError) Unwrap() error {
+	return e.Err
+}
+
+// SelfDiscoveryConfig configures how LookupSelf
+// discovers the public IP address of the handler.
+type SelfDiscoveryConfig struct {
+	// SelfHTTPS (default) or SelfSTUN
+	Strategy string
+	// Echo endpoint answering the address of clients, in plain text,
+	// for SelfHTTPS; defaults to ipinfo.io/ip
+	URL string
+	// STUN server (host:port) for SelfSTUN;
+	// defaults to stun.l.google.com:19302
+	STUNServer string
+	// Bound of a discovery, defaults to 5 seconds
+	Timeout time.Duration
+	// Time a discovered address is kept, defaults to 5 minutes
+	CacheTTL time.Duration
+}
+
+// selfDiscovery discovers the public IP address of the handler,
+// keeping it for a while.
+type selfDiscovery struct {
+	cfg SelfDiscoveryConfig
+	// Concurrent access control to fields below,
+	// held during discoveries so that they do not pile up
+	sync.Mutex
+	addr netip.Addr
+	due  time.Time
+}
+
+// WithSelfDiscovery configures how LookupSelf
+// discovers the public IP address of the handler,
+// instead of asking ipinfo.io over HTTPS.
+func WithSelfDiscovery(cfg SelfDiscoveryConfig) Option {
+	return func(h *Handler) error {
+		switch cfg.Strategy {
+		case "":
+			cfg.Strategy = SelfHTTPS
+		case SelfHTTPS, SelfSTUN:
+		default:
+			return fmt.Errorf("unknown self discovery strategy '%s'", cfg.Strategy)
+		}
+		if cfg.Timeout < 0 || cfg.CacheTTL < 0 {
+			return errors.New("negative self discovery timeout or cache TTL")
+		}
+		h.self = newSelfDiscovery(cfg)
+		return nil
+	}
+}
+
+// newSelfDiscovery returns an initialized selfDiscovery,
+// applying configuration defaults but the ipinfo.io URL.
+func newSelfDiscovery(cfg SelfDiscoveryConfig) *selfDiscovery {
+	if cfg.Strategy == "" {
+		cfg.Strategy = SelfHTTPS
+	}
+	if cfg.STUNServer == "" {
+		cfg.STUNServer = selfSTUNServer
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = selfTimeout
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = selfCacheTTL
+	}
+	return &selfDiscovery{cfg: cfg}
+}
+
+// LookupSelf gathers what is known about the public IP address
+// of the handler, as LookupIpInfo does,
+// such as the ASN a probe runs in.
+// The address is discovered as configured by WithSelfDiscovery,
+// and kept for a while.
+//
+// Returns the IP address information,
+// including the discovery strategy (IpInfo.Discovery),
+// or a *SelfDiscoveryFailedError if the address cannot be discovered.
+func (h Handler) LookupSelf(ctx context.Context, opts ...LookupOption) (IpInfo, error) {
+	addr, err := h.discoverSelf(ctx)
+	if err != nil {
+		return IpInfo{Discovery: h.self.cfg.Strategy}, err
+	}
+	info, err := h.LookupIpInfo(ctx, addr.String(), opts...)
+	info.Discovery = h.self.cfg.Strategy
+	return info, err
+}
+
+// discoverSelf returns the public IP address of the handler,
+// discovering it if not known or expired.
+func (h Handler) discoverSelf(ctx context.Context) (netip.Addr, error) {
+	s := h.self
+	s.Lock()
+	defer s.Unlock()
+	if s.addr.IsValid() && time.Now().Before(s.due) {
+		return s.addr, nil
+	}
+	if h.offline {
+		return netip.Addr{}, &SelfDiscoveryFailedError{Strategy: s.cfg.Strategy, Err: OfflineModeError}
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	var (
+		addr netip.Addr
+		err  error
+	)
+	switch s.cfg.Strategy {
+	case SelfSTUN:
+		addr, err = stunDiscover(ctx, s.cfg.STUNServer)
+	default:
+		url, client := s.cfg.URL, h.newHTTPClient()
+		if url == "" {
+			url, client = h.ipinfoClient().baseURL+"/ip", h.ipinfoClient().client
+		}
+		addr, err = httpsDiscover(ctx, client, url)
+	}
+	if err != nil {
+		return netip.Addr{}, &SelfDiscoveryFailedError{Strategy: s.cfg.Strategy, Err: h.redactError(err)}
+	}
+	s.addr, s.due = addr, time.Now().Add(s.cfg.CacheTTL)
+	return addr, nil
+}
+
+// httpsDiscover asks an echo endpoint for the public IP address,
+// with a given HTTP client.
+func httpsDiscover(ctx context.Context, client *http.Client, url string) (netip.Addr, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to GET '%s': %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("GET '%s' returned status %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to read '%s': %w", url, err)
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("unexpected answer from '%s': %w", url, err)
+	}
+	return addr.Unmap(), nil
+}
+
+// stunDiscover sends a STUN binding request (RFC5389) to a server,
+// retransmitting it until answered or ctx expires.
+//
+// Returns the address the server saw the request from.
+func stunDiscover(ctx context.Context, server string) (netip.Addr, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("cannot reach STUN server '%s': %w", server, err)
+	}
+	defer conn.Close()
+	// Binding request, without attributes
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], 0x0001)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return netip.Addr{}, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		if err := ctxErr(ctx); err != nil {
+			return netip.Addr{}, fmt.Errorf("no answer from STUN server '%s': %w", server, err)
+		}
+		if _, err := conn.Write(req); err != nil {
+			return netip.Addr{}, fmt.Errorf("cannot send STUN request to '%s': %w", server, err)
+		}
+		deadline := time.Now().Add(selfSTUNRetransmit)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return netip.Addr{}, fmt.Errorf("failed to read STUN answer from '%s': %w", server, err)
+			}
+			if addr, ok := parseSTUNBinding(buf[:n], req[8:20]); ok {
+				return addr, nil
+			}
+		}
+	}
+}
+
+// parseSTUNBinding parses a STUN binding success response
+// to a request of a given transaction ID.
+//
+// Returns the mapped address, and whether the response was valid.
+func parseSTUNBinding(msg []byte, id []byte) (netip.Addr, bool) {
+	if len(msg) < 20 || binary.BigEndian.Uint16(msg[0:]) != 0x0101 ||
+		binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie || !bytes.Equal(msg[8:20], id) {
+		return netip.Addr{}, false
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if len(msg) < 20+length {
+		return netip.Addr{}, false
+	}
+	var mapped netip.Addr
+	for attrs := msg[20 : 20+length]; len(attrs) >= 4; {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		n := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+n {
+			break
+		}
+		value := attrs[4 : 4+n]
+		// Attributes are padded to 4 bytes
+		attrs = attrs[min(len(attrs), 4+(n+3)&^3):]
+		if len(value) < 8 {
+			continue
+		}
+		addr := value[4:]
+		switch typ {
+		case 0x0020: // XOR-MAPPED-ADDRESS
+			xored := make([]byte, len(addr))
+			key := msg[4:20]
+			for i := range addr {
+				xored[i] = addr[i] ^ key[i%len(key)]
+			}
+			if a, ok := stunAddr(value[1], xored); ok {
+				return a, true
+			}
+		case 0x0001: // MAPPED-ADDRESS
+			if a, ok := stunAddr(value[1], addr); ok {
+				mapped = a
+			}
+		}
+	}
+	return mapped, mapped.IsValid()
+}
+
+// stunAddr decodes the address of a STUN address attribute
+// of a given family.
+func stunAddr(family byte, b []byte) (netip.Addr, bool) {
+	switch {
+	case family == 0x01 && len(b) == 4:
+		return netip.AddrFrom4([4]byte(b)), true
+	case family == 0x02 && len(b) == 16:
+		return netip.AddrFrom16([16]byte(b)), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestSTUN starts a STUN server on localhost,
+// answering binding requests with a given mapped address,
+// after dropping the first drop requests.
+//
+// Returns the server address.
+func startTestSTUN(t *testing.T, mapped net.IP, drop int) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if drop > 0 || n < 20 {
+				drop--
+				continue
+			}
+			// XOR-MAPPED-ADDRESS of family 1 (IPv4)
+			ip := mapped.To4()
+			resp := make([]byte, 32)
+			binary.BigEndian.PutUint16(resp[0:], 0x0101)
+			binary.BigEndian.PutUint16(resp[2:], 12)
+			copy(resp[4:20], buf[4:20])
+			binary.BigEndian.PutUint16(resp[20:], 0x0020)
+			binary.BigEndian.PutUint16(resp[22:], 8)
+			resp[25] = 0x01
+			binary.BigEndian.PutUint16(resp[26:], 4242^0x2112)
+			for i := range ip {
+				resp[28+i] = ip[i] ^ resp[4+i]
+			}
+			pc.WriteTo(resp, from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestLookupSelf(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/ip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("1.1.1.1\n"))
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	// Default strategy, asking ipinfo.io
+	h := NewFixtureHandler()
+	h.ipinfo.baseURL = ts.URL
+	for i := 0; i < 2; i++ {
+		info, err := h.LookupSelf(ctx)
+		if err != nil || info.IP != "1.1.1.1" || info.Asn != "AS13335" || info.Discovery != SelfHTTPS {
+			t.Fatalf("LookupSelf returned %+v, %v", info, err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 discovery, got %d", n)
+	}
+	// STUN, retransmitting the request
+	h = NewFixtureHandler()
+	stun := SelfDiscoveryConfig{Strategy: SelfSTUN, STUNServer: startTestSTUN(t, net.ParseIP("8.8.8.8"), 1)}
+	if err := WithSelfDiscovery(stun)(&h); err != nil {
+		t.Fatalf("WithSelfDiscovery failed: %s", err)
+	}
+	info, err := h.LookupSelf(ctx)
+	if err != nil || info.IP != "8.8.8.8" || info.Asn != "AS15169" || info.Discovery != SelfSTUN {
+		t.Fatalf("LookupSelf returned %+v, %v", info, err)
+	}
+	if err := WithSelfDiscovery(SelfDiscoveryConfig{Strategy: "dns"})(&h); err == nil {
+		t.Fatalf("expected an error for an unknown strategy")
+	}
+}
+
+func TestLookupSelfNoEgress(t *testing.T) {
+	// Servers which never answer
+	silent := startTestSTUN(t, net.ParseIP("8.8.8.8"), 1<<30)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	for _, cfg := range []SelfDiscoveryConfig{
+		{Strategy: SelfSTUN, STUNServer: silent, Timeout: time.Millisecond * 200},
+		{Strategy: SelfHTTPS, URL: ts.URL, Timeout: time.Millisecond * 200},
+		{Strategy: SelfHTTPS, URL: "http://127.0.0.1:1/ip"},
+	} {
+		h := NewFixtureHandler()
+		if err := WithSelfDiscovery(cfg)(&h); err != nil {
+			t.Fatalf("WithSelfDiscovery failed: %s", err)
+		}
+		start := time.Now()
+		_, err := h.LookupSelf(context.Background())
+		var e *SelfDiscoveryFailedError
+		if !errors.As(err, &e) || e.Strategy != cfg.Strategy {
+			t.Fatalf("%s LookupSelf returned %v", cfg.Strategy, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("%s LookupSelf took %s", cfg.Strategy, elapsed)
+		}
+	}
+}
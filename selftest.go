@@ -0,0 +1,213 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	// selfTestAnchor is the address resolved by SelfTest,
+	// announced for long by a well-known ASN.
+	selfTestAnchor = "8.8.8.8"
+	// selfTestAsn is the dedicated ASN of SelfTest overrides:
+	// reserved (RFC 7300), it is never looked up.
+	selfTestAsn = "AS4294967295"
+	// geoipInfoMaxSize bounds the search
+	// for the database info at the end of a GeoIP database file.
+	geoipInfoMaxSize = 100
+)
+
+// selfTestMaxDatabaseAge is the age past which
+// SelfTest deems GeoIP databases stale.
+var selfTestMaxDatabaseAge = time.Hour * 24 * 45
+
+// reGeoipBuild matches the build date in GeoIP database info.
+var reGeoipBuild = regexp.MustCompile(`\b(\d{8}) Build\b`)
+
+// SelfTestFailedError is returned by SelfTest
+// when any of its checks fails.
+var SelfTestFailedError = errors.New("self-test failed")
+
+// SelfTestCheck is the result of a SelfTest check.
+type SelfTestCheck struct {
+	// What is checked, such as "source:cymru"
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// What was found, or what failed
+	Detail string `json:"detail,omitempty"`
+	// How to fix a failure
+	Hint    string        `json:"hint,omitempty"`
+	Latency time.Duration `json:"latency"`
+}
+
+// SelfTestReport is the result of SelfTest.
+type SelfTestReport struct {
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// Failed returns the failed checks.
+func (r SelfTestReport) Failed() []SelfTestCheck {
+	var failed []SelfTestCheck
+	for _, c := range r.Checks {
+		if !c.Passed {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// SelfTest checks that the handler works in its environment,
+// with real but minimal traffic:
+// an anchor address is resolved through each enabled source individually,
+// a sentinel override is written, read and removed
+// (under a dedicated reserved ASN),
+// an entry is cached and read back,
+// and the GeoIP databases are checked not to be older than 45 days.
+// Checks of disabled features are left out.
+//
+// Nothing SelfTest does changes lookup answers.
+//
+// Returns the report of every check,
+// and SelfTestFailedError if any failed.
+func (h Handler) SelfTest(ctx context.Context) (SelfTestReport, error) {
+	var report SelfTestReport
+	check := func(name string, hint string, run func() (string, error)) {
+		start := time.Now()
+		detail, err := run()
+		c := SelfTestCheck{Name: name, Passed: err == nil, Detail: detail, Latency: time.Since(start)}
+		if err != nil {
+			c.Detail, c.Hint = h.redactError(err).Error(), hint
+		}
+		report.Checks = append(report.Checks, c)
+	}
+	anchor := netip.MustParseAddr(selfTestAnchor)
+	if source, lookup := h.localDatabase(); lookup != nil {
+		check("source:"+source, "reinstall the GeoIP ASN databases", func() (string, error) {
+			asn, descr, err := lookup(selfTestAnchor)
+			return selfTestAnswer(asn, descr, err)
+		})
+	}
+	if h.fixtures == nil {
+		check("source:"+SourceIpinfo, "check HTTPS access to ipinfo.io and the ipinfo token", func() (string, error) {
+			asn, descr, err := h.ipInfoLookup(ctx, selfTestAnchor)
+			return selfTestAnswer(asn, descr, err)
+		})
+		check("source:"+SourceCymru, "check DNS resolution of asn.cymru.com through the resolver", func() (string, error) {
+			origin, err := h.cymru.origin(ctx, anchor)
+			if err != nil {
+				return "", err
+			}
+			return selfTestAnswer(origin.asns[0], origin.prefix.String(), nil)
+		})
+	}
+	if h.overrides != nil {
+		check(SourceOverrides, "grant read and write access to the overrides collection", h.selfTestOverrides)
+	}
+	check(SourceCache, "report a bug: the cache is not working", func() (string, error) {
+		key := "selftest:" + selfTestAsn
+		h.cache.store(key, cacheEntry{asn: selfTestAsn, ttl: time.Minute})
+		defer h.cache.purgeASN(selfTestAsn)
+		if entry, expired, found := h.cache.lookupByIP(key); !found || expired || entry.asn != selfTestAsn {
+			return "", fmt.Errorf("cached entry not found")
+		}
+		return "entry stored and found", nil
+	})
+	for _, path := range h.geoipFiles {
+		check("database:"+path, "update the GeoIP databases, such as with geoipupdate", func() (string, error) {
+			built, err := geoipBuildDate(path)
+			if err != nil {
+				return "", err
+			}
+			age := time.Since(built).Truncate(time.Hour)
+			if age > selfTestMaxDatabaseAge {
+				return "", fmt.Errorf("database built %s ago, more than %s", age, selfTestMaxDatabaseAge)
+			}
+			return fmt.Sprintf("built %s ago", age), nil
+		})
+	}
+	if len(report.Failed()) > 0 {
+		return report, SelfTestFailedError
+	}
+	return report, nil
+}
+
+// selfTestOverrides writes, reads and removes a sentinel override.
+func (h Handler) selfTestOverrides() (string, error) {
+	sentinel := "geoipdb self-test " + time.Now().UTC().Format(time.RFC3339Nano)
+	if err := h.OverridesSet(selfTestAsn, sentinel); err != nil {
+		return "", err
+	}
+	descr, err := h.OverridesLookup(selfTestAsn)
+	if err == nil && descr != sentinel {
+		err = fmt.Errorf("override read back as '%s'", descr)
+	}
+	if rerr := h.OverridesRemove(selfTestAsn); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return "sentinel override written, read and removed", nil
+}
+
+// selfTestAnswer describes the answer of a source to SelfTest.
+func selfTestAnswer(asn string, descr string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if asn == "" {
+		return "", fmt.Errorf("no ASN found for %s", selfTestAnchor)
+	}
+	return fmt.Sprintf("%s answered %s %s", selfTestAnchor, asn, descr), nil
+}
+
+// geoipBuildDate reads the build date of a GeoIP database file
+// from its database info, or else its modification time.
+func geoipBuildDate(path string) (time.Time, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The database info is near the end, such as "GEO-117 20160628 Build 1 ..."
+	tail := b[max(0, len(b)-geoipInfoMaxSize):]
+	if m := reGeoipBuild.FindSubmatch(tail); m != nil {
+		if built, err := time.Parse("20060102", string(m[1])); err == nil {
+			return built, nil
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("AS15169 Google LLC\n"))
+	}))
+	defer ts.Close()
+	zone := testDNSZone{
+		originName("8.8.8.8"): {originName("8.8.8.8") + ` 300 IN TXT "15169 | 8.8.8.0/24 | US | arin | 2023-12-28"`},
+	}
+	// A fresh database, and a stale one
+	dir := t.TempDir()
+	fresh, stale := filepath.Join(dir, "fresh.dat"), filepath.Join(dir, "stale.dat")
+	info := []byte("\x00\x00\x00GEO-117 " + time.Now().Format("20060102") + " Build 1 Copyright (c) MaxMind")
+	if err := os.WriteFile(fresh, info, 0644); err != nil {
+		t.Fatalf("cannot write database: %s", err)
+	}
+	if err := os.WriteFile(stale, []byte("no info"), 0644); err != nil {
+		t.Fatalf("cannot write database: %s", err)
+	}
+	old := time.Now().Add(-selfTestMaxDatabaseAge - time.Hour*24)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatalf("cannot age database: %s", err)
+	}
+	h := newHandler(nil, time.Second)
+	h.ipinfo.baseURL = ts.URL
+	h.resolver.server = startTestDNS(t, zone.serve)
+	h.geoipFiles = []string{fresh}
+	report, err := h.SelfTest(context.Background())
+	if err != nil {
+		t.Fatalf("SelfTest failed: %s: %+v", err, report.Failed())
+	}
+	expected := []string{"source:ipinfo", "source:cymru", "cache", "database:" + fresh}
+	if len(report.Checks) != len(expected) {
+		t.Fatalf("unexpected checks %+v", report.Checks)
+	}
+	for i, c := range report.Checks {
+		if c.Name != expected[i] || !c.Passed || c.Hint != "" {
+			t.Fatalf("unexpected check %+v", c)
+		}
+	}
+	if h.cache.len() != 0 {
+		t.Fatalf("SelfTest left %d cache entries", h.cache.len())
+	}
+	// Failures come with hints
+	h.resolver.server = startTestDNS(t, testDNSZone{}.serve)
+	h.geoipFiles = []string{fresh, stale}
+	report, err = h.SelfTest(context.Background())
+	if err != SelfTestFailedError {
+		t.Fatalf("unexpected SelfTest error: %v", err)
+	}
+	failed := report.Failed()
+	if len(failed) != 2 || failed[0].Name != "source:cymru" || failed[1].Name != "database:"+stale {
+		t.Fatalf("unexpected failed checks %+v", failed)
+	}
+	for _, c := range failed {
+		if c.Hint == "" || c.Detail == "" {
+			t.Fatalf("check %s failed without detail nor hint", c.Name)
+		}
+	}
+}
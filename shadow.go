@@ -0,0 +1,213 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// shadowConcurrency is the default bound of shadow lookups in progress.
+	shadowConcurrency = 4
+	// shadowTimeout is the default bound of a shadow lookup.
+	shadowTimeout = time.Second * 5
+	// shadowExamples is the default number of mismatches kept.
+	shadowExamples = 32
+)
+
+// ShadowFunc is a lookup implementation run in shadow mode
+// (see WithShadow), answering the ASN of an IP address
+// and its description.
+type ShadowFunc func(ctx context.Context, ip string) (asn string, descr string, err error)
+
+// ShadowConfig configures shadow mode.
+type ShadowConfig struct {
+	// Source whose answers are compared (SourceGeoIP, SourceCymru...),
+	// empty for all answers not served from cache
+	Primary string
+	// Implementation compared to Primary
+	Shadow ShadowFunc
+	// Share of the answers compared, from 0 to 1
+	SampleRate float64
+	// Bound of shadow lookups in progress, defaults to 4;
+	// samples past it are dropped
+	Concurrency int
+	// Bound of a shadow lookup, defaults to 5 seconds
+	Timeout time.Duration
+	// Number of mismatches kept as examples, defaults to 32
+	Examples int
+}
+
+// ShadowMismatch is an answer of the shadow implementation
+// differing from the primary source.
+type ShadowMismatch struct {
+	// IP address looked up (truncated if anonymized, see WithAnonymization)
+	IP string    `json:"ip"`
+	At time.Time `json:"at"`
+	// Answers of the primary source and the shadow implementation
+	PrimaryAsn   string `json:"primary_asn"`
+	PrimaryDescr string `json:"primary_descr"`
+	ShadowAsn    string `json:"shadow_asn"`
+	ShadowDescr  string `json:"shadow_descr"`
+	// Shadow failure, if any
+	ShadowErr string `json:"shadow_err,omitempty"`
+}
+
+// ShadowStats reports the comparisons of shadow mode.
+type ShadowStats struct {
+	// Answers compared, matching on ASN, and not matching
+	Sampled    uint64 `json:"sampled"`
+	Matched    uint64 `json:"matched"`
+	Mismatched uint64 `json:"mismatched"`
+	// Mismatches where the shadow implementation failed
+	Errors uint64 `json:"errors"`
+	// Samples dropped at the concurrency bound
+	Dropped uint64 `json:"dropped"`
+	// Latest mismatches, oldest first
+	Examples []ShadowMismatch `json:"examples"`
+}
+
+// WithShadow enables shadow mode, comparing a lookup implementation,
+// such as a replacement of a source, to the answers of a source.
+// LookupAsn answers are served as usual,
+// and a sample of those found by the primary source
+// (rather than served from cache) are looked up again
+// in the background by the shadow implementation.
+// Answers are compared on ASN, mismatches being reported
+// in Status (see also DebugDump).
+//
+// Shadow lookups add no latency to lookups, and are not cached.
+func WithShadow(cfg ShadowConfig) Option {
+	return func(h *Handler) error {
+		if cfg.Shadow == nil {
+			return errors.New("nil shadow implementation")
+		}
+		if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+			return fmt.Errorf("invalid shadow sample rate %g", cfg.SampleRate)
+		}
+		if cfg.Concurrency <= 0 {
+			cfg.Concurrency = shadowConcurrency
+		}
+		if cfg.Timeout <= 0 {
+			cfg.Timeout = shadowTimeout
+		}
+		if cfg.Examples <= 0 {
+			cfg.Examples = shadowExamples
+		}
+		h.shadow = &shadow{
+			cfg:      cfg,
+			runs:     h.runs,
+			slots:    make(chan struct{}, cfg.Concurrency),
+			examples: make([]ShadowMismatch, 0, cfg.Examples),
+		}
+		return nil
+	}
+}
+
+// shadow runs shadow lookups (see WithShadow).
+type shadow struct {
+	cfg  ShadowConfig
+	runs *runGroup
+	// Semaphore of shadow lookups in progress
+	slots chan struct{}
+	// Concurrent access control to fields below
+	sync.Mutex
+	stats ShadowStats
+	// Ring buffer of mismatches, next being the oldest once full
+	examples []ShadowMismatch
+	next     int
+}
+
+// sample compares in the background a lookup answer
+// to the shadow implementation, if sampled.
+// Parameter key is the address reported in mismatches.
+func (s *shadow) sample(ip string, key string, entry cacheEntry) {
+	if s.cfg.Primary != "" && entry.source != s.cfg.Primary || rand.Float64() >= s.cfg.SampleRate {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.Lock()
+		s.stats.Dropped++
+		s.Unlock()
+		return
+	}
+	err := s.runs.run(func(ctx context.Context) {
+		defer func() { <-s.slots }()
+		ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+		defer cancel()
+		asn, descr, err := s.cfg.Shadow(ctx, ip)
+		s.compare(key, entry, asn, descr, err)
+	})
+	if err != nil {
+		<-s.slots
+	}
+}
+
+// compare records the comparison of an answer to the shadow one.
+func (s *shadow) compare(key string, entry cacheEntry, asn string, descr string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.stats.Sampled++
+	if err == nil && asn == entry.asn {
+		s.stats.Matched++
+		return
+	}
+	s.stats.Mismatched++
+	m := ShadowMismatch{
+		IP:           key,
+		At:           time.Now(),
+		PrimaryAsn:   entry.asn,
+		PrimaryDescr: entry.descr,
+		ShadowAsn:    asn,
+		ShadowDescr:  descr,
+	}
+	if err != nil {
+		s.stats.Errors++
+		m.ShadowErr = err.Error()
+	}
+	if len(s.examples) < cap(s.examples) {
+		s.examples = append(s.examples, m)
+		return
+	}
+	s.examples[s.next] = m
+	s.next = (s.next + 1) % len(s.examples)
+}
+
+// status returns the comparisons made so far.
+func (s *shadow) status() *ShadowStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := s.stats
+	stats.Examples = append(append([]ShadowMismatch{}, s.examples[s.next:]...), s.examples[:s.next]...)
+	return &stats
+}
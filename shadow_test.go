@@ -0,0 +1,121 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	release := make(chan struct{})
+	h := NewFixtureHandler()
+	err := WithShadow(ShadowConfig{
+		Primary: SourceFixtures,
+		Shadow: func(ctx context.Context, ip string) (string, string, error) {
+			<-release
+			switch ip {
+			case "8.8.8.8", "8.8.4.4":
+				return "AS15169", "GOOGLE", nil
+			case "1.1.1.1":
+				return "AS64500", "TEST", nil
+			}
+			return "", "", errors.New("not found")
+		},
+		SampleRate:  1,
+		Concurrency: 4,
+		Examples:    2,
+	})(&h)
+	if err != nil {
+		t.Fatalf("WithShadow failed: %s", err)
+	}
+	// Lookups do not wait for blocked shadow lookups
+	ips := []string{"8.8.8.8", "1.1.1.1", "9.9.9.9", "8.8.4.4", "1.0.0.1", "208.67.222.222"}
+	for _, ip := range ips {
+		if _, _, err := h.LookupAsnCtx(context.Background(), ip); err != nil {
+			t.Fatalf("LookupAsnCtx(%s) failed: %s", ip, err)
+		}
+	}
+	// Cache hits are not compared
+	h.LookupAsnCtx(context.Background(), "8.8.8.8")
+	close(release)
+	var stats *ShadowStats
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if stats = h.Status().Shadow; stats.Sampled == 4 {
+			break
+		}
+	}
+	if stats.Sampled != 4 || stats.Matched != 2 || stats.Mismatched != 2 || stats.Errors != 1 || stats.Dropped != 2 {
+		t.Fatalf("unexpected shadow stats %+v", stats)
+	}
+	if len(stats.Examples) != 2 {
+		t.Fatalf("unexpected examples %+v", stats.Examples)
+	}
+	for _, m := range stats.Examples {
+		switch m.IP {
+		case "1.1.1.1":
+			if m.PrimaryAsn != "AS13335" || m.ShadowAsn != "AS64500" || m.ShadowErr != "" {
+				t.Fatalf("unexpected mismatch %+v", m)
+			}
+		case "9.9.9.9":
+			if m.PrimaryAsn != "AS19281" || m.ShadowErr != "not found" {
+				t.Fatalf("unexpected mismatch %+v", m)
+			}
+		default:
+			t.Fatalf("unexpected mismatch %+v", m)
+		}
+	}
+	// Shadow answers are not cached
+	if entry, _, _ := h.cache.lookupByIP("1.1.1.1"); entry.asn != "AS13335" {
+		t.Fatalf("cache holds %+v", entry)
+	}
+	var dump bytes.Buffer
+	if err := h.DebugDump(&dump); err != nil || !strings.Contains(dump.String(), `"shadow_asn": "AS64500"`) {
+		t.Fatalf("DebugDump returned %v:\n%s", err, dump.String())
+	}
+}
+
+func TestShadowExamples(t *testing.T) {
+	s := &shadow{examples: make([]ShadowMismatch, 0, 3)}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"} {
+		s.compare(ip, cacheEntry{asn: "AS64500"}, "AS64501", "", nil)
+	}
+	var ips []string
+	for _, m := range s.status().Examples {
+		ips = append(ips, m.IP)
+	}
+	if strings.Join(ips, " ") != "192.0.2.3 192.0.2.4 192.0.2.5" {
+		t.Fatalf("unexpected examples %v", ips)
+	}
+}
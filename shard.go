@@ -0,0 +1,76 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"hash/fnv"
+	"net/netip"
+)
+
+const (
+	// Bits of the prefixes whose addresses ShardForIP co-locates
+	shardBitsV4 = 24
+	shardBitsV6 = 48
+)
+
+// ShardForIP assigns an IP address to one of n shards,
+// such as handler replicas, so that each shard caches its own addresses.
+// Addresses of the same /24 (IPv4) or /48 (IPv6) prefix
+// are assigned to the same shard.
+//
+// The assignment is stable across versions of this package,
+// and consistent: when n grows, only about 1/n of the addresses move.
+//
+// Returns the shard, from 0 to n-1, or 0 if n < 1 or ip is invalid.
+func ShardForIP(ip netip.Addr, n int) int {
+	if n <= 1 || !ip.IsValid() {
+		return 0
+	}
+	ip = ip.Unmap().WithZone("")
+	bits := shardBitsV6
+	if ip.Is4() {
+		bits = shardBitsV4
+	}
+	p, _ := ip.Prefix(bits)
+	addr := p.Addr().AsSlice()
+	hash := fnv.New64a()
+	// Address family, then the prefix bytes
+	hash.Write([]byte{byte(len(addr))})
+	hash.Write(addr[:bits/8])
+	return jumpHash(hash.Sum64(), n)
+}
+
+// jumpHash is the jump consistent hash of Lamping and Veach,
+// mapping a key to one of n buckets.
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
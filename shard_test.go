@@ -0,0 +1,96 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestShardForIP(t *testing.T) {
+	// Golden assignments, which must not change across versions
+	tests := []struct {
+		ip     string
+		shards [4]int
+	}{
+		{"1.1.1.1", [4]int{0, 4, 13, 127}},
+		{"1.1.1.254", [4]int{0, 4, 13, 127}},
+		{"8.8.8.8", [4]int{1, 1, 1, 878}},
+		{"::ffff:8.8.8.8", [4]int{1, 1, 1, 878}},
+		{"9.9.9.9", [4]int{0, 6, 14, 545}},
+		{"203.0.113.7", [4]int{1, 1, 1, 232}},
+		{"2001:4860:4860::8888", [4]int{0, 0, 0, 424}},
+		{"2001:4860:4860:1::1", [4]int{0, 0, 0, 424}},
+		{"2606:4700::1111", [4]int{0, 2, 2, 708}},
+	}
+	for _, test := range tests {
+		ip := netip.MustParseAddr(test.ip)
+		for i, n := range []int{2, 7, 16, 1000} {
+			if shard := ShardForIP(ip, n); shard != test.shards[i] {
+				t.Fatalf("ShardForIP(%s, %d) returned %d, expected %d", ip, n, shard, test.shards[i])
+			}
+		}
+		if shard := ShardForIP(ip, 1); shard != 0 {
+			t.Fatalf("ShardForIP(%s, 1) returned %d", ip, shard)
+		}
+	}
+	if shard := ShardForIP(netip.Addr{}, 10); shard != 0 {
+		t.Fatalf("ShardForIP of invalid address returned %d", shard)
+	}
+	// Growing from 10 to 11 shards moves about 1/11 of the prefixes
+	var moved int
+	for i := 0; i < 10000; i++ {
+		ip := netip.MustParseAddr(fmt.Sprintf("10.%d.%d.1", i/256, i%256))
+		before, after := ShardForIP(ip, 10), ShardForIP(ip, 11)
+		if before != after {
+			if after != 10 {
+				t.Fatalf("%s moved from shard %d to %d", ip, before, after)
+			}
+			moved++
+		}
+	}
+	if moved < 700 || moved > 1100 {
+		t.Fatalf("%d of 10000 prefixes moved", moved)
+	}
+}
+
+func TestWarmupShard(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("1.1.1.0/24"),
+		netip.MustParsePrefix("8.8.8.0/24"),
+		netip.MustParsePrefix("9.9.9.0/24"),
+	}
+	h := NewFixtureHandler()
+	report, err := h.Warmup(context.Background(), prefixes, WarmupOptions{Shards: 2, Shard: 1})
+	if err != nil {
+		t.Fatalf("Warmup failed: %s", err)
+	}
+	if report != (WarmupReport{Resolved: 1, OtherShards: 2}) {
+		t.Fatalf("unexpected warm-up report %+v", report)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of SourceBreakerConfig
+	sourceBreakerFailures = 5
+	sourceBreakerWindow   = time.Minute
+	sourceBreakerCooldown = time.Second * 30
+)
+
+// BreakerHalfOpen is the state of a source circuit breaker
+// letting a probe call through after its cooldown (see WithSourceBreakers).
+const BreakerHalfOpen BreakerState = "half-open"
+
+// SourceBreakerOpenError is the failure of a source skipped
+// while its circuit breaker is open (see WithSourceBreakers).
+var SourceBreakerOpenError = newClassError("source skipped, circuit breaker open", SourceUnavailableError)
+
+// SourceBreakerConfig configures the circuit breakers of sources
+// (see WithSourceBreakers).
+type SourceBreakerConfig struct {
+	// Number of consecutive failures opening a breaker, zero for 5,
+	// counted if within Window of the first one, zero for 1 minute
+	Failures int
+	Window   time.Duration
+	// Time an open breaker skips its source, zero for 30 seconds
+	Cooldown time.Duration
+	// Called on state transitions, such as for metrics
+	OnTransition func(source string, from BreakerState, to BreakerState)
+}
+
+// WithSourceBreakers gives every source LookupAsn queries
+// but the local ASN database, such as ipinfo.io, Team Cymru
+// and the AsnSources of WithAsnSources, its own circuit breaker:
+// after cfg.Failures consecutive failures within cfg.Window,
+// the breaker of a source opens, and lookups skip the source
+// for cfg.Cooldown, going straight to the next one.
+// The breaker is then half-open: the next lookup queries the source,
+// closing the breaker if it succeeds, opening it again otherwise.
+// Failures matching NotFoundError do not count,
+// so AsnSources should wrap AsnNotFoundError when they do not know an ASN.
+//
+// Skipped sources fail with SourceBreakerOpenError,
+// and are reported to the metrics sink as "skipped" (see WithMetrics).
+// Transitions are logged, passed to cfg.OnTransition,
+// and the breakers states are reported by Status.
+// Handlers derived from the handler share its breakers (see Derive).
+func WithSourceBreakers(cfg SourceBreakerConfig) Option {
+	return func(h *Handler) error {
+		if cfg.Failures < 0 || cfg.Window < 0 || cfg.Cooldown < 0 {
+			return fmt.Errorf("invalid source breaker config %+v", cfg)
+		}
+		if h.tenant != "" {
+			return fmt.Errorf("derived handlers share the source breakers of their parent")
+		}
+		if cfg.Failures == 0 {
+			cfg.Failures = sourceBreakerFailures
+		}
+		if cfg.Window == 0 {
+			cfg.Window = sourceBreakerWindow
+		}
+		if cfg.Cooldown == 0 {
+			cfg.Cooldown = sourceBreakerCooldown
+		}
+		h.sourceBreakers = &sourceBreakers{cfg: cfg, breakers: make(map[string]*sourceBreaker)}
+		return nil
+	}
+}
+
+// sourceBreakers are the circuit breakers of sources, by source name.
+type sourceBreakers struct {
+	cfg SourceBreakerConfig
+	// Concurrent access control to breakers
+	sync.Mutex
+	breakers map[string]*sourceBreaker
+}
+
+// sourceBreaker is the circuit breaker of a source.
+type sourceBreaker struct {
+	state BreakerState
+	// Consecutive failures, and time of the first one
+	failures int
+	first    time.Time
+	// Whether a probe is in progress, while half-open
+	probing bool
+	// Last transition to open, and number of transitions to open
+	opened time.Time
+	opens  uint64
+}
+
+// allow tells whether a source may be queried,
+// turning its breaker half-open after its cooldown.
+func (b *sourceBreakers) allow(source string) bool {
+	b.Lock()
+	defer b.Unlock()
+	sb := b.breakers[source]
+	if sb == nil {
+		return true
+	}
+	switch sb.state {
+	case BreakerOpen:
+		if time.Since(sb.opened) < b.cfg.Cooldown {
+			return false
+		}
+		b.transition(source, sb, BreakerHalfOpen)
+		sb.probing = true
+		return true
+	case BreakerHalfOpen:
+		if sb.probing {
+			return false
+		}
+		sb.probing = true
+	}
+	return true
+}
+
+// record counts the result of a query of a source,
+// opening its breaker after too many consecutive failures,
+// or closing it after a successful probe.
+func (b *sourceBreakers) record(source string, err error) {
+	b.Lock()
+	defer b.Unlock()
+	sb := b.breakers[source]
+	if sb == nil {
+		if err == nil {
+			return
+		}
+		sb = &sourceBreaker{state: BreakerClosed}
+		b.breakers[source] = sb
+	}
+	now := time.Now()
+	switch {
+	case sb.state == BreakerHalfOpen && err == nil:
+		sb.probing = false
+		b.transition(source, sb, BreakerClosed)
+	case sb.state == BreakerHalfOpen:
+		sb.probing = false
+		b.open(source, sb, now)
+	case err == nil:
+		sb.failures = 0
+	case sb.state == BreakerClosed:
+		if sb.failures == 0 || now.Sub(sb.first) > b.cfg.Window {
+			sb.failures, sb.first = 0, now
+		}
+		sb.failures++
+		if sb.failures >= b.cfg.Failures {
+			b.open(source, sb, now)
+		}
+	}
+}
+
+// release ends a probe of a source which neither succeeded nor failed,
+// letting the next query probe it.
+func (b *sourceBreakers) release(source string) {
+	b.Lock()
+	defer b.Unlock()
+	if sb := b.breakers[source]; sb != nil {
+		sb.probing = false
+	}
+}
+
+// open opens the breaker of a source, with b locked.
+func (b *sourceBreakers) open(source string, sb *sourceBreaker, now time.Time) {
+	b.transition(source, sb, BreakerOpen)
+	sb.opened = now
+	sb.opens++
+}
+
+// transition changes the state of the breaker of a source, with b locked.
+func (b *sourceBreakers) transition(source string, sb *sourceBreaker, to BreakerState) {
+	from := sb.state
+	sb.state = to
+	sb.failures = 0
+	log.Printf("(geoipdb) %s breaker %s\n", source, to)
+	if b.cfg.OnTransition != nil {
+		b.cfg.OnTransition(source, from, to)
+	}
+}
+
+// status returns the status of the breakers, by source name.
+func (b *sourceBreakers) status() map[string]BreakerStatus {
+	b.Lock()
+	defer b.Unlock()
+	answer := make(map[string]BreakerStatus, len(b.breakers))
+	for source, sb := range b.breakers {
+		answer[source] = BreakerStatus{State: sb.state, Opened: sb.opened, Opens: sb.opens}
+	}
+	return answer
+}
+
+// guardSource queries a source by calling fn,
+// unless the breaker of the source is open (see WithSourceBreakers).
+// Failures of lookups given up, and of what is not found, do not count.
+//
+// Returns the error of fn, or SourceBreakerOpenError if the breaker is open.
+func (h Handler) guardSource(ctx context.Context, source string, fn func() error) error {
+	b := h.sourceBreakers
+	if b == nil {
+		return fn()
+	}
+	if !b.allow(source) {
+		h.observeMetric(source, "skipped")
+		return fmt.Errorf("%w: %s", SourceBreakerOpenError, source)
+	}
+	err := fn()
+	switch {
+	case err != nil && ctxErr(ctx) != nil:
+		// The source was not given the time to answer
+		b.release(source)
+	case errors.Is(err, NotFoundError):
+		b.record(source, nil)
+	default:
+		b.record(source, err)
+	}
+	return err
+}
+
+// lookupCymruOrigin queries Team Cymru's IP to ASN service
+// for the origin of addr, unless its breaker is open.
+func (h Handler) lookupCymruOrigin(ctx context.Context, addr netip.Addr) (cymruOrigin, error) {
+	var origin cymruOrigin
+	err := h.guardSource(ctx, SourceCymru, func() error {
+		var err error
+		origin, err = h.cymru.origin(ctx, addr)
+		return err
+	})
+	return origin, err
+}
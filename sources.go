@@ -0,0 +1,156 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Names of the sources LookupAsn may consult (see WithSources).
+const (
+	// LookupAsn cached answers
+	SourceCache = "cache"
+	// libgeoip ASN databases
+	SourceGeoIP = "geoip"
+	// GeoLite2 ASN database (see WithMMDB)
+	SourceMMDB = "mmdb"
+	// ipinfo.io service
+	SourceIpinfo = "ipinfo"
+	// Team Cymru's DNS service
+	SourceCymru = "cymru"
+	// PeeringDB network names (see PeeringDbLookup),
+	// consulted only if configured (see WithAsnSources)
+	SourcePeeringDB = "peeringdb"
+	// Overrides collection of ASN descriptions (see NewHandler)
+	SourceOverrides = "overrides"
+	// Fixture mappings (see NewFixtureHandler)
+	SourceFixtures = "fixtures"
+)
+
+// SourceNotConfiguredError is returned by lookups
+// restricted to a source the handler does not have (see WithSources).
+var SourceNotConfiguredError = errors.New("source not configured")
+
+// WithSources restricts a LookupAsnCtx or LookupIpInfo call
+// to the given sources (SourceCache, SourceGeoIP...),
+// which must be configured in the handler (see Handler.Sources).
+// For instance, WithSources(SourceCache, SourceGeoIP, SourceOverrides)
+// answers without reaching network services but the overrides collection.
+//
+// Answers found are cached as usual,
+// unless the overrides collection is configured but excluded,
+// since they could miss an overriden description.
+func WithSources(sources ...string) LookupOption {
+	return func(cfg *lookupConfig) {
+		cfg.sources = append([]string{}, sources...)
+	}
+}
+
+// allows tells whether a lookup may consult a given source.
+func (cfg lookupConfig) allows(source string) bool {
+	if cfg.sources == nil {
+		return true
+	}
+	for _, s := range cfg.sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Sources lists the sources consulted by LookupAsn,
+// in the order they are tried.
+//
+// Returns a non nil list of source names.
+func (h Handler) Sources() []string {
+	sources := []string{SourceCache}
+	if h.fixtures != nil {
+		sources = append(sources, SourceFixtures)
+	} else {
+		_, names := h.asnSourceList()
+		sources = append(sources, names...)
+	}
+	if h.overrides != nil {
+		sources = append(sources, SourceOverrides)
+	}
+	if h.sources != nil {
+		// Restricted by NewHandlerFromConfig
+		allowed := lookupConfig{sources: h.sources}
+		restricted := sources[:0]
+		for _, s := range sources {
+			if allowed.allows(s) {
+				restricted = append(restricted, s)
+			}
+		}
+		sources = restricted
+	}
+	return sources
+}
+
+// localDatabase answers the local ASN database LookupAsn tries first:
+// the GeoLite2 ASN database if given (see WithMMDB),
+// otherwise the libgeoip ones.
+//
+// Returns the source name and its lookup function,
+// nil if the handler has no local database.
+func (h Handler) localDatabase() (string, func(ip string) (string, string, error)) {
+	switch {
+	case h.mmdb != nil:
+		return SourceMMDB, h.mmdbLookup
+	case h.geoip4 != nil && h.geoip6 != nil:
+		return SourceGeoIP, h.libGeoipLookup
+	}
+	return "", nil
+}
+
+// checkSources validates the sources a lookup is restricted to.
+func (h Handler) checkSources(cfg lookupConfig) error {
+	configured := lookupConfig{sources: h.Sources()}
+	for _, s := range cfg.sources {
+		if !configured.allows(s) {
+			return fmt.Errorf("%w: '%s'", SourceNotConfiguredError, s)
+		}
+	}
+	return nil
+}
+
+// LookupAsnCtx is LookupAsn, with a context and LookupOptions
+// (see WithSources).
+//
+// Returns
+// an ASN identification
+// and the corresponding description.
+func (h Handler) LookupAsnCtx(ctx context.Context, ip string, opts ...LookupOption) (string, string, error) {
+	cfg := newLookupConfig(opts)
+	if err := h.checkSources(cfg); err != nil {
+		return "", "", err
+	}
+	entry, err := h.lookupAsn(ctx, ip, cfg)
+	return entry.asn, entry.descr, err
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestWithSources(t *testing.T) {
+	var requests, queries int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("AS15169\n"))
+	}))
+	defer ts.Close()
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+	}
+	h := newHandler(nil, time.Second)
+	h.ipinfo.baseURL = ts.URL
+	h.resolver.server = startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		zone.serve(w, req)
+	})
+	network := func() int32 {
+		return atomic.LoadInt32(&requests) + atomic.LoadInt32(&queries)
+	}
+	if sources := h.Sources(); !reflect.DeepEqual(sources, []string{SourceCache, SourceIpinfo, SourceCymru}) {
+		t.Fatalf("unexpected sources: %v", sources)
+	}
+	ctx := context.Background()
+	for _, source := range []string{SourceGeoIP, SourceOverrides, "mmdb"} {
+		_, _, err := h.LookupAsnCtx(ctx, "8.8.8.8", WithSources(SourceCache, source))
+		if !errors.Is(err, SourceNotConfiguredError) {
+			t.Fatalf("unexpected error restricting to %s: %v", source, err)
+		}
+	}
+	// Cache misses are not looked up further
+	local := WithSources(SourceCache)
+	if asn, _, err := h.LookupAsnCtx(ctx, "8.8.8.8", local); err == nil {
+		t.Fatalf("restricted lookup found %s", asn)
+	}
+	if n := network(); n != 0 {
+		t.Fatalf("restricted lookup made %d network requests", n)
+	}
+	// Answers of restricted lookups are cached
+	asn, descr, err := h.LookupAsnCtx(ctx, "8.8.8.8", WithSources(SourceIpinfo))
+	if err != nil || asn != "AS15169" || descr != "" {
+		t.Fatalf("ipinfo only lookup returned %q, %q, %v", asn, descr, err)
+	}
+	if r, q := atomic.LoadInt32(&requests), atomic.LoadInt32(&queries); r != 1 || q != 0 {
+		t.Fatalf("ipinfo only lookup made %d HTTP requests and %d DNS queries", r, q)
+	}
+	asn, descr, err = h.LookupAsnCtx(ctx, "8.8.8.8", local)
+	if err != nil || asn != "AS15169" || descr != "" {
+		t.Fatalf("cached lookup returned %q, %q, %v", asn, descr, err)
+	}
+	// Unrestricted lookups consult all sources
+	asn, descr, err = h.LookupAsnCtx(ctx, "8.8.4.4")
+	if err != nil || asn != "AS15169" || descr != "GOOGLE, US" {
+		t.Fatalf("unrestricted lookup returned %q, %q, %v", asn, descr, err)
+	}
+	if n := network(); n != 3 {
+		t.Fatalf("expected 3 network requests, got %d", n)
+	}
+	info, err := h.LookupIpInfo(ctx, "8.8.4.4", local)
+	if err != nil || info.Descr != "GOOGLE, US" || network() != 3 {
+		t.Fatalf("restricted LookupIpInfo returned %+v, %v", info, err)
+	}
+	// Fixture handlers have their own sources
+	fh := NewFixtureHandler()
+	if sources := fh.Sources(); !reflect.DeepEqual(sources, []string{SourceCache, SourceFixtures}) {
+		t.Fatalf("unexpected fixture sources: %v", sources)
+	}
+	if _, _, err := fh.LookupAsnCtx(ctx, "8.8.8.8", WithSources(SourceCymru)); !errors.Is(err, SourceNotConfiguredError) {
+		t.Fatalf("unexpected error restricting fixture handler to cymru: %v", err)
+	}
+	if _, _, err := fh.LookupAsnCtx(ctx, "8.8.8.8", local); err == nil {
+		t.Fatalf("restricted lookup found an uncached fixture")
+	}
+}
+
+func TestLookupAsnCtxCanceled(t *testing.T) {
+	var requests, queries int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	server := startTestDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		testDNSZone{}.serve(w, req)
+	})
+	h := newHandler(nil, time.Second*10)
+	h.ipinfo.baseURL = ts.URL
+	h.resolver.server = server
+	// Team Cymru answers origins in prefix mode
+	if err := WithPrefixCache()(&h); err != nil {
+		t.Fatalf("WithPrefixCache failed: %s", err)
+	}
+	goroutines := runtime.NumGoroutine()
+	// Already canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := h.LookupAsnCtx(ctx, "8.8.8.8"); err != context.Canceled {
+		t.Fatalf("canceled LookupAsnCtx returned %v", err)
+	}
+	if _, err := h.LookupIpInfo(ctx, "8.8.8.8"); err != context.Canceled {
+		t.Fatalf("canceled LookupIpInfo returned %v", err)
+	}
+	if atomic.LoadInt32(&requests) != 0 || atomic.LoadInt32(&queries) != 0 {
+		t.Fatalf("canceled lookups reached external services")
+	}
+	// Deadline shorter than external calls, ipinfo.io then Team Cymru
+	for _, sources := range [][]string{{SourceIpinfo}, {SourceCymru}} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		start := time.Now()
+		_, _, err := h.LookupAsnCtx(ctx, "8.8.8.8", WithSources(sources...))
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("LookupAsnCtx from %s returned %v", sources[0], err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("LookupAsnCtx from %s returned after %s", sources[0], elapsed)
+		}
+	}
+	if atomic.LoadInt32(&requests) != 1 || atomic.LoadInt32(&queries) == 0 {
+		t.Fatalf("expected external calls, got %d requests and %d queries", requests, queries)
+	}
+	if _, _, found := h.cache.lookupByIP("8.8.8.8"); found {
+		t.Fatalf("given up lookup cached")
+	}
+	// No goroutine left behind once external services answer
+	close(release)
+	ts.CloseClientConnections()
+	h.ipinfo.client.CloseIdleConnections()
+	for deadline := time.Now().Add(time.Second * 5); runtime.NumGoroutine() > goroutines; time.Sleep(time.Millisecond * 10) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left behind", runtime.NumGoroutine()-goroutines)
+		}
+	}
+	if _, err := h.OverridesLookupCtx(ctx, "AS15169"); err != OverridesNilCollectionError {
+		t.Fatalf("OverridesLookupCtx returned %v", err)
+	}
+}
+
+func TestLookupAsnDetailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("AS15169\n"))
+	}))
+	defer ts.Close()
+	zone := testDNSZone{
+		"AS15169.asn.cymru.com.": {`AS15169.asn.cymru.com. 7200 IN TXT "15169 | US | arin | 2000-03-30 | GOOGLE, US"`},
+	}
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	h.ipinfo.baseURL = ts.URL
+	h.resolver.server = startTestDNS(t, zone.serve)
+	fh := NewFixtureHandler()
+	if err := WithPrefixCache()(&fh); err != nil {
+		t.Fatalf("WithPrefixCache failed: %s", err)
+	}
+	ctx := context.Background()
+	check := func(h Handler, expected AsnInfo) {
+		t.Helper()
+		// Cache hits tell the original sources
+		for _, cached := range []bool{false, true} {
+			info, err := h.LookupAsnDetailed(ctx, "8.8.8.8")
+			if err != nil {
+				t.Fatalf("LookupAsnDetailed failed: %s", err)
+			}
+			info.Prefix = netip.Prefix{}
+			expected.Cached = cached
+			if !reflect.DeepEqual(info, expected) {
+				t.Fatalf("LookupAsnDetailed returned %+v, expected %+v", info, expected)
+			}
+		}
+	}
+	check(h, AsnInfo{Asn: "AS15169", Descr: "GOOGLE, US", Source: SourceIpinfo, DescrSource: SourceCymru,
+		Descrs: map[string]string{SourceCymru: "GOOGLE, US"}})
+	if err := h.OverridesSet("AS15169", "Google"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	check(h, AsnInfo{Asn: "AS15169", Descr: "Google", Source: SourceIpinfo, DescrSource: SourceOverrides,
+		Descrs: map[string]string{SourceCymru: "GOOGLE, US", SourceOverrides: "Google"}})
+	// Origins cached by prefix
+	check(fh, AsnInfo{Asn: "AS15169", Descr: "GOOGLE, US", Source: SourceFixtures, DescrSource: SourceFixtures,
+		Descrs: map[string]string{SourceFixtures: "GOOGLE, US"}})
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// CacheClass designates a cache of LookupAsn answers (see WithSoftTTL).
+type CacheClass string
+
+const (
+	// Answers by IP address
+	CacheASN CacheClass = "asn"
+	// Answers by BGP prefix (see WithPrefixCache and LookupPrefixASN)
+	CachePrefix CacheClass = "prefix"
+)
+
+// WithSoftTTL sets a soft TTL for the entries of a cache class,
+// shorter than their usual (hard) TTL.
+// Past their soft TTL, entries are still answered, marked as stale
+// (see AsnInfo.Stale), but revalidated in the background,
+// once however many lookups hit them meanwhile.
+// Past their hard TTL, entries are not answered anymore.
+//
+// This spares lookups the latency of refreshing expired entries.
+func WithSoftTTL(class CacheClass, soft time.Duration) Option {
+	return func(h *Handler) error {
+		if soft <= 0 {
+			return fmt.Errorf("invalid soft TTL %s", soft)
+		}
+		switch class {
+		case CacheASN:
+			h.cache.soft = soft
+		case CachePrefix:
+			h.prefixes.soft = soft
+		default:
+			return fmt.Errorf("unknown cache class '%s'", class)
+		}
+		return nil
+	}
+}
+
+// revalidate refreshes in the background
+// the cached answer for an IP address,
+// unless it is already being refreshed.
+// The refresh consults the sources allowed by cfg, but the cache.
+func (h Handler) revalidate(ip string, cfg lookupConfig) {
+	cfg.observer = nil
+	cfg.refresh = true
+	h.revalidateKey("ip:"+h.cacheKey(ip), func(ctx context.Context) {
+		h.lookupAsn(ctx, ip, cfg)
+	})
+}
+
+// revalidatePrefix refreshes in the background
+// the cached answer for a BGP prefix,
+// unless it is already being refreshed.
+func (h Handler) revalidatePrefix(prefix netip.Prefix) {
+	h.revalidateKey("prefix:"+prefix.String(), func(ctx context.Context) {
+		if h.fixtures != nil {
+			h.lookupOrigin(ctx, prefix.Addr())
+			return
+		}
+		h.lookupPrefixASNUncached(ctx, prefix)
+	})
+}
+
+// revalidateKey runs a refresh in the background,
+// unless one is in progress for the same key.
+func (h Handler) revalidateKey(key string, refresh func(ctx context.Context)) {
+	if !h.revalidations.claim(key) {
+		return
+	}
+	err := h.runs.run(func(ctx context.Context) {
+		defer h.revalidations.release(key)
+		refresh(ctx)
+	})
+	if err != nil {
+		h.revalidations.release(key)
+	}
+}
+
+// revalidations tracks the refreshes in progress by key,
+// so that concurrent lookups start one refresh.
+// Unlike flightGroup, nobody waits for them.
+type revalidations struct {
+	sync.Mutex
+	keys map[string]bool
+}
+
+// claim marks a refresh in progress.
+//
+// Returns false if one already is.
+func (r *revalidations) claim(key string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.keys[key] {
+		return false
+	}
+	if r.keys == nil {
+		r.keys = make(map[string]bool)
+	}
+	r.keys[key] = true
+	return true
+}
+
+// release marks a refresh done.
+func (r *revalidations) release(key string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.keys, key)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"time"
+)
+
+// Status reports the state of a Handler's optional features,
+// for monitoring.
+type Status struct {
+	// Update time announced by the bogon lists (see WithBogons),
+	// zero if not enabled or never fetched
+	BogonsUpdated time.Time `json:"bogons_updated"`
+	// Number of bogon prefixes
+	Bogons int `json:"bogons"`
+	// Last successful fetch of IXP prefixes (see WithIXPDetection)
+	IXPsUpdated time.Time `json:"ixps_updated"`
+	// Last successful fetch of cloud ranges (see WithCloudRanges)
+	CloudRangesUpdated time.Time `json:"cloud_ranges_updated"`
+	// Number of DNS queries coalesced with identical ones in progress
+	DNSCoalesced uint64 `json:"dns_coalesced"`
+	// Number of malformed records read from GeoIP databases
+	GeoIPCorruptReads uint64 `json:"geoip_corrupt_reads"`
+	// Circuit breaker of the overrides collection
+	// (see WithOverridesBreaker), zero if not enabled
+	OverridesBreaker BreakerStatus `json:"overrides_breaker"`
+	// Circuit breakers of sources which ever failed, by source name
+	// (see WithSourceBreakers), nil if not enabled
+	SourceBreakers map[string]BreakerStatus `json:"source_breakers,omitempty"`
+	// Comparisons of shadow mode (see WithShadow), nil if not enabled
+	Shadow *ShadowStats `json:"shadow,omitempty"`
+}
+
+// Status reports the state of the handler.
+func (h Handler) Status() Status {
+	var s Status
+	if h.bogons != nil {
+		if b := h.bogons.peek(); b != nil {
+			s.BogonsUpdated = b.updated
+			s.Bogons = b.trie.len
+		}
+	}
+	if h.ixps != nil {
+		s.IXPsUpdated = h.ixps.lastUpdate()
+	}
+	if h.clouds != nil {
+		s.CloudRangesUpdated = h.clouds.lastUpdate()
+	}
+	s.DNSCoalesced = h.resolver.coalesced.Load()
+	s.GeoIPCorruptReads = h.corrupt.Load()
+	if h.breaker != nil {
+		s.OverridesBreaker = h.breaker.status()
+	}
+	if h.sourceBreakers != nil {
+		s.SourceBreakers = h.sourceBreakers.status()
+	}
+	if h.shadow != nil {
+		s.Shadow = h.shadow.status()
+	}
+	return s
+}
@@ -0,0 +1,433 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OverridesStore stores overrides of ASN descriptions
+// (see NewHandlerWithStore).
+// Its methods are called concurrently.
+type OverridesStore interface {
+	// Get retrieves the override of an ASN,
+	// or fails with OverridesAsnNotFoundError if there is none.
+	// It should give up when ctx is done, failing with its error.
+	Get(ctx context.Context, asn string) (AsnOverride, error)
+	// Set stores or updates the description of an ASN.
+	Set(asn, name string) error
+	// Remove removes the override of an ASN,
+	// without error if there is none.
+	Remove(asn string) error
+	// List retrieves all overrides, in any order.
+	List() ([]AsnOverride, error)
+}
+
+// OverridesImporter is an OverridesStore
+// able to store overrides verbatim, with their history
+// (see OverridesImportHistorical).
+type OverridesImporter interface {
+	OverridesStore
+	// Import stores or replaces an override,
+	// keeping its creation and update times, and operator.
+	Import(o AsnOverride) error
+}
+
+// OverridesMetaStore is an OverridesStore
+// able to record the creation and update times of overrides,
+// and the author of updates (see OverridesSetWithMeta).
+type OverridesMetaStore interface {
+	OverridesStore
+	// SetMeta stores or updates the description of an ASN,
+	// updated by author at a given time,
+	// also the creation time of an ASN not overriden yet.
+	SetMeta(asn, name, author string, at time.Time) error
+}
+
+// OverridesPinger is an OverridesStore
+// able to check that it is reachable (see WithOverridesBreaker).
+// Stores without Ping are probed by looking up an override.
+type OverridesPinger interface {
+	OverridesStore
+	// Ping fails if the store is unreachable.
+	Ping(ctx context.Context) error
+}
+
+// OverridesBulkStore is an OverridesStore
+// able to write many overrides at once (see OverridesImport).
+// Stores without bulk writes are written one override at a time.
+type OverridesBulkStore interface {
+	OverridesStore
+	// SetMany stores or updates the descriptions of many ASNs.
+	SetMany(overrides []AsnOverride) error
+	// RemoveMany removes the overrides of many ASNs, if any.
+	RemoveMany(asns []string) error
+}
+
+// OverridesSearcher is an OverridesStore
+// able to search overrides by description (see OverridesSearch).
+// Stores without Search are searched by listing every override.
+type OverridesSearcher interface {
+	OverridesStore
+	// Search retrieves the overrides whose description contains query,
+	// case insensitively, all of them if query is empty,
+	// in the order of OverridesList, skipping offset overrides,
+	// up to limit overrides, all of them if limit is zero.
+	Search(query string, limit, offset int) ([]AsnOverride, error)
+}
+
+// OverridesCounter is an OverridesStore
+// able to count overrides (see OverridesCount).
+// Stores without Count are counted by listing every override.
+type OverridesCounter interface {
+	OverridesStore
+	// Count answers the number of overrides.
+	Count() (int, error)
+}
+
+// OverridesUnsupportedError is returned by Overrides<...> methods
+// the overrides store does not support,
+// such as OverridesImportHistorical if it is no OverridesImporter.
+var OverridesUnsupportedError = errors.New("not supported by the overrides store")
+
+// mongoOverrides is the OverridesStore of a MongoDB collection.
+type mongoOverrides struct {
+	c *mgo.Collection
+	// Bound of Get, if not zero
+	timeout time.Duration
+}
+
+// NewMongoOverridesStore returns the OverridesStore of a MongoDB collection,
+// the backend of NewHandler.
+// Parameter timeout, if not zero, bounds lookups of overrides.
+//
+// Returns nil if the collection is nil.
+func NewMongoOverridesStore(c *mgo.Collection, timeout time.Duration) OverridesStore {
+	if c == nil {
+		return nil
+	}
+	return &mongoOverrides{c, timeout}
+}
+
+// Get retrieves the override of an ASN,
+// within the timeout of the store and the deadline of ctx.
+// If ctx is done first, the query is left to time out in the background.
+func (m *mongoOverrides) Get(ctx context.Context, asn string) (AsnOverride, error) {
+	timeout := m.timeout
+	if deadline, ok := ctx.Deadline(); ok && (timeout == 0 || time.Until(deadline) < timeout) {
+		timeout = max(time.Until(deadline), time.Millisecond)
+	}
+	s := m.c.Database.Session.Copy()
+	if timeout > 0 {
+		s.SetSyncTimeout(timeout)
+		s.SetSocketTimeout(timeout)
+	}
+	type result struct {
+		override AsnOverride
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer s.Close()
+		var r result
+		r.err = m.c.With(s).FindId(asn).One(&r.override)
+		if r.err == mgo.ErrNotFound {
+			r.err = OverridesAsnNotFoundError
+		}
+		done <- r
+	}()
+	select {
+	case r := <-done:
+		return r.override, r.err
+	case <-ctx.Done():
+		return AsnOverride{}, ctx.Err()
+	}
+}
+
+// Set stores or updates the description of an ASN,
+// in a document of the current schema version (see OverridesMigrate).
+func (m *mongoOverrides) Set(asn, name string) error {
+	_, err := m.c.UpsertId(asn, bson.M{"$set": bson.M{"name": name, "schema_version": overridesSchemaVersion}})
+	return err
+}
+
+// SetMeta stores or updates the description of an ASN, updated by author,
+// in a document of the current schema version.
+func (m *mongoOverrides) SetMeta(asn, name, author string, at time.Time) error {
+	_, err := m.c.UpsertId(asn, bson.M{
+		"$set":         bson.M{"name": name, "updated_at": at, "updated_by": author, "schema_version": overridesSchemaVersion},
+		"$setOnInsert": bson.M{"created_at": at},
+	})
+	return err
+}
+
+// Remove removes the override of an ASN, if any.
+func (m *mongoOverrides) Remove(asn string) error {
+	err := m.c.RemoveId(asn)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// List retrieves all overrides.
+func (m *mongoOverrides) List() ([]AsnOverride, error) {
+	var answer []AsnOverride
+	err := m.c.Find(nil).All(&answer)
+	return answer, err
+}
+
+// Count answers the number of overrides.
+func (m *mongoOverrides) Count() (int, error) {
+	return m.c.Count()
+}
+
+// Search retrieves the overrides whose description contains query,
+// matched by a case insensitive regular expression.
+// ASNs are sorted by number, which the collection cannot do,
+// so every match is retrieved before paging.
+func (m *mongoOverrides) Search(query string, limit, offset int) ([]AsnOverride, error) {
+	var answer []AsnOverride
+	if err := m.c.Find(overridesSearchQuery(query)).All(&answer); err != nil {
+		return nil, err
+	}
+	return searchOverrides(answer, "", limit, offset), nil
+}
+
+// overridesSearchQuery selects the overrides whose description contains query,
+// case insensitively.
+func overridesSearchQuery(query string) bson.M {
+	if query == "" {
+		return bson.M{}
+	}
+	return bson.M{"name": bson.M{"$regex": regexp.QuoteMeta(query), "$options": "i"}}
+}
+
+// SetMany stores or updates the descriptions of many ASNs,
+// in a single unordered bulk operation.
+func (m *mongoOverrides) SetMany(overrides []AsnOverride) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+	b := m.c.Bulk()
+	b.Unordered()
+	for _, o := range overrides {
+		b.Upsert(bson.M{"_id": o.Asn}, bson.M{"$set": bson.M{"name": o.Name, "schema_version": overridesSchemaVersion}})
+	}
+	_, err := b.Run()
+	return err
+}
+
+// RemoveMany removes the overrides of many ASNs, if any.
+func (m *mongoOverrides) RemoveMany(asns []string) error {
+	if len(asns) == 0 {
+		return nil
+	}
+	_, err := m.c.RemoveAll(bson.M{"_id": bson.M{"$in": asns}})
+	return err
+}
+
+// Import stores or replaces an override verbatim,
+// in a document of the current schema version.
+func (m *mongoOverrides) Import(o AsnOverride) error {
+	_, err := m.c.UpsertId(o.Asn, versionedOverride{o, overridesSchemaVersion})
+	return err
+}
+
+// Ping checks that the collection is reachable,
+// within the deadline of ctx.
+func (m *mongoOverrides) Ping(ctx context.Context) error {
+	s := m.c.Database.Session.Copy()
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetSyncTimeout(time.Until(deadline))
+		s.SetSocketTimeout(time.Until(deadline))
+	}
+	return s.Ping()
+}
+
+// MemoryOverrides is an OverridesStore, OverridesMetaStore,
+// OverridesImporter, OverridesBulkStore, OverridesSearcher and OverridesCounter
+// keeping overrides in memory, for tests and small deployments.
+// It is safe for concurrent use.
+type MemoryOverrides struct {
+	mu        sync.RWMutex
+	overrides map[string]AsnOverride
+}
+
+// NewMemoryOverrides returns an empty MemoryOverrides,
+// to be passed to NewHandlerWithStore.
+func NewMemoryOverrides() *MemoryOverrides {
+	return &MemoryOverrides{overrides: make(map[string]AsnOverride)}
+}
+
+// Get retrieves the override of an ASN.
+func (m *MemoryOverrides) Get(ctx context.Context, asn string) (AsnOverride, error) {
+	if err := ctx.Err(); err != nil {
+		return AsnOverride{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.overrides[asn]
+	if !ok {
+		return AsnOverride{}, OverridesAsnNotFoundError
+	}
+	return o, nil
+}
+
+// Set stores or updates the description of an ASN,
+// keeping the history of an imported override.
+func (m *MemoryOverrides) Set(asn, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.overrides[asn]
+	o.Asn, o.Name = asn, name
+	m.overrides[asn] = o
+	return nil
+}
+
+// SetMeta stores or updates the description of an ASN, updated by author.
+func (m *MemoryOverrides) SetMeta(asn, name, author string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.overrides[asn]
+	if !ok {
+		o.CreatedAt = at
+	}
+	o.Asn, o.Name, o.UpdatedAt, o.UpdatedBy = asn, name, at, author
+	m.overrides[asn] = o
+	return nil
+}
+
+// Remove removes the override of an ASN, if any.
+func (m *MemoryOverrides) Remove(asn string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.overrides, asn)
+	return nil
+}
+
+// List retrieves all overrides, in ASN order.
+func (m *MemoryOverrides) List() ([]AsnOverride, error) {
+	m.mu.RLock()
+	answer := make([]AsnOverride, 0, len(m.overrides))
+	for _, o := range m.overrides {
+		answer = append(answer, o)
+	}
+	m.mu.RUnlock()
+	sort.Slice(answer, func(i, j int) bool { return answer[i].Asn < answer[j].Asn })
+	return answer, nil
+}
+
+// Count answers the number of overrides.
+func (m *MemoryOverrides) Count() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.overrides), nil
+}
+
+// Search retrieves the overrides whose description contains query,
+// case insensitively.
+func (m *MemoryOverrides) Search(query string, limit, offset int) ([]AsnOverride, error) {
+	overrides, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	return searchOverrides(overrides, query, limit, offset), nil
+}
+
+// searchOverrides sorts overrides as OverridesList does,
+// and filters them as OverridesSearcher does.
+func searchOverrides(overrides []AsnOverride, query string, limit, offset int) []AsnOverride {
+	sortOverrides(overrides)
+	query = strings.ToLower(query)
+	answer := overrides[:0]
+	for _, o := range overrides {
+		if strings.Contains(strings.ToLower(o.Name), query) {
+			answer = append(answer, o)
+		}
+	}
+	answer = answer[min(offset, len(answer)):]
+	if limit > 0 && len(answer) > limit {
+		answer = answer[:limit]
+	}
+	return answer
+}
+
+// SetMany stores or updates the descriptions of many ASNs at once.
+func (m *MemoryOverrides) SetMany(overrides []AsnOverride) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, o := range overrides {
+		existing := m.overrides[o.Asn]
+		existing.Asn, existing.Name = o.Asn, o.Name
+		m.overrides[o.Asn] = existing
+	}
+	return nil
+}
+
+// RemoveMany removes the overrides of many ASNs at once.
+func (m *MemoryOverrides) RemoveMany(asns []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, asn := range asns {
+		delete(m.overrides, asn)
+	}
+	return nil
+}
+
+// Import stores or replaces an override verbatim.
+func (m *MemoryOverrides) Import(o AsnOverride) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[o.Asn] = o
+	return nil
+}
+
+// pingOverrides checks that an overrides store is reachable,
+// within the deadline of ctx.
+func pingOverrides(ctx context.Context, store OverridesStore) error {
+	if store == nil {
+		return OverridesNilCollectionError
+	}
+	if p, ok := store.(OverridesPinger); ok {
+		return p.Ping(ctx)
+	}
+	_, err := store.Get(ctx, selfTestAsn)
+	if errors.Is(err, OverridesAsnNotFoundError) {
+		return nil
+	}
+	return err
+}
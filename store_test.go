@@ -0,0 +1,370 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	driverbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testOverridesStore checks that Overrides<...> methods
+// behave the same with any store, initially empty.
+func testOverridesStore(t *testing.T, store OverridesStore) {
+	h := NewFixtureHandler()
+	h.overrides = store
+	list := func(expected ...AsnOverride) {
+		t.Helper()
+		overrides, err := h.OverridesList()
+		if err != nil {
+			t.Fatalf("OverridesList failed: %s", err)
+		}
+		sort.Slice(overrides, func(i, j int) bool { return overrides[i].Asn < overrides[j].Asn })
+		// Metadata is checked by OverridesGet
+		for i := range overrides {
+			overrides[i].CreatedAt, overrides[i].UpdatedAt, overrides[i].UpdatedBy = time.Time{}, time.Time{}, ""
+		}
+		if expected == nil {
+			expected = []AsnOverride{}
+		}
+		if !reflect.DeepEqual(overrides, expected) {
+			t.Fatalf("OverridesList returned %v, expected %v", overrides, expected)
+		}
+	}
+	lookup := func(ip, descr string) {
+		t.Helper()
+		if _, d, err := h.LookupAsn(ip); err != nil || d != descr {
+			t.Fatalf("LookupAsn(%s) returned '%s', %v", ip, d, err)
+		}
+	}
+	list()
+	if _, err := h.OverridesLookup("AS15169"); err != OverridesAsnNotFoundError {
+		t.Fatalf("OverridesLookup of an unknown override returned %v", err)
+	}
+	if _, err := h.OverridesGet("AS15169"); err != OverridesAsnNotFoundError {
+		t.Fatalf("OverridesGet of an unknown override returned %v", err)
+	}
+	if err := h.OverridesSet("qwerty", "l33t"); err != OverridesMalformedAsnError {
+		t.Fatalf("OverridesSet of a malformed ASN returned %v", err)
+	}
+	// Setting purges the cache
+	lookup("8.8.8.8", "GOOGLE, US")
+	for _, descr := range []string{"Google LLC", "Alphabet"} {
+		if err := h.OverridesSet("AS15169", descr); err != nil {
+			t.Fatalf("OverridesSet failed: %s", err)
+		}
+		if _, _, found := h.cache.lookupByIP("8.8.8.8"); found {
+			t.Fatalf("OverridesSet did not purge the cache")
+		}
+		if d, err := h.OverridesLookup("AS15169"); err != nil || d != descr {
+			t.Fatalf("OverridesLookup returned '%s', %v", d, err)
+		}
+		lookup("8.8.8.8", descr)
+	}
+	if err := h.OverridesSet("AS13335", "CLOUDFLARE"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	// Updates keep the creation time, and record their author
+	if _, ok := store.(OverridesMetaStore); ok {
+		before := time.Now().Add(-time.Second)
+		created, err := h.OverridesGet("AS13335")
+		if err != nil || created.CreatedAt.Before(before) || !created.UpdatedAt.Equal(created.CreatedAt) || created.UpdatedBy != "" {
+			t.Fatalf("OverridesGet returned %+v, %v", created, err)
+		}
+		if err := h.OverridesSetWithMeta("as13335", "CLOUDFLARE", "alice"); err != nil {
+			t.Fatalf("OverridesSetWithMeta failed: %s", err)
+		}
+		updated, err := h.OverridesGet("AS13335")
+		if err != nil || !updated.CreatedAt.Equal(created.CreatedAt) || updated.UpdatedAt.Before(created.UpdatedAt) || updated.UpdatedBy != "alice" {
+			t.Fatalf("OverridesGet returned %+v, %v after update", updated, err)
+		}
+	}
+	list(AsnOverride{Asn: "AS13335", Name: "CLOUDFLARE"}, AsnOverride{Asn: "AS15169", Name: "Alphabet"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.OverridesLookupCtx(ctx, "AS15169"); err != context.Canceled {
+		t.Fatalf("canceled OverridesLookupCtx returned %v", err)
+	}
+	if err := pingOverrides(context.Background(), store); err != nil {
+		t.Fatalf("pingOverrides failed: %s", err)
+	}
+	// Removing purges the cache, and is idempotent
+	for i := 0; i < 2; i++ {
+		if err := h.OverridesRemove("AS15169"); err != nil {
+			t.Fatalf("OverridesRemove failed: %s", err)
+		}
+		if _, _, found := h.cache.lookupByIP("8.8.8.8"); found {
+			t.Fatalf("OverridesRemove did not purge the cache")
+		}
+	}
+	if _, err := h.OverridesLookup("AS15169"); err != OverridesAsnNotFoundError {
+		t.Fatalf("OverridesLookup of a removed override returned %v", err)
+	}
+	lookup("8.8.8.8", "GOOGLE, US")
+	if err := h.OverridesRemove("AS13335"); err != nil {
+		t.Fatalf("OverridesRemove failed: %s", err)
+	}
+	list()
+	// Bulk import, aborted by a malformed ASN, then replacing
+	lookup("8.8.8.8", "GOOGLE, US")
+	if err := h.OverridesImport(strings.NewReader(`[{"asn":"AS15169","name":"A"},{"asn":"qwerty","name":"B"}]`), false); err != OverridesMalformedAsnError {
+		t.Fatalf("OverridesImport of a malformed ASN returned %v", err)
+	}
+	list()
+	for _, test := range []struct {
+		json     string
+		replace  bool
+		expected []AsnOverride
+	}{
+		{`[{"asn":"AS15169","name":"A"},{"asn":"AS13335","name":"B"},{"asn":"AS15169","name":"C"}]`, false,
+			[]AsnOverride{{Asn: "AS13335", Name: "B"}, {Asn: "AS15169", Name: "C"}}},
+		{`[{"asn":"AS19281","name":"D"}]`, false,
+			[]AsnOverride{{Asn: "AS13335", Name: "B"}, {Asn: "AS15169", Name: "C"}, {Asn: "AS19281", Name: "D"}}},
+		{`[{"asn":"AS13335","name":"E"}]`, true,
+			[]AsnOverride{{Asn: "AS13335", Name: "E"}}},
+	} {
+		if err := h.OverridesImport(strings.NewReader(test.json), test.replace); err != nil {
+			t.Fatalf("OverridesImport failed: %s", err)
+		}
+		list(test.expected...)
+	}
+	if _, _, found := h.cache.lookupByIP("8.8.8.8"); found {
+		t.Fatalf("OverridesImport did not purge the cache")
+	}
+	var buf bytes.Buffer
+	if err := h.OverridesExport(&buf); err != nil {
+		t.Fatalf("OverridesExport failed: %s", err)
+	}
+	if buf.String() != `[{"asn":"AS13335","name":"E"}]`+"\n" {
+		t.Fatalf("OverridesExport wrote %s", buf.String())
+	}
+	if err := h.OverridesImport(strings.NewReader(`[]`), true); err != nil {
+		t.Fatalf("OverridesImport failed: %s", err)
+	}
+	list()
+	// Search, case insensitive, without regular expressions,
+	// in the order of OverridesList
+	search := `[{"asn":"AS3356","name":"Level 3 .*"},{"asn":"AS174","name":"Cogent [transit]"},` +
+		`{"asn":"AS13335","name":"Cloudflare, Inc."},{"asn":"AS15169","name":"Google (a.k.a. Alphabet)"},` +
+		`{"asn":"AS209242","name":"CLOUDFLARESPECTRUM"}]`
+	if err := h.OverridesImport(strings.NewReader(search), false); err != nil {
+		t.Fatalf("OverridesImport failed: %s", err)
+	}
+	for _, test := range []struct {
+		query         string
+		limit, offset int
+		expected      []string
+	}{
+		{"cloudflare", 0, 0, []string{"AS13335", "AS209242"}},
+		{"CLOUDflare", 1, 0, []string{"AS13335"}},
+		{"CLOUDflare", 1, 1, []string{"AS209242"}},
+		{"CLOUDflare", 1, 2, []string{}},
+		{"cloudflare", 5, 1, []string{"AS209242"}},
+		{".*", 0, 0, []string{"AS3356"}},
+		{"l.", 0, 0, []string{}},
+		{"(a.k.a.", 0, 0, []string{"AS15169"}},
+		{"[transit]", 0, 0, []string{"AS174"}},
+		{"t]", 0, 0, []string{"AS174"}},
+		{"^Level", 0, 0, []string{}},
+		{"nothing", 0, 0, []string{}},
+		{"", 0, 0, []string{"AS174", "AS3356", "AS13335", "AS15169", "AS209242"}},
+		{"", 2, 0, []string{"AS174", "AS3356"}},
+		{"", 2, 4, []string{"AS209242"}},
+		{"", 0, 5, []string{}},
+		{"", 3, 10, []string{}},
+	} {
+		overrides, err := h.OverridesSearch(test.query, test.limit, test.offset)
+		if err != nil {
+			t.Fatalf("OverridesSearch failed: %s", err)
+		}
+		asns := make([]string, 0, len(overrides))
+		for _, o := range overrides {
+			asns = append(asns, o.Asn)
+		}
+		if !reflect.DeepEqual(asns, test.expected) {
+			t.Errorf("OverridesSearch(%q, %d, %d) answered %v, expected %v", test.query, test.limit, test.offset, asns, test.expected)
+		}
+	}
+	for offset := 0; offset < 6; offset += 2 {
+		page, err := h.OverridesListPage(2, offset)
+		if found, _ := h.OverridesSearch("", 2, offset); err != nil || !reflect.DeepEqual(found, page) {
+			t.Errorf("OverridesSearch page at %d is %v, OverridesListPage %v, %v", offset, found, page, err)
+		}
+	}
+	if _, err := h.OverridesSearch("", -1, 0); err == nil {
+		t.Errorf("OverridesSearch accepted a negative limit")
+	}
+	if err := h.OverridesImport(strings.NewReader(`[]`), true); err != nil {
+		t.Fatalf("OverridesImport failed: %s", err)
+	}
+	if _, ok := store.(OverridesImporter); !ok {
+		return
+	}
+	// The most recently updated override wins
+	updated := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, test := range []struct {
+		override AsnOverride
+		inserted int
+		wins     bool
+		descr    string
+	}{
+		{AsnOverride{Asn: "AS15169", Name: "Google", UpdatedAt: updated}, 1, false, "Google"},
+		{AsnOverride{Asn: "AS15169", Name: "Stale", UpdatedAt: updated.Add(-time.Minute)}, 0, false, "Google"},
+		{AsnOverride{Asn: "AS15169", Name: "Fresh", UpdatedAt: updated.Add(time.Minute)}, 0, true, "Fresh"},
+	} {
+		report, err := h.OverridesImportHistorical([]AsnOverride{test.override})
+		if err != nil {
+			t.Fatalf("OverridesImportHistorical failed: %s", err)
+		}
+		if report.Inserted != test.inserted || len(report.Collisions) != 1-test.inserted ||
+			test.inserted == 0 && report.Collisions[0].ImportedWins != test.wins {
+			t.Fatalf("unexpected import report for '%s': %+v", test.override.Name, report)
+		}
+		lookup("8.8.8.8", test.descr)
+	}
+	if err := h.OverridesRemove("AS15169"); err != nil {
+		t.Fatalf("OverridesRemove failed: %s", err)
+	}
+}
+
+func TestOverridesStoreMemory(t *testing.T) {
+	testOverridesStore(t, NewMemoryOverrides())
+	// Stores with the basic methods only
+	basic := struct{ OverridesStore }{NewMemoryOverrides()}
+	testOverridesStore(t, basic)
+	h := newHandler(basic, time.Second)
+	if _, err := h.OverridesImportHistorical(nil); err != OverridesUnsupportedError {
+		t.Fatalf("OverridesImportHistorical returned %v", err)
+	}
+	if _, err := h.OverridesMigrate(context.Background()); err != OverridesUnsupportedError {
+		t.Fatalf("OverridesMigrate returned %v", err)
+	}
+}
+
+func TestMemoryOverridesConcurrency(t *testing.T) {
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			asn := fmt.Sprintf("AS%d", 64512+i%4)
+			for j := 0; j < 100; j++ {
+				if err := h.OverridesSet(asn, fmt.Sprintf("name %d", j)); err != nil {
+					t.Errorf("OverridesSet failed: %s", err)
+					return
+				}
+				if _, err := h.OverridesLookup(asn); err != nil && err != OverridesAsnNotFoundError {
+					t.Errorf("OverridesLookup failed: %s", err)
+					return
+				}
+				if _, err := h.OverridesList(); err != nil {
+					t.Errorf("OverridesList failed: %s", err)
+					return
+				}
+				if err := h.OverridesRemove(asn); err != nil {
+					t.Errorf("OverridesRemove failed: %s", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if list, _ := h.OverridesList(); len(list) != 0 {
+		t.Fatalf("overrides left: %v", list)
+	}
+}
+
+func TestOverridesStoreMongo(t *testing.T) {
+	s, err := mgo.DialWithTimeout("127.0.0.1", time.Second)
+	if err != nil {
+		t.Skipf("cannot dial to mongodb: %s", err)
+	}
+	defer s.Close()
+	c := s.DB("dnsdist").C("geoipdb_store_test")
+	c.DropCollection()
+	defer c.DropCollection()
+	testOverridesStore(t, NewMongoOverridesStore(c, time.Second*5))
+}
+
+func TestOverridesStoreMongoDriver(t *testing.T) {
+	ctx := context.Background()
+	opts := options.Client().ApplyURI("mongodb://127.0.0.1").SetServerSelectionTimeout(time.Second)
+	client, err := mongo.Connect(ctx, opts)
+	if err == nil {
+		err = client.Ping(ctx, nil)
+	}
+	if err != nil {
+		t.Skipf("cannot connect to mongodb: %s", err)
+	}
+	defer client.Disconnect(ctx)
+	c := client.Database("dnsdist").Collection("geoipdb_driver_test")
+	c.Drop(ctx)
+	defer c.Drop(ctx)
+	testOverridesStore(t, NewMongoDriverOverridesStore(c, time.Second*5))
+}
+
+// TestOverridesOldDocuments checks that documents written
+// before overrides had metadata decode with zero times.
+func TestOverridesOldDocuments(t *testing.T) {
+	docs := []map[string]interface{}{
+		// Unversioned
+		{"_id": "AS15169", "name": "Google"},
+		// Schema version 1, set by OverridesSet
+		{"_id": "AS15169", "name": "Google", "schema_version": 1},
+	}
+	expected := AsnOverride{Asn: "AS15169", Name: "Google"}
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var o AsnOverride
+		if err := bson.Unmarshal(data, &o); err != nil || o != expected {
+			t.Errorf("mgo decoded %v as %+v, %v", doc, o, err)
+		}
+		data, err = driverbson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o = AsnOverride{}
+		if err := driverbson.Unmarshal(data, &o); err != nil || o != expected {
+			t.Errorf("mongo-driver decoded %v as %+v, %v", doc, o, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+)
+
+// sharedCaches are the caches shared by a handler
+// and the handlers derived from it (see Derive).
+type sharedCaches struct {
+	// Answers of external sources,
+	// without overrides nor annotations
+	cache    cache
+	prefixes prefixCache
+	// Concurrent access control to tenants
+	sync.Mutex
+	// Curated answers by tenant ID
+	tenants map[string]*tenantCaches
+}
+
+// tenantCaches are the caches of a tenant (see Derive).
+type tenantCaches struct {
+	cache         cache
+	prefixes      prefixCache
+	names         asnNameCache
+	counters      *cacheCounters
+	revalidations *revalidations
+}
+
+// newSharedCaches returns empty initialized sharedCaches.
+func newSharedCaches() *sharedCaches {
+	return &sharedCaches{
+		cache:    newCache(),
+		prefixes: newPrefixCache(),
+		tenants:  make(map[string]*tenantCaches),
+	}
+}
+
+// tenant retrieves the caches of a tenant,
+// creating them with the soft TTLs of a template handler if needed.
+func (s *sharedCaches) tenant(id string, template Handler) *tenantCaches {
+	s.Lock()
+	defer s.Unlock()
+	if t, ok := s.tenants[id]; ok {
+		return t
+	}
+	t := &tenantCaches{
+		cache:         newCache(),
+		prefixes:      newPrefixCache(),
+		names:         newAsnNameCache(),
+		counters:      &cacheCounters{},
+		revalidations: &revalidations{},
+	}
+	t.cache.ttl, t.cache.soft = template.cache.ttl, template.cache.soft
+	t.cache.jitter, t.cache.clock = template.cache.jitter, template.cache.clock
+	t.cache.capacity = template.cache.capacity
+	t.prefixes.ttl, t.prefixes.soft = template.prefixes.ttl, template.prefixes.soft
+	t.prefixes.jitter, t.prefixes.clock = template.prefixes.jitter, template.prefixes.clock
+	t.prefixes.capacity = template.prefixes.capacity
+	s.tenants[id] = t
+	return t
+}
+
+// Derive creates a handler for a tenant,
+// using its own collection of overrides (see NewHandler,
+// and DeriveWithStore for other overrides stores),
+// audited if opts set its own audit log (see WithOverridesAudit),
+// with its own prefix overrides and OverridesSubscriber if opts set them
+// (see WithPrefixOverrides and WithOverridesSubscriber),
+// and annotators, added by opts to those of h (see WithAnnotator).
+//
+// Derived handlers partition the cache of LookupAsn:
+// answers of external sources are cached once for all of them,
+// whereas answers with overrides and annotations applied
+// are cached by tenant, and consulted first.
+// Thus purges, such as by OverridesSet, only affect the tenant.
+// Handlers derived with the same tenant ID share its cache,
+// so they should share its overrides and annotators too.
+//
+// Other features and their data are shared with h.
+//
+// Returns the derived handler.
+func (h Handler) Derive(tenant string, overrides *mgo.Collection, opts ...Option) (Handler, error) {
+	return h.DeriveWithStore(tenant, NewMongoOverridesStore(overrides, h.sourceTimeout(SourceOverrides)), opts...)
+}
+
+// DeriveWithStore is Derive,
+// with the overrides of the tenant kept in a given store, if not nil,
+// rather than in a MongoDB collection (see NewHandlerWithStore).
+//
+// Returns the derived handler.
+func (h Handler) DeriveWithStore(tenant string, overrides OverridesStore, opts ...Option) (Handler, error) {
+	if tenant == "" {
+		return Handler{}, fmt.Errorf("empty tenant ID")
+	}
+	t := h.shared.tenant(tenant, h)
+	d := h
+	d.tenant = tenant
+	d.overrides = overrides
+	d.audit = nil
+	d.prefixOverrides = nil
+	d.watch = newOverridesWatch()
+	d.cache = t.cache
+	d.prefixes = t.prefixes
+	d.names = t.names
+	d.counters = t.counters
+	d.revalidations = t.revalidations
+	// Leave the annotators of h alone
+	d.annotators = slices.Clip(h.annotators)
+	for _, opt := range opts {
+		if err := opt(&d); err != nil {
+			return Handler{}, err
+		}
+	}
+	return d, nil
+}
+
+// Tenant returns the tenant ID of a derived handler (see Derive),
+// or an empty string.
+func (h Handler) Tenant() string {
+	return h.tenant
+}
+
+// lookupUpstream is lookupAsnUncached for derived handlers,
+// cached without overrides nor annotations for every tenant.
+//
+// Returns the cache entry, without overrides.
+func (h Handler) lookupUpstream(ctx context.Context, ip string, key string, cfg lookupConfig) (cacheEntry, error) {
+	if cfg.allows(SourceCache) && !cfg.refresh {
+		entry, expired, found := h.shared.cache.lookupByIP(key)
+		if found && !expired {
+			h.observe(ExplainStep{Source: SourceCache, Result: "hit", Detail: "answer shared by tenants", Age: entry.age(h.shared.cache.now())})
+			// Curated answers expire with the shared one
+			entry.ttl = entry.due.Sub(h.shared.cache.now())
+			return entry, entry.err
+		}
+	}
+	upstream := h
+	upstream.overrides = nil
+	entry, err := upstream.lookupAsnUncached(ctx, ip, cfg)
+	if err == nil {
+		h.shared.cache.store(key, entry)
+	}
+	return entry, err
+}
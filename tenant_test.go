@@ -0,0 +1,158 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// curator rewrites ASN descriptions, like overrides, counting its calls.
+type curator struct {
+	descr string
+	calls int32
+}
+
+func (c *curator) Annotate(ctx context.Context, info *AsnInfo) error {
+	atomic.AddInt32(&c.calls, 1)
+	info.Descr = c.descr
+	return nil
+}
+
+func TestDeriveTenants(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprintln(w, "AS13335 Cloudflare, Inc.")
+	}))
+	defer ts.Close()
+	h := newHandler(nil, time.Second)
+	h.ipinfo.baseURL = ts.URL
+	curators := map[string]*curator{"a": {descr: "CDN of tenant A"}, "b": {descr: "CDN of tenant B"}}
+	tenants := make(map[string]Handler)
+	for id, c := range curators {
+		d, err := h.Derive(id, nil, WithAnnotator(c, AnnotatorConfig{}))
+		if err != nil {
+			t.Fatalf("Derive failed: %s", err)
+		}
+		if d.Tenant() != id {
+			t.Fatalf("unexpected tenant '%s'", d.Tenant())
+		}
+		tenants[id] = d
+	}
+	if len(h.annotators) != 0 {
+		t.Fatalf("Derive changed the annotators of its parent")
+	}
+	check := func(curated map[string]int32) {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			for id, d := range tenants {
+				asn, descr, err := d.LookupAsn("1.1.1.1")
+				if err != nil || asn != "AS13335" || descr != curators[id].descr {
+					t.Fatalf("tenant %s: LookupAsn returned '%s', '%s', %v", id, asn, descr, err)
+				}
+			}
+		}
+		if r := atomic.LoadInt32(&requests); r != 1 {
+			t.Fatalf("expected 1 upstream request, got %d", r)
+		}
+		for id, c := range curators {
+			if calls := atomic.LoadInt32(&c.calls); calls != curated[id] {
+				t.Fatalf("tenant %s: expected %d curated answers, got %d", id, curated[id], calls)
+			}
+		}
+	}
+	// Upstream answers are shared, curated ones are not
+	check(map[string]int32{"a": 1, "b": 1})
+	if h.cache.len() != 0 || h.shared.cache.len() != 1 {
+		t.Fatalf("unexpected cache sizes %d, %d", h.cache.len(), h.shared.cache.len())
+	}
+	if stats := tenants["a"].CacheStats().ASN; stats.Entries != 1 || stats.ExactHits != 1 || stats.Misses != 1 {
+		t.Fatalf("unexpected cache stats of tenant A: %+v", stats)
+	}
+	// Purges by a tenant touch its curated answers only
+	if err := tenants["a"].OverridesSet("AS13335", "Cloudflare"); err != OverridesNilCollectionError {
+		t.Fatalf("unexpected OverridesSet error: %v", err)
+	}
+	if tenants["a"].cache.len() != 0 || tenants["b"].cache.len() != 1 || h.shared.cache.len() != 1 {
+		t.Fatalf("purge leaked out of tenant A")
+	}
+	check(map[string]int32{"a": 2, "b": 1})
+	// Handlers derived for the same tenant share its answers
+	again, err := h.Derive("a", nil)
+	if err != nil {
+		t.Fatalf("Derive failed: %s", err)
+	}
+	if _, descr, _ := again.LookupAsn("1.1.1.1"); descr != curators["a"].descr {
+		t.Fatalf("tenant A answer not shared: '%s'", descr)
+	}
+	if _, err := h.Derive("", nil); err == nil {
+		t.Fatalf("expected an error for an empty tenant ID")
+	}
+}
+
+func TestDeriveWithStore(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "AS13335 Cloudflare, Inc.")
+	}))
+	defer ts.Close()
+	h := newHandler(NewMemoryOverrides(), time.Second)
+	h.ipinfo.baseURL = ts.URL
+	a, err := h.DeriveWithStore("a", NewMemoryOverrides())
+	if err != nil {
+		t.Fatalf("DeriveWithStore failed: %s", err)
+	}
+	b, err := h.DeriveWithStore("b", NewMemoryOverrides())
+	if err != nil {
+		t.Fatalf("DeriveWithStore failed: %s", err)
+	}
+	if err := a.OverridesSet("AS13335", "CDN of tenant A"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	for _, test := range []struct {
+		h     Handler
+		descr string
+	}{
+		{a, "CDN of tenant A"},
+		{b, "Cloudflare, Inc."},
+		{h, "Cloudflare, Inc."},
+	} {
+		if _, descr, err := test.h.LookupAsn("1.1.1.1"); err != nil || descr != test.descr {
+			t.Errorf("tenant %q: LookupAsn answered '%s', %v", test.h.Tenant(), descr, err)
+		}
+	}
+	if _, err := h.OverridesLookup("AS13335"); err != OverridesAsnNotFoundError {
+		t.Errorf("override of tenant A leaked to its parent: %v", err)
+	}
+	if _, err := h.DeriveWithStore("", NewMemoryOverrides()); err == nil {
+		t.Errorf("expected an error for an empty tenant ID")
+	}
+}
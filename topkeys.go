@@ -0,0 +1,214 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+const (
+	// keyTrackerShards is the number of shards of a key tracker,
+	// and keyTrackerShardSize the number of keys tracked by shard.
+	keyTrackerShards    = 16
+	keyTrackerShardSize = 64
+)
+
+// KeyCount is a looked up key and its number of lookups.
+type KeyCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// HotKeys are the most looked up keys, by decreasing count.
+//
+// Counts are upper bounds: a key starting to be tracked
+// inherits the count of the key it evicts.
+type HotKeys struct {
+	// ASNs, as answered by lookups
+	ASNs []KeyCount `json:"asns"`
+	// Prefixes of looked up IP addresses,
+	// /24 for IPv4 and /48 for IPv6
+	Prefixes []KeyCount `json:"prefixes"`
+}
+
+// WithKeyTracking makes the handler count lookups by ASN and IP prefix,
+// as reported by TopKeys.
+//
+// Memory is bounded by tracking a fixed number of keys,
+// the least looked up ones being replaced by new ones.
+func WithKeyTracking() Option {
+	return func(h *Handler) error {
+		h.keys = &hotKeys{
+			asns:     newKeyTracker(),
+			prefixes: newKeyTracker(),
+		}
+		return nil
+	}
+}
+
+// TopKeys returns the n most looked up ASNs and IP prefixes,
+// or all tracked ones if n is zero.
+//
+// Returns nil if key tracking is not enabled (see WithKeyTracking).
+func (h Handler) TopKeys(n int) *HotKeys {
+	if h.keys == nil {
+		return nil
+	}
+	return &HotKeys{
+		ASNs:     h.keys.asns.top(n),
+		Prefixes: h.keys.prefixes.top(n),
+	}
+}
+
+// ResetTopKeys forgets lookup counts.
+func (h Handler) ResetTopKeys() {
+	if h.keys == nil {
+		return
+	}
+	h.keys.asns.reset()
+	h.keys.prefixes.reset()
+}
+
+// hotKeys tracks lookups by ASN and IP prefix.
+type hotKeys struct {
+	asns     *keyTracker
+	prefixes *keyTracker
+}
+
+// recordIP counts a lookup of the prefix of addr.
+func (k *hotKeys) recordIP(addr netip.Addr) {
+	if k == nil {
+		return
+	}
+	bits := 24
+	if !addr.Unmap().Is4() {
+		bits = 48
+	}
+	prefix, err := addr.Unmap().Prefix(bits)
+	if err != nil {
+		return
+	}
+	k.prefixes.record(prefix.String())
+}
+
+// recordASN counts a lookup answering asn.
+func (k *hotKeys) recordASN(asn string) {
+	if k == nil || asn == "" {
+		return
+	}
+	k.asns.record(asn)
+}
+
+// keyTracker counts occurrences of the most frequent keys,
+// with the space saving algorithm on each of its shards,
+// so that lookups of distinct keys rarely contend.
+type keyTracker struct {
+	shards [keyTrackerShards]keyTrackerShard
+}
+
+// keyTrackerShard tracks the keys hashing to it.
+type keyTrackerShard struct {
+	sync.Mutex
+	counts map[string]uint64
+}
+
+// newKeyTracker creates an empty key tracker.
+func newKeyTracker() *keyTracker {
+	t := &keyTracker{}
+	for i := range t.shards {
+		t.shards[i].counts = make(map[string]uint64, keyTrackerShardSize)
+	}
+	return t
+}
+
+// record counts an occurrence of key.
+// When its shard is full, key replaces the least frequent key,
+// inheriting its count.
+func (t *keyTracker) record(key string) {
+	s := &t.shards[fnv32(key)%keyTrackerShards]
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.counts[key]; ok || len(s.counts) < keyTrackerShardSize {
+		s.counts[key]++
+		return
+	}
+	var (
+		minKey   string
+		minCount uint64
+	)
+	for k, c := range s.counts {
+		if minKey == "" || c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	delete(s.counts, minKey)
+	s.counts[key] = minCount + 1
+}
+
+// top returns the n most frequent keys, or all of them if n is zero.
+func (t *keyTracker) top(n int) []KeyCount {
+	var keys []KeyCount
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		for k, c := range s.counts {
+			keys = append(keys, KeyCount{k, c})
+		}
+		s.Unlock()
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// reset forgets all keys.
+func (t *keyTracker) reset() {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		s.counts = make(map[string]uint64, keyTrackerShardSize)
+		s.Unlock()
+	}
+}
+
+// fnv32 is the 32-bit FNV-1a hash of s.
+func fnv32(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
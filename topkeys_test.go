@@ -0,0 +1,105 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopKeys(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	if h.TopKeys(10) != nil {
+		t.Fatalf("key tracking enabled by default")
+	}
+	if err := WithKeyTracking()(&h); err != nil {
+		t.Fatalf("WithKeyTracking failed: %s", err)
+	}
+	h.cache.store("8.8.8.8", cacheEntry{asn: "AS15169", descr: "GOOGLE"})
+	h.cache.store("8.8.4.4", cacheEntry{asn: "AS15169", descr: "GOOGLE"})
+	h.cache.store("2001:4860::8888", cacheEntry{asn: "AS15169", descr: "GOOGLE"})
+	h.cache.store("1.1.1.1", cacheEntry{asn: "AS13335", descr: "CLOUDFLARENET"})
+	ctx := context.Background()
+	for _, ip := range []string{"8.8.8.8", "8.8.8.8", "8.8.4.4", "2001:4860::8888", "1.1.1.1"} {
+		if _, err := h.lookupAsn(ctx, ip, lookupConfig{}); err != nil {
+			t.Fatalf("lookupAsn failed: %s", err)
+		}
+	}
+	expected := &HotKeys{
+		ASNs: []KeyCount{
+			{"AS15169", 4},
+			{"AS13335", 1},
+		},
+		Prefixes: []KeyCount{
+			{"8.8.8.0/24", 2},
+			{"1.1.1.0/24", 1},
+		},
+	}
+	if keys := h.TopKeys(2); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("unexpected top keys: %+v", keys)
+	}
+	if keys := h.TopKeys(0); len(keys.ASNs) != 2 || len(keys.Prefixes) != 4 || keys.Prefixes[3] != (KeyCount{"8.8.4.0/24", 1}) {
+		t.Fatalf("unexpected top keys: %+v", keys)
+	}
+	// Debug dump
+	var buf bytes.Buffer
+	if err := h.DebugDump(&buf); err != nil {
+		t.Fatalf("DebugDump failed: %s", err)
+	}
+	var dump debugDump
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("cannot decode debug dump: %s", err)
+	}
+	if dump.TopKeys == nil || len(dump.TopKeys.Prefixes) != 4 {
+		t.Fatalf("unexpected debug dump top keys: %+v", dump.TopKeys)
+	}
+	h.ResetTopKeys()
+	if keys := h.TopKeys(0); len(keys.ASNs) != 0 || len(keys.Prefixes) != 0 {
+		t.Fatalf("top keys not reset: %+v", keys)
+	}
+}
+
+func TestKeyTrackerBounded(t *testing.T) {
+	tracker := newKeyTracker()
+	for i := 0; i < 100000; i++ {
+		if i%10 == 0 {
+			tracker.record("hot")
+		}
+		tracker.record(fmt.Sprintf("cold-%d", i))
+	}
+	keys := tracker.top(0)
+	if len(keys) > keyTrackerShards*keyTrackerShardSize {
+		t.Fatalf("tracking %d keys", len(keys))
+	}
+	if keys[0].Key != "hot" {
+		t.Fatalf("hot key lost, top key is %+v", keys[0])
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// warmupConcurrency is the default concurrency of Warmup.
+const warmupConcurrency = 10
+
+// WarmupOptions tell how Warmup runs.
+type WarmupOptions struct {
+	// Number of lookups run at once, zero for the default (10)
+	Concurrency int
+	// Bound of the whole warm-up, zero for none
+	Timeout time.Duration
+	// Number of shards, and shard to warm up (see ShardForIP),
+	// zero Shards for all prefixes
+	Shards int
+	Shard  int
+}
+
+// WarmupReport counts the prefixes looked up by Warmup.
+type WarmupReport struct {
+	// Prefixes whose ASN was found, or not
+	Resolved int
+	Failed   int
+	// Private, local and bogon prefixes, not looked up
+	SkippedLocal int
+	// Prefixes of other shards (see WarmupOptions.Shards)
+	OtherShards int
+	// Prefixes not looked up before the warm-up was interrupted
+	Pending int
+}
+
+// Warmup looks up the ASN of a representative address of each prefix,
+// as LookupAsn does, so that later lookups hit the cache.
+// In prefix mode (see WithPrefixCache), BGP prefixes are cached.
+//
+// When sharding, only the prefixes whose representative address
+// is assigned to opts.Shard by ShardForIP are looked up.
+//
+// It may run while the handler is serving other lookups.
+// If ctx expires, or opts.Timeout elapses, before all prefixes are looked up,
+// Warmup returns what it did so far, along with the context error;
+// answers found meanwhile stay cached.
+//
+// Returns the warm-up report.
+func (h Handler) Warmup(ctx context.Context, prefixes []netip.Prefix, opts WarmupOptions) (WarmupReport, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = warmupConcurrency
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	var report WarmupReport
+	// Deduplicate input
+	var unique []netip.Prefix
+	seen := make(map[netip.Prefix]bool, len(prefixes))
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			report.Failed++
+			continue
+		}
+		p = canonicalPrefix(p)
+		if opts.Shards > 0 && ShardForIP(warmupAddr(p), opts.Shards) != opts.Shard {
+			report.OtherShards++
+			continue
+		}
+		if !seen[p] {
+			seen[p] = true
+			unique = append(unique, p)
+		}
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	todo := make(chan netip.Prefix)
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range todo {
+				_, err := h.lookupAsn(ctx, warmupAddr(p).String(), lookupConfig{})
+				mu.Lock()
+				switch {
+				case err == nil:
+					report.Resolved++
+				case err == PrivateIPError || err == BogonIPError:
+					report.SkippedLocal++
+				case ctxErr(ctx) != nil && err == ctxErr(ctx):
+					// Lookups cut short by ctx are not done
+					report.Pending++
+				default:
+					report.Failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	fed := 0
+feed:
+	for _, p := range unique {
+		if iputils.IsLocalIP(net.IP(p.Addr().AsSlice())) {
+			report.SkippedLocal++
+			fed++
+			continue
+		}
+		if ctxErr(ctx) != nil {
+			break
+		}
+		select {
+		case todo <- p:
+			fed++
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+	report.Pending += len(unique) - fed
+	if report.Pending > 0 {
+		return report, ctxErr(ctx)
+	}
+	return report, nil
+}
+
+// warmupAddr returns the representative address of a canonical prefix:
+// its first host address, or its only address.
+func warmupAddr(p netip.Prefix) netip.Addr {
+	if p.Bits() < p.Addr().BitLen() {
+		return p.Addr().Next()
+	}
+	return p.Addr()
+}
+
+// WarmCacheError is the failure of WarmCache for some ASNs.
+type WarmCacheError struct {
+	// Number of ASNs whose description is cached
+	Completed int
+	// Failures, by ASN
+	Errs map[string]error
+}
+
+func (e *WarmCacheError) Error() string {
+	asns := make([]string, 0, len(e.Errs))
+	for asn := range e.Errs {
+		asns = append(asns, asn)
+	}
+	sort.Strings(asns)
+	failures := make([]string, len(asns))
+	for i, asn := range asns {
+		failures[i] = fmt.Sprintf("%s (%s)", asn, e.Errs[asn])
+	}
+	return fmt.Sprintf("cache warm-up failed for %d ASNs: %s", len(asns), strings.Join(failures, ", "))
+}
+
+func (e *WarmCacheError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// WarmCache looks up the descriptions of many ASNs,
+// as LookupAsnDescr does, overrides included,
+// so that later lookups of these ASNs hit the cache:
+// up to parallelism of them at once, or the default (10) if zero.
+// ASNs already cached are not looked up again.
+//
+// The failure of some ASNs does not stop the others.
+// If ctx expires, the ASNs not looked up yet fail with its error.
+//
+// Returns a *WarmCacheError if any ASN failed,
+// telling which ones, and how many ASNs are cached.
+func (h Handler) WarmCache(ctx context.Context, asns []string, parallelism int) error {
+	answer, errs := h.LookupAsnBatch(ctx, asns, parallelism)
+	if len(errs) == 0 {
+		return nil
+	}
+	return &WarmCacheError{Completed: len(answer), Errs: errs}
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmup(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("1.1.1.0/24"),
+		netip.MustParsePrefix("8.8.8.0/24"),
+		netip.MustParsePrefix("8.8.8.0/24"),
+		netip.MustParsePrefix("::ffff:9.9.9.0/120"),
+		netip.MustParsePrefix("2606:4700::/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("5.5.5.0/24"),
+		{},
+	}
+	for _, prefixMode := range []bool{false, true} {
+		h := NewFixtureHandler()
+		h.prefixMode = prefixMode
+		report, err := h.Warmup(context.Background(), prefixes, WarmupOptions{Concurrency: 2})
+		if err != nil {
+			t.Fatalf("Warmup failed: %s", err)
+		}
+		expected := WarmupReport{Resolved: 4, Failed: 2, SkippedLocal: 2}
+		if report != expected {
+			t.Fatalf("unexpected warm-up report %+v", report)
+		}
+		if prefixMode && h.prefixes.len() != 4 {
+			t.Fatalf("expected 4 cached prefixes, got %d", h.prefixes.len())
+		}
+		if _, _, err := h.LookupAsn("8.8.8.1"); err != nil {
+			t.Fatalf("LookupAsn failed: %s", err)
+		}
+		stats := h.CacheStats().ASN
+		if stats.ExactHits+stats.PrefixHits != 1 {
+			t.Fatalf("warmed up address not cached: %+v", stats)
+		}
+	}
+	// Interrupted warm-ups report pending prefixes
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := NewFixtureHandler().Warmup(ctx, prefixes[:2], WarmupOptions{})
+	if err != context.Canceled || report != (WarmupReport{Pending: 2}) {
+		t.Fatalf("unexpected interrupted warm-up: %+v, %v", report, err)
+	}
+}
+
+// slowAsnSource is a testAsnSource taking a while to answer,
+// keeping track of its concurrent lookups.
+type slowAsnSource struct {
+	testAsnSource
+	delay          time.Duration
+	inFlight, peak atomic.Int32
+}
+
+func (s *slowAsnSource) Lookup(ctx context.Context, asn string) (string, error) {
+	n := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	return s.testAsnSource.Lookup(ctx, asn)
+}
+
+func TestWarmCache(t *testing.T) {
+	source := &slowAsnSource{delay: time.Millisecond * 20}
+	source.name = "slow"
+	source.descrs = make(map[string]string)
+	var asns []string
+	for i := 0; i < 20; i++ {
+		asn := fmt.Sprintf("AS%d", 64500+i)
+		asns = append(asns, asn)
+		// Every fifth ASN is unknown
+		if i%5 != 0 {
+			source.descrs[asn] = "NET" + asn
+		}
+	}
+	h, err := NewHandlerWithStore(NewMemoryOverrides(), time.Second, WithMMDB(testMMDB), WithAsnSources(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.OverridesSet("AS64501", "Overriden"); err != nil {
+		t.Fatal(err)
+	}
+	err = h.WarmCache(context.Background(), asns, 3)
+	var warmErr *WarmCacheError
+	if !errors.As(err, &warmErr) || warmErr.Completed != 16 || len(warmErr.Errs) != 4 || warmErr.Errs["AS64505"] == nil {
+		t.Fatalf("WarmCache failed with %v", err)
+	}
+	if peak := source.peak.Load(); peak > 3 || peak < 2 {
+		t.Errorf("%d concurrent lookups, expected up to 3", peak)
+	}
+	// Overrides are not looked up from sources
+	if n := source.lookups.Load(); n != 19 {
+		t.Errorf("%d lookups, expected 19", n)
+	}
+	if descr, err := h.LookupAsnDescr(context.Background(), "AS64501"); err != nil || descr != "Overriden" {
+		t.Errorf("LookupAsnDescr answered %q %v", descr, err)
+	}
+	// Cached ASNs are skipped
+	source.lookups.Store(0)
+	h.WarmCache(context.Background(), asns, 3)
+	if n := source.lookups.Load(); n != 0 {
+		t.Errorf("%d lookups of cached ASNs", n)
+	}
+	// Cancellation stops the warm-up midway
+	h.AsnCachePurge()
+	ctx, cancel := context.WithTimeout(context.Background(), source.delay*5/2)
+	defer cancel()
+	err = h.WarmCache(ctx, asns, 2)
+	if !errors.As(err, &warmErr) || !errors.Is(err, context.DeadlineExceeded) || warmErr.Completed == 0 || warmErr.Completed >= 16 {
+		t.Errorf("interrupted WarmCache failed with %v", err)
+	}
+}
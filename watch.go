@@ -0,0 +1,232 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// overridesWatchBackoff is the initial pause
+	// before subscribing again after a failure (see StartOverridesWatch),
+	// doubling up to overridesWatchMaxBackoff.
+	overridesWatchBackoff    = time.Second
+	overridesWatchMaxBackoff = time.Minute
+)
+
+// OverridesSubscriber spreads changes of overrides
+// among handlers, such as of several processes sharing an overrides store,
+// so that they purge their caches (see WithOverridesSubscriber).
+// Its methods are called concurrently.
+type OverridesSubscriber interface {
+	// Publish announces a change of the override of an ASN,
+	// or of any override if asn is empty.
+	Publish(ctx context.Context, asn string) error
+	// Subscribe calls fn with the ASNs of the changes announced,
+	// by any handler, including the subscriber,
+	// until ctx is done, failing with its error,
+	// or until the subscription is lost.
+	Subscribe(ctx context.Context, fn func(asn string)) error
+}
+
+// OverridesNoSubscriberError is returned by StartOverridesWatch
+// when Handler has no OverridesSubscriber (see WithOverridesSubscriber).
+var OverridesNoSubscriberError = errors.New("no overrides subscriber")
+
+// overridesWatch spreads the changes of overrides of a handler.
+type overridesWatch struct {
+	subscriber OverridesSubscriber
+	// Pauses between subscriptions after failures
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// Hooks called on changes (see OnOverrideChange)
+	mu    sync.RWMutex
+	hooks []func(asn string)
+}
+
+// newOverridesWatch returns an overridesWatch without subscriber.
+func newOverridesWatch() *overridesWatch {
+	return &overridesWatch{backoff: overridesWatchBackoff, maxBackoff: overridesWatchMaxBackoff}
+}
+
+// WithOverridesSubscriber makes the handler announce the changes
+// of its overrides (see OverridesSet) to the handlers sharing its store,
+// and purge its cache on the changes they announce (see StartOverridesWatch).
+func WithOverridesSubscriber(s OverridesSubscriber) Option {
+	return func(h *Handler) error {
+		if s == nil {
+			return OverridesNoSubscriberError
+		}
+		h.watch = newOverridesWatch()
+		h.watch.subscriber = s
+		return nil
+	}
+}
+
+// OnOverrideChange adds a function called with the ASN
+// of every change of overrides received by StartOverridesWatch,
+// or an empty ASN if any override may have changed,
+// after the cache is purged.
+func (h Handler) OnOverrideChange(fn func(asn string)) {
+	h.watch.mu.Lock()
+	defer h.watch.mu.Unlock()
+	h.watch.hooks = append(h.watch.hooks, fn)
+}
+
+// StartOverridesWatch receives the changes of overrides
+// announced by the handlers sharing the OverridesSubscriber of h,
+// including h, purging the cache (see LookupAsn)
+// of all data related to the ASNs changed,
+// and calling the functions added by OnOverrideChange.
+//
+// The watch runs until ctx is done, failing with its error,
+// or the handler is closed, failing with HandlerClosedError.
+// Lost subscriptions are renewed after a pause doubling from a second
+// up to a minute; as changes may be missed meanwhile,
+// the whole cache is purged then.
+func (h Handler) StartOverridesWatch(ctx context.Context) error {
+	w := h.watch
+	if w.subscriber == nil {
+		return OverridesNoSubscriberError
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(h.runs.ctx, func() { cancel(HandlerClosedError) })
+	defer stop()
+	if h.runs.closed.Load() {
+		return HandlerClosedError
+	}
+	backoff := w.backoff
+	for first := true; ; first = false {
+		if !first {
+			h.overridesChanged("")
+		}
+		start := time.Now()
+		err := w.subscriber.Subscribe(ctx, h.overridesChanged)
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if time.Since(start) > w.maxBackoff {
+			backoff = w.backoff
+		}
+		log.Printf("warning: overrides subscription lost: %v\n", err)
+		// Pause, with jitter
+		pause := backoff - time.Duration(rand.Int63n(int64(backoff/2)+1))
+		backoff = min(backoff*2, w.maxBackoff)
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(pause):
+		}
+	}
+}
+
+// overridesChanged purges the cache of the data related to an ASN,
+// or of all data if asn is empty,
+// and calls the hooks (see OnOverrideChange).
+func (h Handler) overridesChanged(asn string) {
+	if asn == "" {
+		h.cache.purgeAll()
+		h.prefixes.purgeAll()
+		h.names.purgeAll()
+	} else {
+		asn = normalizeASN(asn)
+		h.cache.purgeASN(asn)
+		h.prefixes.purgeASN(asn)
+		h.names.purgeASN(asn)
+	}
+	h.watch.mu.RLock()
+	hooks := h.watch.hooks
+	h.watch.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(asn)
+	}
+}
+
+// publishOverride announces a change of the override of an ASN,
+// or of any override if asn is empty,
+// if the handler has an OverridesSubscriber.
+// Failures are logged: other handlers keep their cache until it expires.
+func (h Handler) publishOverride(asn string) {
+	if h.watch.subscriber == nil {
+		return
+	}
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	if err := h.watch.subscriber.Publish(ctx, asn); err != nil {
+		log.Printf("warning: cannot publish change of override of %s: %s\n", asn, err)
+	}
+}
+
+// MemorySubscriber is an OverridesSubscriber
+// spreading changes among the handlers of a process,
+// such as handlers sharing a MemoryOverrides.
+// It is safe for concurrent use.
+type MemorySubscriber struct {
+	mu   sync.RWMutex
+	subs map[*func(string)]struct{}
+}
+
+// NewMemorySubscriber returns a MemorySubscriber without subscriptions,
+// to be passed to WithOverridesSubscriber.
+func NewMemorySubscriber() *MemorySubscriber {
+	return &MemorySubscriber{subs: make(map[*func(string)]struct{})}
+}
+
+// Publish calls the functions of every subscription with asn.
+func (m *MemorySubscriber) Publish(ctx context.Context, asn string) error {
+	m.mu.RLock()
+	fns := make([]func(string), 0, len(m.subs))
+	for fn := range m.subs {
+		fns = append(fns, *fn)
+	}
+	m.mu.RUnlock()
+	for _, fn := range fns {
+		fn(asn)
+	}
+	return nil
+}
+
+// Subscribe calls fn with the ASNs published until ctx is done.
+func (m *MemorySubscriber) Subscribe(ctx context.Context, fn func(asn string)) error {
+	m.mu.Lock()
+	m.subs[&fn] = struct{}{}
+	m.mu.Unlock()
+	<-ctx.Done()
+	m.mu.Lock()
+	delete(m.subs, &fn)
+	m.mu.Unlock()
+	return ctx.Err()
+}
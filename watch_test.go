@@ -0,0 +1,139 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakySubscriber is a MemorySubscriber
+// whose first subscriptions are lost.
+type flakySubscriber struct {
+	*MemorySubscriber
+	// Subscriptions to lose, and subscriptions made
+	failures      int32
+	subscriptions atomic.Int32
+}
+
+func (f *flakySubscriber) Subscribe(ctx context.Context, fn func(asn string)) error {
+	if f.subscriptions.Add(1) <= f.failures {
+		return errors.New("connection reset")
+	}
+	return f.MemorySubscriber.Subscribe(ctx, fn)
+}
+
+func TestOverridesWatch(t *testing.T) {
+	store := NewMemoryOverrides()
+	subscriber := &flakySubscriber{MemorySubscriber: NewMemorySubscriber(), failures: 2}
+	var handlers [2]Handler
+	for i := range handlers {
+		handlers[i] = NewFixtureHandler()
+		handlers[i].overrides = store
+		if err := WithOverridesSubscriber(subscriber)(&handlers[i]); err != nil {
+			t.Fatal(err)
+		}
+		handlers[i].watch.backoff = time.Millisecond
+	}
+	h1, h2 := handlers[0], handlers[1]
+	if err := NewFixtureHandler().StartOverridesWatch(context.Background()); err != OverridesNoSubscriberError {
+		t.Fatalf("StartOverridesWatch failed with %v without subscriber", err)
+	}
+	var mu sync.Mutex
+	var changes []string
+	h2.OnOverrideChange(func(asn string) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, asn)
+	})
+	changed := func(asn string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range changes {
+			if c == asn {
+				return true
+			}
+		}
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- h2.StartOverridesWatch(ctx)
+	}()
+	// Lost subscriptions are renewed, purging the whole cache
+	deadline := time.Now().Add(time.Second * 5)
+	for subscriber.subscriptions.Load() <= subscriber.failures || !changed("") {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscriptions after 5s", subscriber.subscriptions.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Wait for the subscription
+	for {
+		subscriber.mu.RLock()
+		n := len(subscriber.subs)
+		subscriber.mu.RUnlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The second handler picks up the changes of the first one
+	lookup := func(h Handler, descr string) {
+		t.Helper()
+		if _, d, err := h.LookupAsn("8.8.8.8"); err != nil || d != descr {
+			t.Fatalf("LookupAsn answered '%s', %v, expected '%s'", d, err, descr)
+		}
+	}
+	lookup(h2, "GOOGLE, US")
+	if err := h1.OverridesSet("as15169", "Alphabet"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	if !changed("AS15169") {
+		t.Fatalf("no change of AS15169 received, got %v", changes)
+	}
+	lookup(h2, "Alphabet")
+	if err := h1.OverridesRemove("AS15169"); err != nil {
+		t.Fatalf("OverridesRemove failed: %s", err)
+	}
+	lookup(h2, "GOOGLE, US")
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("StartOverridesWatch failed with %v", err)
+	}
+	// Changes are not received anymore
+	if err := h1.OverridesSet("AS15169", "Google"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	lookup(h2, "GOOGLE, US")
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// zoneMaxRecords is the default bound of ExportZone address records.
+const zoneMaxRecords = 1 << 20
+
+// ZoneOptions configures ExportZone.
+type ZoneOptions struct {
+	// Prefix table to export, instead of the prefix cache
+	// (see WithPrefixCache and LookupPrefixASN)
+	Prefixes []AsnInfo
+	// Prefix length of IPv4 address records: 8, 16 or 24 (the default).
+	// IPv6 address records are by /48.
+	V4Bits int
+	// Bound of the number of address records, zero for 1048576
+	MaxRecords int
+	// SOA serial number, zero for 1
+	Serial uint32
+}
+
+// ZoneTruncatedError is returned by ExportZone
+// when the address records it wrote do not cover all prefixes,
+// as bounded by ZoneOptions.MaxRecords.
+type ZoneTruncatedError struct {
+	// Number of address records written
+	Records int
+	// Number of prefixes not entirely covered
+	Prefixes int
+}
+
+func (e *ZoneTruncatedError) Error() string {
+	return fmt.Sprintf("zone truncated at %d records, missing parts of %d prefixes", e.Records, e.Prefixes)
+}
+
+// ExportZone writes a BIND zone file of TXT records
+// in the format of Team Cymru's IP to ASN service,
+// for the prefixes of the prefix cache or of opts.Prefixes.
+//
+// Besides placeholder SOA and NS records, the zone has
+// one address record per /24 (see ZoneOptions.V4Bits) or /48
+// covered by a prefix, named after its reversed octets or nibbles, as in:
+//
+//	4.8.8 IN TXT "15169 | 8.8.4.0/24 |  | arin | 2023-12-28"
+//
+// and one record per ASN of the prefixes or of the overrides collection,
+// with its (overriden) description, as in:
+//
+//	AS15169 IN TXT "15169 |  |  |  | GOOGLE, US"
+//
+// An address record is of the most specific prefix covering it entirely,
+// if any, or else of the least specific prefix within it.
+// Records are sorted by address, then ASN number.
+//
+// If the address records would exceed opts.MaxRecords,
+// the zone is written anyway, with a *ZoneTruncatedError.
+func (h Handler) ExportZone(w io.Writer, suffix string, opts ZoneOptions) error {
+	suffix = dns.Fqdn(suffix)
+	if _, ok := dns.IsDomainName(suffix); !ok || suffix == "." {
+		return fmt.Errorf("invalid zone suffix '%s'", suffix)
+	}
+	if opts.V4Bits == 0 {
+		opts.V4Bits = 24
+	}
+	if opts.V4Bits != 8 && opts.V4Bits != 16 && opts.V4Bits != 24 {
+		return fmt.Errorf("invalid IPv4 record prefix length %d", opts.V4Bits)
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = zoneMaxRecords
+	}
+	if opts.Serial == 0 {
+		opts.Serial = 1
+	}
+	table := opts.Prefixes
+	if table == nil {
+		table = h.prefixes.list()
+	}
+	overrides, err := h.OverridesList()
+	if err != nil && err != OverridesNilCollectionError {
+		return err
+	}
+	// Map records to prefixes, less specific first
+	table = append([]AsnInfo{}, table...)
+	sort.SliceStable(table, func(i, j int) bool {
+		return table[i].Prefix.Bits() < table[j].Prefix.Bits()
+	})
+	records := make(map[netip.Prefix]AsnInfo)
+	var truncated int
+	for _, info := range table {
+		if !info.Prefix.IsValid() {
+			continue
+		}
+		info.Prefix = canonicalPrefix(info.Prefix)
+		bits := 48
+		if info.Prefix.Addr().Is4() {
+			bits = opts.V4Bits
+		}
+		if !expandZonePrefix(records, info, bits, opts.MaxRecords) {
+			truncated++
+		}
+	}
+	blocks := make([]netip.Prefix, 0, len(records))
+	for p := range records {
+		blocks = append(blocks, p)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Addr().Less(blocks[j].Addr())
+	})
+	// Describe ASNs, overrides first
+	descrs := make(map[string]string)
+	for _, o := range overrides {
+		descrs[o.Asn] = o.Name
+	}
+	for _, info := range table {
+		if _, ok := descrs[info.Asn]; !ok && info.Asn != "" {
+			descrs[info.Asn] = info.Descr
+		}
+	}
+	asns := make([]string, 0, len(descrs))
+	for asn := range descrs {
+		asns = append(asns, asn)
+	}
+	sort.Slice(asns, func(i, j int) bool {
+		a, _ := strconv.ParseUint(strings.TrimPrefix(asns[i], "AS"), 10, 32)
+		b, _ := strconv.ParseUint(strings.TrimPrefix(asns[j], "AS"), 10, 32)
+		if a != b {
+			return a < b
+		}
+		return asns[i] < asns[j]
+	})
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n$TTL %d\n", suffix, int(h.prefixes.defaultTTL()/time.Second))
+	fmt.Fprintf(bw, "@ IN SOA ns hostmaster %d 3600 600 604800 3600\n", opts.Serial)
+	fmt.Fprintf(bw, "@ IN NS ns\n")
+	for _, p := range blocks {
+		info := records[p]
+		origins := strings.Join(info.Origins, " ")
+		if origins == "" {
+			origins = info.Asn
+		}
+		var allocated string
+		if !info.AllocatedAt.IsZero() {
+			allocated = info.AllocatedAt.Format("2006-01-02")
+		}
+		txt := fmt.Sprintf("%s | %s |  | %s | %s", strings.ReplaceAll(origins, "AS", ""),
+			info.Prefix, info.Registry, allocated)
+		fmt.Fprintf(bw, "%s IN TXT %s\n", zoneName(p), zoneQuote(txt))
+	}
+	for _, asn := range asns {
+		txt := fmt.Sprintf("%s |  |  |  | %s", strings.TrimPrefix(asn, "AS"), descrs[asn])
+		fmt.Fprintf(bw, "%s IN TXT %s\n", asn, zoneQuote(txt))
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("cannot write zone: %w", err)
+	}
+	if truncated > 0 {
+		return &ZoneTruncatedError{Records: len(blocks), Prefixes: truncated}
+	}
+	return nil
+}
+
+// expandZonePrefix maps to a prefix
+// the records of a given prefix length it covers,
+// overriding less specific prefixes,
+// or the record containing it, if not already mapped.
+// No more than max records are mapped.
+//
+// Returns false if records were left out.
+func expandZonePrefix(records map[netip.Prefix]AsnInfo, info AsnInfo, bits int, max int) bool {
+	p := info.Prefix
+	if p.Bits() >= bits {
+		block, _ := p.Addr().Prefix(bits)
+		if _, ok := records[block]; ok && p.Bits() > bits {
+			return true
+		}
+		if _, ok := records[block]; !ok && len(records) >= max {
+			return false
+		}
+		records[block] = info
+		return true
+	}
+	b := p.Masked().Addr().AsSlice()
+	for n := uint64(1) << uint(min(bits-p.Bits(), 63)); n > 0; n-- {
+		addr, _ := netip.AddrFromSlice(b)
+		block := netip.PrefixFrom(addr, bits)
+		if _, ok := records[block]; !ok && len(records) >= max {
+			return false
+		}
+		records[block] = info
+		// Next record, from its last octet
+		for i := bits/8 - 1; i >= 0; i-- {
+			b[i]++
+			if b[i] != 0 {
+				break
+			}
+		}
+	}
+	return true
+}
+
+// zoneName answers the name of the record of an address prefix,
+// relative to the zone:
+// its reversed octets for IPv4, or its reversed nibbles for IPv6.
+func zoneName(p netip.Prefix) string {
+	b := p.Addr().AsSlice()
+	var labels []string
+	if p.Addr().Is4() {
+		for i := p.Bits()/8 - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(b[i])))
+		}
+	} else {
+		for i := p.Bits()/4 - 1; i >= 0; i-- {
+			labels = append(labels, strconv.FormatUint(uint64(b[i/2]>>(4*uint(1-i%2))&0xf), 16))
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// zoneQuote answers a string as TXT record data,
+// split into quoted character strings of up to 255 bytes.
+func zoneQuote(s string) string {
+	var parts []string
+	for {
+		n := min(len(s), 255)
+		var b strings.Builder
+		b.WriteByte('"')
+		for i := 0; i < n; i++ {
+			switch c := s[i]; {
+			case c == '"' || c == '\\':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c < ' ' || c > '~':
+				fmt.Fprintf(&b, "\\%03d", c)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		b.WriteByte('"')
+		parts = append(parts, b.String())
+		s = s[n:]
+		if s == "" {
+			return strings.Join(parts, " ")
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// parseZone parses a zone file.
+//
+// Returns a map of relative record names to TXT record data.
+func parseZone(t *testing.T, zone string) map[string]string {
+	records := make(map[string]string)
+	zp := dns.NewZoneParser(strings.NewReader(zone), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if txt, ok := rr.(*dns.TXT); ok {
+			name := strings.TrimSuffix(txt.Hdr.Name, ".zone.example.")
+			records[name] = strings.Join(txt.Txt, "")
+		}
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatalf("invalid zone: %s\n%s", err, zone)
+	}
+	return records
+}
+
+func TestExportZone(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	allocated := time.Date(2023, 12, 28, 0, 0, 0, 0, time.UTC)
+	for _, info := range []AsnInfo{
+		{Asn: "AS15169", Descr: "GOOGLE, US", Prefix: netip.MustParsePrefix("8.8.8.0/24"), Registry: "arin", AllocatedAt: allocated},
+		{Asn: "AS15169", Descr: "GOOGLE, US", Prefix: netip.MustParsePrefix("2001:4860::/47")},
+		{Asn: "AS13335", Descr: `CLOUDFLARENET "CF", US`, Prefix: netip.MustParsePrefix("1.0.0.0/23")},
+		{Asn: "AS23969", Descr: "TOT-NET", Prefix: netip.MustParsePrefix("1.0.1.128/25"), Origins: []string{"AS23969", "AS64500"}},
+		{Asn: "AS64501", Prefix: netip.MustParsePrefix("1.0.0.0/25")},
+	} {
+		h.prefixes.store(info)
+	}
+	var buf bytes.Buffer
+	if err := h.ExportZone(&buf, "zone.example", ZoneOptions{}); err != nil {
+		t.Fatalf("ExportZone failed: %s", err)
+	}
+	expected := map[string]string{
+		"8.8.8":                   "15169 | 8.8.8.0/24 |  | arin | 2023-12-28",
+		"0.0.1":                   "13335 | 1.0.0.0/23 |  |  | ",
+		"1.0.1":                   "13335 | 1.0.0.0/23 |  |  | ",
+		"0.0.0.0.0.6.8.4.1.0.0.2": "15169 | 2001:4860::/47 |  |  | ",
+		"1.0.0.0.0.6.8.4.1.0.0.2": "15169 | 2001:4860::/47 |  |  | ",
+		// TXT data is in presentation format
+		"AS13335": `13335 |  |  |  | CLOUDFLARENET \"CF\", US`,
+		"AS15169": "15169 |  |  |  | GOOGLE, US",
+		"AS23969": "23969 |  |  |  | TOT-NET",
+		"AS64501": "64501 |  |  |  | ",
+	}
+	records := parseZone(t, buf.String())
+	if len(records) != len(expected) {
+		t.Fatalf("unexpected records %q", records)
+	}
+	for name, txt := range expected {
+		if records[name] != txt {
+			t.Fatalf("unexpected record %s: %q, expected %q", name, records[name], txt)
+		}
+	}
+	// Output is deterministic
+	var again bytes.Buffer
+	h.ExportZone(&again, "zone.example.", ZoneOptions{})
+	if again.String() != buf.String() {
+		t.Fatalf("zone changed:\n%s\n%s", buf.String(), again.String())
+	}
+}
+
+func TestExportZoneTruncated(t *testing.T) {
+	h := newHandler(nil, time.Second)
+	table := []AsnInfo{
+		{Asn: "AS3356", Prefix: netip.MustParsePrefix("4.0.0.0/9")},
+		{Asn: "AS15169", Prefix: netip.MustParsePrefix("8.8.8.0/24")},
+	}
+	var buf bytes.Buffer
+	err := h.ExportZone(&buf, "zone.example", ZoneOptions{Prefixes: table, V4Bits: 16})
+	if err != nil {
+		t.Fatalf("ExportZone failed: %s", err)
+	}
+	records := parseZone(t, buf.String())
+	if len(records) != 128+1+2 || records["127.4"] == "" || records["8.8"] == "" {
+		t.Fatalf("unexpected %d records", len(records))
+	}
+	buf.Reset()
+	// 4.0.0.0/9 leaves no room for 8.8.8.0/24
+	err = h.ExportZone(&buf, "zone.example", ZoneOptions{Prefixes: table, MaxRecords: 1000})
+	if e, ok := err.(*ZoneTruncatedError); !ok || e.Records != 1000 || e.Prefixes != 2 {
+		t.Fatalf("unexpected ExportZone error: %v", err)
+	}
+	if records := parseZone(t, buf.String()); len(records) != 1000+2 {
+		t.Fatalf("unexpected %d records", len(records))
+	}
+	for _, opts := range []ZoneOptions{{V4Bits: 20}, {V4Bits: 32}} {
+		if err := h.ExportZone(&buf, "zone.example", opts); err == nil {
+			t.Fatalf("expected an error for IPv4 records by /%d", opts.V4Bits)
+		}
+	}
+	if err := h.ExportZone(&buf, "", ZoneOptions{}); err == nil {
+		t.Fatalf("expected an error for an empty suffix")
+	}
+}